@@ -0,0 +1,190 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// brandingMOTDProfile runs the MOTD scripts on login, on distributions without
+// pam_motd running them.
+const brandingMOTDProfile = `if [ -n "$PS1" ] && [ -d /etc/update-motd.d ]; then
+    for script in /etc/update-motd.d/*; do
+        [ -x "$script" ] && "$script"
+    done
+fi
+`
+
+type branding struct {
+	common
+
+	branding shared.DefinitionFileBranding
+}
+
+func (g *branding) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+
+	if defFile.Branding == nil {
+		return
+	}
+
+	g.branding = *defFile.Branding
+
+	if !defFile.Pongo {
+		return
+	}
+
+	render := func(val string) string {
+		out, err := shared.RenderTemplate(val, def)
+		if err != nil {
+			if logger != nil {
+				logger.WithField("err", err).Warn("Failed to render template")
+			}
+
+			return val
+		}
+
+		return out
+	}
+
+	g.branding.MOTD = render(g.branding.MOTD)
+	g.branding.Issue = render(g.branding.Issue)
+
+	g.branding.MOTDScripts = make(map[string]string, len(defFile.Branding.MOTDScripts))
+	for name, script := range defFile.Branding.MOTDScripts {
+		g.branding.MOTDScripts[name] = render(script)
+	}
+
+	g.branding.OSRelease = make(map[string]string, len(defFile.Branding.OSRelease))
+	for key, value := range defFile.Branding.OSRelease {
+		g.branding.OSRelease[key] = render(value)
+	}
+}
+
+// RunLXC brands the image.
+func (g *branding) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD brands the image.
+func (g *branding) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run writes /etc/motd and /etc/issue, installs the MOTD scripts into
+// /etc/update-motd.d, and overrides the fields of /etc/os-release.
+func (g *branding) Run() error {
+	if g.defFile.Branding == nil {
+		return errors.New("Missing branding configuration")
+	}
+
+	for path, content := range map[string]string{"etc/motd": g.branding.MOTD, "etc/issue": g.branding.Issue} {
+		if content == "" {
+			continue
+		}
+
+		err := g.writeFile(path, content, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(g.branding.MOTDScripts) > 0 {
+		// Only pam_motd of Debian and Ubuntu runs the scripts.
+		if !lxdShared.PathExists(filepath.Join(g.sourceDir, "etc/update-motd.d")) {
+			err := g.writeFile("etc/profile.d/update-motd.sh", brandingMOTDProfile, 0644)
+			if err != nil {
+				return err
+			}
+		}
+
+		for name, script := range g.branding.MOTDScripts {
+			err := g.writeFile(filepath.Join("etc/update-motd.d", name), script, 0755)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(g.branding.OSRelease) == 0 {
+		return nil
+	}
+
+	path, err := g.osReleasePath()
+	if err != nil {
+		return err
+	}
+
+	keys := shared.MapKeys(g.branding.OSRelease)
+	slices.Sort(keys)
+
+	vars := make([]string, 0, len(keys)*2)
+	for _, key := range keys {
+		vars = append(vars, key, g.branding.OSRelease[key])
+	}
+
+	return setShellVars(path, true, vars)
+}
+
+// osReleasePath returns the path of the os-release file of the rootfs.
+// /etc/os-release is usually a symlink to /usr/lib/os-release, which is
+// resolved inside of the rootfs.
+func (g *branding) osReleasePath() (string, error) {
+	path := filepath.Join(g.sourceDir, "etc/os-release")
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && lxdShared.PathExists(filepath.Join(g.sourceDir, "usr/lib/os-release")) {
+			return filepath.Join(g.sourceDir, "usr/lib/os-release"), nil
+		}
+
+		return path, nil
+	}
+
+	if !filepath.IsAbs(target) {
+		target = filepath.Join("/etc", target)
+	}
+
+	if !strings.HasPrefix(filepath.Clean(target), "/usr/") && !strings.HasPrefix(filepath.Clean(target), "/etc/") {
+		return "", fmt.Errorf("Unexpected target %q of /etc/os-release", target)
+	}
+
+	return filepath.Join(g.sourceDir, target), nil
+}
+
+// writeFile writes the content to the file inside of the rootfs, with a final
+// new line.
+func (g *branding) writeFile(path string, content string, mode os.FileMode) error {
+	path = filepath.Join(g.sourceDir, path)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+
+	err = os.WriteFile(path, []byte(content), mode)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", path, err)
+	}
+
+	// The mode of existing files isn't changed by os.WriteFile.
+	err = os.Chmod(path, mode)
+	if err != nil {
+		return fmt.Errorf("Failed to set permissions of %q: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestBrandingGeneratorRun(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"etc/update-motd.d", "usr/lib"} {
+		err := os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "usr/lib/os-release"), "PRETTY_NAME=\"Ubuntu 24.04 LTS\"\nNAME=\"Ubuntu\"\n")
+
+	err = os.Symlink("../usr/lib/os-release", filepath.Join(rootfsDir, "etc/os-release"))
+	require.NoError(t, err)
+
+	generator, err := Load("branding", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator: "branding",
+		Pongo:     true,
+		Branding: &shared.DefinitionFileBranding{
+			MOTD:        "Welcome to Corp Linux",
+			MOTDScripts: map[string]string{"10-corp": "#!/bin/sh\necho 'Managed by Corp IT'"},
+			Issue:       "Corp Linux {{ image.release }} \\n \\l",
+			OSRelease:   map[string]string{"PRETTY_NAME": "Corp Linux {{ image.release }}", "BUILD_ID": "{{ image.serial }}"},
+		},
+	}, shared.Definition{Image: shared.DefinitionImage{Release: "noble", Serial: "20240301_0000"}})
+	require.IsType(t, &branding{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/motd"), "Welcome to Corp Linux\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/issue"), "Corp Linux noble \\n \\l\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/update-motd.d/10-corp"), "#!/bin/sh\necho 'Managed by Corp IT'\n")
+
+	info, err := os.Stat(filepath.Join(rootfsDir, "etc/update-motd.d/10-corp"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	// The symlink is kept, and its target is updated.
+	validateTestFile(t, filepath.Join(rootfsDir, "usr/lib/os-release"), "PRETTY_NAME=\"Corp Linux noble\"\nNAME=\"Ubuntu\"\nBUILD_ID=\"20240301_0000\"\n")
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/profile.d/update-motd.sh"))
+}
+
+func TestBrandingGeneratorRunWithoutUpdateMOTD(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/os-release"), "NAME=\"Alpine Linux\"\n")
+
+	generator, err := Load("branding", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator: "branding",
+		Branding: &shared.DefinitionFileBranding{
+			MOTDScripts: map[string]string{"10-corp": "#!/bin/sh\necho 'Managed by Corp IT'\n"},
+			OSRelease:   map[string]string{"VARIANT": "{{ image.variant }}"},
+		},
+	}, shared.Definition{Image: shared.DefinitionImage{Variant: "cloud"}})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	// Without pongo, the values are kept as they are.
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/os-release"), "NAME=\"Alpine Linux\"\nVARIANT=\"{{ image.variant }}\"\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/profile.d/update-motd.sh"), brandingMOTDProfile)
+	require.FileExists(t, filepath.Join(rootfsDir, "etc/update-motd.d/10-corp"))
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/motd"))
+}
@@ -0,0 +1,77 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// datedGenerator sets the modification time of the files written by a
+// generator to the build date, if it was set using --build-date.
+type datedGenerator struct {
+	Generator
+
+	path string
+}
+
+// RunLXC runs the generator for LXC images.
+func (g *datedGenerator) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	err := g.Generator.RunLXC(img, target)
+	if err != nil {
+		return err
+	}
+
+	return g.setTimes()
+}
+
+// RunLXD runs the generator for LXD images.
+func (g *datedGenerator) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	err := g.Generator.RunLXD(img, target)
+	if err != nil {
+		return err
+	}
+
+	return g.setTimes()
+}
+
+// Run runs the generator.
+func (g *datedGenerator) Run() error {
+	err := g.Generator.Run()
+	if err != nil {
+		return err
+	}
+
+	return g.setTimes()
+}
+
+// setTimes sets the modification time of the path of the generator, and of
+// everything below it for directories. It's a no-op if the generator removed
+// the path.
+func (g *datedGenerator) setTimes() error {
+	date := unix.NsecToTimespec(shared.BuildDate().UnixNano())
+
+	err := filepath.WalkDir(g.path, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Symlinks are dated themselves instead of their targets.
+		err = unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{date, date}, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return fmt.Errorf("Failed to set modification time of %q: %w", path, err)
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
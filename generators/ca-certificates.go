@@ -0,0 +1,135 @@
+package generators
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// caTrustStores are the trust stores of the distributions, in the order they
+// are detected. Each is detected by a directory of its package, and gets the
+// certificates in the anchors directory. The command rebuilds the bundles.
+var caTrustStores = []struct {
+	dir     string
+	anchors string
+	command []string
+}{
+	// openSUSE
+	{"etc/pki/trust", "etc/pki/trust/anchors", []string{"update-ca-certificates"}},
+	// Fedora, CentOS, AlmaLinux, Rocky Linux and Oracle Linux
+	{"etc/pki/ca-trust", "etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}},
+	// Arch Linux
+	{"etc/ca-certificates/trust-source", "etc/ca-certificates/trust-source/anchors", []string{"update-ca-trust"}},
+	// Debian, Ubuntu, Alpine Linux, Gentoo and Void Linux
+	{"usr/share/ca-certificates", "usr/local/share/ca-certificates", []string{"update-ca-certificates"}},
+}
+
+type caCertificates struct {
+	common
+
+	definition shared.Definition
+}
+
+func (g *caCertificates) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+	g.definition = def
+}
+
+// RunLXC installs the CA certificates.
+func (g *caCertificates) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD installs the CA certificates.
+func (g *caCertificates) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run installs the CA certificates into the trust store of the rootfs, and
+// rebuilds its bundles. The certificates are taken from content, or the source
+// file on the build host.
+func (g *caCertificates) Run() error {
+	anchorsDir, command, err := g.findTrustStore()
+	if err != nil {
+		return err
+	}
+
+	files, err := g.certificateFiles()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(g.sourceDir, anchorsDir)
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", dir, err)
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+
+		err := os.WriteFile(path, content, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write file %q: %w", path, err)
+		}
+	}
+
+	return runInChroot(g.sourceDir, g.definition, command[0], command[1:]...)
+}
+
+// findTrustStore returns the anchors directory of the trust store in the
+// rootfs, and the command rebuilding its bundles.
+func (g *caCertificates) findTrustStore() (string, []string, error) {
+	for _, store := range caTrustStores {
+		if lxdShared.PathExists(filepath.Join(g.sourceDir, store.dir)) {
+			return store.anchors, store.command, nil
+		}
+	}
+
+	return "", nil, errors.New("Failed to detect the CA trust store of the rootfs, the ca-certificates package needs to be installed")
+}
+
+// certificateFiles returns the files the certificates are installed as. Some
+// trust stores only use the first certificate of a file, so each certificate
+// gets a file of its own, which is numbered if there are several.
+func (g *caCertificates) certificateFiles() (map[string][]byte, error) {
+	content := []byte(g.defFile.Content)
+
+	if g.defFile.Source != "" {
+		var err error
+
+		content, err = os.ReadFile(g.defFile.Source)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %q: %w", g.defFile.Source, err)
+		}
+	}
+
+	certs, err := shared.ParsePEMCertificates(content)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid certificates %q: %w", g.defFile.Name, err)
+	}
+
+	files := make(map[string][]byte, len(certs))
+	base := strings.TrimSuffix(g.defFile.Name, ".crt")
+
+	for i, cert := range certs {
+		name := base + ".crt"
+		if len(certs) > 1 {
+			name = fmt.Sprintf("%s-%d.crt", base, i+1)
+		}
+
+		files[name] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	return files, nil
+}
@@ -0,0 +1,270 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// consoleKeymapDirs and consoleFontDirs are searched for console keymaps and
+// fonts inside of the rootfs.
+var (
+	consoleKeymapDirs = []string{"usr/share/keymaps", "usr/share/kbd/keymaps", "usr/lib/kbd/keymaps"}
+	consoleFontDirs   = []string{"usr/share/consolefonts", "usr/share/kbd/consolefonts", "usr/lib/kbd/consolefonts"}
+)
+
+type console struct {
+	common
+}
+
+// RunLXC configures the console keymap and font.
+func (g *console) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD configures the console keymap and font.
+func (g *console) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run configures the console keymap and font, and the keyboard layout. The
+// files written depend on the init system and distribution of the rootfs.
+func (g *console) Run() error {
+	c := g.defFile.Console
+	if c == nil {
+		return errors.New("Missing console configuration")
+	}
+
+	err := g.checkNames(*c)
+	if err != nil {
+		return err
+	}
+
+	configured := false
+
+	// systemd-vconsole-setup
+	if g.exists("usr/lib/systemd/systemd") || g.exists("lib/systemd/systemd") {
+		err := setShellVars(filepath.Join(g.sourceDir, "etc/vconsole.conf"), false, []string{
+			"KEYMAP", c.Keymap,
+			"FONT", c.Font,
+			"XKBLAYOUT", c.Layout,
+			"XKBMODEL", c.Model,
+			"XKBVARIANT", c.Variant,
+			"XKBOPTIONS", c.Options,
+		})
+		if err != nil {
+			return err
+		}
+
+		configured = true
+	}
+
+	// keyboard-configuration and console-setup on Debian based distributions
+	if g.exists("etc/debian_version") {
+		if c.Layout != "" {
+			err := setShellVars(filepath.Join(g.sourceDir, "etc/default/keyboard"), true, []string{
+				"XKBMODEL", c.Model,
+				"XKBLAYOUT", c.Layout,
+				"XKBVARIANT", c.Variant,
+				"XKBOPTIONS", c.Options,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.Font != "" {
+			err := setShellVars(filepath.Join(g.sourceDir, "etc/default/console-setup"), true, []string{"FONT", c.Font})
+			if err != nil {
+				return err
+			}
+		}
+
+		configured = true
+	}
+
+	// OpenRC keymaps and consolefont services
+	if g.exists("etc/init.d/keymaps") || g.exists("etc/init.d/consolefont") {
+		if c.Keymap != "" {
+			err := setShellVars(filepath.Join(g.sourceDir, "etc/conf.d/keymaps"), true, []string{"keymap", c.Keymap})
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.Font != "" {
+			err := setShellVars(filepath.Join(g.sourceDir, "etc/conf.d/consolefont"), true, []string{"consolefont", c.Font})
+			if err != nil {
+				return err
+			}
+		}
+
+		configured = true
+	}
+
+	if !configured {
+		return errors.New("Failed to detect how the console is configured in the rootfs")
+	}
+
+	return nil
+}
+
+// checkNames checks that the keymap, font and layouts exist in the rootfs. A
+// name is only checked if the rootfs contains any keymaps, fonts or layouts
+// respectively, as they may be installed later.
+func (g *console) checkNames(c shared.DefinitionFileConsole) error {
+	if c.Keymap != "" {
+		found, searched, err := g.findFile(consoleKeymapDirs, c.Keymap, []string{".map", ".kmap"})
+		if err != nil {
+			return err
+		}
+
+		if searched && !found {
+			return fmt.Errorf("Keymap %q not found", c.Keymap)
+		}
+	}
+
+	if c.Font != "" {
+		found, searched, err := g.findFile(consoleFontDirs, c.Font, []string{".psf", ".psfu", ".fnt", ""})
+		if err != nil {
+			return err
+		}
+
+		if searched && !found {
+			return fmt.Errorf("Console font %q not found", c.Font)
+		}
+	}
+
+	symbolsDir := filepath.Join(g.sourceDir, "usr/share/X11/xkb/symbols")
+
+	if c.Layout != "" && lxdShared.PathExists(symbolsDir) {
+		for _, layout := range strings.Split(c.Layout, ",") {
+			if !lxdShared.PathExists(filepath.Join(symbolsDir, layout)) {
+				return fmt.Errorf("Keyboard layout %q not found", layout)
+			}
+		}
+	}
+
+	return nil
+}
+
+// findFile looks for a file called name with one of the extensions, possibly
+// compressed, in the given directories of the rootfs. It also returns whether
+// any of the directories exist.
+func (g *console) findFile(dirs []string, name string, extensions []string) (bool, bool, error) {
+	compressed := regexp.MustCompile(`\.(gz|bz2|xz|zst)$`)
+	searched := false
+
+	for _, dir := range dirs {
+		root := filepath.Join(g.sourceDir, dir)
+
+		if !lxdShared.PathExists(root) {
+			continue
+		}
+
+		searched = true
+		found := false
+
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if d.IsDir() {
+				return nil
+			}
+
+			base := compressed.ReplaceAllString(d.Name(), "")
+
+			for _, ext := range extensions {
+				if base == name+ext {
+					found = true
+					return filepath.SkipAll
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return false, searched, fmt.Errorf("Failed to search %q: %w", root, err)
+		}
+
+		if found {
+			return true, searched, nil
+		}
+	}
+
+	return false, searched, nil
+}
+
+// setShellVars sets the given variables in a shell style configuration file,
+// keeping any other lines. Variables with an empty value are left as they are.
+// The values are quoted if quote is true.
+func setShellVars(path string, quote bool, vars []string) error {
+	var lines []string
+
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+
+	for i := 0; i < len(vars); i += 2 {
+		key, value := vars[i], vars[i+1]
+
+		if value == "" {
+			continue
+		}
+
+		if quote {
+			value = fmt.Sprintf("%q", value)
+		}
+
+		var out []string
+
+		replaced := false
+
+		for _, line := range lines {
+			if !strings.HasPrefix(strings.TrimSpace(line), key+"=") {
+				out = append(out, line)
+				continue
+			}
+
+			if !replaced {
+				out = append(out, key+"="+value)
+			}
+
+			replaced = true
+		}
+
+		if !replaced {
+			out = append(out, key+"="+value)
+		}
+
+		lines = out
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	err = os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestConsoleGeneratorRun(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"usr/lib/systemd", "etc/default", "usr/share/keymaps/i386/qwertz", "usr/share/consolefonts", "usr/share/X11/xkb/symbols"} {
+		err = os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "usr/lib/systemd/systemd"), "")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/debian_version"), "12.5")
+	createTestFile(t, filepath.Join(rootfsDir, "usr/share/keymaps/i386/qwertz/de-latin1.map.gz"), "")
+	createTestFile(t, filepath.Join(rootfsDir, "usr/share/consolefonts/Lat15-Terminus16.psf.gz"), "")
+	createTestFile(t, filepath.Join(rootfsDir, "usr/share/X11/xkb/symbols/de"), "")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/default/keyboard"), "XKBMODEL=\"pc105\"\nXKBLAYOUT=\"us\"\nBACKSPACE=\"guess\"")
+
+	defFile := shared.DefinitionFile{
+		Generator: "console",
+		Console: &shared.DefinitionFileConsole{
+			Keymap:  "de-latin1",
+			Font:    "Lat15-Terminus16",
+			Layout:  "de",
+			Variant: "nodeadkeys",
+		},
+	}
+
+	generator, err := Load("console", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.IsType(t, &console{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/vconsole.conf"), "KEYMAP=de-latin1\nFONT=Lat15-Terminus16\nXKBLAYOUT=de\nXKBVARIANT=nodeadkeys\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/default/keyboard"), "XKBMODEL=\"pc105\"\nXKBLAYOUT=\"de\"\nBACKSPACE=\"guess\"\nXKBVARIANT=\"nodeadkeys\"\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/default/console-setup"), "FONT=\"Lat15-Terminus16\"\n")
+
+	// Names which don't exist in the rootfs are rejected.
+	for _, c := range []shared.DefinitionFileConsole{
+		{Keymap: "fr"},
+		{Font: "Terminus32"},
+		{Layout: "de,fr"},
+	} {
+		defFile.Console = &c
+
+		generator, err := Load("console", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+		require.NoError(t, err)
+
+		err = generator.Run()
+		require.Error(t, err)
+	}
+}
+
+func TestConsoleGeneratorRunOpenRC(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc/init.d"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/init.d/keymaps"), "")
+
+	defFile := shared.DefinitionFile{
+		Generator: "console",
+		Console:   &shared.DefinitionFileConsole{Keymap: "de-latin1", Font: "ter-v16n"},
+	}
+
+	generator, err := Load("console", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/conf.d/keymaps"), "keymap=\"de-latin1\"\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/conf.d/consolefont"), "consolefont=\"ter-v16n\"\n")
+
+	// Without any known init system the console can't be configured.
+	err = os.Remove(filepath.Join(rootfsDir, "etc/init.d/keymaps"))
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.Error(t, err)
+}
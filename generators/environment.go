@@ -0,0 +1,140 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// environmentProfilePath is the default path of the profile script.
+const environmentProfilePath = "/etc/profile.d/environment.sh"
+
+type environment struct {
+	common
+}
+
+// RunLXC sets the environment variables.
+func (g *environment) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD sets the environment variables.
+func (g *environment) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run sets the environment variables in /etc/environment, which is read by
+// pam_env, and exports them in a profile script for shells on distributions
+// without PAM. PATH additions are only made by the profile script, unless
+// /etc/environment sets PATH already.
+func (g *environment) Run() error {
+	e := g.defFile.Environment
+	if e == nil {
+		return errors.New("Missing environment configuration")
+	}
+
+	keys := make([]string, 0, len(e.Variables))
+	for key := range e.Variables {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	err := g.setEnvironment(keys, e.Variables, e.Path)
+	if err != nil {
+		return err
+	}
+
+	path := g.defFile.Path
+	if path == "" {
+		path = environmentProfilePath
+	}
+
+	path = filepath.Join(g.sourceDir, path)
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	err = os.WriteFile(path, []byte(renderEnvironmentProfile(keys, e.Variables, e.Path)), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// setEnvironment sets the variables in /etc/environment, and adds the
+// directories to its PATH if it's set.
+func (g *environment) setEnvironment(keys []string, variables map[string]string, dirs []string) error {
+	path := filepath.Join(g.sourceDir, "etc/environment")
+
+	vars := []string{}
+
+	// pam_env strips the double quotes, and doesn't expand anything inside of
+	// them.
+	for _, key := range keys {
+		vars = append(vars, key, fmt.Sprintf(`"%s"`, variables[key]))
+	}
+
+	if len(dirs) > 0 {
+		content, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Failed to read %q: %w", path, err)
+		}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			value, found := strings.CutPrefix(strings.TrimSpace(line), "PATH=")
+			if !found {
+				continue
+			}
+
+			current := strings.Split(strings.Trim(value, `"'`), ":")
+
+			for _, dir := range dirs {
+				if !slices.Contains(current, dir) {
+					current = append(current, dir)
+				}
+			}
+
+			vars = append(vars, "PATH", fmt.Sprintf(`"%s"`, strings.Join(current, ":")))
+
+			break
+		}
+	}
+
+	if len(vars) == 0 {
+		return nil
+	}
+
+	return setShellVars(path, false, vars)
+}
+
+// renderEnvironmentProfile returns a profile script exporting the variables
+// and adding the directories to PATH once. The values are single-quoted, so
+// the shell doesn't expand them.
+func renderEnvironmentProfile(keys []string, variables map[string]string, dirs []string) string {
+	var sb strings.Builder
+
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "export %s='%s'\n", key, strings.ReplaceAll(variables[key], "'", `'\''`))
+	}
+
+	for _, dir := range dirs {
+		fmt.Fprintf(&sb, "case \":$PATH:\" in\n    *:%s:*) ;;\n    *) PATH=\"$PATH:%s\" ;;\nesac\n", dir, dir)
+	}
+
+	if len(dirs) > 0 {
+		sb.WriteString("export PATH\n")
+	}
+
+	return sb.String()
+}
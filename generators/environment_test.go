@@ -0,0 +1,101 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestEnvironmentGeneratorRun(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/environment"), "PATH=\"/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin\"\n")
+
+	defFile := shared.DefinitionFile{
+		Generator: "environment",
+		Environment: &shared.DefinitionFileEnvironment{
+			Variables: map[string]string{
+				"no_proxy":   "localhost,127.0.0.1",
+				"http_proxy": "http://proxy.example.com:3128",
+				"GREETING":   "it's $HOME",
+			},
+			Path: []string{"/opt/bin", "/usr/bin"},
+		},
+	}
+
+	generator, err := Load("environment", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.IsType(t, &environment{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/environment"), `PATH="/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/opt/bin"
+GREETING="it's $HOME"
+http_proxy="http://proxy.example.com:3128"
+no_proxy="localhost,127.0.0.1"
+`)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/profile.d/environment.sh"), `export GREETING='it'\''s $HOME'
+export http_proxy='http://proxy.example.com:3128'
+export no_proxy='localhost,127.0.0.1'
+case ":$PATH:" in
+    *:/opt/bin:*) ;;
+    *) PATH="$PATH:/opt/bin" ;;
+esac
+case ":$PATH:" in
+    *:/usr/bin:*) ;;
+    *) PATH="$PATH:/usr/bin" ;;
+esac
+export PATH
+`)
+
+	// Running the generator again doesn't add the directories twice.
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/environment"), `PATH="/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/opt/bin"
+GREETING="it's $HOME"
+http_proxy="http://proxy.example.com:3128"
+no_proxy="localhost,127.0.0.1"
+`)
+}
+
+func TestEnvironmentGeneratorRunWithoutPath(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	defFile := shared.DefinitionFile{
+		Generator:   "environment",
+		Path:        "/etc/profile.d/proxy.sh",
+		Environment: &shared.DefinitionFileEnvironment{Path: []string{"/opt/bin"}},
+	}
+
+	generator, err := Load("environment", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	// /etc/environment doesn't set PATH, so only the profile script adds to it.
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/environment"))
+	require.FileExists(t, filepath.Join(rootfsDir, "etc/profile.d/proxy.sh"))
+}
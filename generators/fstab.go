@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/canonical/lxd-imagebuilder/image"
 	"github.com/canonical/lxd-imagebuilder/shared"
@@ -28,9 +30,7 @@ func (g *fstab) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) e
 
 	defer f.Close()
 
-	content := `LABEL=rootfs  /         %s  %s  0 0
-LABEL=UEFI    /boot/efi vfat  defaults  0 0
-`
+	var content string
 
 	fs := target.VM.Filesystem
 
@@ -38,13 +38,70 @@ LABEL=UEFI    /boot/efi vfat  defaults  0 0
 		fs = "ext4"
 	}
 
-	options := "defaults"
+	switch fs {
+	case "btrfs":
+		subvolumes := slices.Clone(target.VM.GetBtrfsSubvolumes())
 
-	if fs == "btrfs" {
-		options = fmt.Sprintf("%s,subvol=@", options)
+		// The root subvolume needs to come first, and parent mountpoints need
+		// to come before their children.
+		slices.SortStableFunc(subvolumes, func(a, b shared.DefinitionTargetLXDVMBtrfsSubvolume) int {
+			return strings.Compare(a.Mountpoint, b.Mountpoint)
+		})
+
+		for _, subvolume := range subvolumes {
+			if subvolume.Mountpoint == "" {
+				continue
+			}
+
+			var options []string
+
+			if target.VM.Btrfs != nil {
+				options = append(options, target.VM.Btrfs.MountOptions...)
+			}
+
+			options = append(options, subvolume.Options...)
+
+			if len(options) == 0 {
+				options = []string{"defaults"}
+			}
+
+			content += fmt.Sprintf("LABEL=rootfs  %-9s %s  %s,subvol=%s  0 0\n", subvolume.Mountpoint, fs, strings.Join(options, ","), subvolume.Name)
+		}
+	case "f2fs":
+		content = fmt.Sprintf("LABEL=rootfs  /         %s  defaults,noatime  0 0\n", fs)
+	case "zfs":
+		// ZFS datasets are mounted by ZFS itself.
+	default:
+		content = fmt.Sprintf("LABEL=rootfs  /         %s  defaults  0 0\n", fs)
+	}
+
+	espLabel := target.VM.ESP.Label
+
+	if espLabel == "" {
+		espLabel = "UEFI"
+	}
+
+	espOptions := "defaults"
+
+	// The root image of the boot artifacts is booted without the EFI system
+	// partition.
+	if target.VM.BootArtifacts != nil && target.VM.BootArtifacts.RootImage {
+		espOptions = "nofail"
+	}
+
+	content += fmt.Sprintf("%-13s /boot/efi vfat  %-8s  0 0\n", fmt.Sprintf("LABEL=%s", espLabel), espOptions)
+
+	lvm := target.VM.LVM
+
+	if lvm != nil && lvm.SwapSize > 0 {
+		content += "LABEL=swap    none      swap  sw        0 0\n"
+	}
+
+	if lvm != nil && lvm.DataSize > 0 {
+		content += fmt.Sprintf("LABEL=data    %s  ext4  defaults  0 2\n", lvm.DataMountpoint)
 	}
 
-	_, err = f.WriteString(fmt.Sprintf(content, fs, options))
+	_, err = f.WriteString(content)
 	if err != nil {
 		return fmt.Errorf("Failed to write string to file %q: %w", filepath.Join(g.sourceDir, "etc/fstab"), err)
 	}
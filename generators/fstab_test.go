@@ -0,0 +1,141 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestFstabGeneratorRunLXD(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	generator, err := Load("fstab", nil, cacheDir, rootfsDir, shared.DefinitionFile{}, shared.Definition{})
+	require.IsType(t, &fstab{}, generator)
+	require.NoError(t, err)
+
+	err = generator.RunLXD(nil, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc", "fstab"), `LABEL=rootfs  /         ext4  defaults  0 0
+LABEL=UEFI    /boot/efi vfat  defaults  0 0
+`)
+
+	err = generator.RunLXD(nil, shared.DefinitionTargetLXD{
+		VM: shared.DefinitionTargetLXDVM{
+			BootArtifacts: &shared.DefinitionTargetLXDVMBootArtifacts{RootImage: true},
+		},
+	})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc", "fstab"), `LABEL=rootfs  /         ext4  defaults  0 0
+LABEL=UEFI    /boot/efi vfat  nofail    0 0
+`)
+
+	err = generator.RunLXD(nil, shared.DefinitionTargetLXD{
+		VM: shared.DefinitionTargetLXDVM{
+			Filesystem: "btrfs",
+			LVM: &shared.DefinitionTargetLXDVMLVM{
+				SwapSize:       1024,
+				DataSize:       1024,
+				DataMountpoint: "/srv",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc", "fstab"), `LABEL=rootfs  /         btrfs  defaults,subvol=@  0 0
+LABEL=UEFI    /boot/efi vfat  defaults  0 0
+LABEL=swap    none      swap  sw        0 0
+LABEL=data    /srv  ext4  defaults  0 2
+`)
+
+	err = generator.RunLXD(nil, shared.DefinitionTargetLXD{
+		VM: shared.DefinitionTargetLXDVM{
+			Filesystem: "btrfs",
+			Btrfs: &shared.DefinitionTargetLXDVMBtrfs{
+				Subvolumes: []shared.DefinitionTargetLXDVMBtrfsSubvolume{
+					{Name: "@", Mountpoint: "/", Options: []string{"compress=zstd", "noatime"}},
+					{Name: "@snapshots", Mountpoint: "/.snapshots"},
+					{Name: "@var_log", Mountpoint: "/var/log"},
+					{Name: "@var", Mountpoint: "/var"},
+					{Name: "@home", Mountpoint: "/home"},
+					{Name: "@unmounted"},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc", "fstab"), `LABEL=rootfs  /         btrfs  compress=zstd,noatime,subvol=@  0 0
+LABEL=rootfs  /.snapshots btrfs  defaults,subvol=@snapshots  0 0
+LABEL=rootfs  /home     btrfs  defaults,subvol=@home  0 0
+LABEL=rootfs  /var      btrfs  defaults,subvol=@var  0 0
+LABEL=rootfs  /var/log  btrfs  defaults,subvol=@var_log  0 0
+LABEL=UEFI    /boot/efi vfat  defaults  0 0
+`)
+
+	err = generator.RunLXD(nil, shared.DefinitionTargetLXD{
+		VM: shared.DefinitionTargetLXDVM{
+			Filesystem: "btrfs",
+			Btrfs: &shared.DefinitionTargetLXDVMBtrfs{
+				MountOptions: []string{"compress=zstd:3", "noatime", "space_cache=v2"},
+				Subvolumes: []shared.DefinitionTargetLXDVMBtrfsSubvolume{
+					{Name: "@", Mountpoint: "/"},
+					{Name: "@var", Mountpoint: "/var", Options: []string{"nodatacow"}},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc", "fstab"), `LABEL=rootfs  /         btrfs  compress=zstd:3,noatime,space_cache=v2,subvol=@  0 0
+LABEL=rootfs  /var      btrfs  compress=zstd:3,noatime,space_cache=v2,nodatacow,subvol=@var  0 0
+LABEL=UEFI    /boot/efi vfat  defaults  0 0
+`)
+
+	err = generator.RunLXD(nil, shared.DefinitionTargetLXD{
+		VM: shared.DefinitionTargetLXDVM{
+			Filesystem: "f2fs",
+		},
+	})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc", "fstab"), `LABEL=rootfs  /         f2fs  defaults,noatime  0 0
+LABEL=UEFI    /boot/efi vfat  defaults  0 0
+`)
+
+	err = generator.RunLXD(nil, shared.DefinitionTargetLXD{
+		VM: shared.DefinitionTargetLXDVM{
+			Filesystem: "zfs",
+		},
+	})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc", "fstab"), "LABEL=UEFI    /boot/efi vfat  defaults  0 0\n")
+
+	err = generator.RunLXD(nil, shared.DefinitionTargetLXD{
+		VM: shared.DefinitionTargetLXDVM{
+			ESP: shared.DefinitionTargetLXDVMESP{
+				Label: "ESP",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc", "fstab"), `LABEL=rootfs  /         ext4  defaults  0 0
+LABEL=ESP     /boot/efi vfat  defaults  0 0
+`)
+}
@@ -2,10 +2,12 @@ package generators
 
 import (
 	"errors"
+	"path/filepath"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/plugins"
 	"github.com/canonical/lxd-imagebuilder/shared"
 )
 
@@ -29,27 +31,65 @@ type Generator interface {
 }
 
 var generators = map[string]func() generator{
-	"cloud-init": func() generator { return &cloudInit{} },
-	"copy":       func() generator { return &copy{} },
-	"dump":       func() generator { return &dump{} },
-	"fstab":      func() generator { return &fstab{} },
-	"hostname":   func() generator { return &hostname{} },
-	"hosts":      func() generator { return &hosts{} },
-	"lxd-agent":  func() generator { return &lxdAgent{} },
-	"remove":     func() generator { return &remove{} },
-	"template":   func() generator { return &template{} },
+	"branding":        func() generator { return &branding{} },
+	"ca-certificates": func() generator { return &caCertificates{} },
+	"cloud-init":      func() generator { return &cloudInit{} },
+	"console":         func() generator { return &console{} },
+	"copy":            func() generator { return &copy{} },
+	"dump":            func() generator { return &dump{} },
+	"environment":     func() generator { return &environment{} },
+	"fstab":           func() generator { return &fstab{} },
+	"hostname":        func() generator { return &hostname{} },
+	"hosts":           func() generator { return &hosts{} },
+	"kernel-modules":  func() generator { return &kernelModules{} },
+	"locale":          func() generator { return &locale{} },
+	"lxd-agent":       func() generator { return &lxdAgent{} },
+	"machine-id":      func() generator { return &machineID{} },
+	"network":         func() generator { return &network{} },
+	"proxy":           func() generator { return &proxy{} },
+	"remove":          func() generator { return &remove{} },
+	"repositories":    func() generator { return &repositories{} },
+	"resolv":          func() generator { return &resolv{} },
+	"selinux-relabel": func() generator { return &selinuxRelabel{} },
+	"ssh-host-keys":   func() generator { return &sshHostKeys{} },
+	"swapfile":        func() generator { return &swapfile{} },
+	"sysctl":          func() generator { return &sysctl{} },
+	"systemd-unit":    func() generator { return &systemdUnit{} },
+	"template":        func() generator { return &template{} },
+	"tmpfiles":        func() generator { return &tmpfiles{} },
+	"users":           func() generator { return &users{} },
 }
 
 // Load loads and initializes a generator.
 func Load(generatorName string, logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) (Generator, error) {
+	var d generator
+
 	df, ok := generators[generatorName]
-	if !ok {
-		return nil, ErrUnknownGenerator
-	}
+	if ok {
+		d = df()
+	} else {
+		p := def.GetPlugin(plugins.TypeGenerator, generatorName)
+		if p == nil {
+			return nil, ErrUnknownGenerator
+		}
 
-	d := df()
+		d = &plugin{plugin: *p}
+	}
 
 	d.init(logger, cacheDir, sourceDir, defFile, def)
 
-	return d, nil
+	if !shared.HasBuildDate() || defFile.Path == "" {
+		return d, nil
+	}
+
+	path := defFile.Path
+
+	if defFile.Pongo {
+		rendered, err := shared.RenderTemplate(path, def)
+		if err == nil {
+			path = rendered
+		}
+	}
+
+	return &datedGenerator{Generator: d, path: filepath.Join(sourceDir, path)}, nil
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -52,3 +53,33 @@ func validateTestFile(t *testing.T, path, content string) {
 
 	require.Equal(t, content, buffer.String())
 }
+
+func TestLoadBuildDate(t *testing.T) {
+	rootfsDir := t.TempDir()
+	date := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	shared.SetBuildDate(date)
+	defer shared.SetBuildDate(time.Time{})
+
+	generator, err := Load("dump", nil, "", rootfsDir, shared.DefinitionFile{
+		Path:    "/etc/{{ image.release }}",
+		Content: "hello",
+		Pongo:   true,
+	}, shared.Definition{Image: shared.DefinitionImage{Release: "noble"}})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(rootfsDir, "etc", "noble"))
+	require.NoError(t, err)
+	require.True(t, info.ModTime().Equal(date))
+
+	// Generators which remove their path don't fail.
+	generator, err = Load("remove", nil, "", rootfsDir, shared.DefinitionFile{Path: "/etc/noble"}, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc", "noble"))
+}
@@ -0,0 +1,163 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// kernelModulesName is the default name of the configuration files.
+const kernelModulesName = "lxd-imagebuilder"
+
+type kernelModules struct {
+	common
+}
+
+// RunLXC writes the configuration of the kernel modules.
+func (g *kernelModules) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD writes the configuration of the kernel modules.
+func (g *kernelModules) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run writes the modules to load on boot to /etc/modules-load.d, the
+// blacklisted modules and the module options to /etc/modprobe.d, and adds the
+// initramfs modules to the configuration of the initramfs generator found in
+// the rootfs. The initramfs itself isn't rebuilt.
+func (g *kernelModules) Run() error {
+	m := g.defFile.KernelModules
+	if m == nil {
+		return errors.New("Missing kernel modules configuration")
+	}
+
+	name := g.defFile.Name
+	if name == "" {
+		name = kernelModulesName
+	}
+
+	if len(m.Load) > 0 {
+		err := g.writeFile(filepath.Join("etc/modules-load.d", name+".conf"), strings.Join(m.Load, "\n")+"\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(m.Blacklist) > 0 || len(m.Options) > 0 {
+		var sb strings.Builder
+
+		for _, module := range m.Blacklist {
+			fmt.Fprintf(&sb, "blacklist %s\n", module)
+		}
+
+		modules := shared.MapKeys(m.Options)
+		slices.Sort(modules)
+
+		for _, module := range modules {
+			fmt.Fprintf(&sb, "options %s %s\n", module, strings.TrimSpace(m.Options[module]))
+		}
+
+		err := g.writeFile(filepath.Join("etc/modprobe.d", name+".conf"), sb.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(m.Initramfs) == 0 {
+		return nil
+	}
+
+	found := false
+
+	// initramfs-tools of Debian and Ubuntu only has a single list of modules.
+	if lxdShared.PathExists(filepath.Join(g.sourceDir, "etc/initramfs-tools")) {
+		err := g.appendModules("etc/initramfs-tools/modules", m.Initramfs)
+		if err != nil {
+			return err
+		}
+
+		found = true
+	}
+
+	if lxdShared.PathExists(filepath.Join(g.sourceDir, "etc/dracut.conf.d")) || lxdShared.PathExists(filepath.Join(g.sourceDir, "etc/dracut.conf")) {
+		err := g.writeFile(filepath.Join("etc/dracut.conf.d", name+".conf"), fmt.Sprintf("add_drivers+=\" %s \"\n", strings.Join(m.Initramfs, " ")))
+		if err != nil {
+			return err
+		}
+
+		found = true
+	}
+
+	if lxdShared.PathExists(filepath.Join(g.sourceDir, "etc/mkinitcpio.conf")) {
+		err := g.writeFile(filepath.Join("etc/mkinitcpio.conf.d", name+".conf"), fmt.Sprintf("MODULES+=(%s)\n", strings.Join(m.Initramfs, " ")))
+		if err != nil {
+			return err
+		}
+
+		found = true
+	}
+
+	if !found && g.logger != nil {
+		g.logger.Warn("Skipping initramfs modules, as no supported initramfs generator was found")
+	}
+
+	return nil
+}
+
+// appendModules adds the modules missing in the list of modules.
+func (g *kernelModules) appendModules(path string, modules []string) error {
+	content, err := os.ReadFile(filepath.Join(g.sourceDir, path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to read %q: %w", filepath.Join(g.sourceDir, path), err)
+	}
+
+	existing := map[string]bool{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			existing[fields[0]] = true
+		}
+	}
+
+	out := string(content)
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+
+	for _, module := range modules {
+		if !existing[module] {
+			out += module + "\n"
+			existing[module] = true
+		}
+	}
+
+	return g.writeFile(path, out)
+}
+
+// writeFile writes the content to the file inside of the rootfs.
+func (g *kernelModules) writeFile(path string, content string) error {
+	path = filepath.Join(g.sourceDir, path)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	err = os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestKernelModulesGeneratorRun(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"etc/initramfs-tools", "etc/dracut.conf.d"} {
+		err := os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/initramfs-tools/modules"), "# List of modules\nvirtio_blk")
+
+	generator, err := Load("kernel-modules", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator: "kernel-modules",
+		KernelModules: &shared.DefinitionFileKernelModules{
+			Load:      []string{"virtio_net", "9pnet_virtio"},
+			Blacklist: []string{"floppy", "pcspkr"},
+			Options:   map[string]string{"kvm_intel": "nested=1", "bonding": "max_bonds=0"},
+			Initramfs: []string{"virtio_blk", "virtio_scsi"},
+		},
+	}, shared.Definition{})
+	require.IsType(t, &kernelModules{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/modules-load.d/lxd-imagebuilder.conf"), "virtio_net\n9pnet_virtio\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/modprobe.d/lxd-imagebuilder.conf"), "blacklist floppy\nblacklist pcspkr\noptions bonding max_bonds=0\noptions kvm_intel nested=1\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/initramfs-tools/modules"), "# List of modules\nvirtio_blk\nvirtio_scsi\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/dracut.conf.d/lxd-imagebuilder.conf"), "add_drivers+=\" virtio_blk virtio_scsi \"\n")
+	require.NoDirExists(t, filepath.Join(rootfsDir, "etc/mkinitcpio.conf.d"))
+}
+
+func TestKernelModulesGeneratorRunMkinitcpio(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/mkinitcpio.conf"), "MODULES=()\n")
+
+	generator, err := Load("kernel-modules", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator:     "kernel-modules",
+		Name:          "virtio",
+		KernelModules: &shared.DefinitionFileKernelModules{Initramfs: []string{"virtio_blk"}},
+	}, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/mkinitcpio.conf.d/virtio.conf"), "MODULES+=(virtio_blk)\n")
+	require.NoDirExists(t, filepath.Join(rootfsDir, "etc/modules-load.d"))
+	require.NoDirExists(t, filepath.Join(rootfsDir, "etc/modprobe.d"))
+}
@@ -0,0 +1,348 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// localeGenConfigs are the lists of locales compiled by glibc based
+// distributions, and the commands compiling them.
+var localeGenConfigs = []struct {
+	path    string
+	command []string
+}{
+	// Debian, Arch Linux and Gentoo
+	{"etc/locale.gen", []string{"locale-gen"}},
+	// Void Linux
+	{"etc/default/libc-locales", []string{"xbps-reconfigure", "-f", "glibc-locales"}},
+}
+
+type locale struct {
+	common
+
+	definition shared.Definition
+}
+
+func (g *locale) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+	g.definition = def
+}
+
+// RunLXC configures the locale and timezone.
+func (g *locale) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD configures the locale and timezone.
+func (g *locale) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run generates the locales, sets the default one and links the timezone.
+// musl doesn't need locales to be generated, so only glibc based rootfs
+// compile them.
+func (g *locale) Run() error {
+	l := g.defFile.Locale
+	if l == nil {
+		return errors.New("Missing locale configuration")
+	}
+
+	musl := g.isMusl()
+
+	if !musl {
+		locales := slices.Clone(l.Generate)
+		if l.Lang != "" && !slices.Contains(locales, l.Lang) {
+			locales = append(locales, l.Lang)
+		}
+
+		err := g.generate(locales)
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.Lang != "" {
+		err := g.setLang(l.Lang, musl)
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.Timezone != "" {
+		err := g.setTimezone(l.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isMusl returns whether the rootfs uses musl instead of glibc.
+func (g *locale) isMusl() bool {
+	for _, dir := range []string{"lib", "usr/lib"} {
+		matches, _ := filepath.Glob(filepath.Join(g.sourceDir, dir, "ld-musl-*.so.1"))
+		if len(matches) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// generate compiles the locales which aren't available in the rootfs yet.
+// Locales listed in locale.gen are enabled there, others are compiled using
+// localedef.
+func (g *locale) generate(locales []string) error {
+	locales = slices.DeleteFunc(slices.Clone(locales), isBuiltinLocale)
+	if len(locales) == 0 {
+		return nil
+	}
+
+	for _, config := range localeGenConfigs {
+		if !g.exists(config.path) {
+			continue
+		}
+
+		changed, err := enableLocales(filepath.Join(g.sourceDir, config.path), locales)
+		if err != nil {
+			return err
+		}
+
+		if !changed {
+			return nil
+		}
+
+		return runInChroot(g.sourceDir, g.definition, config.command[0], config.command[1:]...)
+	}
+
+	if !g.exists("usr/bin/localedef") {
+		return errors.New("Failed to detect how locales are generated in the rootfs")
+	}
+
+	for _, name := range locales {
+		if g.exists(filepath.Join("usr/lib/locale", normalizeLocale(name))) {
+			continue
+		}
+
+		input, charset := splitLocale(name)
+
+		if !g.exists(filepath.Join("usr/share/i18n/locales", input)) {
+			return fmt.Errorf("Locale %q not found", name)
+		}
+
+		err := runInChroot(g.sourceDir, g.definition, "localedef", "-i", input, "-f", charset, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setLang sets the default locale for systemd, OpenRC and Debian based
+// distributions, and for login shells on musl.
+func (g *locale) setLang(lang string, musl bool) error {
+	if !musl || g.exists("etc/locale.conf") {
+		err := setShellVars(filepath.Join(g.sourceDir, "etc/locale.conf"), false, []string{"LANG", lang})
+		if err != nil {
+			return err
+		}
+	}
+
+	if g.exists("etc/debian_version") {
+		err := setShellVars(filepath.Join(g.sourceDir, "etc/default/locale"), false, []string{"LANG", lang})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Gentoo
+	if g.exists("etc/env.d") {
+		err := setShellVars(filepath.Join(g.sourceDir, "etc/env.d/02locale"), true, []string{"LANG", lang})
+		if err != nil {
+			return err
+		}
+	}
+
+	// musl only reads LANG from the environment. The profile is named so it's
+	// sourced before Alpine's locale.sh, which keeps an existing LANG.
+	if musl {
+		path := filepath.Join(g.sourceDir, "etc/profile.d/00-lang.sh")
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+		}
+
+		err = os.WriteFile(path, []byte(fmt.Sprintf("export LANG=%s\n", lang)), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// setTimezone links /etc/localtime to the timezone. If the rootfs doesn't
+// contain any timezones, UTC is set by removing /etc/localtime.
+func (g *locale) setTimezone(timezone string) error {
+	localtime := filepath.Join(g.sourceDir, "etc/localtime")
+	zoneinfo := filepath.Join("usr/share/zoneinfo", timezone)
+
+	err := os.Remove(localtime)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to remove %q: %w", localtime, err)
+	}
+
+	if g.exists(zoneinfo) {
+		err = os.Symlink(filepath.Join("..", zoneinfo), localtime)
+		if err != nil {
+			return fmt.Errorf("Failed to create symlink %q: %w", localtime, err)
+		}
+	} else if timezone != "UTC" && timezone != "Etc/UTC" {
+		return fmt.Errorf("Timezone %q not found", timezone)
+	}
+
+	// Debian based distributions and Alpine Linux also read /etc/timezone.
+	if g.exists("etc/debian_version") || g.exists("etc/timezone") {
+		path := filepath.Join(g.sourceDir, "etc/timezone")
+
+		err = os.WriteFile(path, []byte(timezone+"\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// enableLocales enables the locales in a locale.gen style file, uncommenting
+// their entries or adding them. It returns whether the file was changed.
+func enableLocales(path string, locales []string) (bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	var lines []string
+
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+
+	changed := false
+
+	for _, name := range locales {
+		_, charset := splitLocale(name)
+		entry := []string{name, charset}
+		commented := -1
+		found := false
+
+		for i, line := range lines {
+			fields := strings.Fields(strings.TrimLeft(line, "# \t"))
+			if !slices.Equal(fields, entry) {
+				continue
+			}
+
+			if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				found = true
+				break
+			}
+
+			if commented < 0 {
+				commented = i
+			}
+		}
+
+		if found {
+			continue
+		}
+
+		changed = true
+
+		if commented >= 0 {
+			lines[commented] = strings.Join(entry, " ")
+			continue
+		}
+
+		lines = append(lines, strings.Join(entry, " "))
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	err = os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return false, fmt.Errorf("Failed to write %q: %w", path, err)
+	}
+
+	return true, nil
+}
+
+// isBuiltinLocale returns whether the locale is provided by the C library
+// itself.
+func isBuiltinLocale(name string) bool {
+	return name == "POSIX" || name == "C" || strings.HasPrefix(name, "C.")
+}
+
+// splitLocale splits a locale like "de_DE.UTF-8@euro" into the name of its
+// definition ("de_DE@euro") and its charset ("UTF-8"), which defaults to
+// ISO-8859-1, or ISO-8859-15 for the euro modifier.
+func splitLocale(name string) (string, string) {
+	input, modifier, _ := strings.Cut(name, "@")
+	input, charset, found := strings.Cut(input, ".")
+
+	if !found {
+		charset = "ISO-8859-1"
+
+		if modifier == "euro" {
+			charset = "ISO-8859-15"
+		}
+	}
+
+	if modifier != "" {
+		input += "@" + modifier
+	}
+
+	return input, charset
+}
+
+// normalizeLocale returns the directory name glibc uses for a locale, which
+// has its charset in lower case and without punctuation, e.g. "en_US.utf8".
+func normalizeLocale(name string) string {
+	input, modifier, _ := strings.Cut(name, "@")
+	input, charset, found := strings.Cut(input, ".")
+
+	if found {
+		charset = strings.Map(func(r rune) rune {
+			if r >= 'A' && r <= 'Z' {
+				return r + 'a' - 'A'
+			}
+
+			if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+				return r
+			}
+
+			return -1
+		}, charset)
+
+		input += "." + charset
+	}
+
+	if modifier != "" {
+		input += "@" + modifier
+	}
+
+	return input
+}
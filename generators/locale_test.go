@@ -0,0 +1,121 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestLocaleGeneratorRunGlibc(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"etc/default", "usr/share/zoneinfo/Europe"} {
+		err = os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/debian_version"), "12.0\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/locale.gen"), "# en_US.UTF-8 UTF-8\nde_DE.UTF-8 UTF-8\n")
+	createTestFile(t, filepath.Join(rootfsDir, "usr/share/zoneinfo/Europe/Berlin"), "")
+
+	defFile := shared.DefinitionFile{
+		Generator: "locale",
+		Locale: &shared.DefinitionFileLocale{
+			Lang:     "de_DE.UTF-8",
+			Generate: []string{"C.UTF-8"},
+			Timezone: "Europe/Berlin",
+		},
+	}
+
+	generator, err := Load("locale", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.IsType(t, &locale{}, generator)
+	require.NoError(t, err)
+
+	// The locale is already enabled, so locale-gen isn't run.
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/locale.gen"), "# en_US.UTF-8 UTF-8\nde_DE.UTF-8 UTF-8\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/locale.conf"), "LANG=de_DE.UTF-8\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/default/locale"), "LANG=de_DE.UTF-8\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/timezone"), "Europe/Berlin\n")
+
+	target, err := os.Readlink(filepath.Join(rootfsDir, "etc/localtime"))
+	require.NoError(t, err)
+	require.Equal(t, "../usr/share/zoneinfo/Europe/Berlin", target)
+
+	defFile.Locale.Timezone = "America/New_York"
+
+	generator, err = Load("locale", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.EqualError(t, err, `Timezone "America/New_York" not found`)
+}
+
+func TestLocaleGeneratorRunMusl(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"lib", "etc"} {
+		err = os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "lib/ld-musl-x86_64.so.1"), "")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/localtime"), "")
+
+	defFile := shared.DefinitionFile{
+		Generator: "locale",
+		Locale:    &shared.DefinitionFileLocale{Lang: "fr_FR.UTF-8", Timezone: "UTC"},
+	}
+
+	generator, err := Load("locale", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/profile.d/00-lang.sh"), "export LANG=fr_FR.UTF-8\n")
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/locale.conf"))
+
+	// Without any timezones, UTC is set by removing /etc/localtime.
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/localtime"))
+}
+
+func TestEnableLocales(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locale.gen")
+
+	createTestFile(t, path, "# This file lists locales\n#  en_US.UTF-8 UTF-8\n# de_DE@euro ISO-8859-15\n")
+
+	changed, err := enableLocales(path, []string{"en_US.UTF-8", "ja_JP.EUC-JP", "de_DE@euro"})
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	validateTestFile(t, path, "# This file lists locales\nen_US.UTF-8 UTF-8\nde_DE@euro ISO-8859-15\nja_JP.EUC-JP EUC-JP\n")
+
+	changed, err = enableLocales(path, []string{"en_US.UTF-8"})
+	require.NoError(t, err)
+	require.False(t, changed)
+}
+
+func TestNormalizeLocale(t *testing.T) {
+	require.Equal(t, "en_US.utf8", normalizeLocale("en_US.UTF-8"))
+	require.Equal(t, "de_DE.iso885915@euro", normalizeLocale("de_DE.ISO-8859-15@euro"))
+	require.Equal(t, "ja_JP", normalizeLocale("ja_JP"))
+}
@@ -0,0 +1,83 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+type machineID struct {
+	common
+
+	vm bool
+}
+
+func (g *machineID) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+
+	g.vm = def.Targets.Type == shared.DefinitionFilterTypeVM
+}
+
+// RunLXC resets the machine ID.
+func (g *machineID) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD resets the machine ID.
+func (g *machineID) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run resets the machine ID, so each instance generates its own on boot.
+// /etc/machine-id is emptied, and the D-Bus machine ID is removed. For VMs,
+// /etc/machine-id is marked as uninitialized instead, so systemd treats the
+// first boot of the VM as such.
+func (g *machineID) Run() error {
+	path := filepath.Join(g.sourceDir, "etc/machine-id")
+
+	content := ""
+	if g.vm {
+		content = "uninitialized\n"
+	}
+
+	if lxdShared.PathExists(path) || g.hasSystemd() {
+		// Any symlink is replaced, as it might point outside of the rootfs.
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Failed to remove %q: %w", path, err)
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+		}
+
+		err = os.WriteFile(path, []byte(content), 0444)
+		if err != nil {
+			return fmt.Errorf("Failed to write file %q: %w", path, err)
+		}
+	}
+
+	// The D-Bus daemon falls back to /etc/machine-id, or generates its own
+	// machine ID on distributions without systemd.
+	dbusPath := filepath.Join(g.sourceDir, "var/lib/dbus/machine-id")
+
+	err := os.Remove(dbusPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to remove %q: %w", dbusPath, err)
+	}
+
+	return nil
+}
+
+// hasSystemd returns whether the rootfs contains systemd.
+func (g *machineID) hasSystemd() bool {
+	return lxdShared.PathExists(filepath.Join(g.sourceDir, "usr/lib/systemd/systemd")) || lxdShared.PathExists(filepath.Join(g.sourceDir, "lib/systemd/systemd"))
+}
@@ -0,0 +1,75 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestMachineIDGeneratorRun(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"etc", "var/lib/dbus"} {
+		err = os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/machine-id"), "0123456789abcdef0123456789abcdef\n")
+
+	err = os.Symlink("/etc/machine-id", filepath.Join(rootfsDir, "var/lib/dbus/machine-id"))
+	require.NoError(t, err)
+
+	generator, err := Load("machine-id", nil, cacheDir, rootfsDir, shared.DefinitionFile{Generator: "machine-id"}, shared.Definition{})
+	require.IsType(t, &machineID{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/machine-id"), "")
+	require.NoFileExists(t, filepath.Join(rootfsDir, "var/lib/dbus/machine-id"))
+
+	info, err := os.Stat(filepath.Join(rootfsDir, "etc/machine-id"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0444), info.Mode().Perm())
+
+	// VMs treat their first boot as such.
+	definition := shared.Definition{}
+	definition.Targets.Type = shared.DefinitionFilterTypeVM
+
+	generator, err = Load("machine-id", nil, cacheDir, rootfsDir, shared.DefinitionFile{Generator: "machine-id"}, definition)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/machine-id"), "uninitialized\n")
+}
+
+func TestMachineIDGeneratorRunWithoutSystemd(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	generator, err := Load("machine-id", nil, cacheDir, rootfsDir, shared.DefinitionFile{Generator: "machine-id"}, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/machine-id"))
+}
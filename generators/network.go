@@ -0,0 +1,362 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// The default interfaces of LXD containers and VMs.
+const (
+	networkContainerInterface = "eth0"
+	networkVMInterface        = "enp5s0"
+)
+
+// networkBackendPaths are the default paths of the configurations.
+var networkBackendPaths = map[string]string{
+	"ifupdown": "/etc/network/interfaces",
+	"netplan":  "/etc/netplan/10-lxc.yaml",
+	"networkd": "/etc/systemd/network/10-lxc.network",
+}
+
+type network struct {
+	common
+
+	initSystem string
+	vm         bool
+}
+
+func (g *network) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+
+	g.initSystem = def.Image.Init
+	g.vm = def.Targets.Type == shared.DefinitionFilterTypeVM
+}
+
+// RunLXC writes the network configuration of a container.
+func (g *network) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD writes the network configuration of a container or VM.
+func (g *network) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run writes the network configuration. The backend is detected from the
+// rootfs unless it's set, and the interface defaults to the one of LXD
+// containers or VMs.
+func (g *network) Run() error {
+	config := shared.DefinitionFileNetwork{}
+	if g.defFile.Network != nil {
+		config = *g.defFile.Network
+	}
+
+	if config.Interface == "" {
+		config.Interface = networkContainerInterface
+
+		if g.vm {
+			config.Interface = networkVMInterface
+		}
+	}
+
+	backend := config.Backend
+	if backend == "" {
+		backend = g.detectBackend()
+		if backend == "" {
+			return errors.New("Failed to detect how the network is configured in the rootfs")
+		}
+	}
+
+	var content string
+	mode := os.FileMode(0644)
+
+	switch backend {
+	case "ifupdown":
+		content = renderIfupdown(config)
+	case "netplan":
+		content = renderNetplan(config)
+
+		// netplan warns about configurations readable by others.
+		mode = 0600
+	case "networkd":
+		content = renderNetworkd(config)
+	}
+
+	path := g.defFile.Path
+	if path == "" {
+		path = networkBackendPaths[backend]
+	}
+
+	path = filepath.Join(g.sourceDir, path)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	err = os.WriteFile(path, []byte(content), mode)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", path, err)
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		return fmt.Errorf("Failed to change permissions of %q: %w", path, err)
+	}
+
+	// netplan renders its configuration for systemd-networkd as well.
+	if backend != "ifupdown" && (g.initSystem == "" || g.initSystem == "systemd") && g.exists("etc/systemd/system") {
+		err = g.enableNetworkd()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// detectBackend returns how the network is configured in the rootfs, or an
+// empty string if it's unknown.
+func (g *network) detectBackend() string {
+	if g.exists("usr/sbin/netplan") || g.exists("etc/netplan") {
+		return "netplan"
+	}
+
+	if (g.initSystem == "" || g.initSystem == "systemd") && (g.exists("usr/lib/systemd/systemd-networkd") || g.exists("lib/systemd/systemd-networkd")) {
+		return "networkd"
+	}
+
+	if g.exists("sbin/ifup") || g.exists("usr/sbin/ifup") || g.exists("etc/network/interfaces") {
+		return "ifupdown"
+	}
+
+	return ""
+}
+
+// enableNetworkd enables the systemd-networkd service and socket, like
+// "systemctl enable systemd-networkd" does.
+func (g *network) enableNetworkd() error {
+	for _, unit := range []struct {
+		name   string
+		target string
+	}{
+		{"systemd-networkd.service", "multi-user.target.wants"},
+		{"systemd-networkd.socket", "sockets.target.wants"},
+	} {
+		var unitPath string
+
+		for _, dir := range []string{"/usr/lib/systemd/system", "/lib/systemd/system"} {
+			if g.exists(filepath.Join(dir, unit.name)) {
+				unitPath = filepath.Join(dir, unit.name)
+				break
+			}
+		}
+
+		if unitPath == "" {
+			continue
+		}
+
+		wantsDir := filepath.Join(g.sourceDir, "etc/systemd/system", unit.target)
+
+		err := os.MkdirAll(wantsDir, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", wantsDir, err)
+		}
+
+		link := filepath.Join(wantsDir, unit.name)
+
+		if lxdShared.PathExists(link) {
+			continue
+		}
+
+		err = os.Symlink(unitPath, link)
+		if err != nil {
+			return fmt.Errorf("Failed to enable %q: %w", unit.name, err)
+		}
+	}
+
+	return nil
+}
+
+// isIPv6 returns whether the address or prefix is an IPv6 one.
+func isIPv6(address string) bool {
+	prefix, err := netip.ParsePrefix(address)
+	if err == nil {
+		return prefix.Addr().Is6()
+	}
+
+	addr, err := netip.ParseAddr(address)
+
+	return err == nil && addr.Is6()
+}
+
+// renderNetplan renders the configuration for netplan.
+func renderNetplan(config shared.DefinitionFileNetwork) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "network:\n  version: 2\n  ethernets:\n    %s:\n", config.Interface)
+
+	if config.Method != "static" {
+		b.WriteString("      dhcp4: true\n      dhcp-identifier: mac\n")
+
+		if config.DHCP6 {
+			b.WriteString("      dhcp6: true\n")
+		}
+	} else {
+		b.WriteString("      addresses:\n")
+
+		for _, address := range config.Addresses {
+			fmt.Fprintf(&b, "        - %s\n", address)
+		}
+
+		if len(config.Gateways) > 0 {
+			b.WriteString("      routes:\n")
+
+			for _, gateway := range config.Gateways {
+				to := "0.0.0.0/0"
+				if isIPv6(gateway) {
+					to = "::/0"
+				}
+
+				fmt.Fprintf(&b, "        - to: %s\n          via: %s\n", to, gateway)
+			}
+		}
+	}
+
+	if len(config.Nameservers) > 0 || len(config.Search) > 0 {
+		b.WriteString("      nameservers:\n")
+
+		for _, list := range []struct {
+			key    string
+			values []string
+		}{{"addresses", config.Nameservers}, {"search", config.Search}} {
+			if len(list.values) == 0 {
+				continue
+			}
+
+			fmt.Fprintf(&b, "        %s:\n", list.key)
+
+			for _, value := range list.values {
+				fmt.Fprintf(&b, "          - %s\n", value)
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// renderNetworkd renders the configuration for systemd-networkd.
+func renderNetworkd(config shared.DefinitionFileNetwork) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "[Match]\nName=%s\n\n[Network]\n", config.Interface)
+
+	if config.Method != "static" {
+		if config.DHCP6 {
+			b.WriteString("DHCP=yes\n")
+		} else {
+			b.WriteString("DHCP=ipv4\n")
+		}
+	}
+
+	for _, address := range config.Addresses {
+		fmt.Fprintf(&b, "Address=%s\n", address)
+	}
+
+	for _, gateway := range config.Gateways {
+		fmt.Fprintf(&b, "Gateway=%s\n", gateway)
+	}
+
+	for _, nameserver := range config.Nameservers {
+		fmt.Fprintf(&b, "DNS=%s\n", nameserver)
+	}
+
+	if len(config.Search) > 0 {
+		fmt.Fprintf(&b, "Domains=%s\n", strings.Join(config.Search, " "))
+	}
+
+	if config.Method != "static" {
+		b.WriteString("\n[DHCPv4]\nClientIdentifier=mac\n")
+	}
+
+	return b.String()
+}
+
+// renderIfupdown renders /etc/network/interfaces for ifupdown, including the
+// loopback interface.
+func renderIfupdown(config shared.DefinitionFileNetwork) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "auto lo\niface lo inet loopback\n\nauto %s\n", config.Interface)
+
+	if config.Method != "static" {
+		fmt.Fprintf(&b, "iface %s inet dhcp\n", config.Interface)
+
+		if config.DHCP6 {
+			fmt.Fprintf(&b, "iface %s inet6 dhcp\n", config.Interface)
+		}
+
+		return b.String()
+	}
+
+	// The options of a stanza apply once, so the DNS settings are only set
+	// for the first address family.
+	dnsWritten := false
+
+	for _, family := range []struct {
+		name string
+		ipv6 bool
+	}{{"inet", false}, {"inet6", true}} {
+		var addresses, gateways []string
+
+		for _, address := range config.Addresses {
+			if isIPv6(address) == family.ipv6 {
+				addresses = append(addresses, address)
+			}
+		}
+
+		if len(addresses) == 0 {
+			continue
+		}
+
+		for _, gateway := range config.Gateways {
+			if isIPv6(gateway) == family.ipv6 {
+				gateways = append(gateways, gateway)
+			}
+		}
+
+		fmt.Fprintf(&b, "iface %s %s static\n", config.Interface, family.name)
+
+		for _, address := range addresses {
+			fmt.Fprintf(&b, "    address %s\n", address)
+		}
+
+		for _, gateway := range gateways {
+			fmt.Fprintf(&b, "    gateway %s\n", gateway)
+		}
+
+		if !dnsWritten {
+			if len(config.Nameservers) > 0 {
+				fmt.Fprintf(&b, "    dns-nameservers %s\n", strings.Join(config.Nameservers, " "))
+			}
+
+			if len(config.Search) > 0 {
+				fmt.Fprintf(&b, "    dns-search %s\n", strings.Join(config.Search, " "))
+			}
+
+			dnsWritten = true
+		}
+	}
+
+	return b.String()
+}
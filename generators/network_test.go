@@ -0,0 +1,159 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestNetworkGeneratorRunNetplan(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc/netplan"), 0755)
+	require.NoError(t, err)
+
+	generator, err := Load("network", nil, cacheDir, rootfsDir, shared.DefinitionFile{Generator: "network"}, shared.Definition{})
+	require.IsType(t, &network{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/netplan/10-lxc.yaml"), "network:\n  version: 2\n  ethernets:\n    eth0:\n      dhcp4: true\n      dhcp-identifier: mac\n")
+
+	info, err := os.Stat(filepath.Join(rootfsDir, "etc/netplan/10-lxc.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Static addresses
+	defFile := shared.DefinitionFile{
+		Generator: "network",
+		Network: &shared.DefinitionFileNetwork{
+			Method:      "static",
+			Addresses:   []string{"192.0.2.10/24", "2001:db8::10/64"},
+			Gateways:    []string{"192.0.2.1", "2001:db8::1"},
+			Nameservers: []string{"192.0.2.53"},
+			Search:      []string{"example.com"},
+		},
+	}
+
+	generator, err = Load("network", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/netplan/10-lxc.yaml"), `network:
+  version: 2
+  ethernets:
+    eth0:
+      addresses:
+        - 192.0.2.10/24
+        - 2001:db8::10/64
+      routes:
+        - to: 0.0.0.0/0
+          via: 192.0.2.1
+        - to: ::/0
+          via: 2001:db8::1
+      nameservers:
+        addresses:
+          - 192.0.2.53
+        search:
+          - example.com
+`)
+}
+
+func TestNetworkGeneratorRunNetworkd(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"usr/lib/systemd/system", "etc/systemd/system"} {
+		err = os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "usr/lib/systemd/systemd-networkd"), "")
+	createTestFile(t, filepath.Join(rootfsDir, "usr/lib/systemd/system/systemd-networkd.service"), "")
+
+	definition := shared.Definition{}
+	definition.Targets.Type = shared.DefinitionFilterTypeVM
+
+	defFile := shared.DefinitionFile{
+		Generator: "network",
+		Network:   &shared.DefinitionFileNetwork{DHCP6: true},
+	}
+
+	generator, err := Load("network", nil, cacheDir, rootfsDir, defFile, definition)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/systemd/network/10-lxc.network"), "[Match]\nName=enp5s0\n\n[Network]\nDHCP=yes\n\n[DHCPv4]\nClientIdentifier=mac\n")
+
+	target, err := os.Readlink(filepath.Join(rootfsDir, "etc/systemd/system/multi-user.target.wants/systemd-networkd.service"))
+	require.NoError(t, err)
+	require.Equal(t, "/usr/lib/systemd/system/systemd-networkd.service", target)
+}
+
+func TestNetworkGeneratorRunIfupdown(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	defFile := shared.DefinitionFile{
+		Generator: "network",
+		Network: &shared.DefinitionFileNetwork{
+			Method:      "static",
+			Addresses:   []string{"192.0.2.10/24", "2001:db8::10/64"},
+			Gateways:    []string{"192.0.2.1"},
+			Nameservers: []string{"192.0.2.53", "2001:db8::53"},
+		},
+	}
+
+	// The backend can't be detected in an empty rootfs.
+	generator, err := Load("network", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.EqualError(t, err, "Failed to detect how the network is configured in the rootfs")
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "sbin"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "sbin/ifup"), "")
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/network/interfaces"), `auto lo
+iface lo inet loopback
+
+auto eth0
+iface eth0 inet static
+    address 192.0.2.10/24
+    gateway 192.0.2.1
+    dns-nameservers 192.0.2.53 2001:db8::53
+iface eth0 inet6 static
+    address 2001:db8::10/64
+`)
+}
@@ -0,0 +1,63 @@
+package generators
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/plugins"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// plugin is a generator provided by a plugin binary. It can only modify the
+// rootfs, and not add templates to LXC or LXD images.
+type plugin struct {
+	common
+
+	plugin     shared.DefinitionPlugin
+	definition shared.Definition
+}
+
+func (g *plugin) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+	g.definition = def
+}
+
+// RunLXC runs the generator plugin for LXC images.
+func (g *plugin) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.run("lxc")
+}
+
+// RunLXD runs the generator plugin for LXD images.
+func (g *plugin) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.run("lxd")
+}
+
+// Run runs the generator plugin.
+func (g *plugin) Run() error {
+	return g.run("")
+}
+
+func (g *plugin) run(target string) error {
+	definition, err := plugins.MarshalDefinition(g.definition)
+	if err != nil {
+		return err
+	}
+
+	file, err := yaml.Marshal(g.defFile)
+	if err != nil {
+		return err
+	}
+
+	args := plugins.GeneratorArgs{
+		Definition: definition,
+		File:       string(file),
+		Target:     target,
+		RootfsDir:  g.sourceDir,
+		CacheDir:   g.cacheDir,
+	}
+
+	return plugins.Call(context.Background(), g.logger, g.plugin, "Generator.Run", args, &plugins.Empty{})
+}
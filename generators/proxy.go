@@ -0,0 +1,228 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// proxyProfilePath is the default path of the profile script.
+const proxyProfilePath = "/etc/profile.d/proxy.sh"
+
+// proxyAPTPath is the apt configuration file the proxies are set in.
+const proxyAPTPath = "etc/apt/apt.conf.d/90proxy"
+
+type proxy struct {
+	common
+}
+
+// RunLXC configures the proxies.
+func (g *proxy) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD configures the proxies.
+func (g *proxy) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run sets the proxy variables in /etc/environment and a profile script, like
+// the environment generator does, and configures the package managers found
+// in the rootfs to use the proxies.
+func (g *proxy) Run() error {
+	p := g.defFile.Proxy
+	if p == nil {
+		return errors.New("Missing proxy configuration")
+	}
+
+	noProxy := strings.Join(p.NoProxy, ",")
+
+	// Tools differ in the case of the variables they read.
+	variables := map[string]string{}
+
+	for key, value := range map[string]string{"http_proxy": p.HTTP, "https_proxy": p.HTTPS, "no_proxy": noProxy} {
+		if value == "" {
+			continue
+		}
+
+		variables[key] = value
+		variables[strings.ToUpper(key)] = value
+	}
+
+	keys := shared.MapKeys(variables)
+	slices.Sort(keys)
+
+	env := &environment{common: g.common}
+
+	err := env.setEnvironment(keys, variables, nil)
+	if err != nil {
+		return err
+	}
+
+	path := g.defFile.Path
+	if path == "" {
+		path = proxyProfilePath
+	}
+
+	path = filepath.Join(g.sourceDir, path)
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	err = os.WriteFile(path, []byte(renderEnvironmentProfile(keys, variables, nil)), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", path, err)
+	}
+
+	if lxdShared.PathExists(filepath.Join(g.sourceDir, "etc/apt")) {
+		err := g.configureAPT(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	// dnf and yum use a single proxy for all repositories.
+	repoProxy := p.HTTPS
+	if repoProxy == "" {
+		repoProxy = p.HTTP
+	}
+
+	for _, conf := range []string{"etc/dnf/dnf.conf", "etc/yum.conf"} {
+		path := filepath.Join(g.sourceDir, conf)
+
+		if !lxdShared.PathExists(path) {
+			continue
+		}
+
+		err := setINIValue(path, "main", "proxy", repoProxy)
+		if err != nil {
+			return err
+		}
+	}
+
+	// openSUSE configures the proxies of zypper and YaST in /etc/sysconfig/proxy.
+	path = filepath.Join(g.sourceDir, "etc/sysconfig/proxy")
+
+	if lxdShared.PathExists(path) {
+		err := setShellVars(path, true, []string{
+			"PROXY_ENABLED", "yes",
+			"HTTP_PROXY", p.HTTP,
+			"HTTPS_PROXY", p.HTTPS,
+			"NO_PROXY", strings.Join(p.NoProxy, ", "),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configureAPT writes the apt configuration of the proxies. apt only skips the
+// proxies for exact host names, so other no_proxy entries are left out.
+func (g *proxy) configureAPT(p *shared.DefinitionFileProxy) error {
+	var sb strings.Builder
+
+	for _, scheme := range []struct {
+		name string
+		url  string
+	}{{"http", p.HTTP}, {"https", p.HTTPS}} {
+		if scheme.url == "" {
+			continue
+		}
+
+		fmt.Fprintf(&sb, "Acquire::%s::Proxy \"%s\";\n", scheme.name, scheme.url)
+
+		for _, host := range p.NoProxy {
+			if strings.ContainsAny(host, "*/:") || strings.HasPrefix(host, ".") {
+				continue
+			}
+
+			fmt.Fprintf(&sb, "Acquire::%s::Proxy::%s \"DIRECT\";\n", scheme.name, host)
+		}
+	}
+
+	path := filepath.Join(g.sourceDir, proxyAPTPath)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	err = os.WriteFile(path, []byte(sb.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// setINIValue sets the key in the section of an INI style configuration file,
+// keeping any other lines. The section is added if it's missing.
+func setINIValue(path string, section string, key string, value string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	var lines []string
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+
+	var out []string
+
+	inSection := false
+	done := false
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			// Add the key at the end of the section.
+			if inSection && !done {
+				out = append(out, key+"="+value)
+				done = true
+			}
+
+			inSection = trimmed == "["+section+"]"
+		} else if inSection {
+			name, _, found := strings.Cut(trimmed, "=")
+			if found && strings.TrimSpace(name) == key {
+				if !done {
+					out = append(out, key+"="+value)
+					done = true
+				}
+
+				continue
+			}
+		}
+
+		out = append(out, line)
+	}
+
+	if !done {
+		if !inSection {
+			out = append(out, "["+section+"]")
+		}
+
+		out = append(out, key+"="+value)
+	}
+
+	err = os.WriteFile(path, []byte(strings.Join(out, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", path, err)
+	}
+
+	return nil
+}
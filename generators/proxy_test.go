@@ -0,0 +1,102 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestProxyGeneratorRun(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"etc/apt", "etc/dnf"} {
+		err := os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/environment"), "PATH=\"/usr/bin:/bin\"\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/dnf/dnf.conf"), "[main]\ngpgcheck=1\nproxy=http://old.example.com\n\n[other]\nproxy=keep\n")
+
+	generator, err := Load("proxy", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator: "proxy",
+		Proxy: &shared.DefinitionFileProxy{
+			HTTP:    "http://proxy.example.com:3128",
+			HTTPS:   "http://proxy.example.com:3129",
+			NoProxy: []string{"localhost", ".example.com", "10.0.0.0/8"},
+		},
+	}, shared.Definition{})
+	require.IsType(t, &proxy{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/environment"), `PATH="/usr/bin:/bin"
+HTTPS_PROXY="http://proxy.example.com:3129"
+HTTP_PROXY="http://proxy.example.com:3128"
+NO_PROXY="localhost,.example.com,10.0.0.0/8"
+http_proxy="http://proxy.example.com:3128"
+https_proxy="http://proxy.example.com:3129"
+no_proxy="localhost,.example.com,10.0.0.0/8"
+`)
+
+	validateTestFile(t, filepath.Join(rootfsDir, proxyProfilePath), `export HTTPS_PROXY='http://proxy.example.com:3129'
+export HTTP_PROXY='http://proxy.example.com:3128'
+export NO_PROXY='localhost,.example.com,10.0.0.0/8'
+export http_proxy='http://proxy.example.com:3128'
+export https_proxy='http://proxy.example.com:3129'
+export no_proxy='localhost,.example.com,10.0.0.0/8'
+`)
+
+	validateTestFile(t, filepath.Join(rootfsDir, proxyAPTPath), `Acquire::http::Proxy "http://proxy.example.com:3128";
+Acquire::http::Proxy::localhost "DIRECT";
+Acquire::https::Proxy "http://proxy.example.com:3129";
+Acquire::https::Proxy::localhost "DIRECT";
+`)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/dnf/dnf.conf"), "[main]\ngpgcheck=1\nproxy=http://proxy.example.com:3129\n\n[other]\nproxy=keep\n")
+}
+
+func TestProxyGeneratorRunSysconfig(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc/sysconfig"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/sysconfig/proxy"), "PROXY_ENABLED=\"no\"\nHTTP_PROXY=\"\"\nNO_PROXY=\"localhost, 127.0.0.1\"\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/yum.conf"), "")
+
+	generator, err := Load("proxy", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator: "proxy",
+		Path:      "/etc/profile.d/corp-proxy.sh",
+		Proxy: &shared.DefinitionFileProxy{
+			HTTP:    "http://proxy.example.com:3128",
+			NoProxy: []string{"localhost"},
+		},
+	}, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/sysconfig/proxy"), "PROXY_ENABLED=\"yes\"\nHTTP_PROXY=\"http://proxy.example.com:3128\"\nNO_PROXY=\"localhost\"\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/yum.conf"), "[main]\nproxy=http://proxy.example.com:3128\n")
+	require.FileExists(t, filepath.Join(rootfsDir, "etc/profile.d/corp-proxy.sh"))
+	require.NoFileExists(t, filepath.Join(rootfsDir, proxyAPTPath))
+}
@@ -0,0 +1,244 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+type repositories struct {
+	common
+
+	definition shared.Definition
+}
+
+// repositoryFiles are the files of a repository inside of the rootfs.
+type repositoryFiles struct {
+	repo string
+	key  string
+}
+
+func (g *repositories) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+	g.definition = def
+}
+
+// RunLXC configures the repositories of the image.
+func (g *repositories) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD configures the repositories of the image.
+func (g *repositories) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run writes the repositories of the generator in the format of the package
+// manager, and installs their signing keys. The repositories used during the
+// build which aren't among them are removed, so the image only ships the
+// repositories of the generator.
+func (g *repositories) Run() error {
+	var repos []shared.DefinitionPackagesRepository
+
+	for _, repo := range g.defFile.Repositories {
+		if !shared.ApplyFilter(&repo, g.definition.Image.Release, g.definition.Image.ArchitectureMapped, g.definition.Image.Variant, g.definition.Targets.Type, 0) {
+			continue
+		}
+
+		var err error
+
+		repo.URL, err = shared.RenderTemplate(repo.URL, g.definition)
+		if err != nil {
+			return fmt.Errorf("Failed to render template: %w", err)
+		}
+
+		repo.Key, err = shared.RenderTemplate(repo.Key, g.definition)
+		if err != nil {
+			return fmt.Errorf("Failed to render template: %w", err)
+		}
+
+		repos = append(repos, repo)
+	}
+
+	names := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+
+	manager := g.definition.Packages.Manager
+
+	if manager == "apk" {
+		return g.runAPK(repos)
+	}
+
+	// Remove the repositories used during the build.
+	for _, repo := range g.definition.Packages.Repositories {
+		if slices.Contains(names, repo.Name) {
+			continue
+		}
+
+		files, err := repositoryPaths(manager, repo.Name)
+		if err != nil {
+			return err
+		}
+
+		for _, path := range []string{files.repo, files.key} {
+			err := os.Remove(filepath.Join(g.sourceDir, path))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("Failed to remove %q: %w", path, err)
+			}
+		}
+	}
+
+	var rpmKeys []string
+
+	for _, repo := range repos {
+		files, err := repositoryPaths(manager, repo.Name)
+		if err != nil {
+			return err
+		}
+
+		content := repo.URL
+
+		switch manager {
+		case "apt":
+			content = "# Generated by lxd-imagebuilder\n" + content
+		case "zypper":
+			content = fmt.Sprintf("[%s]\nname=%s\nbaseurl=%s\nenabled=1\nautorefresh=1\ngpgcheck=1\n", repo.Name, repo.Name, strings.TrimSpace(repo.URL))
+		}
+
+		err = g.writeFile(files.repo, content)
+		if err != nil {
+			return err
+		}
+
+		if repo.Key == "" {
+			continue
+		}
+
+		err = g.writeFile(files.key, repo.Key)
+		if err != nil {
+			return err
+		}
+
+		if manager != "apt" {
+			rpmKeys = append(rpmKeys, "/"+files.key)
+		}
+	}
+
+	if len(rpmKeys) == 0 {
+		return nil
+	}
+
+	// RPM based distributions only trust the keys in the RPM database.
+	return runInChroot(g.sourceDir, g.definition, "rpm", append([]string{"--import"}, rpmKeys...)...)
+}
+
+// runAPK rewrites /etc/apk/repositories, which lists all repositories, without
+// the repositories used during the build, and adds the repositories of the
+// generator. The keys are installed as /etc/apk/keys/<name>.rsa.pub.
+func (g *repositories) runAPK(repos []shared.DefinitionPackagesRepository) error {
+	path := filepath.Join(g.sourceDir, "etc/apk/repositories")
+
+	var buildURLs []string
+
+	for _, repo := range g.definition.Packages.Repositories {
+		url, err := shared.RenderTemplate(repo.URL, g.definition)
+		if err != nil {
+			return fmt.Errorf("Failed to render template: %w", err)
+		}
+
+		buildURLs = append(buildURLs, strings.TrimSpace(url))
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	var lines []string
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		if line == "" || slices.Contains(buildURLs, strings.TrimSpace(line)) {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	for _, repo := range repos {
+		url := strings.TrimSpace(repo.URL)
+
+		if !slices.Contains(lines, url) {
+			lines = append(lines, url)
+		}
+
+		if repo.Key != "" {
+			err := g.writeFile(filepath.Join("etc/apk/keys", repo.Name+".rsa.pub"), repo.Key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return g.writeFile("etc/apk/repositories", strings.Join(lines, "\n"))
+}
+
+// writeFile writes the content to the file inside of the rootfs, with a final
+// new line.
+func (g *repositories) writeFile(path string, content string) error {
+	path = filepath.Join(g.sourceDir, path)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+
+	err = os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// repositoryPaths returns the paths of the repository file and signing key of
+// a repository, which are the ones the package manager uses during the build.
+func repositoryPaths(manager string, name string) (repositoryFiles, error) {
+	switch manager {
+	case "apt":
+		if name == "sources.list" {
+			return repositoryFiles{repo: "etc/apt/sources.list", key: "etc/apt/trusted.gpg.d/sources.list.asc"}, nil
+		}
+
+		repo := filepath.Join("etc/apt/sources.list.d", name)
+		if !strings.HasSuffix(repo, ".list") {
+			repo += ".list"
+		}
+
+		return repositoryFiles{repo: repo, key: filepath.Join("etc/apt/trusted.gpg.d", name+".asc")}, nil
+	case "dnf", "yum":
+		repo := filepath.Join("etc/yum.repos.d", name)
+		if !strings.HasSuffix(repo, ".repo") {
+			repo += ".repo"
+		}
+
+		return repositoryFiles{repo: repo, key: filepath.Join("etc/pki/rpm-gpg", "RPM-GPG-KEY-"+strings.TrimSuffix(name, ".repo"))}, nil
+	case "zypper":
+		return repositoryFiles{repo: filepath.Join("etc/zypp/repos.d", name+".repo"), key: filepath.Join("etc/pki/rpm-gpg", "RPM-GPG-KEY-"+name)}, nil
+	}
+
+	return repositoryFiles{}, fmt.Errorf("Package manager %q isn't supported", manager)
+}
@@ -0,0 +1,149 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestRepositoriesGeneratorRunAPT(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	def := shared.Definition{
+		Image: shared.DefinitionImage{
+			Distribution: "ubuntu",
+			Release:      "noble",
+		},
+		Packages: shared.DefinitionPackages{
+			Manager: "apt",
+			Repositories: []shared.DefinitionPackagesRepository{
+				{Name: "mirror", URL: "deb http://mirror.internal/ubuntu noble main"},
+				{Name: "ubuntu", URL: "deb http://mirror.internal/ubuntu noble universe"},
+			},
+		},
+	}
+
+	for _, dir := range []string{"etc/apt/sources.list.d", "etc/apt/trusted.gpg.d"} {
+		err := os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	// Files written by the package manager during the build
+	createTestFile(t, filepath.Join(rootfsDir, "etc/apt/sources.list.d/mirror.list"), "deb http://mirror.internal/ubuntu noble main\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/apt/trusted.gpg.d/mirror.asc"), "key")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/apt/sources.list.d/ubuntu.list"), "deb http://mirror.internal/ubuntu noble universe\n")
+
+	generator, err := Load("repositories", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator: "repositories",
+		Repositories: []shared.DefinitionPackagesRepository{
+			{Name: "ubuntu", URL: "deb http://archive.ubuntu.com/ubuntu {{ image.release }} main universe", Key: "-----BEGIN PGP PUBLIC KEY BLOCK-----"},
+			{Name: "backports", URL: "deb http://archive.ubuntu.com/ubuntu noble-backports main", DefinitionFilter: shared.DefinitionFilter{Releases: []string{"jammy"}}},
+		},
+	}, def)
+	require.IsType(t, &repositories{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/apt/sources.list.d/ubuntu.list"), "# Generated by lxd-imagebuilder\ndeb http://archive.ubuntu.com/ubuntu noble main universe\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/apt/trusted.gpg.d/ubuntu.asc"), "-----BEGIN PGP PUBLIC KEY BLOCK-----\n")
+
+	// The build-time repositories which aren't shipped are removed.
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/apt/sources.list.d/mirror.list"))
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/apt/trusted.gpg.d/mirror.asc"))
+
+	// Filtered repositories are skipped.
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/apt/sources.list.d/backports.list"))
+}
+
+func TestRepositoriesGeneratorRunYum(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	def := shared.Definition{
+		Packages: shared.DefinitionPackages{
+			Manager: "dnf",
+		},
+	}
+
+	content := "[internal]\nname=Internal\nbaseurl=https://mirror.internal/el9/\ngpgcheck=0\n"
+
+	generator, err := Load("repositories", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator:    "repositories",
+		Repositories: []shared.DefinitionPackagesRepository{{Name: "internal", URL: content}},
+	}, def)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/yum.repos.d/internal.repo"), content)
+
+	def.Packages.Manager = "zypper"
+
+	generator, err = Load("repositories", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator:    "repositories",
+		Repositories: []shared.DefinitionPackagesRepository{{Name: "oss", URL: "https://download.opensuse.org/distribution/leap/15.6/repo/oss/"}},
+	}, def)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/zypp/repos.d/oss.repo"), "[oss]\nname=oss\nbaseurl=https://download.opensuse.org/distribution/leap/15.6/repo/oss/\nenabled=1\nautorefresh=1\ngpgcheck=1\n")
+}
+
+func TestRepositoriesGeneratorRunAPK(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	def := shared.Definition{
+		Packages: shared.DefinitionPackages{
+			Manager: "apk",
+			Repositories: []shared.DefinitionPackagesRepository{
+				{Name: "mirror", URL: "http://mirror.internal/alpine/v3.20/main"},
+			},
+		},
+	}
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc/apk"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/apk/repositories"), "http://dl-cdn.alpinelinux.org/alpine/v3.20/main\nhttp://mirror.internal/alpine/v3.20/main\n")
+
+	generator, err := Load("repositories", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator: "repositories",
+		Repositories: []shared.DefinitionPackagesRepository{
+			{Name: "community", URL: "http://dl-cdn.alpinelinux.org/alpine/v3.20/community"},
+			{Name: "internal", URL: "https://packages.internal/alpine", Key: "-----BEGIN PUBLIC KEY-----"},
+		},
+	}, def)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/apk/repositories"), "http://dl-cdn.alpinelinux.org/alpine/v3.20/main\nhttp://dl-cdn.alpinelinux.org/alpine/v3.20/community\nhttps://packages.internal/alpine\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/apk/keys/internal.rsa.pub"), "-----BEGIN PUBLIC KEY-----\n")
+}
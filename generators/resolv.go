@@ -0,0 +1,136 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// resolvedDropInPath is the drop-in configuring systemd-resolved in the stub
+// mode.
+const resolvedDropInPath = "etc/systemd/resolved.conf.d/lxd-imagebuilder.conf"
+
+type resolv struct {
+	common
+
+	resolvConfPolicy string
+}
+
+func (g *resolv) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+
+	g.resolvConfPolicy = def.Environment.ResolvConfPolicy
+}
+
+// RunLXC sets up /etc/resolv.conf.
+func (g *resolv) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD sets up /etc/resolv.conf.
+func (g *resolv) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run sets up /etc/resolv.conf according to the mode. The static mode writes
+// the nameservers to it, the stub mode links it to the stub resolver of
+// systemd-resolved and enables it, and the runtime mode removes it, so it's
+// written by the network configuration of the instance.
+func (g *resolv) Run() error {
+	r := g.defFile.Resolv
+	if r == nil {
+		return errors.New("Missing resolv configuration")
+	}
+
+	path := filepath.Join(g.sourceDir, "etc/resolv.conf")
+
+	// Any symlink is replaced, as it might point outside of the rootfs.
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to remove %q: %w", path, err)
+	}
+
+	switch r.Mode {
+	case "static":
+		if shared.UsesResolved(g.sourceDir) && g.resolvConfPolicy != "keep" && g.logger != nil {
+			g.logger.Warn("systemd-resolved is enabled, so /etc/resolv.conf is replaced with its stub when exiting the chroot. Set environment.resolv_conf_policy to keep to prevent it")
+		}
+
+		var sb strings.Builder
+
+		for _, nameserver := range r.Nameservers {
+			fmt.Fprintf(&sb, "nameserver %s\n", nameserver)
+		}
+
+		if len(r.Search) > 0 {
+			fmt.Fprintf(&sb, "search %s\n", strings.Join(r.Search, " "))
+		}
+
+		if len(r.Options) > 0 {
+			fmt.Fprintf(&sb, "options %s\n", strings.Join(r.Options, " "))
+		}
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+		}
+
+		err = os.WriteFile(path, []byte(sb.String()), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write file %q: %w", path, err)
+		}
+	case "stub":
+		unit := &systemdUnit{common: g.common}
+
+		if unit.findUnit("systemd-resolved.service") == "" {
+			return errors.New("Mode \"stub\" requires systemd-resolved, which isn't installed")
+		}
+
+		err := unit.enable("systemd-resolved.service", map[string]bool{})
+		if err != nil {
+			return err
+		}
+
+		err = os.Symlink(shared.ResolvedStubResolvConf, path)
+		if err != nil {
+			return fmt.Errorf("Failed to create link %q -> %q: %w", path, shared.ResolvedStubResolvConf, err)
+		}
+
+		if len(r.Nameservers) == 0 && len(r.Search) == 0 {
+			return nil
+		}
+
+		var sb strings.Builder
+
+		sb.WriteString("[Resolve]\n")
+
+		if len(r.Nameservers) > 0 {
+			fmt.Fprintf(&sb, "DNS=%s\n", strings.Join(r.Nameservers, " "))
+		}
+
+		if len(r.Search) > 0 {
+			fmt.Fprintf(&sb, "Domains=%s\n", strings.Join(r.Search, " "))
+		}
+
+		dropIn := filepath.Join(g.sourceDir, resolvedDropInPath)
+
+		err = os.MkdirAll(filepath.Dir(dropIn), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(dropIn), err)
+		}
+
+		err = os.WriteFile(dropIn, []byte(sb.String()), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write file %q: %w", dropIn, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestResolvGeneratorRun(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	// The copy of the build host is replaced.
+	err = os.Symlink("/run/systemd/resolve/stub-resolv.conf", filepath.Join(rootfsDir, "etc/resolv.conf"))
+	require.NoError(t, err)
+
+	generator, err := Load("resolv", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator: "resolv",
+		Resolv: &shared.DefinitionFileResolv{
+			Mode:        "static",
+			Nameservers: []string{"192.0.2.53", "2001:db8::53"},
+			Search:      []string{"example.com"},
+			Options:     []string{"edns0", "timeout:2"},
+		},
+	}, shared.Definition{})
+	require.IsType(t, &resolv{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/resolv.conf"), "nameserver 192.0.2.53\nnameserver 2001:db8::53\nsearch example.com\noptions edns0 timeout:2\n")
+
+	generator, err = Load("resolv", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator: "resolv",
+		Resolv:    &shared.DefinitionFileResolv{Mode: "runtime"},
+	}, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	_, err = os.Lstat(filepath.Join(rootfsDir, "etc/resolv.conf"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestResolvGeneratorRunStub(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"etc", "usr/lib/systemd/system"} {
+		err := os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	generator, err := Load("resolv", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator: "resolv",
+		Resolv:    &shared.DefinitionFileResolv{Mode: "stub", Nameservers: []string{"192.0.2.53"}, Search: []string{"example.com", "example.org"}},
+	}, shared.Definition{})
+	require.NoError(t, err)
+
+	// systemd-resolved isn't installed.
+	err = generator.Run()
+	require.EqualError(t, err, `Mode "stub" requires systemd-resolved, which isn't installed`)
+
+	createTestFile(t, filepath.Join(rootfsDir, "usr/lib/systemd/system/systemd-resolved.service"), "[Install]\nWantedBy=sysinit.target\nAlias=dbus-org.freedesktop.resolve1.service\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/resolv.conf"), "nameserver 198.51.100.1\n")
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	target, err := os.Readlink(filepath.Join(rootfsDir, "etc/resolv.conf"))
+	require.NoError(t, err)
+	require.Equal(t, shared.ResolvedStubResolvConf, target)
+	require.True(t, shared.UsesResolved(rootfsDir))
+
+	validateTestFile(t, filepath.Join(rootfsDir, resolvedDropInPath), "[Resolve]\nDNS=192.0.2.53\nDomains=example.com example.org\n")
+}
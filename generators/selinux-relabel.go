@@ -0,0 +1,164 @@
+package generators
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// selinuxConfigPath is the configuration of SELinux in the rootfs.
+const selinuxConfigPath = "etc/selinux/config"
+
+type selinuxRelabel struct {
+	common
+
+	vm bool
+}
+
+func (g *selinuxRelabel) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+
+	g.vm = def.Targets.Type == shared.DefinitionFilterTypeVM
+}
+
+// RunLXC skips the relabel, as containers don't use SELinux.
+func (g *selinuxRelabel) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	g.skip()
+
+	return nil
+}
+
+// RunLXD labels the rootfs of VM images.
+func (g *selinuxRelabel) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	if !g.vm {
+		g.skip()
+
+		return nil
+	}
+
+	return g.Run()
+}
+
+// Run labels the rootfs with the SELinux policy set in /etc/selinux/config.
+// The files are labeled by setfiles of the build host, or marked for a relabel
+// on the first boot by /.autorelabel. The auto mode labels the files if the
+// build host has setfiles and the policy has file contexts.
+func (g *selinuxRelabel) Run() error {
+	policy, state, err := g.readConfig()
+	if err != nil {
+		return err
+	}
+
+	if state == "disabled" && g.logger != nil {
+		g.logger.WithField("path", "/"+selinuxConfigPath).Warn("SELinux is disabled, the labels only apply once it's enabled")
+	}
+
+	fileContexts := filepath.Join(g.sourceDir, "etc/selinux", policy, "contexts/files/file_contexts")
+
+	mode := "auto"
+	if g.defFile.SELinux != nil && g.defFile.SELinux.Mode != "" {
+		mode = g.defFile.SELinux.Mode
+	}
+
+	if mode == "auto" {
+		mode = "autorelabel"
+
+		_, err := exec.LookPath("setfiles")
+		if err == nil && lxdShared.PathExists(fileContexts) {
+			mode = "setfiles"
+		}
+	}
+
+	if mode == "autorelabel" {
+		path := filepath.Join(g.sourceDir, ".autorelabel")
+
+		err := os.WriteFile(path, nil, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write file %q: %w", path, err)
+		}
+
+		return nil
+	}
+
+	if !lxdShared.PathExists(fileContexts) {
+		return fmt.Errorf("Failed to find file contexts %q of SELinux policy %q", fileContexts, policy)
+	}
+
+	_, err = exec.LookPath("setfiles")
+	if err != nil {
+		return fmt.Errorf("Failed to find setfiles, install policycoreutils on the build host, or use mode \"autorelabel\": %w", err)
+	}
+
+	// The rootfs isn't mounted into, so only its own files are labeled.
+	err = shared.RunCommand(context.Background(), nil, nil, "setfiles", "-F", "-r", g.sourceDir, fileContexts, g.sourceDir)
+	if err != nil {
+		return fmt.Errorf("Failed to label rootfs with SELinux policy %q: %w", policy, err)
+	}
+
+	return nil
+}
+
+// readConfig returns the policy and the state of SELinux in the rootfs.
+func (g *selinuxRelabel) readConfig() (string, string, error) {
+	path := filepath.Join(g.sourceDir, selinuxConfigPath)
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", "", fmt.Errorf("Failed to find %q, install the SELinux policy first", "/"+selinuxConfigPath)
+		}
+
+		return "", "", fmt.Errorf("Failed to open %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	var policy, state string
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found || strings.HasPrefix(key, "#") {
+			continue
+		}
+
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+
+		switch strings.TrimSpace(key) {
+		case "SELINUX":
+			state = value
+		case "SELINUXTYPE":
+			policy = value
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	if policy == "" || strings.Contains(policy, "/") {
+		return "", "", fmt.Errorf("Failed to find SELINUXTYPE in %q", "/"+selinuxConfigPath)
+	}
+
+	return policy, state, nil
+}
+
+// skip logs that the relabel is skipped for containers.
+func (g *selinuxRelabel) skip() {
+	if g.logger != nil {
+		g.logger.Warn("Skipping SELinux relabel, as containers don't use SELinux")
+	}
+}
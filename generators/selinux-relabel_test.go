@@ -0,0 +1,121 @@
+package generators
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestSELinuxRelabelGeneratorRunLXD(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	definition := shared.Definition{}
+	definition.Targets.Type = shared.DefinitionFilterTypeVM
+
+	img := image.NewLXDImage(context.TODO(), cacheDir, "", cacheDir, definition)
+
+	defFile := shared.DefinitionFile{Generator: "selinux-relabel"}
+
+	generator, err := Load("selinux-relabel", nil, cacheDir, rootfsDir, defFile, definition)
+	require.IsType(t, &selinuxRelabel{}, generator)
+	require.NoError(t, err)
+
+	// The policy needs to be installed.
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.EqualError(t, err, `Failed to find "/etc/selinux/config", install the SELinux policy first`)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc/selinux/targeted/contexts/files"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/selinux/config"), `# This file controls the state of SELinux on the system.
+SELINUX=enforcing
+SELINUXTYPE=targeted
+`)
+
+	// Without file contexts, the rootfs is relabeled on the first boot.
+	t.Setenv("PATH", cacheDir)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(rootfsDir, ".autorelabel"))
+
+	err = os.Remove(filepath.Join(rootfsDir, ".autorelabel"))
+	require.NoError(t, err)
+
+	// With file contexts and setfiles, the rootfs is labeled right away.
+	createTestFile(t, filepath.Join(rootfsDir, "etc/selinux/targeted/contexts/files/file_contexts"), "/.*  system_u:object_r:default_t:s0")
+	createTestFile(t, filepath.Join(cacheDir, "setfiles"), "#!/bin/sh\necho \"$@\" > "+filepath.Join(cacheDir, "setfiles.args")+"\n")
+
+	err = os.Chmod(filepath.Join(cacheDir, "setfiles"), 0755)
+	require.NoError(t, err)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(rootfsDir, ".autorelabel"))
+
+	validateTestFile(t, filepath.Join(cacheDir, "setfiles.args"), "-F -r "+rootfsDir+" "+rootfsDir+"/etc/selinux/targeted/contexts/files/file_contexts "+rootfsDir+"\n")
+
+	// The mode can be set explicitly.
+	defFile.SELinux = &shared.DefinitionFileSELinux{Mode: "autorelabel"}
+
+	generator, err = Load("selinux-relabel", nil, cacheDir, rootfsDir, defFile, definition)
+	require.NoError(t, err)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(rootfsDir, ".autorelabel"))
+
+	err = os.Remove(filepath.Join(rootfsDir, "etc/selinux/targeted/contexts/files/file_contexts"))
+	require.NoError(t, err)
+
+	defFile.SELinux = &shared.DefinitionFileSELinux{Mode: "setfiles"}
+
+	generator, err = Load("selinux-relabel", nil, cacheDir, rootfsDir, defFile, definition)
+	require.NoError(t, err)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.ErrorContains(t, err, `Failed to find file contexts`)
+}
+
+func TestSELinuxRelabelGeneratorContainer(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc/selinux"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/selinux/config"), "SELINUX=enforcing\nSELINUXTYPE=targeted\n")
+
+	definition := shared.Definition{}
+	definition.Targets.Type = shared.DefinitionFilterTypeContainer
+
+	generator, err := Load("selinux-relabel", nil, cacheDir, rootfsDir, shared.DefinitionFile{Generator: "selinux-relabel"}, definition)
+	require.NoError(t, err)
+
+	img := image.NewLXDImage(context.TODO(), cacheDir, "", cacheDir, definition)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+
+	err = generator.RunLXC(nil, shared.DefinitionTargetLXC{})
+	require.NoError(t, err)
+
+	require.NoFileExists(t, filepath.Join(rootfsDir, ".autorelabel"))
+}
@@ -0,0 +1,131 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	lxdShared "github.com/canonical/lxd/shared"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// sshHostKeysUnit is the name of the systemd unit and OpenRC service
+// regenerating the SSH host keys.
+const sshHostKeysUnit = "ssh-host-keys"
+
+// sshHostKeysSystemdUnit regenerates missing host keys before the SSH server
+// starts. Debian and Ubuntu call it ssh, and other distributions sshd.
+const sshHostKeysSystemdUnit = `[Unit]
+Description=Regenerate SSH host keys
+Before=ssh.service sshd.service
+ConditionPathExistsGlob=!/etc/ssh/ssh_host_*_key
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/ssh-keygen -A
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// sshHostKeysOpenRCScript regenerates missing host keys before the SSH server
+// starts.
+const sshHostKeysOpenRCScript = `#!/sbin/openrc-run
+
+description="Regenerate SSH host keys"
+
+depend() {
+	before sshd
+}
+
+start() {
+	ebegin "Regenerating SSH host keys"
+	ssh-keygen -A
+	eend $?
+}
+`
+
+type sshHostKeys struct {
+	common
+}
+
+// RunLXC removes the SSH host keys and installs the service regenerating them.
+func (g *sshHostKeys) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD removes the SSH host keys and installs the service regenerating them.
+func (g *sshHostKeys) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run removes the SSH host keys created when installing the SSH server, so
+// instances launched from the image don't share them, and installs a systemd
+// unit or OpenRC service generating new ones on the first boot.
+func (g *sshHostKeys) Run() error {
+	keys, err := filepath.Glob(filepath.Join(g.sourceDir, "etc/ssh/ssh_host_*"))
+	if err != nil {
+		return fmt.Errorf("Failed to list SSH host keys: %w", err)
+	}
+
+	for _, key := range keys {
+		err := os.Remove(key)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Failed to remove %q: %w", key, err)
+		}
+	}
+
+	if (&machineID{common: g.common}).hasSystemd() {
+		path := filepath.Join(g.sourceDir, "etc/systemd/system", sshHostKeysUnit+".service")
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+		}
+
+		err = os.WriteFile(path, []byte(sshHostKeysSystemdUnit), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write file %q: %w", path, err)
+		}
+
+		return (&systemdUnit{common: g.common}).enable(sshHostKeysUnit+".service", map[string]bool{})
+	}
+
+	if lxdShared.PathExists(filepath.Join(g.sourceDir, "sbin/openrc-run")) || lxdShared.PathExists(filepath.Join(g.sourceDir, "etc/runlevels")) {
+		path := filepath.Join(g.sourceDir, "etc/init.d", sshHostKeysUnit)
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+		}
+
+		err = os.WriteFile(path, []byte(sshHostKeysOpenRCScript), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to write file %q: %w", path, err)
+		}
+
+		link := filepath.Join(g.sourceDir, "etc/runlevels/default", sshHostKeysUnit)
+
+		err = os.MkdirAll(filepath.Dir(link), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(link), err)
+		}
+
+		err = os.Remove(link)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Failed to remove %q: %w", link, err)
+		}
+
+		err = os.Symlink(filepath.Join("/etc/init.d", sshHostKeysUnit), link)
+		if err != nil {
+			return fmt.Errorf("Failed to create symlink %q: %w", link, err)
+		}
+
+		return nil
+	}
+
+	return errors.New("Failed to determine init system")
+}
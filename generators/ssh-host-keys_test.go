@@ -0,0 +1,91 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestSSHHostKeysGeneratorRunSystemd(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"etc/ssh", "usr/lib/systemd"} {
+		err := os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "usr/lib/systemd/systemd"), "")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/ssh/sshd_config"), "PermitRootLogin no\n")
+
+	for _, key := range []string{"ssh_host_ed25519_key", "ssh_host_ed25519_key.pub", "ssh_host_rsa_key", "ssh_host_rsa_key.pub"} {
+		createTestFile(t, filepath.Join(rootfsDir, "etc/ssh", key), "key\n")
+	}
+
+	generator, err := Load("ssh-host-keys", nil, cacheDir, rootfsDir, shared.DefinitionFile{Generator: "ssh-host-keys"}, shared.Definition{})
+	require.IsType(t, &sshHostKeys{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	keys, err := filepath.Glob(filepath.Join(rootfsDir, "etc/ssh/ssh_host_*"))
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	require.FileExists(t, filepath.Join(rootfsDir, "etc/ssh/sshd_config"))
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/systemd/system/ssh-host-keys.service"), sshHostKeysSystemdUnit)
+
+	target, err := os.Readlink(filepath.Join(rootfsDir, "etc/systemd/system/multi-user.target.wants/ssh-host-keys.service"))
+	require.NoError(t, err)
+	require.Equal(t, "/etc/systemd/system/ssh-host-keys.service", target)
+}
+
+func TestSSHHostKeysGeneratorRunOpenRC(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	for _, dir := range []string{"etc/ssh", "etc/runlevels/default"} {
+		err := os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/ssh/ssh_host_ecdsa_key"), "key\n")
+
+	generator, err := Load("ssh-host-keys", nil, cacheDir, rootfsDir, shared.DefinitionFile{Generator: "ssh-host-keys"}, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/ssh/ssh_host_ecdsa_key"))
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/init.d/ssh-host-keys"), sshHostKeysOpenRCScript)
+
+	info, err := os.Stat(filepath.Join(rootfsDir, "etc/init.d/ssh-host-keys"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	target, err := os.Readlink(filepath.Join(rootfsDir, "etc/runlevels/default/ssh-host-keys"))
+	require.NoError(t, err)
+	require.Equal(t, "/etc/init.d/ssh-host-keys", target)
+
+	// Running it again keeps the service enabled.
+	err = generator.Run()
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(rootfsDir, "etc/runlevels/default/ssh-host-keys"))
+}
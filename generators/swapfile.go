@@ -0,0 +1,137 @@
+package generators
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// swapfilePath is the default path of the swap file.
+const swapfilePath = "/swapfile"
+
+type swapfile struct {
+	common
+
+	vm bool
+}
+
+func (g *swapfile) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+
+	g.vm = def.Targets.Type == shared.DefinitionFilterTypeVM
+}
+
+// RunLXC doesn't support the swapfile generator.
+func (g *swapfile) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return errors.New("swapfile generator not supported for LXC, as containers can't have swap of their own")
+}
+
+// RunLXD creates the swap file of VM images.
+func (g *swapfile) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run creates and formats the swap file, and adds it to /etc/fstab. It fails
+// unless the target is a VM.
+func (g *swapfile) Run() error {
+	if !g.vm {
+		return errors.New("swapfile generator is only supported for VMs, as containers can't have swap of their own")
+	}
+
+	if g.defFile.Swapfile == nil {
+		return errors.New("Missing swapfile configuration")
+	}
+
+	path := g.defFile.Path
+	if path == "" {
+		path = swapfilePath
+	}
+
+	err := g.create(filepath.Join(g.sourceDir, path), g.defFile.Swapfile.Size)
+	if err != nil {
+		return fmt.Errorf("Failed to create swap file: %w", err)
+	}
+
+	return g.addToFstab(path)
+}
+
+// create writes the swap file and formats it. The zeros are written rather
+// than allocated, as unallocated extents count as holes when the rootfs is
+// copied into the VM image, and swap files can't have holes.
+func (g *swapfile) create(path string, size uint64) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	// The size is a multiple of 1MiB.
+	buf := make([]byte, 1048576)
+
+	for written := uint64(0); written < size; written += uint64(len(buf)) {
+		_, err = f.Write(buf)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", path, err)
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to close %q: %w", path, err)
+	}
+
+	return shared.RunCommand(context.Background(), nil, nil, "mkswap", path)
+}
+
+// addToFstab adds the swap file to /etc/fstab, unless it's already listed.
+func (g *swapfile) addToFstab(path string) error {
+	fstab := filepath.Join(g.sourceDir, "etc/fstab")
+	entry := fmt.Sprintf("%s  none  swap  sw  0 0\n", path)
+
+	if !lxdShared.PathExists(fstab) {
+		err := os.WriteFile(fstab, []byte(entry), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", fstab, err)
+		}
+
+		return nil
+	}
+
+	content, err := os.ReadFile(fstab)
+	if err != nil {
+		return fmt.Errorf("Failed to read %q: %w", fstab, err)
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && fields[0] == path && fields[2] == "swap" {
+			return nil
+		}
+	}
+
+	if len(content) > 0 && !strings.HasSuffix(string(content), "\n") {
+		entry = "\n" + entry
+	}
+
+	err = shared.AppendToFile(fstab, entry)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", fstab, err)
+	}
+
+	return nil
+}
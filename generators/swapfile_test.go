@@ -0,0 +1,104 @@
+package generators
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestSwapfileGeneratorRunLXD(t *testing.T) {
+	_, err := exec.LookPath("mkswap")
+	if err != nil {
+		t.Skip("mkswap not available")
+	}
+
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/fstab"), "LABEL=rootfs  /  ext4  defaults  0 0")
+
+	defFile := shared.DefinitionFile{
+		Generator: "swapfile",
+		Swapfile:  &shared.DefinitionFileSwapfile{Size: 16 * 1048576},
+	}
+
+	definition := shared.Definition{}
+	definition.Targets.Type = shared.DefinitionFilterTypeVM
+
+	generator, err := Load("swapfile", nil, cacheDir, rootfsDir, defFile, definition)
+	require.IsType(t, &swapfile{}, generator)
+	require.NoError(t, err)
+
+	img := image.NewLXDImage(context.TODO(), cacheDir, "", cacheDir, definition)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(rootfsDir, "swapfile"))
+	require.NoError(t, err)
+	require.Equal(t, int64(16*1048576), info.Size())
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// mkswap writes its signature at the end of the first page.
+	content, err := os.ReadFile(filepath.Join(rootfsDir, "swapfile"))
+	require.NoError(t, err)
+	require.Equal(t, "SWAPSPACE2", string(content[4086:4096]))
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/fstab"), `LABEL=rootfs  /  ext4  defaults  0 0
+/swapfile  none  swap  sw  0 0
+`)
+
+	// The entry isn't added twice.
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/fstab"), `LABEL=rootfs  /  ext4  defaults  0 0
+/swapfile  none  swap  sw  0 0
+`)
+}
+
+func TestSwapfileGeneratorContainer(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	defFile := shared.DefinitionFile{
+		Generator: "swapfile",
+		Swapfile:  &shared.DefinitionFileSwapfile{Size: 1048576},
+	}
+
+	definition := shared.Definition{}
+	definition.Targets.Type = shared.DefinitionFilterTypeContainer
+
+	generator, err := Load("swapfile", nil, cacheDir, rootfsDir, defFile, definition)
+	require.NoError(t, err)
+
+	img := image.NewLXDImage(context.TODO(), cacheDir, "", cacheDir, definition)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.EqualError(t, err, "swapfile generator is only supported for VMs, as containers can't have swap of their own")
+
+	err = generator.RunLXC(nil, shared.DefinitionTargetLXC{})
+	require.EqualError(t, err, "swapfile generator not supported for LXC, as containers can't have swap of their own")
+
+	require.NoFileExists(t, filepath.Join(rootfsDir, "swapfile"))
+}
@@ -0,0 +1,122 @@
+package generators
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// sysctlPath is the default path of the sysctl fragment.
+const sysctlPath = "/etc/sysctl.d/99-lxc.conf"
+
+// sysctlContainerPrefixes are the kernel parameters which are namespaced, and
+// can therefore be set inside of containers.
+var sysctlContainerPrefixes = []string{
+	"net.",
+	"fs.mqueue.",
+	"kernel.domainname",
+	"kernel.hostname",
+	"kernel.msg",
+	"kernel.sem",
+	"kernel.shm",
+	"user.",
+}
+
+type sysctl struct {
+	common
+
+	vm bool
+}
+
+func (g *sysctl) init(logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) {
+	g.common.init(logger, cacheDir, sourceDir, defFile, def)
+
+	g.vm = def.Targets.Type == shared.DefinitionFilterTypeVM
+}
+
+// RunLXC writes the kernel parameters which can be set inside of containers.
+func (g *sysctl) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.write(false)
+}
+
+// RunLXD writes the kernel parameters, only keeping those which can be set
+// inside of containers for container images.
+func (g *sysctl) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.write(g.vm)
+}
+
+// Run writes the kernel parameters, only keeping those which can be set
+// inside of containers unless the target is a VM.
+func (g *sysctl) Run() error {
+	return g.write(g.vm)
+}
+
+// write writes the sysctl fragment. Unless vm is true, kernel parameters which
+// aren't namespaced are skipped. No fragment is written if all of them are.
+func (g *sysctl) write(vm bool) error {
+	keys := make([]string, 0, len(g.defFile.Sysctl))
+
+	for key := range g.defFile.Sysctl {
+		if !vm && !isNamespacedSysctl(key) {
+			if g.logger != nil {
+				g.logger.WithField("key", key).Warn("Skipping kernel parameter which can't be set inside of containers")
+			}
+
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sort.Strings(keys)
+
+	var sb strings.Builder
+
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "%s = %s\n", key, strings.TrimSpace(g.defFile.Sysctl[key]))
+	}
+
+	path := g.defFile.Path
+	if path == "" {
+		path = sysctlPath
+	}
+
+	path = filepath.Join(g.sourceDir, path)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	err = os.WriteFile(path, []byte(sb.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// isNamespacedSysctl returns whether the kernel parameter can be set inside
+// of containers. Keys may use slashes instead of dots as separators.
+func isNamespacedSysctl(key string) bool {
+	key = strings.ReplaceAll(key, "/", ".")
+
+	for _, prefix := range sysctlContainerPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
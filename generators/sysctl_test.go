@@ -0,0 +1,93 @@
+package generators
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestSysctlGeneratorRunLXD(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	defFile := shared.DefinitionFile{
+		Generator: "sysctl",
+		Sysctl: map[string]string{
+			"vm.swappiness":                "10",
+			"net.ipv4.ip_forward":          "1",
+			"net/ipv4/conf/eth0/rp_filter": "2",
+			"kernel.panic":                 "10",
+			"net.ipv4.tcp_rmem":            "4096 87380 6291456",
+		},
+	}
+
+	// Containers only get the namespaced kernel parameters.
+	definition := shared.Definition{}
+	definition.Targets.Type = shared.DefinitionFilterTypeContainer
+
+	generator, err := Load("sysctl", nil, cacheDir, rootfsDir, defFile, definition)
+	require.IsType(t, &sysctl{}, generator)
+	require.NoError(t, err)
+
+	img := image.NewLXDImage(context.TODO(), cacheDir, "", cacheDir, definition)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/sysctl.d/99-lxc.conf"), `net.ipv4.ip_forward = 1
+net.ipv4.tcp_rmem = 4096 87380 6291456
+net/ipv4/conf/eth0/rp_filter = 2
+`)
+
+	definition.Targets.Type = shared.DefinitionFilterTypeVM
+
+	generator, err = Load("sysctl", nil, cacheDir, rootfsDir, defFile, definition)
+	require.NoError(t, err)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/sysctl.d/99-lxc.conf"), `kernel.panic = 10
+net.ipv4.ip_forward = 1
+net.ipv4.tcp_rmem = 4096 87380 6291456
+net/ipv4/conf/eth0/rp_filter = 2
+vm.swappiness = 10
+`)
+}
+
+func TestSysctlGeneratorRunLXC(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	defFile := shared.DefinitionFile{
+		Generator: "sysctl",
+		Path:      "/etc/sysctl.d/10-memory.conf",
+		Sysctl:    map[string]string{"vm.swappiness": "10"},
+	}
+
+	generator, err := Load("sysctl", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.NoError(t, err)
+
+	img := image.NewLXCImage(context.TODO(), cacheDir, "", cacheDir, shared.Definition{})
+
+	// No fragment is written if none of the kernel parameters can be set.
+	err = generator.RunLXC(img, shared.DefinitionTargetLXC{})
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/sysctl.d/10-memory.conf"))
+}
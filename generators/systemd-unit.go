@@ -0,0 +1,355 @@
+package generators
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// systemdUnitDirs are searched for unit files inside of the rootfs, in order.
+var systemdUnitDirs = []string{"/etc/systemd/system", "/usr/lib/systemd/system", "/lib/systemd/system"}
+
+// systemdDependencyDirs are the suffixes of the directories the dependencies
+// of a unit are linked into when enabling it.
+var systemdDependencyDirs = map[string]string{
+	"WantedBy":   ".wants",
+	"RequiredBy": ".requires",
+	"UpheldBy":   ".upholds",
+}
+
+type systemdUnit struct {
+	common
+}
+
+// RunLXC installs the unit and sets its state.
+func (g *systemdUnit) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD installs the unit and sets its state.
+func (g *systemdUnit) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run installs the unit file or drop-in from the content, and enables,
+// disables or masks the unit by creating or removing the symlinks systemctl
+// would, without running it inside of the rootfs.
+func (g *systemdUnit) Run() error {
+	unit := shared.DefinitionFileSystemdUnit{}
+	if g.defFile.SystemdUnit != nil {
+		unit = *g.defFile.SystemdUnit
+	}
+
+	name := g.defFile.Name
+
+	if g.defFile.Content != "" {
+		path := filepath.Join(g.sourceDir, "etc/systemd/system", name)
+		if unit.DropIn != "" {
+			path = filepath.Join(g.sourceDir, "etc/systemd/system", name+".d", unit.DropIn)
+		}
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+		}
+
+		content := g.defFile.Content
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+
+		err = os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write file %q: %w", path, err)
+		}
+	}
+
+	switch unit.State {
+	case "enabled":
+		return g.enable(name, map[string]bool{})
+	case "disabled":
+		return g.disable(name)
+	case "masked":
+		return g.mask(name)
+	}
+
+	return nil
+}
+
+// findUnit returns the path of the unit file inside of the rootfs, which is
+// the template for instances of template units.
+func (g *systemdUnit) findUnit(name string) string {
+	names := []string{name}
+
+	prefix, instance, found := strings.Cut(name, "@")
+	if found && !strings.HasPrefix(instance, ".") {
+		names = append(names, prefix+"@"+instance[strings.LastIndex(instance, "."):])
+	}
+
+	for _, dir := range systemdUnitDirs {
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+
+			info, err := os.Lstat(filepath.Join(g.sourceDir, path))
+			if err != nil {
+				continue
+			}
+
+			// Masked units can't be enabled.
+			if info.Mode()&os.ModeSymlink != 0 {
+				target, _ := os.Readlink(filepath.Join(g.sourceDir, path))
+				if target == "/dev/null" {
+					continue
+				}
+			}
+
+			return path
+		}
+	}
+
+	return ""
+}
+
+// enable links the unit into the dependency directories of the units in its
+// [Install] section and creates its aliases, like "systemctl enable" does.
+// Units listed in Also are enabled as well. A mask of the unit is removed.
+func (g *systemdUnit) enable(name string, enabled map[string]bool) error {
+	if enabled[name] {
+		return nil
+	}
+
+	enabled[name] = true
+
+	err := g.unmask(name)
+	if err != nil {
+		return err
+	}
+
+	unitPath := g.findUnit(name)
+	if unitPath == "" {
+		return fmt.Errorf("Unit %q not found", name)
+	}
+
+	install, err := parseSystemdInstall(filepath.Join(g.sourceDir, unitPath))
+	if err != nil {
+		return err
+	}
+
+	if len(install) == 0 {
+		return fmt.Errorf("Unit %q has no [Install] section and can't be enabled", name)
+	}
+
+	// Template units are enabled with their default instance.
+	linkName := name
+	if strings.HasSuffix(linkName, "@"+filepath.Ext(linkName)) {
+		if len(install["DefaultInstance"]) == 0 {
+			return fmt.Errorf("Template unit %q has no DefaultInstance and can't be enabled without an instance", name)
+		}
+
+		linkName = strings.TrimSuffix(linkName, filepath.Ext(linkName)) + install["DefaultInstance"][0] + filepath.Ext(linkName)
+	}
+
+	links := map[string]string{}
+
+	for key, suffix := range systemdDependencyDirs {
+		for _, target := range install[key] {
+			links[filepath.Join("etc/systemd/system", target+suffix, linkName)] = unitPath
+		}
+	}
+
+	for _, alias := range install["Alias"] {
+		links[filepath.Join("etc/systemd/system", alias)] = unitPath
+	}
+
+	for link, target := range links {
+		path := filepath.Join(g.sourceDir, link)
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+		}
+
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Failed to remove %q: %w", path, err)
+		}
+
+		err = os.Symlink(target, path)
+		if err != nil {
+			return fmt.Errorf("Failed to enable %q: %w", name, err)
+		}
+	}
+
+	for _, also := range install["Also"] {
+		err := g.enable(also, enabled)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// disable removes the symlinks enabling the unit from /etc/systemd/system,
+// like "systemctl disable" does. Masks are kept.
+func (g *systemdUnit) disable(name string) error {
+	root := filepath.Join(g.sourceDir, "etc/systemd/system")
+
+	if !lxdShared.PathExists(root) {
+		return nil
+	}
+
+	ext := filepath.Ext(name)
+	isTemplate := strings.HasSuffix(name, "@"+ext)
+	prefix := strings.TrimSuffix(name, ext)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+
+		if target == "/dev/null" {
+			return nil
+		}
+
+		// Instances of a template unit link to the template.
+		base := filepath.Base(path)
+		matches := base == name || filepath.Base(target) == name
+		if isTemplate {
+			matches = matches || strings.HasPrefix(base, prefix) && filepath.Ext(base) == ext
+		}
+
+		if !matches {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("Failed to remove %q: %w", path, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to disable %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// mask links the unit to /dev/null, like "systemctl mask" does.
+func (g *systemdUnit) mask(name string) error {
+	path := filepath.Join(g.sourceDir, "etc/systemd/system", name)
+
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("Unit %q is installed in /etc/systemd/system and can't be masked", name)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to remove %q: %w", path, err)
+	}
+
+	err = os.Symlink("/dev/null", path)
+	if err != nil {
+		return fmt.Errorf("Failed to mask %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// unmask removes a mask of the unit.
+func (g *systemdUnit) unmask(name string) error {
+	path := filepath.Join(g.sourceDir, "etc/systemd/system", name)
+
+	target, err := os.Readlink(path)
+	if err != nil || target != "/dev/null" {
+		return nil
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("Failed to unmask %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// parseSystemdInstall returns the settings of the [Install] section of a unit
+// file. Settings which are set multiple times are combined.
+func parseSystemdInstall(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	install := map[string][]string{}
+	section := ""
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line
+			continue
+		}
+
+		if section != "[Install]" {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+
+		key = strings.TrimSpace(key)
+
+		// An empty value resets the setting.
+		if strings.TrimSpace(value) == "" {
+			install[key] = []string{}
+			continue
+		}
+
+		install[key] = append(install[key], strings.Fields(value)...)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	return install, nil
+}
@@ -0,0 +1,156 @@
+package generators
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestSystemdUnitGeneratorRun(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "usr/lib/systemd/system"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "usr/lib/systemd/system/app-helper.socket"), "[Socket]\nListenStream=/run/app.sock\n\n[Install]\nWantedBy=sockets.target\n")
+
+	// Install and enable a new unit.
+	defFile := shared.DefinitionFile{
+		Generator:   "systemd-unit",
+		Name:        "app.service",
+		Content:     "[Service]\nExecStart=/usr/bin/app\n\n[Install]\nWantedBy=multi-user.target\nRequiredBy=graphical.target\nAlias=application.service\nAlso=app-helper.socket",
+		SystemdUnit: &shared.DefinitionFileSystemdUnit{State: "enabled"},
+	}
+
+	generator, err := Load("systemd-unit", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.IsType(t, &systemdUnit{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/systemd/system/app.service"), defFile.Content+"\n")
+
+	for link, target := range map[string]string{
+		"etc/systemd/system/multi-user.target.wants/app.service":    "/etc/systemd/system/app.service",
+		"etc/systemd/system/graphical.target.requires/app.service":  "/etc/systemd/system/app.service",
+		"etc/systemd/system/application.service":                    "/etc/systemd/system/app.service",
+		"etc/systemd/system/sockets.target.wants/app-helper.socket": "/usr/lib/systemd/system/app-helper.socket",
+	} {
+		value, err := os.Readlink(filepath.Join(rootfsDir, link))
+		require.NoError(t, err)
+		require.Equal(t, target, value)
+	}
+
+	// Add a drop-in.
+	generator, err = Load("systemd-unit", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator:   "systemd-unit",
+		Name:        "app.service",
+		Content:     "[Service]\nEnvironment=DEBUG=1\n",
+		SystemdUnit: &shared.DefinitionFileSystemdUnit{DropIn: "debug.conf"},
+	}, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/systemd/system/app.service.d/debug.conf"), "[Service]\nEnvironment=DEBUG=1\n")
+
+	// Disable the unit, which keeps the unit file and the socket.
+	generator, err = Load("systemd-unit", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+		Generator:   "systemd-unit",
+		Name:        "app.service",
+		SystemdUnit: &shared.DefinitionFileSystemdUnit{State: "disabled"},
+	}, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	require.FileExists(t, filepath.Join(rootfsDir, "etc/systemd/system/app.service"))
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/systemd/system/multi-user.target.wants/app.service"))
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/systemd/system/graphical.target.requires/app.service"))
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc/systemd/system/application.service"))
+	require.FileExists(t, filepath.Join(rootfsDir, "etc/systemd/system/sockets.target.wants/app-helper.socket"))
+
+	// Mask the socket, and enable it again.
+	for _, state := range []string{"masked", "enabled"} {
+		generator, err = Load("systemd-unit", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+			Generator:   "systemd-unit",
+			Name:        "app-helper.socket",
+			SystemdUnit: &shared.DefinitionFileSystemdUnit{State: state},
+		}, shared.Definition{})
+		require.NoError(t, err)
+
+		err = generator.Run()
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(rootfsDir, "etc/systemd/system/app-helper.socket"))
+		if state == "masked" {
+			require.NoError(t, err)
+			require.Equal(t, "/dev/null", target)
+		} else {
+			require.Error(t, err)
+		}
+	}
+}
+
+func TestSystemdUnitGeneratorRunTemplate(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "lib/systemd/system"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "lib/systemd/system/getty@.service"), "[Install]\nWantedBy=getty.target\nDefaultInstance=tty1\n")
+	createTestFile(t, filepath.Join(rootfsDir, "lib/systemd/system/static.service"), "[Service]\nExecStart=/bin/true\n")
+
+	for name, link := range map[string]string{
+		"getty@.service":      "getty@tty1.service",
+		"getty@ttyS0.service": "getty@ttyS0.service",
+	} {
+		generator, err := Load("systemd-unit", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+			Generator:   "systemd-unit",
+			Name:        name,
+			SystemdUnit: &shared.DefinitionFileSystemdUnit{State: "enabled"},
+		}, shared.Definition{})
+		require.NoError(t, err)
+
+		err = generator.Run()
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(rootfsDir, "etc/systemd/system/getty.target.wants", link))
+		require.NoError(t, err)
+		require.Equal(t, "/lib/systemd/system/getty@.service", target)
+	}
+
+	for name, message := range map[string]string{
+		"static.service":  `Unit "static.service" has no [Install] section and can't be enabled`,
+		"missing.service": `Unit "missing.service" not found`,
+	} {
+		generator, err := Load("systemd-unit", nil, cacheDir, rootfsDir, shared.DefinitionFile{
+			Generator:   "systemd-unit",
+			Name:        name,
+			SystemdUnit: &shared.DefinitionFileSystemdUnit{State: "enabled"},
+		}, shared.Definition{})
+		require.NoError(t, err)
+
+		err = generator.Run()
+		require.EqualError(t, err, message)
+	}
+}
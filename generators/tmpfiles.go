@@ -0,0 +1,207 @@
+package generators
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+type tmpfiles struct {
+	common
+}
+
+// RunLXC creates the files of the tmpfiles entries.
+func (g *tmpfiles) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD creates the files of the tmpfiles entries.
+func (g *tmpfiles) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	return g.Run()
+}
+
+// Run creates the directories, files, symlinks and devices of the tmpfiles
+// entries, in order. Like systemd-tmpfiles, existing files are kept unless
+// the type ends with "+", and the mode and owner of existing directories,
+// files and devices are adjusted.
+func (g *tmpfiles) Run() error {
+	passwd, err := readAccountDB(filepath.Join(g.sourceDir, "etc/passwd"), 7)
+	if err != nil {
+		return err
+	}
+
+	group, err := readAccountDB(filepath.Join(g.sourceDir, "etc/group"), 4)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range g.defFile.Tmpfiles {
+		entry, err := shared.ParseTmpfilesEntry(line)
+		if err != nil {
+			return fmt.Errorf("Invalid tmpfiles entry %q: %w", line, err)
+		}
+
+		uid, err := lookupID(passwd, entry.User)
+		if err != nil {
+			return fmt.Errorf("Failed to find user of %q: %w", entry.Path, err)
+		}
+
+		gid, err := lookupID(group, entry.Group)
+		if err != nil {
+			return fmt.Errorf("Failed to find group of %q: %w", entry.Path, err)
+		}
+
+		err = g.create(entry, uid, gid)
+		if err != nil {
+			return fmt.Errorf("Failed to create %q: %w", entry.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// create creates the file of the entry, owned by uid and gid.
+func (g *tmpfiles) create(entry *shared.TmpfilesEntry, uid int, gid int) error {
+	path := filepath.Join(g.sourceDir, entry.Path)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	exists := err == nil
+
+	// Directories aren't replaced, as their content would be lost.
+	if exists && entry.Replace {
+		err = os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("Failed to remove %q: %w", path, err)
+		}
+
+		exists = false
+	}
+
+	switch entry.Type {
+	case "d":
+		if exists && !info.IsDir() {
+			return fmt.Errorf("%q exists and isn't a directory", entry.Path)
+		}
+
+		if !exists {
+			err = os.Mkdir(path, 0755)
+		}
+
+	case "f":
+		if exists && !info.Mode().IsRegular() {
+			return fmt.Errorf("%q exists and isn't a regular file", entry.Path)
+		}
+
+		if !exists {
+			err = os.WriteFile(path, []byte(entry.Argument), 0644)
+		}
+
+	case "L":
+		// Existing files are kept, and so are their owners.
+		if exists {
+			return nil
+		}
+
+		err = os.Symlink(entry.Argument, path)
+		if err != nil {
+			return err
+		}
+
+		return os.Lchown(path, uid, gid)
+
+	case "b", "c":
+		if exists && info.Mode()&(fs.ModeDevice|fs.ModeCharDevice) == 0 {
+			return fmt.Errorf("%q exists and isn't a device", entry.Path)
+		}
+
+		if !exists {
+			major, minor, _ := entry.Device()
+
+			mode := uint32(unix.S_IFCHR)
+			if entry.Type == "b" {
+				mode = unix.S_IFBLK
+			}
+
+			err = unix.Mknod(path, mode|entry.Mode, int(unix.Mkdev(major, minor)))
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The mode of new files is affected by the umask, and the one of existing
+	// files is adjusted.
+	err = os.Chmod(path, fs.FileMode(entry.Mode&0777)|modeBits(entry.Mode))
+	if err != nil {
+		return fmt.Errorf("Failed to change mode of %q: %w", path, err)
+	}
+
+	err = os.Chown(path, uid, gid)
+	if err != nil {
+		return fmt.Errorf("Failed to change owner of %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// modeBits returns the setuid, setgid and sticky bits of an octal mode.
+func modeBits(mode uint32) fs.FileMode {
+	var bits fs.FileMode
+
+	if mode&unix.S_ISUID != 0 {
+		bits |= fs.ModeSetuid
+	}
+
+	if mode&unix.S_ISGID != 0 {
+		bits |= fs.ModeSetgid
+	}
+
+	if mode&unix.S_ISVTX != 0 {
+		bits |= fs.ModeSticky
+	}
+
+	return bits
+}
+
+// lookupID returns the ID of the given user or group name of the rootfs. IDs
+// are returned as is, and an unset name is root.
+func lookupID(db *accountDB, name string) (int, error) {
+	if name == "-" {
+		return 0, nil
+	}
+
+	id, err := strconv.Atoi(name)
+	if err == nil {
+		return id, nil
+	}
+
+	entry := db.find(name)
+	if entry == nil {
+		return 0, fmt.Errorf("%q doesn't exist in the rootfs", name)
+	}
+
+	id, err = strconv.Atoi(entry[2])
+	if err != nil {
+		return 0, fmt.Errorf("Invalid ID of %q in %q", name, db.path)
+	}
+
+	return id, nil
+}
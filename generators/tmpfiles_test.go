@@ -0,0 +1,113 @@
+package generators
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestTmpfilesGeneratorRunLXD(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/passwd"), "root:x:0:0:root:/root:/bin/sh\nfoo:x:1001:1001::/var/lib/foo:/usr/sbin/nologin\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/group"), "root:x:0:\nadm:x:4:\nfoo:x:1001:\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/foo.conf"), "old")
+
+	defFile := shared.DefinitionFile{
+		Generator: "tmpfiles",
+		Tmpfiles: []string{
+			"d /var/lib/foo 0750 foo foo",
+			"d /var/lib/foo/cache",
+			"f /var/log/foo.log 0640 foo adm - first line",
+			"f /etc/foo.conf 0600",
+			"L /usr/lib/foo/foo.conf - - - - /etc/foo.conf",
+			"d /srv/shared 1777",
+		},
+	}
+
+	definition := shared.Definition{}
+
+	generator, err := Load("tmpfiles", nil, cacheDir, rootfsDir, defFile, definition)
+	require.IsType(t, &tmpfiles{}, generator)
+	require.NoError(t, err)
+
+	img := image.NewLXDImage(context.TODO(), cacheDir, "", cacheDir, definition)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+
+	requireFile := func(path string, mode os.FileMode, uid uint32, gid uint32) {
+		t.Helper()
+
+		info, err := os.Lstat(filepath.Join(rootfsDir, path))
+		require.NoError(t, err)
+		require.Equal(t, mode, info.Mode().Perm()|info.Mode()&os.ModeSticky, path)
+		require.Equal(t, uid, info.Sys().(*syscall.Stat_t).Uid, path)
+		require.Equal(t, gid, info.Sys().(*syscall.Stat_t).Gid, path)
+	}
+
+	requireFile("var/lib/foo", 0750, 1001, 1001)
+	requireFile("var/lib/foo/cache", 0755, 0, 0)
+	requireFile("var/log/foo.log", 0640, 1001, 4)
+	requireFile("srv/shared", 0777|os.ModeSticky, 0, 0)
+	validateTestFile(t, filepath.Join(rootfsDir, "var/log/foo.log"), "first line")
+
+	// Existing files are kept, but their mode is adjusted.
+	requireFile("etc/foo.conf", 0600, 0, 0)
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/foo.conf"), "old")
+
+	target, err := os.Readlink(filepath.Join(rootfsDir, "usr/lib/foo/foo.conf"))
+	require.NoError(t, err)
+	require.Equal(t, "/etc/foo.conf", target)
+
+	// Files are replaced with "+".
+	defFile.Tmpfiles = []string{"f+ /etc/foo.conf - - - - new", "L+ /usr/lib/foo/foo.conf - - - - /etc/bar.conf"}
+
+	generator, err = Load("tmpfiles", nil, cacheDir, rootfsDir, defFile, definition)
+	require.NoError(t, err)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+
+	requireFile("etc/foo.conf", 0644, 0, 0)
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/foo.conf"), "new")
+
+	target, err = os.Readlink(filepath.Join(rootfsDir, "usr/lib/foo/foo.conf"))
+	require.NoError(t, err)
+	require.Equal(t, "/etc/bar.conf", target)
+
+	// Users need to exist in the rootfs.
+	defFile.Tmpfiles = []string{"d /var/lib/bar 0750 bar"}
+
+	generator, err = Load("tmpfiles", nil, cacheDir, rootfsDir, defFile, definition)
+	require.NoError(t, err)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.EqualError(t, err, `Failed to find user of "/var/lib/bar": "bar" doesn't exist in the rootfs`)
+
+	// Directories aren't replaced by other files.
+	defFile.Tmpfiles = []string{"f+ /var/lib/foo"}
+
+	generator, err = Load("tmpfiles", nil, cacheDir, rootfsDir, defFile, definition)
+	require.NoError(t, err)
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.ErrorContains(t, err, `Failed to create "/var/lib/foo"`)
+	require.DirExists(t, filepath.Join(rootfsDir, "var/lib/foo"))
+}
@@ -0,0 +1,585 @@
+package generators
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/canonical/lxd/shared/api"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// The IDs of new users and groups are allocated from this range.
+const (
+	usersFirstID = 1000
+	usersLastID  = 59999
+)
+
+type users struct {
+	common
+}
+
+// account is a user account created or updated by the generator.
+type account struct {
+	name string
+	home string
+	uid  int
+	gid  int
+}
+
+// RunLXC creates the user accounts.
+func (g *users) RunLXC(img *image.LXCImage, target shared.DefinitionTargetLXC) error {
+	return g.Run()
+}
+
+// RunLXD creates the user accounts, and templates for their authorized_keys,
+// which add the keys set in the user.<name>.ssh_authorized_keys config key of
+// the instance.
+func (g *users) RunLXD(img *image.LXDImage, target shared.DefinitionTargetLXD) error {
+	accounts, err := g.run()
+	if err != nil {
+		return err
+	}
+
+	templateDir := filepath.Join(g.cacheDir, "templates")
+
+	err = os.MkdirAll(templateDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", templateDir, err)
+	}
+
+	when := g.defFile.Template.When
+	if len(when) == 0 {
+		when = []string{"create", "copy"}
+	}
+
+	for i, a := range accounts {
+		// LXD creates missing files as root, so the file has to exist.
+		err := g.installAuthorizedKeys(a, g.defFile.Users[i].SSHAuthorizedKeys)
+		if err != nil {
+			return err
+		}
+
+		var content strings.Builder
+
+		for _, key := range g.defFile.Users[i].SSHAuthorizedKeys {
+			content.WriteString(key + "\n")
+		}
+
+		configKey := fmt.Sprintf("user.%s.ssh_authorized_keys", a.name)
+
+		fmt.Fprintf(&content, "{%% if config_get(%q, \"\") != \"\" %%}{{ config_get(%q, \"\") }}\n{%% endif %%}", configKey, configKey)
+
+		template := fmt.Sprintf("users-%s-authorized_keys.tpl", a.name)
+
+		err = os.WriteFile(filepath.Join(templateDir, template), []byte(content.String()), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write file %q: %w", filepath.Join(templateDir, template), err)
+		}
+
+		img.Metadata.Templates[filepath.Join(a.home, ".ssh/authorized_keys")] = &api.ImageMetadataTemplate{
+			Template:   template,
+			Properties: g.defFile.Template.Properties,
+			When:       when,
+		}
+	}
+
+	return nil
+}
+
+// Run creates the user accounts.
+func (g *users) Run() error {
+	_, err := g.run()
+
+	return err
+}
+
+// run creates or updates the user accounts by editing the account databases
+// of the rootfs, as not all distributions ship useradd, and returns them in
+// the order of the definition.
+func (g *users) run() ([]account, error) {
+	if len(g.defFile.Users) == 0 {
+		return nil, errors.New("Missing users")
+	}
+
+	db, err := readAccountDBs(g.sourceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []account
+
+	for _, user := range g.defFile.Users {
+		a, created, err := g.addUser(db, user)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to add user %q: %w", user.Name, err)
+		}
+
+		for _, name := range user.Groups {
+			err := db.addMember(name, user.Name)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to add user %q to group %q: %w", user.Name, name, err)
+			}
+		}
+
+		accounts = append(accounts, a)
+
+		if created {
+			err := g.createHome(a)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if user.Sudo {
+			err := g.allowSudo(user)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(user.SSHAuthorizedKeys) > 0 {
+			err := g.installAuthorizedKeys(a, user.SSHAuthorizedKeys)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = db.write()
+	if err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+// addUser adds the user to the account databases, or updates the shell and
+// password of an existing user. It returns whether the user was created.
+func (g *users) addUser(db *accountDBs, user shared.DefinitionFileUser) (account, bool, error) {
+	password := ""
+
+	if user.Password != "" {
+		password = user.Password
+
+		if user.Locked {
+			password = "!" + password
+		}
+	} else if user.Locked {
+		password = "!"
+	}
+
+	entry := db.passwd.find(user.Name)
+	if entry != nil {
+		if user.Shell != "" {
+			entry[6] = user.Shell
+		}
+
+		if password != "" {
+			db.setPassword(user.Name, password)
+		}
+
+		uid, _ := strconv.Atoi(entry[2])
+		gid, _ := strconv.Atoi(entry[3])
+
+		return account{name: user.Name, home: entry[5], uid: uid, gid: gid}, false, nil
+	}
+
+	uid, err := db.passwd.allocateID(user.UID)
+	if err != nil {
+		return account{}, false, err
+	}
+
+	var gid int
+
+	group := db.group.find(user.Name)
+
+	switch {
+	case user.GID != "":
+		gid, _ = strconv.Atoi(user.GID)
+
+		// The primary group is created if it doesn't exist yet.
+		if db.group.findID(gid) == nil {
+			if group != nil {
+				return account{}, false, fmt.Errorf("Group %q already exists with another GID", user.Name)
+			}
+
+			db.addGroup(user.Name, gid)
+		}
+	case group != nil:
+		gid, _ = strconv.Atoi(group[2])
+	default:
+		gid = uid
+
+		// The GID matches the UID if it's free.
+		if db.group.findID(gid) != nil {
+			gid, err = db.group.allocateID("")
+			if err != nil {
+				return account{}, false, err
+			}
+		}
+
+		db.addGroup(user.Name, gid)
+	}
+
+	home := user.Home
+	if home == "" {
+		home = filepath.Join("/home", user.Name)
+	}
+
+	shell := user.Shell
+	if shell == "" {
+		shell = "/bin/sh"
+
+		if lxdShared.PathExists(filepath.Join(g.sourceDir, "bin/bash")) {
+			shell = "/bin/bash"
+		}
+	}
+
+	// Without a password, logging in with a password is disabled.
+	if password == "" {
+		password = "*"
+	}
+
+	lastChange := strconv.FormatInt(shared.BuildDate().Unix()/(24*60*60), 10)
+
+	db.passwd.entries = append(db.passwd.entries, []string{user.Name, "x", strconv.Itoa(uid), strconv.Itoa(gid), "", home, shell})
+	db.shadow.entries = append(db.shadow.entries, []string{user.Name, password, lastChange, "0", "99999", "7", "", "", ""})
+
+	return account{name: user.Name, home: home, uid: uid, gid: gid}, true, nil
+}
+
+// createHome creates the home directory of a new user from /etc/skel, unless
+// it exists already.
+func (g *users) createHome(a account) error {
+	home := filepath.Join(g.sourceDir, a.home)
+
+	if lxdShared.PathExists(home) {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(home), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(home), err)
+	}
+
+	skel := filepath.Join(g.sourceDir, "etc/skel")
+
+	if lxdShared.PathExists(skel) {
+		err = shared.CopyTree(context.Background(), skel, home, nil)
+		if err != nil {
+			return fmt.Errorf("Failed to copy %q: %w", skel, err)
+		}
+	} else {
+		err = os.Mkdir(home, 0750)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", home, err)
+		}
+	}
+
+	err = filepath.WalkDir(home, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		return os.Lchown(path, a.uid, a.gid)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to change owner of %q: %w", home, err)
+	}
+
+	err = os.Chmod(home, 0750)
+	if err != nil {
+		return fmt.Errorf("Failed to change permissions of %q: %w", home, err)
+	}
+
+	return nil
+}
+
+// allowSudo allows the user to run any command using sudo. Users without a
+// usable password don't need to enter one.
+func (g *users) allowSudo(user shared.DefinitionFileUser) error {
+	if !lxdShared.PathExists(filepath.Join(g.sourceDir, "etc/sudoers")) {
+		return fmt.Errorf("Failed to allow sudo for user %q: sudo isn't installed", user.Name)
+	}
+
+	dir := filepath.Join(g.sourceDir, "etc/sudoers.d")
+
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", dir, err)
+	}
+
+	rule := fmt.Sprintf("%s ALL=(ALL:ALL) ALL\n", user.Name)
+
+	if user.Password == "" || user.Locked {
+		rule = fmt.Sprintf("%s ALL=(ALL:ALL) NOPASSWD: ALL\n", user.Name)
+	}
+
+	// sudo skips files containing dots.
+	path := filepath.Join(dir, "90-"+strings.ReplaceAll(user.Name, ".", "_"))
+
+	err = os.WriteFile(path, []byte(rule), 0440)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// installAuthorizedKeys writes the authorized_keys of the user. The file is
+// written even without keys.
+func (g *users) installAuthorizedKeys(a account, keys []string) error {
+	sshDir := filepath.Join(g.sourceDir, a.home, ".ssh")
+
+	err := os.MkdirAll(sshDir, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", sshDir, err)
+	}
+
+	path := filepath.Join(sshDir, "authorized_keys")
+
+	var content string
+
+	for _, key := range keys {
+		content += key + "\n"
+	}
+
+	err = os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", path, err)
+	}
+
+	for _, p := range []string{sshDir, path} {
+		err := os.Lchown(p, a.uid, a.gid)
+		if err != nil {
+			return fmt.Errorf("Failed to change owner of %q: %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+// accountDB is a colon separated account database like /etc/passwd.
+type accountDB struct {
+	path    string
+	fields  int
+	entries [][]string
+
+	// exists is whether the file exists in the rootfs.
+	exists bool
+}
+
+// readAccountDB reads the database at path, which doesn't need to exist.
+func readAccountDB(path string, fields int) (*accountDB, error) {
+	db := &accountDB{path: path, fields: fields}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return db, nil
+		}
+
+		return nil, fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	db.exists = true
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+
+		entry := strings.Split(line, ":")
+
+		for len(entry) < fields {
+			entry = append(entry, "")
+		}
+
+		db.entries = append(db.entries, entry)
+	}
+
+	return db, nil
+}
+
+// find returns the entry with the given name.
+func (db *accountDB) find(name string) []string {
+	for _, entry := range db.entries {
+		if entry[0] == name {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// findID returns the entry with the given ID.
+func (db *accountDB) findID(id int) []string {
+	for _, entry := range db.entries {
+		if entry[2] == strconv.Itoa(id) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// allocateID returns the requested ID if it's free, or the first free ID if
+// none is requested.
+func (db *accountDB) allocateID(requested string) (int, error) {
+	if requested != "" {
+		id, _ := strconv.Atoi(requested)
+
+		entry := db.findID(id)
+		if entry != nil {
+			return 0, fmt.Errorf("ID %d is already used by %q", id, entry[0])
+		}
+
+		return id, nil
+	}
+
+	for id := usersFirstID; id <= usersLastID; id++ {
+		if db.findID(id) == nil {
+			return id, nil
+		}
+	}
+
+	return 0, errors.New("No free ID left")
+}
+
+// write writes the database, keeping the permissions of an existing file.
+func (db *accountDB) write() error {
+	var content strings.Builder
+
+	for _, entry := range db.entries {
+		content.WriteString(strings.Join(entry, ":") + "\n")
+	}
+
+	err := os.WriteFile(db.path, []byte(content.String()), 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", db.path, err)
+	}
+
+	return nil
+}
+
+// accountDBs are the account databases of a rootfs.
+type accountDBs struct {
+	passwd  *accountDB
+	shadow  *accountDB
+	group   *accountDB
+	gshadow *accountDB
+}
+
+// readAccountDBs reads the account databases of the rootfs. /etc/passwd and
+// /etc/group need to exist.
+func readAccountDBs(rootfsDir string) (*accountDBs, error) {
+	db := &accountDBs{}
+
+	for _, d := range []struct {
+		db     **accountDB
+		path   string
+		fields int
+	}{
+		{&db.passwd, "etc/passwd", 7},
+		{&db.shadow, "etc/shadow", 9},
+		{&db.group, "etc/group", 4},
+		{&db.gshadow, "etc/gshadow", 4},
+	} {
+		var err error
+
+		*d.db, err = readAccountDB(filepath.Join(rootfsDir, d.path), d.fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !db.passwd.exists || !db.group.exists {
+		return nil, errors.New("Missing /etc/passwd or /etc/group in the rootfs")
+	}
+
+	return db, nil
+}
+
+// setPassword sets the password hash of the user in /etc/shadow.
+func (db *accountDBs) setPassword(name string, password string) {
+	entry := db.shadow.find(name)
+	if entry == nil {
+		entry = []string{name, "", strconv.FormatInt(shared.BuildDate().Unix()/(24*60*60), 10), "0", "99999", "7", "", "", ""}
+		db.shadow.entries = append(db.shadow.entries, entry)
+	}
+
+	entry[1] = password
+}
+
+// addGroup adds a group without members.
+func (db *accountDBs) addGroup(name string, gid int) {
+	db.group.entries = append(db.group.entries, []string{name, "x", strconv.Itoa(gid), ""})
+
+	if db.gshadow.exists {
+		db.gshadow.entries = append(db.gshadow.entries, []string{name, "!", "", ""})
+	}
+}
+
+// addMember adds the user to the group, which is created if it doesn't exist.
+func (db *accountDBs) addMember(group string, user string) error {
+	if db.group.find(group) == nil {
+		gid, err := db.group.allocateID("")
+		if err != nil {
+			return err
+		}
+
+		db.addGroup(group, gid)
+	}
+
+	dbs := []*accountDB{db.group}
+
+	if db.gshadow.exists {
+		dbs = append(dbs, db.gshadow)
+	}
+
+	for _, d := range dbs {
+		entry := d.find(group)
+		if entry == nil {
+			continue
+		}
+
+		var members []string
+
+		if entry[3] != "" {
+			members = strings.Split(entry[3], ",")
+		}
+
+		if !slices.Contains(members, user) {
+			entry[3] = strings.Join(append(members, user), ",")
+		}
+	}
+
+	return nil
+}
+
+// write writes the account databases. /etc/gshadow is only written if it
+// exists.
+func (db *accountDBs) write() error {
+	for _, d := range []*accountDB{db.passwd, db.shadow, db.group, db.gshadow} {
+		if d == db.gshadow && !d.exists {
+			continue
+		}
+
+		err := d.write()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
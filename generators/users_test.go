@@ -0,0 +1,133 @@
+package generators
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/image"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func setupUsersRootfs(t *testing.T, rootfsDir string) {
+	t.Helper()
+
+	for _, dir := range []string{"etc/skel", "bin", "home/existing"} {
+		err := os.MkdirAll(filepath.Join(rootfsDir, dir), 0755)
+		require.NoError(t, err)
+	}
+
+	createTestFile(t, filepath.Join(rootfsDir, "etc/passwd"), "root:x:0:0:root:/root:/bin/sh\nexisting:x:1000:1000::/home/existing:/bin/sh\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/shadow"), "root:*:19000:0:99999:7:::\nexisting:*:19000:0:99999:7:::\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/group"), "root:x:0:\nsudo:x:27:\nexisting:x:1000:\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/gshadow"), "root:*::\nsudo:*::\nexisting:!::\n")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/sudoers"), "")
+	createTestFile(t, filepath.Join(rootfsDir, "etc/skel/.profile"), "# profile\n")
+	createTestFile(t, filepath.Join(rootfsDir, "bin/bash"), "")
+}
+
+func TestUsersGeneratorRun(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	setupUsersRootfs(t, rootfsDir)
+
+	shared.SetBuildDate(time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC))
+	defer shared.SetBuildDate(time.Time{})
+
+	defFile := shared.DefinitionFile{
+		Generator: "users",
+		Users: []shared.DefinitionFileUser{
+			{
+				Name:              "admin",
+				Groups:            []string{"sudo", "docker"},
+				Sudo:              true,
+				SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA admin@example"},
+			},
+			{
+				Name:     "existing",
+				Shell:    "/bin/bash",
+				Password: "$6$salt$hash",
+				Locked:   true,
+			},
+		},
+	}
+
+	generator, err := Load("users", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.IsType(t, &users{}, generator)
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/passwd"), "root:x:0:0:root:/root:/bin/sh\nexisting:x:1000:1000::/home/existing:/bin/bash\nadmin:x:1001:1001::/home/admin:/bin/bash\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/shadow"), "root:*:19000:0:99999:7:::\nexisting:!$6$salt$hash:19000:0:99999:7:::\nadmin:*:19792:0:99999:7:::\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/group"), "root:x:0:\nsudo:x:27:admin\nexisting:x:1000:\nadmin:x:1001:\ndocker:x:1002:admin\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/gshadow"), "root:*::\nsudo:*::admin\nexisting:!::\nadmin:!::\ndocker:!::admin\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "etc/sudoers.d/90-admin"), "admin ALL=(ALL:ALL) NOPASSWD: ALL\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "home/admin/.profile"), "# profile\n")
+	validateTestFile(t, filepath.Join(rootfsDir, "home/admin/.ssh/authorized_keys"), "ssh-ed25519 AAAA admin@example\n")
+
+	info, err := os.Stat(filepath.Join(rootfsDir, "home/admin/.ssh/authorized_keys"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	require.Equal(t, uint32(1001), info.Sys().(*syscall.Stat_t).Uid)
+
+	info, err = os.Stat(filepath.Join(rootfsDir, "home/admin"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), info.Mode().Perm())
+
+	// IDs which are already used are rejected.
+	defFile.Users = []shared.DefinitionFileUser{{Name: "other", UID: "1000"}}
+
+	generator, err = Load("users", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.NoError(t, err)
+
+	err = generator.Run()
+	require.EqualError(t, err, `Failed to add user "other": ID 1000 is already used by "existing"`)
+}
+
+func TestUsersGeneratorRunLXD(t *testing.T) {
+	cacheDir, err := os.MkdirTemp(os.TempDir(), "lxd-imagebuilder-test-")
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(cacheDir, "rootfs")
+
+	setup(t, cacheDir)
+	defer teardown(cacheDir)
+
+	setupUsersRootfs(t, rootfsDir)
+
+	defFile := shared.DefinitionFile{
+		Generator: "users",
+		Users: []shared.DefinitionFileUser{
+			{Name: "admin", SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA admin@example"}},
+			{Name: "guest"},
+		},
+	}
+
+	generator, err := Load("users", nil, cacheDir, rootfsDir, defFile, shared.Definition{})
+	require.NoError(t, err)
+
+	img := image.NewLXDImage(context.TODO(), cacheDir, "", cacheDir, shared.Definition{})
+
+	err = generator.RunLXD(img, shared.DefinitionTargetLXD{})
+	require.NoError(t, err)
+
+	validateTestFile(t, filepath.Join(cacheDir, "templates/users-admin-authorized_keys.tpl"), "ssh-ed25519 AAAA admin@example\n"+`{% if config_get("user.admin.ssh_authorized_keys", "") != "" %}{{ config_get("user.admin.ssh_authorized_keys", "") }}`+"\n{% endif %}")
+	validateTestFile(t, filepath.Join(rootfsDir, "home/guest/.ssh/authorized_keys"), "")
+
+	require.Contains(t, img.Metadata.Templates, "/home/admin/.ssh/authorized_keys")
+	require.Contains(t, img.Metadata.Templates, "/home/guest/.ssh/authorized_keys")
+	require.Equal(t, []string{"create", "copy"}, img.Metadata.Templates["/home/guest/.ssh/authorized_keys"].When)
+}
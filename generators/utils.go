@@ -1,10 +1,14 @@
 package generators
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 
+	lxdShared "github.com/canonical/lxd/shared"
+
 	"github.com/canonical/lxd-imagebuilder/shared"
 )
 
@@ -50,3 +54,30 @@ func updateFileAccess(file *os.File, defFile shared.DefinitionFile) error {
 
 	return nil
 }
+
+// runInChroot runs a command inside of the rootfs. Generators run after the
+// rootfs was populated, so they set up a chroot of their own.
+func runInChroot(sourceDir string, def shared.Definition, name string, arg ...string) error {
+	exitChroot, err := shared.SetupChroot(sourceDir, def, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to setup chroot: %w", err)
+	}
+
+	err = shared.RunCommand(context.Background(), nil, nil, name, arg...)
+	if err != nil {
+		_ = exitChroot()
+		return fmt.Errorf("Failed to run %q: %w", name, err)
+	}
+
+	err = exitChroot()
+	if err != nil {
+		return fmt.Errorf("Failed to exit chroot: %w", err)
+	}
+
+	return nil
+}
+
+// exists returns whether the path exists inside of the rootfs.
+func (g *common) exists(path string) bool {
+	return lxdShared.PathExists(filepath.Join(g.sourceDir, path))
+}
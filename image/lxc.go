@@ -6,7 +6,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
 
 	lxdShared "github.com/canonical/lxd/shared"
 
@@ -75,7 +74,7 @@ func (l *LXCImage) Build(compression string) error {
 		return fmt.Errorf("Failed to pack metadata: %w", err)
 	}
 
-	_, err = shared.Pack(l.ctx, filepath.Join(l.targetDir, "rootfs.tar"), compression, l.sourceDir, ".")
+	_, err = shared.Pack(l.ctx, filepath.Join(l.targetDir, "rootfs.tar"), compression, l.sourceDir, l.definition.Targets.Tar, ".")
 	if err != nil {
 		return fmt.Errorf("Failed to pack %q: %w", filepath.Join(l.targetDir, "rootfs.tar"), err)
 	}
@@ -144,7 +143,7 @@ func (l *LXCImage) createMetadata() error {
 	}
 
 	err = l.writeMetadata(filepath.Join(metaDir, "expiry"),
-		fmt.Sprint(shared.GetExpiryDate(time.Now(), l.definition.Image.Expiry).Unix()),
+		fmt.Sprint(shared.GetExpiryDate(shared.BuildDate(), l.definition.Image.Expiry).Unix()),
 		false)
 	if err != nil {
 		return fmt.Errorf("Error writing 'expiry': %w", err)
@@ -197,7 +196,7 @@ func (l *LXCImage) packMetadata() error {
 	}
 
 	_, err = shared.Pack(l.ctx, filepath.Join(l.targetDir, "meta.tar"), "xz",
-		filepath.Join(l.cacheDir, "metadata"), files...)
+		filepath.Join(l.cacheDir, "metadata"), l.definition.Targets.Tar, files...)
 	if err != nil {
 		return fmt.Errorf("Failed to create metadata: %w", err)
 	}
@@ -2,11 +2,13 @@ package image
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/canonical/lxd/shared/api"
 	"gopkg.in/yaml.v2"
@@ -108,12 +110,12 @@ func (l *LXDImage) Build(unified bool, compression string, vm bool) (string, str
 				return "", "", fmt.Errorf("Failed to rename image %q -> %q: %w", qcowImage, filepath.Join(filepath.Dir(qcowImage), "rootfs.img"), err)
 			}
 
-			_, err = shared.Pack(l.ctx, targetTarball, "", l.cacheDir, "rootfs.img")
+			_, err = shared.Pack(l.ctx, targetTarball, "", l.cacheDir, l.definition.Targets.Tar, "rootfs.img")
 		} else {
 			// Add the rootfs to the tarball, prefix all files with "rootfs".
 			// We intentionally don't set any compression here, as PackUpdate (further down) cannot deal with compressed tarballs.
 			_, err = shared.Pack(l.ctx, targetTarball,
-				"", l.sourceDir, "--transform", "s,^./,rootfs/,", ".")
+				"", l.sourceDir, l.definition.Targets.Tar, "--transform", "s,^./,rootfs/,", ".")
 		}
 
 		if err != nil {
@@ -127,7 +129,7 @@ func (l *LXDImage) Build(unified bool, compression string, vm bool) (string, str
 		}()
 
 		// Add the metadata to the tarball which is located in the cache directory
-		imageFile, err = shared.PackUpdate(l.ctx, targetTarball, compression, l.cacheDir, paths...)
+		imageFile, err = shared.PackUpdate(l.ctx, targetTarball, compression, l.cacheDir, l.definition.Targets.Tar, paths...)
 		if err != nil {
 			return "", "", fmt.Errorf("Failed to add metadata to tarball %q: %w", targetTarball, err)
 		}
@@ -161,7 +163,7 @@ func (l *LXDImage) Build(unified bool, compression string, vm bool) (string, str
 
 		// Create metadata tarball.
 		imageFile, err = shared.Pack(l.ctx, filepath.Join(l.targetDir, "lxd.tar"), compression,
-			l.cacheDir, paths...)
+			l.cacheDir, l.definition.Targets.Tar, paths...)
 		if err != nil {
 			return "", "", fmt.Errorf("Failed to create metadata tarball: %w", err)
 		}
@@ -173,28 +175,254 @@ func (l *LXDImage) Build(unified bool, compression string, vm bool) (string, str
 func (l *LXDImage) createMetadata() error {
 	var err error
 
-	l.Metadata.Architecture = l.definition.Image.Architecture
-	l.Metadata.CreationDate = time.Now().UTC().Unix()
+	buildDate := shared.BuildDate()
+
+	// The kernel architecture is unambiguous, unlike e.g. armhf.
+	l.Metadata.Architecture = l.definition.Image.ArchitectureKernel
+	if l.Metadata.Architecture == "" {
+		l.Metadata.Architecture = l.definition.Image.Architecture
+	}
+
+	l.Metadata.CreationDate = buildDate.Unix()
 	l.Metadata.Properties["architecture"] = l.definition.Image.ArchitectureMapped
-	l.Metadata.Properties["os"] = l.definition.Image.Distribution
-	l.Metadata.Properties["release"] = l.definition.Image.Release
-	l.Metadata.Properties["variant"] = l.definition.Image.Variant
 	l.Metadata.Properties["serial"] = l.definition.Image.Serial
 
-	l.Metadata.Properties["description"], err = shared.RenderTemplate(
-		l.definition.Image.Description, l.definition)
-	if err != nil {
-		return fmt.Errorf("Failed to render template: %w", err)
+	properties := map[string]string{
+		"os":          l.definition.Image.Distribution,
+		"release":     l.definition.Image.Release,
+		"variant":     l.definition.Image.Variant,
+		"description": l.definition.Image.Description,
+		"name":        l.definition.Image.Name,
 	}
 
-	l.Metadata.Properties["name"], err = shared.RenderTemplate(
-		l.definition.Image.Name, l.definition)
+	eol, ok, err := l.definition.Image.GetEOLDate()
 	if err != nil {
-		return fmt.Errorf("Failed to render template: %w", err)
+		return fmt.Errorf("Failed to get EOL date: %w", err)
+	}
+
+	if ok {
+		properties["eol"] = eol.Format(shared.EOLDateLayout)
+	}
+
+	// The requirements are image properties prefixed by "requirements.".
+	for key, value := range deriveRequirements(l.sourceDir, l.definition) {
+		properties["requirements."+key] = value
+	}
+
+	// Custom properties may add new keys or override the default ones.
+	for key, value := range l.definition.Targets.LXD.Properties {
+		properties[key] = value
+	}
+
+	for key, value := range properties {
+		l.Metadata.Properties[key], err = shared.RenderTemplate(value, l.definition)
+		if err != nil {
+			return fmt.Errorf("Failed to render template for property %q: %w", key, err)
+		}
 	}
 
-	l.Metadata.ExpiryDate = shared.GetExpiryDate(time.Now(),
+	l.Metadata.ExpiryDate = shared.GetExpiryDate(buildDate,
 		l.definition.Image.Expiry).Unix()
 
 	return nil
 }
+
+// SeedTools are the tools BuildSeed creates the seed ISO with, in the order of
+// preference.
+var SeedTools = []string{"genisoimage", "mkisofs", "xorrisofs"}
+
+// BuildSeed creates a NoCloud seed ISO in the target directory which can be
+// attached to the VM image when booting it outside of LXD.
+func (l *LXDImage) BuildSeed() (string, error) {
+	seed := l.definition.Targets.LXD.VM.Seed
+	if seed == nil {
+		return "", nil
+	}
+
+	var tool string
+
+	for _, name := range SeedTools {
+		_, err := exec.LookPath(name)
+		if err == nil {
+			tool = name
+			break
+		}
+	}
+
+	if tool == "" {
+		return "", errors.New("One of genisoimage, mkisofs or xorrisofs is required to create the seed")
+	}
+
+	seedDir := filepath.Join(l.cacheDir, "seed")
+
+	files, err := l.writeSeed(seedDir, *seed)
+	if err != nil {
+		return "", err
+	}
+
+	seedFile := filepath.Join(l.targetDir, "seed.iso")
+
+	err = shared.RunCommand(l.ctx, nil, nil, tool, append([]string{"-output", seedFile, "-volid", "cidata", "-joliet", "-rock"}, files...)...)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create seed %q: %w", seedFile, err)
+	}
+
+	return seedFile, nil
+}
+
+// BuildDisks creates the additional disks of the VM image as qcow2 files in
+// the target directory, and returns their paths.
+func (l *LXDImage) BuildDisks() ([]string, error) {
+	var files []string
+
+	for _, disk := range l.definition.Targets.LXD.VM.Disks {
+		rawFile := filepath.Join(l.cacheDir, fmt.Sprintf("disk-%s.raw", disk.Name))
+		qcowFile := filepath.Join(l.targetDir, fmt.Sprintf("disk-%s.qcow2", disk.Name))
+
+		err := l.createDisk(rawFile, disk)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create disk %q: %w", disk.Name, err)
+		}
+
+		err = shared.RunCommand(l.ctx, nil, nil, "qemu-img", "convert", "-c", "-O", "qcow2", rawFile, qcowFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert disk %q: %w", disk.Name, err)
+		}
+
+		err = os.Remove(rawFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to remove %q: %w", rawFile, err)
+		}
+
+		files = append(files, qcowFile)
+	}
+
+	return files, nil
+}
+
+// createDisk creates and formats the raw disk file. Seed disks are formatted as
+// vfat with the cidata label, and contain the NoCloud seed.
+func (l *LXDImage) createDisk(rawFile string, disk shared.DefinitionTargetLXDVMDisk) error {
+	f, err := os.Create(rawFile)
+	if err != nil {
+		return fmt.Errorf("Failed to create %q: %w", rawFile, err)
+	}
+
+	err = f.Truncate(int64(disk.Size))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to resize %q: %w", rawFile, err)
+	}
+
+	if disk.Type == "seed" {
+		err = shared.RunCommand(l.ctx, nil, nil, "mkfs.vfat", "-n", "CIDATA", rawFile)
+		if err != nil {
+			return fmt.Errorf("Failed to format seed disk: %w", err)
+		}
+
+		files, err := l.writeSeed(filepath.Join(l.cacheDir, "seed-disk"), *l.definition.Targets.LXD.VM.Seed)
+		if err != nil {
+			return err
+		}
+
+		err = shared.RunCommand(l.ctx, nil, nil, "mcopy", append(append([]string{"-i", rawFile}, files...), "::")...)
+		if err != nil {
+			return fmt.Errorf("Failed to copy seed to disk: %w", err)
+		}
+
+		return nil
+	}
+
+	var args []string
+
+	switch disk.Filesystem {
+	case "btrfs":
+		args = []string{"mkfs.btrfs", "-f", "-L", disk.Label}
+	case "ext4":
+		args = []string{"mkfs.ext4", "-F", "-L", disk.Label}
+	case "swap":
+		args = []string{"mkswap", "-L", disk.Label}
+	case "vfat":
+		args = []string{"mkfs.vfat", "-n", disk.Label}
+	case "xfs":
+		args = []string{"mkfs.xfs", "-f", "-L", disk.Label}
+	default:
+		return nil
+	}
+
+	err = shared.RunCommand(l.ctx, nil, nil, args[0], append(args[1:], rawFile)...)
+	if err != nil {
+		return fmt.Errorf("Failed to format disk: %w", err)
+	}
+
+	return nil
+}
+
+// EmbedSeed writes the NoCloud seed into the given root filesystem, where
+// cloud-init finds it without an attached seed.
+func (l *LXDImage) EmbedSeed(rootfsDir string) error {
+	seed := l.definition.Targets.LXD.VM.Seed
+	if seed == nil || !seed.Embed {
+		return nil
+	}
+
+	_, err := l.writeSeed(filepath.Join(rootfsDir, "var", "lib", "cloud", "seed", "nocloud"), *seed)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeSeed renders and writes the NoCloud seed files to the given directory.
+func (l *LXDImage) writeSeed(seedDir string, seed shared.DefinitionTargetLXDVMSeed) ([]string, error) {
+	err := os.MkdirAll(seedDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create directory %q: %w", seedDir, err)
+	}
+
+	if seed.UserData == "" {
+		seed.UserData = "#cloud-config\n{}\n"
+	}
+
+	if seed.MetaData == "" {
+		seed.MetaData = "instance-id: iid-{{ image.serial }}\nlocal-hostname: {{ image.distribution }}\n"
+	}
+
+	content := []struct {
+		name    string
+		content string
+	}{
+		{"user-data", seed.UserData},
+		{"meta-data", seed.MetaData},
+		{"network-config", seed.NetworkConfig},
+	}
+
+	var files []string
+
+	for _, c := range content {
+		if c.content == "" {
+			continue
+		}
+
+		out, err := shared.RenderTemplate(c.content, l.definition)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to render %q: %w", c.name, err)
+		}
+
+		if !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+
+		path := filepath.Join(seedDir, c.name)
+
+		err = os.WriteFile(path, []byte(out), 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to write %q: %w", path, err)
+		}
+
+		files = append(files, path)
+	}
+
+	return files, nil
+}
@@ -32,6 +32,13 @@ var lxdDef = shared.Definition{
 	Packages: shared.DefinitionPackages{
 		Manager: "apt",
 	},
+	Targets: shared.DefinitionTarget{
+		LXD: shared.DefinitionTargetLXD{
+			Properties: map[string]string{
+				"build": "{{ image.release }}-{{ image.serial }}",
+			},
+		},
+	},
 }
 
 func setupLXD(t *testing.T) (*LXDImage, string) {
@@ -163,6 +170,11 @@ func TestLXDCreateMetadata(t *testing.T) {
 			fmt.Sprintf("%s-%s-%s-%s", strings.ToLower(lxdDef.Image.Distribution),
 				lxdDef.Image.Release, "x86_64", lxdDef.Image.Serial),
 		},
+		{
+			"Properties[build]",
+			image.Metadata.Properties["build"],
+			fmt.Sprintf("%s-%s", lxdDef.Image.Release, lxdDef.Image.Serial),
+		},
 	}
 
 	for i, tt := range tests {
@@ -170,3 +182,49 @@ func TestLXDCreateMetadata(t *testing.T) {
 		require.Equal(t, tt.expected, tt.have)
 	}
 }
+
+func TestLXDWriteSeed(t *testing.T) {
+	image, cacheDir := setupLXD(t)
+	defer os.RemoveAll(cacheDir)
+
+	seedDir := filepath.Join(cacheDir, "seed")
+
+	files, err := image.writeSeed(seedDir, shared.DefinitionTargetLXDVMSeed{
+		UserData: "#cloud-config\npassword: {{ image.release }}",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(seedDir, "user-data"), filepath.Join(seedDir, "meta-data")}, files)
+
+	userData, err := os.ReadFile(filepath.Join(seedDir, "user-data"))
+	require.NoError(t, err)
+	require.Equal(t, "#cloud-config\npassword: 17.10\n", string(userData))
+
+	metaData, err := os.ReadFile(filepath.Join(seedDir, "meta-data"))
+	require.NoError(t, err)
+	require.Equal(t, "instance-id: iid-testing\nlocal-hostname: ubuntu\n", string(metaData))
+
+	require.NoFileExists(t, filepath.Join(seedDir, "network-config"))
+}
+
+func TestLXDEmbedSeed(t *testing.T) {
+	image, cacheDir := setupLXD(t)
+	defer os.RemoveAll(cacheDir)
+
+	rootfsDir := filepath.Join(cacheDir, "vm")
+
+	err := image.EmbedSeed(rootfsDir)
+	require.NoError(t, err)
+	require.NoDirExists(t, filepath.Join(rootfsDir, "var", "lib", "cloud"))
+
+	image.definition.Targets.LXD.VM.Seed = &shared.DefinitionTargetLXDVMSeed{
+		NetworkConfig: "version: 2",
+		Embed:         true,
+	}
+
+	err = image.EmbedSeed(rootfsDir)
+	require.NoError(t, err)
+
+	for _, name := range []string{"user-data", "meta-data", "network-config"} {
+		require.FileExists(t, filepath.Join(rootfsDir, "var", "lib", "cloud", "seed", "nocloud", name))
+	}
+}
@@ -0,0 +1,113 @@
+package image
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// systemdLibraryPatterns match the shared library of systemd, whose name
+// contains its version, e.g. libsystemd-shared-255.so.
+var systemdLibraryPatterns = []string{
+	"usr/lib/systemd/libsystemd-shared-*.so",
+	"usr/lib64/systemd/libsystemd-shared-*.so",
+	"usr/lib/*/systemd/libsystemd-shared-*.so",
+	"lib/systemd/libsystemd-shared-*.so",
+	"lib/*/systemd/libsystemd-shared-*.so",
+}
+
+// shimPatterns match the shim boot loader of Secure Boot, as installed by the
+// packages of the distributions.
+var shimPatterns = []string{
+	"boot/efi/EFI/*/shim*.efi",
+	"usr/lib/shim/shim*.efi*",
+	"usr/share/efi/*/shim*.efi",
+}
+
+// nestingBinaries are the container managers which need nesting to run
+// inside of a container.
+var nestingBinaries = []string{
+	"usr/bin/containerd",
+	"usr/bin/dockerd",
+	"usr/bin/incusd",
+	"usr/bin/lxd",
+	"usr/bin/podman",
+	"usr/sbin/lxd",
+}
+
+// systemdVersionPattern matches the version of the systemd shared library.
+var systemdVersionPattern = regexp.MustCompile(`libsystemd-shared-(\d+)`)
+
+// systemdCgroupV2Version is the first systemd version which doesn't boot
+// with cgroup v1 anymore.
+const systemdCgroupV2Version = 256
+
+// deriveRequirements returns the LXD image requirements of the rootfs, which
+// are checked by LXD before starting an instance of the image. The
+// requirements of the definition override them, and remove one if empty.
+func deriveRequirements(rootfsDir string, definition shared.Definition) map[string]string {
+	requirements := map[string]string{}
+
+	if definition.Targets.Type == shared.DefinitionFilterTypeVM {
+		bootloader := definition.Targets.LXD.VM.Bootloader
+
+		if (bootloader == nil || !bootloader.SecureBoot) && !hasMatch(rootfsDir, shimPatterns) {
+			requirements["secureboot"] = "false"
+		}
+	} else {
+		version, ok := systemdVersion(rootfsDir)
+		if ok && version >= systemdCgroupV2Version {
+			requirements["cgroup"] = "v2"
+		}
+
+		if hasMatch(rootfsDir, nestingBinaries) {
+			requirements["nesting"] = "true"
+		}
+	}
+
+	for key, value := range definition.Targets.LXD.Requirements {
+		if value == "" {
+			delete(requirements, key)
+			continue
+		}
+
+		requirements[key] = value
+	}
+
+	return requirements
+}
+
+// systemdVersion returns the major version of systemd in the rootfs.
+func systemdVersion(rootfsDir string) (int, bool) {
+	for _, pattern := range systemdLibraryPatterns {
+		matches, _ := filepath.Glob(filepath.Join(rootfsDir, pattern))
+
+		for _, match := range matches {
+			version := systemdVersionPattern.FindStringSubmatch(filepath.Base(match))
+			if version == nil {
+				continue
+			}
+
+			major, err := strconv.Atoi(version[1])
+			if err == nil {
+				return major, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// hasMatch returns whether one of the patterns matches a file of the rootfs.
+func hasMatch(rootfsDir string, patterns []string) bool {
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(rootfsDir, pattern))
+		if len(matches) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,51 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestDeriveRequirements(t *testing.T) {
+	writeFiles := func(t *testing.T, files ...string) string {
+		rootfsDir := t.TempDir()
+
+		for _, file := range files {
+			path := filepath.Join(rootfsDir, file)
+
+			err := os.MkdirAll(filepath.Dir(path), 0755)
+			require.NoError(t, err)
+
+			err = os.WriteFile(path, nil, 0644)
+			require.NoError(t, err)
+		}
+
+		return rootfsDir
+	}
+
+	container := shared.Definition{}
+	vm := shared.Definition{Targets: shared.DefinitionTarget{Type: shared.DefinitionFilterTypeVM}}
+
+	// An old systemd supports cgroup v1.
+	rootfsDir := writeFiles(t, "usr/lib/x86_64-linux-gnu/systemd/libsystemd-shared-255.so")
+	require.Empty(t, deriveRequirements(rootfsDir, container))
+
+	rootfsDir = writeFiles(t, "usr/lib/systemd/libsystemd-shared-257.5-2.fc42.so", "usr/bin/dockerd")
+	require.Equal(t, map[string]string{"cgroup": "v2", "nesting": "true"}, deriveRequirements(rootfsDir, container))
+
+	// The requirements of the definition take precedence.
+	container.Targets.LXD.Requirements = map[string]string{"nesting": "", "privileged": "true"}
+	require.Equal(t, map[string]string{"cgroup": "v2", "privileged": "true"}, deriveRequirements(rootfsDir, container))
+
+	require.Equal(t, map[string]string{"secureboot": "false"}, deriveRequirements(rootfsDir, vm))
+
+	rootfsDir = writeFiles(t, "usr/lib/shim/shimx64.efi.signed")
+	require.Empty(t, deriveRequirements(rootfsDir, vm))
+
+	vm.Targets.LXD.VM.Bootloader = &shared.DefinitionTargetLXDVMBootloader{Type: "grub", SecureBoot: true}
+	require.Empty(t, deriveRequirements(t.TempDir(), vm))
+}
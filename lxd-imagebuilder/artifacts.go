@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// lockDirectory takes an exclusive lock on the given directory, which is held
+// until the returned file is closed or the process exits.
+func lockDirectory(dir string) (*os.File, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %q: %w", dir, err)
+	}
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil {
+		f.Close()
+
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("Directory %q is in use by another build", dir)
+		}
+
+		return nil, fmt.Errorf("Failed to lock %q: %w", dir, err)
+	}
+
+	return f, nil
+}
+
+// removeDirectoryContent removes everything inside of the given directory.
+func removeDirectoryContent(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read directory %q: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		err := os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("Failed to remove %q: %w", filepath.Join(dir, entry.Name()), err)
+		}
+	}
+
+	return nil
+}
+
+// outputLayouts are the layouts of --output-layout.
+var outputLayouts = []string{"flat", "tree"}
+
+// outputTreeDir returns the directory the artifacts are published to inside of
+// the target directory with the tree layout. This is
+// <distribution>/<release>/<architecture>/<variant>/<serial>, as used by image
+// servers. The architecture uses the names of LXD, e.g. amd64.
+func outputTreeDir(def shared.Definition) (string, error) {
+	arch, err := shared.GetArch("debian", def.Image.Architecture)
+	if err != nil {
+		arch = def.Image.ArchitectureMapped
+	}
+
+	parts := []struct {
+		key   string
+		value string
+	}{
+		{"image.distribution", def.Image.Distribution},
+		{"image.release", def.Image.Release},
+		{"image.architecture", arch},
+		{"image.variant", def.Image.Variant},
+		{"image.serial", def.Image.Serial},
+	}
+
+	dirs := make([]string, 0, len(parts))
+
+	for _, part := range parts {
+		if part.value == "" || part.value == "." || part.value == ".." || strings.Contains(part.value, "/") {
+			return "", fmt.Errorf("Invalid %s %q for the tree output layout", part.key, part.value)
+		}
+
+		dirs = append(dirs, part.value)
+	}
+
+	return filepath.Join(dirs...), nil
+}
+
+// updateLatestLink points the latest symlink next to the given directory to
+// it. The symlink is replaced atomically, so it always points to a complete
+// build.
+func updateLatestLink(dir string) error {
+	link := filepath.Join(filepath.Dir(dir), "latest")
+	tmpLink := filepath.Join(filepath.Dir(dir), ".latest.tmp")
+
+	err := os.Remove(tmpLink)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to remove %q: %w", tmpLink, err)
+	}
+
+	err = os.Symlink(filepath.Base(dir), tmpLink)
+	if err != nil {
+		return fmt.Errorf("Failed to create symlink %q: %w", tmpLink, err)
+	}
+
+	err = os.Rename(tmpLink, link)
+	if err != nil {
+		_ = os.Remove(tmpLink)
+		return fmt.Errorf("Failed to update %q: %w", link, err)
+	}
+
+	return nil
+}
+
+// artifactStaging is a directory the artifacts are created in before they are
+// published to the target directory. It is placed inside of the target
+// directory, so publishing an artifact is an atomic rename.
+type artifactStaging struct {
+	ctx       context.Context
+	dir       string
+	targetDir string
+	logger    *logrus.Logger
+	encrypt   *shared.DefinitionTargetEncrypt
+
+	// latestDir is the directory the latest symlink is pointed to after
+	// publishing, if set.
+	latestDir string
+}
+
+func newArtifactStaging(ctx context.Context, targetDir string, logger *logrus.Logger, encrypt *shared.DefinitionTargetEncrypt) (*artifactStaging, error) {
+	// Fail before the build if the artifacts can't be encrypted.
+	if encrypt != nil {
+		_, err := exec.LookPath(encrypt.Method)
+		if err != nil {
+			return nil, fmt.Errorf("Required tool %q is missing", encrypt.Method)
+		}
+	}
+
+	dir, err := os.MkdirTemp(targetDir, ".lxd-imagebuilder.")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create staging directory in %q: %w", targetDir, err)
+	}
+
+	return &artifactStaging{ctx: ctx, dir: dir, targetDir: targetDir, logger: logger, encrypt: encrypt}, nil
+}
+
+// publish moves all artifacts to the target directory. Existing artifacts of
+// the same name are replaced. If targets.encrypt is set, the artifacts are
+// encrypted first. With the tree output layout, the latest symlink is updated
+// afterwards.
+func (s *artifactStaging) publish() error {
+	if s.encrypt != nil {
+		err := s.encryptArtifacts()
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read directory %q: %w", s.dir, err)
+	}
+
+	for _, entry := range entries {
+		target := filepath.Join(s.targetDir, entry.Name())
+
+		// Directories can't be replaced by renaming, so existing artifacts are
+		// removed first. Symlinks are removed, not their targets.
+		_, err := os.Lstat(target)
+		if err == nil {
+			s.logger.WithField("file", target).Warn("Replacing existing artifact")
+
+			err = os.RemoveAll(target)
+			if err != nil {
+				return fmt.Errorf("Failed to remove %q: %w", target, err)
+			}
+		}
+
+		err = os.Rename(filepath.Join(s.dir, entry.Name()), target)
+		if err != nil {
+			return fmt.Errorf("Failed to publish %q: %w", target, err)
+		}
+	}
+
+	err = s.remove()
+	if err != nil {
+		return err
+	}
+
+	if s.latestDir != "" {
+		return updateLatestLink(s.latestDir)
+	}
+
+	return nil
+}
+
+// previous returns the directory holding the artifacts of the previous build,
+// and its name used in the changelog. With the tree output layout, this is the
+// serial the latest symlink points to. Otherwise, it's the target directory,
+// as the artifacts haven't been replaced yet. The directory is empty if there's
+// no previous build.
+func (s *artifactStaging) previous() (string, string) {
+	if s.latestDir == "" {
+		return s.targetDir, "the previous build"
+	}
+
+	serial, err := os.Readlink(filepath.Join(filepath.Dir(s.latestDir), "latest"))
+	if err != nil {
+		return "", ""
+	}
+
+	rel, err := filepath.Rel(s.latestDir, s.targetDir)
+	if err != nil {
+		return "", ""
+	}
+
+	return filepath.Join(filepath.Dir(s.latestDir), serial, rel), serial
+}
+
+// path returns the path the given staged artifact is published to.
+func (s *artifactStaging) path(file string) string {
+	if file == "" {
+		return ""
+	}
+
+	rel, err := filepath.Rel(s.dir, file)
+	if err != nil {
+		return file
+	}
+
+	return filepath.Join(s.targetDir, rel)
+}
+
+// remove removes the staging directory including all unpublished artifacts.
+func (s *artifactStaging) remove() error {
+	err := os.RemoveAll(s.dir)
+	if err != nil {
+		return fmt.Errorf("Failed to remove %q: %w", s.dir, err)
+	}
+
+	return nil
+}
+
+// encryptArtifacts replaces all staged artifacts with their encrypted
+// version. The SHA256 checksums of the unencrypted artifacts are recorded in
+// the SHA256SUMS file, which isn't encrypted, so the artifacts can be
+// verified after decrypting them.
+func (s *artifactStaging) encryptArtifacts() error {
+	var files []string
+
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.Type().IsRegular() {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to read directory %q: %w", s.dir, err)
+	}
+
+	var sums strings.Builder
+
+	for _, file := range files {
+		name, err := filepath.Rel(s.dir, file)
+		if err != nil {
+			return err
+		}
+
+		sum, err := sha256File(file)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&sums, "%s  %s\n", sum, name)
+
+		s.logger.WithFields(logrus.Fields{"file": name, "sha256": sum, "method": s.encrypt.Method}).Info("Encrypting artifact")
+
+		target := file + "." + s.encrypt.Method
+
+		var args []string
+
+		if s.encrypt.Method == "age" {
+			args = []string{"--encrypt"}
+
+			for _, recipient := range s.encrypt.Recipients {
+				args = append(args, "-r", recipient)
+			}
+		} else {
+			args = []string{"--batch", "--yes", "--pinentry-mode", "loopback", "--passphrase-file", s.encrypt.PassphraseFile, "--symmetric", "--cipher-algo", "AES256"}
+		}
+
+		err = shared.RunCommand(s.ctx, nil, nil, s.encrypt.Method, append(args, "-o", target, file)...)
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt %q: %w", file, err)
+		}
+
+		err = os.Remove(file)
+		if err != nil {
+			return fmt.Errorf("Failed to remove %q: %w", file, err)
+		}
+	}
+
+	sumsFile := filepath.Join(s.dir, "SHA256SUMS")
+
+	err = os.WriteFile(sumsFile, []byte(sums.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", sumsFile, err)
+	}
+
+	return nil
+}
+
+// sha256File returns the hex encoded SHA256 checksum of the given file.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	hash := sha256.New()
+
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
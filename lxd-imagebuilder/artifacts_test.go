@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_lockDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	lock, err := lockDirectory(dir)
+	require.NoError(t, err)
+
+	_, err = lockDirectory(dir)
+	require.EqualError(t, err, `Directory "`+dir+`" is in use by another build`)
+
+	err = lock.Close()
+	require.NoError(t, err)
+
+	lock, err = lockDirectory(dir)
+	require.NoError(t, err)
+	require.NoError(t, lock.Close())
+}
+
+func Test_artifactStaging(t *testing.T) {
+	targetDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(targetDir, "rootfs.tar.xz"), []byte("old"), 0644)
+	require.NoError(t, err)
+
+	logger := logrus.New()
+	logOutput := &strings.Builder{}
+	logger.SetOutput(logOutput)
+
+	staging, err := newArtifactStaging(context.Background(), targetDir, logger, nil)
+	require.NoError(t, err)
+	require.Equal(t, targetDir, filepath.Dir(staging.dir))
+
+	for _, name := range []string{"meta.tar.xz", "rootfs.tar.xz"} {
+		err := os.WriteFile(filepath.Join(staging.dir, name), []byte("new"), 0644)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, filepath.Join(targetDir, "meta.tar.xz"), staging.path(filepath.Join(staging.dir, "meta.tar.xz")))
+	require.Equal(t, "", staging.path(""))
+
+	// Nothing is published before the build succeeded.
+	content, err := os.ReadFile(filepath.Join(targetDir, "rootfs.tar.xz"))
+	require.NoError(t, err)
+	require.Equal(t, "old", string(content))
+
+	err = staging.publish()
+	require.NoError(t, err)
+	require.NoDirExists(t, staging.dir)
+	require.Contains(t, logOutput.String(), "Replacing existing artifact")
+
+	for _, name := range []string{"meta.tar.xz", "rootfs.tar.xz"} {
+		content, err := os.ReadFile(filepath.Join(targetDir, name))
+		require.NoError(t, err)
+		require.Equal(t, "new", string(content))
+	}
+
+	// Removing a failed build leaves the target directory untouched.
+	staging, err = newArtifactStaging(context.Background(), targetDir, logger, nil)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(staging.dir, "meta.tar.xz"), []byte("failed"), 0644)
+	require.NoError(t, err)
+
+	err = staging.remove()
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(targetDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func Test_outputTreeDir(t *testing.T) {
+	def := shared.Definition{
+		Image: shared.DefinitionImage{
+			Distribution:       "ubuntu",
+			Release:            "noble",
+			Architecture:       "x86_64",
+			ArchitectureMapped: "amd64",
+			Variant:            "cloud",
+			Serial:             "20240310_0000",
+		},
+	}
+
+	dir, err := outputTreeDir(def)
+	require.NoError(t, err)
+	require.Equal(t, "ubuntu/noble/amd64/cloud/20240310_0000", dir)
+
+	// The architecture doesn't depend on the mapping of the distribution.
+	def.Image.Distribution = "centos"
+	def.Image.Release = "9-Stream"
+	def.Image.ArchitectureMapped = "x86_64"
+
+	dir, err = outputTreeDir(def)
+	require.NoError(t, err)
+	require.Equal(t, "centos/9-Stream/amd64/cloud/20240310_0000", dir)
+
+	def.Image.Release = "../9"
+
+	_, err = outputTreeDir(def)
+	require.EqualError(t, err, `Invalid image.release "../9" for the tree output layout`)
+
+	def.Image.Release = ""
+
+	_, err = outputTreeDir(def)
+	require.EqualError(t, err, `Invalid image.release "" for the tree output layout`)
+}
+
+func Test_artifactStagingReplace(t *testing.T) {
+	targetDir := t.TempDir()
+
+	// Existing directories are replaced, and so are symlinks instead of their
+	// targets.
+	err := os.MkdirAll(filepath.Join(targetDir, "appx"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(targetDir, "appx", "old.xml"), []byte("old"), 0644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(targetDir, "other"), []byte("other"), 0644)
+	require.NoError(t, err)
+
+	err = os.Symlink("other", filepath.Join(targetDir, "rootfs.tar.xz"))
+	require.NoError(t, err)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	staging, err := newArtifactStaging(context.Background(), targetDir, logger, nil)
+	require.NoError(t, err)
+
+	err = os.MkdirAll(filepath.Join(staging.dir, "appx"), 0755)
+	require.NoError(t, err)
+
+	for _, name := range []string{"rootfs.tar.xz", "appx/AppxManifest.xml"} {
+		err := os.WriteFile(filepath.Join(staging.dir, name), []byte("new"), 0644)
+		require.NoError(t, err)
+	}
+
+	err = staging.publish()
+	require.NoError(t, err)
+
+	require.NoFileExists(t, filepath.Join(targetDir, "appx", "old.xml"))
+
+	for _, name := range []string{"rootfs.tar.xz", "appx/AppxManifest.xml"} {
+		content, err := os.ReadFile(filepath.Join(targetDir, name))
+		require.NoError(t, err)
+		require.Equal(t, "new", string(content))
+	}
+
+	content, err := os.ReadFile(filepath.Join(targetDir, "other"))
+	require.NoError(t, err)
+	require.Equal(t, "other", string(content))
+}
+
+func Test_artifactStagingLatest(t *testing.T) {
+	variantDir := t.TempDir()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	for _, serial := range []string{"20240310_0000", "20240311_0000"} {
+		serialDir := filepath.Join(variantDir, serial)
+
+		err := os.Mkdir(serialDir, 0755)
+		require.NoError(t, err)
+
+		staging, err := newArtifactStaging(context.Background(), serialDir, logger, nil)
+		require.NoError(t, err)
+
+		staging.latestDir = serialDir
+
+		err = os.WriteFile(filepath.Join(staging.dir, "rootfs.tar.xz"), []byte(serial), 0644)
+		require.NoError(t, err)
+
+		err = staging.publish()
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(variantDir, "latest"))
+		require.NoError(t, err)
+		require.Equal(t, serial, target)
+
+		content, err := os.ReadFile(filepath.Join(variantDir, "latest", "rootfs.tar.xz"))
+		require.NoError(t, err)
+		require.Equal(t, serial, string(content))
+	}
+
+	entries, err := os.ReadDir(variantDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+}
+
+func Test_artifactStagingEncrypt(t *testing.T) {
+	_, err := exec.LookPath("gpg")
+	if err != nil {
+		t.Skip("gpg is missing")
+	}
+
+	t.Setenv("GNUPGHOME", t.TempDir())
+
+	targetDir := t.TempDir()
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+
+	err = os.WriteFile(passphraseFile, []byte("secret\n"), 0600)
+	require.NoError(t, err)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	staging, err := newArtifactStaging(context.Background(), targetDir, logger, &shared.DefinitionTargetEncrypt{Method: "gpg", PassphraseFile: passphraseFile})
+	require.NoError(t, err)
+
+	err = os.MkdirAll(filepath.Join(staging.dir, "appx"), 0755)
+	require.NoError(t, err)
+
+	for _, name := range []string{"rootfs.tar.xz", "appx/AppxManifest.xml"} {
+		err := os.WriteFile(filepath.Join(staging.dir, name), []byte("data"), 0644)
+		require.NoError(t, err)
+	}
+
+	err = staging.publish()
+	require.NoError(t, err)
+
+	// The checksums are those of the unencrypted artifacts.
+	sums, err := os.ReadFile(filepath.Join(targetDir, "SHA256SUMS"))
+	require.NoError(t, err)
+	require.Equal(t, `3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7  appx/AppxManifest.xml
+3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7  rootfs.tar.xz
+`, string(sums))
+
+	require.NoFileExists(t, filepath.Join(targetDir, "rootfs.tar.xz"))
+	require.FileExists(t, filepath.Join(targetDir, "appx", "AppxManifest.xml.gpg"))
+
+	var out strings.Builder
+
+	err = shared.RunCommand(context.Background(), nil, &out, "gpg", "--batch", "--pinentry-mode", "loopback", "--passphrase-file", passphraseFile, "--decrypt", filepath.Join(targetDir, "rootfs.tar.xz.gpg"))
+	require.NoError(t, err)
+	require.Equal(t, "data", out.String())
+}
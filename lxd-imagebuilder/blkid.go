@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// errUnknownFilesystem is returned if no known filesystem signature was found.
+var errUnknownFilesystem = errors.New("Unknown filesystem")
+
+// getGPTPartitionUUID returns the unique partition GUID (PARTUUID) of the given
+// partition, starting at 1, as found in the primary GUID partition table.
+func getGPTPartitionUUID(r io.ReaderAt, partition int) (string, error) {
+	header := make([]byte, gptHeaderSize)
+
+	_, err := r.ReadAt(header, gptSectorSize)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read partition table header: %w", err)
+	}
+
+	if string(header[0:8]) != "EFI PART" {
+		return "", errors.New("No GUID partition table found")
+	}
+
+	entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+	entryCount := binary.LittleEndian.Uint32(header[80:84])
+	entrySize := binary.LittleEndian.Uint32(header[84:88])
+
+	if partition < 1 || uint32(partition) > entryCount {
+		return "", fmt.Errorf("Invalid partition %d", partition)
+	}
+
+	if entrySize < 32 {
+		return "", fmt.Errorf("Invalid partition entry size %d", entrySize)
+	}
+
+	entry := make([]byte, 32)
+
+	_, err = r.ReadAt(entry, int64(entriesLBA*gptSectorSize+uint64(partition-1)*uint64(entrySize)))
+	if err != nil {
+		return "", fmt.Errorf("Failed to read partition entry: %w", err)
+	}
+
+	// An unused entry has a zero type GUID.
+	if bytes.Equal(entry[0:16], make([]byte, 16)) {
+		return "", fmt.Errorf("Partition %d doesn't exist", partition)
+	}
+
+	var guid [16]byte
+	copy(guid[:], entry[16:32])
+
+	return formatGUID(guid), nil
+}
+
+// filesystemInfo identifies a filesystem or swap space.
+type filesystemInfo struct {
+	uuid  string
+	label string
+}
+
+// getFilesystemInfo returns the UUID and the label of the filesystem or swap
+// space, as reported by blkid. Supported are btrfs, ext2/3/4, f2fs, swap and
+// vfat.
+func getFilesystemInfo(r io.ReaderAt) (*filesystemInfo, error) {
+	probes := []func(io.ReaderAt) (*filesystemInfo, error){
+		probeExt,
+		probeBtrfs,
+		probeF2FS,
+		probeSwap,
+		probeVFAT,
+	}
+
+	for _, probe := range probes {
+		info, err := probe(r)
+		if err == nil {
+			return info, nil
+		}
+
+		if !errors.Is(err, errUnknownFilesystem) {
+			return nil, err
+		}
+	}
+
+	return nil, errUnknownFilesystem
+}
+
+// getFilesystemUUID returns the UUID of the filesystem or swap space.
+func getFilesystemUUID(r io.ReaderAt) (string, error) {
+	info, err := getFilesystemInfo(r)
+	if err != nil {
+		return "", err
+	}
+
+	return info.uuid, nil
+}
+
+// getDeviceFilesystemInfo returns the UUID and the label of the filesystem on
+// the given device.
+func getDeviceFilesystemInfo(device string) (*filesystemInfo, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %q: %w", device, err)
+	}
+
+	defer f.Close()
+
+	info, err := getFilesystemInfo(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to identify filesystem of %q: %w", device, err)
+	}
+
+	return info, nil
+}
+
+// getDeviceFilesystemUUID returns the UUID of the filesystem on the given device.
+func getDeviceFilesystemUUID(device string) (string, error) {
+	info, err := getDeviceFilesystemInfo(device)
+	if err != nil {
+		return "", err
+	}
+
+	return info.uuid, nil
+}
+
+// readAt reads len(b) bytes at the given offset, treating a short device as
+// not containing the signature.
+func readAt(r io.ReaderAt, b []byte, offset int64) error {
+	_, err := r.ReadAt(b, offset)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errUnknownFilesystem
+	}
+
+	return err
+}
+
+func probeExt(r io.ReaderAt) (*filesystemInfo, error) {
+	// The superblock starts at 1024 bytes.
+	sb := make([]byte, 136)
+
+	err := readAt(r, sb, 1024)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint16(sb[56:58]) != 0xEF53 {
+		return nil, errUnknownFilesystem
+	}
+
+	return &filesystemInfo{uuid: formatUUID(sb[104:120]), label: formatLabel(sb[120:136])}, nil
+}
+
+func probeBtrfs(r io.ReaderAt) (*filesystemInfo, error) {
+	// The primary superblock starts at 64KiB.
+	sb := make([]byte, 0x22b)
+
+	err := readAt(r, sb, 0x10000)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(sb[64:72]) != "_BHRfS_M" {
+		return nil, errUnknownFilesystem
+	}
+
+	return &filesystemInfo{uuid: formatUUID(sb[32:48]), label: formatLabel(sb[0x12b:0x22b])}, nil
+}
+
+func probeF2FS(r io.ReaderAt) (*filesystemInfo, error) {
+	// The superblock starts at 1024 bytes, and the label is UTF-16.
+	sb := make([]byte, 1148)
+
+	err := readAt(r, sb, 1024)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(sb[0:4]) != 0xF2F52010 {
+		return nil, errUnknownFilesystem
+	}
+
+	name := make([]uint16, 0, 512)
+
+	for i := 124; i < len(sb); i += 2 {
+		c := binary.LittleEndian.Uint16(sb[i:])
+		if c == 0 {
+			break
+		}
+
+		name = append(name, c)
+	}
+
+	return &filesystemInfo{uuid: formatUUID(sb[108:124]), label: string(utf16.Decode(name))}, nil
+}
+
+func probeSwap(r io.ReaderAt) (*filesystemInfo, error) {
+	// The signature is at the end of the first page, which depends on the page
+	// size of the system it was created on.
+	for _, pageSize := range []int64{4096, 8192, 16384, 65536} {
+		magic := make([]byte, 10)
+
+		err := readAt(r, magic, pageSize-10)
+		if err != nil {
+			return nil, err
+		}
+
+		if string(magic) != "SWAPSPACE2" {
+			continue
+		}
+
+		// The UUID is followed by the label.
+		header := make([]byte, 32)
+
+		err = readAt(r, header, 1036)
+		if err != nil {
+			return nil, err
+		}
+
+		return &filesystemInfo{uuid: formatUUID(header[0:16]), label: formatLabel(header[16:32])}, nil
+	}
+
+	return nil, errUnknownFilesystem
+}
+
+func probeVFAT(r io.ReaderAt) (*filesystemInfo, error) {
+	bs := make([]byte, 512)
+
+	err := readAt(r, bs, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if bs[510] != 0x55 || bs[511] != 0xAA {
+		return nil, errUnknownFilesystem
+	}
+
+	var serial []byte
+	var label []byte
+
+	switch {
+	case string(bs[82:87]) == "FAT32":
+		serial = bs[67:71]
+		label = bs[71:82]
+	case string(bs[54:58]) == "FAT1":
+		serial = bs[39:43]
+		label = bs[43:54]
+	default:
+		return nil, errUnknownFilesystem
+	}
+
+	info := &filesystemInfo{uuid: fmt.Sprintf("%02X%02X-%02X%02X", serial[3], serial[2], serial[1], serial[0])}
+
+	// Unlabeled filesystems use a placeholder.
+	info.label = strings.TrimRight(formatLabel(label), " ")
+	if info.label == "NO NAME" {
+		info.label = ""
+	}
+
+	return info, nil
+}
+
+// formatLabel returns the given NUL-terminated label.
+func formatLabel(b []byte) string {
+	end := bytes.IndexByte(b, 0)
+	if end >= 0 {
+		b = b[:end]
+	}
+
+	return string(b)
+}
+
+// formatUUID formats the given big-endian UUID.
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+
+	return fmt.Sprintf("%s-%s-%s-%s-%s", s[0:8], s[8:12], s[12:16], s[16:20], s[20:32])
+}
+
+// formatGUID formats the given GUID in its on-disk representation, where the
+// first three fields are little-endian.
+func formatGUID(b [16]byte) string {
+	raw := []byte{
+		b[3], b[2], b[1], b[0],
+		b[5], b[4],
+		b[7], b[6],
+	}
+
+	return formatUUID(append(raw, b[8:]...))
+}
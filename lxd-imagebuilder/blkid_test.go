@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_getGPTPartitionUUID(t *testing.T) {
+	diskSize := uint64(64 * 1024 * 1024)
+	disk := make(memDisk, diskSize)
+
+	err := writeGPT(disk, diskSize, []gptPartition{
+		{typeGUID: gptTypeEFISystem, size: 8 * 1024 * 1024},
+		{typeGUID: gptTypeLinuxFS},
+	})
+	require.NoError(t, err)
+
+	// Set a known GUID for the second partition.
+	guid, err := parseGUID("0B8AE6F4-3D2C-4A8B-9F1E-2C3D4E5F6A7B")
+	require.NoError(t, err)
+	copy(disk[2*gptSectorSize+gptEntrySize+16:], guid[:])
+
+	uuid, err := getGPTPartitionUUID(bytes.NewReader(disk), 2)
+	require.NoError(t, err)
+	require.Equal(t, "0b8ae6f4-3d2c-4a8b-9f1e-2c3d4e5f6a7b", uuid)
+
+	uuid, err = getGPTPartitionUUID(bytes.NewReader(disk), 1)
+	require.NoError(t, err)
+	require.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", uuid)
+
+	_, err = getGPTPartitionUUID(bytes.NewReader(disk), 3)
+	require.EqualError(t, err, "Partition 3 doesn't exist")
+
+	_, err = getGPTPartitionUUID(bytes.NewReader(disk), 0)
+	require.Error(t, err)
+
+	_, err = getGPTPartitionUUID(bytes.NewReader(make([]byte, 4096)), 1)
+	require.EqualError(t, err, "No GUID partition table found")
+}
+
+func Test_getFilesystemInfo(t *testing.T) {
+	uuid := []byte{0xdd, 0x57, 0x70, 0x5e, 0x71, 0x50, 0x49, 0x43, 0x95, 0x1e, 0x9e, 0x29, 0xed, 0xbe, 0xfb, 0xdd}
+
+	tests := []struct {
+		name     string
+		image    func() []byte
+		expected filesystemInfo
+	}{
+		{
+			"ext4",
+			func() []byte {
+				b := make([]byte, 4096)
+				binary.LittleEndian.PutUint16(b[1024+56:], 0xEF53)
+				copy(b[1024+104:], uuid)
+				copy(b[1024+120:], "rootfs")
+				return b
+			},
+			filesystemInfo{uuid: "dd57705e-7150-4943-951e-9e29edbefbdd", label: "rootfs"},
+		},
+		{
+			"btrfs",
+			func() []byte {
+				b := make([]byte, 0x20000)
+				copy(b[0x10000+32:], uuid)
+				copy(b[0x10000+64:], "_BHRfS_M")
+				copy(b[0x10000+0x12b:], "rootfs")
+				return b
+			},
+			filesystemInfo{uuid: "dd57705e-7150-4943-951e-9e29edbefbdd", label: "rootfs"},
+		},
+		{
+			"f2fs",
+			func() []byte {
+				b := make([]byte, 4096)
+				binary.LittleEndian.PutUint32(b[1024:], 0xF2F52010)
+				copy(b[1024+108:], uuid)
+
+				for i, c := range "rootfs" {
+					binary.LittleEndian.PutUint16(b[1024+124+i*2:], uint16(c))
+				}
+
+				return b
+			},
+			filesystemInfo{uuid: "dd57705e-7150-4943-951e-9e29edbefbdd", label: "rootfs"},
+		},
+		{
+			"swap",
+			func() []byte {
+				b := make([]byte, 8192)
+				copy(b[1036:], uuid)
+				copy(b[1052:], "swap")
+				copy(b[4096-10:], "SWAPSPACE2")
+				return b
+			},
+			filesystemInfo{uuid: "dd57705e-7150-4943-951e-9e29edbefbdd", label: "swap"},
+		},
+		{
+			"swap with 64KiB pages",
+			func() []byte {
+				b := make([]byte, 65536)
+				copy(b[1036:], uuid)
+				copy(b[65536-10:], "SWAPSPACE2")
+				return b
+			},
+			filesystemInfo{uuid: "dd57705e-7150-4943-951e-9e29edbefbdd"},
+		},
+		{
+			"vfat (FAT32)",
+			func() []byte {
+				b := make([]byte, 4096)
+				copy(b[67:], []byte{0x78, 0x56, 0x34, 0x12})
+				copy(b[71:], "UEFI       ")
+				copy(b[82:], "FAT32   ")
+				b[510], b[511] = 0x55, 0xAA
+				return b
+			},
+			filesystemInfo{uuid: "1234-5678", label: "UEFI"},
+		},
+		{
+			"vfat (FAT16)",
+			func() []byte {
+				b := make([]byte, 4096)
+				copy(b[39:], []byte{0xEF, 0xBE, 0xAD, 0xDE})
+				copy(b[43:], "NO NAME    ")
+				copy(b[54:], "FAT16   ")
+				b[510], b[511] = 0x55, 0xAA
+				return b
+			},
+			filesystemInfo{uuid: "DEAD-BEEF"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := getFilesystemInfo(bytes.NewReader(tt.image()))
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, *info)
+
+			uuid, err := getFilesystemUUID(bytes.NewReader(tt.image()))
+			require.NoError(t, err)
+			require.Equal(t, tt.expected.uuid, uuid)
+		})
+	}
+
+	_, err := getFilesystemUUID(bytes.NewReader(make([]byte, 0x20000)))
+	require.ErrorIs(t, err, errUnknownFilesystem)
+
+	_, err = getFilesystemUUID(bytes.NewReader(make([]byte, 512)))
+	require.ErrorIs(t, err, errUnknownFilesystem)
+}
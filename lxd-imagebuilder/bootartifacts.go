@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// Names of the boot artifacts in the target directory.
+const (
+	bootArtifactKernel  = "vmlinuz"
+	bootArtifactInitrd  = "initrd.img"
+	bootArtifactCmdline = "cmdline"
+	bootArtifactRoot    = "rootfs.img"
+)
+
+// rootImageDevice is the root file system of the root image, which is attached
+// as the first virtio disk.
+const rootImageDevice = "/dev/vda"
+
+// extractBootArtifacts copies the kernel and initrd of the image to the target
+// directory, and writes the kernel command line needed to boot them.
+func (v *vm) extractBootArtifacts(targetDir string, rootDataset string) error {
+	if v.bootArtifacts == nil {
+		return nil
+	}
+
+	kernel, initrd, err := findKernel(filepath.Join(v.rootfsDir, "boot"))
+	if err != nil {
+		return err
+	}
+
+	err = shared.Copy(kernel, filepath.Join(targetDir, bootArtifactKernel))
+	if err != nil {
+		return fmt.Errorf("Failed to copy kernel %q: %w", kernel, err)
+	}
+
+	if initrd != "" {
+		err = shared.Copy(initrd, filepath.Join(targetDir, bootArtifactInitrd))
+		if err != nil {
+			return fmt.Errorf("Failed to copy initrd %q: %w", initrd, err)
+		}
+	}
+
+	cmdline, err := v.bootArtifactsCmdline(rootDataset)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(targetDir, bootArtifactCmdline), []byte(cmdline+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", filepath.Join(targetDir, bootArtifactCmdline), err)
+	}
+
+	return nil
+}
+
+// bootsFromRootImage returns whether the image is booted from the root image of
+// the boot artifacts, as it has no boot loader.
+func (v *vm) bootsFromRootImage() bool {
+	if v.bootArtifacts == nil || !v.bootArtifacts.RootImage {
+		return false
+	}
+
+	return v.bootloader == nil || v.bootloader.Type == ""
+}
+
+// bootArtifactsCmdline returns the kernel command line of the boot artifacts.
+// With a root image, the root file system is its device instead of the root
+// partition, unless it's set explicitly.
+func (v *vm) bootArtifactsCmdline(rootDataset string) (string, error) {
+	cmdline, err := v.kernelCmdline(rootDataset)
+	if err != nil || !v.bootArtifacts.RootImage {
+		return cmdline, err
+	}
+
+	params, err := v.kernelCmdlineParams()
+	if err != nil {
+		return "", err
+	}
+
+	_, ok := params.Get("root")
+	if ok {
+		return cmdline, nil
+	}
+
+	rootCmdline, err := shared.ParseKernelCmdline(cmdline)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse kernel command line: %w", err)
+	}
+
+	rootCmdline.Set("root=" + rootImageDevice)
+
+	return rootCmdline.String(), nil
+}
+
+// extractRootImage copies the root partition of the image to the target
+// directory, so it can be booted from the boot artifacts without a partition
+// table, boot loader or EFI system partition.
+func (v *vm) extractRootImage(targetDir string) error {
+	if v.bootArtifacts == nil || !v.bootArtifacts.RootImage {
+		return nil
+	}
+
+	f, err := os.Open(v.imageFile)
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %w", v.imageFile, err)
+	}
+
+	defer f.Close()
+
+	_, entries, err := readGPT(f)
+	if err != nil {
+		return fmt.Errorf("Failed to read partition table of %q: %w", v.imageFile, err)
+	}
+
+	if len(entries) < 2 {
+		return fmt.Errorf("Partition table of %q has %d partitions instead of 2", v.imageFile, len(entries))
+	}
+
+	rootFile := filepath.Join(targetDir, bootArtifactRoot)
+	size := partitionSize(entries[1])
+
+	err = createSparseFile(rootFile, size)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(rootFile, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %w", rootFile, err)
+	}
+
+	defer out.Close()
+
+	err = writeSparse(out, 0, io.NewSectionReader(f, int64(entries[1].firstLBA*gptSectorSize), int64(size)))
+	if err != nil {
+		return fmt.Errorf("Failed to copy root partition of %q: %w", v.imageFile, err)
+	}
+
+	return out.Close()
+}
+
+// findKernel returns the newest kernel in the given boot directory, and its
+// initrd if there's one.
+func findKernel(bootDir string) (string, string, error) {
+	entries, err := os.ReadDir(bootDir)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read directory %q: %w", bootDir, err)
+	}
+
+	var versions []string
+
+	kernels := map[string]string{}
+
+	for _, entry := range entries {
+		// Symlinks like /boot/vmlinuz point to one of the versioned kernels.
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		// Uncompressed kernels, e.g. on riscv64, are named vmlinux.
+		var version string
+
+		for _, prefix := range []string{"vmlinuz-", "vmlinux-"} {
+			v, ok := strings.CutPrefix(entry.Name(), prefix)
+			if ok {
+				version = v
+				break
+			}
+		}
+
+		if version == "" || strings.HasSuffix(version, ".old") || strings.Contains(version, "rescue") {
+			continue
+		}
+
+		// Prefer the compressed kernel if there are both.
+		_, exists := kernels[version]
+		if !exists {
+			versions = append(versions, version)
+		}
+
+		if !exists || strings.HasPrefix(entry.Name(), "vmlinuz-") {
+			kernels[version] = entry.Name()
+		}
+	}
+
+	if len(versions) == 0 {
+		return "", "", fmt.Errorf("No kernel found in %q", bootDir)
+	}
+
+	slices.SortFunc(versions, compareVersions)
+	version := versions[len(versions)-1]
+
+	kernel := filepath.Join(bootDir, kernels[version])
+
+	// Debian, Fedora, openSUSE and Arch Linux/Alpine naming.
+	for _, name := range []string{"initrd.img-" + version, "initramfs-" + version + ".img", "initrd-" + version, "initramfs-" + version} {
+		initrd := filepath.Join(bootDir, name)
+
+		// The rootfs is read from the build host, so symlinks aren't followed.
+		info, err := os.Lstat(initrd)
+		if err == nil && info.Mode().IsRegular() {
+			return kernel, initrd, nil
+		}
+
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", "", fmt.Errorf("Failed to stat %q: %w", initrd, err)
+		}
+	}
+
+	return kernel, "", nil
+}
+
+// compareVersions compares two version strings, treating sequences of digits
+// as numbers, so 6.8.0-9 sorts before 6.8.0-10.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		var partA, partB string
+
+		isDigit := unicode.IsDigit(rune(a[0]))
+
+		if isDigit != unicode.IsDigit(rune(b[0])) {
+			// Numbers sort after other characters.
+			if isDigit {
+				return 1
+			}
+
+			return -1
+		}
+
+		partA, a = splitVersionPart(a, isDigit)
+		partB, b = splitVersionPart(b, isDigit)
+
+		if isDigit {
+			numA, _ := strconv.ParseUint(partA, 10, 64)
+			numB, _ := strconv.ParseUint(partB, 10, 64)
+
+			if numA != numB {
+				if numA < numB {
+					return -1
+				}
+
+				return 1
+			}
+
+			continue
+		}
+
+		cmp := strings.Compare(partA, partB)
+		if cmp != 0 {
+			return cmp
+		}
+	}
+
+	return strings.Compare(a, b)
+}
+
+// splitVersionPart splits off the leading sequence of digits or non-digits.
+func splitVersionPart(s string, digits bool) (string, string) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsDigit(r) != digits
+	})
+
+	if i < 0 {
+		return s, ""
+	}
+
+	return s[:i], s[i:]
+}
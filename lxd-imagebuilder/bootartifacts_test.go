@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_findKernel(t *testing.T) {
+	bootDir := t.TempDir()
+
+	_, _, err := findKernel(bootDir)
+	require.Error(t, err)
+
+	for _, name := range []string{"vmlinuz-6.8.0-9-generic", "vmlinuz-6.8.0-10-generic", "vmlinuz-6.8.0-10-generic.old", "initrd.img-6.8.0-9-generic", "initrd.img-6.8.0-10-generic"} {
+		err := os.WriteFile(filepath.Join(bootDir, name), nil, 0644)
+		require.NoError(t, err)
+	}
+
+	err = os.Symlink("vmlinuz-6.8.0-9-generic", filepath.Join(bootDir, "vmlinuz"))
+	require.NoError(t, err)
+
+	kernel, initrd, err := findKernel(bootDir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(bootDir, "vmlinuz-6.8.0-10-generic"), kernel)
+	require.Equal(t, filepath.Join(bootDir, "initrd.img-6.8.0-10-generic"), initrd)
+
+	// A kernel without initrd, using the Fedora naming.
+	bootDir = t.TempDir()
+
+	err = os.WriteFile(filepath.Join(bootDir, "vmlinuz-6.11.4-301.fc41.x86_64"), nil, 0644)
+	require.NoError(t, err)
+
+	kernel, initrd, err = findKernel(bootDir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(bootDir, "vmlinuz-6.11.4-301.fc41.x86_64"), kernel)
+	require.Empty(t, initrd)
+
+	// Symlinks of the initrd aren't followed, as they may point to the build host.
+	hostFile := filepath.Join(t.TempDir(), "secret")
+
+	err = os.WriteFile(hostFile, []byte("secret"), 0600)
+	require.NoError(t, err)
+
+	err = os.Symlink(hostFile, filepath.Join(bootDir, "initramfs-6.11.4-301.fc41.x86_64.img"))
+	require.NoError(t, err)
+
+	_, initrd, err = findKernel(bootDir)
+	require.NoError(t, err)
+	require.Empty(t, initrd)
+
+	// An uncompressed kernel as used on riscv64.
+	bootDir = t.TempDir()
+
+	for _, name := range []string{"vmlinux-6.12.9-riscv64", "initrd.img-6.12.9-riscv64"} {
+		err := os.WriteFile(filepath.Join(bootDir, name), nil, 0644)
+		require.NoError(t, err)
+	}
+
+	kernel, initrd, err = findKernel(bootDir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(bootDir, "vmlinux-6.12.9-riscv64"), kernel)
+	require.Equal(t, filepath.Join(bootDir, "initrd.img-6.12.9-riscv64"), initrd)
+}
+
+func Test_compareVersions(t *testing.T) {
+	require.Equal(t, -1, compareVersions("6.8.0-9-generic", "6.8.0-10-generic"))
+	require.Equal(t, 1, compareVersions("6.10.1", "6.9.12"))
+	require.Equal(t, 0, compareVersions("6.8.0", "6.8.0"))
+	require.Equal(t, -1, compareVersions("6.8", "6.8.1"))
+	require.Equal(t, -1, compareVersions("lts", "virt"))
+}
+
+func Test_kernelCmdline(t *testing.T) {
+	imageFile := filepath.Join(t.TempDir(), "image.raw")
+	diskSize := uint64(64 * 1024 * 1024)
+
+	f, err := os.Create(imageFile)
+	require.NoError(t, err)
+
+	err = f.Truncate(int64(diskSize))
+	require.NoError(t, err)
+
+	err = writeGPT(f, diskSize, []gptPartition{
+		{typeGUID: gptTypeEFISystem, size: 8 * 1024 * 1024},
+		{typeGUID: gptTypeLinuxFS},
+	})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	v := vm{imageFile: imageFile, rootFS: "ext4"}
+
+	partUUID, err := v.getRootfsPartitionUUID()
+	require.NoError(t, err)
+
+	cmdline, err := v.kernelCmdline("")
+	require.NoError(t, err)
+	require.Equal(t, "root=PARTUUID="+partUUID+" ro", cmdline)
+
+	v = vm{imageFile: imageFile, rootFS: "btrfs", btrfs: shared.DefinitionTargetLXDVMBtrfs{Subvolumes: []shared.DefinitionTargetLXDVMBtrfsSubvolume{{Name: "@home", Mountpoint: "/home"}, {Name: "@", Mountpoint: "/"}}}}
+
+	cmdline, err = v.kernelCmdline("")
+	require.NoError(t, err)
+	require.Equal(t, "root=PARTUUID="+partUUID+" rootflags=subvol=@ ro", cmdline)
+
+	v = vm{rootFS: "zfs", bootArtifacts: &shared.DefinitionTargetLXDVMBootArtifacts{Cmdline: "rw console=ttyS0"}}
+
+	cmdline, err = v.kernelCmdline("rpool/ROOT/default")
+	require.NoError(t, err)
+	require.Equal(t, "root=ZFS=rpool/ROOT/default rw console=ttyS0", cmdline)
+
+	v = vm{rootFS: "ext4", lvm: &shared.DefinitionTargetLXDVMLVM{VolumeGroup: "rootvg"}}
+
+	cmdline, err = v.kernelCmdline("")
+	require.NoError(t, err)
+	require.Equal(t, "root=/dev/mapper/rootvg-root ro", cmdline)
+
+	v = vm{rootFS: "ext4", encryption: &shared.DefinitionTargetLXDVMEncryption{}, bootArtifacts: &shared.DefinitionTargetLXDVMBootArtifacts{Cmdline: "root=LABEL=rootfs ro"}}
+
+	cmdline, err = v.kernelCmdline("")
+	require.NoError(t, err)
+	require.Equal(t, "root=LABEL=rootfs ro", cmdline)
+}
+
+func Test_extractRootImage(t *testing.T) {
+	imageFile := filepath.Join(t.TempDir(), "image.raw")
+	diskSize := uint64(64 * 1024 * 1024)
+
+	f, err := os.Create(imageFile)
+	require.NoError(t, err)
+
+	err = f.Truncate(int64(diskSize))
+	require.NoError(t, err)
+
+	err = writeGPT(f, diskSize, []gptPartition{
+		{typeGUID: gptTypeEFISystem, size: 8 * 1024 * 1024},
+		{typeGUID: gptTypeLinuxFS},
+	})
+	require.NoError(t, err)
+
+	_, entries, err := readGPT(f)
+	require.NoError(t, err)
+
+	_, err = f.WriteAt([]byte("rootfs"), int64(entries[1].firstLBA*gptSectorSize))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	targetDir := t.TempDir()
+
+	v := vm{imageFile: imageFile, rootFS: "ext4", bootArtifacts: &shared.DefinitionTargetLXDVMBootArtifacts{RootImage: true}}
+
+	err = v.extractRootImage(targetDir)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(targetDir, bootArtifactRoot))
+	require.NoError(t, err)
+	require.Len(t, content, int(partitionSize(entries[1])))
+	require.Equal(t, "rootfs", string(content[:6]))
+
+	cmdline, err := v.bootArtifactsCmdline("")
+	require.NoError(t, err)
+	require.Equal(t, "root=/dev/vda ro", cmdline)
+
+	// The root file system is set explicitly.
+	v.bootArtifacts.Cmdline = "root=/dev/vdb"
+
+	cmdline, err = v.bootArtifactsCmdline("")
+	require.NoError(t, err)
+	require.Equal(t, "root=/dev/vdb ro", cmdline)
+
+	require.True(t, v.bootsFromRootImage())
+
+	v.bootloader = &shared.DefinitionTargetLXDVMBootloader{Type: "systemd-boot"}
+	require.False(t, v.bootsFromRootImage())
+}
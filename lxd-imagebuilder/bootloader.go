@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	securejoin "github.com/cyphar/filepath-securejoin"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// efiArchitecture describes the EFI binaries of an architecture.
+type efiArchitecture struct {
+	// suffix is the suffix of the removable media boot path, e.g. BOOTAA64.EFI.
+	suffix string
+
+	// grubTarget is the target passed to grub-install.
+	grubTarget string
+
+	// secureBoot is whether distributions ship a signed shim for the architecture.
+	secureBoot bool
+}
+
+// efiArchitectures maps kernel architecture names to their EFI binaries.
+var efiArchitectures = map[string]efiArchitecture{
+	"aarch64":     {suffix: "AA64", grubTarget: "arm64-efi", secureBoot: true},
+	"armv7l":      {suffix: "ARM", grubTarget: "arm-efi"},
+	"i686":        {suffix: "IA32", grubTarget: "i386-efi"},
+	"loongarch64": {suffix: "LOONGARCH64", grubTarget: "loongarch64-efi"},
+	"riscv64":     {suffix: "RISCV64", grubTarget: "riscv64-efi"},
+	"x86_64":      {suffix: "X64", grubTarget: "x86_64-efi", secureBoot: true},
+}
+
+// bootloaderScript returns the script installing the given boot loader for the
+// given architecture. It's run inside of the chroot. If espDir is true, the
+// EFI system partition is a plain directory instead of a mounted partition.
+func bootloaderScript(bootloader string, arch efiArchitecture, espDir bool) string {
+	// Unified kernel images are booted by systemd-boot.
+	if bootloader == "systemd-boot" || bootloader == "uki" {
+		env := ""
+
+		// bootctl refuses to install into anything but a mounted FAT file system.
+		if espDir {
+			env = "SYSTEMD_RELAX_ESP_CHECKS=1 "
+		}
+
+		return fmt.Sprintf(`#!/bin/sh
+set -eu
+
+%sbootctl install --no-variables --esp-path=/boot/efi
+`, env)
+	}
+
+	return grubScript(fmt.Sprintf("--target=%s --efi-directory=/boot/efi --no-nvram --removable", arch.grubTarget))
+}
+
+// grubScript returns the script running grub-install with the given arguments,
+// and generating the grub configuration.
+func grubScript(installArgs string) string {
+	return fmt.Sprintf(`#!/bin/sh
+set -eu
+
+if command -v grub-install >/dev/null; then
+    grub_install=grub-install
+    grub_mkconfig=grub-mkconfig
+    grub_cfg=/boot/grub/grub.cfg
+elif command -v grub2-install >/dev/null; then
+    grub_install=grub2-install
+    grub_mkconfig=grub2-mkconfig
+    grub_cfg=/boot/grub2/grub.cfg
+else
+    echo "grub-install is missing" >&2
+    exit 1
+fi
+
+"${grub_install}" %s
+"${grub_mkconfig}" -o "${grub_cfg}"
+`, installArgs)
+}
+
+// secureBootScript returns the script installing the signed shim and grub of
+// the distribution to the removable media path. It's run inside of the chroot.
+func secureBootScript(arch efiArchitecture) string {
+	return fmt.Sprintf(`#!/bin/sh
+set -eu
+
+boot_dir=/boot/efi/EFI/BOOT
+
+# Debian based distributions install the signed binaries using grub-install.
+if command -v grub-install >/dev/null && grub-install --help | grep -q -- --uefi-secure-boot; then
+    grub-install --target=%[1]s --efi-directory=/boot/efi --no-nvram --removable --uefi-secure-boot
+    grub-mkconfig -o /boot/grub/grub.cfg
+    exit 0
+fi
+
+# Other distributions, e.g. Fedora based ones, install them into their vendor
+# directory of the EFI system partition.
+shim=""
+grub=""
+
+for dir in /boot/efi/EFI/*; do
+    if [ "${dir}" = "${boot_dir}" ]; then
+        continue
+    fi
+
+    if [ -e "${dir}/shim%[2]s.efi" ]; then
+        shim="${dir}/shim%[2]s.efi"
+    fi
+
+    if [ -e "${dir}/grub%[2]s.efi" ]; then
+        grub="${dir}/grub%[2]s.efi"
+    fi
+done
+
+if [ -z "${shim}" ] || [ -z "${grub}" ]; then
+    echo "Signed shim%[2]s.efi or grub%[2]s.efi is missing" >&2
+    exit 1
+fi
+
+mkdir -p "${boot_dir}"
+cp "${shim}" "${boot_dir}/BOOT%[3]s.EFI"
+cp "${grub}" "${boot_dir}/grub%[2]s.efi"
+
+# The MOK manager, and the fallback creating the boot entries on first boot.
+for file in mm%[2]s.efi fb%[2]s.efi; do
+    if [ -e "$(dirname "${shim}")/${file}" ] && [ ! -e "${boot_dir}/${file}" ]; then
+        cp "$(dirname "${shim}")/${file}" "${boot_dir}/${file}"
+    fi
+done
+
+if command -v grub2-mkconfig >/dev/null; then
+    grub2-mkconfig -o /boot/grub2/grub.cfg
+else
+    grub-mkconfig -o /boot/grub/grub.cfg
+fi
+`, arch.grubTarget, strings.ToLower(arch.suffix), arch.suffix)
+}
+
+// isSignedEFIBinary returns whether the given EFI binary has an Authenticode
+// signature. Gzip compressed kernels are decompressed first, as grub verifies
+// the decompressed kernel.
+func isSignedEFIBinary(path string) (bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	if bytes.HasPrefix(content, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return false, fmt.Errorf("Failed to decompress %q: %w", path, err)
+		}
+
+		var buf bytes.Buffer
+
+		_, err = buf.ReadFrom(r)
+		if err != nil {
+			return false, fmt.Errorf("Failed to decompress %q: %w", path, err)
+		}
+
+		content = buf.Bytes()
+	}
+
+	f, err := pe.NewFile(bytes.NewReader(content))
+	if err != nil {
+		return false, fmt.Errorf("%q isn't an EFI binary: %w", path, err)
+	}
+
+	defer f.Close()
+
+	var security pe.DataDirectory
+
+	switch header := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		if header.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+			security = header.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		}
+
+	case *pe.OptionalHeader64:
+		if header.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+			security = header.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		}
+	}
+
+	return security.Size > 0, nil
+}
+
+// verifySecureBoot checks that shim, grub and the kernel are signed, so the
+// image boots with Secure Boot enabled. It needs to be called inside of the
+// chroot.
+func verifySecureBoot(arch efiArchitecture) error {
+	kernel, _, err := findKernel("/boot")
+	if err != nil {
+		return err
+	}
+
+	bootDir := "/boot/efi/EFI/BOOT"
+
+	for _, path := range []string{filepath.Join(bootDir, fmt.Sprintf("BOOT%s.EFI", arch.suffix)), filepath.Join(bootDir, fmt.Sprintf("grub%s.efi", strings.ToLower(arch.suffix))), kernel} {
+		signed, err := isSignedEFIBinary(path)
+		if err != nil {
+			return err
+		}
+
+		if !signed {
+			return fmt.Errorf("%q isn't signed", path)
+		}
+	}
+
+	return nil
+}
+
+// installBootloader installs the boot loader into the EFI system partition.
+// It needs to be called inside of the chroot.
+func (v *vm) installBootloader(architecture string) error {
+	if v.bootloader == nil || v.bootloader.Type == "" {
+		return nil
+	}
+
+	// POWER firmware loads grub from the PReP boot partition instead of the
+	// EFI system partition.
+	if v.prep {
+		if v.bootloader.Type != "grub" {
+			return fmt.Errorf("Boot loader %q isn't supported on %q", v.bootloader.Type, architecture)
+		}
+
+		err := shared.RunScript(v.ctx, grubScript(fmt.Sprintf("--target=powerpc-ieee1275 --no-nvram %s", v.getPRePDevFile())))
+		if err != nil {
+			return fmt.Errorf("Failed to install %q: %w", v.bootloader.Type, err)
+		}
+
+		return nil
+	}
+
+	arch, ok := efiArchitectures[architecture]
+	if !ok {
+		return fmt.Errorf("Boot loader %q isn't supported on %q", v.bootloader.Type, architecture)
+	}
+
+	script := bootloaderScript(v.bootloader.Type, arch, v.userspace)
+
+	if v.bootloader.SecureBoot {
+		if !arch.secureBoot {
+			return fmt.Errorf("Secure Boot isn't supported on %q", architecture)
+		}
+
+		script = secureBootScript(arch)
+	}
+
+	err := shared.RunScript(v.ctx, script)
+	if err != nil {
+		return fmt.Errorf("Failed to install %q: %w", v.bootloader.Type, err)
+	}
+
+	// The firmware falls back to the removable media boot path, as there are no
+	// boot entries in the NVRAM of a new VM.
+	bootFile := fmt.Sprintf("/boot/efi/EFI/BOOT/BOOT%s.EFI", arch.suffix)
+
+	if !lxdShared.PathExists(bootFile) {
+		return fmt.Errorf("Boot loader %q didn't create %q", v.bootloader.Type, bootFile)
+	}
+
+	if v.bootloader.SecureBoot {
+		err := verifySecureBoot(arch)
+		if err != nil {
+			return fmt.Errorf("Failed to verify Secure Boot chain: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// configureUKI determines the kernel command line of the unified kernel image,
+// and writes it together with the kernel-install configuration, so the ones of
+// kernel updates boot the root file system of the image as well.
+func (v *vm) configureUKI(rootDataset string) error {
+	if v.bootloader == nil || v.bootloader.Type != "uki" {
+		return nil
+	}
+
+	cmdline, err := v.kernelCmdline(rootDataset)
+	if err != nil {
+		return err
+	}
+
+	// The chroot has no access to the partition table of the image.
+	v.ukiCmdline = cmdline
+
+	// Kernel updates can't be installed on a read-only root.
+	if v.verity != nil {
+		return nil
+	}
+
+	kernelDir := filepath.Join(v.rootfsDir, "etc", "kernel")
+
+	err = os.MkdirAll(kernelDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", kernelDir, err)
+	}
+
+	err = os.WriteFile(filepath.Join(kernelDir, "cmdline"), []byte(cmdline+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", filepath.Join(kernelDir, "cmdline"), err)
+	}
+
+	// Keep the kernel-install configuration of the image if there's one.
+	installConf := filepath.Join(kernelDir, "install.conf")
+
+	if !lxdShared.PathExists(installConf) {
+		err = os.WriteFile(installConf, []byte("layout=uki\nuki_generator=ukify\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", installConf, err)
+		}
+	}
+
+	return nil
+}
+
+// installUKI builds the unified kernel image of the newest kernel, and
+// installs it into the EFI system partition, where systemd-boot finds it
+// without a boot entry. It needs to be called inside of the chroot, after the
+// post-files actions, so it contains the final initrd.
+func (v *vm) installUKI() error {
+	if v.bootloader == nil || v.bootloader.Type != "uki" {
+		return nil
+	}
+
+	kernel, initrd, err := findKernel("/boot")
+	if err != nil {
+		return err
+	}
+
+	version := strings.TrimPrefix(strings.TrimPrefix(filepath.Base(kernel), "vmlinuz-"), "vmlinux-")
+
+	osRelease, err := parseOSRelease("/")
+	if err != nil {
+		return err
+	}
+
+	id := osRelease["ID"]
+	if id == "" {
+		id = "linux"
+	}
+
+	ukiDir := "/boot/efi/EFI/Linux"
+
+	err = os.MkdirAll(ukiDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", ukiDir, err)
+	}
+
+	args := []string{"build", "--linux", kernel, "--cmdline", v.ukiCmdline, "--uname", version, "--output", filepath.Join(ukiDir, fmt.Sprintf("%s-%s.efi", id, version))}
+
+	if initrd != "" {
+		args = append(args, "--initrd", initrd)
+	}
+
+	err = shared.RunCommand(v.ctx, nil, nil, "ukify", args...)
+	if err != nil {
+		return fmt.Errorf("Failed to build unified kernel image of %q: %w", kernel, err)
+	}
+
+	return nil
+}
+
+// installUBoot writes the u-boot binary from the image to the disk, between
+// the partition table and the first partition.
+func (v *vm) installUBoot() error {
+	if v.bootloader == nil || v.bootloader.UBoot == nil {
+		return nil
+	}
+
+	// The userspace backend writes to the image directly.
+	disk := v.loopDevice
+	if v.userspace {
+		disk = v.imageFile
+	}
+
+	if disk == "" {
+		return errors.New("Disk image not mounted")
+	}
+
+	uBoot := v.bootloader.UBoot
+
+	// This runs on the build host, so symlinks of the rootfs are resolved
+	// inside of it.
+	path, err := securejoin.SecureJoin(v.rootfsDir, uBoot.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve u-boot binary %q: %w", uBoot.Path, err)
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read u-boot binary %q: %w", uBoot.Path, err)
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("u-boot binary %q isn't a regular file", uBoot.Path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read u-boot binary %q: %w", uBoot.Path, err)
+	}
+
+	if uBoot.Offset+uint64(len(content)) > gptAlignment*gptSectorSize {
+		return fmt.Errorf("u-boot binary %q of size %d at offset %d overlaps the first partition", uBoot.Path, len(content), uBoot.Offset)
+	}
+
+	f, err := os.OpenFile(disk, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %w", disk, err)
+	}
+
+	defer f.Close()
+
+	_, err = f.WriteAt(content, int64(uBoot.Offset))
+	if err != nil {
+		return fmt.Errorf("Failed to write u-boot binary to %q: %w", disk, err)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("Failed to sync %q: %w", disk, err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_bootloaderScript(t *testing.T) {
+	for _, bootloader := range []string{"grub", "systemd-boot", "uki"} {
+		for _, espDir := range []bool{false, true} {
+			script := bootloaderScript(bootloader, efiArchitectures["aarch64"], espDir)
+
+			err := exec.Command("sh", "-n", "-c", script).Run()
+			require.NoError(t, err)
+		}
+	}
+
+	require.Contains(t, bootloaderScript("grub", efiArchitectures["aarch64"], false), "--target=arm64-efi")
+	require.Contains(t, bootloaderScript("grub", efiArchitectures["x86_64"], false), "--target=x86_64-efi")
+	require.Contains(t, bootloaderScript("systemd-boot", efiArchitectures["aarch64"], false), "bootctl install")
+	require.Contains(t, bootloaderScript("uki", efiArchitectures["x86_64"], false), "bootctl install")
+	require.NotContains(t, bootloaderScript("systemd-boot", efiArchitectures["x86_64"], false), "SYSTEMD_RELAX_ESP_CHECKS")
+	require.Contains(t, bootloaderScript("systemd-boot", efiArchitectures["x86_64"], true), "SYSTEMD_RELAX_ESP_CHECKS=1 bootctl install")
+
+	err := exec.Command("sh", "-n", "-c", grubScript("--target=powerpc-ieee1275 --no-nvram /dev/loop0p3")).Run()
+	require.NoError(t, err)
+}
+
+func Test_secureBootScript(t *testing.T) {
+	script := secureBootScript(efiArchitectures["x86_64"])
+
+	err := exec.Command("sh", "-n", "-c", script).Run()
+	require.NoError(t, err)
+
+	require.Contains(t, script, "--uefi-secure-boot")
+	require.Contains(t, script, `"${dir}/shimx64.efi"`)
+	require.Contains(t, script, `"${boot_dir}/BOOTX64.EFI"`)
+	require.Contains(t, script, `"${boot_dir}/grubx64.efi"`)
+}
+
+// testEFIBinary returns a minimal PE32+ binary, with a certificate table if
+// signed is true.
+func testEFIBinary(t *testing.T, signed bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	dosHeader := make([]byte, 64)
+	copy(dosHeader, "MZ")
+	binary.LittleEndian.PutUint32(dosHeader[0x3c:], 64)
+	buf.Write(dosHeader)
+	buf.WriteString("PE\x00\x00")
+
+	optionalHeader := pe.OptionalHeader64{Magic: 0x20b, NumberOfRvaAndSizes: 16}
+	if signed {
+		optionalHeader.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY] = pe.DataDirectory{VirtualAddress: 512, Size: 1024}
+	}
+
+	err := binary.Write(&buf, binary.LittleEndian, pe.FileHeader{Machine: pe.IMAGE_FILE_MACHINE_AMD64, SizeOfOptionalHeader: uint16(binary.Size(optionalHeader))})
+	require.NoError(t, err)
+
+	err = binary.Write(&buf, binary.LittleEndian, optionalHeader)
+	require.NoError(t, err)
+
+	return buf.Bytes()
+}
+
+func Test_isSignedEFIBinary(t *testing.T) {
+	dir := t.TempDir()
+
+	var compressed bytes.Buffer
+
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(testEFIBinary(t, true))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	tests := []struct {
+		name    string
+		content []byte
+		signed  bool
+		wantErr bool
+	}{
+		{"signed", testEFIBinary(t, true), true, false},
+		{"unsigned", testEFIBinary(t, false), false, false},
+		{"compressed", compressed.Bytes(), true, false},
+		{"not a PE", []byte("#!/bin/sh\n"), false, true},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+
+		err := os.WriteFile(path, tt.content, 0644)
+		require.NoError(t, err)
+
+		signed, err := isSignedEFIBinary(path)
+		if tt.wantErr {
+			require.Error(t, err, tt.name)
+			continue
+		}
+
+		require.NoError(t, err, tt.name)
+		require.Equal(t, tt.signed, signed, tt.name)
+	}
+}
+
+func Test_configureUKI(t *testing.T) {
+	rootfsDir := t.TempDir()
+
+	v := vm{rootfsDir: rootfsDir, rootFS: "zfs", bootloader: &shared.DefinitionTargetLXDVMBootloader{Type: "uki"}}
+
+	err := v.configureUKI("rpool/ROOT/default")
+	require.NoError(t, err)
+
+	cmdline, err := os.ReadFile(filepath.Join(rootfsDir, "etc", "kernel", "cmdline"))
+	require.NoError(t, err)
+	require.Equal(t, "root=ZFS=rpool/ROOT/default ro\n", string(cmdline))
+
+	installConf, err := os.ReadFile(filepath.Join(rootfsDir, "etc", "kernel", "install.conf"))
+	require.NoError(t, err)
+	require.Equal(t, "layout=uki\nuki_generator=ukify\n", string(installConf))
+
+	// An existing kernel-install configuration is kept.
+	err = os.WriteFile(filepath.Join(rootfsDir, "etc", "kernel", "install.conf"), []byte("layout=bls\n"), 0644)
+	require.NoError(t, err)
+
+	err = v.configureUKI("rpool/ROOT/default")
+	require.NoError(t, err)
+
+	installConf, err = os.ReadFile(filepath.Join(rootfsDir, "etc", "kernel", "install.conf"))
+	require.NoError(t, err)
+	require.Equal(t, "layout=bls\n", string(installConf))
+
+	// Nothing is written for other boot loaders.
+	rootfsDir = t.TempDir()
+	v = vm{rootfsDir: rootfsDir, rootFS: "zfs", bootloader: &shared.DefinitionTargetLXDVMBootloader{Type: "systemd-boot"}}
+
+	err = v.configureUKI("rpool/ROOT/default")
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(rootfsDir, "etc", "kernel", "cmdline"))
+}
+
+func Test_installUBoot(t *testing.T) {
+	rootfsDir := t.TempDir()
+	disk := filepath.Join(t.TempDir(), "disk.img")
+
+	err := os.WriteFile(disk, make([]byte, 2*1024*1024), 0600)
+	require.NoError(t, err)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "usr", "lib", "u-boot"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(rootfsDir, "usr", "lib", "u-boot", "u-boot.itb"), []byte("u-boot"), 0644)
+	require.NoError(t, err)
+
+	v := vm{
+		rootfsDir:  rootfsDir,
+		loopDevice: disk,
+		bootloader: &shared.DefinitionTargetLXDVMBootloader{
+			UBoot: &shared.DefinitionTargetLXDVMUBoot{Path: "/usr/lib/u-boot/u-boot.itb", Offset: 32768},
+		},
+	}
+
+	err = v.installUBoot()
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(disk)
+	require.NoError(t, err)
+	require.Equal(t, "u-boot", string(content[32768:32774]))
+	require.Len(t, content, 2*1024*1024)
+
+	// The binary must not overlap the first partition.
+	v.bootloader.UBoot.Offset = 1048576 - 4
+
+	err = v.installUBoot()
+	require.Error(t, err)
+
+	// Symlinks are resolved inside of the rootfs.
+	hostFile := filepath.Join(t.TempDir(), "secret")
+
+	err = os.WriteFile(hostFile, []byte("secret"), 0600)
+	require.NoError(t, err)
+
+	err = os.Symlink(hostFile, filepath.Join(rootfsDir, "usr", "lib", "u-boot", "link.itb"))
+	require.NoError(t, err)
+
+	v.bootloader.UBoot = &shared.DefinitionTargetLXDVMUBoot{Path: "/usr/lib/u-boot/link.itb", Offset: 32768}
+
+	err = v.installUBoot()
+	require.ErrorContains(t, err, `Failed to read u-boot binary "/usr/lib/u-boot/link.itb"`)
+}
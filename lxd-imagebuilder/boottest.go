@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/canonical/lxd/shared/osarch"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// defaultBootTestPatterns match the login prompt of getty, and the message
+// cloud-init prints once it's done.
+var defaultBootTestPatterns = []string{`\S+ login: ?$`, `Cloud-init v\. \S+ finished`}
+
+// bootTestWindow is the amount of console output the patterns are matched
+// against, and which is included in the error if the image doesn't boot.
+const bootTestWindow = 4096
+
+// qemuMachines describes the QEMU system emulator and machine used to boot VM
+// images of an architecture.
+var qemuMachines = map[string]struct {
+	binary  string
+	machine string
+}{
+	"aarch64": {binary: "qemu-system-aarch64", machine: "virt"},
+	"armv7l":  {binary: "qemu-system-arm", machine: "virt"},
+	"riscv64": {binary: "qemu-system-riscv64", machine: "virt"},
+	"x86_64":  {binary: "qemu-system-x86_64", machine: "q35"},
+}
+
+// qemuBootArgs returns the QEMU system emulator and its arguments, booting the
+// given raw disk image headless with the serial console on stdout. The image
+// is opened in snapshot mode, so the boot doesn't modify it. Without network,
+// the VM has no network interface.
+func qemuBootArgs(architecture string, firmware uefiFirmware, varsFile string, imageFile string, memory uint64, secureBoot bool, kvm bool, network bool) (string, []string, error) {
+	qemu, ok := qemuMachines[architecture]
+	if !ok {
+		return "", nil, fmt.Errorf("Boot test isn't supported on %q", architecture)
+	}
+
+	machine := qemu.machine
+
+	// Secure Boot firmware needs SMM to protect its variable store.
+	if secureBoot && architecture == "x86_64" {
+		machine += ",smm=on"
+	}
+
+	args := []string{"-machine", machine}
+
+	if kvm {
+		args = append(args, "-accel", "kvm", "-cpu", "host")
+	} else {
+		args = append(args, "-accel", "tcg", "-cpu", "max")
+	}
+
+	if secureBoot && architecture == "x86_64" {
+		args = append(args, "-global", "driver=cfi.pflash01,property=secure,value=on")
+	}
+
+	args = append(args,
+		"-m", strconv.FormatUint(memory/1024/1024, 10),
+		"-smp", "2",
+		"-display", "none",
+		"-monitor", "none",
+		"-serial", "stdio",
+		"-drive", fmt.Sprintf("if=pflash,format=raw,unit=0,readonly=on,file=%s", firmware.code))
+
+	if varsFile != "" {
+		args = append(args, "-drive", fmt.Sprintf("if=pflash,format=raw,unit=1,file=%s", varsFile))
+	}
+
+	args = append(args, "-drive", fmt.Sprintf("if=virtio,format=raw,snapshot=on,file=%s", imageFile))
+
+	if network {
+		args = append(args, "-nic", "user,model=virtio-net-pci")
+	} else {
+		args = append(args, "-nic", "none")
+	}
+
+	return qemu.binary, args, nil
+}
+
+// waitForBoot reads the console output until one of the patterns matches, and
+// returns the pattern. If the output ends first, the last part of the output
+// is returned in the error.
+func waitForBoot(r io.Reader, patterns []*regexp.Regexp) (string, error) {
+	var window []byte
+
+	buf := make([]byte, 1024)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			window = append(window, buf[:n]...)
+
+			// Only the end of the output is kept, so matches may be at most
+			// as long as the window.
+			if len(window) > bootTestWindow {
+				window = window[len(window)-bootTestWindow:]
+			}
+
+			for _, pattern := range patterns {
+				if pattern.Match(window) {
+					return pattern.String(), nil
+				}
+			}
+		}
+
+		if err != nil {
+			lines := strings.Split(strings.TrimSpace(string(window)), "\n")
+			if len(lines) > 20 {
+				lines = lines[len(lines)-20:]
+			}
+
+			return "", fmt.Errorf("None of the boot patterns matched, last console output:\n%s", strings.Join(lines, "\n"))
+		}
+	}
+}
+
+// runBootTest boots the given raw disk image under QEMU, and waits for the
+// login prompt or cloud-init on the serial console.
+func runBootTest(ctx context.Context, logger *logrus.Logger, imageFile string, workDir string, architecture string, config shared.DefinitionTargetLXDVM) error {
+	bootTest := config.BootTest
+
+	timeout, err := bootTest.GetTimeout()
+	if err != nil {
+		return err
+	}
+
+	memory := bootTest.Memory
+	if memory == 0 {
+		memory = 2 * 1024 * 1024 * 1024
+	}
+
+	patternStrings := bootTest.Patterns
+	if len(patternStrings) == 0 {
+		patternStrings = defaultBootTestPatterns
+	}
+
+	var patterns []*regexp.Regexp
+
+	for _, pattern := range patternStrings {
+		re, err := regexp.Compile("(?m)" + pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid boot test pattern %q: %w", pattern, err)
+		}
+
+		patterns = append(patterns, re)
+	}
+
+	secureBoot := config.Bootloader != nil && config.Bootloader.SecureBoot
+
+	firmware, err := findUEFIFirmware(architecture, secureBoot, config.Firmware)
+	if err != nil {
+		return err
+	}
+
+	// The firmware writes to its variable store, so it's booted with a copy.
+	var varsFile string
+
+	if firmware.vars != "" {
+		varsFile = filepath.Join(workDir, "boot-test-vars.fd")
+
+		err = shared.Copy(firmware.vars, varsFile)
+		if err != nil {
+			return fmt.Errorf("Failed to copy UEFI variable store %q: %w", firmware.vars, err)
+		}
+
+		defer os.Remove(varsFile)
+	}
+
+	localArchitecture, err := osarch.ArchitectureGetLocal()
+	if err != nil {
+		return fmt.Errorf("Failed to get local architecture: %w", err)
+	}
+
+	kvm := localArchitecture == architecture && lxdShared.PathExists("/dev/kvm")
+
+	binary, args, err := qemuBootArgs(architecture, firmware, varsFile, imageFile, memory, secureBoot, kvm, bootTest.HasNetwork())
+	if err != nil {
+		return err
+	}
+
+	_, err = exec.LookPath(binary)
+	if err != nil {
+		return fmt.Errorf("Required tool %q is missing", binary)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, binary, args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Failed to get console output: %w", err)
+	}
+
+	var stderr strings.Builder
+
+	cmd.Stderr = &stderr
+
+	logger.WithFields(logrus.Fields{"firmware": firmware.code, "kvm": kvm, "timeout": timeout}).Info("Booting VM image")
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to start %q: %w", binary, err)
+	}
+
+	pattern, bootErr := waitForBoot(stdout, patterns)
+
+	// Stop the VM once it booted, or reap QEMU if it exited or timed out.
+	cancel()
+
+	_ = cmd.Wait()
+
+	if bootErr != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("VM image didn't boot within %s: %w", timeout, bootErr)
+		}
+
+		if stderr.Len() > 0 {
+			return fmt.Errorf("VM image didn't boot: %w\n%s", bootErr, strings.TrimSpace(stderr.String()))
+		}
+
+		return fmt.Errorf("VM image didn't boot: %w", bootErr)
+	}
+
+	logger.WithField("pattern", pattern).Info("VM image booted")
+
+	return nil
+}
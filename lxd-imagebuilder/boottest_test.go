@@ -0,0 +1,66 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_qemuBootArgs(t *testing.T) {
+	firmware := uefiFirmware{code: "/usr/share/OVMF/OVMF_CODE_4M.secboot.fd", vars: "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"}
+
+	binary, args, err := qemuBootArgs("x86_64", firmware, "/tmp/vars.fd", "/tmp/disk.img", 2*1024*1024*1024, true, true, true)
+	require.NoError(t, err)
+	require.Equal(t, "qemu-system-x86_64", binary)
+
+	cmdline := strings.Join(args, " ")
+	require.Contains(t, cmdline, "-machine q35,smm=on")
+	require.Contains(t, cmdline, "-accel kvm -cpu host")
+	require.Contains(t, cmdline, "-global driver=cfi.pflash01,property=secure,value=on")
+	require.Contains(t, cmdline, "-m 2048")
+	require.Contains(t, cmdline, "readonly=on,file=/usr/share/OVMF/OVMF_CODE_4M.secboot.fd")
+	require.Contains(t, cmdline, "unit=1,file=/tmp/vars.fd")
+	require.Contains(t, cmdline, "snapshot=on,file=/tmp/disk.img")
+	require.Contains(t, cmdline, "-nic user,model=virtio-net-pci")
+
+	// Without network, the VM has no network interface.
+	binary, args, err = qemuBootArgs("aarch64", uefiFirmware{code: "/usr/share/AAVMF/AAVMF_CODE.fd"}, "", "/tmp/disk.img", 1024*1024*1024, false, false, false)
+	require.NoError(t, err)
+	require.Equal(t, "qemu-system-aarch64", binary)
+
+	cmdline = strings.Join(args, " ")
+	require.Contains(t, cmdline, "-machine virt -accel tcg -cpu max")
+	require.NotContains(t, cmdline, "unit=1")
+	require.Contains(t, cmdline, "-nic none")
+
+	binary, _, err = qemuBootArgs("armv7l", uefiFirmware{code: "/usr/share/AAVMF/AAVMF32_CODE.fd"}, "", "/tmp/disk.img", 1024*1024*1024, false, false, true)
+	require.NoError(t, err)
+	require.Equal(t, "qemu-system-arm", binary)
+
+	_, _, err = qemuBootArgs("s390x", firmware, "", "/tmp/disk.img", 1024*1024*1024, false, false, true)
+	require.Error(t, err)
+}
+
+func Test_waitForBoot(t *testing.T) {
+	var patterns []*regexp.Regexp
+
+	for _, pattern := range defaultBootTestPatterns {
+		patterns = append(patterns, regexp.MustCompile("(?m)"+pattern))
+	}
+
+	// The login prompt isn't followed by a new line.
+	_, err := waitForBoot(strings.NewReader("BdsDxe: starting Boot0001\r\n[  OK  ] Reached target multi-user.target.\r\n\r\nUbuntu 24.04 LTS ubuntu ttyS0\r\n\r\nubuntu login: "), patterns)
+	require.NoError(t, err)
+
+	_, err = waitForBoot(strings.NewReader("Cloud-init v. 24.1.3-0ubuntu3 finished at Mon, 01 Jan 2024 00:00:00 +0000.\n"), patterns)
+	require.NoError(t, err)
+
+	_, err = waitForBoot(strings.NewReader("error: no such device: root.\nEntering rescue mode...\ngrub rescue> "), patterns)
+	require.ErrorContains(t, err, "grub rescue>")
+
+	// Matches spanning several reads are found as well.
+	_, err = waitForBoot(strings.NewReader(strings.Repeat("x", 5000)+"\nubuntu login: "), patterns)
+	require.NoError(t, err)
+}
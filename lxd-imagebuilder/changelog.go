@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// packageVersionRegexes split the name and version of the packages listed by
+// package managers which don't separate them, like apk and xbps.
+var packageVersionRegexes = []*regexp.Regexp{
+	// apk, e.g. musl-1.2.5-r0
+	regexp.MustCompile(`^(.+)-([^-]+-r[0-9]+)$`),
+	// xbps, e.g. glibc-2.39_1
+	regexp.MustCompile(`^(.+)-([^-]+_[0-9]+)$`),
+}
+
+// changelogFilePrefixes are the directories whose changed files are listed
+// in the changelog. Changes in other directories are only counted.
+var changelogFilePrefixes = []string{"etc/"}
+
+// fileManifestEntry is a file of the rootfs listed in a file manifest.
+type fileManifestEntry struct {
+	mode   string
+	digest string
+}
+
+// writeFileManifest writes the file manifest of the rootfs to the given path.
+// Each line holds the mode, the SHA256 of the content or the target of a
+// symlink, and the path of a file. Directories aren't listed.
+func writeFileManifest(rootfsDir string, path string) error {
+	var sb strings.Builder
+
+	err := filepath.WalkDir(rootfsDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(rootfsDir, path)
+		if err != nil {
+			return err
+		}
+
+		var digest string
+
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			digest = "->" + target
+		case info.Mode().IsRegular():
+			digest, err = sha256File(path)
+			if err != nil {
+				return err
+			}
+		default:
+			// Device nodes, sockets and pipes
+			digest = "-"
+		}
+
+		fmt.Fprintf(&sb, "%s\t%s\t%s\n", info.Mode().String(), digest, rel)
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to list files of %q: %w", rootfsDir, err)
+	}
+
+	err = os.WriteFile(path, []byte(sb.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// parseFileManifest parses a file manifest written by writeFileManifest.
+func parseFileManifest(r io.Reader) (map[string]fileManifestEntry, error) {
+	files := map[string]fileManifestEntry{}
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		files[fields[2]] = fileManifestEntry{mode: fields[0], digest: fields[1]}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// parsePackageManifest parses a package manifest, as written by --manifest,
+// into the versions of the packages.
+func parsePackageManifest(r io.Reader) (map[string]string, error) {
+	packages := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		// apt, dnf, yum and zypper separate the version with a tab, pacman with
+		// a space, and xbps lists the state first.
+		name, version, found := strings.Cut(line, "\t")
+		if found {
+			packages[name] = strings.TrimSpace(version)
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) == 2 {
+			packages[fields[0]] = fields[1]
+			continue
+		}
+
+		pkg := fields[0]
+		if len(fields) > 2 {
+			pkg = fields[1]
+		}
+
+		packages[pkg] = ""
+
+		for _, re := range packageVersionRegexes {
+			match := re.FindStringSubmatch(pkg)
+			if match != nil {
+				delete(packages, pkg)
+				packages[match[1]] = match[2]
+
+				break
+			}
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+// renderChangelog returns the changelog of the packages and files between
+// the previous and the new build.
+func renderChangelog(previous string, oldPackages map[string]string, newPackages map[string]string, oldFiles map[string]fileManifestEntry, newFiles map[string]fileManifestEntry) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "Changes since %s\n", previous)
+
+	var added, removed, changed []string
+
+	for name, version := range newPackages {
+		oldVersion, ok := oldPackages[name]
+		if !ok {
+			added = append(added, fmt.Sprintf("%s %s", name, version))
+		} else if oldVersion != version {
+			changed = append(changed, fmt.Sprintf("%s %s -> %s", name, oldVersion, version))
+		}
+	}
+
+	for name, version := range oldPackages {
+		_, ok := newPackages[name]
+		if !ok {
+			removed = append(removed, fmt.Sprintf("%s %s", name, version))
+		}
+	}
+
+	for _, section := range []struct {
+		title string
+		lines []string
+	}{{"Packages added", added}, {"Packages removed", removed}, {"Packages upgraded", changed}} {
+		if len(section.lines) == 0 {
+			continue
+		}
+
+		slices.Sort(section.lines)
+
+		fmt.Fprintf(&sb, "\n%s (%d):\n", section.title, len(section.lines))
+
+		for _, line := range section.lines {
+			fmt.Fprintf(&sb, "  %s\n", strings.TrimSpace(line))
+		}
+	}
+
+	if len(added)+len(removed)+len(changed) == 0 {
+		sb.WriteString("\nNo package changes\n")
+	}
+
+	if oldFiles == nil || newFiles == nil {
+		return sb.String()
+	}
+
+	var filesAdded, filesRemoved, filesChanged int
+	var notable []string
+
+	notableFile := func(state string, path string) {
+		for _, prefix := range changelogFilePrefixes {
+			if strings.HasPrefix(path, prefix) {
+				notable = append(notable, fmt.Sprintf("%s /%s", state, path))
+				return
+			}
+		}
+	}
+
+	for path, entry := range newFiles {
+		oldEntry, ok := oldFiles[path]
+		if !ok {
+			filesAdded++
+			notableFile("A", path)
+		} else if oldEntry != entry {
+			filesChanged++
+			notableFile("M", path)
+		}
+	}
+
+	for path := range oldFiles {
+		_, ok := newFiles[path]
+		if !ok {
+			filesRemoved++
+			notableFile("D", path)
+		}
+	}
+
+	fmt.Fprintf(&sb, "\nFiles: %d added, %d removed, %d changed\n", filesAdded, filesRemoved, filesChanged)
+
+	if len(notable) > 0 {
+		slices.SortFunc(notable, func(a string, b string) int {
+			return strings.Compare(a[2:], b[2:])
+		})
+
+		fmt.Fprintf(&sb, "\nConfiguration files (%d):\n", len(notable))
+
+		for _, line := range notable {
+			fmt.Fprintf(&sb, "  %s\n", line)
+		}
+	}
+
+	return sb.String()
+}
+
+// writeChangelog writes the changelog between the artifacts of the previous
+// build in previousDir and the new ones in dir to rootfs.changelog. Nothing is
+// written if there's no package manifest of a previous build.
+func writeChangelog(previous string, previousDir string, dir string) (bool, error) {
+	readManifest := func(path string) ([]byte, error) {
+		content, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("Failed to read %q: %w", path, err)
+		}
+
+		return content, nil
+	}
+
+	oldPackagesData, err := readManifest(filepath.Join(previousDir, "rootfs.manifest"))
+	if err != nil {
+		return false, err
+	}
+
+	if oldPackagesData == nil {
+		return false, nil
+	}
+
+	newPackagesData, err := readManifest(filepath.Join(dir, "rootfs.manifest"))
+	if err != nil {
+		return false, err
+	}
+
+	oldPackages, err := parsePackageManifest(bytes.NewReader(oldPackagesData))
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse %q: %w", filepath.Join(previousDir, "rootfs.manifest"), err)
+	}
+
+	newPackages, err := parsePackageManifest(bytes.NewReader(newPackagesData))
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse %q: %w", filepath.Join(dir, "rootfs.manifest"), err)
+	}
+
+	// Previous builds may not have a file manifest.
+	var oldFiles, newFiles map[string]fileManifestEntry
+
+	oldFilesData, err := readManifest(filepath.Join(previousDir, "rootfs.files"))
+	if err != nil {
+		return false, err
+	}
+
+	if oldFilesData != nil {
+		oldFiles, err = parseFileManifest(bytes.NewReader(oldFilesData))
+		if err != nil {
+			return false, fmt.Errorf("Failed to parse %q: %w", filepath.Join(previousDir, "rootfs.files"), err)
+		}
+
+		newFilesData, err := readManifest(filepath.Join(dir, "rootfs.files"))
+		if err != nil {
+			return false, err
+		}
+
+		newFiles, err = parseFileManifest(bytes.NewReader(newFilesData))
+		if err != nil {
+			return false, fmt.Errorf("Failed to parse %q: %w", filepath.Join(dir, "rootfs.files"), err)
+		}
+	}
+
+	path := filepath.Join(dir, "rootfs.changelog")
+
+	err = os.WriteFile(path, []byte(renderChangelog(previous, oldPackages, newPackages, oldFiles, newFiles)), 0644)
+	if err != nil {
+		return false, fmt.Errorf("Failed to write %q: %w", path, err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parsePackageManifest(t *testing.T) {
+	tests := []struct {
+		manager  string
+		manifest string
+		expected map[string]string
+	}{
+		{"apt", "bash\t5.2.21-2ubuntu4\nlibc6:amd64\t2.39-0ubuntu8\n", map[string]string{"bash": "5.2.21-2ubuntu4", "libc6:amd64": "2.39-0ubuntu8"}},
+		{"apk", "musl-1.2.5-r0\nbusybox-binsh-1.36.1-r29\n", map[string]string{"musl": "1.2.5-r0", "busybox-binsh": "1.36.1-r29"}},
+		{"pacman", "bash 5.2.026-2\n", map[string]string{"bash": "5.2.026-2"}},
+		{"xbps", "ii glibc-2.39_1  The GNU C library\n", map[string]string{"glibc": "2.39_1"}},
+	}
+
+	for _, test := range tests {
+		packages, err := parsePackageManifest(strings.NewReader(test.manifest))
+		require.NoError(t, err, test.manager)
+		require.Equal(t, test.expected, packages, test.manager)
+	}
+}
+
+func Test_renderChangelog(t *testing.T) {
+	oldPackages := map[string]string{"bash": "5.2-1", "curl": "8.5-1", "wget": "1.21-1"}
+	newPackages := map[string]string{"bash": "5.2-1", "curl": "8.5-2", "vim": "9.1-1"}
+
+	oldFiles := map[string]fileManifestEntry{
+		"etc/hostname":  {"-rw-r--r--", "a"},
+		"etc/wgetrc":    {"-rw-r--r--", "b"},
+		"usr/bin/curl":  {"-rwxr-xr-x", "c"},
+		"usr/bin/wget":  {"-rwxr-xr-x", "d"},
+		"etc/issue":     {"-rw-r--r--", "e"},
+		"etc/localtime": {"Lrwxrwxrwx", "->/usr/share/zoneinfo/UTC"},
+	}
+
+	newFiles := map[string]fileManifestEntry{
+		"etc/hostname":  {"-rw-r--r--", "a"},
+		"etc/vimrc":     {"-rw-r--r--", "f"},
+		"usr/bin/curl":  {"-rwxr-xr-x", "g"},
+		"usr/bin/vim":   {"-rwxr-xr-x", "h"},
+		"etc/issue":     {"-rw-------", "e"},
+		"etc/localtime": {"Lrwxrwxrwx", "->/usr/share/zoneinfo/UTC"},
+	}
+
+	require.Equal(t, `Changes since 20240301_0000
+
+Packages added (1):
+  vim 9.1-1
+
+Packages removed (1):
+  wget 1.21-1
+
+Packages upgraded (1):
+  curl 8.5-1 -> 8.5-2
+
+Files: 2 added, 2 removed, 2 changed
+
+Configuration files (3):
+  M /etc/issue
+  A /etc/vimrc
+  D /etc/wgetrc
+`, renderChangelog("20240301_0000", oldPackages, newPackages, oldFiles, newFiles))
+
+	// File changes are left out without the file manifest of the previous build.
+	require.Equal(t, "Changes since the previous build\n\nNo package changes\n", renderChangelog("the previous build", oldPackages, oldPackages, nil, newFiles))
+}
+
+func Test_writeChangelog(t *testing.T) {
+	rootfsDir := t.TempDir()
+	previousDir := t.TempDir()
+	dir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(rootfsDir, "etc", "hostname"), []byte("image\n"), 0644)
+	require.NoError(t, err)
+
+	err = os.Symlink("/usr/share/zoneinfo/UTC", filepath.Join(rootfsDir, "etc", "localtime"))
+	require.NoError(t, err)
+
+	err = writeFileManifest(rootfsDir, filepath.Join(dir, "rootfs.files"))
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(dir, "rootfs.files"))
+	require.NoError(t, err)
+	require.Equal(t, "-rw-r--r--\t254eddf15d9534e3b20c55469077aa2f24f167aa4b897a36381d3e251e4829c2\tetc/hostname\nLrwxrwxrwx\t->/usr/share/zoneinfo/UTC\tetc/localtime\n", string(content))
+
+	err = os.WriteFile(filepath.Join(dir, "rootfs.manifest"), []byte("bash\t5.2-2\n"), 0644)
+	require.NoError(t, err)
+
+	// There's no previous build.
+	written, err := writeChangelog("20240301_0000", previousDir, dir)
+	require.NoError(t, err)
+	require.False(t, written)
+	require.NoFileExists(t, filepath.Join(dir, "rootfs.changelog"))
+
+	err = os.WriteFile(filepath.Join(previousDir, "rootfs.manifest"), []byte("bash\t5.2-1\n"), 0644)
+	require.NoError(t, err)
+
+	written, err = writeChangelog("20240301_0000", previousDir, dir)
+	require.NoError(t, err)
+	require.True(t, written)
+
+	content, err = os.ReadFile(filepath.Join(dir, "rootfs.changelog"))
+	require.NoError(t, err)
+	require.Equal(t, "Changes since 20240301_0000\n\nPackages upgraded (1):\n  bash 5.2-1 -> 5.2-2\n", string(content))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// checkBootable checks that the mounted image contains a boot loader in the
+// removable media path of the EFI system partition, and that the file systems
+// in /etc/fstab exist in the image. It catches images which would fail to
+// boot, e.g. because an action installed the boot loader elsewhere.
+func (v *vm) checkBootable(architecture string) error {
+	if v.skipChecks {
+		return nil
+	}
+
+	// POWER and u-boot don't boot from the EFI system partition, and neither
+	// does the root image of the boot artifacts.
+	arch, ok := efiArchitectures[architecture]
+	if ok && !v.prep && (v.bootloader == nil || v.bootloader.UBoot == nil) && !v.bootsFromRootImage() {
+		err := checkESP(filepath.Join(v.rootfsDir, "boot", "efi"), arch)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The file systems of the userspace backend are created at the end of the
+	// build, and checked by writeFilesystems.
+	if v.userspace {
+		return nil
+	}
+
+	devs := []string{v.getUEFIDevFile(), v.getRootfsDevFile(), v.getPVDevFile(), v.getRootDevFile(), v.getSwapDevFile()}
+	devs = append(devs, v.getLVDevFiles()...)
+
+	slices.Sort(devs)
+	devs = slices.Compact(slices.DeleteFunc(devs, func(dev string) bool { return dev == "" }))
+
+	return v.checkFstabDevices(devs)
+}
+
+// checkFstabDevices checks /etc/fstab of the image against the partitions of
+// the image and the file systems on the given devices.
+func (v *vm) checkFstabDevices(devs []string) error {
+	fstab := filepath.Join(v.rootfsDir, "etc", "fstab")
+
+	content, err := os.ReadFile(fstab)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("Failed to read %q: %w", fstab, err)
+	}
+
+	tags, err := v.getFstabTags(devs)
+	if err != nil {
+		return fmt.Errorf("Failed to identify file systems of the image: %w", err)
+	}
+
+	return checkFstab(string(content), tags)
+}
+
+// getFstabTags returns the tags fstab may refer to, e.g. "UUID=<uuid>" or
+// "LABEL=rootfs". The PARTUUID and PARTLABEL tags are read from the partition
+// table of the image, and the UUID and LABEL tags from the given devices.
+// Devices without a known file system, e.g. LVM physical volumes, are skipped.
+func (v *vm) getFstabTags(devs []string) (map[string]bool, error) {
+	tags := map[string]bool{}
+
+	f, err := os.Open(v.imageFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %q: %w", v.imageFile, err)
+	}
+
+	defer f.Close()
+
+	_, entries, err := readGPT(f)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		tags["PARTUUID="+formatGUID(entry.uniqueGUID)] = true
+
+		if entry.name != "" {
+			tags["PARTLABEL="+entry.name] = true
+		}
+	}
+
+	for _, dev := range devs {
+		info, err := getDeviceFilesystemInfo(dev)
+		if err != nil {
+			if errors.Is(err, errUnknownFilesystem) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		tags["UUID="+info.uuid] = true
+
+		if info.label != "" {
+			tags["LABEL="+info.label] = true
+		}
+	}
+
+	return tags, nil
+}
+
+// checkESP checks that the EFI system partition mounted at the given path
+// contains the boot loader of the removable media path.
+func checkESP(espDir string, arch efiArchitecture) error {
+	bootFile := filepath.Join(espDir, "EFI", "BOOT", fmt.Sprintf("BOOT%s.EFI", arch.suffix))
+
+	if !lxdShared.PathExists(bootFile) {
+		return fmt.Errorf("EFI system partition has no boot loader at %q", strings.TrimPrefix(bootFile, espDir))
+	}
+
+	return nil
+}
+
+// checkFstab checks that the file systems of the fstab entries referred to by
+// tag exist. Entries which are optional, or refer to devices by path, aren't
+// checked, as they may not be part of the image.
+func checkFstab(content string, tags map[string]bool) error {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		source := fields[0]
+
+		key, value, ok := strings.Cut(source, "=")
+		if !ok || !slices.Contains([]string{"UUID", "LABEL", "PARTUUID", "PARTLABEL"}, key) {
+			continue
+		}
+
+		if len(fields) >= 4 {
+			options := strings.Split(fields[3], ",")
+
+			if slices.Contains(options, "nofail") || slices.Contains(options, "noauto") {
+				continue
+			}
+		}
+
+		if !tags[key+"="+strings.Trim(value, `"`)] {
+			return fmt.Errorf("File system %q of %q in /etc/fstab doesn't exist in the image", source, fields[1])
+		}
+	}
+
+	return nil
+}
+
+// checkFilesystems checks the unmounted file systems of the image without
+// modifying them, so broken file systems fail the build.
+func (v *vm) checkFilesystems() error {
+	if v.skipChecks {
+		return nil
+	}
+
+	if v.loopDevice == "" {
+		return errors.New("Disk image not mounted")
+	}
+
+	err := v.checkFilesystem("vfat", v.getUEFIDevFile())
+	if err != nil {
+		return err
+	}
+
+	err = v.checkFilesystem(v.rootFS, v.getRootDevFile())
+	if err != nil {
+		return err
+	}
+
+	if v.lvmActive && v.lvm.DataSize > 0 {
+		return v.checkFilesystem("ext4", v.getLVDevFile("data"))
+	}
+
+	return nil
+}
+
+// checkFilesystem checks the file system of the given type on the given
+// device or file without modifying it.
+func (v *vm) checkFilesystem(fs string, dev string) error {
+	var err error
+
+	switch fs {
+	case "vfat":
+		err = shared.RunCommand(v.ctx, nil, nil, "fsck.vfat", "-n", dev)
+		if err != nil {
+			return fmt.Errorf("EFI system partition check failed: %w", err)
+		}
+
+		return nil
+	case "btrfs":
+		err = shared.RunCommand(v.ctx, nil, nil, "btrfs", "check", "--readonly", dev)
+	case "f2fs":
+		err = shared.RunCommand(v.ctx, nil, nil, "fsck.f2fs", "--dry-run", dev)
+	case "zfs":
+		// ZFS checks itself when the pool is scrubbed.
+		return nil
+	default:
+		err = shared.RunCommand(v.ctx, nil, nil, "e2fsck", "-f", "-n", dev)
+	}
+
+	if err != nil {
+		return fmt.Errorf("File system check of %q failed: %w", dev, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkESP(t *testing.T) {
+	espDir := t.TempDir()
+
+	err := checkESP(espDir, efiArchitectures["x86_64"])
+	require.EqualError(t, err, `EFI system partition has no boot loader at "/EFI/BOOT/BOOTX64.EFI"`)
+
+	err = os.MkdirAll(filepath.Join(espDir, "EFI", "BOOT"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(espDir, "EFI", "BOOT", "BOOTX64.EFI"), nil, 0644)
+	require.NoError(t, err)
+
+	err = checkESP(espDir, efiArchitectures["x86_64"])
+	require.NoError(t, err)
+}
+
+func Test_checkFstab(t *testing.T) {
+	tags := map[string]bool{
+		"UUID=1A2B-3C4D":       true,
+		"LABEL=UEFI":           true,
+		"PARTUUID=0f8e5c1a-01": true,
+		"LABEL=rootfs":         true,
+		"UUID=5d5c2e1f-0f0b-4a4e-9a43-2b6b0f2f5c7e": true,
+		"PARTUUID=0f8e5c1a-02":                      true,
+	}
+
+	fstab := `# /etc/fstab
+LABEL=rootfs  /         ext4  defaults  0 0
+UUID="1A2B-3C4D"  /boot/efi vfat  defaults  0 0
+LABEL=data  /srv/data  xfs  defaults,nofail  0 2
+/dev/vdb  /mnt  ext4  defaults  0 2
+tmpfs  /tmp  tmpfs  defaults  0 0
+`
+
+	err := checkFstab(fstab, tags)
+	require.NoError(t, err)
+
+	err = checkFstab(fstab+"UUID=8c9f3f36  /home  ext4  defaults  0 2\n", tags)
+	require.EqualError(t, err, `File system "UUID=8c9f3f36" of "/home" in /etc/fstab doesn't exist in the image`)
+}
+
+func Test_getFstabTags(t *testing.T) {
+	dir := t.TempDir()
+	diskSize := uint64(64 * 1024 * 1024)
+
+	v := &vm{imageFile: filepath.Join(dir, "image.img")}
+
+	f, err := os.Create(v.imageFile)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	err = f.Truncate(int64(diskSize))
+	require.NoError(t, err)
+
+	err = writeGPT(f, diskSize, []gptPartition{
+		{typeGUID: gptTypeEFISystem, name: "EFI", size: 8 * 1024 * 1024},
+		{typeGUID: gptTypeLinuxFS},
+	})
+	require.NoError(t, err)
+
+	_, entries, err := readGPT(f)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// An ext4 file system labeled "rootfs", and a device without a file system.
+	rootfs := make([]byte, 4096)
+	binary.LittleEndian.PutUint16(rootfs[1024+56:], 0xEF53)
+	copy(rootfs[1024+104:], []byte{0xdd, 0x57, 0x70, 0x5e, 0x71, 0x50, 0x49, 0x43, 0x95, 0x1e, 0x9e, 0x29, 0xed, 0xbe, 0xfb, 0xdd})
+	copy(rootfs[1024+120:], "rootfs")
+
+	err = os.WriteFile(filepath.Join(dir, "rootfs"), rootfs, 0644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "pv"), make([]byte, 4096), 0644)
+	require.NoError(t, err)
+
+	tags, err := v.getFstabTags([]string{filepath.Join(dir, "rootfs"), filepath.Join(dir, "pv")})
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{
+		"PARTUUID=" + formatGUID(entries[0].uniqueGUID): true,
+		"PARTLABEL=EFI": true,
+		"PARTUUID=" + formatGUID(entries[1].uniqueGUID): true,
+		"UUID=dd57705e-7150-4943-951e-9e29edbefbdd":     true,
+		"LABEL=rootfs": true,
+	}, tags)
+
+	_, err = v.getFstabTags([]string{filepath.Join(dir, "missing")})
+	require.Error(t, err)
+}
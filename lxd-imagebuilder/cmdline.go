@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	lxdShared "github.com/canonical/lxd/shared"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// baseKernelCmdline returns the parameters of targets.lxd.vm.kernel_cmdline,
+// which default to "ro".
+func (v *vm) baseKernelCmdline() (*shared.KernelCmdline, error) {
+	cmdline := shared.NewKernelCmdline("ro")
+
+	if v.kernelCmdlineConfig == nil {
+		return cmdline, nil
+	}
+
+	if v.kernelCmdlineConfig.Mode != "" {
+		cmdline.Set(v.kernelCmdlineConfig.Mode)
+	}
+
+	for _, console := range v.kernelCmdlineConfig.Console {
+		cmdline.Set("console=" + console)
+	}
+
+	extra, err := shared.ParseKernelCmdline(v.kernelCmdlineConfig.Extra)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse kernel command line: %w", err)
+	}
+
+	cmdline.Merge(extra)
+
+	return cmdline, nil
+}
+
+// rootKernelParams returns the kernel parameters mounting the root file
+// system of the image.
+func (v *vm) rootKernelParams(rootDataset string) ([]string, error) {
+	var params []string
+
+	switch {
+	case v.rootFS == "zfs":
+		params = append(params, fmt.Sprintf("root=ZFS=%s", rootDataset))
+	case v.lvm != nil:
+		params = append(params, fmt.Sprintf("root=/dev/mapper/%s-root", v.lvm.VolumeGroup))
+	case v.encryption != nil:
+		params = append(params, fmt.Sprintf("root=/dev/mapper/%s", cryptRootName))
+	case v.verity != nil:
+		verityParams, err := v.verityCmdline()
+		if err != nil {
+			return nil, err
+		}
+
+		params = append(params, verityParams...)
+	default:
+		partUUID, err := v.getRootfsPartitionUUID()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get PARTUUID of root partition: %w", err)
+		}
+
+		params = append(params, fmt.Sprintf("root=PARTUUID=%s", partUUID))
+	}
+
+	if v.rootFS == "btrfs" {
+		for _, subvolume := range v.btrfs.Subvolumes {
+			if subvolume.Mountpoint == "/" {
+				params = append(params, fmt.Sprintf("rootflags=subvol=%s", subvolume.Name))
+			}
+		}
+	}
+
+	return params, nil
+}
+
+// kernelCmdlineParams returns the parameters of kernel_cmdline, followed by the
+// ones of boot_artifacts.cmdline.
+func (v *vm) kernelCmdlineParams() (*shared.KernelCmdline, error) {
+	params, err := v.baseKernelCmdline()
+	if err != nil {
+		return nil, err
+	}
+
+	if v.bootArtifacts != nil && v.bootArtifacts.Cmdline != "" {
+		extra, err := shared.ParseKernelCmdline(v.bootArtifacts.Cmdline)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse kernel command line: %w", err)
+		}
+
+		params.Merge(extra)
+	}
+
+	return params, nil
+}
+
+// kernelCmdline returns the kernel command line mounting the root file system
+// of the image, followed by the parameters of kernel_cmdline and
+// boot_artifacts.cmdline. It's used for the boot artifacts, systemd-boot and
+// unified kernel images.
+func (v *vm) kernelCmdline(rootDataset string) (string, error) {
+	params, err := v.kernelCmdlineParams()
+	if err != nil {
+		return "", err
+	}
+
+	var cmdline *shared.KernelCmdline
+
+	// The root file system is set explicitly.
+	root, ok := params.Get("root")
+	if ok {
+		cmdline = shared.NewKernelCmdline(root)
+	} else {
+		rootParams, err := v.rootKernelParams(rootDataset)
+		if err != nil {
+			return "", err
+		}
+
+		cmdline = shared.NewKernelCmdline(rootParams...)
+	}
+
+	cmdline.Merge(params)
+
+	return cmdline.String(), nil
+}
+
+// grubKernelCmdline returns the kernel parameters added by grub. grub-mkconfig
+// sets the root file system and "ro" itself, except for ZFS.
+func (v *vm) grubKernelCmdline(rootDataset string) (string, error) {
+	params, err := v.baseKernelCmdline()
+	if err != nil {
+		return "", err
+	}
+
+	params.Remove("ro")
+
+	cmdline := shared.NewKernelCmdline()
+
+	if v.rootFS == "zfs" {
+		cmdline.Set(fmt.Sprintf("root=ZFS=%s", rootDataset))
+	}
+
+	cmdline.Merge(params)
+
+	return cmdline.String(), nil
+}
+
+// configureKernelCmdline writes the kernel command line for the boot loader
+// of the image, so neither the build nor kernel updates need to edit it.
+func (v *vm) configureKernelCmdline(rootDataset string) error {
+	if lxdShared.PathExists(filepath.Join(v.rootfsDir, "etc", "default", "grub")) {
+		cmdline, err := v.grubKernelCmdline(rootDataset)
+		if err != nil {
+			return err
+		}
+
+		if cmdline != "" {
+			grubDir := filepath.Join(v.rootfsDir, "etc", "default", "grub.d")
+
+			err = os.MkdirAll(grubDir, 0755)
+			if err != nil {
+				return fmt.Errorf("Failed to create directory %q: %w", grubDir, err)
+			}
+
+			grubConf := filepath.Join(grubDir, "lxd-imagebuilder.cfg")
+
+			err = os.WriteFile(grubConf, []byte(fmt.Sprintf("GRUB_CMDLINE_LINUX=\"$GRUB_CMDLINE_LINUX %s\"\n", cmdline)), 0644)
+			if err != nil {
+				return fmt.Errorf("Failed to write %q: %w", grubConf, err)
+			}
+		}
+	}
+
+	// Unified kernel images are configured by configureUKI.
+	if v.bootloader == nil || v.bootloader.Type != "systemd-boot" {
+		return nil
+	}
+
+	cmdline, err := v.kernelCmdline(rootDataset)
+	if err != nil {
+		return err
+	}
+
+	kernelDir := filepath.Join(v.rootfsDir, "etc", "kernel")
+
+	err = os.MkdirAll(kernelDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", kernelDir, err)
+	}
+
+	err = os.WriteFile(filepath.Join(kernelDir, "cmdline"), []byte(cmdline+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", filepath.Join(kernelDir, "cmdline"), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_kernelCmdlineConfig(t *testing.T) {
+	config := &shared.DefinitionTargetLXDVMKernelCmdline{Mode: "rw", Console: []string{"tty0", "ttyS0,115200"}, Extra: "quiet console=tty0"}
+
+	v := vm{rootFS: "zfs", kernelCmdlineConfig: config, bootArtifacts: &shared.DefinitionTargetLXDVMBootArtifacts{Cmdline: "ro"}}
+
+	cmdline, err := v.kernelCmdline("rpool/ROOT/default")
+	require.NoError(t, err)
+	require.Equal(t, "root=ZFS=rpool/ROOT/default ro console=tty0 console=ttyS0,115200 quiet", cmdline)
+
+	cmdline, err = v.grubKernelCmdline("rpool/ROOT/default")
+	require.NoError(t, err)
+	require.Equal(t, "root=ZFS=rpool/ROOT/default rw console=tty0 console=ttyS0,115200 quiet", cmdline)
+
+	// grub sets the root file system and "ro" itself.
+	v = vm{rootFS: "ext4"}
+
+	cmdline, err = v.grubKernelCmdline("")
+	require.NoError(t, err)
+	require.Equal(t, "", cmdline)
+}
+
+func Test_configureKernelCmdline(t *testing.T) {
+	rootfsDir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(rootfsDir, "etc", "default"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(rootfsDir, "etc", "default", "grub"), nil, 0644)
+	require.NoError(t, err)
+
+	v := vm{rootfsDir: rootfsDir, rootFS: "zfs", kernelCmdlineConfig: &shared.DefinitionTargetLXDVMKernelCmdline{Console: []string{"ttyS0"}}, bootloader: &shared.DefinitionTargetLXDVMBootloader{Type: "systemd-boot"}}
+
+	err = v.configureKernelCmdline("rpool/ROOT/default")
+	require.NoError(t, err)
+
+	grubConf, err := os.ReadFile(filepath.Join(rootfsDir, "etc", "default", "grub.d", "lxd-imagebuilder.cfg"))
+	require.NoError(t, err)
+	require.Equal(t, "GRUB_CMDLINE_LINUX=\"$GRUB_CMDLINE_LINUX root=ZFS=rpool/ROOT/default console=ttyS0\"\n", string(grubConf))
+
+	cmdline, err := os.ReadFile(filepath.Join(rootfsDir, "etc", "kernel", "cmdline"))
+	require.NoError(t, err)
+	require.Equal(t, "root=ZFS=rpool/ROOT/default ro console=ttyS0\n", string(cmdline))
+
+	// Without parameters, the configuration of grub is left alone.
+	rootfsDir = t.TempDir()
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "etc", "default"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(rootfsDir, "etc", "default", "grub"), nil, 0644)
+	require.NoError(t, err)
+
+	v = vm{rootfsDir: rootfsDir, rootFS: "ext4"}
+
+	err = v.configureKernelCmdline("")
+	require.NoError(t, err)
+	require.NoDirExists(t, filepath.Join(rootfsDir, "etc", "default", "grub.d"))
+	require.NoDirExists(t, filepath.Join(rootfsDir, "etc", "kernel"))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// logRecorder is a logrus hook which keeps a copy of all log entries, so they
+// can be added to the diagnostics.
+type logRecorder struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	formatter logrus.Formatter
+}
+
+func newLogRecorder() *logRecorder {
+	return &logRecorder{formatter: &logrus.TextFormatter{FullTimestamp: true, DisableColors: true}}
+}
+
+// Levels returns the log levels the hook is fired for.
+func (r *logRecorder) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire records the log entry.
+func (r *logRecorder) Fire(entry *logrus.Entry) error {
+	line, err := r.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf.Write(line)
+
+	return nil
+}
+
+// Bytes returns the recorded log.
+func (r *logRecorder) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return bytes.Clone(r.buf.Bytes())
+}
+
+// collectDiagnostics creates a tarball in the target directory containing the
+// information needed to debug the failed build.
+func (c *cmdGlobal) collectDiagnostics(buildErr error) (string, error) {
+	dir, err := os.MkdirTemp("", "lxd-imagebuilder-diagnostics.")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create temporary directory: %w", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"error.txt": []byte(buildErr.Error() + "\n"),
+	}
+
+	if c.logRecorder != nil {
+		files["build.log"] = c.logRecorder.Bytes()
+	}
+
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err == nil {
+		files["mountinfo"] = mountinfo
+	}
+
+	definition, err := yaml.Marshal(redactDefinition(*c.definition))
+	if err == nil {
+		files["definition.yaml"] = definition
+	}
+
+	var scriptErr *shared.ScriptError
+
+	if errors.As(buildErr, &scriptErr) {
+		files["action.sh"] = []byte(scriptErr.Script)
+
+		for i, output := range scriptErr.Attempts {
+			files[fmt.Sprintf("action-attempt-%d.log", i+1)] = []byte(output)
+		}
+	}
+
+	var commandErr *shared.CommandError
+
+	if errors.As(buildErr, &commandErr) {
+		files["command.log"] = []byte(strings.Join(commandErr.Command, " ") + "\n\n" + strings.Join(commandErr.Output, "\n") + "\n")
+	}
+
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), content, 0600)
+		if err != nil {
+			return "", fmt.Errorf("Failed to write %q: %w", filepath.Join(dir, name), err)
+		}
+	}
+
+	// The build context may be cancelled already, e.g. if the build timed out.
+	ctx := context.Background()
+
+	// Package managers log to /var/log as well.
+	logDir := filepath.Join(c.sourceDir, "var", "log")
+
+	if c.sourceDir != "" && lxdShared.PathExists(logDir) {
+		err := os.MkdirAll(filepath.Join(dir, "rootfs", "var"), 0755)
+		if err != nil {
+			return "", fmt.Errorf("Failed to create directory %q: %w", filepath.Join(dir, "rootfs", "var"), err)
+		}
+
+		err = shared.RsyncLocal(ctx, logDir, filepath.Join(dir, "rootfs", "var"))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	targetDir := c.targetDir
+
+	// When running build-dir, the target directory is the rootfs itself.
+	if targetDir == c.sourceDir {
+		targetDir = filepath.Dir(targetDir)
+	}
+
+	filename := filepath.Join(targetDir, fmt.Sprintf("lxd-imagebuilder-diagnostics-%s.tar", time.Now().UTC().Format("20060102T150405Z")))
+
+	return shared.Pack(ctx, filename, "gzip", dir, shared.DefinitionTargetTar{}, ".")
+}
+
+// redactDefinition returns a copy of the definition without secrets.
+func redactDefinition(def shared.Definition) shared.Definition {
+	encryption := def.Targets.LXD.VM.Encryption
+
+	if encryption != nil && encryption.Passphrase != "" {
+		redacted := *encryption
+		redacted.Passphrase = "<redacted>"
+		def.Targets.LXD.VM.Encryption = &redacted
+	}
+
+	return def
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_collectDiagnostics(t *testing.T) {
+	for _, tool := range []string{"gzip", "rsync", "tar"} {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			t.Skipf("%s is missing", tool)
+		}
+	}
+
+	sourceDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(sourceDir, "var", "log", "apt"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(sourceDir, "var", "log", "apt", "term.log"), []byte("failed\n"), 0644)
+	require.NoError(t, err)
+
+	logger := logrus.New()
+	recorder := newLogRecorder()
+	logger.AddHook(recorder)
+	logger.SetOutput(&strings.Builder{})
+	logger.Info("Managing packages")
+
+	c := cmdGlobal{
+		definition: &shared.Definition{
+			Image: shared.DefinitionImage{Distribution: "ubuntu"},
+			Targets: shared.DefinitionTarget{
+				LXD: shared.DefinitionTargetLXD{
+					VM: shared.DefinitionTargetLXDVM{
+						Encryption: &shared.DefinitionTargetLXDVMEncryption{Passphrase: "secret"},
+					},
+				},
+			},
+		},
+		sourceDir:   sourceDir,
+		targetDir:   targetDir,
+		logger:      logger,
+		logRecorder: recorder,
+	}
+
+	buildErr := fmt.Errorf("Failed to run post-packages: %w", &shared.ScriptError{Script: "#!/bin/sh\nexit 1\n", Err: errors.New("exit status 1"), Attempts: []string{"first", "second"}})
+
+	filename, err := c.collectDiagnostics(buildErr)
+	require.NoError(t, err)
+	require.Equal(t, targetDir, filepath.Dir(filename))
+	require.True(t, strings.HasSuffix(filename, ".tar.gz"))
+
+	out, err := exec.Command("tar", "-tzf", filename).Output()
+	require.NoError(t, err)
+
+	for _, name := range []string{"./action.sh", "./action-attempt-1.log", "./action-attempt-2.log", "./build.log", "./definition.yaml", "./error.txt", "./rootfs/var/log/apt/term.log"} {
+		require.Contains(t, strings.Split(string(out), "\n"), name)
+	}
+
+	out, err = exec.Command("tar", "-xzOf", filename, "./definition.yaml").Output()
+	require.NoError(t, err)
+	require.NotContains(t, string(out), "secret")
+
+	out, err = exec.Command("tar", "-xzOf", filename, "./build.log").Output()
+	require.NoError(t, err)
+	require.Contains(t, string(out), "Managing packages")
+
+	// The original definition must be left untouched.
+	require.Equal(t, "secret", c.definition.Targets.LXD.VM.Encryption.Passphrase)
+
+	// The output of failed commands is included.
+	buildErr = fmt.Errorf("Failed to create partitions: %w", &shared.CommandError{Command: []string{"sgdisk", "--zap-all", "/dev/loop0"}, Err: errors.New("exit status 2"), Output: []string{"Problem opening /dev/loop0 for reading!"}})
+
+	filename, err = c.collectDiagnostics(buildErr)
+	require.NoError(t, err)
+
+	out, err = exec.Command("tar", "-xzOf", filename, "./command.log").Output()
+	require.NoError(t, err)
+	require.Equal(t, "sgdisk --zap-all /dev/loop0\n\nProblem opening /dev/loop0 for reading!\n", string(out))
+}
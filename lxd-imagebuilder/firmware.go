@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+
+	lxdShared "github.com/canonical/lxd/shared"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// uefiFirmware describes the UEFI firmware files used to boot a VM image under
+// QEMU. The variables file is copied, as the firmware writes to it.
+type uefiFirmware struct {
+	code string
+	vars string
+}
+
+// uefiFirmwareCandidates lists the firmware files shipped by the edk2 packages
+// of common distributions, by architecture. The Secure Boot ones have the
+// Microsoft keys enrolled, so the signed shim of the distributions boots.
+var uefiFirmwareCandidates = map[string]struct {
+	plain      []uefiFirmware
+	secureBoot []uefiFirmware
+}{
+	"aarch64": {
+		plain: []uefiFirmware{
+			{code: "/usr/share/AAVMF/AAVMF_CODE.fd", vars: "/usr/share/AAVMF/AAVMF_VARS.fd"},
+			{code: "/usr/share/edk2/aarch64/QEMU_EFI-pflash.raw", vars: "/usr/share/edk2/aarch64/vars-template-pflash.raw"},
+		},
+		secureBoot: []uefiFirmware{
+			{code: "/usr/share/AAVMF/AAVMF_CODE.ms.fd", vars: "/usr/share/AAVMF/AAVMF_VARS.ms.fd"},
+		},
+	},
+	"armv7l": {
+		plain: []uefiFirmware{
+			{code: "/usr/share/AAVMF/AAVMF32_CODE.fd", vars: "/usr/share/AAVMF/AAVMF32_VARS.fd"},
+			{code: "/usr/share/edk2/arm/QEMU_EFI-pflash.raw", vars: "/usr/share/edk2/arm/vars-template-pflash.raw"},
+		},
+	},
+	"riscv64": {
+		plain: []uefiFirmware{
+			{code: "/usr/share/qemu-efi-riscv64/RISCV_VIRT_CODE.fd", vars: "/usr/share/qemu-efi-riscv64/RISCV_VIRT_VARS.fd"},
+		},
+	},
+	"x86_64": {
+		plain: []uefiFirmware{
+			{code: "/usr/share/OVMF/OVMF_CODE_4M.fd", vars: "/usr/share/OVMF/OVMF_VARS_4M.fd"},
+			{code: "/usr/share/OVMF/OVMF_CODE.fd", vars: "/usr/share/OVMF/OVMF_VARS.fd"},
+			{code: "/usr/share/edk2/ovmf/OVMF_CODE.fd", vars: "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+			{code: "/usr/share/edk2/x64/OVMF_CODE.4m.fd", vars: "/usr/share/edk2/x64/OVMF_VARS.4m.fd"},
+		},
+		secureBoot: []uefiFirmware{
+			{code: "/usr/share/OVMF/OVMF_CODE_4M.secboot.fd", vars: "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"},
+			{code: "/usr/share/edk2/ovmf/OVMF_CODE.secboot.fd", vars: "/usr/share/edk2/ovmf/OVMF_VARS.secboot.fd"},
+		},
+	},
+}
+
+// findUEFIFirmware returns the UEFI firmware to boot VM images of the given
+// architecture with. The firmware set in the definition takes precedence over
+// the one installed on the build host.
+func findUEFIFirmware(architecture string, secureBoot bool, override *shared.DefinitionTargetLXDVMFirmware) (uefiFirmware, error) {
+	if override != nil && override.Code != "" {
+		for _, path := range []string{override.Code, override.Vars} {
+			if path != "" && !lxdShared.PathExists(path) {
+				return uefiFirmware{}, fmt.Errorf("UEFI firmware file %q doesn't exist", path)
+			}
+		}
+
+		return uefiFirmware{code: override.Code, vars: override.Vars}, nil
+	}
+
+	candidates := uefiFirmwareCandidates[architecture].plain
+	if secureBoot {
+		candidates = uefiFirmwareCandidates[architecture].secureBoot
+	}
+
+	for _, firmware := range candidates {
+		if lxdShared.PathExists(firmware.code) && lxdShared.PathExists(firmware.vars) {
+			return firmware, nil
+		}
+	}
+
+	if secureBoot {
+		return uefiFirmware{}, fmt.Errorf("No UEFI firmware with Secure Boot support found for %q, set targets.lxd.vm.firmware", architecture)
+	}
+
+	return uefiFirmware{}, fmt.Errorf("No UEFI firmware found for %q, set targets.lxd.vm.firmware", architecture)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_findUEFIFirmware(t *testing.T) {
+	dir := t.TempDir()
+
+	code := filepath.Join(dir, "OVMF_CODE.fd")
+	vars := filepath.Join(dir, "OVMF_VARS.fd")
+
+	for _, path := range []string{code, vars} {
+		err := os.WriteFile(path, nil, 0644)
+		require.NoError(t, err)
+	}
+
+	firmware, err := findUEFIFirmware("x86_64", true, &shared.DefinitionTargetLXDVMFirmware{Code: code, Vars: vars})
+	require.NoError(t, err)
+	require.Equal(t, uefiFirmware{code: code, vars: vars}, firmware)
+
+	_, err = findUEFIFirmware("x86_64", false, &shared.DefinitionTargetLXDVMFirmware{Code: filepath.Join(dir, "missing.fd")})
+	require.ErrorContains(t, err, "doesn't exist")
+
+	_, err = findUEFIFirmware("s390x", false, nil)
+	require.ErrorContains(t, err, `No UEFI firmware found for "s390x"`)
+}
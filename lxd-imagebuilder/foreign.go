@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd/shared/osarch"
+	"github.com/sirupsen/logrus"
+)
+
+// binfmtDir is the mount point of binfmt_misc.
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuBinfmt is the binfmt_misc registration of the qemu-user emulator of an
+// architecture, as registered by qemu-binfmt-conf.sh.
+type qemuBinfmt struct {
+	name  string
+	magic string
+	mask  string
+}
+
+// qemuBinfmts are the qemu-user emulators, by kernel architecture name.
+var qemuBinfmts = map[string]qemuBinfmt{
+	"aarch64": {"aarch64", "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00", "\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff"},
+	"armv7l":  {"arm", "\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00", "\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff"},
+	"i686":    {"i386", "\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x03\x00", "\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff"},
+	"ppc64le": {"ppc64le", "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x15\x00", "\xff\xff\xff\xff\xff\xff\xff\xfc\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\x00"},
+	"riscv64": {"riscv64", "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00", "\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff"},
+	"s390x":   {"s390x", "\x7fELF\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x16", "\xff\xff\xff\xff\xff\xff\xff\xfc\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff"},
+	"x86_64":  {"x86_64", "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00", "\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff"},
+}
+
+// binfmtHandler is a handler registered in binfmt_misc.
+type binfmtHandler struct {
+	name        string
+	interpreter string
+	flags       string
+}
+
+// registration returns the line registering the emulator in binfmt_misc. The
+// F flag opens the interpreter when registering it, so it's available inside
+// of the chroot.
+func (q qemuBinfmt) registration(name string, interpreter string) string {
+	escape := func(s string) string {
+		var sb strings.Builder
+
+		for i := 0; i < len(s); i++ {
+			fmt.Fprintf(&sb, "\\x%02x", s[i])
+		}
+
+		return sb.String()
+	}
+
+	return fmt.Sprintf(":%s:M::%s:%s:%s:F", name, escape(q.magic), escape(q.mask), interpreter)
+}
+
+// isNativeArchitecture returns whether binaries of the architecture run on the
+// host without emulation.
+func isNativeArchitecture(architecture string) (bool, error) {
+	archID, err := osarch.ArchitectureId(architecture)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get architecture ID of %q: %w", architecture, err)
+	}
+
+	localID, err := osarch.ArchitectureGetLocalID()
+	if err != nil {
+		return false, fmt.Errorf("Failed to get architecture of the host: %w", err)
+	}
+
+	if archID == localID {
+		return true, nil
+	}
+
+	personalities, err := osarch.ArchitecturePersonalities(localID)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get personalities of the host: %w", err)
+	}
+
+	return slices.Contains(personalities, archID), nil
+}
+
+// findBinfmtHandler returns the enabled handler of the qemu-user emulator in
+// the binfmt_misc directory, or nil if there's none. Handlers are identified
+// by their magic, or the name of their interpreter.
+func findBinfmtHandler(dir string, qemu qemuBinfmt) (*binfmtHandler, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed to list %q: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == "register" || entry.Name() == "status" {
+			continue
+		}
+
+		handler, magic, err := parseBinfmtHandler(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if handler == nil {
+			continue
+		}
+
+		interpreter := filepath.Base(handler.interpreter)
+
+		if magic == hex.EncodeToString([]byte(qemu.magic)) || strings.TrimSuffix(interpreter, "-static") == "qemu-"+qemu.name || strings.HasPrefix(interpreter, qemu.name+"-binfmt") {
+			return handler, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// parseBinfmtHandler parses a handler of binfmt_misc, returning nil for
+// disabled handlers.
+func parseBinfmtHandler(path string) (*binfmtHandler, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to open %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	handler := &binfmtHandler{name: filepath.Base(path)}
+	enabled := false
+	magic := ""
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+
+		switch key {
+		case "enabled":
+			enabled = true
+		case "interpreter":
+			handler.interpreter = value
+		case "flags:":
+			handler.flags = value
+		case "magic":
+			magic = value
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	if !enabled {
+		return nil, "", nil
+	}
+
+	return handler, magic, nil
+}
+
+// checkForeignArchitecture checks that the architecture of the definition runs
+// on the host, natively or emulated by a handler of binfmt_misc usable inside
+// of the chroot. Otherwise the build stops, unless --force-foreign is set,
+// which registers the qemu-user-static emulator for the build.
+func (c *cmdGlobal) checkForeignArchitecture() error {
+	architecture := c.definition.Image.ArchitectureKernel
+
+	native, err := isNativeArchitecture(architecture)
+	if err != nil {
+		return err
+	}
+
+	if native {
+		return nil
+	}
+
+	hostArchitecture, _ := osarch.ArchitectureGetLocal()
+
+	qemu, ok := qemuBinfmts[architecture]
+	if !ok {
+		return fmt.Errorf("Architecture %q of the definition can't run on this %q host, and emulating it isn't supported", architecture, hostArchitecture)
+	}
+
+	handler, err := findBinfmtHandler(binfmtDir, qemu)
+	if err != nil {
+		return err
+	}
+
+	if handler != nil && strings.Contains(handler.flags, "F") {
+		c.logger.WithFields(logrus.Fields{"architecture": architecture, "handler": handler.name}).Info("Emulating foreign architecture")
+		return nil
+	}
+
+	if !c.flagForceForeign {
+		reason := "no emulator is registered for it in binfmt_misc"
+		if handler != nil {
+			reason = fmt.Sprintf("the binfmt_misc handler %q lacks the F flag, so its interpreter %q isn't available inside of the chroot", handler.name, handler.interpreter)
+		}
+
+		return fmt.Errorf("Architecture %q of the definition can't run on this %q host, and %s. Commands run inside of the rootfs would fail with exec format errors. Use --force-foreign to emulate it with qemu-%s-static for the build", architecture, hostArchitecture, reason, qemu.name)
+	}
+
+	interpreter, err := exec.LookPath("qemu-" + qemu.name + "-static")
+	if err != nil {
+		return fmt.Errorf("Failed to find qemu-%s-static, install qemu-user-static to emulate architecture %q: %w", qemu.name, architecture, err)
+	}
+
+	name := "lxd-imagebuilder-" + qemu.name
+	path := filepath.Join(binfmtDir, name)
+
+	// Remove the handler left behind by an interrupted build.
+	_ = os.WriteFile(path, []byte("-1"), 0644)
+
+	err = os.WriteFile(filepath.Join(binfmtDir, "register"), []byte(qemu.registration(name, interpreter)), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to register %q in binfmt_misc, which needs to be mounted at %q: %w", interpreter, binfmtDir, err)
+	}
+
+	c.logger.WithFields(logrus.Fields{"architecture": architecture, "interpreter": interpreter}).Warn("Emulating foreign architecture, which is slow")
+
+	c.binfmtCleanup = func() {
+		err := os.WriteFile(path, []byte("-1"), 0644)
+		if err != nil {
+			c.logger.WithFields(logrus.Fields{"handler": name, "err": err}).Warn("Failed to remove binfmt_misc handler")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/lxd/shared/osarch"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_isNativeArchitecture(t *testing.T) {
+	local, err := osarch.ArchitectureGetLocal()
+	require.NoError(t, err)
+
+	native, err := isNativeArchitecture(local)
+	require.NoError(t, err)
+	require.True(t, native)
+
+	foreign := "s390x"
+	if local == foreign {
+		foreign = "aarch64"
+	}
+
+	native, err = isNativeArchitecture(foreign)
+	require.NoError(t, err)
+	require.False(t, native)
+
+	_, err = isNativeArchitecture("unknown")
+	require.Error(t, err)
+}
+
+func Test_findBinfmtHandler(t *testing.T) {
+	dir := t.TempDir()
+
+	handlers := map[string]string{
+		"status":           "enabled\n",
+		"register":         "",
+		"python3.12":       "enabled\ninterpreter /usr/bin/python3.12\nflags: \noffset 0\nmagic cb0d0d0a\n",
+		"qemu-riscv64":     "disabled\ninterpreter /usr/bin/qemu-riscv64-static\nflags: F\noffset 0\nmagic 7f454c460201010000000000000000000200f300\n",
+		"qemu-aarch64":     "enabled\ninterpreter /usr/libexec/qemu-binfmt/aarch64-binfmt-P\nflags: POCF\noffset 0\nmagic 7f454c460201010000000000000000000200b700\n",
+		"arm-static-entry": "enabled\ninterpreter /usr/bin/qemu-arm-static\nflags: OC\noffset 0\nmagic 00\n",
+	}
+
+	for name, content := range handlers {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		require.NoError(t, err)
+	}
+
+	handler, err := findBinfmtHandler(dir, qemuBinfmts["aarch64"])
+	require.NoError(t, err)
+	require.Equal(t, &binfmtHandler{name: "qemu-aarch64", interpreter: "/usr/libexec/qemu-binfmt/aarch64-binfmt-P", flags: "POCF"}, handler)
+
+	// Handlers are found by the name of their interpreter as well.
+	handler, err = findBinfmtHandler(dir, qemuBinfmts["armv7l"])
+	require.NoError(t, err)
+	require.Equal(t, &binfmtHandler{name: "arm-static-entry", interpreter: "/usr/bin/qemu-arm-static", flags: "OC"}, handler)
+
+	// Disabled handlers are skipped.
+	handler, err = findBinfmtHandler(dir, qemuBinfmts["riscv64"])
+	require.NoError(t, err)
+	require.Nil(t, handler)
+
+	handler, err = findBinfmtHandler(filepath.Join(dir, "missing"), qemuBinfmts["s390x"])
+	require.NoError(t, err)
+	require.Nil(t, handler)
+}
+
+func Test_qemuBinfmtRegistration(t *testing.T) {
+	require.Equal(t, `:lxd-imagebuilder-aarch64:M::\x7f\x45\x4c\x46\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00:\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff:/usr/bin/qemu-aarch64-static:F`, qemuBinfmts["aarch64"].registration("lxd-imagebuilder-aarch64", "/usr/bin/qemu-aarch64-static"))
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	gptSectorSize = 512
+
+	// gptAlignment is the partition alignment in sectors (1MiB).
+	gptAlignment = 2048
+
+	gptEntryCount   = 128
+	gptEntrySize    = 128
+	gptEntrySectors = gptEntryCount * gptEntrySize / gptSectorSize
+	gptHeaderSize   = 92
+)
+
+// Partition type GUIDs.
+const (
+	gptTypeEFISystem = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	gptTypeLinuxFS   = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	gptTypeLinuxSwap = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"
+	gptTypePReP      = "9E1A2D38-C612-4316-AA26-8B49521E5A8B"
+
+	// gptTypeRootRISCV64 is the root partition type of the Discoverable
+	// Partitions Specification on 64-bit RISC-V.
+	gptTypeRootRISCV64 = "72EC70A6-CF74-40E6-BD49-4BDA08E8F224"
+)
+
+// gptPartition describes a partition which is to be created.
+type gptPartition struct {
+	typeGUID   string
+	name       string
+	attributes uint64
+
+	// size is the size in bytes. A size of 0 takes up the remaining space.
+	size uint64
+}
+
+// gptEntry is a partition entry of the partition table.
+type gptEntry struct {
+	typeGUID   [16]byte
+	uniqueGUID [16]byte
+	firstLBA   uint64
+	lastLBA    uint64
+	attributes uint64
+	name       string
+}
+
+// gptLayout calculates the partition entries for a disk of the given size in bytes.
+// Partitions are aligned to 1MiB, and at most one partition may take up the
+// remaining space.
+func gptLayout(diskSize uint64, partitions []gptPartition) ([]gptEntry, error) {
+	if len(partitions) > gptEntryCount {
+		return nil, fmt.Errorf("Too many partitions: %d", len(partitions))
+	}
+
+	totalSectors := diskSize / gptSectorSize
+	if totalSectors < 2*gptAlignment {
+		return nil, fmt.Errorf("Disk size %d is too small", diskSize)
+	}
+
+	lastUsable := totalSectors - gptEntrySectors - 2
+
+	entries := make([]gptEntry, 0, len(partitions))
+	next := uint64(gptAlignment)
+	hasRest := false
+
+	for i, part := range partitions {
+		typeGUID, err := parseGUID(part.typeGUID)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid type of partition %d: %w", i+1, err)
+		}
+
+		uniqueGUID, err := randomGUID()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate GUID: %w", err)
+		}
+
+		start := alignUp(next, gptAlignment)
+
+		var end uint64
+
+		if part.size > 0 {
+			if part.size%gptSectorSize != 0 {
+				return nil, fmt.Errorf("Size of partition %d must be a multiple of %d", i+1, gptSectorSize)
+			}
+
+			end = start + part.size/gptSectorSize - 1
+		} else {
+			if hasRest {
+				return nil, errors.New("Only one partition may take up the remaining space")
+			}
+
+			hasRest = true
+
+			// Leave room for the following partitions.
+			var following uint64
+
+			for _, p := range partitions[i+1:] {
+				following += alignUp(p.size/gptSectorSize, gptAlignment)
+			}
+
+			if following > lastUsable+1 {
+				return nil, fmt.Errorf("Partitions don't fit on disk of size %d", diskSize)
+			}
+
+			end = alignDown(lastUsable+1-following, gptAlignment) - 1
+
+			// The last partition can use all of the remaining space.
+			if i == len(partitions)-1 {
+				end = lastUsable
+			}
+		}
+
+		if end < start || end > lastUsable {
+			return nil, fmt.Errorf("Partitions don't fit on disk of size %d", diskSize)
+		}
+
+		entries = append(entries, gptEntry{
+			typeGUID:   typeGUID,
+			uniqueGUID: uniqueGUID,
+			firstLBA:   start,
+			lastLBA:    end,
+			attributes: part.attributes,
+			name:       part.name,
+		})
+
+		next = end + 1
+	}
+
+	return entries, nil
+}
+
+// writeGPT writes a protective MBR and the primary and backup GUID partition
+// tables with the given partitions to a disk of the given size in bytes.
+func writeGPT(w io.WriterAt, diskSize uint64, partitions []gptPartition) error {
+	entries, err := gptLayout(diskSize, partitions)
+	if err != nil {
+		return err
+	}
+
+	diskGUID, err := randomGUID()
+	if err != nil {
+		return fmt.Errorf("Failed to generate GUID: %w", err)
+	}
+
+	return writeGPTEntries(w, diskSize, diskGUID, entries)
+}
+
+// readGPT reads the disk GUID and the partition entries from the primary GUID
+// partition table.
+func readGPT(r io.ReaderAt) ([16]byte, []gptEntry, error) {
+	var diskGUID [16]byte
+
+	header := make([]byte, gptHeaderSize)
+
+	_, err := r.ReadAt(header, gptSectorSize)
+	if err != nil {
+		return diskGUID, nil, fmt.Errorf("Failed to read partition table header: %w", err)
+	}
+
+	if string(header[0:8]) != "EFI PART" {
+		return diskGUID, nil, errors.New("No GUID partition table found")
+	}
+
+	copy(diskGUID[:], header[56:72])
+
+	entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+	entryCount := binary.LittleEndian.Uint32(header[80:84])
+	entrySize := binary.LittleEndian.Uint32(header[84:88])
+
+	if entryCount > gptEntryCount || entrySize != gptEntrySize {
+		return diskGUID, nil, fmt.Errorf("Unsupported partition table with %d entries of size %d", entryCount, entrySize)
+	}
+
+	entryTable := make([]byte, entryCount*entrySize)
+
+	_, err = r.ReadAt(entryTable, int64(entriesLBA*gptSectorSize))
+	if err != nil {
+		return diskGUID, nil, fmt.Errorf("Failed to read partition entries: %w", err)
+	}
+
+	var entries []gptEntry
+
+	for i := 0; i < int(entryCount); i++ {
+		b := entryTable[i*gptEntrySize : (i+1)*gptEntrySize]
+
+		var entry gptEntry
+
+		copy(entry.typeGUID[:], b[0:16])
+
+		// The entries are written consecutively, so the first unused entry ends the table.
+		if entry.typeGUID == [16]byte{} {
+			break
+		}
+
+		copy(entry.uniqueGUID[:], b[16:32])
+		entry.firstLBA = binary.LittleEndian.Uint64(b[32:40])
+		entry.lastLBA = binary.LittleEndian.Uint64(b[40:48])
+		entry.attributes = binary.LittleEndian.Uint64(b[48:56])
+
+		name := make([]uint16, 0, 36)
+
+		for j := 0; j < 36; j++ {
+			c := binary.LittleEndian.Uint16(b[56+j*2:])
+			if c == 0 {
+				break
+			}
+
+			name = append(name, c)
+		}
+
+		entry.name = string(utf16.Decode(name))
+		entries = append(entries, entry)
+	}
+
+	return diskGUID, entries, nil
+}
+
+// shrinkGPT rewrites the partition table, so the last partition on disk ends
+// at the given size in bytes, and returns the new size of the disk. The disk GUID
+// and the partition GUIDs are kept.
+func shrinkGPT(rw interface {
+	io.ReaderAt
+	io.WriterAt
+}, lastPartitionSize uint64) (uint64, error) {
+	diskGUID, entries, err := readGPT(rw)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(entries) == 0 {
+		return 0, errors.New("No partitions found")
+	}
+
+	// The entries aren't necessarily sorted by their location on disk.
+	lastIndex := 0
+
+	for i, entry := range entries {
+		if entry.lastLBA > entries[lastIndex].lastLBA {
+			lastIndex = i
+		}
+	}
+
+	last := &entries[lastIndex]
+
+	sectors := alignUp(lastPartitionSize, gptSectorSize) / gptSectorSize
+	if sectors == 0 || last.firstLBA+sectors-1 > last.lastLBA {
+		return 0, fmt.Errorf("Cannot shrink partition %d to %d bytes", lastIndex+1, lastPartitionSize)
+	}
+
+	last.lastLBA = last.firstLBA + sectors - 1
+
+	// Leave room for the backup partition table after the last partition.
+	diskSize := alignUp(last.lastLBA+1+gptEntrySectors+1, gptAlignment) * gptSectorSize
+
+	err = writeGPTEntries(rw, diskSize, diskGUID, entries)
+	if err != nil {
+		return 0, err
+	}
+
+	return diskSize, nil
+}
+
+// writeGPTEntries writes a protective MBR and the primary and backup GUID
+// partition tables with the given entries to a disk of the given size in bytes.
+func writeGPTEntries(w io.WriterAt, diskSize uint64, diskGUID [16]byte, entries []gptEntry) error {
+	totalSectors := diskSize / gptSectorSize
+	lastLBA := totalSectors - 1
+
+	entryTable := make([]byte, gptEntryCount*gptEntrySize)
+
+	for i, entry := range entries {
+		b := entryTable[i*gptEntrySize : (i+1)*gptEntrySize]
+
+		copy(b[0:16], entry.typeGUID[:])
+		copy(b[16:32], entry.uniqueGUID[:])
+		binary.LittleEndian.PutUint64(b[32:40], entry.firstLBA)
+		binary.LittleEndian.PutUint64(b[40:48], entry.lastLBA)
+		binary.LittleEndian.PutUint64(b[48:56], entry.attributes)
+
+		for j, c := range utf16.Encode([]rune(entry.name)) {
+			if j >= 36 {
+				break
+			}
+
+			binary.LittleEndian.PutUint16(b[56+j*2:], c)
+		}
+	}
+
+	entryTableCRC := crc32.ChecksumIEEE(entryTable)
+
+	header := func(currentLBA, backupLBA, entriesLBA uint64) []byte {
+		b := make([]byte, gptSectorSize)
+
+		copy(b[0:8], "EFI PART")
+		binary.LittleEndian.PutUint32(b[8:12], 0x00010000)
+		binary.LittleEndian.PutUint32(b[12:16], gptHeaderSize)
+		binary.LittleEndian.PutUint64(b[24:32], currentLBA)
+		binary.LittleEndian.PutUint64(b[32:40], backupLBA)
+		binary.LittleEndian.PutUint64(b[40:48], gptEntrySectors+2)
+		binary.LittleEndian.PutUint64(b[48:56], lastLBA-gptEntrySectors-1)
+		copy(b[56:72], diskGUID[:])
+		binary.LittleEndian.PutUint64(b[72:80], entriesLBA)
+		binary.LittleEndian.PutUint32(b[80:84], gptEntryCount)
+		binary.LittleEndian.PutUint32(b[84:88], gptEntrySize)
+		binary.LittleEndian.PutUint32(b[88:92], entryTableCRC)
+		binary.LittleEndian.PutUint32(b[16:20], crc32.ChecksumIEEE(b[:gptHeaderSize]))
+
+		return b
+	}
+
+	// Protective MBR covering the entire disk.
+	mbr := make([]byte, gptSectorSize)
+	mbrSize := lastLBA
+	if mbrSize > 0xFFFFFFFF {
+		mbrSize = 0xFFFFFFFF
+	}
+
+	copy(mbr[446:462], []byte{0x00, 0x00, 0x02, 0x00, 0xEE, 0xFF, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(mbr[454:458], 1)
+	binary.LittleEndian.PutUint32(mbr[458:462], uint32(mbrSize))
+	mbr[510] = 0x55
+	mbr[511] = 0xAA
+
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, mbr},
+		{1, header(1, lastLBA, 2)},
+		{2, entryTable},
+		{lastLBA - gptEntrySectors, entryTable},
+		{lastLBA, header(lastLBA, 1, lastLBA-gptEntrySectors)},
+	}
+
+	for _, write := range writes {
+		_, err := w.WriteAt(write.data, int64(write.lba*gptSectorSize))
+		if err != nil {
+			return fmt.Errorf("Failed to write partition table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// parseGUID converts a GUID string to its on-disk representation, where the
+// first three fields are little-endian.
+func parseGUID(guid string) ([16]byte, error) {
+	var b [16]byte
+
+	raw, err := hex.DecodeString(strings.ReplaceAll(guid, "-", ""))
+	if err != nil || len(raw) != 16 {
+		return b, fmt.Errorf("Invalid GUID %q", guid)
+	}
+
+	b[0], b[1], b[2], b[3] = raw[3], raw[2], raw[1], raw[0]
+	b[4], b[5] = raw[5], raw[4]
+	b[6], b[7] = raw[7], raw[6]
+	copy(b[8:], raw[8:])
+
+	return b, nil
+}
+
+// randomGUID returns a random version 4 GUID in its on-disk representation.
+func randomGUID() ([16]byte, error) {
+	var b [16]byte
+
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return b, err
+	}
+
+	// The version is stored in the most significant bits of the little-endian third field.
+	b[7] = (b[7] & 0x0F) | 0x40
+	b[8] = (b[8] & 0x3F) | 0x80
+
+	return b, nil
+}
+
+func alignUp(value, alignment uint64) uint64 {
+	return (value + alignment - 1) / alignment * alignment
+}
+
+func alignDown(value, alignment uint64) uint64 {
+	return value / alignment * alignment
+}
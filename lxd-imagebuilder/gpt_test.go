@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type memDisk []byte
+
+func (d memDisk) WriteAt(p []byte, off int64) (int, error) {
+	return copy(d[off:], p), nil
+}
+
+func (d memDisk) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, d[off:]), nil
+}
+
+func Test_gptLayout(t *testing.T) {
+	diskSize := uint64(4 * 1024 * 1024 * 1024)
+	totalSectors := diskSize / gptSectorSize
+
+	entries, err := gptLayout(diskSize, []gptPartition{
+		{typeGUID: gptTypeEFISystem, size: 100 * 1024 * 1024},
+		{typeGUID: gptTypeLinuxFS},
+	})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, uint64(2048), entries[0].firstLBA)
+	require.Equal(t, uint64(206847), entries[0].lastLBA)
+	require.Equal(t, uint64(206848), entries[1].firstLBA)
+	require.Equal(t, totalSectors-34, entries[1].lastLBA)
+
+	// A partition following the one taking up the remaining space.
+	entries, err = gptLayout(diskSize, []gptPartition{
+		{typeGUID: gptTypeEFISystem, size: 100 * 1024 * 1024},
+		{typeGUID: gptTypeLinuxFS},
+		{typeGUID: gptTypeLinuxSwap, size: 512 * 1024 * 1024},
+	})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, entries[1].lastLBA+1, entries[2].firstLBA)
+	require.Zero(t, entries[2].firstLBA%gptAlignment)
+	require.Equal(t, uint64(512*1024*1024/gptSectorSize), entries[2].lastLBA-entries[2].firstLBA+1)
+	require.LessOrEqual(t, entries[2].lastLBA, totalSectors-34)
+
+	_, err = gptLayout(diskSize, []gptPartition{
+		{typeGUID: gptTypeLinuxFS},
+		{typeGUID: gptTypeLinuxFS},
+	})
+	require.Error(t, err)
+
+	_, err = gptLayout(diskSize, []gptPartition{
+		{typeGUID: gptTypeEFISystem, size: diskSize},
+	})
+	require.Error(t, err)
+
+	_, err = gptLayout(diskSize, []gptPartition{
+		{typeGUID: "invalid"},
+	})
+	require.Error(t, err)
+}
+
+func Test_writeGPT(t *testing.T) {
+	diskSize := uint64(64 * 1024 * 1024)
+	disk := make(memDisk, diskSize)
+
+	err := writeGPT(disk, diskSize, []gptPartition{
+		{typeGUID: gptTypeEFISystem, name: "EFI System", size: 8 * 1024 * 1024},
+		{typeGUID: gptTypeLinuxFS, name: "Linux filesystem"},
+	})
+	require.NoError(t, err)
+
+	// Protective MBR
+	require.Equal(t, byte(0xEE), disk[450])
+	require.Equal(t, []byte{0x55, 0xAA}, []byte(disk[510:512]))
+
+	lastLBA := diskSize/gptSectorSize - 1
+
+	for _, lba := range []uint64{1, lastLBA} {
+		header := make([]byte, gptHeaderSize)
+		copy(header, disk[lba*gptSectorSize:])
+
+		require.Equal(t, "EFI PART", string(header[0:8]))
+		require.Equal(t, lba, binary.LittleEndian.Uint64(header[24:32]))
+
+		headerCRC := binary.LittleEndian.Uint32(header[16:20])
+		binary.LittleEndian.PutUint32(header[16:20], 0)
+		require.Equal(t, crc32.ChecksumIEEE(header), headerCRC)
+
+		entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+		entries := disk[entriesLBA*gptSectorSize : entriesLBA*gptSectorSize+gptEntryCount*gptEntrySize]
+		require.Equal(t, crc32.ChecksumIEEE(entries), binary.LittleEndian.Uint32(header[88:92]))
+
+		typeGUID, err := parseGUID(gptTypeEFISystem)
+		require.NoError(t, err)
+		require.Equal(t, typeGUID[:], []byte(entries[0:16]))
+		require.Equal(t, uint64(2048), binary.LittleEndian.Uint64(entries[32:40]))
+	}
+}
+
+func Test_shrinkGPT(t *testing.T) {
+	diskSize := uint64(64 * 1024 * 1024)
+	disk := make(memDisk, diskSize)
+
+	err := writeGPT(disk, diskSize, []gptPartition{
+		{typeGUID: gptTypeEFISystem, name: "EFI System", size: 8 * 1024 * 1024},
+		{typeGUID: gptTypeLinuxFS, name: "Linux filesystem"},
+	})
+	require.NoError(t, err)
+
+	diskGUID, entries, err := readGPT(disk)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "Linux filesystem", entries[1].name)
+
+	// Shrink the root partition to 10MiB + 1 byte.
+	newSize, err := shrinkGPT(disk, 10*1024*1024+1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20*1024*1024), newSize)
+
+	newDiskGUID, newEntries, err := readGPT(disk)
+	require.NoError(t, err)
+	require.Equal(t, diskGUID, newDiskGUID)
+	require.Len(t, newEntries, 2)
+	require.Equal(t, entries[0], newEntries[0])
+	require.Equal(t, entries[1].uniqueGUID, newEntries[1].uniqueGUID)
+	require.Equal(t, entries[1].firstLBA+10*1024*1024/gptSectorSize, newEntries[1].lastLBA)
+
+	// The backup header is located at the end of the shrunk disk.
+	lastLBA := newSize/gptSectorSize - 1
+	require.Equal(t, "EFI PART", string(disk[lastLBA*gptSectorSize:lastLBA*gptSectorSize+8]))
+	require.Equal(t, lastLBA, binary.LittleEndian.Uint64(disk[gptSectorSize+32:gptSectorSize+40]))
+
+	// The partition cannot grow.
+	_, err = shrinkGPT(disk, 64*1024*1024)
+	require.Error(t, err)
+
+	// The partition located last on disk is shrunk, regardless of its entry.
+	err = writeGPTEntries(disk, diskSize, diskGUID, []gptEntry{entries[1], entries[0]})
+	require.NoError(t, err)
+
+	_, err = shrinkGPT(disk, 10*1024*1024)
+	require.NoError(t, err)
+
+	_, newEntries, err = readGPT(disk)
+	require.NoError(t, err)
+	require.Equal(t, entries[1].firstLBA+10*1024*1024/gptSectorSize-1, newEntries[0].lastLBA)
+	require.Equal(t, entries[0], newEntries[1])
+}
+
+func Test_parseGUID(t *testing.T) {
+	guid, err := parseGUID(gptTypeEFISystem)
+	require.NoError(t, err)
+	require.Equal(t, [16]byte{0x28, 0x73, 0x2A, 0xC1, 0x1F, 0xF8, 0xD2, 0x11, 0xBA, 0x4B, 0x00, 0xA0, 0xC9, 0x3E, 0xC9, 0x3B}, guid)
+
+	_, err = parseGUID("C12A7328-F81F-11D2")
+	require.Error(t, err)
+}
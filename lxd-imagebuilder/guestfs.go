@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// guestfsRootDev and guestfsESPDev are the partitions of the image inside of
+// the libguestfs appliance, where it's the only disk.
+const (
+	guestfsESPDev  = "/dev/sda1"
+	guestfsRootDev = "/dev/sda2"
+)
+
+// writeGuestfsFilesystems creates the root file system of the guestfs backend
+// inside of the libguestfs appliance, and populates it from the rootfs
+// directory. The EFI system partition is uploaded from espFile. No file
+// systems of the image are mounted on the host.
+func (v *vm) writeGuestfsFilesystems(espFile string) error {
+	script, err := os.CreateTemp(filepath.Dir(v.imageFile), "guestfish-")
+	if err != nil {
+		return fmt.Errorf("Failed to create guestfish script: %w", err)
+	}
+
+	defer os.Remove(script.Name())
+
+	_, err = script.WriteString(v.guestfsScript(espFile))
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", script.Name(), err)
+	}
+
+	err = script.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to close %q: %w", script.Name(), err)
+	}
+
+	// The contents of the EFI system partition are part of espFile.
+	tar := exec.CommandContext(v.ctx, "tar", "--numeric-owner", "--xattrs", "--acls", "--exclude=./boot/efi/*", "-C", v.rootfsDir, "-cf", "-", ".")
+	tar.Stderr = os.Stderr
+
+	stdout, err := tar.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Failed to create pipe: %w", err)
+	}
+
+	err = tar.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to archive %q: %w", v.rootfsDir, err)
+	}
+
+	err = shared.RunCommand(v.ctx, stdout, nil, "guestfish", "--rw", "--format=raw", "-a", v.imageFile, "-f", script.Name())
+
+	// Stop tar if guestfish failed before reading the archive.
+	_ = stdout.Close()
+
+	tarErr := tar.Wait()
+
+	if err != nil {
+		return fmt.Errorf("Failed to populate %q using guestfish: %w", v.imageFile, err)
+	}
+
+	if tarErr != nil {
+		return fmt.Errorf("Failed to archive %q: %w", v.rootfsDir, tarErr)
+	}
+
+	return nil
+}
+
+// guestfsScript returns the guestfish script uploading the EFI system
+// partition, formatting the root partition and extracting the archive of the
+// rootfs from stdin into it.
+func (v *vm) guestfsScript(espFile string) string {
+	var script strings.Builder
+
+	fmt.Fprintf(&script, "run\nupload %s %s\n", guestfsQuote(espFile), guestfsESPDev)
+
+	if v.rootFS == "btrfs" {
+		fmt.Fprintf(&script, "mkfs-btrfs %s label:rootfs\n", guestfsRootDev)
+
+		// Subvolumes are created in the top level of the file system.
+		fmt.Fprintf(&script, "mount %s /\n", guestfsRootDev)
+
+		for _, subvolume := range v.btrfs.Subvolumes {
+			fmt.Fprintf(&script, "btrfs-subvolume-create %s\n", guestfsQuote("/"+subvolume.Name))
+		}
+
+		script.WriteString("umount /\n")
+
+		for _, subvolume := range v.btrfs.Subvolumes {
+			if subvolume.Mountpoint == "/" {
+				fmt.Fprintf(&script, "mount-options %s %s /\n", guestfsQuote("subvol=/"+subvolume.Name), guestfsRootDev)
+			}
+		}
+
+		for _, subvolume := range v.getBtrfsSubvolumeMounts() {
+			fmt.Fprintf(&script, "mkdir-p %s\n", guestfsQuote(subvolume.Mountpoint))
+			fmt.Fprintf(&script, "mount-options %s %s %s\n", guestfsQuote("subvol=/"+subvolume.Name), guestfsRootDev, guestfsQuote(subvolume.Mountpoint))
+		}
+	} else {
+		fmt.Fprintf(&script, "mke2fs %s %s label:rootfs\n", guestfsRootDev, strings.Join(guestfsMke2fsArgs(v.fsOptions), " "))
+		fmt.Fprintf(&script, "mount %s /\n", guestfsRootDev)
+	}
+
+	script.WriteString("tar-in - / xattrs:true acls:true\numount-all\n")
+
+	return script.String()
+}
+
+// guestfsMke2fsArgs returns the optional arguments of the guestfish mke2fs
+// command for the given filesystem options. The defaults match ext4MkfsArgs.
+func guestfsMke2fsArgs(options map[string]string) []string {
+	get := func(key string, defaultValue string) string {
+		value, ok := options[key]
+		if !ok {
+			return defaultValue
+		}
+
+		return value
+	}
+
+	args := []string{"fstype:ext4", "blocksize:" + get("block_size", "4096")}
+
+	inodeCount, ok := options["inode_count"]
+	if ok {
+		args = append(args, "numberofinodes:"+inodeCount)
+	} else {
+		args = append(args, "bytesperinode:"+get("inode_ratio", "8192"))
+	}
+
+	inodeSize, ok := options["inode_size"]
+	if ok {
+		args = append(args, "inodesize:"+inodeSize)
+	}
+
+	return append(args, "reservedblockspercentage:"+get("reserved_blocks", "0"))
+}
+
+// guestfsQuote quotes the given argument of a guestfish command.
+func guestfsQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
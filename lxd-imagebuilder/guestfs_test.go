@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_guestfsScript(t *testing.T) {
+	v := &vm{rootFS: "ext4", fsOptions: map[string]string{"inode_count": "65536", "inode_size": "256"}}
+
+	require.Equal(t, `run
+upload "/tmp/image.esp" /dev/sda1
+mke2fs /dev/sda2 fstype:ext4 blocksize:4096 numberofinodes:65536 inodesize:256 reservedblockspercentage:0 label:rootfs
+mount /dev/sda2 /
+tar-in - / xattrs:true acls:true
+umount-all
+`, v.guestfsScript("/tmp/image.esp"))
+
+	v = &vm{rootFS: "btrfs", btrfs: shared.DefinitionTargetLXDVMBtrfs{
+		Subvolumes: []shared.DefinitionTargetLXDVMBtrfsSubvolume{
+			{Name: "@", Mountpoint: "/"},
+			{Name: "@home", Mountpoint: "/home"},
+			{Name: "@snapshots"},
+			{Name: "@var-log", Mountpoint: "/var/log"},
+		},
+	}}
+
+	require.Equal(t, `run
+upload "/tmp/image.esp" /dev/sda1
+mkfs-btrfs /dev/sda2 label:rootfs
+mount /dev/sda2 /
+btrfs-subvolume-create "/@"
+btrfs-subvolume-create "/@home"
+btrfs-subvolume-create "/@snapshots"
+btrfs-subvolume-create "/@var-log"
+umount /
+mount-options "subvol=/@" /dev/sda2 /
+mkdir-p "/home"
+mount-options "subvol=/@home" /dev/sda2 "/home"
+mkdir-p "/var/log"
+mount-options "subvol=/@var-log" /dev/sda2 "/var/log"
+tar-in - / xattrs:true acls:true
+umount-all
+`, v.guestfsScript("/tmp/image.esp"))
+}
+
+func Test_guestfsQuote(t *testing.T) {
+	require.Equal(t, `"/a \"b\" \\c"`, guestfsQuote(`/a "b" \c`))
+}
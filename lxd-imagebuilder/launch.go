@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	client "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/sirupsen/logrus"
+)
+
+// launchTimeout is how long cloud-init may take to finish in the launched
+// instance.
+const launchTimeout = 10 * time.Minute
+
+// launchMarker is set on instances created by --launch, so only those are
+// replaced by later builds.
+const launchMarker = "user.lxd-imagebuilder.launch"
+
+// launchInstance creates and starts an instance from the image, replacing
+// one created by an earlier build. If waitCloudInit is true, it waits for
+// cloud-init to finish inside of the instance.
+func launchInstance(ctx context.Context, logger *logrus.Logger, server client.InstanceServer, fingerprint string, name string, profiles []string, imageType string, waitCloudInit bool) error {
+	instance, _, err := server.GetInstance(name)
+	if err != nil && !api.StatusErrorCheck(err, 404) {
+		return fmt.Errorf("Failed to get instance %q: %w", name, err)
+	}
+
+	if err == nil {
+		if instance.Config[launchMarker] != "true" {
+			return fmt.Errorf("Instance %q exists and wasn't launched by lxd-imagebuilder", name)
+		}
+
+		logger.WithField("instance", name).Info("Deleting previously launched instance")
+
+		op, err := server.UpdateInstanceState(name, api.InstanceStatePut{Action: "stop", Force: true, Timeout: -1}, "")
+		if err == nil {
+			_ = op.Wait()
+		}
+
+		op, err = server.DeleteInstance(name)
+		if err == nil {
+			err = op.Wait()
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to delete instance %q: %w", name, err)
+		}
+	}
+
+	logger.WithFields(logrus.Fields{"instance": name, "profiles": profiles}).Info("Launching instance")
+
+	req := api.InstancesPost{
+		Name:   name,
+		Source: api.InstanceSource{Type: "image", Fingerprint: fingerprint},
+		Type:   api.InstanceType(imageType),
+		InstancePut: api.InstancePut{
+			Config:   map[string]string{launchMarker: "true"},
+			Profiles: profiles,
+		},
+	}
+
+	op, err := server.CreateInstance(req)
+	if err == nil {
+		err = op.Wait()
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to create instance %q: %w", name, err)
+	}
+
+	op, err = server.UpdateInstanceState(name, api.InstanceStatePut{Action: "start", Timeout: -1}, "")
+	if err == nil {
+		err = op.Wait()
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to start instance %q: %w", name, err)
+	}
+
+	if !waitCloudInit {
+		return nil
+	}
+
+	return waitForCloudInit(ctx, logger, server, name)
+}
+
+// waitForCloudInit waits for cloud-init to finish inside of the instance.
+// Commands can't be run inside of VMs before their agent started, so running
+// them is retried until the timeout.
+func waitForCloudInit(ctx context.Context, logger *logrus.Logger, server client.InstanceServer, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, launchTimeout)
+	defer cancel()
+
+	logger.WithFields(logrus.Fields{"instance": name, "timeout": launchTimeout}).Info("Waiting for cloud-init")
+
+	for {
+		out, status, err := execInstance(server, name, []string{"cloud-init", "status", "--wait"})
+		if err == nil {
+			switch status {
+			case 0:
+				logger.WithField("instance", name).Info("cloud-init finished")
+				return nil
+			case 2:
+				logger.WithFields(logrus.Fields{"instance": name, "status": strings.TrimSpace(out)}).Warn("cloud-init finished with recoverable errors")
+				return nil
+			case 127:
+				return fmt.Errorf("cloud-init isn't installed in instance %q", name)
+			default:
+				return fmt.Errorf("cloud-init failed in instance %q: %s", name, strings.TrimSpace(out))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("cloud-init didn't finish within %s: %w", launchTimeout, err)
+			}
+
+			return ctx.Err()
+		case <-time.After(verifyInterval):
+		}
+	}
+}
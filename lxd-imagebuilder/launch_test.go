@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkLaunchFlags(t *testing.T) {
+	c := &cmdLXD{}
+	require.NoError(t, c.checkLaunchFlags())
+
+	c.flagProfiles = []string{"default"}
+	require.EqualError(t, c.checkLaunchFlags(), "--profile requires --launch")
+
+	c.flagProfiles = nil
+	c.flagWaitCloudInit = true
+	require.EqualError(t, c.checkLaunchFlags(), "--wait-cloud-init requires --launch")
+
+	c.flagLaunch = "test"
+	c.flagProfiles = []string{"default", "test-net"}
+	require.NoError(t, c.checkLaunchFlags())
+}
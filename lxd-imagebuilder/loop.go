@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// attachLoopDevice attaches the given file to a free loop device with partition
+// scanning enabled, and returns the path of the loop device.
+func attachLoopDevice(file string) (string, error) {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open %q: %w", file, err)
+	}
+
+	defer f.Close()
+
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open %q: %w", "/dev/loop-control", shared.LXDConfigError(err, "security.privileged=true"))
+	}
+
+	defer ctl.Close()
+
+	// Another process may grab the free loop device before it's set up, in
+	// which case a new one is requested.
+	for i := 0; i < 10; i++ {
+		index, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return "", fmt.Errorf("Failed to get free loop device: %w", err)
+		}
+
+		loopDevice := fmt.Sprintf("/dev/loop%d", index)
+
+		err = setupLoopDevice(loopDevice, f)
+		if errors.Is(err, unix.EBUSY) {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		return loopDevice, nil
+	}
+
+	return "", errors.New("Failed to find free loop device")
+}
+
+// setupLoopDevice binds the given file to the loop device and enables partition scanning.
+func setupLoopDevice(loopDevice string, f *os.File) error {
+	// The device node may be missing when running inside of a container.
+	_, err := os.Stat(loopDevice)
+	if errors.Is(err, os.ErrNotExist) {
+		index := strings.TrimPrefix(filepath.Base(loopDevice), "loop")
+
+		minor, err := strconv.ParseUint(index, 10, 32)
+		if err != nil {
+			return fmt.Errorf("Failed to parse %q: %w", index, err)
+		}
+
+		err = unix.Mknod(loopDevice, unix.S_IFBLK|0660, int(unix.Mkdev(7, uint32(minor))))
+		if err != nil {
+			return fmt.Errorf("Failed to create block device %q: %w", loopDevice, shared.LXDConfigError(err, "security.privileged=true"))
+		}
+	}
+
+	loop, err := os.OpenFile(loopDevice, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %w", loopDevice, err)
+	}
+
+	defer loop.Close()
+
+	err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(f.Fd()))
+	if err != nil {
+		return fmt.Errorf("Failed to attach %q to %q: %w", f.Name(), loopDevice, err)
+	}
+
+	info := unix.LoopInfo64{Flags: unix.LO_FLAGS_PARTSCAN}
+	copy(info.File_name[:unix.LO_NAME_SIZE-1], f.Name())
+
+	err = unix.IoctlLoopSetStatus64(int(loop.Fd()), &info)
+	if err != nil {
+		_ = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+		return fmt.Errorf("Failed to set status of %q: %w", loopDevice, err)
+	}
+
+	return nil
+}
+
+// detachLoopDevice detaches the backing file from the loop device.
+func detachLoopDevice(loopDevice string) error {
+	loop, err := os.OpenFile(loopDevice, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %w", loopDevice, err)
+	}
+
+	defer loop.Close()
+
+	err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to detach %q: %w", loopDevice, err)
+	}
+
+	return nil
+}
+
+// loopPartitionTimeout is how long to wait for the kernel and udev to pick up
+// the partitions of a loop device.
+const loopPartitionTimeout = 10 * time.Second
+
+// loopPartition is a partition of a loop device as seen by the kernel. The
+// start and size are in 512 byte sectors.
+type loopPartition struct {
+	dev   uint64
+	start uint64
+	size  uint64
+}
+
+// getLoopPartition returns the given partition of the loop device as found in sysfs.
+func getLoopPartition(loopDevice string, partition int) (loopPartition, error) {
+	dir := filepath.Join("/sys/class/block", fmt.Sprintf("%sp%d", filepath.Base(loopDevice), partition))
+
+	content, err := os.ReadFile(filepath.Join(dir, "dev"))
+	if err != nil {
+		return loopPartition{}, fmt.Errorf("Failed to read %q: %w", filepath.Join(dir, "dev"), err)
+	}
+
+	dev, err := parseDevNumber(string(content))
+	if err != nil {
+		return loopPartition{}, err
+	}
+
+	values := map[string]uint64{}
+
+	for _, name := range []string{"start", "size"} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return loopPartition{}, fmt.Errorf("Failed to read %q: %w", filepath.Join(dir, name), err)
+		}
+
+		values[name], err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return loopPartition{}, fmt.Errorf("Failed to parse %q: %w", filepath.Join(dir, name), err)
+		}
+	}
+
+	return loopPartition{dev: dev, start: values["start"], size: values["size"]}, nil
+}
+
+// settleUdev waits for udev to process the events of new devices. udev
+// usually isn't running inside of containers, in which case there's nothing
+// to wait for.
+func settleUdev() {
+	_, err := exec.LookPath("udevadm")
+	if err != nil || !lxdShared.PathExists("/run/udev/control") {
+		return
+	}
+
+	// Failing to settle only means that the partitions may take longer to show
+	// up, which is handled by retrying.
+	_ = exec.Command("udevadm", "settle", fmt.Sprintf("--timeout=%d", int(loopPartitionTimeout.Seconds()))).Run()
+}
+
+// retryWithBackoff calls fn until it succeeds or the timeout is reached, and
+// returns the last error. The delay between attempts starts at 10ms and is
+// doubled up to one second.
+func retryWithBackoff(timeout time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	delay := 10 * time.Millisecond
+
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		time.Sleep(delay)
+
+		delay = min(delay*2, time.Second)
+	}
+}
+
+// parseDevNumber parses a device number in the MAJOR:MINOR format.
+func parseDevNumber(value string) (uint64, error) {
+	fields := strings.Split(strings.TrimSpace(value), ":")
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("Invalid device number %q", value)
+	}
+
+	major, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse %q: %w", fields[0], err)
+	}
+
+	minor, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse %q: %w", fields[1], err)
+	}
+
+	return unix.Mkdev(uint32(major), uint32(minor)), nil
+}
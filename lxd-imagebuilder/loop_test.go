@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func Test_parseDevNumber(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    uint64
+		wantErr bool
+	}{
+		{
+			"Valid",
+			"259:3\n",
+			unix.Mkdev(259, 3),
+			false,
+		},
+		{
+			"Missing minor",
+			"259",
+			0,
+			true,
+		},
+		{
+			"Invalid major",
+			"foo:3",
+			0,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDevNumber(tt.value)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_attachLoopDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Requires root")
+	}
+
+	_, err := os.Stat("/dev/loop-control")
+	if err != nil {
+		t.Skip("Requires loop devices")
+	}
+
+	file := filepath.Join(t.TempDir(), "disk.img")
+
+	err = os.WriteFile(file, make([]byte, 1024*1024), 0600)
+	require.NoError(t, err)
+
+	loopDevice, err := attachLoopDevice(file)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join("/sys/class/block", filepath.Base(loopDevice), "loop", "backing_file"))
+	require.NoError(t, err)
+	require.Equal(t, file+"\n", string(content))
+
+	err = detachLoopDevice(loopDevice)
+	require.NoError(t, err)
+}
+
+func Test_retryWithBackoff(t *testing.T) {
+	calls := 0
+
+	err := retryWithBackoff(time.Second, func() error {
+		calls++
+
+		if calls < 3 {
+			return errors.New("not yet")
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	err = retryWithBackoff(50*time.Millisecond, func() error {
+		return errors.New("never")
+	})
+	require.EqualError(t, err, "never")
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v2"
+)
+
+// loopStateDir holds the state of the loop devices used by running builds, so
+// the ones of builds which were killed can be cleaned up by the next run. It's
+// on a tmpfs, as the loop devices don't survive a reboot either.
+var loopStateDir = "/run/lxd-imagebuilder"
+
+// loopState describes what needs to be cleaned up to detach the loop device
+// of a VM image.
+type loopState struct {
+	PID         int      `yaml:"pid"`
+	LoopDevice  string   `yaml:"loop_device"`
+	ImageFile   string   `yaml:"image_file"`
+	Mountpoint  string   `yaml:"mountpoint,omitempty"`
+	DevNodes    []string `yaml:"dev_nodes,omitempty"`
+	CryptName   string   `yaml:"crypt_name,omitempty"`
+	VolumeGroup string   `yaml:"volume_group,omitempty"`
+	ZFSPool     string   `yaml:"zfs_pool,omitempty"`
+}
+
+// loopStateFile returns the state file of the given loop device of this process.
+func loopStateFile(pid int, loopDevice string) string {
+	return filepath.Join(loopStateDir, fmt.Sprintf("%d-%s.yaml", pid, filepath.Base(loopDevice)))
+}
+
+// saveState records the loop device of the VM image and everything using it.
+// It's called whenever a new mount or device mapping is set up.
+func (v *vm) saveState() error {
+	if v.loopDevice == "" {
+		return nil
+	}
+
+	state := loopState{
+		PID:        os.Getpid(),
+		LoopDevice: v.loopDevice,
+		ImageFile:  v.imageFile,
+		Mountpoint: v.rootfsDir,
+		DevNodes:   v.devNodes,
+		CryptName:  v.cryptName,
+	}
+
+	if v.lvmActive {
+		state.VolumeGroup = v.lvm.VolumeGroup
+	}
+
+	if v.zfsActive {
+		state.ZFSPool = v.zfs.Pool
+	}
+
+	return writeLoopState(state)
+}
+
+// writeLoopState writes the state file of the loop device.
+func writeLoopState(state loopState) error {
+	content, err := yaml.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal loop device state: %w", err)
+	}
+
+	err = os.MkdirAll(loopStateDir, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", loopStateDir, err)
+	}
+
+	path := loopStateFile(state.PID, state.LoopDevice)
+
+	// Replace the state atomically, so it's never seen half written.
+	err = os.WriteFile(path+".tmp", content, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", path, err)
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// removeState removes the state file once the loop device is detached.
+func (v *vm) removeState(loopDevice string) error {
+	err := os.Remove(loopStateFile(os.Getpid(), loopDevice))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to remove loop device state: %w", err)
+	}
+
+	return nil
+}
+
+// readLoopStates returns the recorded loop device states by state file.
+func readLoopStates() (map[string]loopState, error) {
+	states := map[string]loopState{}
+
+	files, err := filepath.Glob(filepath.Join(loopStateDir, "*.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list loop device states: %w", err)
+	}
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %q: %w", file, err)
+		}
+
+		var state loopState
+
+		err = yaml.Unmarshal(content, &state)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse %q: %w", file, err)
+		}
+
+		states[file] = state
+	}
+
+	return states, nil
+}
+
+// processAlive returns whether the process with the given PID is running.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	err := unix.Kill(pid, 0)
+
+	return err == nil || errors.Is(err, unix.EPERM)
+}
+
+// cleanupLoopStates cleans up the loop devices of builds which are no longer
+// running, and the ones of this process if all is true. The latter handles
+// builds which failed or were interrupted before unmounting the VM image.
+func cleanupLoopStates(logger *logrus.Logger, all bool) {
+	states, err := readLoopStates()
+	if err != nil {
+		logger.WithField("err", err).Warn("Failed reading loop device states")
+		return
+	}
+
+	for file, state := range states {
+		own := state.PID == os.Getpid()
+
+		if own && !all || !own && processAlive(state.PID) {
+			continue
+		}
+
+		logger.WithFields(logrus.Fields{"loop_device": state.LoopDevice, "image": state.ImageFile, "pid": state.PID}).Info("Cleaning up loop device")
+
+		err := cleanupLoopState(state)
+		if err != nil {
+			logger.WithFields(logrus.Fields{"loop_device": state.LoopDevice, "err": err}).Warn("Failed cleaning up loop device")
+			continue
+		}
+
+		err = os.Remove(file)
+		if err != nil {
+			logger.WithFields(logrus.Fields{"file": file, "err": err}).Warn("Failed removing loop device state")
+		}
+	}
+}
+
+// cleanupLoopState unmounts and closes everything using the loop device, and
+// detaches it if it's still backed by the image file.
+func cleanupLoopState(state loopState) error {
+	if state.Mountpoint != "" {
+		err := unmountRecursive(state.Mountpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The pool, volume group and LUKS device may be gone already, in which
+	// case the commands fail.
+	if state.ZFSPool != "" {
+		_ = lxdShared.RunCommandWithFds(nil, nil, nil, "zpool", "export", "-f", state.ZFSPool)
+	}
+
+	if state.VolumeGroup != "" {
+		_ = lxdShared.RunCommandWithFds(nil, nil, nil, "vgchange", "-an", state.VolumeGroup)
+	}
+
+	if state.CryptName != "" {
+		_ = lxdShared.RunCommandWithFds(nil, nil, nil, "cryptsetup", "close", state.CryptName)
+	}
+
+	// The loop device may have been reused by another process if it was
+	// detached already.
+	backingFile, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(state.LoopDevice), "loop", "backing_file"))
+	if err == nil && strings.TrimSpace(string(backingFile)) == state.ImageFile {
+		err := detachLoopDevice(state.LoopDevice)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, node := range state.DevNodes {
+		err := os.Remove(node)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Failed to remove %q: %w", node, err)
+		}
+	}
+
+	return nil
+}
+
+// unmountRecursive lazily unmounts the given mountpoint and everything mounted
+// below it, deepest first.
+func unmountRecursive(mountpoint string) error {
+	content, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return fmt.Errorf("Failed to read mount table: %w", err)
+	}
+
+	var mountpoints []string
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+
+		path, err := strconv.Unquote(`"` + strings.ReplaceAll(fields[4], `"`, `\"`) + `"`)
+		if err != nil {
+			path = fields[4]
+		}
+
+		if path == mountpoint || strings.HasPrefix(path, mountpoint+"/") {
+			mountpoints = append(mountpoints, path)
+		}
+	}
+
+	slices.SortFunc(mountpoints, func(a, b string) int {
+		return len(b) - len(a)
+	})
+
+	for _, path := range mountpoints {
+		err := unix.Unmount(path, unix.MNT_DETACH)
+		if err != nil && !errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("Failed to unmount %q: %w", path, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_vmSaveState(t *testing.T) {
+	loopStateDir = t.TempDir()
+
+	v := &vm{
+		imageFile:  "/var/cache/lxd-imagebuilder/lxd.raw",
+		loopDevice: "/dev/loop7",
+		rootfsDir:  "/var/cache/lxd-imagebuilder/vm",
+		devNodes:   []string{"/dev/loop7p1", "/dev/loop7p2"},
+		cryptName:  "lxd-imagebuilder-loop7",
+		lvm:        &shared.DefinitionTargetLXDVMLVM{VolumeGroup: "rootvg"},
+		zfs:        &shared.DefinitionTargetLXDVMZFS{Pool: "rpool"},
+		lvmActive:  true,
+	}
+
+	err := v.saveState()
+	require.NoError(t, err)
+
+	states, err := readLoopStates()
+	require.NoError(t, err)
+	require.Equal(t, map[string]loopState{
+		loopStateFile(os.Getpid(), "/dev/loop7"): {
+			PID:         os.Getpid(),
+			LoopDevice:  "/dev/loop7",
+			ImageFile:   "/var/cache/lxd-imagebuilder/lxd.raw",
+			Mountpoint:  "/var/cache/lxd-imagebuilder/vm",
+			DevNodes:    []string{"/dev/loop7p1", "/dev/loop7p2"},
+			CryptName:   "lxd-imagebuilder-loop7",
+			VolumeGroup: "rootvg",
+		},
+	}, states)
+
+	err = v.removeState(v.loopDevice)
+	require.NoError(t, err)
+
+	states, err = readLoopStates()
+	require.NoError(t, err)
+	require.Empty(t, states)
+}
+
+func Test_cleanupLoopStates(t *testing.T) {
+	loopStateDir = t.TempDir()
+	dir := t.TempDir()
+
+	// Get the PID of a process which isn't running anymore.
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+
+	deadPID := cmd.Process.Pid
+	devNode := filepath.Join(dir, "loop7p1")
+
+	require.NoError(t, os.WriteFile(devNode, nil, 0644))
+
+	for _, state := range []loopState{
+		{PID: deadPID, LoopDevice: "/dev/loop7", ImageFile: filepath.Join(dir, "dead.raw"), Mountpoint: filepath.Join(dir, "vm"), DevNodes: []string{devNode}},
+		{PID: os.Getpid(), LoopDevice: "/dev/loop8", ImageFile: filepath.Join(dir, "own.raw")},
+	} {
+		require.NoError(t, writeLoopState(state))
+	}
+
+	logger := logrus.New()
+
+	// The state of this process is kept, as it's still using the loop device.
+	cleanupLoopStates(logger, false)
+
+	states, err := readLoopStates()
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	require.Contains(t, states, loopStateFile(os.Getpid(), "/dev/loop8"))
+	require.NoFileExists(t, devNode)
+
+	cleanupLoopStates(logger, true)
+
+	states, err = readLoopStates()
+	require.NoError(t, err)
+	require.Empty(t, states)
+}
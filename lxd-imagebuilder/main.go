@@ -63,15 +63,18 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/canonical/lxd/shared/units"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"gopkg.in/yaml.v2"
+	"golang.org/x/sys/unix"
 
 	"github.com/canonical/lxd-imagebuilder/managers"
+	"github.com/canonical/lxd-imagebuilder/plugins"
 	"github.com/canonical/lxd-imagebuilder/shared"
 	"github.com/canonical/lxd-imagebuilder/shared/version"
 	"github.com/canonical/lxd-imagebuilder/sources"
@@ -112,13 +115,36 @@ type cmdGlobal struct {
 	flagDisableOverlay bool
 	flagSourcesDir     string
 	flagKeepSources    bool
+	flagDiagnostics    bool
+	flagBuildHost      string
+	flagFlavor         string
+	flagRestricted     bool
+	flagAllowedMirrors []string
+	flagMaxConnections uint
+	flagMaxRate        string
+	flagBuildDate      string
+	flagProgress       string
+	flagOutputLayout   string
+	flagForceForeign   bool
+
+	flagFaultDownloadErrorRate float64
+	flagFaultDownloadDelay     time.Duration
+	flagFaultActionExits       []string
+	flagFaultSeed              int64
 
 	definition     *shared.Definition
 	sourceDir      string
 	targetDir      string
+	outputSubdir   string
 	interrupt      chan os.Signal
 	logger         *logrus.Logger
+	logRecorder    *logRecorder
+	buildErr       error
+	cacheLock      *os.File
+	targetLock     *os.File
+	lxdContainer   *shared.LXDContainer
 	overlayCleanup func()
+	binfmtCleanup  func()
 	ctx            context.Context
 	cancel         context.CancelFunc
 	subCommand     *cobra.Command
@@ -132,8 +158,12 @@ func main() {
 		Use:   "lxd-imagebuilder",
 		Short: "System container and VM image builder for LXC and LXD",
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			// Quick checks
-			if os.Geteuid() != 0 {
+			isRemote := globalCmd.isRemote(cmd)
+
+			// Quick checks. The doctor sub-command reports this itself, prune
+			// only needs access to the output tree, and remote builds run as
+			// root on the build host.
+			if os.Geteuid() != 0 && !slices.Contains([]string{"doctor", "prune"}, cmd.CalledAs()) && !isRemote {
 				fmt.Fprintf(os.Stderr, "You must be root to run this tool\n")
 				os.Exit(1)
 			}
@@ -151,6 +181,38 @@ func main() {
 				os.Exit(1)
 			}
 
+			shared.SetCommandLogger(globalCmd.logger)
+
+			if globalCmd.flagBuildDate != "" {
+				buildDate, err := shared.ParseBuildDate(globalCmd.flagBuildDate)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to parse build date: %s\n", err)
+					os.Exit(1)
+				}
+
+				shared.SetBuildDate(buildDate)
+			}
+
+			if !slices.Contains(progressFormats, globalCmd.flagProgress) {
+				fmt.Fprintf(os.Stderr, "Invalid --progress %q, must be one of %v\n", globalCmd.flagProgress, progressFormats)
+				os.Exit(1)
+			}
+
+			if !slices.Contains(outputLayouts, globalCmd.flagOutputLayout) {
+				fmt.Fprintf(os.Stderr, "Invalid --output-layout %q, must be one of %v\n", globalCmd.flagOutputLayout, outputLayouts)
+				os.Exit(1)
+			}
+
+			err = globalCmd.setFaults()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to set faults: %s\n", err)
+				os.Exit(1)
+			}
+
+			// Keep a copy of the log for the diagnostics of failed builds.
+			globalCmd.logRecorder = newLogRecorder()
+			globalCmd.logger.AddHook(globalCmd.logRecorder)
+
 			if globalCmd.flagTimeout == 0 {
 				globalCmd.ctx, globalCmd.cancel = context.WithCancel(context.Background())
 			} else {
@@ -174,11 +236,16 @@ func main() {
 				}
 			}()
 
-			// No need to create cache directory if we're only validating.
-			if cmd.CalledAs() == "validate" {
+			// No need to create cache directory if we're only validating, checking the
+			// environment, pruning or building remotely.
+			if slices.Contains([]string{"doctor", "prune", "validate"}, cmd.CalledAs()) || isRemote {
 				return
 			}
 
+			// Clean up the loop devices of builds which were killed before they
+			// could clean up themselves.
+			cleanupLoopStates(globalCmd.logger, false)
+
 			// Create temp directory if the cache directory isn't explicitly set
 			if globalCmd.flagCacheDir == "" {
 				dir, err := os.MkdirTemp("/var/cache", "lxd-imagebuilder.")
@@ -205,6 +272,28 @@ func main() {
 	app.PersistentFlags().BoolVar(&globalCmd.flagVersion, "version", false, "Print version number")
 	app.PersistentFlags().BoolVar(&globalCmd.flagDebug, "debug", false, "Enable debug output")
 	app.PersistentFlags().BoolVar(&globalCmd.flagDisableOverlay, "disable-overlay", false, "Disable the use of filesystem overlays")
+	app.PersistentFlags().BoolVar(&globalCmd.flagDiagnostics, "diagnostics", true, "Collect diagnostics in the target directory if the build fails")
+	app.PersistentFlags().StringVar(&globalCmd.flagBuildHost, "build-host", "", "Run the build on a remote host using ssh (user@host)"+"``")
+	app.PersistentFlags().StringVar(&globalCmd.flagFlavor, "flavor", "", "Flavor of the definition to build, e.g. cloud, desktop or minimal"+"``")
+	app.PersistentFlags().BoolVar(&globalCmd.flagRestricted, "restricted", false, "Build definitions from untrusted users without access to the build host")
+	app.PersistentFlags().StringSliceVar(&globalCmd.flagAllowedMirrors, "allowed-mirror", nil, "URL of a mirror the definition may use in restricted mode"+"``")
+	app.PersistentFlags().StringVar(&globalCmd.flagBuildDate, "build-date", "", "Date of the build used for the serial and timestamps, e.g. 2024-03-10"+"``")
+	app.PersistentFlags().UintVar(&globalCmd.flagMaxConnections, "max-connections-per-host", 0, "Maximum number of concurrent downloads from a host"+"``")
+	app.PersistentFlags().StringVar(&globalCmd.flagMaxRate, "max-download-rate", "", "Maximum download rate per host, e.g. 10MiB per second"+"``")
+	app.PersistentFlags().StringVar(&globalCmd.flagProgress, "progress", "plain", "Format of progress reports (plain or json)"+"``")
+	app.PersistentFlags().StringVar(&globalCmd.flagOutputLayout, "output-layout", "flat", "Layout of the artifacts in the target directory (flat or tree)"+"``")
+	app.PersistentFlags().BoolVar(&globalCmd.flagForceForeign, "force-foreign", false, "Emulate foreign architectures with qemu-user-static if no emulator is registered")
+
+	// Developer flags injecting faults into builds, to test definitions and
+	// the handling of failures.
+	app.PersistentFlags().Float64Var(&globalCmd.flagFaultDownloadErrorRate, "fault-download-error-rate", 0, "Share of downloads which fail, between 0 and 1"+"``")
+	app.PersistentFlags().DurationVar(&globalCmd.flagFaultDownloadDelay, "fault-download-delay", 0, "Delay added to every download, e.g. 2s"+"``")
+	app.PersistentFlags().StringSliceVar(&globalCmd.flagFaultActionExits, "fault-action-exit", nil, "Fail the actions of a trigger, optionally for a number of attempts (<trigger>[=<attempts>])"+"``")
+	app.PersistentFlags().Int64Var(&globalCmd.flagFaultSeed, "fault-seed", 0, "Seed of the choice of the failing downloads"+"``")
+
+	for _, name := range []string{"fault-download-error-rate", "fault-download-delay", "fault-action-exit", "fault-seed"} {
+		_ = app.PersistentFlags().MarkHidden(name)
+	}
 
 	// Version handling
 	app.SetVersionTemplate("{{.Version}}\n")
@@ -224,6 +313,18 @@ func main() {
 	buildDirCmd := cmdBuildDir{global: &globalCmd}
 	app.AddCommand(buildDirCmd.command())
 
+	// build-tarball sub-command
+	buildTarballCmd := cmdBuildTarball{global: &globalCmd}
+	app.AddCommand(buildTarballCmd.command())
+
+	// build-sysext sub-command
+	buildSysextCmd := cmdBuildSysext{global: &globalCmd}
+	app.AddCommand(buildSysextCmd.command())
+
+	// build-wsl sub-command
+	buildWSLCmd := cmdBuildWSL{global: &globalCmd}
+	app.AddCommand(buildWSLCmd.command())
+
 	// repack-windows sub-command
 	repackWindowsCmd := cmdRepackWindows{global: &globalCmd}
 	app.AddCommand(repackWindowsCmd.command())
@@ -231,8 +332,64 @@ func main() {
 	validateCmd := cmdValidate{global: &globalCmd}
 	app.AddCommand(validateCmd.command())
 
+	// fmt sub-command
+	fmtCmd := cmdFmt{global: &globalCmd}
+	app.AddCommand(fmtCmd.command())
+
+	// doctor sub-command
+	doctorCmd := cmdDoctor{global: &globalCmd}
+	app.AddCommand(doctorCmd.command())
+
+	// download-packages sub-command
+	downloadPackagesCmd := cmdDownloadPackages{global: &globalCmd}
+	app.AddCommand(downloadPackagesCmd.command())
+
+	// prune sub-command
+	pruneCmd := cmdPrune{global: &globalCmd}
+	app.AddCommand(pruneCmd.command())
+
+	// Run builds on the remote build host instead if requested.
+	for _, cmd := range app.Commands() {
+		if !slices.Contains(remoteCommands, cmd.Name()) {
+			continue
+		}
+
+		preRunE := cmd.PreRunE
+		runE := cmd.RunE
+		postRunE := cmd.PostRunE
+
+		cmd.PreRunE = func(cmd *cobra.Command, args []string) error {
+			if globalCmd.isRemote(cmd) || preRunE == nil {
+				return nil
+			}
+
+			return preRunE(cmd, args)
+		}
+
+		cmd.RunE = func(cmd *cobra.Command, args []string) error {
+			if globalCmd.isRemote(cmd) {
+				return globalCmd.runRemote(cmd, args)
+			}
+
+			if runE == nil {
+				return nil
+			}
+
+			return runE(cmd, args)
+		}
+
+		// The definition isn't loaded for remote builds.
+		cmd.PostRunE = func(cmd *cobra.Command, args []string) error {
+			if globalCmd.isRemote(cmd) || postRunE == nil {
+				return nil
+			}
+
+			return postRunE(cmd, args)
+		}
+	}
+
 	globalCmd.interrupt = make(chan os.Signal, 1)
-	signal.Notify(globalCmd.interrupt, os.Interrupt)
+	signal.Notify(globalCmd.interrupt, os.Interrupt, unix.SIGTERM)
 
 	// Run the main command and handle errors
 	err := app.Execute()
@@ -243,6 +400,8 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Failed running imagebuilder: %s\n", err.Error())
 		}
 
+		globalCmd.buildErr = err
+
 		_ = globalCmd.postRun(globalCmd.subCommand, nil)
 		os.Exit(1)
 	}
@@ -256,32 +415,67 @@ func (c *cmdGlobal) cleanupCacheDirectory() {
 	}
 
 	// Try removing the content of the cache directory if the directory itself cannot be removed.
-	err = filepath.Walk(c.flagCacheDir, func(path string, info os.FileInfo, err error) error {
-		if path == c.flagCacheDir {
-			return nil
-		}
-
-		return os.RemoveAll(path)
-	})
+	err = removeDirectoryContent(c.flagCacheDir)
 	if err != nil {
 		c.logger.WithField("err", err).Warn("Failed cleaning up cache directory")
 	}
 }
 
+// prepareCacheDirectory creates and locks the cache directory, and removes any
+// leftovers of previous builds. The lock makes sure that concurrent builds
+// don't share a cache directory.
+func (c *cmdGlobal) prepareCacheDirectory() error {
+	err := os.MkdirAll(c.flagCacheDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed creating cache directory: %w", err)
+	}
+
+	c.cacheLock, err = lockDirectory(c.flagCacheDir)
+	if err != nil {
+		return err
+	}
+
+	return removeDirectoryContent(c.flagCacheDir)
+}
+
+// lockTargetDirectory locks the target directory, so concurrent builds don't
+// overwrite each other's artifacts.
+func (c *cmdGlobal) lockTargetDirectory() error {
+	var err error
+
+	c.targetLock, err = lockDirectory(c.targetDir)
+
+	return err
+}
+
 func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 	// if an error is returned, disable the usage message
 	cmd.SilenceUsage = true
 
 	isRunningBuildDir := cmd.CalledAs() == "build-dir"
+	isRunningDownloadPackages := cmd.CalledAs() == "download-packages"
 
-	// Clean up cache directory before doing anything
-	c.cleanupCacheDirectory()
+	var err error
 
-	err := os.MkdirAll(c.flagCacheDir, 0755)
+	limits := sources.DownloadLimits{MaxConnections: int(c.flagMaxConnections)}
+
+	if c.flagMaxRate != "" {
+		limits.MaxRate, err = units.ParseByteSizeString(c.flagMaxRate)
+		if err != nil || limits.MaxRate <= 0 {
+			return fmt.Errorf("Invalid --max-download-rate %q", c.flagMaxRate)
+		}
+	}
+
+	sources.SetDownloadLimits(limits)
+
+	// Lock and clean up cache directory before doing anything
+	err = c.prepareCacheDirectory()
 	if err != nil {
-		return fmt.Errorf("Failed creating cache directory: %w", err)
+		return err
 	}
 
+	c.detectLXDContainer()
+
 	if len(args) > 1 {
 		// Create and set target directory if provided
 		err := os.MkdirAll(args[1], 0755)
@@ -298,6 +492,11 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf("Failed to get working directory: %w", err)
 		}
 	}
+	err = c.lockTargetDirectory()
+	if err != nil {
+		return err
+	}
+
 	if isRunningBuildDir {
 		c.sourceDir = c.targetDir
 	} else {
@@ -310,10 +509,33 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Failed to create directory %q: %w", c.sourceDir, err)
 	}
 
-	// Get the image definition
-	c.definition, err = getDefinition(args[0], c.flagOptions)
+	err = c.loadDefinition(args[0])
 	if err != nil {
-		return fmt.Errorf("Failed to get definition: %w", err)
+		return err
+	}
+
+	// Open the plugins while their binaries are reachable, as managers are
+	// run after changing the root directory to the rootfs.
+	err = plugins.Open(c.definition.Plugins)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkEOL()
+	if err != nil {
+		return err
+	}
+
+	err = c.checkForeignArchitecture()
+	if err != nil {
+		return err
+	}
+
+	if !isRunningBuildDir && !isRunningDownloadPackages {
+		err = c.checkOutputLayout()
+		if err != nil {
+			return err
+		}
 	}
 
 	// Create cache directory if we also plan on creating LXC or LXD images
@@ -338,8 +560,11 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Failed to render source URL: %w", err)
 	}
 
-	// Load and run downloader
-	downloader, err := sources.Load(c.ctx, c.definition.Source.Downloader, c.logger, *c.definition, c.sourceDir, c.flagCacheDir, c.flagSourcesDir)
+	// Load and run downloader, which reports the progress of unpacking the
+	// downloaded rootfs.
+	ctx := shared.WithProgress(c.ctx, c.progressReporter("rootfs-unpack", "Unpacking rootfs"))
+
+	downloader, err := sources.Load(ctx, c.definition.Source.Downloader, c.logger, *c.definition, c.sourceDir, c.flagCacheDir, c.flagSourcesDir)
 	if err != nil {
 		return fmt.Errorf("Failed to load downloader %q: %w", c.definition.Source.Downloader, err)
 	}
@@ -351,8 +576,30 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Error while downloading source: %w", err)
 	}
 
+	// The overlays of the post-unpack trigger have no type filter, so they
+	// apply to the rootfs of all image types.
+	err = c.mergeRootfsOverlays("post-unpack", shared.ImageTargetUndefined, c.sourceDir)
+	if err != nil {
+		return err
+	}
+
+	c.detectInit(c.sourceDir)
+
+	var mounts []shared.ChrootMount
+
+	// Make the target directory available inside the chroot so that the
+	// package manager can place the downloaded packages there.
+	if isRunningDownloadPackages {
+		mounts = append(mounts, shared.ChrootMount{
+			Source: c.targetDir,
+			Target: packagesDownloadDir,
+			Flags:  unix.MS_BIND,
+			IsDir:  true,
+		})
+	}
+
 	// Setup the mounts and chroot into the rootfs
-	exitChroot, err := shared.SetupChroot(c.sourceDir, *c.definition, nil)
+	exitChroot, err := shared.SetupChroot(c.sourceDir, *c.definition, mounts)
 	if err != nil {
 		return fmt.Errorf("Failed to setup chroot: %w", err)
 	}
@@ -365,17 +612,32 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 	// only these sections will be processed.
 	imageTargets := shared.ImageTargetUndefined
 
+	// The same applies to build-lxd --hybrid, which processes the sections of
+	// each image type on an overlay of the rootfs afterwards.
+	isRunningHybrid := false
+
+	if cmd.CalledAs() == "build-lxd" {
+		isRunningHybrid, err = cmd.Flags().GetBool("hybrid")
+		if err != nil {
+			return fmt.Errorf(`Failed to get bool value of "hybrid": %w`, err)
+		}
+	}
+
 	// If we're running either build-lxc or build-lxd, include types which are
 	// meant for all.
-	if !isRunningBuildDir {
+	if !isRunningBuildDir && !isRunningHybrid {
 		imageTargets |= shared.ImageTargetAll
 	}
 
 	switch cmd.CalledAs() {
-	case "build-lxc":
-		// If we're running build-lxc, also process container-only sections.
+	case "build-lxc", "build-sysext", "build-tarball", "build-wsl":
+		// If we're running build-lxc, build-sysext, build-tarball or build-wsl, also process container-only sections.
 		imageTargets |= shared.ImageTargetContainer
-	case "build-lxd":
+	case "build-lxd", "download-packages":
+		if isRunningHybrid {
+			break
+		}
+
 		// Include either container-specific or vm-specific sections when
 		// running build-lxd.
 		ok, err := cmd.Flags().GetBool("vm")
@@ -407,41 +669,101 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 
 	// Run post unpack hook
 	for _, hook := range c.definition.GetRunnableActions("post-unpack", imageTargets) {
+		c.logger.WithField("action", hook.ID()).Info("Running action")
+
 		if hook.Pongo {
 			hook.Action, err = shared.RenderTemplate(hook.Action, c.definition)
 			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
+				return fmt.Errorf("Failed to render action %q: %w", hook.ID(), err)
 			}
 		}
 
-		err := shared.RunScript(c.ctx, hook.Action)
+		err := shared.RunAction(c.ctx, c.logger, hook)
 		if err != nil {
-			return fmt.Errorf("Failed to run post-unpack: %w", err)
+			return fmt.Errorf("Failed to run post-unpack action %q: %w", hook.ID(), err)
 		}
 	}
 
+	if isRunningDownloadPackages {
+		c.logger.WithField("dir", c.targetDir).Info("Downloading packages")
+
+		err = manager.DownloadPackages(imageTargets, packagesDownloadDir)
+		if err != nil {
+			return fmt.Errorf("Failed to download packages: %w", err)
+		}
+
+		return nil
+	}
+
+	err = c.managePackages(manager, imageTargets)
+	if err != nil {
+		return err
+	}
+
+	return c.verifyPackageState("post-packages")
+}
+
+// managePackages manages the packages of all stages, and runs the
+// post-packages actions between the main and the late stage.
+func (c *cmdGlobal) managePackages(manager *managers.Manager, imageTargets shared.ImageTarget) error {
 	c.logger.Info("Managing packages")
 
 	// Install/remove/update packages
-	err = manager.ManagePackages(imageTargets)
+	err := manager.ManagePackages(imageTargets)
 	if err != nil {
 		return fmt.Errorf("Failed to manage packages: %w", err)
 	}
 
+	// The packages may have installed another init system.
+	c.detectInit("/")
+
 	c.logger.WithField("trigger", "post-packages").Info("Running hooks")
 
 	// Run post packages hook
 	for _, hook := range c.definition.GetRunnableActions("post-packages", imageTargets) {
+		c.logger.WithField("action", hook.ID()).Info("Running action")
+
 		if hook.Pongo {
 			hook.Action, err = shared.RenderTemplate(hook.Action, c.definition)
 			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
+				return fmt.Errorf("Failed to render action %q: %w", hook.ID(), err)
 			}
 		}
 
-		err := shared.RunScript(c.ctx, hook.Action)
+		err := shared.RunAction(c.ctx, c.logger, hook)
 		if err != nil {
-			return fmt.Errorf("Failed to run post-packages: %w", err)
+			return fmt.Errorf("Failed to run post-packages action %q: %w", hook.ID(), err)
+		}
+	}
+
+	c.logger.Info("Managing late packages")
+
+	// Install/remove packages of the late stage
+	err = manager.ManageLatePackages(imageTargets)
+	if err != nil {
+		return fmt.Errorf("Failed to manage late packages: %w", err)
+	}
+
+	return nil
+}
+
+// detectInit sets image.init to the init system of the rootfs, unless it's set
+// in the definition.
+func (c *cmdGlobal) detectInit(rootfsDir string) {
+	if c.definition.DetectInit(rootfsDir) {
+		c.logger.WithField("init", c.definition.Image.Init).Debug("Detected init system")
+	}
+}
+
+// mergeRootfsOverlays merges the rootfs overlays of the given trigger onto the
+// rootfs. It runs on the build host, outside of the chroot.
+func (c *cmdGlobal) mergeRootfsOverlays(trigger string, imageTargets shared.ImageTarget, rootfsDir string) error {
+	for _, overlay := range c.definition.GetRootfsOverlays(trigger, imageTargets) {
+		c.logger.WithFields(logrus.Fields{"overlay": overlay.ID(), "source": overlay.Source}).Info("Merging rootfs overlay")
+
+		err := shared.MergeRootfsOverlay(c.ctx, overlay, rootfsDir)
+		if err != nil {
+			return fmt.Errorf("Failed to merge rootfs overlay %q: %w", overlay.ID(), err)
 		}
 	}
 
@@ -452,14 +774,14 @@ func (c *cmdGlobal) preRunPack(cmd *cobra.Command, args []string) error {
 	// if an error is returned, disable the usage message
 	cmd.SilenceUsage = true
 
-	// Clean up cache directory before doing anything
-	c.cleanupCacheDirectory()
-
-	err := os.MkdirAll(c.flagCacheDir, 0755)
+	// Lock and clean up cache directory before doing anything
+	err := c.prepareCacheDirectory()
 	if err != nil {
-		return fmt.Errorf("Failed creating cache directory: %w", err)
+		return err
 	}
 
+	c.detectLXDContainer()
+
 	// resolve path
 	c.sourceDir, err = filepath.Abs(args[1])
 	if err != nil {
@@ -471,18 +793,158 @@ func (c *cmdGlobal) preRunPack(cmd *cobra.Command, args []string) error {
 		c.targetDir = args[2]
 	}
 
-	// Get the image definition
-	c.definition, err = getDefinition(args[0], c.flagOptions)
+	err = c.lockTargetDirectory()
+	if err != nil {
+		return err
+	}
+
+	err = c.loadDefinition(args[0])
+	if err != nil {
+		return err
+	}
+
+	// Open the plugins while their binaries are reachable, as managers are
+	// run after changing the root directory to the rootfs.
+	err = plugins.Open(c.definition.Plugins)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkEOL()
+	if err != nil {
+		return err
+	}
+
+	err = c.checkForeignArchitecture()
+	if err != nil {
+		return err
+	}
+
+	err = c.checkOutputLayout()
+	if err != nil {
+		return err
+	}
+
+	c.detectInit(c.sourceDir)
+
+	return nil
+}
+
+// setFaults sets the faults injected into downloads and actions by the
+// developer flags.
+func (c *cmdGlobal) setFaults() error {
+	if c.flagFaultDownloadErrorRate < 0 || c.flagFaultDownloadErrorRate > 1 {
+		return fmt.Errorf("Invalid --fault-download-error-rate %v, must be between 0 and 1", c.flagFaultDownloadErrorRate)
+	}
+
+	if c.flagFaultDownloadDelay < 0 {
+		return fmt.Errorf("Invalid --fault-download-delay %s", c.flagFaultDownloadDelay)
+	}
+
+	actionFaults := map[string]uint{}
+
+	for _, value := range c.flagFaultActionExits {
+		trigger, attempts, err := shared.ParseActionFault(value)
+		if err != nil {
+			return err
+		}
+
+		actionFaults[trigger] = attempts
+	}
+
+	if c.flagFaultDownloadErrorRate > 0 || c.flagFaultDownloadDelay > 0 || len(actionFaults) > 0 {
+		c.logger.WithFields(logrus.Fields{"download_error_rate": c.flagFaultDownloadErrorRate, "download_delay": c.flagFaultDownloadDelay, "actions": actionFaults}).Warn("Injecting faults into the build")
+	}
+
+	if c.flagFaultDownloadErrorRate > 0 || c.flagFaultDownloadDelay > 0 {
+		sources.SetDownloadFaults(sources.DownloadFaults{
+			ErrorRate: c.flagFaultDownloadErrorRate,
+			Delay:     c.flagFaultDownloadDelay,
+			Seed:      c.flagFaultSeed,
+		})
+	}
+
+	shared.SetActionFaults(actionFaults)
+
+	return nil
+}
+
+// checkOutputLayout fails before the build if the artifacts can't be
+// published with the tree output layout.
+func (c *cmdGlobal) checkOutputLayout() error {
+	if c.flagOutputLayout != "tree" {
+		return nil
+	}
+
+	_, err := outputTreeDir(*c.definition)
+
+	return err
+}
+
+// newArtifactStaging creates the staging directory of the artifacts in the
+// directory of the output layout. With the tree layout, the artifacts of
+// hybrid builds are published to the outputSubdir of the serial directory.
+func (c *cmdGlobal) newArtifactStaging() (*artifactStaging, error) {
+	if c.flagOutputLayout != "tree" {
+		return newArtifactStaging(c.ctx, c.targetDir, c.logger, c.definition.Targets.Encrypt)
+	}
+
+	treeDir, err := outputTreeDir(*c.definition)
+	if err != nil {
+		return nil, err
+	}
+
+	serialDir := filepath.Join(c.targetDir, treeDir)
+	dir := filepath.Join(serialDir, c.outputSubdir)
+
+	err = os.MkdirAll(dir, 0755)
 	if err != nil {
-		return fmt.Errorf("Failed to get definition: %w", err)
+		return nil, fmt.Errorf("Failed to create directory %q: %w", dir, err)
+	}
+
+	staging, err := newArtifactStaging(c.ctx, dir, c.logger, c.definition.Targets.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	staging.latestDir = serialDir
+
+	return staging, nil
+}
+
+// checkEOL warns or fails according to image.eol_policy if the release is end-of-life.
+func (c *cmdGlobal) checkEOL() error {
+	if c.definition.Image.EOLPolicy == "ignore" {
+		return nil
+	}
+
+	eol, ok, err := c.definition.Image.GetEOLDate()
+	if err != nil {
+		return fmt.Errorf("Failed to get EOL date: %w", err)
+	}
+
+	if !ok || time.Now().Before(eol) {
+		return nil
+	}
+
+	if c.definition.Image.EOLPolicy == "fail" {
+		return fmt.Errorf("Release %q of %q reached its end of life on %s", c.definition.Image.Release, c.definition.Image.Distribution, eol.Format(shared.EOLDateLayout))
 	}
 
+	c.logger.WithFields(logrus.Fields{"distribution": c.definition.Image.Distribution, "release": c.definition.Image.Release, "eol": eol.Format(shared.EOLDateLayout)}).Warn("Release reached its end of life")
+
 	return nil
 }
 
+// isRemote returns whether the command is run on a remote build host.
+func (c *cmdGlobal) isRemote(cmd *cobra.Command) bool {
+	return c.flagBuildHost != "" && cmd != nil && slices.Contains(remoteCommands, cmd.Name())
+}
+
 func (c *cmdGlobal) postRun(cmd *cobra.Command, args []string) error {
-	// If we're only validating, there's nothing to clean up.
-	if cmd != nil && cmd.CalledAs() == "validate" {
+	// If we're only validating, checking the environment, pruning or building
+	// remotely, there's nothing to clean up.
+	if cmd != nil && (slices.Contains([]string{"doctor", "prune", "validate"}, cmd.CalledAs()) || c.isRemote(cmd)) {
 		return nil
 	}
 
@@ -498,6 +960,30 @@ func (c *cmdGlobal) postRun(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	// Unregister the emulator of a foreign architecture.
+	if c.binfmtCleanup != nil {
+		c.binfmtCleanup()
+	}
+
+	// Collect diagnostics if the build failed. This needs to happen before the
+	// overlay and cache directory are cleaned up.
+	if c.buildErr != nil && c.flagDiagnostics && c.definition != nil && c.targetDir != "" && hasLogger {
+		c.logger.Info("Collecting diagnostics")
+
+		filename, err := c.collectDiagnostics(c.buildErr)
+		if err != nil {
+			c.logger.WithField("err", err).Warn("Failed collecting diagnostics")
+		} else {
+			c.logger.WithField("file", filename).Info("Collected diagnostics")
+		}
+	}
+
+	// Detach the loop devices of VM images which weren't unmounted, e.g.
+	// because the build was interrupted.
+	if hasLogger {
+		cleanupLoopStates(c.logger, true)
+	}
+
 	// Clean up overlay
 	if c.overlayCleanup != nil {
 		if hasLogger {
@@ -507,8 +993,9 @@ func (c *cmdGlobal) postRun(cmd *cobra.Command, args []string) error {
 		c.overlayCleanup()
 	}
 
-	// Clean up cache directory
-	if c.flagCleanup {
+	// Clean up cache directory. If it isn't locked, it may be in use by
+	// another build.
+	if c.flagCleanup && c.cacheLock != nil {
 		if hasLogger {
 			c.logger.Info("Removing cache directory")
 		}
@@ -525,6 +1012,12 @@ func (c *cmdGlobal) postRun(cmd *cobra.Command, args []string) error {
 		_ = os.RemoveAll(c.flagSourcesDir)
 	}
 
+	for _, lock := range []*os.File{c.cacheLock, c.targetLock} {
+		if lock != nil {
+			_ = lock.Close()
+		}
+	}
+
 	return nil
 }
 
@@ -561,7 +1054,7 @@ func (c *cmdGlobal) getOverlayDir() (string, func(), error) {
 	return overlayDir, cleanup, nil
 }
 
-func getDefinition(fname string, options []string) (*shared.Definition, error) {
+func getDefinition(fname string, flavor string, options []string) (*shared.Definition, error) {
 	// Read the provided file, or if none was given, read from stdin
 	var buf bytes.Buffer
 	if fname == "" || fname == "-" {
@@ -583,13 +1076,28 @@ func getDefinition(fname string, options []string) (*shared.Definition, error) {
 		}
 	}
 
+	// Check the required version before parsing the definition strictly, which
+	// fails on fields of newer versions.
+	err := shared.CheckRequires(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
 	// Parse the yaml input
 	var def shared.Definition
-	err := yaml.UnmarshalStrict(buf.Bytes(), &def)
+	err = shared.UnmarshalDefinition(buf.Bytes(), &def)
 	if err != nil {
 		return nil, err
 	}
 
+	// Apply the flavor before the options, so they can override it
+	if flavor != "" {
+		err := def.ApplyFlavor(flavor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Set options from the command line
 	for _, o := range options {
 		parts := strings.Split(o, "=")
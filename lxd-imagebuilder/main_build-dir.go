@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/canonical/lxd-imagebuilder/generators"
@@ -33,10 +34,10 @@ func (c *cmdBuildDir) command() *cobra.Command {
 
 				generator, err := generators.Load(file.Generator, c.global.logger, c.global.flagCacheDir, c.global.targetDir, file, *c.global.definition)
 				if err != nil {
-					return fmt.Errorf("Failed to load generator %q: %w", file.Generator, err)
+					return fmt.Errorf("Failed to load generator %q of %s: %w", file.Generator, file.ID(), err)
 				}
 
-				c.global.logger.WithField("generator", file.Generator).Info("Running generator")
+				c.global.logger.WithFields(logrus.Fields{"file": file.ID(), "generator": file.Generator}).Info("Running generator")
 
 				err = generator.Run()
 				if err != nil {
@@ -44,6 +45,11 @@ func (c *cmdBuildDir) command() *cobra.Command {
 				}
 			}
 
+			err := c.global.mergeRootfsOverlays("post-files", shared.ImageTargetUndefined, c.global.targetDir)
+			if err != nil {
+				return err
+			}
+
 			if !c.flagWithPostFiles {
 				return nil
 			}
@@ -58,14 +64,16 @@ func (c *cmdBuildDir) command() *cobra.Command {
 
 			// Run post files hook
 			for _, action := range c.global.definition.GetRunnableActions("post-files", shared.ImageTargetUndefined) {
+				c.global.logger.WithField("action", action.ID()).Info("Running action")
+
 				if action.Pongo {
 					action.Action, err = shared.RenderTemplate(action.Action, c.global.definition)
 					if err != nil {
-						return fmt.Errorf("Failed to render action: %w", err)
+						return fmt.Errorf("Failed to render action %q: %w", action.ID(), err)
 					}
 				}
 
-				err := shared.RunScript(c.global.ctx, action.Action)
+				err := shared.RunAction(c.global.ctx, c.global.logger, action)
 				if err != nil {
 					{
 						err := exitChroot()
@@ -74,10 +82,22 @@ func (c *cmdBuildDir) command() *cobra.Command {
 						}
 					}
 
-					return fmt.Errorf("Failed to run post-files: %w", err)
+					return fmt.Errorf("Failed to run post-files action %q: %w", action.ID(), err)
 				}
 			}
 
+			err = c.global.verifyPackageState("post-files")
+			if err != nil {
+				{
+					err := exitChroot()
+					if err != nil {
+						c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+					}
+				}
+
+				return err
+			}
+
 			err = exitChroot()
 			if err != nil {
 				return fmt.Errorf("Failed exiting chroot: %w", err)
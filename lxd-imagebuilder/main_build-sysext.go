@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/generators"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// sysextArchitectures maps kernel architecture names to the ones used by
+// systemd in the ARCHITECTURE field of the extension release.
+var sysextArchitectures = map[string]string{
+	"aarch64":     "arm64",
+	"armv6l":      "arm",
+	"armv7l":      "arm",
+	"i686":        "x86",
+	"loongarch64": "loongarch64",
+	"ppc64le":     "ppc64-le",
+	"riscv64":     "riscv64",
+	"s390x":       "s390x",
+	"x86_64":      "x86-64",
+}
+
+type cmdBuildSysext struct {
+	cmdBuild *cobra.Command
+	global   *cmdGlobal
+}
+
+func (c *cmdBuildSysext) command() *cobra.Command {
+	c.cmdBuild = &cobra.Command{
+		Use:   "build-sysext <filename|-> [target dir]",
+		Short: "Build systemd-sysext or systemd-confext extension image",
+		Long: `Build systemd-sysext or systemd-confext extension image
+
+Only the paths listed in targets.sysext.paths are included in the extension
+image, together with the extension release file.
+`,
+		Args:    cobra.RangeArgs(1, 2),
+		PreRunE: c.global.preRunBuild,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			overlayDir, cleanup, err := c.global.getOverlayDir()
+			if err != nil {
+				return fmt.Errorf("Failed to get overlay directory: %w", err)
+			}
+
+			if cleanup != nil {
+				c.global.overlayCleanup = cleanup
+
+				defer func() {
+					cleanup()
+					c.global.overlayCleanup = nil
+				}()
+			}
+
+			return c.run(cmd, args, overlayDir)
+		},
+	}
+
+	c.cmdBuild.Flags().StringVar(&c.global.flagSourcesDir, "sources-dir", filepath.Join(os.TempDir(), "lxd-imagebuilder"), "Sources directory for distribution tarballs"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagKeepSources, "keep-sources", true, "Keep sources after build"+"``")
+
+	return c.cmdBuild
+}
+
+func (c *cmdBuildSysext) run(cmd *cobra.Command, args []string, overlayDir string) error {
+	imageTargets := shared.ImageTargetUndefined | shared.ImageTargetAll | shared.ImageTargetContainer
+	sysext := c.global.definition.Targets.Sysext
+
+	if len(sysext.Paths) == 0 {
+		return errors.New("targets.sysext.paths is required to build an extension image")
+	}
+
+	if sysext.Type == "" {
+		sysext.Type = "sysext"
+	}
+
+	if sysext.Format == "" {
+		sysext.Format = "squashfs"
+	}
+
+	mkfs := "mksquashfs"
+	if sysext.Format == "erofs" {
+		mkfs = "mkfs.erofs"
+	}
+
+	for _, dep := range []string{mkfs, "rsync"} {
+		_, err := exec.LookPath(dep)
+		if err != nil {
+			return fmt.Errorf("Required tool %q is missing", dep)
+		}
+	}
+
+	var err error
+
+	if sysext.Name == "" {
+		sysext.Name = c.global.definition.Image.Name
+		if sysext.Name != "" {
+			sysext.Name, err = shared.RenderTemplate(sysext.Name, c.global.definition)
+			if err != nil {
+				return fmt.Errorf("Failed to render image name: %w", err)
+			}
+		} else {
+			sysext.Name = c.global.definition.Image.Distribution
+		}
+	}
+
+	// Create the artifacts in a staging directory, so they don't replace the
+	// ones in the target directory until the build succeeded.
+	staging, err := c.global.newArtifactStaging()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = staging.remove()
+	}()
+
+	for _, file := range c.global.definition.Files {
+		if !shared.ApplyFilter(&file, c.global.definition.Image.Release, c.global.definition.Image.ArchitectureMapped, c.global.definition.Image.Variant, c.global.definition.Targets.Type, imageTargets) {
+			c.global.logger.WithFields(logrus.Fields{"file": file.ID(), "generator": file.Generator}).Info("Skipping generator")
+
+			continue
+		}
+
+		generator, err := generators.Load(file.Generator, c.global.logger, c.global.flagCacheDir, overlayDir, file, *c.global.definition)
+		if err != nil {
+			return fmt.Errorf("Failed to load generator %q of %s: %w", file.Generator, file.ID(), err)
+		}
+
+		c.global.logger.WithFields(logrus.Fields{"file": file.ID(), "generator": file.Generator}).Info("Running generator")
+
+		err = generator.Run()
+		if err != nil {
+			return fmt.Errorf("Failed to run generator %q of %s: %w", file.Generator, file.ID(), err)
+		}
+	}
+
+	err = c.global.mergeRootfsOverlays("post-files", imageTargets, overlayDir)
+	if err != nil {
+		return err
+	}
+
+	exitChroot, err := shared.SetupChroot(overlayDir, *c.global.definition, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to setup chroot in %q: %w", overlayDir, err)
+	}
+
+	c.global.logger.WithField("trigger", "post-files").Info("Running hooks")
+
+	// Run post files hook
+	for _, action := range c.global.definition.GetRunnableActions("post-files", imageTargets) {
+		c.global.logger.WithField("action", action.ID()).Info("Running action")
+
+		if action.Pongo {
+			action.Action, err = shared.RenderTemplate(action.Action, c.global.definition)
+			if err != nil {
+				return fmt.Errorf("Failed to render action %q: %w", action.ID(), err)
+			}
+		}
+
+		err := shared.RunAction(c.global.ctx, c.global.logger, action)
+		if err != nil {
+			{
+				err := exitChroot()
+				if err != nil {
+					c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+				}
+			}
+
+			return fmt.Errorf("Failed to run post-files action %q: %w", action.ID(), err)
+		}
+	}
+
+	err = c.global.verifyPackageState("post-files")
+	if err != nil {
+		{
+			err := exitChroot()
+			if err != nil {
+				c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+			}
+		}
+
+		return err
+	}
+
+	err = exitChroot()
+	if err != nil {
+		return fmt.Errorf("Failed exiting chroot: %w", err)
+	}
+
+	extensionDir := filepath.Join(c.global.flagCacheDir, "sysext")
+
+	err = os.Mkdir(extensionDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", extensionDir, err)
+	}
+
+	c.global.logger.WithField("type", sysext.Type).Info("Copying extension paths")
+
+	for _, path := range sysext.Paths {
+		if !lxdShared.PathExists(filepath.Join(overlayDir, path)) {
+			return fmt.Errorf("Extension path %q doesn't exist in the rootfs", path)
+		}
+
+		// The "/./" marks the part of the path which is recreated in the
+		// extension directory.
+		err := shared.RunCommand(c.global.ctx, nil, nil, "rsync", "-aHASX", "--devices", "--relative", overlayDir+"/."+filepath.Clean(path), extensionDir)
+		if err != nil {
+			return fmt.Errorf("Failed to copy %q: %w", path, err)
+		}
+	}
+
+	osRelease, err := parseOSRelease(overlayDir)
+	if err != nil {
+		return err
+	}
+
+	releaseFile := filepath.Join("usr", "lib", "extension-release.d", "extension-release."+sysext.Name)
+	if sysext.Type == "confext" {
+		releaseFile = filepath.Join("etc", "extension-release.d", "extension-release."+sysext.Name)
+	}
+
+	err = os.MkdirAll(filepath.Join(extensionDir, filepath.Dir(releaseFile)), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(releaseFile), err)
+	}
+
+	err = os.WriteFile(filepath.Join(extensionDir, releaseFile), []byte(extensionRelease(sysext, osRelease, c.global.definition.Image.ArchitectureKernel)), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", releaseFile, err)
+	}
+
+	imageFile := filepath.Join(staging.dir, sysext.Name+".raw")
+
+	c.global.logger.WithFields(logrus.Fields{"format": sysext.Format, "file": filepath.Base(imageFile)}).Info("Creating extension image")
+
+	if sysext.Format == "erofs" {
+		err = shared.RunCommand(c.global.ctx, nil, nil, "mkfs.erofs", "-zlz4hc", imageFile, extensionDir)
+	} else {
+		err = shared.RunCommand(c.global.ctx, nil, nil, "mksquashfs", extensionDir, imageFile, "-noappend", "-b", "1M", "-no-exports", "-no-progress", "-no-recovery", "-comp", "xz")
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to create extension image: %w", err)
+	}
+
+	return staging.publish()
+}
+
+// extensionRelease returns the content of the extension release file, which
+// systemd matches against the os-release of the host before merging the
+// extension.
+func extensionRelease(sysext shared.DefinitionTargetSysext, osRelease map[string]string, architecture string) string {
+	var b strings.Builder
+
+	id := osRelease["ID"]
+	if id == "" {
+		id = "_any"
+	}
+
+	fmt.Fprintf(&b, "ID=%s\n", id)
+
+	if sysext.Level != "" {
+		fmt.Fprintf(&b, "%s_LEVEL=%s\n", strings.ToUpper(sysext.Type), sysext.Level)
+	} else if osRelease["VERSION_ID"] != "" {
+		fmt.Fprintf(&b, "VERSION_ID=%s\n", osRelease["VERSION_ID"])
+	}
+
+	// Configuration extensions are architecture independent.
+	arch, ok := sysextArchitectures[architecture]
+	if ok && sysext.Type != "confext" {
+		fmt.Fprintf(&b, "ARCHITECTURE=%s\n", arch)
+	}
+
+	return b.String()
+}
+
+// parseOSRelease returns the fields of the os-release file of the given rootfs.
+func parseOSRelease(rootfsDir string) (map[string]string, error) {
+	osRelease := map[string]string{}
+
+	path := filepath.Join(rootfsDir, "etc", "os-release")
+	if !lxdShared.PathExists(path) {
+		path = filepath.Join(rootfsDir, "usr", "lib", "os-release")
+
+		if !lxdShared.PathExists(path) {
+			return osRelease, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err == nil {
+				value = unquoted
+			}
+		} else {
+			value = strings.Trim(value, "'")
+		}
+
+		osRelease[key] = value
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	return osRelease, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_extensionRelease(t *testing.T) {
+	osRelease := map[string]string{"ID": "ubuntu", "VERSION_ID": "24.04"}
+
+	require.Equal(t, "ID=ubuntu\nVERSION_ID=24.04\nARCHITECTURE=x86-64\n", extensionRelease(shared.DefinitionTargetSysext{Type: "sysext"}, osRelease, "x86_64"))
+	require.Equal(t, "ID=ubuntu\nSYSEXT_LEVEL=1.0\nARCHITECTURE=arm64\n", extensionRelease(shared.DefinitionTargetSysext{Type: "sysext", Level: "1.0"}, osRelease, "aarch64"))
+	require.Equal(t, "ID=ubuntu\nCONFEXT_LEVEL=1.0\n", extensionRelease(shared.DefinitionTargetSysext{Type: "confext", Level: "1.0"}, osRelease, "x86_64"))
+	require.Equal(t, "ID=_any\n", extensionRelease(shared.DefinitionTargetSysext{Type: "sysext"}, map[string]string{}, "mips"))
+}
+
+func Test_parseOSRelease(t *testing.T) {
+	rootfsDir := t.TempDir()
+
+	osRelease, err := parseOSRelease(rootfsDir)
+	require.NoError(t, err)
+	require.Empty(t, osRelease)
+
+	err = os.MkdirAll(filepath.Join(rootfsDir, "usr", "lib"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(rootfsDir, "usr", "lib", "os-release"), []byte(`# Comment
+NAME="Ubuntu"
+VERSION_ID="24.04"
+ID=ubuntu
+ID_LIKE='debian'
+`), 0644)
+	require.NoError(t, err)
+
+	osRelease, err = parseOSRelease(rootfsDir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"NAME": "Ubuntu", "VERSION_ID": "24.04", "ID": "ubuntu", "ID_LIKE": "debian"}, osRelease)
+}
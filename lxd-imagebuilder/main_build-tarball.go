@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/generators"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// packageManifestCommands are the commands listing the installed packages, by package manager.
+var packageManifestCommands = map[string][]string{
+	"apk":    {"apk", "info", "-v"},
+	"apt":    {"dpkg-query", "-W", "-f", "${binary:Package}\t${Version}\n"},
+	"dnf":    {"rpm", "-qa", "--qf", "%{NAME}.%{ARCH}\t%{VERSION}-%{RELEASE}\n"},
+	"pacman": {"pacman", "-Q"},
+	"xbps":   {"xbps-query", "-l"},
+	"yum":    {"rpm", "-qa", "--qf", "%{NAME}.%{ARCH}\t%{VERSION}-%{RELEASE}\n"},
+	"zypper": {"rpm", "-qa", "--qf", "%{NAME}.%{ARCH}\t%{VERSION}-%{RELEASE}\n"},
+}
+
+type cmdBuildTarball struct {
+	cmdBuild *cobra.Command
+	global   *cmdGlobal
+
+	flagCompression string
+	flagManifest    bool
+	flagChangelog   bool
+}
+
+func (c *cmdBuildTarball) command() *cobra.Command {
+	c.cmdBuild = &cobra.Command{
+		Use:   "build-tarball <filename|-> [target dir] [--compression=COMPRESSION] [--manifest] [--changelog]",
+		Short: "Build plain rootfs tarball",
+		Long: fmt.Sprintf(`Build plain rootfs tarball without LXC or LXD metadata
+
+%s
+Use --compression=none to create an uncompressed tarball.
+
+Use --changelog with --manifest to write the changes of the packages and files
+since the previous build to rootfs.changelog.
+`, compressionDescription),
+		Args: cobra.RangeArgs(1, 2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			// Check compression arguments
+			_, _, err := shared.ParseCompression(c.flagCompression)
+			if err != nil {
+				return fmt.Errorf("Failed to parse compression level: %w", err)
+			}
+
+			if c.flagChangelog && !c.flagManifest {
+				return errors.New("--changelog requires --manifest")
+			}
+
+			return c.global.preRunBuild(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			overlayDir, cleanup, err := c.global.getOverlayDir()
+			if err != nil {
+				return fmt.Errorf("Failed to get overlay directory: %w", err)
+			}
+
+			if cleanup != nil {
+				c.global.overlayCleanup = cleanup
+
+				defer func() {
+					cleanup()
+					c.global.overlayCleanup = nil
+				}()
+			}
+
+			return c.run(cmd, args, overlayDir)
+		},
+	}
+
+	c.cmdBuild.Flags().StringVar(&c.flagCompression, "compression", "xz", "Type of compression to use"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.flagManifest, "manifest", false, "Write the list of installed packages to rootfs.manifest")
+	c.cmdBuild.Flags().BoolVar(&c.flagChangelog, "changelog", false, "Write the changes since the previous build to rootfs.changelog")
+	c.cmdBuild.Flags().StringVar(&c.global.flagSourcesDir, "sources-dir", filepath.Join(os.TempDir(), "lxd-imagebuilder"), "Sources directory for distribution tarballs"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagKeepSources, "keep-sources", true, "Keep sources after build"+"``")
+
+	return c.cmdBuild
+}
+
+func (c *cmdBuildTarball) run(cmd *cobra.Command, args []string, overlayDir string) error {
+	imageTargets := shared.ImageTargetUndefined | shared.ImageTargetAll | shared.ImageTargetContainer
+
+	var manifestCommand []string
+
+	if c.flagManifest {
+		var ok bool
+
+		manifestCommand, ok = packageManifestCommands[c.global.definition.Packages.Manager]
+		if !ok {
+			return fmt.Errorf("Manifest isn't supported for package manager %q", c.global.definition.Packages.Manager)
+		}
+	}
+
+	// Create the artifacts in a staging directory, so they don't replace the
+	// ones in the target directory until the build succeeded.
+	staging, err := c.global.newArtifactStaging()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = staging.remove()
+	}()
+
+	for _, file := range c.global.definition.Files {
+		if !shared.ApplyFilter(&file, c.global.definition.Image.Release, c.global.definition.Image.ArchitectureMapped, c.global.definition.Image.Variant, c.global.definition.Targets.Type, imageTargets) {
+			c.global.logger.WithFields(logrus.Fields{"file": file.ID(), "generator": file.Generator}).Info("Skipping generator")
+
+			continue
+		}
+
+		generator, err := generators.Load(file.Generator, c.global.logger, c.global.flagCacheDir, overlayDir, file, *c.global.definition)
+		if err != nil {
+			return fmt.Errorf("Failed to load generator %q of %s: %w", file.Generator, file.ID(), err)
+		}
+
+		c.global.logger.WithFields(logrus.Fields{"file": file.ID(), "generator": file.Generator}).Info("Running generator")
+
+		err = generator.Run()
+		if err != nil {
+			return fmt.Errorf("Failed to run generator %q of %s: %w", file.Generator, file.ID(), err)
+		}
+	}
+
+	err = c.global.mergeRootfsOverlays("post-files", imageTargets, overlayDir)
+	if err != nil {
+		return err
+	}
+
+	exitChroot, err := shared.SetupChroot(overlayDir, *c.global.definition, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to setup chroot in %q: %w", overlayDir, err)
+	}
+
+	c.global.logger.WithField("trigger", "post-files").Info("Running hooks")
+
+	// Run post files hook
+	for _, action := range c.global.definition.GetRunnableActions("post-files", imageTargets) {
+		c.global.logger.WithField("action", action.ID()).Info("Running action")
+
+		if action.Pongo {
+			action.Action, err = shared.RenderTemplate(action.Action, c.global.definition)
+			if err != nil {
+				return fmt.Errorf("Failed to render action %q: %w", action.ID(), err)
+			}
+		}
+
+		err := shared.RunAction(c.global.ctx, c.global.logger, action)
+		if err != nil {
+			{
+				err := exitChroot()
+				if err != nil {
+					c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+				}
+			}
+
+			return fmt.Errorf("Failed to run post-files action %q: %w", action.ID(), err)
+		}
+	}
+
+	err = c.global.verifyPackageState("post-files")
+	if err != nil {
+		{
+			err := exitChroot()
+			if err != nil {
+				c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+			}
+		}
+
+		return err
+	}
+
+	var manifest bytes.Buffer
+
+	if manifestCommand != nil {
+		err := shared.RunCommand(c.global.ctx, nil, &manifest, manifestCommand[0], manifestCommand[1:]...)
+		if err != nil {
+			{
+				err := exitChroot()
+				if err != nil {
+					c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+				}
+			}
+
+			return fmt.Errorf("Failed to list installed packages: %w", err)
+		}
+	}
+
+	err = exitChroot()
+	if err != nil {
+		return fmt.Errorf("Failed exiting chroot: %w", err)
+	}
+
+	if c.flagChangelog {
+		err := writeFileManifest(overlayDir, filepath.Join(staging.dir, "rootfs.files"))
+		if err != nil {
+			return err
+		}
+	}
+
+	c.global.logger.WithField("compression", c.flagCompression).Info("Creating tarball")
+
+	_, err = shared.Pack(c.global.ctx, filepath.Join(staging.dir, "rootfs.tar"), c.flagCompression, overlayDir, c.global.definition.Targets.Tar, ".")
+	if err != nil {
+		return fmt.Errorf("Failed to pack %q: %w", filepath.Join(staging.dir, "rootfs.tar"), err)
+	}
+
+	if manifestCommand != nil {
+		err := os.WriteFile(filepath.Join(staging.dir, "rootfs.manifest"), manifest.Bytes(), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", filepath.Join(staging.dir, "rootfs.manifest"), err)
+		}
+	}
+
+	if c.flagChangelog {
+		previousDir, previous := staging.previous()
+
+		written := false
+
+		if previousDir != "" {
+			written, err = writeChangelog(previous, previousDir, staging.dir)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !written {
+			c.global.logger.Info("No manifest of a previous build found, skipping changelog")
+		}
+	}
+
+	return staging.publish()
+}
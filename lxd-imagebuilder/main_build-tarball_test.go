@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_cmdBuildTarballManifest(t *testing.T) {
+	c := cmdBuildTarball{
+		global: &cmdGlobal{
+			definition: &shared.Definition{Packages: shared.DefinitionPackages{Manager: "portage"}},
+			logger:     logrus.New(),
+		},
+		flagManifest: true,
+	}
+
+	err := c.run(nil, nil, t.TempDir())
+	require.EqualError(t, err, `Manifest isn't supported for package manager "portage"`)
+
+	for _, manager := range []string{"apk", "apt", "dnf", "pacman", "yum", "zypper"} {
+		require.Contains(t, packageManifestCommands, manager)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/generators"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+type cmdBuildWSL struct {
+	cmdBuild *cobra.Command
+	global   *cmdGlobal
+}
+
+func (c *cmdBuildWSL) command() *cobra.Command {
+	c.cmdBuild = &cobra.Command{
+		Use:   "build-wsl <filename|-> [target dir]",
+		Short: "Build WSL distribution",
+		Long: `Build WSL distribution from scratch
+
+The result is a gzip compressed tarball which can be installed with
+"wsl --install --from-file" or imported with "wsl --import".
+If targets.wsl.appx is set, the appx package layout is created as well.
+`,
+		Args:    cobra.RangeArgs(1, 2),
+		PreRunE: c.global.preRunBuild,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			overlayDir, cleanup, err := c.global.getOverlayDir()
+			if err != nil {
+				return fmt.Errorf("Failed to get overlay directory: %w", err)
+			}
+
+			if cleanup != nil {
+				c.global.overlayCleanup = cleanup
+
+				defer func() {
+					cleanup()
+					c.global.overlayCleanup = nil
+				}()
+			}
+
+			return c.run(cmd, args, overlayDir)
+		},
+	}
+
+	c.cmdBuild.Flags().StringVar(&c.global.flagSourcesDir, "sources-dir", filepath.Join(os.TempDir(), "lxd-imagebuilder"), "Sources directory for distribution tarballs"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagKeepSources, "keep-sources", true, "Keep sources after build"+"``")
+
+	return c.cmdBuild
+}
+
+func (c *cmdBuildWSL) run(cmd *cobra.Command, args []string, overlayDir string) error {
+	imageTargets := shared.ImageTargetUndefined | shared.ImageTargetAll | shared.ImageTargetContainer
+	wsl := c.global.definition.Targets.WSL
+
+	name := c.global.definition.Image.Name
+	if name != "" {
+		var err error
+
+		name, err = shared.RenderTemplate(name, c.global.definition)
+		if err != nil {
+			return fmt.Errorf("Failed to render image name: %w", err)
+		}
+	} else {
+		name = c.global.definition.Image.Distribution
+	}
+
+	// Create the artifacts in a staging directory, so they don't replace the
+	// ones in the target directory until the build succeeded.
+	staging, err := c.global.newArtifactStaging()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = staging.remove()
+	}()
+
+	for _, file := range c.global.definition.Files {
+		if !shared.ApplyFilter(&file, c.global.definition.Image.Release, c.global.definition.Image.ArchitectureMapped, c.global.definition.Image.Variant, c.global.definition.Targets.Type, imageTargets) {
+			c.global.logger.WithFields(logrus.Fields{"file": file.ID(), "generator": file.Generator}).Info("Skipping generator")
+
+			continue
+		}
+
+		generator, err := generators.Load(file.Generator, c.global.logger, c.global.flagCacheDir, overlayDir, file, *c.global.definition)
+		if err != nil {
+			return fmt.Errorf("Failed to load generator %q of %s: %w", file.Generator, file.ID(), err)
+		}
+
+		c.global.logger.WithFields(logrus.Fields{"file": file.ID(), "generator": file.Generator}).Info("Running generator")
+
+		err = generator.Run()
+		if err != nil {
+			return fmt.Errorf("Failed to run generator %q of %s: %w", file.Generator, file.ID(), err)
+		}
+	}
+
+	err = c.global.mergeRootfsOverlays("post-files", imageTargets, overlayDir)
+	if err != nil {
+		return err
+	}
+
+	defaultName := wsl.DefaultName
+	if defaultName == "" {
+		defaultName = name
+	}
+
+	// Write the WSL configuration before the post-files actions, so they can
+	// still modify it.
+	for file, content := range map[string]string{
+		"/etc/wsl.conf":              wslConf(wsl),
+		"/etc/wsl-distribution.conf": wslDistributionConf(wsl, defaultName),
+	} {
+		if content == "" {
+			continue
+		}
+
+		err := os.WriteFile(filepath.Join(overlayDir, file), []byte(content), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", file, err)
+		}
+	}
+
+	exitChroot, err := shared.SetupChroot(overlayDir, *c.global.definition, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to setup chroot in %q: %w", overlayDir, err)
+	}
+
+	c.global.logger.WithField("trigger", "post-files").Info("Running hooks")
+
+	// Run post files hook
+	for _, action := range c.global.definition.GetRunnableActions("post-files", imageTargets) {
+		c.global.logger.WithField("action", action.ID()).Info("Running action")
+
+		if action.Pongo {
+			action.Action, err = shared.RenderTemplate(action.Action, c.global.definition)
+			if err != nil {
+				return fmt.Errorf("Failed to render action %q: %w", action.ID(), err)
+			}
+		}
+
+		err := shared.RunAction(c.global.ctx, c.global.logger, action)
+		if err != nil {
+			{
+				err := exitChroot()
+				if err != nil {
+					c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+				}
+			}
+
+			return fmt.Errorf("Failed to run post-files action %q: %w", action.ID(), err)
+		}
+	}
+
+	err = c.global.verifyPackageState("post-files")
+	if err != nil {
+		{
+			err := exitChroot()
+			if err != nil {
+				c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+			}
+		}
+
+		return err
+	}
+
+	err = exitChroot()
+	if err != nil {
+		return fmt.Errorf("Failed exiting chroot: %w", err)
+	}
+
+	c.global.logger.Info("Creating WSL tarball")
+
+	tarball, err := shared.Pack(c.global.ctx, filepath.Join(staging.dir, "install.tar"), "gzip", overlayDir, c.global.definition.Targets.Tar, ".")
+	if err != nil {
+		return fmt.Errorf("Failed to pack %q: %w", filepath.Join(staging.dir, "install.tar"), err)
+	}
+
+	if wsl.Appx != nil {
+		c.global.logger.Info("Creating appx package layout")
+
+		appxDir := filepath.Join(staging.dir, "appx")
+
+		err := os.MkdirAll(filepath.Join(appxDir, "Assets"), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", appxDir, err)
+		}
+
+		err = shared.Copy(tarball, filepath.Join(appxDir, "install.tar.gz"))
+		if err != nil {
+			return fmt.Errorf("Failed to copy %q: %w", tarball, err)
+		}
+
+		err = os.WriteFile(filepath.Join(appxDir, "AppxManifest.xml"), []byte(appxManifest(*wsl.Appx, c.global.definition.Image.ArchitectureMapped)), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", filepath.Join(appxDir, "AppxManifest.xml"), err)
+		}
+	}
+
+	err = os.Rename(tarball, filepath.Join(staging.dir, name+".wsl"))
+	if err != nil {
+		return fmt.Errorf("Failed to rename %q: %w", tarball, err)
+	}
+
+	return staging.publish()
+}
+
+// wslConf returns the content of /etc/wsl.conf, which configures the
+// distribution inside of WSL.
+func wslConf(wsl shared.DefinitionTargetWSL) string {
+	var b strings.Builder
+
+	if wsl.Systemd {
+		b.WriteString("[boot]\nsystemd=true\n\n")
+	}
+
+	if wsl.DefaultUser != "" {
+		fmt.Fprintf(&b, "[user]\ndefault=%s\n\n", wsl.DefaultUser)
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// wslDistributionConf returns the content of /etc/wsl-distribution.conf, which
+// is read by WSL when installing the distribution.
+func wslDistributionConf(wsl shared.DefinitionTargetWSL, defaultName string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "[oobe]\ndefaultName=%s\n", defaultName)
+
+	if wsl.Icon != "" {
+		fmt.Fprintf(&b, "\n[shortcut]\nicon=%s\n", wsl.Icon)
+	}
+
+	return b.String()
+}
+
+// appxArchitectures maps the architectures of the image to the ones of appx
+// packages.
+var appxArchitectures = map[string]string{
+	"amd64":   "x64",
+	"arm64":   "arm64",
+	"aarch64": "arm64",
+	"x86_64":  "x64",
+}
+
+// appxManifest returns the AppxManifest.xml of the appx package. The launcher
+// executable and logos referenced by it aren't part of the build.
+func appxManifest(appx shared.DefinitionTargetWSLAppx, architecture string) string {
+	displayName := appx.DisplayName
+	if displayName == "" {
+		displayName = appx.Name
+	}
+
+	version := appx.Version
+	if version == "" {
+		version = "1.0.0.0"
+	}
+
+	arch, ok := appxArchitectures[architecture]
+	if !ok {
+		arch = "neutral"
+	}
+
+	// The publisher display name is the common name of the publisher.
+	publisherName, _, _ := strings.Cut(strings.TrimPrefix(appx.Publisher, "CN="), ",")
+
+	name := html.EscapeString(appx.Name)
+	displayName = html.EscapeString(displayName)
+
+	return fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<Package xmlns="http://schemas.microsoft.com/appx/manifest/foundation/windows10"
+         xmlns:uap="http://schemas.microsoft.com/appx/manifest/uap/windows10"
+         xmlns:rescap="http://schemas.microsoft.com/appx/manifest/foundation/windows10/restrictedcapabilities">
+  <Identity Name="%s" Publisher="%s" Version="%s" ProcessorArchitecture="%s" />
+  <Properties>
+    <DisplayName>%s</DisplayName>
+    <PublisherDisplayName>%s</PublisherDisplayName>
+    <Logo>Assets\StoreLogo.png</Logo>
+  </Properties>
+  <Dependencies>
+    <TargetDeviceFamily Name="Windows.Desktop" MinVersion="10.0.16215.0" MaxVersionTested="10.0.22621.0" />
+  </Dependencies>
+  <Resources>
+    <Resource Language="en-us" />
+  </Resources>
+  <Applications>
+    <Application Id="%s" Executable="launcher.exe" EntryPoint="Windows.FullTrustApplication">
+      <uap:VisualElements DisplayName="%s" Description="%s" BackgroundColor="transparent"
+                          Square150x150Logo="Assets\Square150x150Logo.png" Square44x44Logo="Assets\Square44x44Logo.png" />
+    </Application>
+  </Applications>
+  <Capabilities>
+    <rescap:Capability Name="runFullTrust" />
+  </Capabilities>
+</Package>
+`, name, html.EscapeString(appx.Publisher), version, arch, displayName, html.EscapeString(publisherName), appxApplicationID(appx.Name), displayName, displayName)
+}
+
+// appxApplicationID returns the application ID derived from the package name,
+// which may only contain alphanumeric characters and must start with a letter.
+func appxApplicationID(name string) string {
+	id := strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' {
+			return -1
+		}
+
+		return r
+	}, name)
+
+	if id == "" || (id[0] >= '0' && id[0] <= '9') {
+		id = "App" + id
+	}
+
+	return id
+}
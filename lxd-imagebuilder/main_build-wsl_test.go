@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_wslConf(t *testing.T) {
+	require.Equal(t, "", wslConf(shared.DefinitionTargetWSL{}))
+	require.Equal(t, "[user]\ndefault=ubuntu\n", wslConf(shared.DefinitionTargetWSL{DefaultUser: "ubuntu"}))
+	require.Equal(t, "[boot]\nsystemd=true\n\n[user]\ndefault=ubuntu\n", wslConf(shared.DefinitionTargetWSL{DefaultUser: "ubuntu", Systemd: true}))
+
+	require.Equal(t, "[oobe]\ndefaultName=Ubuntu\n", wslDistributionConf(shared.DefinitionTargetWSL{}, "Ubuntu"))
+	require.Equal(t, "[oobe]\ndefaultName=Ubuntu\n\n[shortcut]\nicon=/usr/share/wsl/ubuntu.ico\n", wslDistributionConf(shared.DefinitionTargetWSL{Icon: "/usr/share/wsl/ubuntu.ico"}, "Ubuntu"))
+}
+
+func Test_appxManifest(t *testing.T) {
+	manifest := appxManifest(shared.DefinitionTargetWSLAppx{Name: "Ubuntu-24.04", Publisher: "CN=Canonical Group Limited, O=Canonical"}, "amd64")
+
+	require.Contains(t, manifest, `<Identity Name="Ubuntu-24.04" Publisher="CN=Canonical Group Limited, O=Canonical" Version="1.0.0.0" ProcessorArchitecture="x64" />`)
+	require.Contains(t, manifest, `<PublisherDisplayName>Canonical Group Limited</PublisherDisplayName>`)
+	require.Contains(t, manifest, `<Application Id="Ubuntu2404"`)
+
+	require.Equal(t, "App2404", appxApplicationID("24-04"))
+}
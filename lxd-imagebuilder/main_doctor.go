@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/canonical/lxd/shared/osarch"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// doctorCheck represents a single check of the build environment.
+type doctorCheck struct {
+	name string
+
+	// fatal marks checks which prevent any build from succeeding.
+	fatal bool
+
+	// run returns an error if the check fails.
+	run func() error
+
+	// remediation describes how to fix a failed check.
+	remediation string
+}
+
+type cmdDoctor struct {
+	cmdDoctor *cobra.Command
+	global    *cmdGlobal
+}
+
+func (c *cmdDoctor) command() *cobra.Command {
+	c.cmdDoctor = &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the build environment",
+		Long: `Check the build environment
+
+Checks for the kernel features, tools and permissions required to build images
+and prints how to fix the problems which were found.
+`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			failed := 0
+
+			for _, check := range c.checks() {
+				err := check.run()
+				if err == nil {
+					fmt.Printf("[OK]   %s\n", check.name)
+					continue
+				}
+
+				status := "WARN"
+				if check.fatal {
+					status = "FAIL"
+					failed++
+				}
+
+				fmt.Printf("[%s] %s: %s\n", status, check.name, err)
+				fmt.Printf("       %s\n", check.remediation)
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d checks failed", failed)
+			}
+
+			return nil
+		},
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	return c.cmdDoctor
+}
+
+func (c *cmdDoctor) checks() []doctorCheck {
+	checks := []doctorCheck{
+		{
+			name:        "Root privileges",
+			fatal:       true,
+			run:         checkRoot,
+			remediation: "Run lxd-imagebuilder as root, e.g. using sudo.",
+		},
+		{
+			name:        "Cache directory",
+			fatal:       true,
+			run:         func() error { return checkCacheDir(c.global.flagCacheDir) },
+			remediation: "Use --cache-dir to point to a directory on a file system which isn't mounted with noexec, nodev or nosuid.",
+		},
+		{
+			name:        "Mount namespaces",
+			fatal:       true,
+			run:         func() error { return checkNamespaces("mnt") },
+			remediation: "Run on a kernel with namespace support, or in a container which allows nesting (e.g. security.nesting=true in LXD).",
+		},
+		{
+			name:        "Overlay file system",
+			run:         func() error { return checkFilesystems("overlay") },
+			remediation: "Load the overlay module (modprobe overlay), or use --disable-overlay.",
+		},
+		{
+			name:        "Squashfs file system",
+			run:         func() error { return checkFilesystems("squashfs") },
+			remediation: "Load the squashfs module (modprobe squashfs).",
+		},
+		{
+			name:        "Loop devices",
+			run:         checkLoop,
+			remediation: "Load the loop module (modprobe loop). In containers, /dev/loop-control and the loop devices need to be passed through. Loop devices are required for VM images.",
+		},
+		{
+			name:        "binfmt_misc",
+			run:         checkBinfmtMisc,
+			remediation: "Mount binfmt_misc (mount -t binfmt_misc binfmt_misc /proc/sys/fs/binfmt_misc) and install qemu-user-static. This is required for building images of foreign architectures.",
+		},
+		{
+			name:        "Control groups",
+			run:         checkCgroups,
+			remediation: "Mount the cgroup file system at /sys/fs/cgroup.",
+		},
+		{
+			name:        "Required tools",
+			fatal:       true,
+			run:         func() error { return checkTools(requiredTools) },
+			remediation: "Install the missing tools using the package manager of the host.",
+		},
+		{
+			name:        "VM tools",
+			run:         func() error { return checkTools(vmDependencies) },
+			remediation: "Install the missing tools using the package manager of the host. They are required for VM images.",
+		},
+		{
+			name:        "LXD container",
+			run:         func() error { return checkLXDContainer(c.global.flagCacheDir) },
+			remediation: "Set the listed keys on the LXD container using \"lxc config set <container> <key>=<value>\" on the LXD host, and restart it. Loop devices additionally need to be passed through as unix-block devices.",
+		},
+		{
+			name:        "UEFI firmware",
+			run:         checkUEFIFirmware,
+			remediation: "Install the edk2 firmware of the host architecture, e.g. ovmf on Debian based distributions, or set targets.lxd.vm.firmware. It is required for booting VM images on the build host.",
+		},
+	}
+
+	return checks
+}
+
+// requiredTools are the tools required to build any image.
+var requiredTools = []string{"gpg", "mksquashfs", "rsync", "tar", "xz"}
+
+func checkUEFIFirmware() error {
+	architecture, err := osarch.ArchitectureGetLocal()
+	if err != nil {
+		return fmt.Errorf("Failed to get local architecture: %w", err)
+	}
+
+	_, err = findUEFIFirmware(architecture, false, nil)
+
+	return err
+}
+
+func checkRoot() error {
+	if os.Geteuid() != 0 {
+		return errors.New("Not running as root")
+	}
+
+	return nil
+}
+
+func checkCacheDir(cacheDir string) error {
+	if cacheDir == "" {
+		cacheDir = "/var/cache"
+	}
+
+	// Check the closest existing parent as the cache directory is created on demand.
+	path := cacheDir
+	for !lxdShared.PathExists(path) {
+		path = filepath.Dir(path)
+	}
+
+	var stat unix.Statfs_t
+
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return fmt.Errorf("Failed to stat %q: %w", path, err)
+	}
+
+	var flags []string
+
+	if stat.Flags&unix.ST_NOEXEC != 0 {
+		flags = append(flags, "noexec")
+	}
+
+	if stat.Flags&unix.ST_NODEV != 0 {
+		flags = append(flags, "nodev")
+	}
+
+	if stat.Flags&unix.ST_NOSUID != 0 {
+		flags = append(flags, "nosuid")
+	}
+
+	if stat.Flags&unix.ST_RDONLY != 0 {
+		flags = append(flags, "ro")
+	}
+
+	if len(flags) > 0 {
+		return fmt.Errorf("%q is mounted with %s", cacheDir, strings.Join(flags, ","))
+	}
+
+	return nil
+}
+
+func checkNamespaces(names ...string) error {
+	for _, name := range names {
+		if !lxdShared.PathExists(filepath.Join("/proc/self/ns", name)) {
+			return fmt.Errorf("Namespace %q is not available", name)
+		}
+	}
+
+	return nil
+}
+
+func checkFilesystems(names ...string) error {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %w", "/proc/filesystems", err)
+	}
+
+	defer f.Close()
+
+	var supported []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		supported = append(supported, fields[len(fields)-1])
+	}
+
+	for _, name := range names {
+		if !slices.Contains(supported, name) {
+			return fmt.Errorf("File system %q is not supported by the kernel", name)
+		}
+	}
+
+	return nil
+}
+
+func checkLoop() error {
+	if !lxdShared.PathExists("/dev/loop-control") {
+		return errors.New("/dev/loop-control is missing")
+	}
+
+	return nil
+}
+
+func checkBinfmtMisc() error {
+	if !lxdShared.PathExists("/proc/sys/fs/binfmt_misc/status") {
+		return errors.New("binfmt_misc is not mounted")
+	}
+
+	return nil
+}
+
+func checkCgroups() error {
+	var stat unix.Statfs_t
+
+	err := unix.Statfs("/sys/fs/cgroup", &stat)
+	if err != nil {
+		return fmt.Errorf("Failed to stat %q: %w", "/sys/fs/cgroup", err)
+	}
+
+	// cgroup v2 is mounted directly, cgroup v1 hierarchies are mounted below a tmpfs.
+	if stat.Type != unix.CGROUP2_SUPER_MAGIC && stat.Type != unix.TMPFS_MAGIC {
+		return errors.New("/sys/fs/cgroup is not mounted")
+	}
+
+	return nil
+}
+
+func checkTools(tools []string) error {
+	var missing []string
+
+	for _, tool := range tools {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			missing = append(missing, tool)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// packagesDownloadDir is the path inside the chroot the target directory is mounted to.
+const packagesDownloadDir = "/var/cache/lxd-imagebuilder/packages"
+
+type cmdDownloadPackages struct {
+	cmdDownloadPackages *cobra.Command
+	global              *cmdGlobal
+
+	flagVM bool
+}
+
+func (c *cmdDownloadPackages) command() *cobra.Command {
+	c.cmdDownloadPackages = &cobra.Command{
+		Use:   "download-packages <filename|-> [target dir] [--vm]",
+		Short: "Download the packages of a definition without installing them",
+		Long: `Download the packages of a definition without installing them
+
+All packages which are to be installed, including their dependencies, are
+downloaded into the target directory. If the host provides the required tools,
+repository metadata is generated as well so that the directory can be used as
+a local mirror for offline builds.
+`,
+		Args:    cobra.RangeArgs(1, 2),
+		PreRunE: c.global.preRunBuild,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Remove leftovers of the package managers.
+			for _, name := range []string{"lock", "partial"} {
+				err := os.RemoveAll(filepath.Join(c.global.targetDir, name))
+				if err != nil {
+					return fmt.Errorf("Failed to remove %q: %w", filepath.Join(c.global.targetDir, name), err)
+				}
+			}
+
+			return c.createRepositoryMetadata()
+		},
+	}
+
+	c.cmdDownloadPackages.Flags().BoolVar(&c.flagVM, "vm", false, "Include packages for VMs"+"``")
+	c.cmdDownloadPackages.Flags().BoolVar(&c.global.flagKeepSources, "keep-sources", true, "Keep sources after build"+"``")
+	c.cmdDownloadPackages.Flags().StringVar(&c.global.flagSourcesDir, "sources-dir", filepath.Join(os.TempDir(), "lxd-imagebuilder"), "Sources directory for distribution tarballs"+"``")
+
+	return c.cmdDownloadPackages
+}
+
+// createRepositoryMetadata creates the repository metadata for the downloaded packages.
+func (c *cmdDownloadPackages) createRepositoryMetadata() error {
+	var name string
+	var args []string
+
+	switch c.global.definition.Packages.Manager {
+	case "apt":
+		name = "dpkg-scanpackages"
+		args = []string{"--multiversion", "."}
+	case "dnf", "yum":
+		name = "createrepo_c"
+		args = []string{"."}
+	default:
+		c.global.logger.WithField("manager", c.global.definition.Packages.Manager).Warn("Skipping repository metadata creation as it is not supported for this package manager")
+		return nil
+	}
+
+	_, err := exec.LookPath(name)
+	if err != nil {
+		c.global.logger.WithField("tool", name).Warn("Skipping repository metadata creation as the required tool is missing")
+		return nil
+	}
+
+	c.global.logger.Info("Creating repository metadata")
+
+	var buf bytes.Buffer
+
+	cmd := exec.CommandContext(c.global.ctx, name, args...)
+	cmd.Dir = c.global.targetDir
+	cmd.Stdout = &buf
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to run %q: %w", name, err)
+	}
+
+	if name != "dpkg-scanpackages" {
+		return nil
+	}
+
+	// dpkg-scanpackages writes the index to stdout.
+	packagesFile := filepath.Join(c.global.targetDir, "Packages")
+
+	err = os.WriteFile(packagesFile, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write file %q: %w", packagesFile, err)
+	}
+
+	err = shared.RunCommand(c.global.ctx, nil, nil, "gzip", "--keep", "--force", packagesFile)
+	if err != nil {
+		return fmt.Errorf("Failed to compress %q: %w", packagesFile, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+type cmdFmt struct {
+	cmdFmt *cobra.Command
+	global *cmdGlobal
+
+	flagWrite bool
+	flagCheck bool
+}
+
+func (c *cmdFmt) command() *cobra.Command {
+	c.cmdFmt = &cobra.Command{
+		Use:   "fmt <filename|->...",
+		Short: "Format definition files",
+		Long: `Format definition files
+
+The definitions are parsed and written back in their canonical form, which
+orders the keys, indents mappings by two spaces and lists the filters after
+the fields they apply to. Comments aren't kept.
+
+Without flags, the formatted definition is printed. With --write, the files
+are replaced. With --check, the files which aren't formatted are listed, and
+the command fails if there are any.
+`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: c.run,
+
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	c.cmdFmt.Flags().BoolVarP(&c.flagWrite, "write", "w", false, "Replace the files with the formatted definitions")
+	c.cmdFmt.Flags().BoolVar(&c.flagCheck, "check", false, "List the files which aren't formatted, and fail if there are any")
+
+	return c.cmdFmt
+}
+
+func (c *cmdFmt) run(cmd *cobra.Command, args []string) error {
+	if c.flagWrite && c.flagCheck {
+		return errors.New("--write and --check can't be used together")
+	}
+
+	if !c.flagWrite && !c.flagCheck && len(args) > 1 {
+		return errors.New("Formatting several definitions requires --write or --check")
+	}
+
+	unformatted := 0
+
+	for _, fname := range args {
+		if fname == "-" && c.flagWrite {
+			return errors.New("--write can't be used with the standard input")
+		}
+
+		var data []byte
+		var err error
+
+		if fname == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(fname)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to read %q: %w", fname, err)
+		}
+
+		out, err := shared.FormatDefinition(data)
+		if err != nil {
+			return fmt.Errorf("Failed to format %q: %w", fname, err)
+		}
+
+		switch {
+		case c.flagCheck:
+			if !bytes.Equal(data, out) {
+				fmt.Println(fname)
+				unformatted++
+			}
+
+		case c.flagWrite:
+			if bytes.Equal(data, out) {
+				continue
+			}
+
+			err = os.WriteFile(fname, out, 0644)
+			if err != nil {
+				return fmt.Errorf("Failed to write %q: %w", fname, err)
+			}
+
+		default:
+			_, err = os.Stdout.Write(out)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if unformatted > 0 {
+		return fmt.Errorf("%d of %d definitions aren't formatted, run lxd-imagebuilder fmt --write to format them", unformatted, len(args))
+	}
+
+	return nil
+}
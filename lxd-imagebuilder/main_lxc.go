@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/canonical/lxd-imagebuilder/generators"
@@ -19,11 +20,12 @@ type cmdLXC struct {
 	global   *cmdGlobal
 
 	flagCompression string
+	flagVerify      bool
 }
 
 func (c *cmdLXC) commandBuild() *cobra.Command {
 	c.cmdBuild = &cobra.Command{
-		Use:   "build-lxc <filename|-> [target dir] [--compression=COMPRESSION]",
+		Use:   "build-lxc <filename|-> [target dir] [--compression=COMPRESSION] [--verify]",
 		Short: "Build LXC image from scratch",
 		Long: fmt.Sprintf(`Build LXC image from scratch
 
@@ -59,6 +61,7 @@ func (c *cmdLXC) commandBuild() *cobra.Command {
 	}
 
 	c.cmdBuild.Flags().StringVar(&c.flagCompression, "compression", "xz", "Type of compression to use"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.flagVerify, "verify", false, "Check that a container created from the image boots"+"``")
 	c.cmdBuild.Flags().StringVar(&c.global.flagSourcesDir, "sources-dir", filepath.Join(os.TempDir(), "lxd-imagebuilder"), "Sources directory for distribution tarballs"+"``")
 	c.cmdBuild.Flags().BoolVar(&c.global.flagKeepSources, "keep-sources", true, "Keep sources after build"+"``")
 
@@ -67,7 +70,7 @@ func (c *cmdLXC) commandBuild() *cobra.Command {
 
 func (c *cmdLXC) commandPack() *cobra.Command {
 	c.cmdPack = &cobra.Command{
-		Use:   "pack-lxc <filename|-> <source dir> [target dir] [--compression=COMPRESSION]",
+		Use:   "pack-lxc <filename|-> <source dir> [target dir] [--compression=COMPRESSION] [--verify]",
 		Short: "Create LXC image from existing rootfs",
 		Long: fmt.Sprintf(`Create LXC image from existing rootfs
 
@@ -108,6 +111,7 @@ func (c *cmdLXC) commandPack() *cobra.Command {
 	}
 
 	c.cmdPack.Flags().StringVar(&c.flagCompression, "compression", "xz", "Type of compression to use"+"``")
+	c.cmdPack.Flags().BoolVar(&c.flagVerify, "verify", false, "Check that a container created from the image boots"+"``")
 
 	return c.cmdPack
 }
@@ -141,71 +145,64 @@ func (c *cmdLXC) runPack(cmd *cobra.Command, args []string, overlayDir string) e
 
 	// Run post unpack hook
 	for _, hook := range c.global.definition.GetRunnableActions("post-unpack", imageTargets) {
+		c.global.logger.WithField("action", hook.ID()).Info("Running action")
+
 		if hook.Pongo {
 			hook.Action, err = shared.RenderTemplate(hook.Action, c.global.definition)
 			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
+				return fmt.Errorf("Failed to render action %q: %w", hook.ID(), err)
 			}
 		}
 
-		err := shared.RunScript(c.global.ctx, hook.Action)
+		err := shared.RunAction(c.global.ctx, c.global.logger, hook)
 		if err != nil {
-			return fmt.Errorf("Failed to run post-unpack: %w", err)
+			return fmt.Errorf("Failed to run post-unpack action %q: %w", hook.ID(), err)
 		}
 	}
 
-	c.global.logger.Info("Managing packages")
+	return c.global.managePackages(manager, imageTargets)
+}
 
-	// Install/remove/update packages
-	err = manager.ManagePackages(imageTargets)
+func (c *cmdLXC) run(cmd *cobra.Command, args []string, overlayDir string) error {
+	// Create the artifacts in a staging directory, so they don't replace the
+	// ones in the target directory until the build succeeded.
+	staging, err := c.global.newArtifactStaging()
 	if err != nil {
-		return fmt.Errorf("Failed to manage packages: %w", err)
+		return err
 	}
 
-	c.global.logger.WithField("trigger", "post-packages").Info("Running hooks")
-
-	// Run post packages hook
-	for _, hook := range c.global.definition.GetRunnableActions("post-packages", imageTargets) {
-		if hook.Pongo {
-			hook.Action, err = shared.RenderTemplate(hook.Action, c.global.definition)
-			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
-			}
-		}
-
-		err := shared.RunScript(c.global.ctx, hook.Action)
-		if err != nil {
-			return fmt.Errorf("Failed to run post-packages: %w", err)
-		}
-	}
-
-	return nil
-}
+	defer func() {
+		_ = staging.remove()
+	}()
 
-func (c *cmdLXC) run(cmd *cobra.Command, args []string, overlayDir string) error {
-	img := image.NewLXCImage(c.global.ctx, overlayDir, c.global.targetDir,
+	img := image.NewLXCImage(c.global.ctx, overlayDir, staging.dir,
 		c.global.flagCacheDir, *c.global.definition)
 
 	for _, file := range c.global.definition.Files {
 		if !shared.ApplyFilter(&file, c.global.definition.Image.Release, c.global.definition.Image.ArchitectureMapped, c.global.definition.Image.Variant, c.global.definition.Targets.Type, shared.ImageTargetUndefined|shared.ImageTargetAll|shared.ImageTargetContainer) {
-			c.global.logger.WithField("generator", file.Generator).Info("Skipping generator")
+			c.global.logger.WithFields(logrus.Fields{"file": file.ID(), "generator": file.Generator}).Info("Skipping generator")
 
 			continue
 		}
 
 		generator, err := generators.Load(file.Generator, c.global.logger, c.global.flagCacheDir, overlayDir, file, *c.global.definition)
 		if err != nil {
-			return fmt.Errorf("Failed to load generator %q: %w", file.Generator, err)
+			return fmt.Errorf("Failed to load generator %q of %s: %w", file.Generator, file.ID(), err)
 		}
 
-		c.global.logger.WithField("generator", file.Generator).Info("Running generator")
+		c.global.logger.WithFields(logrus.Fields{"file": file.ID(), "generator": file.Generator}).Info("Running generator")
 
 		err = generator.RunLXC(img, c.global.definition.Targets.LXC)
 		if err != nil {
-			return fmt.Errorf("Failed to run generator %q: %w", file.Generator, err)
+			return fmt.Errorf("Failed to run generator %q of %s: %w", file.Generator, file.ID(), err)
 		}
 	}
 
+	err = c.global.mergeRootfsOverlays("post-files", shared.ImageTargetUndefined|shared.ImageTargetAll|shared.ImageTargetContainer, overlayDir)
+	if err != nil {
+		return err
+	}
+
 	exitChroot, err := shared.SetupChroot(overlayDir,
 		*c.global.definition, nil)
 	if err != nil {
@@ -221,14 +218,16 @@ func (c *cmdLXC) run(cmd *cobra.Command, args []string, overlayDir string) error
 
 	// Run post files hook
 	for _, action := range c.global.definition.GetRunnableActions("post-files", shared.ImageTargetUndefined|shared.ImageTargetAll|shared.ImageTargetContainer) {
+		c.global.logger.WithField("action", action.ID()).Info("Running action")
+
 		if action.Pongo {
 			action.Action, err = shared.RenderTemplate(action.Action, c.global.definition)
 			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
+				return fmt.Errorf("Failed to render action %q: %w", action.ID(), err)
 			}
 		}
 
-		err := shared.RunScript(c.global.ctx, action.Action)
+		err := shared.RunAction(c.global.ctx, c.global.logger, action)
 		if err != nil {
 			{
 				err := exitChroot()
@@ -237,8 +236,20 @@ func (c *cmdLXC) run(cmd *cobra.Command, args []string, overlayDir string) error
 				}
 			}
 
-			return fmt.Errorf("Failed to run post-files: %w", err)
+			return fmt.Errorf("Failed to run post-files action %q: %w", action.ID(), err)
+		}
+	}
+
+	err = c.global.verifyPackageState("post-files")
+	if err != nil {
+		{
+			err := exitChroot()
+			if err != nil {
+				c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+			}
 		}
+
+		return err
 	}
 
 	err = exitChroot()
@@ -253,5 +264,12 @@ func (c *cmdLXC) run(cmd *cobra.Command, args []string, overlayDir string) error
 		return fmt.Errorf("Failed to create LXC image: %w", err)
 	}
 
-	return nil
+	if c.flagVerify {
+		err := verifyLXCImage(c.global.ctx, c.global.logger, staging.dir, fmt.Sprintf("lxd-imagebuilder-verify-%d", os.Getpid()))
+		if err != nil {
+			return fmt.Errorf("Failed to verify image: %w", err)
+		}
+	}
+
+	return staging.publish()
 }
@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,6 +12,7 @@ import (
 	"github.com/canonical/lxd/shared/api"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/sys/unix"
 
 	"github.com/canonical/lxd-imagebuilder/generators"
@@ -30,11 +30,16 @@ type cmdLXD struct {
 	flagCompression   string
 	flagVM            bool
 	flagImportIntoLXD string
+	flagVerify        bool
+	flagHybrid        bool
+	flagLaunch        string
+	flagProfiles      []string
+	flagWaitCloudInit bool
 }
 
 func (c *cmdLXD) commandBuild() *cobra.Command {
 	c.cmdBuild = &cobra.Command{
-		Use:   "build-lxd <filename|-> [target dir] [--type=TYPE] [--compression=COMPRESSION] [--import-into-lxd]",
+		Use:   "build-lxd <filename|-> [target dir] [--type=TYPE] [--compression=COMPRESSION] [--import-into-lxd] [--verify] [--hybrid] [--launch=NAME]",
 		Short: "Build LXD image from scratch",
 		Long: fmt.Sprintf(`Build LXD image from scratch
 
@@ -61,8 +66,31 @@ func (c *cmdLXD) commandBuild() *cobra.Command {
 				}
 			}
 
+			if c.flagVM && c.flagVerify {
+				return errors.New("--verify isn't supported for VM images, use targets.lxd.vm.boot_test instead")
+			}
+
+			if c.flagHybrid && c.flagVM {
+				return errors.New("--hybrid cannot be used with --vm")
+			}
+
+			// Both images would get the same alias.
+			if c.flagHybrid && cmd.Flags().Changed("import-into-lxd") {
+				return errors.New("--import-into-lxd cannot be used with --hybrid")
+			}
+
+			// Both instances would get the same name.
+			if c.flagHybrid && c.flagLaunch != "" {
+				return errors.New("--launch cannot be used with --hybrid")
+			}
+
+			err = c.checkLaunchFlags()
+			if err != nil {
+				return err
+			}
+
 			// Check dependencies
-			if c.flagVM {
+			if c.flagVM || c.flagHybrid {
 				err := c.checkVMDependencies()
 				if err != nil {
 					return fmt.Errorf("Failed to check VM dependencies: %w", err)
@@ -72,6 +100,10 @@ func (c *cmdLXD) commandBuild() *cobra.Command {
 			return c.global.preRunBuild(cmd, args)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if c.flagHybrid {
+				return c.runHybrid(cmd, args)
+			}
+
 			overlayDir, cleanup, err := c.global.getOverlayDir()
 			if err != nil {
 				return fmt.Errorf("Failed to get overlay directory: %w", err)
@@ -94,6 +126,9 @@ func (c *cmdLXD) commandBuild() *cobra.Command {
 	c.cmdBuild.Flags().StringVar(&c.flagCompression, "compression", "xz", "Type of compression to use"+"``")
 	c.cmdBuild.Flags().BoolVar(&c.flagVM, "vm", false, "Create a qcow2 image for VMs"+"``")
 	c.cmdBuild.Flags().StringVar(&c.flagImportIntoLXD, "import-into-lxd", "", "Import built image into LXD"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.flagVerify, "verify", false, "Check that a container created from the image boots"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.flagHybrid, "hybrid", false, "Create both a container and a VM image from the same rootfs"+"``")
+	c.addLaunchFlags(c.cmdBuild)
 	c.cmdBuild.Flags().BoolVar(&c.global.flagKeepSources, "keep-sources", true, "Keep sources after build"+"``")
 	c.cmdBuild.Flags().StringVar(&c.global.flagSourcesDir, "sources-dir", filepath.Join(os.TempDir(), "lxd-imagebuilder"), "Sources directory for distribution tarballs"+"``")
 
@@ -102,7 +137,7 @@ func (c *cmdLXD) commandBuild() *cobra.Command {
 
 func (c *cmdLXD) commandPack() *cobra.Command {
 	c.cmdPack = &cobra.Command{
-		Use:   "pack-lxd <filename|-> <source dir> [target dir] [--type=TYPE] [--compression=COMPRESSION] [--import-into-lxd]",
+		Use:   "pack-lxd <filename|-> <source dir> [target dir] [--type=TYPE] [--compression=COMPRESSION] [--import-into-lxd] [--verify] [--launch=NAME]",
 		Short: "Create LXD image from existing rootfs",
 		Long: fmt.Sprintf(`Create LXD image from existing rootfs
 
@@ -129,6 +164,15 @@ func (c *cmdLXD) commandPack() *cobra.Command {
 				}
 			}
 
+			if c.flagVM && c.flagVerify {
+				return errors.New("--verify isn't supported for VM images, use targets.lxd.vm.boot_test instead")
+			}
+
+			err = c.checkLaunchFlags()
+			if err != nil {
+				return err
+			}
+
 			// Check dependencies
 			if c.flagVM {
 				err := c.checkVMDependencies()
@@ -171,11 +215,90 @@ func (c *cmdLXD) commandPack() *cobra.Command {
 	c.cmdPack.Flags().StringVar(&c.flagCompression, "compression", "xz", "Type of compression to use")
 	c.cmdPack.Flags().BoolVar(&c.flagVM, "vm", false, "Create a qcow2 image for VMs"+"``")
 	c.cmdPack.Flags().StringVar(&c.flagImportIntoLXD, "import-into-lxd", "", "Import built image into LXD"+"``")
+	c.cmdPack.Flags().BoolVar(&c.flagVerify, "verify", false, "Check that a container created from the image boots"+"``")
+	c.addLaunchFlags(c.cmdPack)
 	c.cmdPack.Flags().Lookup("import-into-lxd").NoOptDefVal = "-"
 
 	return c.cmdPack
 }
 
+// runHybrid creates both a container and a VM image from the rootfs populated
+// by preRunBuild, which only contains the sections without a type filter, like
+// build-dir. As with pack-lxd, the sections of each image type are applied to
+// an overlay of the rootfs. The images are written to the container and vm
+// subdirectories of the target directory, or of the serial directory with the
+// tree output layout.
+func (c *cmdLXD) runHybrid(cmd *cobra.Command, args []string) error {
+	cacheDir := c.global.flagCacheDir
+	targetDir := c.global.targetDir
+	verify := c.flagVerify
+
+	defer func() {
+		c.global.flagCacheDir = cacheDir
+		c.global.targetDir = targetDir
+		c.global.outputSubdir = ""
+		c.flagVM = false
+		c.flagVerify = verify
+	}()
+
+	for _, imageType := range []shared.DefinitionFilterType{shared.DefinitionFilterTypeContainer, shared.DefinitionFilterTypeVM} {
+		// Each image has its own cache directory, so neither the LXD metadata
+		// nor the overlay of the first image end up in the second one.
+		c.global.flagCacheDir = filepath.Join(cacheDir, string(imageType))
+
+		if c.global.flagOutputLayout == "tree" {
+			c.global.outputSubdir = string(imageType)
+		} else {
+			c.global.targetDir = filepath.Join(targetDir, string(imageType))
+		}
+
+		for _, dir := range []string{c.global.flagCacheDir, c.global.targetDir} {
+			err := os.MkdirAll(dir, 0755)
+			if err != nil {
+				return fmt.Errorf("Failed to create directory %q: %w", dir, err)
+			}
+		}
+
+		c.flagVM = imageType == shared.DefinitionFilterTypeVM
+		c.flagVerify = verify && !c.flagVM
+		c.global.definition.Targets.Type = imageType
+
+		c.global.logger.WithField("type", imageType).Info("Creating hybrid image")
+
+		err := c.runHybridImage(cmd, args)
+		if err != nil {
+			return fmt.Errorf("Failed to create %s image: %w", imageType, err)
+		}
+	}
+
+	return nil
+}
+
+// runHybridImage creates one of the images of runHybrid from an overlay of
+// the rootfs.
+func (c *cmdLXD) runHybridImage(cmd *cobra.Command, args []string) error {
+	overlayDir, cleanup, err := c.global.getOverlayDir()
+	if err != nil {
+		return fmt.Errorf("Failed to get overlay directory: %w", err)
+	}
+
+	if cleanup != nil {
+		c.global.overlayCleanup = cleanup
+
+		defer func() {
+			cleanup()
+			c.global.overlayCleanup = nil
+		}()
+	}
+
+	err = c.runPack(cmd, args, overlayDir)
+	if err != nil {
+		return fmt.Errorf("Failed to pack image: %w", err)
+	}
+
+	return c.run(cmd, args, overlayDir)
+}
+
 func (c *cmdLXD) runPack(cmd *cobra.Command, args []string, overlayDir string) error {
 	// Setup the mounts and chroot into the rootfs
 	exitChroot, err := shared.SetupChroot(overlayDir, *c.global.definition, nil)
@@ -211,49 +334,42 @@ func (c *cmdLXD) runPack(cmd *cobra.Command, args []string, overlayDir string) e
 
 	// Run post unpack hook
 	for _, hook := range c.global.definition.GetRunnableActions("post-unpack", imageTargets) {
+		c.global.logger.WithField("action", hook.ID()).Info("Running action")
+
 		if hook.Pongo {
 			hook.Action, err = shared.RenderTemplate(hook.Action, c.global.definition)
 			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
+				return fmt.Errorf("Failed to render action %q: %w", hook.ID(), err)
 			}
 		}
 
-		err := shared.RunScript(c.global.ctx, hook.Action)
+		err := shared.RunAction(c.global.ctx, c.global.logger, hook)
 		if err != nil {
-			return fmt.Errorf("Failed to run post-unpack: %w", err)
+			return fmt.Errorf("Failed to run post-unpack action %q: %w", hook.ID(), err)
 		}
 	}
 
-	c.global.logger.Info("Managing packages")
+	return c.global.managePackages(manager, imageTargets)
+}
 
-	// Install/remove/update packages
-	err = manager.ManagePackages(imageTargets)
-	if err != nil {
-		return fmt.Errorf("Failed to manage packages: %w", err)
+func (c *cmdLXD) run(cmd *cobra.Command, args []string, overlayDir string) error {
+	// The encrypted artifacts can't be imported.
+	if c.global.definition.Targets.Encrypt != nil && cmd.Flags().Changed("import-into-lxd") {
+		return errors.New("--import-into-lxd cannot be used with targets.encrypt")
 	}
 
-	c.global.logger.WithField("trigger", "post-packages").Info("Running hooks")
-
-	// Run post packages hook
-	for _, hook := range c.global.definition.GetRunnableActions("post-packages", imageTargets) {
-		if hook.Pongo {
-			hook.Action, err = shared.RenderTemplate(hook.Action, c.global.definition)
-			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
-			}
-		}
-
-		err := shared.RunScript(c.global.ctx, hook.Action)
-		if err != nil {
-			return fmt.Errorf("Failed to run post-packages: %w", err)
-		}
+	// Create the artifacts in a staging directory, so they don't replace the
+	// ones in the target directory until the build succeeded.
+	staging, err := c.global.newArtifactStaging()
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	defer func() {
+		_ = staging.remove()
+	}()
 
-func (c *cmdLXD) run(cmd *cobra.Command, args []string, overlayDir string) error {
-	img := image.NewLXDImage(c.global.ctx, overlayDir, c.global.targetDir,
+	img := image.NewLXDImage(c.global.ctx, overlayDir, staging.dir,
 		c.global.flagCacheDir, *c.global.definition)
 
 	imageTargets := shared.ImageTargetUndefined | shared.ImageTargetAll
@@ -271,17 +387,22 @@ func (c *cmdLXD) run(cmd *cobra.Command, args []string, overlayDir string) error
 
 		generator, err := generators.Load(file.Generator, c.global.logger, c.global.flagCacheDir, overlayDir, file, *c.global.definition)
 		if err != nil {
-			return fmt.Errorf("Failed to load generator %q: %w", file.Generator, err)
+			return fmt.Errorf("Failed to load generator %q of %s: %w", file.Generator, file.ID(), err)
 		}
 
-		c.global.logger.WithField("generator", file.Generator).Info("Running generator")
+		c.global.logger.WithFields(logrus.Fields{"file": file.ID(), "generator": file.Generator}).Info("Running generator")
 
 		err = generator.RunLXD(img, c.global.definition.Targets.LXD)
 		if err != nil {
-			return fmt.Errorf("Failed to create LXD data: %w", err)
+			return fmt.Errorf("Failed to create LXD data of %s: %w", file.ID(), err)
 		}
 	}
 
+	err = c.global.mergeRootfsOverlays("post-files", imageTargets, overlayDir)
+	if err != nil {
+		return err
+	}
+
 	rootfsDir := overlayDir
 	var mounts []shared.ChrootMount
 	var vmDir string
@@ -302,7 +423,9 @@ func (c *cmdLXD) run(cmd *cobra.Command, args []string, overlayDir string) error
 
 		imgFile := filepath.Join(c.global.flagCacheDir, imgFilename)
 
-		vm, err = newVM(c.global.ctx, imgFile, vmDir, c.global.definition.Targets.LXD.VM.Filesystem, c.global.definition.Targets.LXD.VM.Size)
+		c.global.preferUserspaceBackend()
+
+		vm, err = newVM(c.global.ctx, imgFile, vmDir, overlayDir, c.global.definition.Image.ArchitectureKernel, c.global.definition.Targets.LXD.VM)
 		if err != nil {
 			return fmt.Errorf("Failed to instantiate VM: %w", err)
 		}
@@ -317,72 +440,173 @@ func (c *cmdLXD) run(cmd *cobra.Command, args []string, overlayDir string) error
 			return fmt.Errorf("Failed to create partitions: %w", err)
 		}
 
-		err = vm.mountImage()
+		if vm.userspace {
+			// The file systems are created from the directory at the end of
+			// the build, see writeFilesystems.
+			err = os.MkdirAll(filepath.Join(vmDir, "boot", "efi"), 0755)
+			if err != nil {
+				return fmt.Errorf("Failed to create directory %q: %w", filepath.Join(vmDir, "boot", "efi"), err)
+			}
+		} else {
+			err = vm.mountImage()
+			if err != nil {
+				return fmt.Errorf("Failed to mount image: %w", err)
+			}
+
+			defer func() {
+				_ = vm.umountImage()
+			}()
+
+			err = vm.createSwap()
+			if err != nil {
+				return fmt.Errorf("Failed to create swap partition: %w", err)
+			}
+
+			err = vm.encryptRootPartition()
+			if err != nil {
+				return fmt.Errorf("Failed to encrypt root partition: %w", err)
+			}
+
+			err = vm.createLVM()
+			if err != nil {
+				return fmt.Errorf("Failed to create LVM layout: %w", err)
+			}
+
+			err = vm.createRootFS()
+			if err != nil {
+				return fmt.Errorf("Failed to create root filesystem: %w", err)
+			}
+
+			err = vm.mountRootPartition()
+			if err != nil {
+				return fmt.Errorf("failed to mount root partion: %w", err)
+			}
+
+			defer func() {
+				_ = shared.RunCommand(vm.ctx, nil, nil, "umount", "-R", vmDir)
+			}()
+
+			err = vm.createUEFIFS()
+			if err != nil {
+				return fmt.Errorf("Failed to create UEFI filesystem: %w", err)
+			}
+
+			err = vm.mountUEFIPartition()
+			if err != nil {
+				return fmt.Errorf("Failed to mount UEFI partition: %w", err)
+			}
+		}
+
+		// The rootfs is merged into the mounted image, which already contains
+		// the boot/efi directory. File contents are reflinked or copied by the
+		// kernel where the file systems support it, and holes are kept.
+		err = shared.CopyTree(c.global.ctx, overlayDir+"/", vmDir, c.global.progressReporter("rootfs-copy", "Copying rootfs"))
 		if err != nil {
-			return fmt.Errorf("Failed to mount image: %w", err)
+			return fmt.Errorf("Failed to copy rootfs: %w", err)
 		}
 
-		defer func() {
-			_ = vm.umountImage()
-		}()
+		err = vm.configureSwap()
+		if err != nil {
+			return fmt.Errorf("Failed to configure swap: %w", err)
+		}
 
-		err = vm.createRootFS()
+		err = vm.configureDisks()
 		if err != nil {
-			return fmt.Errorf("Failed to create root filesystem: %w", err)
+			return fmt.Errorf("Failed to configure disks: %w", err)
 		}
 
-		err = vm.mountRootPartition()
+		err = img.EmbedSeed(vmDir)
 		if err != nil {
-			return fmt.Errorf("failed to mount root partion: %w", err)
+			return fmt.Errorf("Failed to embed NoCloud seed: %w", err)
 		}
 
-		defer func() {
-			_ = shared.RunCommand(vm.ctx, nil, nil, "umount", "-R", vmDir)
-		}()
+		err = vm.configureEncryption()
+		if err != nil {
+			return fmt.Errorf("Failed to configure encryption: %w", err)
+		}
 
-		err = vm.createUEFIFS()
+		err = vm.configureLVM()
 		if err != nil {
-			return fmt.Errorf("Failed to create UEFI filesystem: %w", err)
+			return fmt.Errorf("Failed to configure LVM: %w", err)
 		}
 
-		err = vm.mountUEFIPartition()
+		err = vm.configureZFS(c.global.definition.Targets.LXD.VM.GetZFSRootDataset())
 		if err != nil {
-			return fmt.Errorf("Failed to mount UEFI partition: %w", err)
+			return fmt.Errorf("Failed to configure ZFS: %w", err)
 		}
 
-		// We cannot use LXD's rsync package as that uses the --delete flag which
-		// causes an issue due to the boot/efi directory being present.
-		err = shared.RsyncLocal(c.global.ctx, overlayDir+"/", vmDir)
+		err = vm.configureGrowRoot()
 		if err != nil {
-			return fmt.Errorf("Failed to copy rootfs: %w", err)
+			return fmt.Errorf("Failed to configure growing the root partition: %w", err)
+		}
+
+		err = vm.configureUKI(c.global.definition.Targets.LXD.VM.GetZFSRootDataset())
+		if err != nil {
+			return fmt.Errorf("Failed to configure unified kernel image: %w", err)
+		}
+
+		err = vm.configureKernelCmdline(c.global.definition.Targets.LXD.VM.GetZFSRootDataset())
+		if err != nil {
+			return fmt.Errorf("Failed to configure kernel command line: %w", err)
 		}
 
 		rootfsDir = vmDir
 
-		mounts = []shared.ChrootMount{
-			{
-				Source: vm.getLoopDev(),
-				Target: filepath.Join("/", "dev", filepath.Base(vm.getLoopDev())),
-				Flags:  unix.MS_BIND,
-			},
-			{
-				Source: vm.getRootfsDevFile(),
-				Target: filepath.Join("/", "dev", filepath.Base(vm.getRootfsDevFile())),
-				Flags:  unix.MS_BIND,
-			},
-			{
-				Source: vm.getUEFIDevFile(),
-				Target: filepath.Join("/", "dev", filepath.Base(vm.getUEFIDevFile())),
-				Flags:  unix.MS_BIND,
-			},
-			{
+		// The userspace backend has neither devices nor mounts.
+		if !vm.userspace {
+			mounts = []shared.ChrootMount{
+				{
+					Source: vm.getLoopDev(),
+					Target: filepath.Join("/", "dev", filepath.Base(vm.getLoopDev())),
+					Flags:  unix.MS_BIND,
+				},
+				{
+					Source: vm.getRootfsDevFile(),
+					Target: filepath.Join("/", "dev", filepath.Base(vm.getRootfsDevFile())),
+					Flags:  unix.MS_BIND,
+				},
+				{
+					Source: vm.getUEFIDevFile(),
+					Target: filepath.Join("/", "dev", filepath.Base(vm.getUEFIDevFile())),
+					Flags:  unix.MS_BIND,
+				},
+			}
+
+			// Subvolumes and datasets need to be mounted before the EFI system
+			// partition, as they may contain /boot.
+			mounts = append(mounts, vm.getBtrfsMounts()...)
+			mounts = append(mounts, vm.getZFSMounts()...)
+
+			mounts = append(mounts, shared.ChrootMount{
 				Source: vm.getUEFIDevFile(),
 				Target: "/boot/efi",
 				FSType: "vfat",
 				Flags:  0,
 				Data:   "",
 				IsDir:  true,
-			},
+			})
+
+			extraDevs := vm.getLVDevFiles()
+
+			if vm.getPVDevFile() != vm.getRootfsDevFile() {
+				extraDevs = append(extraDevs, vm.getPVDevFile())
+			}
+
+			if vm.getSwapDevFile() != "" {
+				extraDevs = append(extraDevs, vm.getSwapDevFile())
+			}
+
+			if vm.getPRePDevFile() != "" {
+				extraDevs = append(extraDevs, vm.getPRePDevFile())
+			}
+
+			for _, dev := range extraDevs {
+				mounts = append(mounts, shared.ChrootMount{
+					Source: dev,
+					Target: dev,
+					Flags:  unix.MS_BIND,
+				})
+			}
 		}
 	}
 
@@ -397,18 +621,34 @@ func (c *cmdLXD) run(cmd *cobra.Command, args []string, overlayDir string) error
 		return fmt.Errorf("Failed adding systemd generator: %w", err)
 	}
 
+	if c.flagVM {
+		err := vm.installBootloader(c.global.definition.Image.ArchitectureKernel)
+		if err != nil {
+			{
+				err := exitChroot()
+				if err != nil {
+					c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+				}
+			}
+
+			return fmt.Errorf("Failed to install boot loader: %w", err)
+		}
+	}
+
 	c.global.logger.WithField("trigger", "post-files").Info("Running hooks")
 
 	// Run post files hook
 	for _, action := range c.global.definition.GetRunnableActions("post-files", imageTargets) {
+		c.global.logger.WithField("action", action.ID()).Info("Running action")
+
 		if action.Pongo {
 			action.Action, err = shared.RenderTemplate(action.Action, c.global.definition)
 			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
+				return fmt.Errorf("Failed to render action %q: %w", action.ID(), err)
 			}
 		}
 
-		err := shared.RunScript(c.global.ctx, action.Action)
+		err := shared.RunAction(c.global.ctx, c.global.logger, action)
 		if err != nil {
 			{
 				err := exitChroot()
@@ -417,127 +657,272 @@ func (c *cmdLXD) run(cmd *cobra.Command, args []string, overlayDir string) error
 				}
 			}
 
-			return fmt.Errorf("Failed to run post-files: %w", err)
+			return fmt.Errorf("Failed to run post-files action %q: %w", action.ID(), err)
 		}
 	}
 
-	err = exitChroot()
+	err = c.global.verifyPackageState("post-files")
 	if err != nil {
-		return fmt.Errorf("Failed exiting chroot: %w", err)
+		{
+			err := exitChroot()
+			if err != nil {
+				c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+			}
+		}
+
+		return err
 	}
 
-	// Unmount VM directory and loop device before creating the image.
 	if c.flagVM {
-		err := shared.RunCommand(vm.ctx, nil, nil, "umount", "-R", vmDir)
+		err := vm.installUKI()
 		if err != nil {
-			return fmt.Errorf("Failed to unmount %q: %w", vmDir, err)
-		}
+			{
+				err := exitChroot()
+				if err != nil {
+					c.global.logger.WithField("err", err).Warn("Failed exiting chroot")
+				}
+			}
 
-		err = vm.umountImage()
-		if err != nil {
-			return fmt.Errorf("Failed to unmount image: %w", err)
+			return fmt.Errorf("Failed to install unified kernel image: %w", err)
 		}
 	}
 
-	c.global.logger.WithFields(logrus.Fields{"type": c.flagType, "vm": c.flagVM, "compression": c.flagCompression}).Info("Creating LXD image")
-
-	imageFile, rootfsFile, err := img.Build(c.flagType == "unified", c.flagCompression, c.flagVM)
+	err = exitChroot()
 	if err != nil {
-		return fmt.Errorf("Failed to create LXD image: %w", err)
+		return fmt.Errorf("Failed exiting chroot: %w", err)
 	}
 
-	importFlag := cmd.Flags().Lookup("import-into-lxd")
-
-	if importFlag.Changed {
-		path := ""
-
-		server, err := client.ConnectLXDUnix(path, nil)
+	// Unmount VM directory and loop device before creating the image.
+	if c.flagVM {
+		err := vm.extractBootArtifacts(staging.dir, c.global.definition.Targets.LXD.VM.GetZFSRootDataset())
 		if err != nil {
-			return fmt.Errorf("Failed to connect to LXD: %w", err)
+			return fmt.Errorf("Failed to extract boot artifacts: %w", err)
 		}
 
-		image := api.ImagesPost{
-			Filename: imageFile,
+		err = vm.installUBoot()
+		if err != nil {
+			return fmt.Errorf("Failed to install u-boot: %w", err)
 		}
 
-		imageType := "container"
-
-		var meta io.ReadCloser
-		var rootfs io.ReadCloser
+		err = vm.checkBootable(c.global.definition.Image.ArchitectureKernel)
+		if err != nil {
+			return fmt.Errorf("Failed to check VM image: %w", err)
+		}
 
-		// Open meta
-		meta, err = os.Open(imageFile)
+		err = vm.trimFilesystems(vmDir)
 		if err != nil {
-			return err
+			c.global.logger.WithField("err", err).Warn("Failed to trim filesystems")
 		}
 
-		defer meta.Close()
+		if vm.userspace {
+			err = vm.writeFilesystems()
+			if err != nil {
+				return fmt.Errorf("Failed to write filesystems: %w", err)
+			}
+		} else {
+			err = shared.RunCommand(vm.ctx, nil, nil, "umount", "-R", vmDir)
+			if err != nil {
+				return fmt.Errorf("Failed to unmount %q: %w", vmDir, err)
+			}
 
-		// Open rootfs
-		if rootfsFile != "" {
-			rootfs, err = os.Open(rootfsFile)
+			err = vm.compactRootFS()
 			if err != nil {
-				return err
+				return fmt.Errorf("Failed to compact root filesystem: %w", err)
+			}
+
+			err = vm.formatVerity()
+			if err != nil {
+				return fmt.Errorf("Failed to format dm-verity hash partition: %w", err)
+			}
+
+			err = vm.embedRootHash(staging.dir)
+			if err != nil {
+				return fmt.Errorf("Failed to embed dm-verity root hash: %w", err)
 			}
 
-			defer rootfs.Close()
+			err = vm.checkFilesystems()
+			if err != nil {
+				return fmt.Errorf("Failed to check VM image: %w", err)
+			}
 
-			if filepath.Ext(rootfsFile) == ".qcow2" {
-				imageType = "virtual-machine"
+			err = vm.umountImage()
+			if err != nil {
+				return fmt.Errorf("Failed to unmount image: %w", err)
 			}
 		}
 
-		createArgs := &client.ImageCreateArgs{
-			MetaFile:   meta,
-			MetaName:   filepath.Base(imageFile),
-			RootfsFile: rootfs,
-			RootfsName: filepath.Base(rootfsFile),
-			Type:       imageType,
+		err = vm.truncateImage()
+		if err != nil {
+			return fmt.Errorf("Failed to truncate image: %w", err)
 		}
 
-		op, err := server.CreateImage(image, createArgs)
+		err = vm.extractRootImage(staging.dir)
 		if err != nil {
-			return fmt.Errorf("Failed to create image: %w", err)
+			return fmt.Errorf("Failed to extract root image: %w", err)
 		}
 
-		err = op.Wait()
+		if c.global.definition.Targets.LXD.VM.BootTest != nil {
+			err = runBootTest(c.global.ctx, c.global.logger, vm.imageFile, c.global.flagCacheDir, c.global.definition.Image.ArchitectureKernel, c.global.definition.Targets.LXD.VM)
+			if err != nil {
+				return fmt.Errorf("Failed to boot VM image: %w", err)
+			}
+		}
+	}
+
+	c.global.logger.WithFields(logrus.Fields{"type": c.flagType, "vm": c.flagVM, "compression": c.flagCompression}).Info("Creating LXD image")
+
+	imageFile, rootfsFile, err := img.Build(c.flagType == "unified", c.flagCompression, c.flagVM)
+	if err != nil {
+		return fmt.Errorf("Failed to create LXD image: %w", err)
+	}
+
+	if c.flagVM && c.global.definition.Targets.LXD.VM.Seed != nil {
+		c.global.logger.Info("Creating NoCloud seed")
+
+		_, err = img.BuildSeed()
 		if err != nil {
-			return fmt.Errorf("Failed to create image: %w", err)
+			return fmt.Errorf("Failed to create NoCloud seed: %w", err)
 		}
+	}
+
+	if c.flagVM && len(c.global.definition.Targets.LXD.VM.Disks) > 0 {
+		c.global.logger.Info("Creating additional disks")
 
-		// Don't create alias if the flag value is equal to the NoOptDefVal (the default value if --import-into-lxd flag is set without any value).
-		if importFlag.Value.String() == importFlag.NoOptDefVal {
-			return nil
+		_, err = img.BuildDisks()
+		if err != nil {
+			return fmt.Errorf("Failed to create additional disks: %w", err)
 		}
+	}
 
-		opAPI := op.Get()
+	if c.flagVerify {
+		err := verifyLXDImage(c.global.ctx, c.global.logger, imageFile, rootfsFile)
+		if err != nil {
+			return fmt.Errorf("Failed to verify image: %w", err)
+		}
+	}
+
+	err = staging.publish()
+	if err != nil {
+		return err
+	}
+
+	imageFile = staging.path(imageFile)
+	rootfsFile = staging.path(rootfsFile)
+
+	imageType := "container"
+
+	if filepath.Ext(rootfsFile) == ".qcow2" {
+		imageType = "virtual-machine"
+	}
 
-		alias := api.ImageAliasesPost{}
-		alias.Target = opAPI.Metadata["fingerprint"].(string)
+	// The instance of --launch is created on the server the image was
+	// published to, or imported into.
+	var server client.InstanceServer
+	var fingerprint string
 
-		alias.Name, err = shared.RenderTemplate(importFlag.Value.String(), c.global.definition)
+	if c.global.definition.Targets.LXD.Publish != nil {
+		server, fingerprint, err = publishLXDImage(c.global.logger, *c.global.definition, imageFile, rootfsFile, imageType)
 		if err != nil {
-			return fmt.Errorf("Failed to render %q: %w", importFlag.Value.String(), err)
+			return fmt.Errorf("Failed to publish image: %w", err)
 		}
+	}
+
+	importFlag := cmd.Flags().Lookup("import-into-lxd")
 
-		alias.Description, err = shared.RenderTemplate(c.global.definition.Image.Description, c.global.definition)
+	if importFlag.Changed || (c.flagLaunch != "" && server == nil) {
+		localServer, localFingerprint, err := c.importIntoLXD(importFlag, imageFile, rootfsFile, imageType)
 		if err != nil {
-			return fmt.Errorf("Failed to render %q: %w", c.global.definition.Image.Description, err)
+			return err
 		}
 
-		err = server.CreateImageAlias(alias)
+		if server == nil {
+			server = localServer
+			fingerprint = localFingerprint
+		}
+	}
+
+	if c.flagLaunch != "" {
+		err = launchInstance(c.global.ctx, c.global.logger, server, fingerprint, c.flagLaunch, c.flagProfiles, imageType, c.flagWaitCloudInit)
 		if err != nil {
-			return fmt.Errorf("Failed to create image alias: %w", err)
+			return fmt.Errorf("Failed to launch instance: %w", err)
 		}
 	}
 
 	return nil
 }
 
-func (c *cmdLXD) checkVMDependencies() error {
-	dependencies := []string{"btrfs", "mkfs.ext4", "mkfs.vfat", "qemu-img", "rsync", "sgdisk"}
+// importIntoLXD imports the image into the local LXD, and creates the alias of
+// --import-into-lxd if one is set. It returns the server and the fingerprint
+// of the image.
+func (c *cmdLXD) importIntoLXD(importFlag *pflag.Flag, imageFile string, rootfsFile string, imageType string) (client.InstanceServer, string, error) {
+	path := ""
 
-	for _, dep := range dependencies {
+	server, err := client.ConnectLXDUnix(path, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to connect to LXD: %w", err)
+	}
+
+	fingerprint, err := importLXDImage(server, imageFile, rootfsFile, imageType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Don't create alias if the flag value is equal to the NoOptDefVal (the default value if --import-into-lxd flag is set without any value).
+	if !importFlag.Changed || importFlag.Value.String() == importFlag.NoOptDefVal {
+		return server, fingerprint, nil
+	}
+
+	alias := api.ImageAliasesPost{}
+	alias.Target = fingerprint
+
+	alias.Name, err = shared.RenderTemplate(importFlag.Value.String(), c.global.definition)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to render %q: %w", importFlag.Value.String(), err)
+	}
+
+	alias.Description, err = shared.RenderTemplate(c.global.definition.Image.Description, c.global.definition)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to render %q: %w", c.global.definition.Image.Description, err)
+	}
+
+	err = server.CreateImageAlias(alias)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to create image alias: %w", err)
+	}
+
+	return server, fingerprint, nil
+}
+
+// addLaunchFlags adds the flags launching an instance from the image.
+func (c *cmdLXD) addLaunchFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&c.flagLaunch, "launch", "", "Launch an instance with the given name from the published or imported image"+"``")
+	cmd.Flags().StringArrayVar(&c.flagProfiles, "profile", nil, "Profile to apply to the instance of --launch"+"``")
+	cmd.Flags().BoolVar(&c.flagWaitCloudInit, "wait-cloud-init", false, "Wait for cloud-init to finish in the instance of --launch"+"``")
+}
+
+// checkLaunchFlags checks that the flags of the launched instance are only
+// used with --launch.
+func (c *cmdLXD) checkLaunchFlags() error {
+	if c.flagLaunch != "" {
+		return nil
+	}
+
+	if len(c.flagProfiles) > 0 {
+		return errors.New("--profile requires --launch")
+	}
+
+	if c.flagWaitCloudInit {
+		return errors.New("--wait-cloud-init requires --launch")
+	}
+
+	return nil
+}
+
+// vmDependencies are the tools required to build VM images.
+var vmDependencies = []string{"btrfs", "mkfs.ext4", "mkfs.vfat", "qemu-img", "rsync"}
+
+func (c *cmdLXD) checkVMDependencies() error {
+	for _, dep := range vmDependencies {
 		_, err := exec.LookPath(dep)
 		if err != nil {
 			return fmt.Errorf("Required tool %q is missing", dep)
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// pruneAgeRegex matches the --min-age of prune, which uses the format of
+// image.expiry.
+var pruneAgeRegex = regexp.MustCompile(`^(\d+(s|m|h|d|w))+$`)
+
+type cmdPrune struct {
+	cmdPrune *cobra.Command
+	global   *cmdGlobal
+
+	flagKeep   int
+	flagMinAge string
+	flagDryRun bool
+}
+
+// pruneSerial is a serial directory of an image in an output tree.
+type pruneSerial struct {
+	product string
+	serial  string
+	path    string
+}
+
+func (c *cmdPrune) command() *cobra.Command {
+	c.cmdPrune = &cobra.Command{
+		Use:   "prune <output-tree>",
+		Short: "Remove old serials from an output tree",
+		Long: `Remove old serials from an output tree
+
+Removes all but the newest serials of each image in an output tree created
+with --output-layout tree. Serials the latest symlink points to are always kept.
+
+If the output tree is a stream of a simplestreams image server, the removed
+serials are removed from its product catalog and index as well.
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if c.flagKeep < 1 {
+				return errors.New("--keep must be at least 1")
+			}
+
+			var minAge time.Duration
+
+			if c.flagMinAge != "" {
+				if !pruneAgeRegex.MatchString(c.flagMinAge) {
+					return fmt.Errorf("Invalid --min-age %q", c.flagMinAge)
+				}
+
+				minAge = shared.GetExpiryDate(time.Time{}, c.flagMinAge).Sub(time.Time{})
+			}
+
+			// Don't remove the serials of a build which is still running.
+			lock, err := lockDirectory(args[0])
+			if err != nil {
+				return err
+			}
+
+			defer lock.Close()
+
+			serials, err := findPruneSerials(args[0], c.flagKeep, minAge, time.Now())
+			if err != nil {
+				return err
+			}
+
+			return c.prune(args[0], serials)
+		},
+		SilenceUsage: true,
+	}
+
+	c.cmdPrune.Flags().IntVar(&c.flagKeep, "keep", 10, "Number of serials to keep per image"+"``")
+	c.cmdPrune.Flags().StringVar(&c.flagMinAge, "min-age", "", "Minimum age of the serials to remove, e.g. 30d"+"``")
+	c.cmdPrune.Flags().BoolVar(&c.flagDryRun, "dry-run", false, "Only log the serials which would be removed")
+
+	return c.cmdPrune
+}
+
+// prune removes the serials from the simplestreams index of the output tree,
+// if there is one, and from the output tree afterwards, so the index never
+// refers to missing serials.
+func (c *cmdPrune) prune(treeDir string, serials []pruneSerial) error {
+	for _, serial := range serials {
+		fields := logrus.Fields{"image": serial.product, "serial": serial.serial}
+
+		if c.flagDryRun {
+			c.global.logger.WithFields(fields).Info("Would remove serial")
+		} else {
+			c.global.logger.WithFields(fields).Info("Removing serial")
+		}
+	}
+
+	if c.flagDryRun || len(serials) == 0 {
+		return nil
+	}
+
+	err := pruneSimplestreams(treeDir, serials)
+	if err != nil {
+		return err
+	}
+
+	for _, serial := range serials {
+		err := os.RemoveAll(serial.path)
+		if err != nil {
+			return fmt.Errorf("Failed to remove %q: %w", serial.path, err)
+		}
+	}
+
+	return nil
+}
+
+// findPruneSerials returns the serials of the images in the output tree which
+// are to be removed. These are all but the newest keep serials of each image,
+// which are older than minAge. Hidden directories, like the staging
+// directories of running builds, and the target of the latest symlink are
+// skipped.
+func findPruneSerials(treeDir string, keep int, minAge time.Duration, now time.Time) ([]pruneSerial, error) {
+	// The images are in <distribution>/<release>/<architecture>/<variant>.
+	productDirs, err := filepath.Glob(filepath.Join(treeDir, "*", "*", "*", "*"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find images in %q: %w", treeDir, err)
+	}
+
+	var serials []pruneSerial
+
+	for _, productDir := range productDirs {
+		info, err := os.Lstat(productDir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to stat %q: %w", productDir, err)
+		}
+
+		if !info.IsDir() {
+			continue
+		}
+
+		product, err := filepath.Rel(treeDir, productDir)
+		if err != nil {
+			return nil, err
+		}
+
+		latest, _ := os.Readlink(filepath.Join(productDir, "latest"))
+
+		entries, err := os.ReadDir(productDir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read directory %q: %w", productDir, err)
+		}
+
+		var names []string
+
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			names = append(names, entry.Name())
+		}
+
+		// Newest serials first
+		slices.Sort(names)
+		slices.Reverse(names)
+
+		for i, name := range names {
+			if i < keep || name == filepath.Base(latest) {
+				continue
+			}
+
+			path := filepath.Join(productDir, name)
+
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to stat %q: %w", path, err)
+			}
+
+			if now.Sub(info.ModTime()) < minAge {
+				continue
+			}
+
+			serials = append(serials, pruneSerial{product: product, serial: name, path: path})
+		}
+	}
+
+	return serials, nil
+}
+
+// pruneSimplestreams removes the serials from the product catalog of the
+// stream the output tree is served as, and the products without serials from
+// the index. The stream of <dir>/images is described by
+// <dir>/streams/v1/images.json. Nothing is done if it doesn't exist.
+func pruneSimplestreams(treeDir string, serials []pruneSerial) error {
+	treeDir, err := filepath.Abs(treeDir)
+	if err != nil {
+		return fmt.Errorf("Failed to get absolute path of %q: %w", treeDir, err)
+	}
+
+	streamName := filepath.Base(treeDir)
+	metaDir := filepath.Join(filepath.Dir(treeDir), "streams", "v1")
+	catalogPath := filepath.Join(metaDir, streamName+".json")
+
+	if !lxdShared.PathExists(catalogPath) {
+		return nil
+	}
+
+	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	if err != nil {
+		return fmt.Errorf("Failed to read %q: %w", catalogPath, err)
+	}
+
+	for _, serial := range serials {
+		id := strings.ReplaceAll(serial.product, string(os.PathSeparator), ":")
+
+		product, ok := catalog.Products[id]
+		if !ok {
+			continue
+		}
+
+		delete(product.Versions, serial.serial)
+
+		if len(product.Versions) == 0 {
+			delete(catalog.Products, id)
+		}
+	}
+
+	err = writeSimplestreamsFile(catalogPath, catalog)
+	if err != nil {
+		return err
+	}
+
+	indexPath := filepath.Join(metaDir, "index.json")
+
+	if !lxdShared.PathExists(indexPath) {
+		return nil
+	}
+
+	index, err := shared.ReadJSONFile(indexPath, &stream.StreamIndex{})
+	if err != nil {
+		return fmt.Errorf("Failed to read %q: %w", indexPath, err)
+	}
+
+	entry, ok := index.Index[streamName]
+	if !ok {
+		return nil
+	}
+
+	index.AddEntry(streamName, entry.Path, *catalog)
+
+	return writeSimplestreamsFile(indexPath, index)
+}
+
+// writeSimplestreamsFile atomically replaces the JSON file of a simplestreams
+// index, and its compressed version if there is one.
+func writeSimplestreamsFile(path string, obj any) error {
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	err := shared.WriteJSONFile(tmpPath, obj)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", tmpPath, err)
+	}
+
+	defer os.Remove(tmpPath)
+
+	err = os.Chmod(tmpPath, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to set permissions of %q: %w", tmpPath, err)
+	}
+
+	if lxdShared.PathExists(path + ".gz") {
+		err := shared.GZipFile(tmpPath, tmpPath+".gz")
+		if err != nil {
+			return fmt.Errorf("Failed to compress %q: %w", tmpPath, err)
+		}
+
+		defer os.Remove(tmpPath + ".gz")
+
+		err = os.Rename(tmpPath+".gz", path+".gz")
+		if err != nil {
+			return fmt.Errorf("Failed to replace %q: %w", path+".gz", err)
+		}
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("Failed to replace %q: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// createPruneTree creates an output tree with the given serials of the image,
+// which are as many days old as their index.
+func createPruneTree(t *testing.T, treeDir string, product string, serials []string, now time.Time) {
+	t.Helper()
+
+	for i, serial := range serials {
+		dir := filepath.Join(treeDir, product, serial)
+
+		err := os.MkdirAll(dir, 0755)
+		require.NoError(t, err)
+
+		err = os.WriteFile(filepath.Join(dir, "lxd.tar.xz"), []byte(serial), 0644)
+		require.NoError(t, err)
+
+		mtime := now.Add(-time.Duration(i) * 24 * time.Hour)
+
+		err = os.Chtimes(dir, mtime, mtime)
+		require.NoError(t, err)
+	}
+}
+
+func Test_findPruneSerials(t *testing.T) {
+	treeDir := t.TempDir()
+	now := time.Now()
+
+	createPruneTree(t, treeDir, "ubuntu/noble/amd64/default", []string{"20240305_0000", "20240304_0000", "20240303_0000", "20240302_0000", "20240301_0000"}, now)
+	createPruneTree(t, treeDir, "alpine/3.19/arm64/cloud", []string{"20240305_0000"}, now)
+
+	// Staging directories of running builds are skipped.
+	err := os.Mkdir(filepath.Join(treeDir, "ubuntu/noble/amd64/default/.lxd-imagebuilder.1234"), 0755)
+	require.NoError(t, err)
+
+	// The target of the latest symlink is kept.
+	err = os.Symlink("20240302_0000", filepath.Join(treeDir, "ubuntu/noble/amd64/default/latest"))
+	require.NoError(t, err)
+
+	names := func(serials []pruneSerial) []string {
+		var names []string
+
+		for _, serial := range serials {
+			require.Equal(t, "ubuntu/noble/amd64/default", serial.product)
+			require.Equal(t, filepath.Join(treeDir, serial.product, serial.serial), serial.path)
+
+			names = append(names, serial.serial)
+		}
+
+		return names
+	}
+
+	serials, err := findPruneSerials(treeDir, 2, 0, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"20240303_0000", "20240301_0000"}, names(serials))
+
+	serials, err = findPruneSerials(treeDir, 2, 84*time.Hour, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"20240301_0000"}, names(serials))
+
+	serials, err = findPruneSerials(treeDir, 5, 0, now)
+	require.NoError(t, err)
+	require.Empty(t, serials)
+}
+
+func Test_pruneSimplestreams(t *testing.T) {
+	rootDir := t.TempDir()
+	treeDir := filepath.Join(rootDir, "images")
+	metaDir := filepath.Join(rootDir, "streams", "v1")
+
+	err := os.MkdirAll(metaDir, 0755)
+	require.NoError(t, err)
+
+	catalog := stream.NewCatalog("images", map[string]stream.Product{
+		"ubuntu:noble:amd64:default": {
+			Versions: map[string]stream.Version{"20240301_0000": {}, "20240302_0000": {}},
+		},
+		"alpine:3.19:arm64:cloud": {
+			Versions: map[string]stream.Version{"20240301_0000": {}},
+		},
+	})
+
+	catalogPath := filepath.Join(metaDir, "images.json")
+
+	err = shared.WriteJSONFile(catalogPath, catalog)
+	require.NoError(t, err)
+
+	err = shared.GZipFile(catalogPath, "")
+	require.NoError(t, err)
+
+	index := stream.NewStreamIndex()
+	index.AddEntry("images", "streams/v1/images.json", *catalog)
+
+	err = shared.WriteJSONFile(filepath.Join(metaDir, "index.json"), index)
+	require.NoError(t, err)
+
+	err = pruneSimplestreams(treeDir, []pruneSerial{
+		{product: "ubuntu/noble/amd64/default", serial: "20240301_0000"},
+		{product: "alpine/3.19/arm64/cloud", serial: "20240301_0000"},
+	})
+	require.NoError(t, err)
+
+	catalog, err = shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"ubuntu:noble:amd64:default"}, shared.MapKeys(catalog.Products))
+	require.Equal(t, []string{"20240302_0000"}, shared.MapKeys(catalog.Products["ubuntu:noble:amd64:default"].Versions))
+
+	newIndex, err := shared.ReadJSONFile(filepath.Join(metaDir, "index.json"), &stream.StreamIndex{})
+	require.NoError(t, err)
+	require.Equal(t, "streams/v1/images.json", newIndex.Index["images"].Path)
+	require.Equal(t, []string{"ubuntu:noble:amd64:default"}, newIndex.Index["images"].Products)
+
+	info, err := os.Stat(catalogPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	entries, err := os.ReadDir(metaDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	// Output trees which aren't served as a stream are left alone.
+	err = pruneSimplestreams(filepath.Join(rootDir, "other"), []pruneSerial{{product: "ubuntu/noble/amd64/default", serial: "20240302_0000"}})
+	require.NoError(t, err)
+}
@@ -18,7 +18,7 @@ func (c *cmdValidate) command() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			// Get the image definition
-			_, err := getDefinition(args[0], c.global.flagOptions)
+			_, err := getDefinition(args[0], c.global.flagFlavor, c.global.flagOptions)
 			if err != nil {
 				return fmt.Errorf("Failed to get definition: %w", err)
 			}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// detectLXDContainer checks whether lxd-imagebuilder runs inside of an LXD
+// container, and logs what the container allows.
+func (c *cmdGlobal) detectLXDContainer() {
+	c.lxdContainer = shared.DetectLXDContainer(c.flagCacheDir)
+	if c.lxdContainer == nil {
+		return
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"privileged": c.lxdContainer.Privileged,
+		"mknod":      c.lxdContainer.Mknod,
+		"loop":       c.lxdContainer.Loop,
+	}).Info("Running inside of an LXD container")
+}
+
+// preferUserspaceBackend switches VM images to the userspace backend if
+// loop devices aren't available inside of the LXD container, unless a
+// backend is set or the definition can't be built with it.
+func (c *cmdGlobal) preferUserspaceBackend() {
+	if c.lxdContainer == nil || c.lxdContainer.Loop || c.definition.Targets.LXD.VM.Backend != "" {
+		return
+	}
+
+	def := *c.definition
+	def.Targets.LXD.VM.Backend = "userspace"
+
+	err := def.Validate()
+	if err == nil {
+		_, err = exec.LookPath("mcopy")
+	}
+
+	if err != nil {
+		c.logger.WithField("err", err).Warn("Loop devices aren't available, and the userspace backend can't be used")
+		return
+	}
+
+	c.logger.Info("Using the userspace backend, as loop devices aren't available")
+
+	c.definition.Targets.LXD.VM.Backend = "userspace"
+}
+
+// checkLXDContainer returns what the LXD container lxd-imagebuilder runs in
+// doesn't allow.
+func checkLXDContainer(cacheDir string) error {
+	container := shared.DetectLXDContainer(cacheDir)
+	if container == nil {
+		return nil
+	}
+
+	var missing []string
+
+	if !container.Loop {
+		missing = append(missing, "loop devices aren't available, so VM images use the userspace backend (security.privileged=true)")
+	}
+
+	if !container.Mknod {
+		missing = append(missing, "device nodes can't be created, so the ones of the host are used (security.syscalls.intercept.mknod=true)")
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return errors.New(strings.Join(missing, ", "))
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// packageStateChecks check the package database of the rootfs, by package
+// manager. They run inside of the chroot and return the offending items.
+var packageStateChecks = map[string]func(ctx context.Context) ([]string, error){
+	"apk":    checkAPKState,
+	"apt":    checkDpkgState,
+	"dnf":    checkRPMState,
+	"pacman": checkPacmanState,
+	"xbps":   checkXBPSState,
+	"yum":    checkRPMState,
+	"zypper": checkRPMState,
+}
+
+// dpkgDiversionRegex matches a line of "dpkg-divert --list".
+var dpkgDiversionRegex = regexp.MustCompile(`^(?:local )?diversion of (.+) to (.+?)(?: by (.+))?$`)
+
+// rpmInstallOnlyPrefixes are the packages of which several versions may be
+// installed at the same time.
+var rpmInstallOnlyPrefixes = []string{"gpg-pubkey", "kernel"}
+
+// verifyPackageState checks that the package database of the rootfs is
+// consistent after the actions of the trigger, and fails listing the
+// offending items if it isn't. It's run inside of the chroot.
+func (c *cmdGlobal) verifyPackageState(trigger string) error {
+	if c.definition.Packages.SkipVerification {
+		return nil
+	}
+
+	check, ok := packageStateChecks[c.definition.Packages.Manager]
+	if !ok {
+		return nil
+	}
+
+	c.logger.WithField("trigger", trigger).Info("Verifying package database")
+
+	items, err := check(c.ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to verify package database: %w", err)
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("Package database is inconsistent after the %s actions:\n  - %s", trigger, strings.Join(items, "\n  - "))
+}
+
+// checkDpkgState returns the packages which aren't fully installed or need to
+// be reinstalled, and the diversions of packages which aren't installed.
+func checkDpkgState(ctx context.Context) ([]string, error) {
+	var status strings.Builder
+
+	err := shared.RunCommand(ctx, nil, &status, "dpkg-query", "-W", "-f", "${Package}\t${db:Status-Abbrev}\n")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list packages: %w", err)
+	}
+
+	var diversions strings.Builder
+
+	err = shared.RunCommand(ctx, nil, &diversions, "dpkg-divert", "--list")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list diversions: %w", err)
+	}
+
+	return parseDpkgState(status.String(), diversions.String()), nil
+}
+
+// parseDpkgState parses the status of the packages, as listed by dpkg-query,
+// and the diversions, as listed by dpkg-divert.
+func parseDpkgState(status string, diversions string) []string {
+	var items []string
+
+	installed := map[string]bool{}
+
+	for _, line := range strings.Split(status, "\n") {
+		name, abbrev, found := strings.Cut(line, "\t")
+		if !found || len(abbrev) < 2 {
+			continue
+		}
+
+		// The abbreviation holds the desired action, the status, and whether
+		// the package needs to be reinstalled.
+		state := abbrev[1]
+
+		switch {
+		case len(abbrev) > 2 && abbrev[2] == 'R':
+			items = append(items, fmt.Sprintf("Package %q needs to be reinstalled", name))
+		case state == 'H':
+			items = append(items, fmt.Sprintf("Package %q is half-installed", name))
+		case state == 'F':
+			items = append(items, fmt.Sprintf("Package %q is half-configured", name))
+		case state == 'U':
+			items = append(items, fmt.Sprintf("Package %q is unpacked but not configured", name))
+		case state == 'W' || state == 't':
+			items = append(items, fmt.Sprintf("Package %q is awaiting triggers", name))
+		}
+
+		if state != 'n' && state != 'c' {
+			installed[name] = true
+		}
+	}
+
+	for _, line := range strings.Split(diversions, "\n") {
+		match := dpkgDiversionRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil || match[3] == "" {
+			continue
+		}
+
+		// Diversions of removed packages keep the files of other packages
+		// moved away.
+		if !installed[match[3]] {
+			items = append(items, fmt.Sprintf("Diversion of %q to %q by %q, which isn't installed", match[1], match[2], match[3]))
+		}
+	}
+
+	return items
+}
+
+// checkRPMState returns an error of the rpm database, and the packages of which
+// several versions are installed, which is left behind by interrupted
+// transactions.
+func checkRPMState(ctx context.Context) ([]string, error) {
+	var out strings.Builder
+
+	err := shared.RunCommand(ctx, nil, &out, "rpm", "-qa", "--qf", "%{NAME}.%{ARCH}\t%{VERSION}-%{RELEASE}\n")
+	if err != nil {
+		return inconsistentCommand(err, "")
+	}
+
+	return parseRPMDuplicates(out.String()), nil
+}
+
+// parseRPMDuplicates returns the packages listed with more than one version.
+func parseRPMDuplicates(out string) []string {
+	versions := map[string][]string{}
+
+	for _, line := range strings.Split(out, "\n") {
+		name, version, found := strings.Cut(line, "\t")
+		if !found {
+			continue
+		}
+
+		versions[name] = append(versions[name], version)
+	}
+
+	var items []string
+
+	for name, versions := range versions {
+		if len(versions) < 2 || slices.ContainsFunc(rpmInstallOnlyPrefixes, func(prefix string) bool { return strings.HasPrefix(name, prefix) }) {
+			continue
+		}
+
+		slices.Sort(versions)
+		items = append(items, fmt.Sprintf("Package %q is installed in several versions: %s", name, strings.Join(versions, ", ")))
+	}
+
+	slices.Sort(items)
+
+	return items
+}
+
+// checkAPKState returns the packages of /etc/apk/world which aren't installed.
+func checkAPKState(ctx context.Context) ([]string, error) {
+	world, err := os.ReadFile("/etc/apk/world")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %q: %w", "/etc/apk/world", err)
+	}
+
+	var installed strings.Builder
+
+	err = shared.RunCommand(ctx, nil, &installed, "apk", "info")
+	if err != nil {
+		return inconsistentCommand(err, "")
+	}
+
+	return parseAPKWorld(string(world), installed.String()), nil
+}
+
+// parseAPKWorld returns the packages of the world file missing in the list of
+// installed packages.
+func parseAPKWorld(world string, installed string) []string {
+	names := map[string]bool{}
+	for _, name := range strings.Fields(installed) {
+		names[name] = true
+	}
+
+	var items []string
+
+	for _, entry := range strings.Fields(world) {
+		// Conflicts and providers, like cmd:bash, aren't packages.
+		if strings.HasPrefix(entry, "!") || strings.Contains(entry, ":") {
+			continue
+		}
+
+		// Strip version constraints and repository tags.
+		name := entry
+
+		i := strings.IndexAny(name, "=<>~@")
+		if i > 0 {
+			name = name[:i]
+		}
+
+		if !names[name] {
+			items = append(items, fmt.Sprintf("Package %q of /etc/apk/world isn't installed", entry))
+		}
+	}
+
+	return items
+}
+
+// checkPacmanState returns the inconsistencies of the pacman database.
+func checkPacmanState(ctx context.Context) ([]string, error) {
+	var out strings.Builder
+
+	err := shared.RunCommand(ctx, nil, &out, "pacman", "-Dk")
+	if err != nil {
+		return inconsistentCommand(err, out.String())
+	}
+
+	return nil, nil
+}
+
+// checkXBPSState returns the inconsistencies of the xbps database.
+func checkXBPSState(ctx context.Context) ([]string, error) {
+	var out strings.Builder
+
+	err := shared.RunCommand(ctx, nil, &out, "xbps-pkgdb", "-a")
+	if err != nil {
+		return inconsistentCommand(err, out.String())
+	}
+
+	return nil, nil
+}
+
+// inconsistentCommand returns the output of a failed check as offending
+// items. Errors other than the check failing are returned as such.
+func inconsistentCommand(err error, stdout string) ([]string, error) {
+	var exitErr *exec.ExitError
+	var cmdErr *shared.CommandError
+
+	if !errors.As(err, &exitErr) || !errors.As(err, &cmdErr) {
+		return nil, err
+	}
+
+	var items []string
+
+	for _, line := range append(strings.Split(stdout, "\n"), cmdErr.Output...) {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			items = append(items, line)
+		}
+	}
+
+	if len(items) == 0 {
+		items = append(items, fmt.Sprintf("%s failed: %v", cmdErr.Command[0], exitErr))
+	}
+
+	return items, nil
+}
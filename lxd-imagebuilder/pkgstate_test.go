@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseDpkgState(t *testing.T) {
+	status := "bash\tii \nlibfoo\tiU \nlibbar\tiF \nbroken\tiHR\nold\trc \nremoved\tun \nmandb\tiW \n"
+	diversions := `diversion of /usr/bin/sh to /usr/bin/sh.distrib by bash
+diversion of /usr/bin/ischroot to /usr/bin/ischroot.debianutils by removed
+local diversion of /etc/issue to /etc/issue.orig
+`
+
+	require.Equal(t, []string{
+		`Package "libfoo" is unpacked but not configured`,
+		`Package "libbar" is half-configured`,
+		`Package "broken" needs to be reinstalled`,
+		`Package "mandb" is awaiting triggers`,
+		`Diversion of "/usr/bin/ischroot" to "/usr/bin/ischroot.debianutils" by "removed", which isn't installed`,
+	}, parseDpkgState(status, diversions))
+
+	require.Empty(t, parseDpkgState("bash\tii \n", "diversion of /usr/bin/sh to /usr/bin/sh.distrib by bash\n"))
+}
+
+func Test_parseRPMDuplicates(t *testing.T) {
+	out := "bash.x86_64\t5.2.26-3\nglibc.x86_64\t2.39-1\nglibc.x86_64\t2.39-2\nglibc.i686\t2.39-2\nkernel-core.x86_64\t6.8.5-1\nkernel-core.x86_64\t6.8.9-1\ngpg-pubkey.(none)\ta15b79cc-63d04c2c\ngpg-pubkey.(none)\t18b8e74c-62f2920f\n"
+
+	require.Equal(t, []string{`Package "glibc.x86_64" is installed in several versions: 2.39-1, 2.39-2`}, parseRPMDuplicates(out))
+}
+
+func Test_parseAPKWorld(t *testing.T) {
+	world := "alpine-base\nbusybox>=1.36\ncurl@edge\n!sudo\ncmd:bash\n.build-deps\nopenssh\n"
+	installed := "alpine-base\nbusybox\ncurl\n.build-deps\n"
+
+	require.Equal(t, []string{`Package "openssh" of /etc/apk/world isn't installed`}, parseAPKWorld(world, installed))
+}
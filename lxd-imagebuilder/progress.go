@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/canonical/lxd/shared/units"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// progressFormats are the formats of --progress.
+var progressFormats = []string{"json", "plain"}
+
+// progressInterval is the minimum time between two progress reports.
+const progressInterval = 5 * time.Second
+
+// progressReport is a line of --progress json.
+type progressReport struct {
+	Task       string `json:"task"`
+	Bytes      uint64 `json:"bytes"`
+	Percent    int    `json:"percent"`
+	Files      uint64 `json:"files"`
+	TotalFiles uint64 `json:"total_files"`
+	ETASeconds int64  `json:"eta_seconds"`
+	Done       bool   `json:"done"`
+}
+
+// progressReporter returns a function reporting the progress of the given
+// task, e.g. "rootfs-copy", according to --progress. Reports are throttled,
+// except for the final one.
+func (c *cmdGlobal) progressReporter(task string, message string) func(shared.CopyProgress) {
+	var last time.Time
+
+	return func(progress shared.CopyProgress) {
+		if !progress.Done && time.Since(last) < progressInterval {
+			return
+		}
+
+		last = time.Now()
+
+		if c.flagProgress == "json" {
+			data, err := json.Marshal(progressReport{
+				Task:       task,
+				Bytes:      progress.Bytes,
+				Percent:    progress.Percent,
+				Files:      progress.Files,
+				TotalFiles: progress.TotalFiles,
+				ETASeconds: int64(progress.ETA / time.Second),
+				Done:       progress.Done,
+			})
+			if err == nil {
+				fmt.Fprintln(os.Stderr, string(data))
+			}
+
+			return
+		}
+
+		fields := logrus.Fields{
+			"copied":  units.GetByteSizeStringIEC(int64(progress.Bytes), 1),
+			"percent": progress.Percent,
+		}
+
+		// Unpacking tarballs only reports the bytes read.
+		if progress.TotalFiles > 0 {
+			fields["files"] = fmt.Sprintf("%d/%d", progress.Files, progress.TotalFiles)
+		}
+
+		if !progress.Done {
+			fields["rate"] = units.GetByteSizeStringIEC(int64(progress.Rate), 2) + "/s"
+			fields["eta"] = progress.ETA.String()
+		}
+
+		c.logger.WithFields(fields).Info(message)
+	}
+}
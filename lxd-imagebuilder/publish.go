@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	client "github.com/canonical/lxd/client"
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// productProperties are the image properties identifying the images which are
+// rotated together. Images of a product only differ in their serial.
+var productProperties = []string{"os", "release", "variant", "architecture"}
+
+// connectPublishServer connects to the LXD server of targets.lxd.publish, or
+// the local one if no remote is set.
+func connectPublishServer(publish shared.DefinitionTargetLXDPublish) (client.InstanceServer, error) {
+	var server client.InstanceServer
+	var err error
+
+	if publish.Remote == "" {
+		server, err = client.ConnectLXDUnix("", nil)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to connect to LXD: %w", err)
+		}
+	} else {
+		args := &client.ConnectionArgs{}
+
+		for _, file := range []struct {
+			path  string
+			value *string
+		}{
+			{publish.ClientCert, &args.TLSClientCert},
+			{publish.ClientKey, &args.TLSClientKey},
+			{publish.ServerCert, &args.TLSServerCert},
+		} {
+			if file.path == "" {
+				continue
+			}
+
+			content, err := os.ReadFile(file.path)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read %q: %w", file.path, err)
+			}
+
+			*file.value = string(content)
+		}
+
+		server, err = client.ConnectLXD(publish.Remote, args)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to connect to %q: %w", publish.Remote, err)
+		}
+	}
+
+	if publish.Project != "" {
+		server = server.UseProject(publish.Project)
+	}
+
+	return server, nil
+}
+
+// publishLXDImage uploads the image to the LXD server of targets.lxd.publish,
+// and moves its aliases to it. Older images of the same product are deleted
+// according to the retention policy. It returns the server and the
+// fingerprint of the image.
+func publishLXDImage(logger *logrus.Logger, definition shared.Definition, imageFile string, rootfsFile string, imageType string) (client.InstanceServer, string, error) {
+	publish := *definition.Targets.LXD.Publish
+
+	server, err := connectPublishServer(publish)
+	if err != nil {
+		return nil, "", err
+	}
+
+	logger.WithFields(logrus.Fields{"remote": publish.Remote, "project": publish.Project}).Info("Uploading image")
+
+	fingerprint, err := importLXDImage(server, imageFile, rootfsFile, imageType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	image, etag, err := server.GetImage(fingerprint)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to get image %q: %w", fingerprint, err)
+	}
+
+	now := time.Now()
+
+	if publish.Public || publish.Expiry != "" {
+		put := image.Writable()
+		put.Public = publish.Public
+
+		put.ExpiresAt, err = lxdShared.GetExpiry(now, publish.Expiry)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid expiry %q: %w", publish.Expiry, err)
+		}
+
+		err = server.UpdateImage(fingerprint, put, etag)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to update image %q: %w", fingerprint, err)
+		}
+	}
+
+	description, err := shared.RenderTemplate(definition.Image.Description, definition)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to render %q: %w", definition.Image.Description, err)
+	}
+
+	for _, alias := range publish.Aliases {
+		name, err := shared.RenderTemplate(alias, definition)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to render %q: %w", alias, err)
+		}
+
+		err = setImageAlias(server, name, fingerprint, description)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if publish.Keep == 0 && publish.Expiry == "" {
+		return server, fingerprint, nil
+	}
+
+	images, err := server.GetImages()
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to get images: %w", err)
+	}
+
+	for _, old := range expiredImages(images, *image, publish.Keep, now) {
+		logger.WithFields(logrus.Fields{"fingerprint": old.Fingerprint, "serial": old.Properties["serial"]}).Info("Deleting image")
+
+		op, err := server.DeleteImage(old.Fingerprint)
+		if err == nil {
+			err = op.Wait()
+		}
+
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to delete image %q: %w", old.Fingerprint, err)
+		}
+	}
+
+	return server, fingerprint, nil
+}
+
+// setImageAlias points the given alias to the image, creating it if needed.
+func setImageAlias(server client.InstanceServer, name string, fingerprint string, description string) error {
+	_, etag, err := server.GetImageAlias(name)
+	if err != nil {
+		if !api.StatusErrorCheck(err, 404) {
+			return fmt.Errorf("Failed to get image alias %q: %w", name, err)
+		}
+
+		err = server.CreateImageAlias(api.ImageAliasesPost{ImageAliasesEntry: api.ImageAliasesEntry{Name: name, Target: fingerprint, Description: description}})
+		if err != nil {
+			return fmt.Errorf("Failed to create image alias %q: %w", name, err)
+		}
+
+		return nil
+	}
+
+	err = server.UpdateImageAlias(name, api.ImageAliasesEntryPut{Target: fingerprint, Description: description}, etag)
+	if err != nil {
+		return fmt.Errorf("Failed to update image alias %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// expiredImages returns the images of the same product as the published one
+// which are to be deleted. These are all but the newest keep serials, if keep
+// isn't 0, and those past their expiry date. The published image and images
+// with aliases, e.g. one pinned as stable, are never deleted.
+func expiredImages(images []api.Image, published api.Image, keep uint, now time.Time) []api.Image {
+	var product []api.Image
+
+	for _, image := range images {
+		if image.Type != published.Type {
+			continue
+		}
+
+		if !slices.ContainsFunc(productProperties, func(key string) bool { return image.Properties[key] != published.Properties[key] }) {
+			product = append(product, image)
+		}
+	}
+
+	// Newest serials first
+	slices.SortStableFunc(product, func(a, b api.Image) int {
+		cmp := strings.Compare(b.Properties["serial"], a.Properties["serial"])
+		if cmp != 0 {
+			return cmp
+		}
+
+		return b.UploadedAt.Compare(a.UploadedAt)
+	})
+
+	var expired []api.Image
+
+	for i, image := range product {
+		if image.Fingerprint == published.Fingerprint || len(image.Aliases) > 0 {
+			continue
+		}
+
+		if (keep > 0 && uint(i) >= keep) || (!image.ExpiresAt.IsZero() && image.ExpiresAt.Before(now)) {
+			expired = append(expired, image)
+		}
+	}
+
+	return expired
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/canonical/lxd/shared/api"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_expiredImages(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	image := func(fingerprint string, serial string) api.Image {
+		return api.Image{
+			Fingerprint: fingerprint,
+			Type:        "container",
+			Properties:  map[string]string{"os": "Ubuntu", "release": "noble", "variant": "default", "architecture": "amd64", "serial": serial},
+		}
+	}
+
+	published := image("e", "20240310_0000")
+
+	pinned := image("b", "20240307_0000")
+	pinned.Aliases = []api.ImageAlias{{Name: "ubuntu/noble/stable"}}
+
+	expiring := image("d", "20240309_0000")
+	expiring.ExpiresAt = now.Add(-time.Hour)
+
+	otherRelease := image("x", "20240301_0000")
+	otherRelease.Properties["release"] = "jammy"
+
+	vm := image("y", "20240301_0000")
+	vm.Type = "virtual-machine"
+
+	images := []api.Image{image("a", "20240306_0000"), pinned, image("c", "20240308_0000"), expiring, published, otherRelease, vm}
+
+	fingerprints := func(images []api.Image) []string {
+		var out []string
+
+		for _, image := range images {
+			out = append(out, image.Fingerprint)
+		}
+
+		return out
+	}
+
+	// The newest serials are kept, but pinned images are never deleted.
+	require.Equal(t, []string{"d", "a"}, fingerprints(expiredImages(images, published, 3, now)))
+	require.Equal(t, []string{"d", "c", "a"}, fingerprints(expiredImages(images, published, 1, now)))
+
+	// Without keep, only expired images are deleted.
+	require.Equal(t, []string{"d"}, fingerprints(expiredImages(images, published, 0, now)))
+	require.Empty(t, expiredImages(images, published, 0, now.Add(-2*time.Hour)))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// remoteCommands are the sub-commands which can be run on a remote build host.
+var remoteCommands = []string{"build-dir", "build-lxc", "build-lxd", "build-sysext", "build-tarball", "build-wsl", "download-packages"}
+
+// remoteHost runs commands on a remote build host using ssh.
+type remoteHost struct {
+	ctx  context.Context
+	host string
+
+	// sudo is set if the remote user isn't root.
+	sudo bool
+}
+
+// command returns the ssh command running the given command on the remote host.
+func (r *remoteHost) command(root bool, args ...string) *exec.Cmd {
+	quoted := make([]string, 0, len(args)+2)
+
+	if root && r.sudo {
+		quoted = append(quoted, "sudo", "--")
+	}
+
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	cmd := exec.CommandContext(r.ctx, "ssh", "-o", "ServerAliveInterval=30", "--", r.host, strings.Join(quoted, " "))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd
+}
+
+// run runs the given command on the remote host.
+func (r *remoteHost) run(stdin io.Reader, stdout io.Writer, root bool, args ...string) error {
+	cmd := r.command(root, args...)
+
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to run %q on %q: %w", strings.Join(args, " "), r.host, err)
+	}
+
+	return nil
+}
+
+// output runs the given command on the remote host and returns its trimmed output.
+func (r *remoteHost) output(root bool, args ...string) (string, error) {
+	var out bytes.Buffer
+
+	err := r.run(nil, &out, root, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
+
+// runRemote runs the build on the remote build host. The definition and the
+// local files it refers to are copied to the build host, and the artifacts are
+// copied back to the target directory.
+func (c *cmdGlobal) runRemote(cmd *cobra.Command, args []string) error {
+	// if an error is returned, disable the usage message
+	cmd.SilenceUsage = true
+
+	targetDir := "."
+	if len(args) > 1 {
+		targetDir = args[1]
+	}
+
+	err := os.MkdirAll(targetDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", targetDir, err)
+	}
+
+	var definition []byte
+
+	if args[0] == "" || args[0] == "-" {
+		definition, err = io.ReadAll(os.Stdin)
+	} else {
+		definition, err = os.ReadFile(args[0])
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to read definition: %w", err)
+	}
+
+	remote := &remoteHost{ctx: c.ctx, host: c.flagBuildHost}
+
+	uid, err := remote.output(false, "id", "-u")
+	if err != nil {
+		return err
+	}
+
+	remote.sudo = uid != "0"
+
+	workDir, err := remote.output(false, "mktemp", "-d", "/tmp/lxd-imagebuilder-remote.XXXXXX")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err := remote.run(nil, nil, true, "rm", "-rf", workDir)
+		if err != nil {
+			c.logger.WithField("err", err).Warn("Failed to remove remote working directory")
+		}
+	}()
+
+	remoteDefinition := path.Join(workDir, "definition.yaml")
+	remoteTargetDir := path.Join(workDir, "target")
+
+	definition, err = c.uploadHostPaths(remote, definition, path.Join(workDir, "inputs"))
+	if err != nil {
+		return err
+	}
+
+	err = remote.run(bytes.NewReader(definition), nil, false, "sh", "-c", fmt.Sprintf("cat > %s", shellQuote(remoteDefinition)))
+	if err != nil {
+		return fmt.Errorf("Failed to copy definition: %w", err)
+	}
+
+	c.logger.WithFields(logrus.Fields{"host": c.flagBuildHost, "command": cmd.Name()}).Info("Running remote build")
+
+	buildArgs := append([]string{"lxd-imagebuilder", cmd.Name(), remoteDefinition, remoteTargetDir}, remoteFlags(cmd)...)
+
+	err = remote.run(nil, nil, true, buildArgs...)
+	if err != nil {
+		// Fetch the diagnostics of the failed build if there are any.
+		_ = c.fetchRemoteArtifacts(remote, remoteTargetDir, targetDir)
+
+		return fmt.Errorf("Remote build failed: %w", err)
+	}
+
+	c.logger.WithField("dir", targetDir).Info("Fetching artifacts")
+
+	return c.fetchRemoteArtifacts(remote, remoteTargetDir, targetDir)
+}
+
+// uploadHostPaths copies the local files and directories the definition refers
+// to into remoteDir on the build host, and returns the definition referring to
+// the copies. The definition is returned as is if it doesn't refer to any.
+func (c *cmdGlobal) uploadHostPaths(remote *remoteHost, content []byte, remoteDir string) ([]byte, error) {
+	// Check the required version before parsing the definition strictly, which
+	// fails on fields of newer versions.
+	err := shared.CheckRequires(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var def shared.Definition
+
+	// Profiles are applied on the build host, so they aren't merged here.
+	err = yaml.UnmarshalStrict(content, &def)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse definition: %w", err)
+	}
+
+	hostPaths := def.HostPaths()
+
+	// The rootfs-http source unpacks local files given by URL.
+	sourcePath, isFile := strings.CutPrefix(def.Source.URL, "file://")
+	if isFile {
+		hostPaths = append(hostPaths, shared.DefinitionHostPath{Key: "source.url", Path: &sourcePath})
+	}
+
+	if len(hostPaths) == 0 {
+		return content, nil
+	}
+
+	for i, hostPath := range hostPaths {
+		dir := path.Join(remoteDir, strconv.Itoa(i))
+
+		c.logger.WithFields(logrus.Fields{"key": hostPath.Key, "path": *hostPath.Path}).Info("Copying input to build host")
+
+		remotePath, err := uploadPath(c.ctx, remote, *hostPath.Path, dir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to copy %s %q: %w", hostPath.Key, *hostPath.Path, err)
+		}
+
+		*hostPath.Path = remotePath
+	}
+
+	if isFile {
+		def.Source.URL = "file://" + sourcePath
+	}
+
+	content, err = yaml.Marshal(&def)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal definition: %w", err)
+	}
+
+	return content, nil
+}
+
+// uploadPath copies the given local file or directory into remoteDir on the
+// build host, keeping its owners and modes, and returns the path of the copy.
+func uploadPath(ctx context.Context, remote *remoteHost, localPath string, remoteDir string) (string, error) {
+	// Symlinks are only resolved for the path itself, not for the content of
+	// directories.
+	localPath, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	localPath, err = filepath.Abs(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(localPath)
+
+	cmd := exec.CommandContext(ctx, "tar", "-C", filepath.Dir(localPath), "-cf", "-", name)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get stdout pipe: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return "", fmt.Errorf("Failed to start %q: %w", "tar", err)
+	}
+
+	uploadErr := remote.run(out, nil, true, "sh", "-c", fmt.Sprintf("mkdir -p %s && tar -C %s -xf -", shellQuote(remoteDir), shellQuote(remoteDir)))
+
+	err = cmd.Wait()
+	if err != nil {
+		return "", fmt.Errorf("Failed to archive %q: %w", localPath, err)
+	}
+
+	if uploadErr != nil {
+		return "", uploadErr
+	}
+
+	return path.Join(remoteDir, name), nil
+}
+
+// fetchRemoteArtifacts copies the content of the remote directory to the local directory.
+func (c *cmdGlobal) fetchRemoteArtifacts(remote *remoteHost, remoteDir string, localDir string) error {
+	cmd := remote.command(true, "tar", "-C", remoteDir, "-cf", "-", ".")
+	cmd.Stdin = nil
+	cmd.Stdout = nil
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Failed to get stdout pipe: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to start %q: %w", "ssh", err)
+	}
+
+	extractErr := shared.RunCommand(c.ctx, out, nil, "tar", "-C", localDir, "-xf", "-")
+
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("Failed to fetch artifacts from %q: %w", remote.host, err)
+	}
+
+	if extractErr != nil {
+		return fmt.Errorf("Failed to extract artifacts: %w", extractErr)
+	}
+
+	return nil
+}
+
+// remoteFlags returns the flags which were set on the command line, except for
+// --build-host. The cache and sources directories are local directories,
+// so the build host uses its defaults instead.
+func remoteFlags(cmd *cobra.Command) []string {
+	var flags []string
+
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if slices.Contains([]string{"build-host", "cache-dir", "sources-dir"}, f.Name) {
+			return
+		}
+
+		slice, ok := f.Value.(pflag.SliceValue)
+		if ok {
+			for _, value := range slice.GetSlice() {
+				flags = append(flags, fmt.Sprintf("--%s=%s", f.Name, value))
+			}
+
+			return
+		}
+
+		flags = append(flags, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+
+	return flags
+}
+
+// shellQuote quotes the given string for use in a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_shellQuote(t *testing.T) {
+	out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(`it's a "test" $HOME`)).Output()
+	require.NoError(t, err)
+	require.Equal(t, `it's a "test" $HOME`, string(out))
+}
+
+func Test_remoteFlags(t *testing.T) {
+	cmd := &cobra.Command{Use: "build-lxd", Run: func(cmd *cobra.Command, args []string) {}}
+	cmd.Flags().String("build-host", "", "")
+	cmd.Flags().String("cache-dir", "", "")
+	cmd.Flags().Bool("vm", false, "")
+	cmd.Flags().String("compression", "xz", "")
+	cmd.Flags().StringSliceP("options", "o", nil, "")
+
+	err := cmd.ParseFlags([]string{"--build-host", "root@builder", "--cache-dir", "/var/cache/images", "--vm", "-o", "image.release=noble", "-o", "image.variant=cloud"})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"--options=image.release=noble", "--options=image.variant=cloud", "--vm=true"}, remoteFlags(cmd))
+}
+
+func Test_runRemote(t *testing.T) {
+	binDir := t.TempDir()
+
+	// The fake ssh runs the command locally, and the fake lxd-imagebuilder
+	// creates artifacts containing the definition and its inputs.
+	scripts := map[string]string{
+		"ssh": `#!/bin/sh
+while [ "$1" != "--" ]; do shift; done
+shift 2
+exec sh -c "$1"
+`,
+		"lxd-imagebuilder": `#!/bin/sh
+[ "$1" = "build-lxd" ] || exit 1
+[ "$4" = "--vm=true" ] || exit 1
+mkdir -p "$3"
+cp "$2" "$3/image.yaml"
+[ ! -d "$(dirname "$2")/inputs" ] || cp -r "$(dirname "$2")/inputs" "$3/inputs"
+`,
+	}
+
+	for name, content := range scripts {
+		err := os.WriteFile(filepath.Join(binDir, name), []byte(content), 0755)
+		require.NoError(t, err)
+	}
+
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	definition := filepath.Join(t.TempDir(), "definition.yaml")
+	err := os.WriteFile(definition, []byte("image:\n  distribution: ubuntu\n"), 0644)
+	require.NoError(t, err)
+
+	targetDir := t.TempDir()
+
+	c := cmdGlobal{ctx: context.Background(), logger: logrus.New(), flagBuildHost: "root@builder"}
+
+	cmd := &cobra.Command{Use: "build-lxd"}
+	cmd.Flags().Bool("vm", false, "")
+
+	err = cmd.ParseFlags([]string{"--vm"})
+	require.NoError(t, err)
+
+	err = c.runRemote(cmd, []string{definition, targetDir})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(targetDir, "image.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "image:\n  distribution: ubuntu\n", string(content))
+
+	// Local files of the definition are copied, and the definition refers to
+	// the copies.
+	inputDir := t.TempDir()
+
+	err = os.Mkdir(filepath.Join(inputDir, "overlay"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(inputDir, "overlay", "motd"), []byte("hello"), 0644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(inputDir, "rootfs.tar"), []byte("rootfs"), 0644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(definition, []byte(`image:
+  distribution: ubuntu
+source:
+  downloader: rootfs-http
+  url: file://`+filepath.Join(inputDir, "rootfs.tar")+`
+rootfs_overlays:
+- source: `+filepath.Join(inputDir, "overlay")+`
+`), 0644)
+	require.NoError(t, err)
+
+	targetDir = t.TempDir()
+
+	err = c.runRemote(cmd, []string{definition, targetDir})
+	require.NoError(t, err)
+
+	content, err = os.ReadFile(filepath.Join(targetDir, "inputs", "0", "overlay", "motd"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+
+	content, err = os.ReadFile(filepath.Join(targetDir, "inputs", "1", "rootfs.tar"))
+	require.NoError(t, err)
+	require.Equal(t, "rootfs", string(content))
+
+	content, err = os.ReadFile(filepath.Join(targetDir, "image.yaml"))
+	require.NoError(t, err)
+
+	var def shared.Definition
+
+	err = yaml.Unmarshal(content, &def)
+	require.NoError(t, err)
+	require.Regexp(t, "^/.*/inputs/0/overlay$", def.RootfsOverlays[0].Source)
+	require.Regexp(t, "^file:///.*/inputs/1/rootfs.tar$", def.Source.URL)
+	require.NotContains(t, string(content), inputDir)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// restrictedEnvVariables are the environment variables of the build host which
+// are kept in restricted mode. The proxy variables are kept, as a proxy may be
+// what limits the network access of the package managers.
+var restrictedEnvVariables = []string{"PATH", "TERM", "LANG", "LC_ALL", "http_proxy", "https_proxy", "no_proxy", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+// restrictEnvironment removes all but restrictedEnvVariables from the
+// environment, so neither the env template helper nor the actions can read
+// secrets of the build host.
+func restrictEnvironment() {
+	kept := map[string]string{}
+
+	for _, key := range restrictedEnvVariables {
+		value, ok := os.LookupEnv(key)
+		if ok {
+			kept[key] = value
+		}
+	}
+
+	os.Clearenv()
+
+	for key, value := range kept {
+		_ = os.Setenv(key, value)
+	}
+}
+
+// loadDefinition loads the image definition. In restricted mode, the
+// environment is restricted before the definition is rendered, and the
+// definition is restricted before any plugin, action or generator runs.
+func (c *cmdGlobal) loadDefinition(fname string) error {
+	// Don't leak the environment of the build host into templates and actions.
+	if c.flagRestricted {
+		restrictEnvironment()
+	}
+
+	definition, err := getDefinition(fname, c.flagFlavor, c.flagOptions)
+	if err != nil {
+		return fmt.Errorf("Failed to get definition: %w", err)
+	}
+
+	if c.flagRestricted {
+		err = definition.Restrict(c.flagAllowedMirrors)
+		if err != nil {
+			return fmt.Errorf("Failed to restrict definition: %w", err)
+		}
+	}
+
+	c.definition = definition
+
+	return nil
+}
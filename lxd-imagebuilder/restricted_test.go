@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreRunPackRestricted(t *testing.T) {
+	// Restricting the environment clears it.
+	environ := os.Environ()
+
+	t.Cleanup(func() {
+		os.Clearenv()
+
+		for _, entry := range environ {
+			key, value, _ := strings.Cut(entry, "=")
+			_ = os.Setenv(key, value)
+		}
+	})
+
+	t.Setenv("BUILD_SECRET", "secret")
+
+	dir := t.TempDir()
+	definitionPath := filepath.Join(dir, "image.yaml")
+
+	err := os.WriteFile(definitionPath, []byte(`image:
+  distribution: ubuntu
+source:
+  downloader: my-source
+packages:
+  manager: apt
+plugins:
+- name: my-source
+  type: source
+`), 0644)
+	require.NoError(t, err)
+
+	rootfsDir := filepath.Join(dir, "rootfs")
+	targetDir := filepath.Join(dir, "out")
+
+	for _, d := range []string{rootfsDir, targetDir} {
+		err = os.Mkdir(d, 0755)
+		require.NoError(t, err)
+	}
+
+	c := cmdGlobal{
+		ctx:            context.Background(),
+		logger:         logrus.New(),
+		flagCacheDir:   filepath.Join(dir, "cache"),
+		flagRestricted: true,
+	}
+
+	defer func() {
+		if c.cacheLock != nil {
+			_ = c.cacheLock.Close()
+		}
+
+		if c.targetLock != nil {
+			_ = c.targetLock.Close()
+		}
+	}()
+
+	// Packing the rootfs runs the plugins, actions and generators of the
+	// definition as well, so it's restricted like a build.
+	err = c.preRunPack(&cobra.Command{}, []string{definitionPath, rootfsDir, targetDir})
+	require.EqualError(t, err, "Failed to restrict definition: plugins aren't allowed in restricted mode")
+
+	_, ok := os.LookupEnv("BUILD_SECRET")
+	require.False(t, ok)
+}
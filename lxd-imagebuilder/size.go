@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"syscall"
+)
+
+// defaultSizeHeadroom is the free space auto-sized images leave in the root
+// file system, in percent of the size of the rootfs.
+const defaultSizeHeadroom = 20
+
+// autoSizeOverhead is reserved in the root partition of auto-sized images for
+// the metadata of the file system, e.g. its inode tables and journal.
+const autoSizeOverhead = 256 * 1024 * 1024
+
+// autoSizeBlockSize is the block size the files of the rootfs are rounded up
+// to when measuring it.
+const autoSizeBlockSize = 4096
+
+const (
+	// luksHeaderSize is the size of the default LUKS2 header.
+	luksHeaderSize = 16 * 1024 * 1024
+
+	// lvmMetadataSize is reserved for the metadata of the LVM physical volume.
+	lvmMetadataSize = 4 * 1024 * 1024
+)
+
+// autoSize returns the size of an image which holds the rootfs at sourceDir, and
+// leaves the given headroom in percent of its size. The partitions and the
+// volumes of a fixed size are added on top.
+func (v *vm) autoSize(sourceDir string, headroom uint64) (uint64, error) {
+	used, err := measureRootfs(sourceDir)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to measure rootfs: %w", err)
+	}
+
+	if headroom == 0 {
+		headroom = defaultSizeHeadroom
+	}
+
+	root := used + used*headroom/100 + autoSizeOverhead
+
+	// The swap file is created inside of the root file system.
+	if v.swap != nil && v.swap.Type == "file" {
+		root += v.swap.Size
+	}
+
+	if v.lvm != nil {
+		root = max(root, v.lvm.RootSize) + v.lvm.SwapSize + v.lvm.DataSize + lvmMetadataSize
+	}
+
+	if v.encryption != nil {
+		root += luksHeaderSize
+	}
+
+	// The partitions are aligned to 1MiB, and the partition table takes up the
+	// first and the last MiB of the disk.
+	size := 2*gptAlignment*gptSectorSize + alignUp(v.esp.Size, 1024*1024) + alignUp(root, 1024*1024)
+
+	if v.prep {
+		size += prepSize
+	}
+
+	if v.swap != nil && v.swap.Type == "partition" {
+		size += alignUp(v.swap.Size, 1024*1024)
+	}
+
+	// The default size of the hash partition depends on the size of the image.
+	base := size
+
+	for v.verity != nil {
+		v.size = size
+
+		next := base + v.verityHashSize()
+		if next <= size {
+			break
+		}
+
+		size = next
+	}
+
+	return size, nil
+}
+
+// measureRootfs returns the space the files of the rootfs take up in bytes.
+// Files are rounded up to whole blocks and take up an inode each, and hard
+// links are only counted once.
+func measureRootfs(dir string) (uint64, error) {
+	var size uint64
+
+	inodes := map[[2]uint64]bool{}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if ok && !info.IsDir() && stat.Nlink > 1 {
+			inode := [2]uint64{uint64(stat.Dev), stat.Ino}
+			if inodes[inode] {
+				return nil
+			}
+
+			inodes[inode] = true
+		}
+
+		size += 256
+
+		switch {
+		case info.Mode().IsRegular():
+			size += alignUp(uint64(info.Size()), autoSizeBlockSize)
+		case info.IsDir():
+			size += alignUp(max(uint64(info.Size()), 1), autoSizeBlockSize)
+		case info.Mode()&fs.ModeSymlink != 0:
+			// Short symlinks are stored in the inode.
+			if info.Size() > 60 {
+				size += autoSizeBlockSize
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_measureRootfs(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.Mkdir(filepath.Join(dir, "etc"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "etc", "hostname"), []byte("a"), 0644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "etc", "large"), make([]byte, 5000), 0644)
+	require.NoError(t, err)
+
+	// Hard links are only counted once, and short symlinks only take up an inode.
+	err = os.Link(filepath.Join(dir, "etc", "large"), filepath.Join(dir, "etc", "link"))
+	require.NoError(t, err)
+
+	err = os.Symlink("large", filepath.Join(dir, "etc", "short"))
+	require.NoError(t, err)
+
+	err = os.Symlink(strings.Repeat("a/", 50)+"large", filepath.Join(dir, "etc", "long"))
+	require.NoError(t, err)
+
+	size, err := measureRootfs(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6*256+2*4096+4096+8192+4096), size)
+
+	_, err = measureRootfs(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func Test_autoSize(t *testing.T) {
+	dir := t.TempDir()
+	mib := uint64(1024 * 1024)
+
+	// The apparent size of sparse files is counted.
+	f, err := os.Create(filepath.Join(dir, "data"))
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	err = f.Truncate(int64(100 * mib))
+	require.NoError(t, err)
+
+	used, err := measureRootfs(dir)
+	require.NoError(t, err)
+
+	esp := shared.DefinitionTargetLXDVMESP{Size: 100 * mib}
+
+	tests := []struct {
+		name     string
+		vm       *vm
+		headroom uint64
+		expected uint64
+	}{
+		{
+			"default headroom",
+			&vm{esp: esp},
+			0,
+			2*mib + 100*mib + alignUp(used+used*20/100+autoSizeOverhead, mib),
+		},
+		{
+			"headroom",
+			&vm{esp: esp},
+			100,
+			2*mib + 100*mib + alignUp(2*used+autoSizeOverhead, mib),
+		},
+		{
+			"swap partition",
+			&vm{esp: esp, swap: &shared.DefinitionTargetLXDVMSwap{Type: "partition", Size: 512 * mib}},
+			0,
+			2*mib + 100*mib + alignUp(used+used*20/100+autoSizeOverhead, mib) + 512*mib,
+		},
+		{
+			"swap file",
+			&vm{esp: esp, swap: &shared.DefinitionTargetLXDVMSwap{Type: "file", Size: 512 * mib}},
+			0,
+			2*mib + 100*mib + alignUp(used+used*20/100+autoSizeOverhead+512*mib, mib),
+		},
+		{
+			"lvm",
+			&vm{esp: esp, lvm: &shared.DefinitionTargetLXDVMLVM{RootSize: 2048 * mib, SwapSize: 512 * mib}},
+			0,
+			2*mib + 100*mib + 2048*mib + 512*mib + lvmMetadataSize,
+		},
+		{
+			"ppc64le",
+			&vm{esp: esp, prep: true},
+			0,
+			2*mib + 100*mib + prepSize + alignUp(used+used*20/100+autoSizeOverhead, mib),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, err := tt.vm.autoSize(dir, tt.headroom)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, size)
+		})
+	}
+
+	// The hash partition grows with the image, so it still fits.
+	v := &vm{esp: esp, verity: &shared.DefinitionTargetLXDVMVerity{}}
+
+	size, err := v.autoSize(dir, 1000)
+	require.NoError(t, err)
+
+	base := 2*mib + 100*mib + alignUp(11*used+autoSizeOverhead, mib)
+
+	v.size = size
+	require.Equal(t, base+v.verityHashSize(), size)
+}
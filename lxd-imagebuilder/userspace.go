@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	lxdShared "github.com/canonical/lxd/shared"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// writeFilesystems creates the file systems of the userspace and guestfs
+// backends from the rootfs directory, and copies them into their partitions of
+// the image. It needs neither loop devices nor mounts. The EFI system
+// partition is created from the boot/efi directory of the rootfs.
+func (v *vm) writeFilesystems() error {
+	f, err := os.OpenFile(v.imageFile, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %w", v.imageFile, err)
+	}
+
+	defer f.Close()
+
+	_, entries, err := readGPT(f)
+	if err != nil {
+		return fmt.Errorf("Failed to read partition table of %q: %w", v.imageFile, err)
+	}
+
+	if len(entries) < 2 {
+		return fmt.Errorf("Partition table of %q has %d partitions instead of 2", v.imageFile, len(entries))
+	}
+
+	espFile := v.imageFile + ".esp"
+	rootFile := v.imageFile + ".root"
+
+	defer func() {
+		_ = os.Remove(espFile)
+		_ = os.Remove(rootFile)
+	}()
+
+	err = v.createUEFIImage(espFile, partitionSize(entries[0]))
+	if err != nil {
+		return fmt.Errorf("Failed to create EFI system partition: %w", err)
+	}
+
+	// The guestfs backend creates the root file system inside of the
+	// libguestfs appliance, so only the EFI system partition can be checked.
+	if v.guestfs {
+		err = f.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to close %q: %w", v.imageFile, err)
+		}
+
+		if !v.skipChecks {
+			err = v.checkFilesystem("vfat", espFile)
+			if err != nil {
+				return err
+			}
+		}
+
+		return v.writeGuestfsFilesystems(espFile)
+	}
+
+	err = v.createRootImage(rootFile, partitionSize(entries[1]))
+	if err != nil {
+		return fmt.Errorf("Failed to create root filesystem: %w", err)
+	}
+
+	if !v.skipChecks {
+		err = v.checkFilesystemImages(espFile, rootFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, file := range []string{espFile, rootFile} {
+		err = copySparse(f, int64(entries[i].firstLBA*gptSectorSize), file)
+		if err != nil {
+			return fmt.Errorf("Failed to write partition %d of %q: %w", i+1, v.imageFile, err)
+		}
+	}
+
+	return f.Close()
+}
+
+// partitionSize returns the size in bytes of the given partition.
+func partitionSize(entry gptEntry) uint64 {
+	return (entry.lastLBA - entry.firstLBA + 1) * gptSectorSize
+}
+
+// createSparseFile creates an empty file of the given size.
+func createSparseFile(path string, size uint64) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	err = f.Truncate(int64(size))
+	if err != nil {
+		return fmt.Errorf("Failed to create sparse file %q: %w", path, err)
+	}
+
+	return f.Close()
+}
+
+// createUEFIImage creates the FAT file system of the EFI system partition in
+// the given file, and copies the boot/efi directory of the rootfs into it.
+func (v *vm) createUEFIImage(file string, size uint64) error {
+	err := createSparseFile(file, size)
+	if err != nil {
+		return err
+	}
+
+	err = shared.RunCommand(v.ctx, nil, nil, "mkfs.vfat", "-F", strconv.FormatUint(uint64(v.esp.FAT), 10), "-n", v.esp.Label, file)
+	if err != nil {
+		return err
+	}
+
+	espDir := filepath.Join(v.rootfsDir, "boot", "efi")
+
+	dirEntries, err := os.ReadDir(espDir)
+	if err != nil {
+		return fmt.Errorf("Failed to read directory %q: %w", espDir, err)
+	}
+
+	if len(dirEntries) == 0 {
+		return nil
+	}
+
+	args := []string{"-s", "-p", "-Q", "-i", file}
+
+	for _, entry := range dirEntries {
+		args = append(args, filepath.Join(espDir, entry.Name()))
+	}
+
+	err = shared.RunCommand(v.ctx, nil, nil, "mcopy", append(args, "::")...)
+	if err != nil {
+		return fmt.Errorf("Failed to copy %q: %w", espDir, err)
+	}
+
+	return nil
+}
+
+// createRootImage creates the root file system in the given file, populated
+// with the rootfs directory. The contents of the EFI system partition are
+// left out.
+func (v *vm) createRootImage(file string, size uint64) error {
+	err := createSparseFile(file, size)
+	if err != nil {
+		return err
+	}
+
+	espDir := filepath.Join(v.rootfsDir, "boot", "efi")
+	espTmpDir := v.rootfsDir + ".esp"
+
+	err = os.Rename(espDir, espTmpDir)
+	if err != nil {
+		return fmt.Errorf("Failed to move %q: %w", espDir, err)
+	}
+
+	defer func() {
+		_ = os.Remove(espDir)
+		_ = os.Rename(espTmpDir, espDir)
+	}()
+
+	err = os.Mkdir(espDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", espDir, err)
+	}
+
+	if v.rootFS == "btrfs" {
+		return v.createBtrfsImage(file)
+	}
+
+	err = shared.RunCommand(v.ctx, nil, nil, "mkfs.ext4", append(ext4MkfsArgs(v.fsOptions), "-d", v.rootfsDir, file)...)
+	if err != nil {
+		return fmt.Errorf("Failed to create ext4 filesystem: %w", err)
+	}
+
+	return nil
+}
+
+// btrfsLayoutMove is a directory of the rootfs which was moved to the
+// directory of its subvolume.
+type btrfsLayoutMove struct {
+	source string
+	target string
+}
+
+// createBtrfsImage creates the btrfs file system in the given file. As
+// mkfs.btrfs populates the top level of the file system, the rootfs is
+// rearranged into a directory per subvolume while it runs.
+func (v *vm) createBtrfsImage(file string) error {
+	layoutDir := v.rootfsDir + ".btrfs"
+
+	err := os.Mkdir(layoutDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", layoutDir, err)
+	}
+
+	var moves []btrfsLayoutMove
+
+	// The moves are undone in reverse order, so the rootfs is back in place
+	// for the rest of the build.
+	defer func() {
+		for i := len(moves) - 1; i >= 0; i-- {
+			move := moves[i]
+
+			_ = os.Remove(move.source)
+			_ = os.Rename(move.target, move.source)
+		}
+
+		_ = os.RemoveAll(layoutDir)
+	}()
+
+	move := func(source string, target string) error {
+		err := os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", filepath.Dir(target), err)
+		}
+
+		err = os.Rename(source, target)
+		if err != nil {
+			return fmt.Errorf("Failed to move %q: %w", source, err)
+		}
+
+		moves = append(moves, btrfsLayoutMove{source: source, target: target})
+
+		return nil
+	}
+
+	var rootDir string
+
+	for _, subvolume := range v.btrfs.Subvolumes {
+		if subvolume.Mountpoint == "/" {
+			rootDir = filepath.Join(layoutDir, subvolume.Name)
+		}
+	}
+
+	err = move(v.rootfsDir, rootDir)
+	if err != nil {
+		return err
+	}
+
+	// Nested mountpoints are moved before their parents.
+	mounts := v.getBtrfsSubvolumeMounts()
+
+	for i := len(mounts) - 1; i >= 0; i-- {
+		subvolume := mounts[i]
+		source := filepath.Join(rootDir, subvolume.Mountpoint)
+		target := filepath.Join(layoutDir, subvolume.Name)
+
+		if source == target {
+			continue
+		}
+
+		if !lxdShared.PathExists(source) {
+			err = os.MkdirAll(source, 0755)
+			if err != nil {
+				return fmt.Errorf("Failed to create directory %q: %w", source, err)
+			}
+		}
+
+		err = move(source, target)
+		if err != nil {
+			return err
+		}
+
+		// Keep the mountpoint of the subvolume.
+		err = os.Mkdir(source, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", source, err)
+		}
+	}
+
+	args := append([]string{"-f", "-L", "rootfs"}, v.btrfs.MkfsOptions...)
+	args = append(args, "--rootdir", layoutDir)
+
+	for _, subvolume := range v.btrfs.Subvolumes {
+		dir := filepath.Join(layoutDir, subvolume.Name)
+
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", dir, err)
+		}
+
+		args = append(args, "--subvol", subvolume.Name)
+	}
+
+	err = shared.RunCommand(v.ctx, nil, nil, "mkfs.btrfs", append(args, file)...)
+	if err != nil {
+		return fmt.Errorf("Failed to create btrfs filesystem: %w", err)
+	}
+
+	return nil
+}
+
+// checkFilesystemImages checks the file systems created by the userspace
+// backend, and that the file systems in /etc/fstab exist in the image.
+func (v *vm) checkFilesystemImages(espFile string, rootFile string) error {
+	err := v.checkFilesystem("vfat", espFile)
+	if err != nil {
+		return err
+	}
+
+	err = v.checkFilesystem(v.rootFS, rootFile)
+	if err != nil {
+		return err
+	}
+
+	return v.checkFstabDevices([]string{espFile, rootFile})
+}
+
+// copySparse copies the given file into w at the given offset. Blocks which
+// only contain zeros are skipped, so the image stays sparse.
+func copySparse(w io.WriterAt, offset int64, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	err = writeSparse(w, offset, f)
+	if err != nil {
+		return fmt.Errorf("Failed to copy %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// writeSparse copies r into w at the given offset, skipping blocks which only
+// contain zeros.
+func writeSparse(w io.WriterAt, offset int64, r io.Reader) error {
+	buf := make([]byte, 1024*1024)
+	zero := make([]byte, len(buf))
+
+	for pos := int64(0); ; {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zero[:n]) {
+			_, err := w.WriteAt(buf[:n], offset+pos)
+			if err != nil {
+				return err
+			}
+		}
+
+		pos += int64(n)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
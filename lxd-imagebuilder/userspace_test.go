@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_copySparse(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+
+	content := make([]byte, 3*1024*1024+10)
+	copy(content[1024*1024:], "data")
+	content[len(content)-1] = 1
+
+	err := os.WriteFile(src, content, 0644)
+	require.NoError(t, err)
+
+	disk := make(memDisk, 4096+len(content))
+
+	err = copySparse(disk, 4096, src)
+	require.NoError(t, err)
+	require.Equal(t, content, []byte(disk[4096:]))
+}
+
+func Test_partitionSize(t *testing.T) {
+	require.Equal(t, uint64(1024*1024), partitionSize(gptEntry{firstLBA: 2048, lastLBA: 4095}))
+}
+
+func Test_createRootImage(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "e2fsck"} {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			t.Skipf("%s is missing", tool)
+		}
+	}
+
+	dir := t.TempDir()
+	rootfsDir := filepath.Join(dir, "rootfs")
+
+	for _, path := range []string{"etc", "boot/efi/EFI/BOOT"} {
+		err := os.MkdirAll(filepath.Join(rootfsDir, path), 0755)
+		require.NoError(t, err)
+	}
+
+	err := os.WriteFile(filepath.Join(rootfsDir, "etc", "hostname"), []byte("test\n"), 0644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(rootfsDir, "boot", "efi", "EFI", "BOOT", "BOOTX64.EFI"), []byte("efi"), 0644)
+	require.NoError(t, err)
+
+	v := &vm{ctx: context.Background(), rootfsDir: rootfsDir, rootFS: "ext4", userspace: true}
+
+	rootFile := filepath.Join(dir, "root.img")
+
+	err = v.createRootImage(rootFile, 64*1024*1024)
+	require.NoError(t, err)
+
+	err = v.checkFilesystem("ext4", rootFile)
+	require.NoError(t, err)
+
+	// The contents of the EFI system partition are left out, and moved back
+	// into the rootfs afterwards.
+	require.FileExists(t, filepath.Join(rootfsDir, "boot", "efi", "EFI", "BOOT", "BOOTX64.EFI"))
+
+	_, err = exec.LookPath("debugfs")
+	if err != nil {
+		return
+	}
+
+	var out strings.Builder
+
+	err = shared.RunCommand(v.ctx, nil, &out, "debugfs", "-R", "ls -l /boot/efi", rootFile)
+	require.NoError(t, err)
+	require.NotContains(t, out.String(), "EFI")
+
+	out.Reset()
+
+	err = shared.RunCommand(v.ctx, nil, &out, "debugfs", "-R", "cat /etc/hostname", rootFile)
+	require.NoError(t, err)
+	require.Equal(t, "test\n", out.String())
+}
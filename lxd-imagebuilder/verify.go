@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	client "github.com/canonical/lxd/client"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// verifyTimeout is how long the container may take to boot and configure its
+// network.
+const verifyTimeout = 5 * time.Minute
+
+// verifyInterval is the time between checks of the container state.
+const verifyInterval = 2 * time.Second
+
+// verifyScript checks whether init reached its default target or runlevel, and
+// whether there's a default route. It's run inside of the container, and only
+// relies on a POSIX shell.
+const verifyScript = `
+if [ -d /run/systemd/system ]; then
+	state="$(systemctl is-system-running 2>/dev/null)"
+	case "${state}" in
+	running|degraded) ;;
+	*) echo "systemd is ${state:-not running}"; exit 1 ;;
+	esac
+elif [ -d /run/openrc ]; then
+	if [ ! -e /run/openrc/softlevel ]; then
+		echo "OpenRC hasn't reached a runlevel"
+		exit 1
+	fi
+
+	if [ -d /run/openrc/starting ] && [ -n "$(ls /run/openrc/starting)" ]; then
+		echo "OpenRC is starting services"
+		exit 1
+	fi
+elif command -v runlevel >/dev/null 2>&1; then
+	set -- $(runlevel)
+	case "${2}" in
+	[1-5]) ;;
+	*) echo "Runlevel is ${2:-unknown}"; exit 1 ;;
+	esac
+fi
+
+while read -r iface dest _; do
+	[ "${dest}" = "00000000" ] && [ "${iface}" != "lo" ] && exit 0
+done < /proc/net/route
+
+if [ -e /proc/net/ipv6_route ]; then
+	while read -r dest len _ _ _ _ _ _ _ iface; do
+		[ "${dest}" = "00000000000000000000000000000000" ] && [ "${len}" = "00" ] && [ "${iface}" != "lo" ] && exit 0
+	done < /proc/net/ipv6_route
+fi
+
+echo "Network has no default route"
+exit 1
+`
+
+// verifyContainer runs the verification script with the given function until
+// it succeeds, or fails with the last reported problem once the timeout is
+// reached.
+func verifyContainer(ctx context.Context, logger *logrus.Logger, run func(ctx context.Context, script string) (string, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+
+	logger.WithField("timeout", verifyTimeout).Info("Waiting for container to boot")
+
+	for {
+		out, err := run(ctx, verifyScript)
+		if err == nil {
+			logger.Info("Container booted")
+			return nil
+		}
+
+		reason := strings.TrimSpace(out)
+		if reason == "" {
+			reason = err.Error()
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("Container didn't boot within %s: %s", verifyTimeout, reason)
+			}
+
+			return ctx.Err()
+		case <-time.After(verifyInterval):
+		}
+	}
+}
+
+// verifyLXDImage imports the given image into the local LXD, and checks that
+// a container created from it boots. The image and container are removed
+// afterwards.
+func verifyLXDImage(ctx context.Context, logger *logrus.Logger, imageFile string, rootfsFile string) error {
+	server, err := client.ConnectLXDUnix("", nil)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to LXD: %w", err)
+	}
+
+	logger.Info("Importing image into LXD")
+
+	fingerprint, err := importLXDImage(server, imageFile, rootfsFile, "container")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		op, err := server.DeleteImage(fingerprint)
+		if err == nil {
+			err = op.Wait()
+		}
+
+		if err != nil {
+			logger.WithFields(logrus.Fields{"fingerprint": fingerprint, "err": err}).Warn("Failed deleting image")
+		}
+	}()
+
+	name := fmt.Sprintf("lxd-imagebuilder-verify-%s", fingerprint[:12])
+
+	op, err := server.CreateInstance(api.InstancesPost{
+		Name:   name,
+		Source: api.InstanceSource{Type: "image", Fingerprint: fingerprint},
+		Type:   api.InstanceTypeContainer,
+	})
+	if err == nil {
+		err = op.Wait()
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to create container %q: %w", name, err)
+	}
+
+	defer func() {
+		op, err := server.UpdateInstanceState(name, api.InstanceStatePut{Action: "stop", Force: true, Timeout: -1}, "")
+		if err == nil {
+			_ = op.Wait()
+		}
+
+		op, err = server.DeleteInstance(name)
+		if err == nil {
+			err = op.Wait()
+		}
+
+		if err != nil {
+			logger.WithFields(logrus.Fields{"container": name, "err": err}).Warn("Failed deleting container")
+		}
+	}()
+
+	op, err = server.UpdateInstanceState(name, api.InstanceStatePut{Action: "start", Timeout: -1}, "")
+	if err == nil {
+		err = op.Wait()
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to start container %q: %w", name, err)
+	}
+
+	return verifyContainer(ctx, logger, func(ctx context.Context, script string) (string, error) {
+		out, status, err := execInstance(server, name, []string{"/bin/sh", "-c", script})
+		if err != nil {
+			return "", err
+		}
+
+		if status != 0 {
+			return out, fmt.Errorf("Verification exited with status %v", status)
+		}
+
+		return out, nil
+	})
+}
+
+// execInstance runs the command inside of the instance, and returns its
+// combined output and exit status.
+func execInstance(server client.InstanceServer, name string, command []string) (string, int, error) {
+	var out strings.Builder
+
+	dataDone := make(chan bool)
+
+	op, err := server.ExecInstance(name, api.InstanceExecPost{
+		Command:   command,
+		WaitForWS: true,
+	}, &client.InstanceExecArgs{Stdout: &out, Stderr: &out, DataDone: dataDone})
+	if err != nil {
+		return "", -1, err
+	}
+
+	err = op.Wait()
+	if err != nil {
+		return "", -1, err
+	}
+
+	<-dataDone
+
+	status, ok := op.Get().Metadata["return"].(float64)
+	if !ok {
+		return out.String(), -1, errors.New("Exit status is missing")
+	}
+
+	return out.String(), int(status), nil
+}
+
+// importLXDImage imports the given image into LXD, and returns its fingerprint.
+func importLXDImage(server client.InstanceServer, imageFile string, rootfsFile string, imageType string) (string, error) {
+	meta, err := os.Open(imageFile)
+	if err != nil {
+		return "", err
+	}
+
+	defer meta.Close()
+
+	var rootfs io.ReadCloser
+
+	if rootfsFile != "" {
+		rootfs, err = os.Open(rootfsFile)
+		if err != nil {
+			return "", err
+		}
+
+		defer rootfs.Close()
+	}
+
+	createArgs := &client.ImageCreateArgs{
+		MetaFile:   meta,
+		MetaName:   filepath.Base(imageFile),
+		RootfsFile: rootfs,
+		RootfsName: filepath.Base(rootfsFile),
+		Type:       imageType,
+	}
+
+	op, err := server.CreateImage(api.ImagesPost{Filename: imageFile}, createArgs)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create image: %w", err)
+	}
+
+	err = op.Wait()
+	if err != nil {
+		return "", fmt.Errorf("Failed to create image: %w", err)
+	}
+
+	fingerprint, ok := op.Get().Metadata["fingerprint"].(string)
+	if !ok {
+		return "", errors.New("Fingerprint of the image is missing")
+	}
+
+	return fingerprint, nil
+}
+
+// verifyLXCImage creates a container from the LXC image in the given
+// directory using the local template, and checks that it boots. The container
+// is destroyed afterwards.
+func verifyLXCImage(ctx context.Context, logger *logrus.Logger, dir string, name string) error {
+	for _, tool := range []string{"lxc-create", "lxc-start", "lxc-attach", "lxc-destroy"} {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			return fmt.Errorf("Required tool %q is missing", tool)
+		}
+	}
+
+	files := map[string]string{}
+
+	for _, prefix := range []string{"meta.tar", "rootfs.tar"} {
+		matches, err := filepath.Glob(filepath.Join(dir, prefix+"*"))
+		if err != nil || len(matches) == 0 {
+			return fmt.Errorf("Failed to find %q in %q", prefix, dir)
+		}
+
+		files[prefix] = matches[0]
+	}
+
+	logger.WithField("container", name).Info("Creating LXC container")
+
+	err := shared.RunCommand(ctx, nil, nil, "lxc-create", "-n", name, "-t", "local", "--", "--metadata", files["meta.tar"], "--fstree", files["rootfs.tar"])
+	if err != nil {
+		return fmt.Errorf("Failed to create container %q: %w", name, err)
+	}
+
+	defer func() {
+		// The build context may be cancelled already.
+		err := shared.RunCommand(context.Background(), nil, nil, "lxc-destroy", "-n", name, "-f")
+		if err != nil {
+			logger.WithFields(logrus.Fields{"container": name, "err": err}).Warn("Failed destroying container")
+		}
+	}()
+
+	err = shared.RunCommand(ctx, nil, nil, "lxc-start", "-n", name)
+	if err != nil {
+		return fmt.Errorf("Failed to start container %q: %w", name, err)
+	}
+
+	return verifyContainer(ctx, logger, func(ctx context.Context, script string) (string, error) {
+		var out strings.Builder
+
+		err := shared.RunCommand(ctx, nil, &out, "lxc-attach", "-n", name, "--", "/bin/sh", "-c", script)
+
+		return out.String(), err
+	})
+}
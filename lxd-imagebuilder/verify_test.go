@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_verifyContainer(t *testing.T) {
+	logger := logrus.New()
+
+	calls := 0
+
+	err := verifyContainer(context.Background(), logger, func(ctx context.Context, script string) (string, error) {
+		calls++
+		require.Equal(t, verifyScript, script)
+
+		if calls == 1 {
+			return "systemd is starting\n", errors.New("exit status 1")
+		}
+
+		return "", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	// The verification stops once the build is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err = verifyContainer(ctx, logger, func(ctx context.Context, script string) (string, error) {
+		cancel()
+
+		return "Network has no default route\n", errors.New("exit status 1")
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// verityRootHashPlaceholder stands in for the root hash on the kernel command
+// line until the hash tree is created at the end of the build. It has the
+// length of a SHA-256 root hash, so it can be replaced in place.
+var verityRootHashPlaceholder = strings.Repeat("0", 64)
+
+// verityHashSize returns the size of the dm-verity hash partition. It defaults
+// to 1/64 of the image size, which leaves room for the hash tree of a SHA-256
+// hash with 4KiB blocks.
+func (v *vm) verityHashSize() uint64 {
+	if v.verity.HashSize > 0 {
+		return v.verity.HashSize
+	}
+
+	size := alignUp(v.size/64, 1024*1024)
+
+	return max(size, 8*1024*1024)
+}
+
+// verityCmdline returns the kernel parameters which make the systemd based
+// initrd open the dm-verity protected root partition as /dev/mapper/root.
+func (v *vm) verityCmdline() ([]string, error) {
+	dataUUID, err := v.getRootfsPartitionUUID()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get PARTUUID of root partition: %w", err)
+	}
+
+	hashUUID, err := v.getPartitionUUID(3)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get PARTUUID of hash partition: %w", err)
+	}
+
+	rootHash := v.rootHash
+	if rootHash == "" {
+		rootHash = verityRootHashPlaceholder
+	}
+
+	return []string{
+		"root=/dev/mapper/root",
+		fmt.Sprintf("systemd.verity_root_data=PARTUUID=%s", dataUUID),
+		fmt.Sprintf("systemd.verity_root_hash=PARTUUID=%s", hashUUID),
+		fmt.Sprintf("roothash=%s", rootHash),
+	}, nil
+}
+
+// formatVerity creates the hash tree of the root partition. The root
+// partition must not be mounted, as it mustn't change afterwards.
+func (v *vm) formatVerity() error {
+	if v.verity == nil {
+		return nil
+	}
+
+	if v.loopDevice == "" {
+		return errors.New("Disk image not mounted")
+	}
+
+	var out strings.Builder
+
+	err := shared.RunCommand(v.ctx, nil, &out, "veritysetup", "format", v.getRootfsDevFile(), v.getVerityDevFile())
+	if err != nil {
+		return fmt.Errorf("Failed to create hash tree of %q: %w", v.getRootfsDevFile(), err)
+	}
+
+	v.rootHash, err = parseVerityRootHash(out.String())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// parseVerityRootHash returns the root hash from the output of veritysetup format.
+func parseVerityRootHash(out string) (string, error) {
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) != "Root hash" {
+			continue
+		}
+
+		rootHash := strings.TrimSpace(value)
+
+		// Only SHA-256 root hashes fit in place of the placeholder.
+		if len(rootHash) != len(verityRootHashPlaceholder) {
+			return "", fmt.Errorf("Unexpected root hash %q", rootHash)
+		}
+
+		return rootHash, nil
+	}
+
+	return "", errors.New("Root hash missing in veritysetup output")
+}
+
+// embedRootHash replaces the root hash placeholder on the kernel command line
+// of the boot artifacts in the given target directory, and of the unified
+// kernel images on the EFI system partition.
+func (v *vm) embedRootHash(targetDir string) error {
+	if v.verity == nil {
+		return nil
+	}
+
+	if v.rootHash == "" {
+		return errors.New("Root hash of the root partition is unknown")
+	}
+
+	if v.bootArtifacts != nil {
+		_, err := replaceRootHash(filepath.Join(targetDir, bootArtifactCmdline), v.rootHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	if v.bootloader == nil || v.bootloader.Type != "uki" {
+		return nil
+	}
+
+	mountpoint, err := os.MkdirTemp("", "lxd-imagebuilder-esp-")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory: %w", err)
+	}
+
+	defer os.Remove(mountpoint)
+
+	err = unix.Mount(v.getUEFIDevFile(), mountpoint, "vfat", 0, "")
+	if err != nil {
+		return fmt.Errorf("Failed to mount %q: %w", v.getUEFIDevFile(), err)
+	}
+
+	defer func() {
+		_ = unix.Unmount(mountpoint, 0)
+	}()
+
+	ukis, err := filepath.Glob(filepath.Join(mountpoint, "EFI", "Linux", "*.efi"))
+	if err != nil {
+		return fmt.Errorf("Failed to list unified kernel images: %w", err)
+	}
+
+	replaced := false
+
+	for _, uki := range ukis {
+		ok, err := replaceRootHash(uki, v.rootHash)
+		if err != nil {
+			return err
+		}
+
+		replaced = replaced || ok
+	}
+
+	if !replaced {
+		return errors.New("No unified kernel image with root hash placeholder found")
+	}
+
+	return unix.Unmount(mountpoint, 0)
+}
+
+// replaceRootHash replaces the root hash placeholder in the given file, and
+// returns whether it was found.
+func replaceRootHash(path string, rootHash string) (bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	placeholder := []byte("roothash=" + verityRootHashPlaceholder)
+
+	if !bytes.Contains(content, placeholder) {
+		return false, nil
+	}
+
+	content = bytes.ReplaceAll(content, placeholder, []byte("roothash="+rootHash))
+
+	err = os.WriteFile(path, content, 0644)
+	if err != nil {
+		return false, fmt.Errorf("Failed to write %q: %w", path, err)
+	}
+
+	return true, nil
+}
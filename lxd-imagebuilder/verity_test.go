@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_parseVerityRootHash(t *testing.T) {
+	rootHash := strings.Repeat("ab", 32)
+
+	out := `VERITY header information for /dev/loop0p3
+UUID:            	2c4d1a7e-1b8e-4d3c-9d8a-6c0e4f1a2b3c
+Hash type:       	1
+Data blocks:     	1048576
+Data block size: 	4096
+Hash block size: 	4096
+Hash algorithm:  	sha256
+Salt:            	7d0e0c2c8f1b4a6e9d3f5b2a1c8e7f6d5c4b3a2918070605040302010f0e0d0c
+Root hash:      	` + rootHash + "\n"
+
+	hash, err := parseVerityRootHash(out)
+	require.NoError(t, err)
+	require.Equal(t, rootHash, hash)
+
+	_, err = parseVerityRootHash("Root hash: abcd\n")
+	require.Error(t, err)
+
+	_, err = parseVerityRootHash("")
+	require.Error(t, err)
+}
+
+func Test_replaceRootHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cmdline")
+	rootHash := strings.Repeat("ab", 32)
+
+	err := os.WriteFile(path, []byte("root=/dev/mapper/root roothash="+verityRootHashPlaceholder+" ro\n"), 0644)
+	require.NoError(t, err)
+
+	ok, err := replaceRootHash(path, rootHash)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "root=/dev/mapper/root roothash="+rootHash+" ro\n", string(content))
+
+	ok, err = replaceRootHash(path, rootHash)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func Test_createPartitionsVerity(t *testing.T) {
+	imageFile := filepath.Join(t.TempDir(), "disk.img")
+	diskSize := uint64(1024 * 1024 * 1024)
+
+	err := os.WriteFile(imageFile, nil, 0600)
+	require.NoError(t, err)
+
+	err = os.Truncate(imageFile, int64(diskSize))
+	require.NoError(t, err)
+
+	v := vm{imageFile: imageFile, size: diskSize, rootFS: "ext4", esp: shared.DefinitionTargetLXDVMESP{Size: 8 * 1024 * 1024}, verity: &shared.DefinitionTargetLXDVMVerity{}}
+
+	err = v.createPartitions()
+	require.NoError(t, err)
+
+	f, err := os.Open(imageFile)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	_, entries, err := readGPT(f)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	// The hash partition takes up 1/64 of the disk after the root partition.
+	require.Equal(t, "Linux root verity", entries[2].name)
+	require.Greater(t, entries[2].firstLBA, entries[1].lastLBA)
+	require.Equal(t, uint64(16*1024*1024/gptSectorSize), entries[2].lastLBA-entries[2].firstLBA+1)
+
+	hashUUID, err := v.getPartitionUUID(3)
+	require.NoError(t, err)
+
+	cmdline, err := v.kernelCmdline("")
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "root=/dev/mapper/root ")
+	require.Contains(t, cmdline, "systemd.verity_root_hash=PARTUUID="+hashUUID)
+	require.Contains(t, cmdline, "roothash="+verityRootHashPlaceholder)
+
+	v.rootHash = strings.Repeat("ab", 32)
+
+	cmdline, err = v.kernelCmdline("")
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "roothash="+v.rootHash)
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"slices"
 	"strconv"
@@ -13,38 +16,321 @@ import (
 	lxdShared "github.com/canonical/lxd/shared"
 	"golang.org/x/sys/unix"
 
+	"github.com/canonical/lxd-imagebuilder/image"
 	"github.com/canonical/lxd-imagebuilder/shared"
 )
 
+// cryptRootName is the name of the LUKS mapping of the root partition inside the image.
+const cryptRootName = "rootfs"
+
+// prepSize is the size of the PReP boot partition on POWER.
+const prepSize = 8 * 1024 * 1024
+
 type vm struct {
-	imageFile  string
-	loopDevice string
-	rootFS     string
-	rootfsDir  string
-	size       uint64
-	ctx        context.Context
+	imageFile           string
+	loopDevice          string
+	rootFS              string
+	rootfsDir           string
+	architecture        string
+	size                uint64
+	fsOptions           map[string]string
+	btrfs               shared.DefinitionTargetLXDVMBtrfs
+	encryption          *shared.DefinitionTargetLXDVMEncryption
+	cryptName           string
+	esp                 shared.DefinitionTargetLXDVMESP
+	prep                bool
+	partitions          map[string]shared.DefinitionTargetLXDVMPartition
+	swap                *shared.DefinitionTargetLXDVMSwap
+	lvm                 *shared.DefinitionTargetLXDVMLVM
+	lvmActive           bool
+	zfs                 *shared.DefinitionTargetLXDVMZFS
+	zfsActive           bool
+	growRoot            bool
+	bootArtifacts       *shared.DefinitionTargetLXDVMBootArtifacts
+	bootloader          *shared.DefinitionTargetLXDVMBootloader
+	kernelCmdlineConfig *shared.DefinitionTargetLXDVMKernelCmdline
+	ukiCmdline          string
+	verity              *shared.DefinitionTargetLXDVMVerity
+	rootHash            string
+	shrink              string
+	zerofree            bool
+	rootfsSize          uint64
+	devNodes            []string
+	disks               []shared.DefinitionTargetLXDVMDisk
+	skipChecks          bool
+	userspace           bool
+	guestfs             bool
+	ctx                 context.Context
 }
 
-func newVM(ctx context.Context, imageFile, rootfsDir, fs string, size uint64) (*vm, error) {
+// newVM returns the VM image of the given config. The rootfs is mounted at
+// rootfsDir, and auto-sized images are sized to hold the rootfs at sourceDir.
+func newVM(ctx context.Context, imageFile, rootfsDir, sourceDir, architecture string, config shared.DefinitionTargetLXDVM) (*vm, error) {
+	fs := config.Filesystem
 	if fs == "" {
 		fs = "ext4"
 	}
 
-	if !slices.Contains([]string{"btrfs", "ext4"}, fs) {
+	if !slices.Contains([]string{"btrfs", "ext4", "f2fs", "zfs"}, fs) {
 		return nil, fmt.Errorf("Unsupported fs: %s", fs)
 	}
 
+	size := config.Size.Bytes
 	if size == 0 {
 		size = 4294967296
 	}
 
-	return &vm{ctx: ctx, imageFile: imageFile, rootfsDir: rootfsDir, rootFS: fs, size: size}, nil
+	esp := config.ESP
+	if esp.Size == 0 {
+		esp.Size = 104857600
+	}
+
+	if esp.Label == "" {
+		esp.Label = "UEFI"
+	}
+
+	if esp.FAT == 0 {
+		esp.FAT = 32
+	}
+
+	if config.Swap != nil {
+		_, err := exec.LookPath("mkswap")
+		if err != nil {
+			return nil, errors.New("Required tool \"mkswap\" is missing")
+		}
+	}
+
+	if config.Encryption != nil {
+		_, err := exec.LookPath("cryptsetup")
+		if err != nil {
+			return nil, errors.New("Required tool \"cryptsetup\" is missing")
+		}
+	}
+
+	if config.LVM != nil {
+		for _, dep := range []string{"pvcreate", "vgcreate", "lvcreate", "vgchange", "mkswap"} {
+			_, err := exec.LookPath(dep)
+			if err != nil {
+				return nil, fmt.Errorf("Required tool %q is missing", dep)
+			}
+		}
+
+		// The volume group is activated on the build host, so its name must not clash.
+		err := shared.RunCommand(ctx, nil, io.Discard, "vgs", config.LVM.VolumeGroup)
+		if err == nil {
+			return nil, fmt.Errorf("Volume group %q already exists on the host", config.LVM.VolumeGroup)
+		}
+	}
+
+	if fs == "f2fs" {
+		_, err := exec.LookPath("mkfs.f2fs")
+		if err != nil {
+			return nil, errors.New("Required tool \"mkfs.f2fs\" is missing")
+		}
+	}
+
+	if fs == "zfs" {
+		for _, dep := range []string{"zpool", "zfs"} {
+			_, err := exec.LookPath(dep)
+			if err != nil {
+				return nil, fmt.Errorf("Required tool %q is missing", dep)
+			}
+		}
+
+		// The pool is imported on the build host, so its name must not clash.
+		err := shared.RunCommand(ctx, nil, io.Discard, "zpool", "list", "-H", config.ZFS.Pool)
+		if err == nil {
+			return nil, fmt.Errorf("ZFS pool %q already exists on the host", config.ZFS.Pool)
+		}
+	}
+
+	if config.Verity != nil {
+		_, err := exec.LookPath("veritysetup")
+		if err != nil {
+			return nil, errors.New("Required tool \"veritysetup\" is missing")
+		}
+	}
+
+	if config.Shrink == "minimal" {
+		for _, dep := range []string{"e2fsck", "resize2fs", "dumpe2fs"} {
+			_, err := exec.LookPath(dep)
+			if err != nil {
+				return nil, fmt.Errorf("Required tool %q is missing", dep)
+			}
+		}
+	}
+
+	// The seed is created after the image, so check for the tools upfront.
+	if config.Seed != nil {
+		found := slices.ContainsFunc(image.SeedTools, func(name string) bool {
+			_, err := exec.LookPath(name)
+			return err == nil
+		})
+
+		if !found {
+			return nil, fmt.Errorf("One of %s is required to create the seed", strings.Join(image.SeedTools, ", "))
+		}
+	}
+
+	diskTools := map[string]string{"btrfs": "mkfs.btrfs", "ext4": "mkfs.ext4", "swap": "mkswap", "vfat": "mkfs.vfat", "xfs": "mkfs.xfs"}
+
+	for _, disk := range config.Disks {
+		deps := []string{diskTools[disk.Filesystem]}
+
+		if disk.Type == "seed" {
+			deps = []string{"mkfs.vfat", "mcopy"}
+		}
+
+		for _, dep := range deps {
+			if dep == "" {
+				continue
+			}
+
+			_, err := exec.LookPath(dep)
+			if err != nil {
+				return nil, fmt.Errorf("Required tool %q is missing", dep)
+			}
+		}
+	}
+
+	if !config.SkipChecks {
+		deps := []string{"fsck.vfat", "e2fsck"}
+
+		if fs == "btrfs" {
+			deps = append(deps, "btrfs")
+		}
+
+		if fs == "f2fs" {
+			deps = append(deps, "fsck.f2fs")
+		}
+
+		for _, dep := range deps {
+			_, err := exec.LookPath(dep)
+			if err != nil {
+				return nil, fmt.Errorf("Required tool %q is missing", dep)
+			}
+		}
+	}
+
+	if config.Backend == "userspace" || config.Backend == "guestfs" {
+		deps := []string{"mkfs.vfat", "mcopy", "mkfs.ext4"}
+
+		if fs == "btrfs" {
+			deps = []string{"mkfs.vfat", "mcopy", "mkfs.btrfs"}
+		}
+
+		// The root file system is created inside of the libguestfs appliance.
+		if config.Backend == "guestfs" {
+			deps = []string{"mkfs.vfat", "mcopy", "guestfish", "tar"}
+		}
+
+		for _, dep := range deps {
+			_, err := exec.LookPath(dep)
+			if err != nil {
+				return nil, fmt.Errorf("Required tool %q is missing", dep)
+			}
+		}
+	}
+
+	var btrfs shared.DefinitionTargetLXDVMBtrfs
+
+	if fs == "btrfs" {
+		if config.Btrfs != nil {
+			btrfs = *config.Btrfs
+		}
+
+		btrfs.Subvolumes = config.GetBtrfsSubvolumes()
+	}
+
+	v := &vm{ctx: ctx, imageFile: imageFile, rootfsDir: rootfsDir, architecture: architecture, rootFS: fs, size: size, fsOptions: config.FilesystemOptions, btrfs: btrfs, encryption: config.Encryption, esp: esp, prep: architecture == "ppc64le", partitions: config.Partitions, swap: config.Swap, lvm: config.LVM, zfs: config.ZFS, growRoot: config.GrowRoot, shrink: config.Shrink, bootArtifacts: config.BootArtifacts, bootloader: config.Bootloader, kernelCmdlineConfig: config.KernelCmdline, verity: config.Verity, disks: config.Disks, skipChecks: config.SkipChecks, userspace: config.Backend == "userspace" || config.Backend == "guestfs", guestfs: config.Backend == "guestfs"}
+
+	if config.Size.Auto {
+		var err error
+
+		v.size, err = v.autoSize(sourceDir, config.SizeHeadroom)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to calculate image size: %w", err)
+		}
+	}
+
+	if v.esp.Size >= v.size {
+		return nil, fmt.Errorf("EFI system partition size %d exceeds image size %d", v.esp.Size, v.size)
+	}
+
+	// The logical volumes need to fit into the root partition, which holds the
+	// LVM metadata and the LUKS header as well.
+	if v.lvm != nil {
+		volumes := v.lvm.RootSize + v.lvm.SwapSize + v.lvm.DataSize
+		used := 2*gptAlignment*gptSectorSize + v.esp.Size + lvmMetadataSize + volumes
+
+		if v.prep {
+			used += prepSize
+		}
+
+		if v.swap != nil && v.swap.Type == "partition" {
+			used += v.swap.Size
+		}
+
+		if v.encryption != nil {
+			used += luksHeaderSize
+		}
+
+		if used > v.size {
+			return nil, fmt.Errorf("Logical volumes size %d exceeds image size %d", volumes, v.size)
+		}
+	}
+
+	return v, nil
 }
 
 func (v *vm) getLoopDev() string {
 	return v.loopDevice
 }
 
+// getRootDevFile returns the device holding the root filesystem. This is the
+// root logical volume if LVM is used, or the opened LUKS mapping if the root
+// partition is encrypted.
+func (v *vm) getRootDevFile() string {
+	if v.lvmActive {
+		return v.getLVDevFile("root")
+	}
+
+	return v.getPVDevFile()
+}
+
+// getPVDevFile returns the device which is used as LVM physical volume.
+func (v *vm) getPVDevFile() string {
+	if v.cryptName != "" {
+		return filepath.Join("/dev/mapper", v.cryptName)
+	}
+
+	return v.getRootfsDevFile()
+}
+
+// getLVDevFile returns the device of the given logical volume.
+func (v *vm) getLVDevFile(name string) string {
+	return filepath.Join("/dev", v.lvm.VolumeGroup, name)
+}
+
+// getLVDevFiles returns the devices of all logical volumes.
+func (v *vm) getLVDevFiles() []string {
+	if !v.lvmActive {
+		return nil
+	}
+
+	devs := []string{v.getLVDevFile("root")}
+
+	if v.lvm.SwapSize > 0 {
+		devs = append(devs, v.getLVDevFile("swap"))
+	}
+
+	if v.lvm.DataSize > 0 {
+		devs = append(devs, v.getLVDevFile("data"))
+	}
+
+	return devs
+}
+
 func (v *vm) getRootfsDevFile() string {
 	if v.loopDevice == "" {
 		return ""
@@ -61,6 +347,59 @@ func (v *vm) getUEFIDevFile() string {
 	return fmt.Sprintf("%sp1", v.loopDevice)
 }
 
+// getSwapDevFile returns the swap partition, or an empty string if there's none.
+func (v *vm) getSwapDevFile() string {
+	if v.loopDevice == "" || v.swap == nil || v.swap.Type != "partition" {
+		return ""
+	}
+
+	return fmt.Sprintf("%sp3", v.loopDevice)
+}
+
+// getPRePDevFile returns the PReP boot partition, or an empty string if there's none.
+func (v *vm) getPRePDevFile() string {
+	if v.loopDevice == "" || !v.prep {
+		return ""
+	}
+
+	if v.getSwapDevFile() != "" || v.getVerityDevFile() != "" {
+		return fmt.Sprintf("%sp4", v.loopDevice)
+	}
+
+	return fmt.Sprintf("%sp3", v.loopDevice)
+}
+
+// getVerityDevFile returns the dm-verity hash partition, or an empty string if there's none.
+func (v *vm) getVerityDevFile() string {
+	if v.loopDevice == "" || v.verity == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%sp3", v.loopDevice)
+}
+
+// getRootfsPartitionUUID returns the PARTUUID of the root partition.
+func (v *vm) getRootfsPartitionUUID() (string, error) {
+	return v.getPartitionUUID(2)
+}
+
+// getPartitionUUID reads the PARTUUID of the given partition from the partition table of the image.
+func (v *vm) getPartitionUUID(partition int) (string, error) {
+	f, err := os.Open(v.imageFile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open %s: %w", v.imageFile, err)
+	}
+
+	defer f.Close()
+
+	uuid, err := getGPTPartitionUUID(f, partition)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get UUID of partition %d: %w", partition, err)
+	}
+
+	return uuid, nil
+}
+
 func (v *vm) createEmptyDiskImage() error {
 	f, err := os.Create(v.imageFile)
 	if err != nil {
@@ -83,20 +422,164 @@ func (v *vm) createEmptyDiskImage() error {
 }
 
 func (v *vm) createPartitions() error {
-	args := [][]string{
-		{"--zap-all"},
-		{"--new=1::+100M", "-t 1:EF00"},
-		{"--new=2::", "-t 2:8300"},
+	partitions := []gptPartition{
+		v.gptPartition("esp", gptTypeEFISystem, "EFI System", v.esp.Size),
+	}
+
+	// The PReP boot partition holds the boot loader on POWER. It's placed in
+	// front of the root partition, so the latter can still grow or shrink.
+	if v.prep {
+		partitions = append(partitions, v.gptPartition("prep", gptTypePReP, "PowerPC PReP boot", prepSize))
+	}
+
+	partitions = append(partitions, v.gptPartition("root", v.rootPartitionType(), "Linux filesystem", 0))
+
+	// The hash partition follows the root partition, which can't be resized
+	// once the hash tree has been created.
+	if v.verity != nil {
+		partitions = append(partitions, v.gptPartition("verity", gptTypeLinuxFS, "Linux root verity", v.verityHashSize()))
+	}
+
+	// The swap partition is placed at the end of the disk.
+	if v.swap != nil && v.swap.Type == "partition" {
+		partitions = append(partitions, v.gptPartition("swap", gptTypeLinuxSwap, "Linux swap", v.swap.Size))
+	}
+
+	entries, err := gptLayout(v.size, partitions)
+	if err != nil {
+		return fmt.Errorf("Failed to create partitions: %w", err)
+	}
+
+	// The PReP boot partition is the last entry of the partition table, so the
+	// numbers of the other partitions are the same on all architectures.
+	if v.prep {
+		prep := entries[1]
+		entries = append(slices.Delete(entries, 1, 2), prep)
+	}
+
+	diskGUID, err := randomGUID()
+	if err != nil {
+		return fmt.Errorf("Failed to generate GUID: %w", err)
+	}
+
+	f, err := os.OpenFile(v.imageFile, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %w", v.imageFile, err)
+	}
+
+	defer f.Close()
+
+	err = writeGPTEntries(f, v.size, diskGUID, entries)
+	if err != nil {
+		return fmt.Errorf("Failed to create partitions: %w", err)
+	}
+
+	return f.Close()
+}
+
+// waitForPartitions waits until the kernel has picked up the first count
+// partitions of the image, and returns their device numbers. The partitions
+// must match the partition table of the image, and the first two must be the
+// EFI system and root partitions.
+func (v *vm) waitForPartitions(count int) ([]uint64, error) {
+	f, err := os.Open(v.imageFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %q: %w", v.imageFile, err)
+	}
+
+	defer f.Close()
+
+	_, entries, err := readGPT(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read partition table of %q: %w", v.imageFile, err)
+	}
+
+	if len(entries) < count {
+		return nil, fmt.Errorf("Partition table of %q has %d partitions instead of %d", v.imageFile, len(entries), count)
 	}
 
-	for _, cmd := range args {
-		err := shared.RunCommand(v.ctx, nil, nil, "sgdisk", append([]string{v.imageFile}, cmd...)...)
+	for i, partition := range []struct {
+		typeGUID string
+		name     string
+	}{
+		{typeGUID: v.partitionType("esp", gptTypeEFISystem), name: "EFI system partition"},
+		{typeGUID: v.rootPartitionType(), name: "root partition"},
+	} {
+		typeGUID, err := parseGUID(partition.typeGUID)
 		if err != nil {
-			return fmt.Errorf("Failed to create partitions: %w", err)
+			return nil, err
+		}
+
+		if entries[i].typeGUID != typeGUID {
+			return nil, fmt.Errorf("Partition %d of %q isn't the %s", i+1, v.imageFile, partition.name)
 		}
 	}
 
-	return nil
+	devs := make([]uint64, count)
+
+	err = retryWithBackoff(loopPartitionTimeout, func() error {
+		for i := range devs {
+			partition, err := getLoopPartition(v.loopDevice, i+1)
+			if err != nil {
+				return err
+			}
+
+			// The kernel may still see the partitions of a previous image
+			// attached to the loop device.
+			if partition.start != entries[i].firstLBA || partition.size != entries[i].lastLBA-entries[i].firstLBA+1 {
+				return fmt.Errorf("Partition %d of %q doesn't match the partition table of %q", i+1, v.loopDevice, v.imageFile)
+			}
+
+			devs[i] = partition.dev
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Partitions of %q aren't available: %w", v.loopDevice, err)
+	}
+
+	return devs, nil
+}
+
+// gptPartition returns the given partition, with the type, name and
+// attributes of targets.lxd.vm.partitions applied.
+func (v *vm) gptPartition(key string, typeGUID string, name string, size uint64) gptPartition {
+	partition := gptPartition{typeGUID: v.partitionType(key, typeGUID), name: name, size: size}
+
+	config, ok := v.partitions[key]
+	if ok {
+		if config.Name != "" {
+			partition.name = config.Name
+		}
+
+		partition.attributes = config.GetAttributes()
+	}
+
+	return partition
+}
+
+// partitionType returns the type of the given partition of
+// targets.lxd.vm.partitions, or the default type if unset.
+func (v *vm) partitionType(key string, defaultType string) string {
+	config, ok := v.partitions[key]
+	if ok && config.Type != "" {
+		return config.GetType()
+	}
+
+	return defaultType
+}
+
+// rootPartitionType returns the partition type of the root partition.
+func (v *vm) rootPartitionType() string {
+	// The architecture specific type lets systemd-gpt-auto-generator find the
+	// root partition if the kernel command line has no root= parameter, e.g.
+	// when U-Boot or EDK2 boot the kernel through its EFI stub.
+	if v.architecture == "riscv64" {
+		return v.partitionType("root", gptTypeRootRISCV64)
+	}
+
+	return v.partitionType("root", gptTypeLinuxFS)
 }
 
 func (v *vm) mountImage() error {
@@ -105,83 +588,109 @@ func (v *vm) mountImage() error {
 		return nil
 	}
 
-	var out strings.Builder
+	var err error
 
-	err := shared.RunCommand(v.ctx, nil, &out, "losetup", "-P", "-f", "--show", v.imageFile)
+	v.loopDevice, err = attachLoopDevice(v.imageFile)
 	if err != nil {
 		return fmt.Errorf("Failed to setup loop device: %w", err)
 	}
 
-	v.loopDevice = strings.TrimSpace(out.String())
+	partitions := []string{v.getUEFIDevFile(), v.getRootfsDevFile()}
 
-	out.Reset()
+	if v.getSwapDevFile() != "" {
+		partitions = append(partitions, v.getSwapDevFile())
+	}
 
-	// Ensure the partitions are accessible. This part is usually only needed
-	// if building inside of a container.
-	err = shared.RunCommand(v.ctx, nil, &out, "lsblk", "--raw", "--output", "MAJ:MIN", "--noheadings", v.loopDevice)
-	if err != nil {
-		return fmt.Errorf("Failed to list block devices: %w", err)
+	if v.getVerityDevFile() != "" {
+		partitions = append(partitions, v.getVerityDevFile())
 	}
 
-	deviceNumbers := strings.Split(out.String(), "\n")
+	if v.getPRePDevFile() != "" {
+		partitions = append(partitions, v.getPRePDevFile())
+	}
 
-	if !lxdShared.PathExists(v.getUEFIDevFile()) {
-		fields := strings.Split(deviceNumbers[1], ":")
+	settleUdev()
 
-		major, err := strconv.Atoi(fields[0])
-		if err != nil {
-			return fmt.Errorf("Failed to parse %q: %w", fields[0], err)
-		}
+	devs, err := v.waitForPartitions(len(partitions))
+	if err != nil {
+		return err
+	}
 
-		minor, err := strconv.Atoi(fields[1])
-		if err != nil {
-			return fmt.Errorf("Failed to parse %q: %w", fields[1], err)
+	// Ensure the partitions are accessible. This part is usually only needed
+	// if building inside of a container. Nodes left over from a previous use
+	// of the loop device may point to another device, and are replaced.
+	for i, partition := range partitions {
+		var stat unix.Stat_t
+
+		err := unix.Stat(partition, &stat)
+		if err == nil && stat.Mode&unix.S_IFMT == unix.S_IFBLK && uint64(stat.Rdev) == devs[i] {
+			continue
 		}
 
-		dev := unix.Mkdev(uint32(major), uint32(minor))
+		if err == nil {
+			err := os.Remove(partition)
+			if err != nil {
+				return fmt.Errorf("Failed to remove stale block device %q: %w", partition, err)
+			}
+		}
 
-		err = unix.Mknod(v.getUEFIDevFile(), unix.S_IFBLK|0644, int(dev))
+		err = unix.Mknod(partition, unix.S_IFBLK|0644, int(devs[i]))
 		if err != nil {
-			return fmt.Errorf("Failed to create block device %q: %w", v.getUEFIDevFile(), err)
+			return fmt.Errorf("Failed to create block device %q: %w", partition, shared.LXDConfigError(err, "security.privileged=true"))
 		}
+
+		v.devNodes = append(v.devNodes, partition)
 	}
 
-	if !lxdShared.PathExists(v.getRootfsDevFile()) {
-		fields := strings.Split(deviceNumbers[2], ":")
+	// Record the loop device, so it's cleaned up if the build is interrupted
+	// before unmounting the image.
+	return v.saveState()
+}
 
-		major, err := strconv.Atoi(fields[0])
-		if err != nil {
-			return fmt.Errorf("Failed to parse %q: %w", fields[0], err)
-		}
+func (v *vm) umountImage() error {
+	// If loopDevice is empty, the image probably isn't mounted.
+	if v.loopDevice == "" || !lxdShared.PathExists(v.loopDevice) {
+		return nil
+	}
 
-		minor, err := strconv.Atoi(fields[1])
+	if v.zfsActive {
+		err := shared.RunCommand(v.ctx, nil, nil, "zpool", "export", v.zfs.Pool)
 		if err != nil {
-			return fmt.Errorf("Failed to parse %q: %w", fields[1], err)
+			return fmt.Errorf("Failed to export ZFS pool %q: %w", v.zfs.Pool, err)
 		}
 
-		dev := unix.Mkdev(uint32(major), uint32(minor))
+		v.zfsActive = false
+	}
 
-		err = unix.Mknod(v.getRootfsDevFile(), unix.S_IFBLK|0644, int(dev))
+	if v.lvmActive {
+		err := shared.RunCommand(v.ctx, nil, nil, "vgchange", "-an", v.lvm.VolumeGroup)
 		if err != nil {
-			return fmt.Errorf("Failed to create block device %q: %w", v.getRootfsDevFile(), err)
+			return fmt.Errorf("Failed to deactivate volume group %q: %w", v.lvm.VolumeGroup, err)
 		}
+
+		v.lvmActive = false
 	}
 
-	return nil
-}
+	if v.cryptName != "" {
+		err := shared.RunCommand(v.ctx, nil, nil, "cryptsetup", "close", v.cryptName)
+		if err != nil {
+			return fmt.Errorf("Failed to close LUKS device %q: %w", v.cryptName, err)
+		}
 
-func (v *vm) umountImage() error {
-	// If loopDevice is empty, the image probably isn't mounted.
-	if v.loopDevice == "" || !lxdShared.PathExists(v.loopDevice) {
-		return nil
+		v.cryptName = ""
 	}
 
-	err := shared.RunCommand(v.ctx, nil, nil, "losetup", "-d", v.loopDevice)
+	err := detachLoopDevice(v.loopDevice)
 	if err != nil {
 		return fmt.Errorf("Failed to detach loop device: %w", err)
 	}
 
-	// Make sure that p1 and p2 are also removed.
+	err = v.removeState(v.loopDevice)
+	if err != nil {
+		return err
+	}
+
+	// Make sure that the partition devices are also removed.
 	if lxdShared.PathExists(v.getUEFIDevFile()) {
 		err := os.Remove(v.getUEFIDevFile())
 		if err != nil {
@@ -196,37 +705,628 @@ func (v *vm) umountImage() error {
 		}
 	}
 
-	v.loopDevice = ""
-
-	return nil
-}
+	if v.getSwapDevFile() != "" && lxdShared.PathExists(v.getSwapDevFile()) {
+		err := os.Remove(v.getSwapDevFile())
+		if err != nil {
+			return fmt.Errorf("Failed to remove file %q: %w", v.getSwapDevFile(), err)
+		}
+	}
 
-func (v *vm) createRootFS() error {
-	if v.loopDevice == "" {
-		return errors.New("Disk image not mounted")
+	if v.getVerityDevFile() != "" && lxdShared.PathExists(v.getVerityDevFile()) {
+		err := os.Remove(v.getVerityDevFile())
+		if err != nil {
+			return fmt.Errorf("Failed to remove file %q: %w", v.getVerityDevFile(), err)
+		}
 	}
 
-	switch v.rootFS {
-	case "btrfs":
-		err := shared.RunCommand(v.ctx, nil, nil, "mkfs.btrfs", "-f", "-L", "rootfs", v.getRootfsDevFile())
+	if v.getPRePDevFile() != "" && lxdShared.PathExists(v.getPRePDevFile()) {
+		err := os.Remove(v.getPRePDevFile())
 		if err != nil {
-			return fmt.Errorf("Failed to create btrfs filesystem: %w", err)
+			return fmt.Errorf("Failed to remove file %q: %w", v.getPRePDevFile(), err)
 		}
+	}
+
+	v.loopDevice = ""
+	v.devNodes = nil
 
-		// Create the root subvolume as well
+	return nil
+}
 
-		err = shared.RunCommand(v.ctx, nil, nil, "mount", "-t", v.rootFS, v.getRootfsDevFile(), v.rootfsDir)
+// getKey returns the key used to format and open the encrypted root partition.
+func (v *vm) getKey() ([]byte, error) {
+	if v.encryption.Keyfile != "" {
+		key, err := os.ReadFile(v.encryption.Keyfile)
 		if err != nil {
-			return fmt.Errorf("Failed to mount %q at %q: %w", v.getRootfsDevFile(), v.rootfsDir, err)
+			return nil, fmt.Errorf("Failed to read keyfile %q: %w", v.encryption.Keyfile, err)
 		}
 
-		defer func() {
+		return key, nil
+	}
+
+	return []byte(v.encryption.Passphrase), nil
+}
+
+// encryptRootPartition formats the root partition as LUKS2 and opens it.
+func (v *vm) encryptRootPartition() error {
+	if v.loopDevice == "" {
+		return errors.New("Disk image not mounted")
+	}
+
+	if v.encryption == nil {
+		return nil
+	}
+
+	key, err := v.getKey()
+	if err != nil {
+		return err
+	}
+
+	err = shared.RunCommand(v.ctx, bytes.NewReader(key), nil, "cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", v.getRootfsDevFile())
+	if err != nil {
+		return fmt.Errorf("Failed to format LUKS partition: %w", err)
+	}
+
+	cryptName := fmt.Sprintf("lxd-imagebuilder-%s", filepath.Base(v.loopDevice))
+
+	err = shared.RunCommand(v.ctx, bytes.NewReader(key), nil, "cryptsetup", "open", "--key-file", "-", v.getRootfsDevFile(), cryptName)
+	if err != nil {
+		return fmt.Errorf("Failed to open LUKS partition: %w", err)
+	}
+
+	v.cryptName = cryptName
+
+	return v.saveState()
+}
+
+// configureEncryption writes the crypttab and initramfs configuration needed
+// to unlock the root partition on boot.
+func (v *vm) configureEncryption() error {
+	if v.cryptName == "" {
+		return nil
+	}
+
+	var out strings.Builder
+
+	err := shared.RunCommand(v.ctx, nil, &out, "cryptsetup", "luksUUID", v.getRootfsDevFile())
+	if err != nil {
+		return fmt.Errorf("Failed to get LUKS UUID: %w", err)
+	}
+
+	uuid := strings.TrimSpace(out.String())
+
+	err = os.MkdirAll(filepath.Join(v.rootfsDir, "etc"), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Join(v.rootfsDir, "etc"), err)
+	}
+
+	crypttab := filepath.Join(v.rootfsDir, "etc", "crypttab")
+
+	err = os.WriteFile(crypttab, []byte(fmt.Sprintf("%s UUID=%s none luks,discard,initramfs\n", cryptRootName, uuid)), 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", crypttab, err)
+	}
+
+	// Make sure the crypt modules end up in the initramfs on dracut based distributions.
+	if lxdShared.PathExists(filepath.Join(v.rootfsDir, "etc", "dracut.conf.d")) {
+		dracutConf := filepath.Join(v.rootfsDir, "etc", "dracut.conf.d", "lxd-imagebuilder-crypt.conf")
+
+		err = os.WriteFile(dracutConf, []byte(fmt.Sprintf("add_dracutmodules+=\" crypt \"\nkernel_cmdline+=\" rd.luks.uuid=%s \"\n", uuid)), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", dracutConf, err)
+		}
+	}
+
+	// Make sure cryptsetup is added to the initramfs on Debian based distributions.
+	confHook := filepath.Join(v.rootfsDir, "etc", "cryptsetup-initramfs", "conf-hook")
+
+	if lxdShared.PathExists(confHook) {
+		err = shared.AppendToFile(confHook, "CRYPTSETUP=y\n")
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", confHook, err)
+		}
+	}
+
+	return nil
+}
+
+// createSwap formats the swap partition.
+func (v *vm) createSwap() error {
+	if v.loopDevice == "" {
+		return errors.New("Disk image not mounted")
+	}
+
+	if v.getSwapDevFile() == "" {
+		return nil
+	}
+
+	return shared.RunCommand(v.ctx, nil, nil, "mkswap", "-L", "swap", v.getSwapDevFile())
+}
+
+// configureSwap creates the swap file if needed, and adds the swap space to /etc/fstab.
+func (v *vm) configureSwap() error {
+	if v.swap == nil {
+		return nil
+	}
+
+	var entry string
+
+	if v.swap.Type == "partition" {
+		uuid, err := getDeviceFilesystemUUID(v.getSwapDevFile())
+		if err != nil {
+			return fmt.Errorf("Failed to get UUID of swap partition: %w", err)
+		}
+
+		entry = fmt.Sprintf("UUID=%s  none  swap  sw  0 0\n", uuid)
+	} else {
+		err := v.createSwapFile()
+		if err != nil {
+			return fmt.Errorf("Failed to create swap file: %w", err)
+		}
+
+		entry = fmt.Sprintf("%s  none  swap  sw  0 0\n", v.swap.Path)
+	}
+
+	fstab := filepath.Join(v.rootfsDir, "etc", "fstab")
+
+	if !lxdShared.PathExists(fstab) {
+		err := os.WriteFile(fstab, []byte(entry), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", fstab, err)
+		}
+
+		return nil
+	}
+
+	err := shared.AppendToFile(fstab, entry)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", fstab, err)
+	}
+
+	return nil
+}
+
+// configureDisks adds the additional disks of the VM image to fstab, and
+// creates their mountpoints. They're mounted by label with nofail, so the VM
+// still boots if a disk isn't attached.
+func (v *vm) configureDisks() error {
+	var entries strings.Builder
+
+	for _, disk := range v.disks {
+		if disk.Filesystem == "swap" {
+			fmt.Fprintf(&entries, "LABEL=%s  none  swap  sw,nofail  0 0\n", disk.Label)
+			continue
+		}
+
+		if disk.Mountpoint == "" {
+			continue
+		}
+
+		path := filepath.Join(v.rootfsDir, disk.Mountpoint)
+
+		err := os.MkdirAll(path, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", path, err)
+		}
+
+		fmt.Fprintf(&entries, "LABEL=%s  %s  %s  defaults,nofail  0 2\n", disk.Label, disk.Mountpoint, disk.Filesystem)
+	}
+
+	if entries.Len() == 0 {
+		return nil
+	}
+
+	fstab := filepath.Join(v.rootfsDir, "etc", "fstab")
+
+	if !lxdShared.PathExists(fstab) {
+		err := os.WriteFile(fstab, []byte(entries.String()), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", fstab, err)
+		}
+
+		return nil
+	}
+
+	err := shared.AppendToFile(fstab, entries.String())
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", fstab, err)
+	}
+
+	return nil
+}
+
+// createSwapFile creates and formats the swap file inside the root filesystem.
+func (v *vm) createSwapFile() error {
+	path := filepath.Join(v.rootfsDir, v.swap.Path)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	// Swap files on btrfs must not be copy-on-write, which can only be set on empty files.
+	if v.rootFS == "btrfs" {
+		err = shared.RunCommand(v.ctx, nil, nil, "chattr", "+C", path)
+		if err != nil {
+			return fmt.Errorf("Failed to disable copy-on-write for %q: %w", path, err)
+		}
+	}
+
+	err = unix.Fallocate(int(f.Fd()), 0, 0, int64(v.swap.Size))
+	if err != nil {
+		return fmt.Errorf("Failed to allocate %q: %w", path, err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to close %q: %w", path, err)
+	}
+
+	return shared.RunCommand(v.ctx, nil, nil, "mkswap", path)
+}
+
+// createLVM creates the LVM physical volume, volume group and logical volumes.
+func (v *vm) createLVM() error {
+	if v.loopDevice == "" {
+		return errors.New("Disk image not mounted")
+	}
+
+	if v.lvm == nil {
+		return nil
+	}
+
+	err := shared.RunCommand(v.ctx, nil, nil, "pvcreate", "-ff", "-y", v.getPVDevFile())
+	if err != nil {
+		return fmt.Errorf("Failed to create physical volume: %w", err)
+	}
+
+	err = shared.RunCommand(v.ctx, nil, nil, "vgcreate", v.lvm.VolumeGroup, v.getPVDevFile())
+	if err != nil {
+		return fmt.Errorf("Failed to create volume group %q: %w", v.lvm.VolumeGroup, err)
+	}
+
+	v.lvmActive = true
+
+	err = v.saveState()
+	if err != nil {
+		return err
+	}
+
+	volumes := []struct {
+		name string
+		size uint64
+	}{
+		{"swap", v.lvm.SwapSize},
+		{"data", v.lvm.DataSize},
+		{"root", v.lvm.RootSize},
+	}
+
+	// The root volume is created last so that it can take up the remaining space.
+	for _, volume := range volumes {
+		var sizeArg string
+
+		if volume.size > 0 {
+			sizeArg = fmt.Sprintf("--size=%db", volume.size)
+		} else if volume.name == "root" {
+			sizeArg = "--extents=100%FREE"
+		} else {
+			continue
+		}
+
+		err = shared.RunCommand(v.ctx, nil, nil, "lvcreate", "--yes", "--wipesignatures", "y", sizeArg, "--name", volume.name, v.lvm.VolumeGroup)
+		if err != nil {
+			return fmt.Errorf("Failed to create logical volume %q: %w", volume.name, err)
+		}
+	}
+
+	if v.lvm.SwapSize > 0 {
+		err = shared.RunCommand(v.ctx, nil, nil, "mkswap", "-L", "swap", v.getLVDevFile("swap"))
+		if err != nil {
+			return fmt.Errorf("Failed to create swap: %w", err)
+		}
+	}
+
+	if v.lvm.DataSize > 0 {
+		err = shared.RunCommand(v.ctx, nil, nil, "mkfs.ext4", "-F", "-L", "data", v.getLVDevFile("data"))
+		if err != nil {
+			return fmt.Errorf("Failed to create data filesystem: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// configureLVM writes the initramfs configuration needed to activate the root
+// logical volume on boot.
+func (v *vm) configureLVM() error {
+	if !v.lvmActive {
+		return nil
+	}
+
+	// Make sure the lvm module ends up in the initramfs on dracut based distributions.
+	if lxdShared.PathExists(filepath.Join(v.rootfsDir, "etc", "dracut.conf.d")) {
+		dracutConf := filepath.Join(v.rootfsDir, "etc", "dracut.conf.d", "lxd-imagebuilder-lvm.conf")
+
+		err := os.WriteFile(dracutConf, []byte(fmt.Sprintf("add_dracutmodules+=\" lvm \"\nkernel_cmdline+=\" rd.lvm.lv=%s/root \"\n", v.lvm.VolumeGroup)), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", dracutConf, err)
+		}
+	}
+
+	return nil
+}
+
+func (v *vm) createRootFS() error {
+	if v.loopDevice == "" {
+		return errors.New("Disk image not mounted")
+	}
+
+	switch v.rootFS {
+	case "btrfs":
+		args := append([]string{"-f", "-L", "rootfs"}, v.btrfs.MkfsOptions...)
+
+		err := shared.RunCommand(v.ctx, nil, nil, "mkfs.btrfs", append(args, v.getRootDevFile())...)
+		if err != nil {
+			return fmt.Errorf("Failed to create btrfs filesystem: %w", err)
+		}
+
+		// Create the subvolumes as well
+
+		err = shared.RunCommand(v.ctx, nil, nil, "mount", "-t", v.rootFS, v.getRootDevFile(), v.rootfsDir)
+		if err != nil {
+			return fmt.Errorf("Failed to mount %q at %q: %w", v.getRootDevFile(), v.rootfsDir, err)
+		}
+
+		defer func() {
 			_ = shared.RunCommand(v.ctx, nil, nil, "umount", v.rootfsDir)
 		}()
 
-		return shared.RunCommand(v.ctx, nil, nil, "btrfs", "subvolume", "create", fmt.Sprintf("%s/@", v.rootfsDir))
+		for _, subvolume := range v.btrfs.Subvolumes {
+			err = shared.RunCommand(v.ctx, nil, nil, "btrfs", "subvolume", "create", filepath.Join(v.rootfsDir, subvolume.Name))
+			if err != nil {
+				return fmt.Errorf("Failed to create btrfs subvolume %q: %w", subvolume.Name, err)
+			}
+		}
+
+		return nil
 	case "ext4":
-		return shared.RunCommand(v.ctx, nil, nil, "mkfs.ext4", "-F", "-b", "4096", "-i 8192", "-m", "0", "-L", "rootfs", "-E", "resize=536870912", v.getRootfsDevFile())
+		return shared.RunCommand(v.ctx, nil, nil, "mkfs.ext4", append(ext4MkfsArgs(v.fsOptions), v.getRootDevFile())...)
+	case "f2fs":
+		return shared.RunCommand(v.ctx, nil, nil, "mkfs.f2fs", "-f", "-l", "rootfs", v.getRootDevFile())
+	case "zfs":
+		return v.createZFSPool()
+	}
+
+	return nil
+}
+
+// ext4MkfsArgs returns the mkfs.ext4 arguments for the given filesystem options.
+func ext4MkfsArgs(options map[string]string) []string {
+	get := func(key string, defaultValue string) string {
+		value, ok := options[key]
+		if !ok {
+			return defaultValue
+		}
+
+		return value
+	}
+
+	args := []string{"-F", "-b", get("block_size", "4096")}
+
+	inodeCount, ok := options["inode_count"]
+	if ok {
+		args = append(args, "-N", inodeCount)
+	} else {
+		args = append(args, "-i", get("inode_ratio", "8192"))
+	}
+
+	inodeSize, ok := options["inode_size"]
+	if ok {
+		args = append(args, "-I", inodeSize)
+	}
+
+	args = append(args, "-m", get("reserved_blocks", "0"), "-L", "rootfs")
+
+	extended := []string{fmt.Sprintf("resize=%s", get("resize", "536870912"))}
+
+	encoding, ok := options["encoding"]
+	if ok {
+		extended = append(extended, fmt.Sprintf("encoding=%s", encoding))
+	}
+
+	args = append(args, "-E", strings.Join(extended, ","))
+
+	features, ok := options["features"]
+	if ok {
+		args = append(args, "-O", features)
+	}
+
+	return args
+}
+
+// createZFSPool creates the ZFS pool and its datasets. The pool is imported
+// with the rootfs directory as altroot, so the datasets are mounted right away.
+func (v *vm) createZFSPool() error {
+	args := []string{"create", "-f",
+		"-o", "ashift=12",
+		"-o", "autotrim=on",
+		"-o", "cachefile=none",
+	}
+
+	// grub loads the kernel from /boot inside of the pool, and can't read
+	// pools using features it doesn't support. systemd-boot and UKIs load it
+	// from the EFI system partition instead.
+	if v.bootloader == nil || v.bootloader.Type == "" || v.bootloader.Type == "grub" {
+		args = append(args, "-o", "compatibility=grub2")
+	}
+
+	args = append(args,
+		"-O", "acltype=posixacl",
+		"-O", "compression=lz4",
+		"-O", "normalization=formD",
+		"-O", "relatime=on",
+		"-O", "xattr=sa",
+		"-O", "mountpoint=none",
+		"-R", v.rootfsDir,
+		v.zfs.Pool, v.getRootDevFile())
+
+	err := shared.RunCommand(v.ctx, nil, nil, "zpool", args...)
+	if err != nil {
+		return fmt.Errorf("Failed to create ZFS pool %q: %w", v.zfs.Pool, err)
+	}
+
+	v.zfsActive = true
+
+	err = v.saveState()
+	if err != nil {
+		return err
+	}
+
+	for _, dataset := range v.zfs.Datasets {
+		args := []string{"create"}
+
+		// Sort the properties to keep the command deterministic.
+		keys := shared.MapKeys(dataset.Properties)
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			args = append(args, "-o", fmt.Sprintf("%s=%s", key, dataset.Properties[key]))
+		}
+
+		if dataset.Mountpoint != "" {
+			args = append(args, "-o", fmt.Sprintf("mountpoint=%s", dataset.Mountpoint))
+		}
+
+		args = append(args, fmt.Sprintf("%s/%s", v.zfs.Pool, dataset.Name))
+
+		err = shared.RunCommand(v.ctx, nil, nil, "zfs", args...)
+		if err != nil {
+			return fmt.Errorf("Failed to create ZFS dataset %q: %w", dataset.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// getBtrfsSubvolumeMounts returns the btrfs subvolumes which are mounted in
+// addition to the root subvolume, sorted by their mountpoints.
+func (v *vm) getBtrfsSubvolumeMounts() []shared.DefinitionTargetLXDVMBtrfsSubvolume {
+	var subvolumes []shared.DefinitionTargetLXDVMBtrfsSubvolume
+
+	for _, subvolume := range v.btrfs.Subvolumes {
+		if subvolume.Mountpoint == "" || subvolume.Mountpoint == "/" {
+			continue
+		}
+
+		subvolumes = append(subvolumes, subvolume)
+	}
+
+	// Parent mountpoints need to be mounted first.
+	slices.SortFunc(subvolumes, func(a, b shared.DefinitionTargetLXDVMBtrfsSubvolume) int {
+		return strings.Compare(a.Mountpoint, b.Mountpoint)
+	})
+
+	return subvolumes
+}
+
+// mountBtrfsSubvolumes mounts the root subvolume and all other subvolumes
+// with a mountpoint.
+func (v *vm) mountBtrfsSubvolumes() error {
+	// The configured mount options come last so they take precedence.
+	options := strings.Join(append([]string{"defaults", "discard", "nobarrier", "commit=300", "noatime"}, v.btrfs.MountOptions...), ",")
+
+	for _, subvolume := range v.btrfs.Subvolumes {
+		if subvolume.Mountpoint != "/" {
+			continue
+		}
+
+		err := shared.RunCommand(v.ctx, nil, nil, "mount", v.getRootDevFile(), v.rootfsDir, "-t", v.rootFS, "-o", fmt.Sprintf("%s,subvol=/%s", options, subvolume.Name))
+		if err != nil {
+			return fmt.Errorf("Failed to mount btrfs subvolume %q: %w", subvolume.Name, err)
+		}
+	}
+
+	for _, subvolume := range v.getBtrfsSubvolumeMounts() {
+		mountpoint := filepath.Join(v.rootfsDir, subvolume.Mountpoint)
+
+		err := os.MkdirAll(mountpoint, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", mountpoint, err)
+		}
+
+		err = shared.RunCommand(v.ctx, nil, nil, "mount", v.getRootDevFile(), mountpoint, "-t", v.rootFS, "-o", fmt.Sprintf("%s,subvol=/%s", options, subvolume.Name))
+		if err != nil {
+			return fmt.Errorf("Failed to mount btrfs subvolume %q: %w", subvolume.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// getBtrfsMounts returns the btrfs subvolumes which need to be bind mounted
+// into the chroot in addition to the root subvolume.
+func (v *vm) getBtrfsMounts() []shared.ChrootMount {
+	var mounts []shared.ChrootMount
+
+	for _, subvolume := range v.getBtrfsSubvolumeMounts() {
+		mounts = append(mounts, shared.ChrootMount{
+			Source: filepath.Join(v.rootfsDir, subvolume.Mountpoint),
+			Target: subvolume.Mountpoint,
+			Flags:  unix.MS_BIND,
+			IsDir:  true,
+		})
+	}
+
+	return mounts
+}
+
+// getZFSMounts returns the ZFS datasets which need to be bind mounted into the
+// chroot in addition to the root dataset.
+func (v *vm) getZFSMounts() []shared.ChrootMount {
+	if !v.zfsActive {
+		return nil
+	}
+
+	var mounts []shared.ChrootMount
+
+	for _, dataset := range v.zfs.Datasets {
+		if dataset.Mountpoint == "" || dataset.Mountpoint == "/" || dataset.Mountpoint == "none" || dataset.Mountpoint == "legacy" {
+			continue
+		}
+
+		mounts = append(mounts, shared.ChrootMount{
+			Source: filepath.Join(v.rootfsDir, dataset.Mountpoint),
+			Target: dataset.Mountpoint,
+			Flags:  unix.MS_BIND,
+			IsDir:  true,
+		})
+	}
+
+	return mounts
+}
+
+// configureZFS sets the boot file system of the pool, and writes the initramfs
+// configuration needed to boot from the ZFS root dataset. The root parameter
+// for grub is written by configureKernelCmdline.
+func (v *vm) configureZFS(rootDataset string) error {
+	if !v.zfsActive {
+		return nil
+	}
+
+	err := shared.RunCommand(v.ctx, nil, nil, "zpool", "set", fmt.Sprintf("bootfs=%s", rootDataset), v.zfs.Pool)
+	if err != nil {
+		return fmt.Errorf("Failed to set bootfs of ZFS pool %q: %w", v.zfs.Pool, err)
+	}
+
+	// Make sure the zfs module ends up in the initramfs on dracut based distributions.
+	if lxdShared.PathExists(filepath.Join(v.rootfsDir, "etc", "dracut.conf.d")) {
+		dracutConf := filepath.Join(v.rootfsDir, "etc", "dracut.conf.d", "lxd-imagebuilder-zfs.conf")
+
+		err := os.WriteFile(dracutConf, []byte(fmt.Sprintf("add_dracutmodules+=\" zfs \"\nkernel_cmdline+=\" root=ZFS=%s \"\n", rootDataset)), 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", dracutConf, err)
+		}
 	}
 
 	return nil
@@ -237,7 +1337,7 @@ func (v *vm) createUEFIFS() error {
 		return errors.New("Disk image not mounted")
 	}
 
-	return shared.RunCommand(v.ctx, nil, nil, "mkfs.vfat", "-F", "32", "-n", "UEFI", v.getUEFIDevFile())
+	return shared.RunCommand(v.ctx, nil, nil, "mkfs.vfat", "-F", strconv.FormatUint(uint64(v.esp.FAT), 10), "-n", v.esp.Label, v.getUEFIDevFile())
 }
 
 func (v *vm) mountRootPartition() error {
@@ -247,9 +1347,14 @@ func (v *vm) mountRootPartition() error {
 
 	switch v.rootFS {
 	case "btrfs":
-		return shared.RunCommand(v.ctx, nil, nil, "mount", v.getRootfsDevFile(), v.rootfsDir, "-t", v.rootFS, "-o", "defaults,discard,nobarrier,commit=300,noatime,subvol=/@")
+		return v.mountBtrfsSubvolumes()
 	case "ext4":
-		return shared.RunCommand(v.ctx, nil, nil, "mount", v.getRootfsDevFile(), v.rootfsDir, "-t", v.rootFS, "-o", "discard,nobarrier,commit=300,noatime,data=writeback")
+		return shared.RunCommand(v.ctx, nil, nil, "mount", v.getRootDevFile(), v.rootfsDir, "-t", v.rootFS, "-o", "discard,nobarrier,commit=300,noatime,data=writeback")
+	case "f2fs":
+		return shared.RunCommand(v.ctx, nil, nil, "mount", v.getRootDevFile(), v.rootfsDir, "-t", v.rootFS, "-o", "discard,noatime")
+	case "zfs":
+		// The datasets are already mounted when creating the pool.
+		return nil
 	}
 
 	return nil
@@ -269,3 +1374,238 @@ func (v *vm) mountUEFIPartition() error {
 
 	return shared.RunCommand(v.ctx, nil, nil, "mount", "-t", "vfat", v.getUEFIDevFile(), mountpoint, "-o", "discard")
 }
+
+// trimFilesystems discards the unused blocks of the filesystems mounted at the
+// given directory, so they are left out of the image. If discarding isn't
+// supported by the loop device, the unused blocks of an ext4 root filesystem
+// are zeroed by compactRootFS instead.
+func (v *vm) trimFilesystems(dir string) error {
+	// The file systems of the userspace backend are written sparsely.
+	if v.shrink == "" || v.shrink == "none" || v.userspace {
+		return nil
+	}
+
+	err := shared.RunCommand(v.ctx, nil, nil, "fstrim", filepath.Join(dir, "boot", "efi"))
+	if err != nil {
+		return fmt.Errorf("Failed to trim EFI system partition: %w", err)
+	}
+
+	if v.zfsActive {
+		err := shared.RunCommand(v.ctx, nil, nil, "zpool", "trim", "-w", v.zfs.Pool)
+		if err != nil {
+			return fmt.Errorf("Failed to trim ZFS pool %q: %w", v.zfs.Pool, err)
+		}
+
+		return nil
+	}
+
+	err = shared.RunCommand(v.ctx, nil, nil, "fstrim", dir)
+	if err != nil {
+		_, lookErr := exec.LookPath("zerofree")
+		if v.rootFS != "ext4" || lookErr != nil {
+			return fmt.Errorf("Failed to trim root filesystem: %w", err)
+		}
+
+		v.zerofree = true
+	}
+
+	return nil
+}
+
+// compactRootFS zeroes the unused blocks of the root filesystem if it couldn't
+// be trimmed, and shrinks it to its minimal size if requested. The root
+// filesystem must be unmounted.
+func (v *vm) compactRootFS() error {
+	if v.loopDevice == "" {
+		return errors.New("Disk image not mounted")
+	}
+
+	if v.zerofree {
+		err := shared.RunCommand(v.ctx, nil, nil, "zerofree", v.getRootDevFile())
+		if err != nil {
+			return fmt.Errorf("Failed to zero unused blocks of %q: %w", v.getRootDevFile(), err)
+		}
+	}
+
+	if v.shrink != "minimal" {
+		return nil
+	}
+
+	// resize2fs refuses to shrink a filesystem which hasn't been checked.
+	err := shared.RunCommand(v.ctx, nil, nil, "e2fsck", "-f", "-p", v.getRootDevFile())
+	if err != nil {
+		return fmt.Errorf("Failed to check root filesystem: %w", err)
+	}
+
+	err = shared.RunCommand(v.ctx, nil, nil, "resize2fs", "-M", v.getRootDevFile())
+	if err != nil {
+		return fmt.Errorf("Failed to shrink root filesystem: %w", err)
+	}
+
+	var out strings.Builder
+
+	err = shared.RunCommand(v.ctx, nil, &out, "dumpe2fs", "-h", v.getRootDevFile())
+	if err != nil {
+		return fmt.Errorf("Failed to get size of root filesystem: %w", err)
+	}
+
+	v.rootfsSize, err = parseExt4Size(out.String())
+	if err != nil {
+		return fmt.Errorf("Failed to get size of root filesystem: %w", err)
+	}
+
+	return nil
+}
+
+// truncateImage shrinks the root partition to the size of the shrunk root
+// filesystem, and truncates the image after it. The image must be unmounted.
+func (v *vm) truncateImage() error {
+	if v.rootfsSize == 0 {
+		return nil
+	}
+
+	if v.loopDevice != "" {
+		return errors.New("Disk image still mounted")
+	}
+
+	f, err := os.OpenFile(v.imageFile, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %w", v.imageFile, err)
+	}
+
+	defer f.Close()
+
+	size, err := shrinkGPT(f, v.rootfsSize)
+	if err != nil {
+		return fmt.Errorf("Failed to shrink root partition: %w", err)
+	}
+
+	err = f.Truncate(int64(size))
+	if err != nil {
+		return fmt.Errorf("Failed to truncate %s: %w", v.imageFile, err)
+	}
+
+	v.size = size
+
+	return f.Close()
+}
+
+// parseExt4Size returns the size in bytes of an ext4 filesystem from the output of dumpe2fs -h.
+func parseExt4Size(out string) (uint64, error) {
+	var blockCount, blockSize uint64
+
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		var err error
+
+		switch key {
+		case "Block count":
+			blockCount, err = strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		case "Block size":
+			blockSize, err = strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("Invalid %q: %w", key, err)
+		}
+	}
+
+	if blockCount == 0 || blockSize == 0 {
+		return 0, errors.New("Block count or block size missing")
+	}
+
+	return blockCount * blockSize, nil
+}
+
+// growRootService is the systemd unit growing the root partition and file system on boot.
+const growRootService = `[Unit]
+Description=Grow the root partition and file system to the size of the disk
+After=local-fs.target
+
+[Service]
+Type=oneshot
+ExecStart=/usr/local/sbin/lxd-imagebuilder-growroot
+RemainAfterExit=yes
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// growRootScript returns the script growing the root partition with the given
+// PARTUUID and the root file system.
+func (v *vm) growRootScript(partUUID string) string {
+	var resize string
+
+	switch v.rootFS {
+	case "btrfs":
+		resize = "btrfs filesystem resize max /"
+	case "zfs":
+		resize = fmt.Sprintf("zpool online -e %s \"${part}\"", v.zfs.Pool)
+	default:
+		resize = "resize2fs \"${part}\""
+	}
+
+	return fmt.Sprintf(`#!/bin/sh
+# Grow the root partition and file system to the size of the disk.
+set -eu
+
+part="$(readlink -f /dev/disk/by-partuuid/%s)"
+disk="/dev/$(lsblk -n -d -o PKNAME "${part}")"
+partnum="$(cat "/sys/class/block/$(basename "${part}")/partition")"
+
+# growpart exits with 1 if the partition cannot be grown.
+rc=0
+growpart "${disk}" "${partnum}" || rc=$?
+[ "${rc}" -le 1 ] || exit "${rc}"
+
+%s
+`, partUUID, resize)
+}
+
+// configureGrowRoot installs and enables the systemd unit growing the root
+// partition and file system on boot.
+func (v *vm) configureGrowRoot() error {
+	if !v.growRoot {
+		return nil
+	}
+
+	partUUID, err := v.getRootfsPartitionUUID()
+	if err != nil {
+		return fmt.Errorf("Failed to get PARTUUID of root partition: %w", err)
+	}
+
+	script := filepath.Join(v.rootfsDir, "usr", "local", "sbin", "lxd-imagebuilder-growroot")
+	unitDir := filepath.Join(v.rootfsDir, "etc", "systemd", "system")
+
+	for _, dir := range []string{filepath.Dir(script), filepath.Join(unitDir, "multi-user.target.wants")} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", dir, err)
+		}
+	}
+
+	err = os.WriteFile(script, []byte(v.growRootScript(partUUID)), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", script, err)
+	}
+
+	unit := filepath.Join(unitDir, "lxd-imagebuilder-growroot.service")
+
+	err = os.WriteFile(unit, []byte(growRootService), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", unit, err)
+	}
+
+	link := filepath.Join(unitDir, "multi-user.target.wants", "lxd-imagebuilder-growroot.service")
+
+	err = os.Symlink("../lxd-imagebuilder-growroot.service", link)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("Failed to enable %q: %w", unit, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func Test_ext4MkfsArgs(t *testing.T) {
+	require.Equal(t, []string{"-F", "-b", "4096", "-i", "8192", "-m", "0", "-L", "rootfs", "-E", "resize=536870912"}, ext4MkfsArgs(nil))
+
+	args := ext4MkfsArgs(map[string]string{
+		"block_size":      "1024",
+		"inode_count":     "20000",
+		"inode_size":      "256",
+		"reserved_blocks": "5",
+		"resize":          "1073741824",
+		"encoding":        "utf8",
+		"features":        "^64bit,casefold",
+	})
+
+	require.Equal(t, []string{"-F", "-b", "1024", "-N", "20000", "-I", "256", "-m", "5", "-L", "rootfs", "-E", "resize=1073741824,encoding=utf8", "-O", "^64bit,casefold"}, args)
+}
+
+func Test_parseExt4Size(t *testing.T) {
+	out := `dumpe2fs 1.47.0 (5-Feb-2023)
+Filesystem volume name:   rootfs
+Block count:              27049
+Reserved block count:     0
+Block size:               1024
+Fragment size:            1024
+`
+
+	size, err := parseExt4Size(out)
+	require.NoError(t, err)
+	require.Equal(t, uint64(27049*1024), size)
+
+	_, err = parseExt4Size("Block count:              27049\n")
+	require.Error(t, err)
+
+	_, err = parseExt4Size("Block count:              many\nBlock size:               1024\n")
+	require.Error(t, err)
+}
+
+func Test_growRootScript(t *testing.T) {
+	tests := []struct {
+		vm     vm
+		resize string
+	}{
+		{vm{rootFS: "ext4"}, `resize2fs "${part}"`},
+		{vm{rootFS: "btrfs"}, "btrfs filesystem resize max /"},
+		{vm{rootFS: "zfs", zfs: &shared.DefinitionTargetLXDVMZFS{Pool: "rpool"}}, `zpool online -e rpool "${part}"`},
+	}
+
+	for _, tt := range tests {
+		script := tt.vm.growRootScript("8c9f3f36-7e4a-4b8e-9d5a-2f1f6c0e8a11")
+		require.Contains(t, script, "/dev/disk/by-partuuid/8c9f3f36-7e4a-4b8e-9d5a-2f1f6c0e8a11")
+		require.Contains(t, script, tt.resize)
+
+		err := exec.Command("sh", "-n", "-c", script).Run()
+		require.NoError(t, err)
+	}
+}
+
+func Test_configureDisks(t *testing.T) {
+	rootfsDir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(rootfsDir, "etc", "fstab"), []byte("UUID=1234  /  ext4  defaults  0 1\n"), 0644)
+	require.NoError(t, err)
+
+	v := vm{rootfsDir: rootfsDir, disks: []shared.DefinitionTargetLXDVMDisk{
+		{Name: "data", Type: "data", Filesystem: "xfs", Label: "data", Mountpoint: "/srv/data"},
+		{Name: "swap", Type: "data", Filesystem: "swap", Label: "swap"},
+		{Name: "raw", Type: "data", Filesystem: "none"},
+		{Name: "seed", Type: "seed"},
+	}}
+
+	err = v.configureDisks()
+	require.NoError(t, err)
+
+	fstab, err := os.ReadFile(filepath.Join(rootfsDir, "etc", "fstab"))
+	require.NoError(t, err)
+	require.Equal(t, "UUID=1234  /  ext4  defaults  0 1\nLABEL=data  /srv/data  xfs  defaults,nofail  0 2\nLABEL=swap  none  swap  sw,nofail  0 0\n", string(fstab))
+	require.DirExists(t, filepath.Join(rootfsDir, "srv", "data"))
+}
+
+func Test_createPartitionsPReP(t *testing.T) {
+	imageFile := filepath.Join(t.TempDir(), "disk.img")
+
+	err := os.WriteFile(imageFile, nil, 0600)
+	require.NoError(t, err)
+
+	err = os.Truncate(imageFile, 64*1024*1024)
+	require.NoError(t, err)
+
+	v := vm{imageFile: imageFile, size: 64 * 1024 * 1024, esp: shared.DefinitionTargetLXDVMESP{Size: 8 * 1024 * 1024}, prep: true}
+
+	err = v.createPartitions()
+	require.NoError(t, err)
+
+	f, err := os.Open(imageFile)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	_, entries, err := readGPT(f)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	// The PReP boot partition is the third entry, but located in front of the
+	// root partition.
+	require.Equal(t, "EFI System", entries[0].name)
+	require.Equal(t, "Linux filesystem", entries[1].name)
+	require.Equal(t, "PowerPC PReP boot", entries[2].name)
+	require.Less(t, entries[2].lastLBA, entries[1].firstLBA)
+	require.Equal(t, uint64(prepSize/gptSectorSize), entries[2].lastLBA-entries[2].firstLBA+1)
+}
+
+func Test_rootPartitionType(t *testing.T) {
+	require.Equal(t, gptTypeLinuxFS, (&vm{architecture: "x86_64"}).rootPartitionType())
+	require.Equal(t, gptTypeRootRISCV64, (&vm{architecture: "riscv64"}).rootPartitionType())
+
+	partitions := map[string]shared.DefinitionTargetLXDVMPartition{"root": {Type: "root-x86-64"}}
+	require.Equal(t, "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709", (&vm{architecture: "x86_64", partitions: partitions}).rootPartitionType())
+}
+
+func Test_createPartitionsConfig(t *testing.T) {
+	imageFile := filepath.Join(t.TempDir(), "disk.img")
+
+	err := os.WriteFile(imageFile, nil, 0600)
+	require.NoError(t, err)
+
+	err = os.Truncate(imageFile, 64*1024*1024)
+	require.NoError(t, err)
+
+	v := vm{imageFile: imageFile, size: 64 * 1024 * 1024, esp: shared.DefinitionTargetLXDVMESP{Size: 8 * 1024 * 1024}, partitions: map[string]shared.DefinitionTargetLXDVMPartition{
+		"esp":  {Name: "esp"},
+		"root": {Type: "root-x86-64", Name: "root-x86-64", Attributes: []string{"grow-file-system"}},
+	}}
+
+	err = v.createPartitions()
+	require.NoError(t, err)
+
+	f, err := os.Open(imageFile)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	_, entries, err := readGPT(f)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	espType, err := parseGUID(gptTypeEFISystem)
+	require.NoError(t, err)
+
+	rootType, err := parseGUID("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+	require.NoError(t, err)
+
+	require.Equal(t, "esp", entries[0].name)
+	require.Equal(t, espType, entries[0].typeGUID)
+	require.Equal(t, uint64(0), entries[0].attributes)
+	require.Equal(t, "root-x86-64", entries[1].name)
+	require.Equal(t, rootType, entries[1].typeGUID)
+	require.Equal(t, uint64(1<<59), entries[1].attributes)
+}
+
+func Test_waitForPartitionsType(t *testing.T) {
+	imageFile := filepath.Join(t.TempDir(), "disk.img")
+
+	err := os.WriteFile(imageFile, nil, 0600)
+	require.NoError(t, err)
+
+	err = os.Truncate(imageFile, 64*1024*1024)
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(imageFile, os.O_RDWR, 0)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	// The root partition comes first.
+	err = writeGPT(f, 64*1024*1024, []gptPartition{
+		{typeGUID: gptTypeLinuxFS, name: "Linux filesystem", size: 32 * 1024 * 1024},
+		{typeGUID: gptTypeEFISystem, name: "EFI System"},
+	})
+	require.NoError(t, err)
+
+	v := vm{imageFile: imageFile, loopDevice: "/dev/loop7"}
+
+	_, err = v.waitForPartitions(2)
+	require.EqualError(t, err, fmt.Sprintf("Partition 1 of %q isn't the EFI system partition", imageFile))
+
+	_, err = v.waitForPartitions(3)
+	require.EqualError(t, err, fmt.Sprintf("Partition table of %q has 2 partitions instead of 3", imageFile))
+}
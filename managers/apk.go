@@ -41,6 +41,18 @@ func (m *apk) load() error {
 	return nil
 }
 
+func (m *apk) download(pkgs, flags []string, targetDir string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	args := []string{"fetch", "--recursive", "--output", targetDir}
+	args = append(args, flags...)
+	args = append(args, pkgs...)
+
+	return shared.RunCommand(m.ctx, nil, nil, "apk", args...)
+}
+
 func (m *apk) manageRepository(repoAction shared.DefinitionPackagesRepository) error {
 	repoFile := "/etc/apk/repositories"
 
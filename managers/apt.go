@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	lxdShared "github.com/canonical/lxd/shared"
@@ -50,6 +51,27 @@ func (m *apt) load() error {
 	return nil
 }
 
+func (m *apt) download(pkgs, flags []string, targetDir string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	// apt requires the partial directory to be present.
+	err := os.MkdirAll(filepath.Join(targetDir, "partial"), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", filepath.Join(targetDir, "partial"), err)
+	}
+
+	// apt skips the packages which are already installed, e.g. those of the
+	// bootstrap rootfs. An empty package status makes it download all
+	// dependencies, so they're available to builds from another source.
+	args := append(slices.Clone(m.flags.global), "install", "--download-only", "-o", "Dir::State::status=/dev/null", "-o", fmt.Sprintf("Dir::Cache::archives=%s", targetDir))
+	args = append(args, flags...)
+	args = append(args, pkgs...)
+
+	return shared.RunCommand(m.ctx, nil, nil, "apt-get", args...)
+}
+
 func (m *apt) manageRepository(repoAction shared.DefinitionPackagesRepository) error {
 	var targetFile string
 
@@ -49,6 +49,11 @@ func (c *common) remove(pkgs, flags []string) error {
 	return shared.RunCommand(c.ctx, nil, nil, c.commands.remove, args...)
 }
 
+// download downloads packages without installing them.
+func (c *common) download(pkgs, flags []string, targetDir string) error {
+	return ErrNotSupported
+}
+
 // Clean cleans up cached files used by the package managers.
 func (c *common) clean() error {
 	var err error
@@ -1,6 +1,9 @@
 package managers
 
 import (
+	"fmt"
+	"slices"
+
 	"github.com/canonical/lxd-imagebuilder/shared"
 )
 
@@ -44,6 +47,18 @@ func (m *dnf) load() error {
 	return nil
 }
 
+func (m *dnf) download(pkgs, flags []string, targetDir string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	args := append(slices.Clone(m.flags.global), "install", "--nobest", "--downloadonly", fmt.Sprintf("--downloaddir=%s", targetDir))
+	args = append(args, flags...)
+	args = append(args, pkgs...)
+
+	return shared.RunCommand(m.ctx, nil, nil, "dnf", args...)
+}
+
 func (m *dnf) manageRepository(repoAction shared.DefinitionPackagesRepository) error {
 	return yumManageRepository(repoAction)
 }
@@ -0,0 +1,141 @@
+package managers
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// firmwareDirs are the directories holding the firmware loaded by the kernel.
+var firmwareDirs = []string{"/usr/lib/firmware", "/lib/firmware"}
+
+// getHardware returns the microcode and firmware options of VM images.
+func (m *Manager) getHardware(imageTarget shared.ImageTarget) *shared.DefinitionTargetLXDVMHardware {
+	if imageTarget&shared.ImageTargetVM == 0 {
+		return nil
+	}
+
+	return m.def.Targets.LXD.VM.Hardware
+}
+
+// getHardwareSet returns the package set installing the microcode and the
+// firmware of VM images, or nil if there are no packages to install.
+func (m *Manager) getHardwareSet(imageTarget shared.ImageTarget) *shared.DefinitionPackagesSet {
+	hardware := m.getHardware(imageTarget)
+	if hardware == nil {
+		return nil
+	}
+
+	packages := hardware.Packages(m.def.Packages.Manager, m.def.Image.Distribution, m.def.Image.ArchitectureKernel)
+	if len(packages) == 0 {
+		return nil
+	}
+
+	return &shared.DefinitionPackagesSet{Packages: packages, Action: "install", Stage: "main"}
+}
+
+// pruneFirmware removes the firmware files of the rootfs which aren't kept by
+// the hardware options, as well as the links and directories left empty.
+func pruneFirmware(rootDir string, hardware *shared.DefinitionTargetLXDVMHardware) error {
+	var pruned []string
+
+	for _, dir := range firmwareDirs {
+		dir = filepath.Join(rootDir, dir)
+
+		// On merged /usr, /lib/firmware is the same directory as /usr/lib/firmware.
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return fmt.Errorf("Failed to resolve %q: %w", dir, err)
+		}
+
+		if slices.Contains(pruned, realDir) {
+			continue
+		}
+
+		pruned = append(pruned, realDir)
+
+		err = pruneFirmwareDir(realDir, hardware)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneFirmwareDir prunes the given firmware directory.
+func pruneFirmwareDir(dir string, hardware *shared.DefinitionTargetLXDVMHardware) error {
+	var dirs []string
+	var links []string
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == dir {
+			return nil
+		}
+
+		if d.IsDir() {
+			dirs = append(dirs, path)
+
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if hardware.KeepFirmware(filepath.ToSlash(name)) {
+			if d.Type()&fs.ModeSymlink != 0 {
+				links = append(links, path)
+			}
+
+			return nil
+		}
+
+		return os.Remove(path)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to prune firmware %q: %w", dir, err)
+	}
+
+	// Kept links may point to pruned files.
+	for _, link := range links {
+		_, err := os.Stat(link)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = os.Remove(link)
+			if err != nil {
+				return fmt.Errorf("Failed to remove %q: %w", link, err)
+			}
+		}
+	}
+
+	// Remove the empty directories, deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			return fmt.Errorf("Failed to read %q: %w", dirs[i], err)
+		}
+
+		if len(entries) == 0 {
+			err = os.Remove(dirs[i])
+			if err != nil {
+				return fmt.Errorf("Failed to remove %q: %w", dirs[i], err)
+			}
+		}
+	}
+
+	return nil
+}
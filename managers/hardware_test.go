@@ -0,0 +1,92 @@
+package managers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+func TestManagePackagesHardware(t *testing.T) {
+	rootDir := t.TempDir()
+
+	def := shared.Definition{
+		Image: shared.DefinitionImage{Distribution: "debian", ArchitectureKernel: "x86_64"},
+		Packages: shared.DefinitionPackages{
+			Manager: "apt",
+			Sets: []shared.DefinitionPackagesSet{
+				{
+					DefinitionFilter: shared.DefinitionFilter{Types: []shared.DefinitionFilterType{shared.DefinitionFilterTypeContainer, shared.DefinitionFilterTypeVM}},
+					Packages:         []string{"linux-image-amd64"},
+					Action:           "install",
+					Stage:            "main",
+				},
+			},
+		},
+	}
+
+	def.Targets.LXD.VM.Hardware = &shared.DefinitionTargetLXDVMHardware{Microcode: true, Firmware: []string{"i915/*"}}
+
+	mgr := &recordingManager{}
+	m := Manager{mgr: mgr, def: def, logger: logrus.New(), rootDir: rootDir}
+
+	// Containers don't get microcode and firmware.
+	m.def.Targets.Type = shared.DefinitionFilterTypeContainer
+
+	err := m.ManagePackages(shared.ImageTargetAll | shared.ImageTargetContainer)
+	require.NoError(t, err)
+	require.Equal(t, []string{"refresh", "install linux-image-amd64"}, mgr.calls)
+
+	mgr.calls = nil
+	m.def.Targets.Type = shared.DefinitionFilterTypeVM
+
+	err = m.ManagePackages(shared.ImageTargetAll | shared.ImageTargetVM)
+	require.NoError(t, err)
+	require.Equal(t, []string{"refresh", "install linux-image-amd64 intel-microcode amd64-microcode firmware-linux"}, mgr.calls)
+}
+
+func TestPruneFirmware(t *testing.T) {
+	rootDir := t.TempDir()
+
+	// The rootfs has a merged /usr.
+	firmwareDir := filepath.Join(rootDir, "usr/lib/firmware")
+
+	for _, name := range []string{"i915/tgl_guc.bin.zst", "amdgpu/navi10_sos.bin", "intel-ucode/06-8c-01", "iwlwifi-cc-a0-77.ucode", "rtl_nic/rtl8168h-2.fw"} {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(firmwareDir, name)), 0755)
+		require.NoError(t, err)
+
+		err = os.WriteFile(filepath.Join(firmwareDir, name), nil, 0644)
+		require.NoError(t, err)
+	}
+
+	err := os.Symlink("usr/lib", filepath.Join(rootDir, "lib"))
+	require.NoError(t, err)
+
+	// The link is kept, but its target is pruned.
+	err = os.Symlink("rtl_nic/rtl8168h-2.fw", filepath.Join(firmwareDir, "iwlwifi-link.ucode"))
+	require.NoError(t, err)
+
+	hardware := &shared.DefinitionTargetLXDVMHardware{Microcode: true, Firmware: []string{"i915", "iwlwifi-*"}}
+
+	err = pruneFirmware(rootDir, hardware)
+	require.NoError(t, err)
+
+	require.FileExists(t, filepath.Join(firmwareDir, "i915/tgl_guc.bin.zst"))
+	require.FileExists(t, filepath.Join(firmwareDir, "intel-ucode/06-8c-01"))
+	require.FileExists(t, filepath.Join(firmwareDir, "iwlwifi-cc-a0-77.ucode"))
+	require.NoFileExists(t, filepath.Join(firmwareDir, "iwlwifi-link.ucode"))
+	require.NoDirExists(t, filepath.Join(firmwareDir, "amdgpu"))
+	require.NoDirExists(t, filepath.Join(firmwareDir, "rtl_nic"))
+
+	// Without microcode and firmware, all the firmware is pruned.
+	err = pruneFirmware(rootDir, &shared.DefinitionTargetLXDVMHardware{})
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(firmwareDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -8,12 +8,16 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/canonical/lxd-imagebuilder/plugins"
 	"github.com/canonical/lxd-imagebuilder/shared"
 )
 
 // ErrUnknownManager represents the unknown manager error.
 var ErrUnknownManager = errors.New("Unknown manager")
 
+// ErrNotSupported returns a "Not supported" error.
+var ErrNotSupported = errors.New("Not supported")
+
 // managerFlags represents flags for all subcommands of a package manager.
 type managerFlags struct {
 	global  []string
@@ -45,6 +49,10 @@ type Manager struct {
 	def    shared.Definition
 	ctx    context.Context
 	logger *logrus.Logger
+
+	// rootDir is the rootfs the packages are managed in, which is the root
+	// directory of the chroot.
+	rootDir string
 }
 
 type manager interface {
@@ -53,6 +61,7 @@ type manager interface {
 	manageRepository(repo shared.DefinitionPackagesRepository) error
 	install(pkgs, flags []string) error
 	remove(pkgs, flags []string) error
+	download(pkgs, flags []string, targetDir string) error
 	clean() error
 	refresh() error
 	update() error
@@ -77,12 +86,19 @@ var managers = map[string]func() manager{
 
 // Load loads and initializes a downloader.
 func Load(ctx context.Context, managerName string, logger *logrus.Logger, definition shared.Definition) (*Manager, error) {
+	var d manager
+
 	df, ok := managers[managerName]
-	if !ok {
-		return nil, ErrUnknownManager
-	}
+	if ok {
+		d = df()
+	} else {
+		p := definition.GetPlugin(plugins.TypeManager, managerName)
+		if p == nil {
+			return nil, ErrUnknownManager
+		}
 
-	d := df()
+		d = &plugin{plugin: *p}
+	}
 
 	d.init(ctx, logger, definition)
 
@@ -91,25 +107,18 @@ func Load(ctx context.Context, managerName string, logger *logrus.Logger, defini
 		return nil, fmt.Errorf("Failed to load manager %q: %w", managerName, err)
 	}
 
-	return &Manager{def: definition, mgr: d, ctx: ctx, logger: logger}, nil
+	return &Manager{def: definition, mgr: d, ctx: ctx, logger: logger, rootDir: "/"}, nil
 }
 
-// ManagePackages manages packages.
+// ManagePackages manages the packages of the early and main stages.
 func (m *Manager) ManagePackages(imageTarget shared.ImageTarget) error {
-	var validSets []shared.DefinitionPackagesSet
-
-	for _, set := range m.def.Packages.Sets {
-		if !shared.ApplyFilter(&set, m.def.Image.Release, m.def.Image.ArchitectureMapped, m.def.Image.Variant, m.def.Targets.Type, imageTarget) {
-			continue
-		}
-
-		validSets = append(validSets, set)
-	}
+	earlySets := m.getPackageSets(imageTarget, "early")
+	mainSets := m.getPackageSets(imageTarget, "main")
 
 	// If there's nothing to install or remove, and no updates need to be performed,
 	// we can exit here.
-	if len(validSets) == 0 && !m.def.Packages.Update {
-		return nil
+	if len(earlySets) == 0 && len(mainSets) == 0 && !m.def.Packages.Update {
+		return m.pruneFirmware(imageTarget)
 	}
 
 	err := m.mgr.refresh()
@@ -117,6 +126,19 @@ func (m *Manager) ManagePackages(imageTarget shared.ImageTarget) error {
 		return fmt.Errorf("Failed to refresh: %w", err)
 	}
 
+	if len(earlySets) > 0 {
+		err = m.applyPackageSets(earlySets)
+		if err != nil {
+			return err
+		}
+
+		// Early packages, e.g. keyrings, may affect the repositories.
+		err = m.mgr.refresh()
+		if err != nil {
+			return fmt.Errorf("Failed to refresh: %w", err)
+		}
+	}
+
 	if m.def.Packages.Update {
 		err = m.mgr.update()
 		if err != nil {
@@ -127,21 +149,117 @@ func (m *Manager) ManagePackages(imageTarget shared.ImageTarget) error {
 
 		// Run post update hook
 		for _, action := range m.def.GetRunnableActions("post-update", imageTarget) {
+			m.logger.WithField("action", action.ID()).Info("Running action")
+
 			if action.Pongo {
 				action.Action, err = shared.RenderTemplate(action.Action, m.def)
 				if err != nil {
-					return fmt.Errorf("Failed to render action: %w", err)
+					return fmt.Errorf("Failed to render action %q: %w", action.ID(), err)
 				}
 			}
 
-			err = shared.RunScript(m.ctx, action.Action)
+			err = shared.RunAction(m.ctx, m.logger, action)
 			if err != nil {
-				return fmt.Errorf("Failed to run post-update: %w", err)
+				return fmt.Errorf("Failed to run post-update action %q: %w", action.ID(), err)
 			}
 		}
 	}
 
-	for _, set := range optimizePackageSets(validSets) {
+	err = m.applyPackageSets(mainSets)
+	if err != nil {
+		return err
+	}
+
+	err = m.pruneFirmware(imageTarget)
+	if err != nil {
+		return err
+	}
+
+	// If there are late packages, cleaning up is done after they've been handled.
+	if m.def.Packages.Cleanup && len(m.getPackageSets(imageTarget, "late")) == 0 {
+		err = m.mgr.clean()
+		if err != nil {
+			return fmt.Errorf("Failed to clean up packages: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ManageLatePackages manages the packages of the late stage. It's meant to be
+// called after the post-packages actions have been run.
+func (m *Manager) ManageLatePackages(imageTarget shared.ImageTarget) error {
+	lateSets := m.getPackageSets(imageTarget, "late")
+
+	if len(lateSets) == 0 {
+		return nil
+	}
+
+	// The package database may have been cleaned up by a post-packages action.
+	err := m.mgr.refresh()
+	if err != nil {
+		return fmt.Errorf("Failed to refresh: %w", err)
+	}
+
+	err = m.applyPackageSets(lateSets)
+	if err != nil {
+		return err
+	}
+
+	if m.def.Packages.Cleanup {
+		err = m.mgr.clean()
+		if err != nil {
+			return fmt.Errorf("Failed to clean up packages: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// getPackageSets returns the package sets of the given stage which apply to the image, in definition order.
+func (m *Manager) getPackageSets(imageTarget shared.ImageTarget, stage string) []shared.DefinitionPackagesSet {
+	var sets []shared.DefinitionPackagesSet
+
+	for _, set := range m.def.Packages.Sets {
+		if set.Stage != stage {
+			continue
+		}
+
+		if !shared.ApplyFilter(&set, m.def.Image.Release, m.def.Image.ArchitectureMapped, m.def.Image.Variant, m.def.Targets.Type, imageTarget) {
+			continue
+		}
+
+		sets = append(sets, set)
+	}
+
+	// The microcode and firmware of VM images are installed last.
+	if stage == "main" {
+		set := m.getHardwareSet(imageTarget)
+		if set != nil {
+			sets = append(sets, *set)
+		}
+	}
+
+	return sets
+}
+
+// pruneFirmware prunes the firmware files of VM images.
+func (m *Manager) pruneFirmware(imageTarget shared.ImageTarget) error {
+	hardware := m.getHardware(imageTarget)
+	if hardware == nil {
+		return nil
+	}
+
+	m.logger.Info("Pruning firmware")
+
+	return pruneFirmware(m.rootDir, hardware)
+}
+
+// applyPackageSets installs or removes the packages of the given sets.
+func (m *Manager) applyPackageSets(sets []shared.DefinitionPackagesSet) error {
+	var err error
+
+	for _, set := range optimizePackageSets(sets) {
 		if set.Action == "install" {
 			err = m.mgr.install(set.Packages, set.Flags)
 		} else if set.Action == "remove" {
@@ -153,10 +271,40 @@ func (m *Manager) ManagePackages(imageTarget shared.ImageTarget) error {
 		}
 	}
 
-	if m.def.Packages.Cleanup {
-		err = m.mgr.clean()
+	return nil
+}
+
+// DownloadPackages downloads the packages which are to be installed into
+// targetDir without installing them.
+func (m *Manager) DownloadPackages(imageTarget shared.ImageTarget, targetDir string) error {
+	var installSets []shared.DefinitionPackagesSet
+
+	for _, set := range m.def.Packages.Sets {
+		if set.Action != "install" || !shared.ApplyFilter(&set, m.def.Image.Release, m.def.Image.ArchitectureMapped, m.def.Image.Variant, m.def.Targets.Type, imageTarget) {
+			continue
+		}
+
+		installSets = append(installSets, set)
+	}
+
+	set := m.getHardwareSet(imageTarget)
+	if set != nil {
+		installSets = append(installSets, *set)
+	}
+
+	if len(installSets) == 0 {
+		return nil
+	}
+
+	err := m.mgr.refresh()
+	if err != nil {
+		return fmt.Errorf("Failed to refresh: %w", err)
+	}
+
+	for _, set := range optimizePackageSets(installSets) {
+		err = m.mgr.download(set.Packages, set.Flags, targetDir)
 		if err != nil {
-			return fmt.Errorf("Failed to clean up packages: %w", err)
+			return fmt.Errorf("Failed to download packages: %w", err)
 		}
 	}
 
@@ -1,8 +1,11 @@
 package managers
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
@@ -58,3 +61,66 @@ func TestManagePackages(t *testing.T) {
 	optimizedSets = optimizePackageSets(sets)
 	require.Len(t, optimizedSets, 0)
 }
+
+type recordingManager struct {
+	common
+
+	calls []string
+}
+
+func (m *recordingManager) load() error {
+	return nil
+}
+
+func (m *recordingManager) install(pkgs, flags []string) error {
+	m.calls = append(m.calls, fmt.Sprintf("install %s", strings.Join(pkgs, " ")))
+	return nil
+}
+
+func (m *recordingManager) remove(pkgs, flags []string) error {
+	m.calls = append(m.calls, fmt.Sprintf("remove %s", strings.Join(pkgs, " ")))
+	return nil
+}
+
+func (m *recordingManager) clean() error {
+	m.calls = append(m.calls, "clean")
+	return nil
+}
+
+func (m *recordingManager) refresh() error {
+	m.calls = append(m.calls, "refresh")
+	return nil
+}
+
+func (m *recordingManager) update() error {
+	m.calls = append(m.calls, "update")
+	return nil
+}
+
+func TestManagePackageStages(t *testing.T) {
+	def := shared.Definition{
+		Packages: shared.DefinitionPackages{
+			Update:  true,
+			Cleanup: true,
+			Sets: []shared.DefinitionPackagesSet{
+				{Packages: []string{"foo"}, Action: "install", Stage: "main"},
+				{Packages: []string{"gdb"}, Action: "remove", Stage: "late"},
+				{Packages: []string{"keyring"}, Action: "install", Stage: "early"},
+				{Packages: []string{"bar"}, Action: "install", Stage: "main"},
+			},
+		},
+	}
+
+	mgr := &recordingManager{}
+	m := Manager{mgr: mgr, def: def, logger: logrus.New()}
+
+	err := m.ManagePackages(shared.ImageTargetUndefined)
+	require.NoError(t, err)
+	require.Equal(t, []string{"refresh", "install keyring", "refresh", "update", "install foo bar"}, mgr.calls)
+
+	mgr.calls = nil
+
+	err = m.ManageLatePackages(shared.ImageTargetUndefined)
+	require.NoError(t, err)
+	require.Equal(t, []string{"refresh", "remove gdb", "clean"}, mgr.calls)
+}
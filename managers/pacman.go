@@ -84,6 +84,18 @@ func (m *pacman) load() error {
 	return nil
 }
 
+func (m *pacman) download(pkgs, flags []string, targetDir string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	args := append(slices.Clone(m.flags.global), "-Sw", "--cachedir", targetDir)
+	args = append(args, flags...)
+	args = append(args, pkgs...)
+
+	return shared.RunCommand(m.ctx, nil, nil, "pacman", args...)
+}
+
 func (m *pacman) setupTrustedKeys() error {
 	var err error
 
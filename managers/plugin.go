@@ -0,0 +1,78 @@
+package managers
+
+import (
+	"errors"
+
+	"github.com/canonical/lxd-imagebuilder/plugins"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// plugin is a package manager provided by a plugin binary.
+type plugin struct {
+	common
+
+	plugin shared.DefinitionPlugin
+}
+
+func (m *plugin) load() error {
+	return nil
+}
+
+// call calls the given method of the plugin. Methods the plugin doesn't
+// implement aren't supported.
+func (m *plugin) call(method string, args plugins.ManagerArgs) error {
+	var err error
+
+	args.Definition, err = plugins.MarshalDefinition(m.definition)
+	if err != nil {
+		return err
+	}
+
+	err = plugins.Call(m.ctx, m.logger, m.plugin, "Manager."+method, args, &plugins.Empty{})
+	if errors.Is(err, plugins.ErrNotImplemented) {
+		return ErrNotSupported
+	}
+
+	return err
+}
+
+func (m *plugin) manageRepository(repo shared.DefinitionPackagesRepository) error {
+	return m.call("ManageRepository", plugins.ManagerArgs{Repository: &plugins.Repository{
+		Name: repo.Name,
+		URL:  repo.URL,
+		Type: repo.Type,
+		Key:  repo.Key,
+	}})
+}
+
+func (m *plugin) install(pkgs, flags []string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	return m.call("Install", plugins.ManagerArgs{Packages: pkgs, Flags: flags})
+}
+
+func (m *plugin) remove(pkgs, flags []string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	return m.call("Remove", plugins.ManagerArgs{Packages: pkgs, Flags: flags})
+}
+
+func (m *plugin) download(pkgs, flags []string, targetDir string) error {
+	return m.call("Download", plugins.ManagerArgs{Packages: pkgs, Flags: flags, TargetDir: targetDir})
+}
+
+func (m *plugin) clean() error {
+	return m.call("Clean", plugins.ManagerArgs{})
+}
+
+func (m *plugin) refresh() error {
+	return m.call("Refresh", plugins.ManagerArgs{})
+}
+
+func (m *plugin) update() error {
+	return m.call("Update", plugins.ManagerArgs{})
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	lxdShared "github.com/canonical/lxd/shared"
@@ -70,6 +71,18 @@ func (m *yum) load() error {
 	return nil
 }
 
+func (m *yum) download(pkgs, flags []string, targetDir string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	args := append(slices.Clone(m.flags.global), "install", "--downloadonly", fmt.Sprintf("--downloaddir=%s", targetDir))
+	args = append(args, flags...)
+	args = append(args, pkgs...)
+
+	return shared.RunCommand(m.ctx, nil, nil, "yum", args...)
+}
+
 func (m *yum) manageRepository(repoAction shared.DefinitionPackagesRepository) error {
 	// Run rpmdb --rebuilddb
 	err := shared.RunCommand(m.ctx, nil, nil, "rpmdb", "--rebuilddb")
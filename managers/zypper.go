@@ -2,6 +2,7 @@ package managers
 
 import (
 	"errors"
+	"slices"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
 )
@@ -47,6 +48,18 @@ func (m *zypper) load() error {
 	return nil
 }
 
+func (m *zypper) download(pkgs, flags []string, targetDir string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	args := append(slices.Clone(m.flags.global), "--pkg-cache-dir", targetDir, "install", "--download-only")
+	args = append(args, flags...)
+	args = append(args, pkgs...)
+
+	return shared.RunCommand(m.ctx, nil, nil, "zypper", args...)
+}
+
 func (m *zypper) manageRepository(repoAction shared.DefinitionPackagesRepository) error {
 	if repoAction.Type != "" && repoAction.Type != "zypper" {
 		return errors.New("Invalid repository Type")
@@ -0,0 +1,305 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"github.com/sirupsen/logrus"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// pluginDir is searched for plugins without a path, if they aren't found in
+// $PATH as lxd-imagebuilder-plugin-<name>.
+var pluginDir = "/usr/lib/lxd-imagebuilder/plugins"
+
+// handshakeTimeout is how long a plugin may take to announce its socket.
+const handshakeTimeout = 30 * time.Second
+
+// binaries are the plugin binaries opened by Open, by type and name.
+var binaries = map[string]*os.File{}
+
+var binariesLock sync.Mutex
+
+// Path returns the path of the plugin binary.
+func Path(plugin shared.DefinitionPlugin) (string, error) {
+	if plugin.Path != "" {
+		return plugin.Path, nil
+	}
+
+	path, err := exec.LookPath("lxd-imagebuilder-plugin-" + plugin.Name)
+	if err == nil {
+		return path, nil
+	}
+
+	path = filepath.Join(pluginDir, plugin.Name)
+
+	if !lxdShared.PathExists(path) {
+		return "", fmt.Errorf("Plugin %q not found in $PATH or %q", plugin.Name, pluginDir)
+	}
+
+	return path, nil
+}
+
+// Open opens the binaries of the given plugins, so they can still be started
+// once the build has changed its root directory to the rootfs.
+func Open(plugins []shared.DefinitionPlugin) error {
+	binariesLock.Lock()
+	defer binariesLock.Unlock()
+
+	for _, plugin := range plugins {
+		key := plugin.Type + "/" + plugin.Name
+
+		if binaries[key] != nil {
+			continue
+		}
+
+		path, err := Path(plugin)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Failed to open plugin %q: %w", plugin.Name, err)
+		}
+
+		binaries[key] = f
+	}
+
+	return nil
+}
+
+// Client is a connection to a running plugin.
+type Client struct {
+	name   string
+	cmd    *exec.Cmd
+	rpc    *rpc.Client
+	output []*io.PipeWriter
+	done   chan struct{}
+}
+
+// Start starts the plugin, and checks that it implements the given type.
+func Start(ctx context.Context, logger *logrus.Logger, plugin shared.DefinitionPlugin) (*Client, error) {
+	if !validType(plugin.Type) {
+		return nil, fmt.Errorf("Unknown plugin type %q", plugin.Type)
+	}
+
+	binariesLock.Lock()
+	binary := binaries[plugin.Type+"/"+plugin.Name]
+	binariesLock.Unlock()
+
+	var cmd *exec.Cmd
+
+	// An opened binary is passed to the plugin as fd 3, and started from there.
+	if binary != nil {
+		cmd = exec.CommandContext(ctx, "/proc/self/fd/3")
+		cmd.ExtraFiles = []*os.File{binary}
+	} else {
+		path, err := Path(plugin)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd = exec.CommandContext(ctx, path)
+	}
+
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", MagicCookieKey, MagicCookieValue),
+		fmt.Sprintf("%s=%d", ProtocolVersionKey, ProtocolVersion))
+
+	pluginLogger := logger.WithField("plugin", plugin.Name)
+	stderr := pluginLogger.WriterLevel(logrus.InfoLevel)
+
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get output of plugin %q: %w", plugin.Name, err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start plugin %q: %w", plugin.Name, err)
+	}
+
+	c := &Client{name: plugin.Name, cmd: cmd, output: []*io.PipeWriter{stderr}, done: make(chan struct{})}
+
+	addr, err := c.handshake(ctx, stdout, pluginLogger)
+	if err != nil {
+		c.kill()
+		return nil, err
+	}
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		c.kill()
+		return nil, fmt.Errorf("Failed to connect to plugin %q: %w", plugin.Name, err)
+	}
+
+	c.rpc = jsonrpc.NewClient(conn)
+
+	var reply TypesReply
+
+	err = c.rpc.Call("Plugin.Types", Empty{}, &reply)
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("Failed to get types of plugin %q: %w", plugin.Name, err)
+	}
+
+	if !slices.Contains(reply.Types, plugin.Type) {
+		_ = c.Close()
+		return nil, fmt.Errorf("Plugin %q isn't a %s plugin", plugin.Name, plugin.Type)
+	}
+
+	return c, nil
+}
+
+// handshake reads the socket announced by the plugin, and logs its remaining
+// output.
+func (c *Client) handshake(ctx context.Context, stdout io.Reader, logger *logrus.Entry) (string, error) {
+	lines := make(chan string, 1)
+
+	go func() {
+		defer close(c.done)
+
+		scanner := bufio.NewScanner(stdout)
+
+		if scanner.Scan() {
+			lines <- scanner.Text()
+		}
+
+		close(lines)
+
+		stdoutWriter := logger.WriterLevel(logrus.InfoLevel)
+		defer stdoutWriter.Close()
+
+		_, _ = io.Copy(stdoutWriter, stdout)
+	}()
+
+	var line string
+
+	select {
+	case l, ok := <-lines:
+		if !ok {
+			return "", fmt.Errorf("Plugin %q exited without announcing its socket", c.name)
+		}
+
+		line = l
+	case <-time.After(handshakeTimeout):
+		return "", fmt.Errorf("Plugin %q didn't announce its socket within %s", c.name, handshakeTimeout)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	return parseHandshake(c.name, line)
+}
+
+// parseHandshake returns the socket from the handshake line of the plugin.
+func parseHandshake(name string, line string) (string, error) {
+	fields := strings.Split(strings.TrimSpace(line), "|")
+	if len(fields) != 3 {
+		return "", fmt.Errorf("Invalid handshake of plugin %q: %q", name, line)
+	}
+
+	version, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return "", fmt.Errorf("Invalid protocol version of plugin %q: %q", name, fields[0])
+	}
+
+	if version != ProtocolVersion {
+		return "", fmt.Errorf("Plugin %q uses protocol version %d, but version %d is required", name, version, ProtocolVersion)
+	}
+
+	if fields[1] != "unix" {
+		return "", fmt.Errorf("Plugin %q uses unsupported network %q", name, fields[1])
+	}
+
+	return fields[2], nil
+}
+
+// Call calls the given method of the plugin.
+func (c *Client) Call(method string, args any, reply any) error {
+	err := c.rpc.Call(method, args, reply)
+	if err != nil {
+		// Errors returned by the plugin are passed on as they are.
+		var serverErr rpc.ServerError
+		if errors.As(err, &serverErr) {
+			if string(serverErr) == ErrNotImplemented.Error() {
+				return ErrNotImplemented
+			}
+
+			return errors.New(string(serverErr))
+		}
+
+		return fmt.Errorf("Failed to call %q of plugin %q: %w", method, c.name, err)
+	}
+
+	return nil
+}
+
+// Close disconnects from the plugin, and waits for it to exit.
+func (c *Client) Close() error {
+	_ = c.rpc.Close()
+
+	// The plugin exits once the connection is closed, which ends its output.
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		_ = c.cmd.Process.Kill()
+		<-c.done
+	}
+
+	err := c.cmd.Wait()
+
+	for _, w := range c.output {
+		_ = w.Close()
+	}
+
+	if err != nil {
+		return fmt.Errorf("Plugin %q failed: %w", c.name, err)
+	}
+
+	return nil
+}
+
+// kill stops the plugin if starting it failed.
+func (c *Client) kill() {
+	_ = c.cmd.Process.Kill()
+	_ = c.cmd.Wait()
+
+	for _, w := range c.output {
+		_ = w.Close()
+	}
+}
+
+// Call starts the plugin, calls the given method, and stops the plugin again.
+func Call(ctx context.Context, logger *logrus.Logger, plugin shared.DefinitionPlugin, method string, args any, reply any) error {
+	c, err := Start(ctx, logger, plugin)
+	if err != nil {
+		return err
+	}
+
+	err = c.Call(method, args, reply)
+	if err != nil {
+		_ = c.Close()
+		return err
+	}
+
+	return c.Close()
+}
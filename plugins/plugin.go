@@ -0,0 +1,123 @@
+// Package plugins implements sources, managers and generators provided by
+// separate binaries.
+//
+// A plugin is started by lxd-imagebuilder for each call. It listens on a unix
+// socket, and announces it by writing a single line to stdout:
+//
+//	<protocol version>|unix|<socket path>
+//
+// lxd-imagebuilder then connects to the socket, and calls the methods of the
+// plugin using JSON-RPC 1.0. Once the connection is closed, the plugin exits.
+// Anything the plugin writes to stdout or stderr afterwards is logged.
+//
+// Plugins written in Go can use Serve to implement the protocol.
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// ProtocolVersion is the version of the plugin protocol. It's increased
+// whenever a change breaks existing plugins.
+const ProtocolVersion = 1
+
+// MagicCookieKey and MagicCookieValue are set in the environment of plugins.
+// They aren't a security measure, but tell the binary that it's run as a
+// plugin rather than by a user.
+const (
+	MagicCookieKey   = "LXD_IMAGEBUILDER_PLUGIN"
+	MagicCookieValue = "c3a1d0d5-6b0e-4b8f-9a53-3f0c2f9a7e41"
+)
+
+// ProtocolVersionKey is set in the environment of plugins to the protocol
+// version lxd-imagebuilder speaks.
+const ProtocolVersionKey = "LXD_IMAGEBUILDER_PLUGIN_PROTOCOL_VERSION"
+
+// Plugin types, which are also the names of the RPC services.
+const (
+	TypeGenerator = "generator"
+	TypeManager   = "manager"
+	TypeSource    = "source"
+)
+
+// ErrNotImplemented is returned by plugins for methods they don't support.
+var ErrNotImplemented = errors.New("Not implemented")
+
+// Empty is the reply of methods which return nothing.
+type Empty struct{}
+
+// TypesReply is the reply of Plugin.Types.
+type TypesReply struct {
+	Types []string `json:"types"`
+}
+
+// SourceArgs are the arguments of Source.Run, which downloads and unpacks the
+// rootfs.
+type SourceArgs struct {
+	// Definition is the image definition in YAML.
+	Definition string `json:"definition"`
+	RootfsDir  string `json:"rootfs_dir"`
+	CacheDir   string `json:"cache_dir"`
+	SourcesDir string `json:"sources_dir"`
+}
+
+// ManagerArgs are the arguments of the Manager methods. The methods run inside
+// of the rootfs, which is the root directory of the plugin.
+type ManagerArgs struct {
+	// Definition is the image definition in YAML.
+	Definition string `json:"definition"`
+
+	// Packages and Flags are set for Manager.Install, Manager.Remove and
+	// Manager.Download.
+	Packages []string `json:"packages,omitempty"`
+	Flags    []string `json:"flags,omitempty"`
+
+	// TargetDir is set for Manager.Download.
+	TargetDir string `json:"target_dir,omitempty"`
+
+	// Repository is set for Manager.ManageRepository.
+	Repository *Repository `json:"repository,omitempty"`
+}
+
+// Repository is a package repository.
+type Repository struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Type string `json:"type,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// GeneratorArgs are the arguments of Generator.Run, which modifies the rootfs.
+type GeneratorArgs struct {
+	// Definition is the image definition in YAML.
+	Definition string `json:"definition"`
+
+	// File is the entry of the files section in YAML.
+	File string `json:"file"`
+
+	// Target is "lxc" or "lxd" when building images for them, else empty.
+	Target    string `json:"target,omitempty"`
+	RootfsDir string `json:"rootfs_dir"`
+	CacheDir  string `json:"cache_dir"`
+}
+
+// MarshalDefinition returns the definition in the YAML format passed to plugins.
+func MarshalDefinition(definition shared.Definition) (string, error) {
+	content, err := yaml.Marshal(definition)
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshal definition: %w", err)
+	}
+
+	return string(content), nil
+}
+
+// validType returns whether the given plugin type exists.
+func validType(pluginType string) bool {
+	return slices.Contains([]string{TypeGenerator, TypeManager, TypeSource}, pluginType)
+}
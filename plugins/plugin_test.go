@@ -0,0 +1,123 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+type testSource struct{}
+
+func (s *testSource) Run(args SourceArgs) error {
+	if args.RootfsDir == "" {
+		return errors.New("Missing rootfs directory")
+	}
+
+	return os.WriteFile(filepath.Join(args.RootfsDir, "definition.yaml"), []byte(args.Definition), 0644)
+}
+
+type testManager struct{}
+
+func (m *testManager) Clean(args ManagerArgs) error    { return nil }
+func (m *testManager) Download(args ManagerArgs) error { return ErrNotImplemented }
+func (m *testManager) Install(args ManagerArgs) error {
+	return errors.New("Failed to install " + args.Packages[0])
+}
+func (m *testManager) ManageRepository(args ManagerArgs) error { return nil }
+func (m *testManager) Refresh(args ManagerArgs) error          { return nil }
+func (m *testManager) Remove(args ManagerArgs) error           { return nil }
+func (m *testManager) Update(args ManagerArgs) error           { return nil }
+
+// TestMain serves the test plugins if the test binary is started as a plugin.
+func TestMain(m *testing.M) {
+	if os.Getenv(MagicCookieKey) == MagicCookieValue {
+		err := Serve(Plugin{Source: &testSource{}, Manager: &testManager{}})
+		if err != nil {
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestCall(t *testing.T) {
+	logger := logrus.New()
+	rootfsDir := t.TempDir()
+
+	source := shared.DefinitionPlugin{Name: "test", Type: TypeSource, Path: os.Args[0]}
+
+	err := Call(context.Background(), logger, source, "Source.Run", SourceArgs{Definition: "image:\n  distribution: test\n", RootfsDir: rootfsDir}, &Empty{})
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(rootfsDir, "definition.yaml"))
+
+	err = Call(context.Background(), logger, source, "Source.Run", SourceArgs{}, &Empty{})
+	require.EqualError(t, err, "Missing rootfs directory")
+
+	manager := shared.DefinitionPlugin{Name: "test", Type: TypeManager, Path: os.Args[0]}
+
+	err = Call(context.Background(), logger, manager, "Manager.Install", ManagerArgs{Packages: []string{"foo"}}, &Empty{})
+	require.EqualError(t, err, "Failed to install foo")
+
+	err = Call(context.Background(), logger, manager, "Manager.Download", ManagerArgs{}, &Empty{})
+	require.ErrorIs(t, err, ErrNotImplemented)
+
+	generator := shared.DefinitionPlugin{Name: "test", Type: TypeGenerator, Path: os.Args[0]}
+
+	err = Call(context.Background(), logger, generator, "Generator.Run", GeneratorArgs{}, &Empty{})
+	require.EqualError(t, err, `Plugin "test" isn't a generator plugin`)
+}
+
+func TestOpen(t *testing.T) {
+	plugin := shared.DefinitionPlugin{Name: "opened", Type: TypeSource, Path: os.Args[0]}
+
+	err := Open([]shared.DefinitionPlugin{plugin})
+	require.NoError(t, err)
+
+	defer func() {
+		binariesLock.Lock()
+		_ = binaries["source/opened"].Close()
+		delete(binaries, "source/opened")
+		binariesLock.Unlock()
+	}()
+
+	// The opened binary is started, even if the path doesn't exist anymore.
+	plugin.Path = filepath.Join(t.TempDir(), "missing")
+
+	err = Call(context.Background(), logrus.New(), plugin, "Source.Run", SourceArgs{RootfsDir: t.TempDir()}, &Empty{})
+	require.NoError(t, err)
+}
+
+func Test_parseHandshake(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    string
+		wantErr string
+	}{
+		{"1|unix|/tmp/plugin.sock\n", "/tmp/plugin.sock", ""},
+		{"2|unix|/tmp/plugin.sock", "", `Plugin "test" uses protocol version 2, but version 1 is required`},
+		{"1|tcp|127.0.0.1:1234", "", `Plugin "test" uses unsupported network "tcp"`},
+		{"Hello world", "", `Invalid handshake of plugin "test": "Hello world"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := parseHandshake("test", tt.line)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+)
+
+// Source is implemented by source plugins.
+type Source interface {
+	Run(args SourceArgs) error
+}
+
+// Manager is implemented by manager plugins. Methods which aren't supported
+// return ErrNotImplemented.
+type Manager interface {
+	Clean(args ManagerArgs) error
+	Download(args ManagerArgs) error
+	Install(args ManagerArgs) error
+	ManageRepository(args ManagerArgs) error
+	Refresh(args ManagerArgs) error
+	Remove(args ManagerArgs) error
+	Update(args ManagerArgs) error
+}
+
+// Generator is implemented by generator plugins.
+type Generator interface {
+	Run(args GeneratorArgs) error
+}
+
+// Plugin holds the implementations of a plugin binary. A binary may implement
+// more than one type.
+type Plugin struct {
+	Source    Source
+	Manager   Manager
+	Generator Generator
+}
+
+// Serve serves the given plugin until lxd-imagebuilder disconnects. It fails if
+// the binary isn't run by lxd-imagebuilder.
+func Serve(p Plugin) error {
+	if os.Getenv(MagicCookieKey) != MagicCookieValue {
+		return errors.New("This binary is a plugin for lxd-imagebuilder and can't be run directly")
+	}
+
+	server := rpc.NewServer()
+
+	var types []string
+
+	if p.Source != nil {
+		types = append(types, TypeSource)
+
+		err := server.RegisterName("Source", &sourceService{impl: p.Source})
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Manager != nil {
+		types = append(types, TypeManager)
+
+		err := server.RegisterName("Manager", &managerService{impl: p.Manager})
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Generator != nil {
+		types = append(types, TypeGenerator)
+
+		err := server.RegisterName("Generator", &generatorService{impl: p.Generator})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := server.RegisterName("Plugin", &pluginService{types: types})
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "lxd-imagebuilder-plugin-")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory: %w", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "plugin.sock")
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %q: %w", socket, err)
+	}
+
+	defer listener.Close()
+
+	fmt.Printf("%d|unix|%s\n", ProtocolVersion, socket)
+
+	// lxd-imagebuilder connects exactly once.
+	conn, err := listener.Accept()
+	if err != nil {
+		return fmt.Errorf("Failed to accept connection: %w", err)
+	}
+
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+
+	return nil
+}
+
+type pluginService struct {
+	types []string
+}
+
+func (s *pluginService) Types(args Empty, reply *TypesReply) error {
+	reply.Types = s.types
+
+	return nil
+}
+
+type sourceService struct {
+	impl Source
+}
+
+func (s *sourceService) Run(args SourceArgs, reply *Empty) error {
+	return s.impl.Run(args)
+}
+
+type managerService struct {
+	impl Manager
+}
+
+func (s *managerService) Clean(args ManagerArgs, reply *Empty) error {
+	return s.impl.Clean(args)
+}
+
+func (s *managerService) Download(args ManagerArgs, reply *Empty) error {
+	return s.impl.Download(args)
+}
+
+func (s *managerService) Install(args ManagerArgs, reply *Empty) error {
+	return s.impl.Install(args)
+}
+
+func (s *managerService) ManageRepository(args ManagerArgs, reply *Empty) error {
+	return s.impl.ManageRepository(args)
+}
+
+func (s *managerService) Refresh(args ManagerArgs, reply *Empty) error {
+	return s.impl.Refresh(args)
+}
+
+func (s *managerService) Remove(args ManagerArgs, reply *Empty) error {
+	return s.impl.Remove(args)
+}
+
+func (s *managerService) Update(args ManagerArgs, reply *Empty) error {
+	return s.impl.Update(args)
+}
+
+type generatorService struct {
+	impl Generator
+}
+
+func (s *generatorService) Run(args GeneratorArgs, reply *Empty) error {
+	return s.impl.Run(args)
+}
@@ -1,19 +1,35 @@
 package shared
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"strings"
+	"time"
 
 	lxdShared "github.com/canonical/lxd/shared"
 	"golang.org/x/sys/unix"
 )
 
-// Unpack unpacks a tarball.
-func Unpack(file string, path string) error {
+// tarDecompressors are the commands decompressing tarballs to stdout, by the
+// compression of the tarball, in order of preference. They are used if they
+// are installed, as they decompress in parallel or at least in a process of
+// their own, otherwise tar decompresses the tarball itself.
+var tarDecompressors = map[string][][]string{
+	".tar.gz":  {{"pigz", "-d", "-c"}},
+	".tar.bz2": {{"lbzip2", "-d", "-c"}, {"pbzip2", "-d", "-c"}},
+	".tar.xz":  {{"pixz", "-d"}, {"xz", "-d", "-c", "-T0"}},
+	".tar.zst": {{"zstd", "-d", "-c", "-T0"}},
+}
+
+// Unpack unpacks a tarball or squashfs image. Tarballs are read through a
+// parallel decompressor if one is installed for their compression, and the
+// progress is reported to the reporter set using WithProgress.
+func Unpack(ctx context.Context, file string, path string) error {
 	extractArgs, extension, _, err := lxdShared.DetectCompression(file)
 	if err != nil {
 		return err
@@ -22,12 +38,11 @@ func Unpack(file string, path string) error {
 	command := ""
 	args := []string{}
 	var reader io.Reader
+	var progress *progressReader
 	if strings.HasPrefix(extension, ".tar") {
 		command = "tar"
 		args = append(args, "--restrict", "--force-local")
 		args = append(args, "-C", path, "--numeric-owner", "--xattrs-include=*")
-		args = append(args, extractArgs...)
-		args = append(args, "-")
 
 		f, err := os.Open(file)
 		if err != nil {
@@ -37,6 +52,36 @@ func Unpack(file string, path string) error {
 		defer f.Close()
 
 		reader = f
+
+		report := progressReporter(ctx)
+		if report != nil {
+			info, err := f.Stat()
+			if err != nil {
+				return err
+			}
+
+			progress = &progressReader{reader: f, report: report, start: time.Now()}
+			progress.progress.TotalBytes = uint64(info.Size())
+
+			reader = progress
+		}
+
+		decompressor := findDecompressor(extension)
+		if decompressor != nil {
+			args = append(args, "-xf", "-")
+
+			err = runPipeline(ctx, reader, decompressor, append([]string{command}, args...))
+			if err != nil {
+				return unpackError(path, err)
+			}
+
+			progress.done()
+
+			return nil
+		}
+
+		args = append(args, extractArgs...)
+		args = append(args, "-")
 	} else if strings.HasPrefix(extension, ".squashfs") {
 		// unsquashfs does not support reading from stdin,
 		// so ProgressTracker is not possible.
@@ -46,7 +91,7 @@ func Unpack(file string, path string) error {
 		return fmt.Errorf("Unsupported image format: %s", extension)
 	}
 
-	err = lxdShared.RunCommandWithFds(context.TODO(), reader, nil, command, args...)
+	err = lxdShared.RunCommandWithFds(ctx, reader, nil, command, args...)
 	if err != nil {
 		// We can't create char/block devices in unpriv containers so ignore related errors.
 		if command == "unsquashfs" {
@@ -83,21 +128,125 @@ func Unpack(file string, path string) error {
 			}
 		}
 
-		// Check if we ran out of space
-		fs := unix.Statfs_t{}
+		return unpackError(path, err)
+	}
+
+	progress.done()
 
-		err1 := unix.Statfs(path, &fs)
-		if err1 != nil {
-			return err1
-		}
+	return nil
+}
+
+// unpackError returns the error of a failed unpack, checking whether the
+// file system of path ran out of space.
+func unpackError(path string, err error) error {
+	fs := unix.Statfs_t{}
+
+	err1 := unix.Statfs(path, &fs)
+	if err1 != nil {
+		return err1
+	}
+
+	// Check if we're running out of space
+	if int64(fs.Bfree) < 10 {
+		return fmt.Errorf("Unable to unpack image, run out of disk space")
+	}
+
+	return fmt.Errorf("Unpack failed: %w", err)
+}
 
-		// Check if we're running out of space
-		if int64(fs.Bfree) < 10 {
-			return fmt.Errorf("Unable to unpack image, run out of disk space")
+// findDecompressor returns the preferred decompressor installed for the
+// compression of a tarball, or nil if tar should decompress it.
+func findDecompressor(extension string) []string {
+	for _, decompressor := range tarDecompressors[extension] {
+		_, err := exec.LookPath(decompressor[0])
+		if err == nil {
+			return decompressor
 		}
+	}
+
+	return nil
+}
+
+// runPipeline runs the decompressor reading from reader, and tar reading its
+// output.
+func runPipeline(ctx context.Context, reader io.Reader, decompressor []string, tar []string) error {
+	pipeReader, pipeWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Failed to create pipe: %w", err)
+	}
+
+	var decompressStderr, tarStderr bytes.Buffer
 
-		return fmt.Errorf("Unpack failed: %w", err)
+	decompress := exec.CommandContext(ctx, decompressor[0], decompressor[1:]...)
+	decompress.Stdin = reader
+	decompress.Stdout = pipeWriter
+	decompress.Stderr = &decompressStderr
+
+	extract := exec.CommandContext(ctx, tar[0], tar[1:]...)
+	extract.Stdin = pipeReader
+	extract.Stderr = &tarStderr
+
+	err = decompress.Start()
+	if err != nil {
+		pipeReader.Close()
+		pipeWriter.Close()
+		return fmt.Errorf("Failed to start %q: %w", decompressor[0], err)
+	}
+
+	err = extract.Start()
+
+	// Only the commands keep the pipe open, so the decompressor stops if tar
+	// exits early.
+	pipeReader.Close()
+	pipeWriter.Close()
+
+	if err != nil {
+		_ = decompress.Process.Kill()
+		_ = decompress.Wait()
+		return fmt.Errorf("Failed to start %q: %w", tar[0], err)
+	}
+
+	extractErr := extract.Wait()
+	decompressErr := decompress.Wait()
+
+	if extractErr != nil {
+		return fmt.Errorf("Failed to run %q: %w (%s)", tar[0], extractErr, strings.TrimSpace(tarStderr.String()))
+	}
+
+	if decompressErr != nil {
+		return fmt.Errorf("Failed to run %q: %w (%s)", decompressor[0], decompressErr, strings.TrimSpace(decompressStderr.String()))
 	}
 
 	return nil
 }
+
+// progressReader reports how much of a file has been read.
+type progressReader struct {
+	reader   io.Reader
+	report   func(CopyProgress)
+	progress CopyProgress
+	start    time.Time
+}
+
+// Read reads from the file and reports the progress.
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+
+	r.progress.Bytes += uint64(n)
+	r.progress.update(r.start)
+	r.report(r.progress)
+
+	return n, err
+}
+
+// done reports the final progress. It does nothing if r is nil.
+func (r *progressReader) done() {
+	if r == nil {
+		return
+	}
+
+	r.progress.Done = true
+	r.progress.ETA = 0
+	r.progress.update(r.start)
+	r.report(r.progress)
+}
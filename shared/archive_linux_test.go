@@ -0,0 +1,77 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnpack(t *testing.T) {
+	srcDir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(srcDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(srcDir, "etc/hostname"), []byte("test\n"), 0644)
+	require.NoError(t, err)
+
+	// gzip is decompressed by tar itself unless pigz is installed, and xz by
+	// a separate xz process.
+	for _, compression := range []string{"gzip", "xz"} {
+		t.Run(compression, func(t *testing.T) {
+			_, err := exec.LookPath(compression)
+			if err != nil {
+				t.Skipf("%s isn't installed", compression)
+			}
+
+			tarball := filepath.Join(t.TempDir(), "rootfs.tar")
+
+			err = exec.Command("tar", "-C", srcDir, "--use-compress-program", compression, "-cf", tarball, ".").Run()
+			require.NoError(t, err)
+
+			info, err := os.Stat(tarball)
+			require.NoError(t, err)
+
+			var last CopyProgress
+
+			ctx := WithProgress(context.Background(), func(progress CopyProgress) {
+				last = progress
+			})
+
+			destDir := t.TempDir()
+
+			err = Unpack(ctx, tarball, destDir)
+			require.NoError(t, err)
+
+			content, err := os.ReadFile(filepath.Join(destDir, "etc/hostname"))
+			require.NoError(t, err)
+			require.Equal(t, "test\n", string(content))
+
+			require.True(t, last.Done)
+			require.Equal(t, uint64(info.Size()), last.Bytes)
+			require.Equal(t, 100, last.Percent)
+		})
+	}
+}
+
+func TestUnpackFailed(t *testing.T) {
+	tarball := filepath.Join(t.TempDir(), "rootfs.tar.xz")
+
+	// A valid xz header followed by garbage.
+	err := os.WriteFile(tarball, append([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, make([]byte, 512)...), 0644)
+	require.NoError(t, err)
+
+	var done bool
+
+	ctx := WithProgress(context.Background(), func(progress CopyProgress) {
+		done = progress.Done
+	})
+
+	err = Unpack(ctx, tarball, t.TempDir())
+	require.Error(t, err)
+	require.False(t, done)
+}
@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -181,6 +182,10 @@ func SetupChroot(rootfs string, definition Definition, m []ChrootMount) (func()
 	// Mount the rootfs
 	err := unix.Mount(rootfs, rootfs, "", unix.MS_BIND, "")
 	if err != nil {
+		if errors.Is(err, unix.EPERM) {
+			err = LXDConfigError(err, "security.nesting=true")
+		}
+
 		return nil, fmt.Errorf("Failed to mount '%s': %w", rootfs, err)
 	}
 
@@ -195,6 +200,16 @@ func SetupChroot(rootfs string, definition Definition, m []ChrootMount) (func()
 		{"/etc/resolv.conf", "/etc/resolv.conf", "", unix.MS_BIND, "", false},
 	}
 
+	// Unprivileged containers can't create device nodes, so the ones of the
+	// host are bind mounted instead.
+	if !CanMknod(rootfs) {
+		for _, d := range chrootDevices {
+			if lxdShared.PathExists(d.Path) {
+				mounts = append(mounts, ChrootMount{d.Path, d.Path, "", unix.MS_BIND, "", false})
+			}
+		}
+	}
+
 	// Keep a reference to the host rootfs and cwd
 	root, err := os.Open("/")
 	if err != nil {
@@ -206,6 +221,11 @@ func SetupChroot(rootfs string, definition Definition, m []ChrootMount) (func()
 		return nil, err
 	}
 
+	// Bind mounting the host's resolv.conf creates an empty one if it's
+	// missing, which is removed again when exiting the chroot.
+	_, err = os.Lstat(filepath.Join(rootfs, "etc", "resolv.conf"))
+	resolvConfMissing := errors.Is(err, os.ErrNotExist)
+
 	// Setup all needed mounts in a temporary location
 	if len(m) > 0 {
 		err = setupMounts(rootfs, append(mounts, m...))
@@ -214,6 +234,10 @@ func SetupChroot(rootfs string, definition Definition, m []ChrootMount) (func()
 	}
 
 	if err != nil {
+		if errors.Is(err, unix.EPERM) {
+			err = LXDConfigError(err, "security.nesting=true")
+		}
+
 		return nil, fmt.Errorf("Failed to mount filesystems: %w", err)
 	}
 
@@ -369,7 +393,28 @@ exit 101
 
 		ActiveChroots[rootfs] = nil
 
-		return os.MkdirAll(devPath, 0755)
+		err = os.MkdirAll(devPath, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %q: %w", devPath, err)
+		}
+
+		if resolvConfMissing {
+			err = removeEmptyFile(filepath.Join(rootfs, "etc", "resolv.conf"))
+			if err != nil {
+				return err
+			}
+		}
+
+		// The host's resolv.conf is bind mounted during the build, so packages
+		// can't replace the copy left by the downloader with the stub symlink.
+		if definition.Environment.ResolvConfPolicy != "keep" {
+			err = restoreResolvConf(rootfs)
+			if err != nil {
+				return fmt.Errorf("Failed to restore resolv.conf: %w", err)
+			}
+		}
+
+		return nil
 	}
 
 	ActiveChroots[rootfs] = exitFunc
@@ -377,23 +422,91 @@ exit 101
 	return exitFunc, nil
 }
 
-func populateDev() error {
-	devs := []struct {
-		Path  string
-		Major uint32
-		Minor uint32
-		Mode  uint32
-	}{
-		{"/dev/console", 5, 1, unix.S_IFCHR | 0640},
-		{"/dev/full", 1, 7, unix.S_IFCHR | 0666},
-		{"/dev/null", 1, 3, unix.S_IFCHR | 0666},
-		{"/dev/random", 1, 8, unix.S_IFCHR | 0666},
-		{"/dev/tty", 5, 0, unix.S_IFCHR | 0666},
-		{"/dev/urandom", 1, 9, unix.S_IFCHR | 0666},
-		{"/dev/zero", 1, 5, unix.S_IFCHR | 0666},
+// ResolvedStubResolvConf is the target of /etc/resolv.conf on systems using
+// the stub resolver of systemd-resolved.
+const ResolvedStubResolvConf = "../run/systemd/resolve/stub-resolv.conf"
+
+// UsesResolved returns whether systemd-resolved is enabled in the given rootfs.
+func UsesResolved(rootfs string) bool {
+	for _, path := range []string{
+		"etc/systemd/system/dbus-org.freedesktop.resolve1.service",
+		"etc/systemd/system/multi-user.target.wants/systemd-resolved.service",
+		"etc/systemd/system/sysinit.target.wants/systemd-resolved.service",
+	} {
+		_, err := os.Lstat(filepath.Join(rootfs, path))
+		if err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeEmptyFile removes the file if it's a regular file without content.
+func removeEmptyFile(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() > 0 {
+		return nil
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("Failed to remove %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// restoreResolvConf replaces /etc/resolv.conf of the given rootfs with the
+// symlink to the systemd-resolved stub, if systemd-resolved is enabled and
+// /etc/resolv.conf isn't a symlink already.
+func restoreResolvConf(rootfs string) error {
+	if !UsesResolved(rootfs) {
+		return nil
+	}
+
+	path := filepath.Join(rootfs, "etc", "resolv.conf")
+
+	fi, err := os.Lstat(path)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to stat %q: %w", path, err)
+	}
+
+	err = os.RemoveAll(path)
+	if err != nil {
+		return fmt.Errorf("Failed to remove %q: %w", path, err)
+	}
+
+	err = os.Symlink(ResolvedStubResolvConf, path)
+	if err != nil {
+		return fmt.Errorf("Failed to create link %q -> %q: %w", path, ResolvedStubResolvConf, err)
 	}
 
-	for _, d := range devs {
+	return nil
+}
+
+// chrootDevices are the device nodes created in /dev of the chroot.
+var chrootDevices = []struct {
+	Path  string
+	Major uint32
+	Minor uint32
+	Mode  uint32
+}{
+	{"/dev/console", 5, 1, unix.S_IFCHR | 0640},
+	{"/dev/full", 1, 7, unix.S_IFCHR | 0666},
+	{"/dev/null", 1, 3, unix.S_IFCHR | 0666},
+	{"/dev/random", 1, 8, unix.S_IFCHR | 0666},
+	{"/dev/tty", 5, 0, unix.S_IFCHR | 0666},
+	{"/dev/urandom", 1, 9, unix.S_IFCHR | 0666},
+	{"/dev/zero", 1, 5, unix.S_IFCHR | 0666},
+}
+
+func populateDev() error {
+	for _, d := range chrootDevices {
 		if lxdShared.PathExists(d.Path) {
 			continue
 		}
@@ -402,7 +515,7 @@ func populateDev() error {
 
 		err := unix.Mknod(d.Path, d.Mode, int(dev))
 		if err != nil {
-			return fmt.Errorf("Failed to create %q: %w", d.Path, err)
+			return fmt.Errorf("Failed to create %q: %w", d.Path, LXDConfigError(err, "security.syscalls.intercept.mknod=true"))
 		}
 
 		// For some odd reason, unix.Mknod will not set the mode correctly.
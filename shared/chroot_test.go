@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreResolvConf(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolved bool
+		symlink  string
+		want     string
+	}{
+		{"host copy with systemd-resolved", true, "", ResolvedStubResolvConf},
+		{"host copy without systemd-resolved", false, "", ""},
+		{"existing symlink", true, "../run/systemd/resolve/resolv.conf", "../run/systemd/resolve/resolv.conf"},
+	}
+
+	for _, tt := range tests {
+		rootfs := t.TempDir()
+
+		err := os.MkdirAll(filepath.Join(rootfs, "etc", "systemd", "system", "sysinit.target.wants"), 0755)
+		require.NoError(t, err)
+
+		if tt.resolved {
+			err := os.Symlink("/usr/lib/systemd/system/systemd-resolved.service", filepath.Join(rootfs, "etc", "systemd", "system", "sysinit.target.wants", "systemd-resolved.service"))
+			require.NoError(t, err)
+		}
+
+		resolvConf := filepath.Join(rootfs, "etc", "resolv.conf")
+
+		if tt.symlink != "" {
+			err = os.Symlink(tt.symlink, resolvConf)
+		} else {
+			err = os.WriteFile(resolvConf, []byte("nameserver 192.0.2.1\n"), 0644)
+		}
+
+		require.NoError(t, err)
+
+		err = restoreResolvConf(rootfs)
+		require.NoError(t, err, tt.name)
+
+		target, err := os.Readlink(resolvConf)
+		if tt.want == "" {
+			require.Error(t, err, tt.name)
+
+			content, err := os.ReadFile(resolvConf)
+			require.NoError(t, err)
+			require.Equal(t, "nameserver 192.0.2.1\n", string(content))
+
+			continue
+		}
+
+		require.NoError(t, err, tt.name)
+		require.Equal(t, tt.want, target, tt.name)
+	}
+}
+
+func TestRemoveEmptyFile(t *testing.T) {
+	dir := t.TempDir()
+
+	empty := filepath.Join(dir, "empty")
+	err := os.WriteFile(empty, nil, 0644)
+	require.NoError(t, err)
+
+	full := filepath.Join(dir, "full")
+	err = os.WriteFile(full, []byte("nameserver 192.0.2.1\n"), 0644)
+	require.NoError(t, err)
+
+	link := filepath.Join(dir, "link")
+	err = os.Symlink("empty", link)
+	require.NoError(t, err)
+
+	for _, path := range []string{link, full, empty, filepath.Join(dir, "missing")} {
+		err := removeEmptyFile(path)
+		require.NoError(t, err)
+	}
+
+	require.NoFileExists(t, empty)
+	require.FileExists(t, full)
+
+	_, err = os.Lstat(link)
+	require.NoError(t, err)
+}
@@ -0,0 +1,148 @@
+package shared
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// repeatableKernelParams may be given more than once, e.g. to write the
+// console to several devices. Other parameters replace earlier ones.
+var repeatableKernelParams = []string{"console"}
+
+// KernelCmdline is a kernel command line. It keeps the order of the
+// parameters, so the command line only changes where parameters are set.
+type KernelCmdline struct {
+	params []string
+}
+
+// NewKernelCmdline returns a kernel command line with the given parameters.
+func NewKernelCmdline(params ...string) *KernelCmdline {
+	c := &KernelCmdline{}
+
+	for _, param := range params {
+		c.Set(param)
+	}
+
+	return c
+}
+
+// ParseKernelCmdline parses the given kernel command line. Values may be
+// quoted with double quotes to contain spaces.
+func ParseKernelCmdline(cmdline string) (*KernelCmdline, error) {
+	var params []string
+	var param strings.Builder
+
+	quoted := false
+
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			param.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if param.Len() > 0 {
+				params = append(params, param.String())
+				param.Reset()
+			}
+
+		default:
+			param.WriteRune(r)
+		}
+	}
+
+	if quoted {
+		return nil, errors.New("Unterminated quote in kernel command line")
+	}
+
+	if param.Len() > 0 {
+		params = append(params, param.String())
+	}
+
+	return NewKernelCmdline(params...), nil
+}
+
+// kernelParamKey returns the name of the given parameter.
+func kernelParamKey(param string) string {
+	key, _, _ := strings.Cut(param, "=")
+
+	return key
+}
+
+// Set sets the given parameter, e.g. "root=LABEL=rootfs" or "quiet". It
+// replaces a parameter of the same name in place, unless the parameter is
+// repeatable. "ro" and "rw" replace each other.
+func (c *KernelCmdline) Set(param string) {
+	key := kernelParamKey(param)
+
+	if slices.Contains(repeatableKernelParams, key) {
+		if !slices.Contains(c.params, param) {
+			c.params = append(c.params, param)
+		}
+
+		return
+	}
+
+	keys := []string{key}
+
+	if key == "ro" || key == "rw" {
+		keys = []string{"ro", "rw"}
+	}
+
+	var params []string
+
+	replaced := false
+
+	for _, p := range c.params {
+		if !slices.Contains(keys, kernelParamKey(p)) {
+			params = append(params, p)
+			continue
+		}
+
+		if !replaced {
+			params = append(params, param)
+			replaced = true
+		}
+	}
+
+	if !replaced {
+		params = append(params, param)
+	}
+
+	c.params = params
+}
+
+// Merge sets all parameters of the given command line.
+func (c *KernelCmdline) Merge(other *KernelCmdline) {
+	for _, param := range other.params {
+		c.Set(param)
+	}
+}
+
+// Get returns the first parameter of the given name.
+func (c *KernelCmdline) Get(key string) (string, bool) {
+	for _, p := range c.params {
+		if kernelParamKey(p) == key {
+			return p, true
+		}
+	}
+
+	return "", false
+}
+
+// Remove removes all parameters of the given name.
+func (c *KernelCmdline) Remove(key string) {
+	c.params = slices.DeleteFunc(c.params, func(p string) bool {
+		return kernelParamKey(p) == key
+	})
+}
+
+// Params returns the parameters.
+func (c *KernelCmdline) Params() []string {
+	return slices.Clone(c.params)
+}
+
+// String returns the kernel command line.
+func (c *KernelCmdline) String() string {
+	return strings.Join(c.params, " ")
+}
@@ -0,0 +1,50 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKernelCmdline(t *testing.T) {
+	cmdline, err := ParseKernelCmdline("root=LABEL=rootfs ro  console=tty0\tconsole=ttyS0,115200 dyndbg=\"file drivers/* +p\" quiet")
+	require.NoError(t, err)
+	require.Equal(t, []string{"root=LABEL=rootfs", "ro", "console=tty0", "console=ttyS0,115200", "dyndbg=\"file drivers/* +p\"", "quiet"}, cmdline.Params())
+
+	cmdline, err = ParseKernelCmdline("")
+	require.NoError(t, err)
+	require.Equal(t, "", cmdline.String())
+
+	_, err = ParseKernelCmdline("dyndbg=\"file")
+	require.Error(t, err)
+}
+
+func TestKernelCmdlineSet(t *testing.T) {
+	cmdline := NewKernelCmdline("root=PARTUUID=1234", "ro", "console=tty0", "quiet")
+
+	// Parameters are replaced in place.
+	cmdline.Set("root=LABEL=rootfs")
+	cmdline.Set("rw")
+
+	// Consoles are added, unless they're set already.
+	cmdline.Set("console=ttyS0")
+	cmdline.Set("console=tty0")
+
+	require.Equal(t, "root=LABEL=rootfs rw console=tty0 quiet console=ttyS0", cmdline.String())
+
+	root, ok := cmdline.Get("root")
+	require.True(t, ok)
+	require.Equal(t, "root=LABEL=rootfs", root)
+
+	cmdline.Remove("console")
+	require.Equal(t, "root=LABEL=rootfs rw quiet", cmdline.String())
+
+	_, ok = cmdline.Get("console")
+	require.False(t, ok)
+
+	other, err := ParseKernelCmdline("ro quiet=1 splash")
+	require.NoError(t, err)
+
+	cmdline.Merge(other)
+	require.Equal(t, "root=LABEL=rootfs ro quiet=1 splash", cmdline.String())
+}
@@ -0,0 +1,79 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lxdShared "github.com/canonical/lxd/shared"
+	"golang.org/x/sys/unix"
+)
+
+// An LXDContainer describes the LXD container lxd-imagebuilder runs in, which
+// limits what a build can do.
+type LXDContainer struct {
+	// Privileged is whether the container runs without an ID map.
+	Privileged bool
+
+	// Mknod is whether device nodes can be created, which unprivileged
+	// containers can only do if security.syscalls.intercept.mknod is set.
+	Mknod bool
+
+	// Loop is whether loop devices can be attached.
+	Loop bool
+}
+
+// InLXDContainer returns whether lxd-imagebuilder runs inside of an LXD
+// container.
+func InLXDContainer() bool {
+	return lxdShared.PathExists("/dev/lxd/sock") || lxdShared.PathExists("/dev/.lxd-mounts")
+}
+
+// DetectLXDContainer returns the LXD container lxd-imagebuilder runs in, or
+// nil if it doesn't run inside of one. Whether device nodes can be created is
+// checked in dir.
+func DetectLXDContainer(dir string) *LXDContainer {
+	if !InLXDContainer() {
+		return nil
+	}
+
+	c := &LXDContainer{Mknod: CanMknod(dir)}
+
+	uidMap, err := os.ReadFile("/proc/self/uid_map")
+	if err == nil {
+		c.Privileged = strings.Join(strings.Fields(string(uidMap)), " ") == "0 0 4294967295"
+	}
+
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err == nil {
+		c.Loop = true
+		_ = ctl.Close()
+	}
+
+	return c
+}
+
+// CanMknod returns whether character devices can be created in dir.
+func CanMknod(dir string) bool {
+	path := filepath.Join(dir, ".lxd-imagebuilder-mknod")
+
+	err := unix.Mknod(path, unix.S_IFCHR|0600, int(unix.Mkdev(1, 3)))
+	if err != nil {
+		return false
+	}
+
+	_ = os.Remove(path)
+
+	return true
+}
+
+// LXDConfigError adds the configuration keys the LXD container needs to err,
+// if lxd-imagebuilder runs inside of one.
+func LXDConfigError(err error, keys ...string) error {
+	if err == nil || !InLXDContainer() {
+		return err
+	}
+
+	return fmt.Errorf("%w (the LXD container running lxd-imagebuilder needs %s, e.g. using \"lxc config set <container> %s\" on the LXD host)", err, strings.Join(keys, " and "), strings.Join(keys, " "))
+}
@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanMknod(t *testing.T) {
+	dir := t.TempDir()
+
+	// Only root outside of unprivileged containers can create device nodes.
+	if os.Geteuid() == 0 && !InLXDContainer() {
+		require.True(t, CanMknod(dir))
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestLXDConfigError(t *testing.T) {
+	err := errors.New("Operation not permitted")
+
+	require.Nil(t, LXDConfigError(nil, "security.nesting=true"))
+
+	wrapped := LXDConfigError(err, "security.nesting=true")
+	require.ErrorIs(t, wrapped, err)
+
+	if InLXDContainer() {
+		require.Contains(t, wrapped.Error(), "security.nesting=true")
+	} else {
+		require.Equal(t, err, wrapped)
+	}
+}
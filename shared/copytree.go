@@ -0,0 +1,470 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CopyProgress is the overall progress of a copy.
+type CopyProgress struct {
+	// Bytes is the number of bytes copied so far, out of TotalBytes.
+	Bytes      uint64
+	TotalBytes uint64
+
+	// Percent is the share of the total size copied so far.
+	Percent int
+
+	// Rate is the average number of bytes copied per second.
+	Rate float64
+
+	// Files is the number of files copied so far, out of TotalFiles.
+	Files      uint64
+	TotalFiles uint64
+
+	// ETA is the estimated remaining time of the copy.
+	ETA time.Duration
+
+	// Done is set for the final progress once the copy has finished.
+	Done bool
+}
+
+// update calculates the share of the total, the rate and the ETA of a copy
+// started at start.
+func (p *CopyProgress) update(start time.Time) {
+	elapsed := time.Since(start)
+
+	if p.TotalBytes > 0 {
+		p.Percent = int(p.Bytes * 100 / p.TotalBytes)
+	} else if p.Done {
+		p.Percent = 100
+	}
+
+	if elapsed > 0 {
+		p.Rate = float64(p.Bytes) / elapsed.Seconds()
+	}
+
+	if !p.Done && p.Rate > 0 {
+		p.ETA = time.Duration(float64(p.TotalBytes-p.Bytes) / p.Rate * float64(time.Second)).Round(time.Second)
+	}
+}
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx reporting the progress of long running
+// operations like Unpack to report.
+func WithProgress(ctx context.Context, report func(CopyProgress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+// progressReporter returns the function progress is reported to, or nil.
+func progressReporter(ctx context.Context) func(CopyProgress) {
+	report, _ := ctx.Value(progressKey{}).(func(CopyProgress))
+	return report
+}
+
+// treeCopier copies a directory tree like "rsync -aHASX --devices". File
+// contents are reflinked or copied by the kernel where the file systems
+// support it, and holes are kept.
+type treeCopier struct {
+	ctx    context.Context
+	report func(CopyProgress)
+
+	progress CopyProgress
+	start    time.Time
+
+	// links maps the inodes of hard linked files to their first copy.
+	links map[[2]uint64]string
+
+	// The fallbacks are remembered once a file system doesn't support them.
+	noClone     bool
+	noCopyRange bool
+}
+
+// CopyTree copies the contents of src into dest, which may exist already.
+// Ownership, permissions, timestamps, extended attributes including ACLs,
+// hard links, device files and holes are kept. The progress is passed to
+// report, which may be nil.
+func CopyTree(ctx context.Context, src string, dest string, report func(CopyProgress)) error {
+	c := &treeCopier{ctx: ctx, report: report, start: time.Now(), links: map[[2]uint64]string{}}
+
+	// Count the files first, so the progress has a total.
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		c.progress.TotalFiles++
+
+		if info.Mode().IsRegular() {
+			c.progress.TotalBytes += uint64(info.Size())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to walk %q: %w", src, err)
+	}
+
+	err = c.copyDir(src, dest)
+	if err != nil {
+		return err
+	}
+
+	c.progress.Done = true
+	c.progress.ETA = 0
+	c.sendProgress()
+
+	return nil
+}
+
+// sendProgress reports the current progress.
+func (c *treeCopier) sendProgress() {
+	if c.report == nil {
+		return
+	}
+
+	c.progress.update(c.start)
+	c.report(c.progress)
+}
+
+// copyDir copies the directory src and its contents to dest. The metadata of
+// the directory is set after its contents, as they change its timestamps.
+func (c *treeCopier) copyDir(src string, dest string) error {
+	err := c.ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		return fmt.Errorf("Failed to stat %q: %w", src, err)
+	}
+
+	destInfo, err := os.Lstat(dest)
+	if err == nil && !destInfo.IsDir() {
+		err = os.RemoveAll(dest)
+		if err != nil {
+			return fmt.Errorf("Failed to remove %q: %w", dest, err)
+		}
+	}
+
+	err = os.Mkdir(dest, 0700)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("Failed to create directory %q: %w", dest, err)
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("Failed to read directory %q: %w", src, err)
+	}
+
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		destPath := filepath.Join(dest, entry.Name())
+
+		if entry.IsDir() {
+			err = c.copyDir(srcPath, destPath)
+		} else {
+			err = c.copyEntry(srcPath, destPath)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	c.progress.Files++
+
+	return copyMetadata(src, dest, info)
+}
+
+// copyEntry copies a file, symlink, device file, FIFO or socket.
+func (c *treeCopier) copyEntry(src string, dest string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return fmt.Errorf("Failed to stat %q: %w", src, err)
+	}
+
+	// Existing files are replaced.
+	destInfo, err := os.Lstat(dest)
+	if err == nil {
+		if destInfo.IsDir() {
+			err = os.RemoveAll(dest)
+		} else {
+			err = os.Remove(dest)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to remove %q: %w", dest, err)
+		}
+	}
+
+	stat := info.Sys().(*syscall.Stat_t)
+
+	if !info.IsDir() && stat.Nlink > 1 {
+		key := [2]uint64{uint64(stat.Dev), stat.Ino}
+
+		target, ok := c.links[key]
+		if ok {
+			err = os.Link(target, dest)
+			if err != nil {
+				return fmt.Errorf("Failed to link %q: %w", dest, err)
+			}
+
+			c.progress.Files++
+
+			if info.Mode().IsRegular() {
+				c.progress.Bytes += uint64(info.Size())
+			}
+
+			return nil
+		}
+
+		c.links[key] = dest
+	}
+
+	switch {
+	case info.Mode().IsRegular():
+		err = c.copyFile(src, dest, info)
+		if err != nil {
+			return err
+		}
+	case info.Mode().Type() == fs.ModeSymlink:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return fmt.Errorf("Failed to read link %q: %w", src, err)
+		}
+
+		err = os.Symlink(target, dest)
+		if err != nil {
+			return fmt.Errorf("Failed to create symlink %q: %w", dest, err)
+		}
+	default:
+		err = unix.Mknod(dest, stat.Mode, int(stat.Rdev))
+		if err != nil {
+			return fmt.Errorf("Failed to create %q: %w", dest, err)
+		}
+	}
+
+	c.progress.Files++
+	c.sendProgress()
+
+	return copyMetadata(src, dest, info)
+}
+
+// copyFile copies the content of a regular file. It's reflinked if both are
+// on the same file system, otherwise the data segments are copied by the
+// kernel, keeping the holes.
+func (c *treeCopier) copyFile(src string, dest string, info fs.FileInfo) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %w", src, err)
+	}
+
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create %q: %w", dest, err)
+	}
+
+	defer destFile.Close()
+
+	if !c.noClone {
+		err = unix.IoctlFileClone(int(destFile.Fd()), int(srcFile.Fd()))
+		if err == nil {
+			c.progress.Bytes += uint64(info.Size())
+
+			return destFile.Close()
+		}
+
+		// Reflinks only work within a file system, which is the same for
+		// all files of a copy.
+		c.noClone = true
+	}
+
+	err = c.copySegments(srcFile, destFile, info.Size())
+	if err != nil {
+		return fmt.Errorf("Failed to copy %q: %w", src, err)
+	}
+
+	// The file may end with a hole.
+	err = destFile.Truncate(info.Size())
+	if err != nil {
+		return fmt.Errorf("Failed to truncate %q: %w", dest, err)
+	}
+
+	return destFile.Close()
+}
+
+// copySegments copies the data segments of src to the same offsets of dest.
+func (c *treeCopier) copySegments(src *os.File, dest *os.File, size int64) error {
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(int(src.Fd()), offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// There's only a hole left.
+			c.progress.Bytes += uint64(size - offset)
+
+			return nil
+		}
+
+		if err != nil {
+			// Without SEEK_DATA, the file is copied as a whole.
+			start = offset
+		}
+
+		end, err := unix.Seek(int(src.Fd()), start, unix.SEEK_HOLE)
+		if err != nil {
+			end = size
+		}
+
+		err = c.copyRange(src, dest, start, end-start)
+		if err != nil {
+			return err
+		}
+
+		// The holes count as copied as well.
+		c.progress.Bytes += uint64(end - offset)
+		c.sendProgress()
+
+		offset = end
+	}
+
+	return nil
+}
+
+// copyRange copies a range of src to the same offset of dest.
+func (c *treeCopier) copyRange(src *os.File, dest *os.File, offset int64, length int64) error {
+	for !c.noCopyRange && length > 0 {
+		srcOffset := offset
+		destOffset := offset
+
+		n, err := unix.CopyFileRange(int(src.Fd()), &srcOffset, int(dest.Fd()), &destOffset, int(min(length, 1<<30)), 0)
+		if err != nil {
+			// Copies between file systems need Linux 5.19 or later.
+			if errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL) {
+				c.noCopyRange = true
+				break
+			}
+
+			return err
+		}
+
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+
+		offset += int64(n)
+		length -= int64(n)
+	}
+
+	if length == 0 {
+		return nil
+	}
+
+	_, err := io.Copy(io.NewOffsetWriter(dest, offset), io.NewSectionReader(src, offset, length))
+
+	return err
+}
+
+// copyMetadata copies the ownership, permissions, extended attributes and
+// timestamps of src to dest. The ownership comes first, as changing it
+// clears setuid bits and file capabilities.
+func copyMetadata(src string, dest string, info fs.FileInfo) error {
+	stat := info.Sys().(*syscall.Stat_t)
+
+	err := os.Lchown(dest, int(stat.Uid), int(stat.Gid))
+	if err != nil {
+		return fmt.Errorf("Failed to change owner of %q: %w", dest, err)
+	}
+
+	isSymlink := info.Mode().Type() == fs.ModeSymlink
+
+	// The permissions of symlinks can't be changed.
+	if !isSymlink {
+		err = unix.Chmod(dest, stat.Mode&07777)
+		if err != nil {
+			return fmt.Errorf("Failed to change permissions of %q: %w", dest, err)
+		}
+	}
+
+	err = copyXattrs(src, dest)
+	if err != nil {
+		return err
+	}
+
+	times := []unix.Timespec{unix.Timespec(stat.Atim), unix.Timespec(stat.Mtim)}
+
+	err = unix.UtimesNanoAt(unix.AT_FDCWD, dest, times, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fmt.Errorf("Failed to set timestamps of %q: %w", dest, err)
+	}
+
+	return nil
+}
+
+// copyXattrs copies the extended attributes of src to dest, which include
+// the ACLs.
+func copyXattrs(src string, dest string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+
+		return fmt.Errorf("Failed to list extended attributes of %q: %w", src, err)
+	}
+
+	if size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+
+	size, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return fmt.Errorf("Failed to list extended attributes of %q: %w", src, err)
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		valueSize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return fmt.Errorf("Failed to get extended attribute %q of %q: %w", name, src, err)
+		}
+
+		value := make([]byte, valueSize)
+
+		valueSize, err = unix.Lgetxattr(src, name, value)
+		if err != nil {
+			return fmt.Errorf("Failed to get extended attribute %q of %q: %w", name, src, err)
+		}
+
+		err = unix.Lsetxattr(dest, name, value[:valueSize], 0)
+		if err != nil {
+			// File systems like the vfat of the ESP don't have extended
+			// attributes.
+			if errors.Is(err, unix.ENOTSUP) {
+				return nil
+			}
+
+			return fmt.Errorf("Failed to set extended attribute %q of %q: %w", name, dest, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyTree(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "etc", "empty"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "etc", "hostname"), []byte("test\n"), 0644))
+	require.NoError(t, os.Chmod(filepath.Join(src, "etc", "empty"), 0700))
+	require.NoError(t, os.Symlink("hostname", filepath.Join(src, "etc", "name")))
+	require.NoError(t, os.Link(filepath.Join(src, "etc", "hostname"), filepath.Join(src, "etc", "hostname.link")))
+
+	// A file with a hole in between and at the end.
+	sparse, err := os.Create(filepath.Join(src, "sparse"))
+	require.NoError(t, err)
+	_, err = sparse.WriteAt([]byte("start"), 0)
+	require.NoError(t, err)
+	_, err = sparse.WriteAt([]byte("middle"), 8<<20)
+	require.NoError(t, err)
+	require.NoError(t, sparse.Truncate(16<<20))
+	require.NoError(t, sparse.Close())
+
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(src, "etc"), mtime, mtime))
+
+	// Existing files are replaced, and other existing files are kept.
+	require.NoError(t, os.MkdirAll(filepath.Join(dest, "boot", "efi"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dest, "sparse"), []byte("old"), 0644))
+
+	var last CopyProgress
+
+	err = CopyTree(context.Background(), src+"/", dest, func(progress CopyProgress) { last = progress })
+	require.NoError(t, err)
+
+	require.True(t, last.Done)
+	require.Equal(t, 100, last.Percent)
+	require.Equal(t, last.TotalFiles, last.Files)
+	require.Equal(t, last.TotalBytes, last.Bytes)
+
+	content, err := os.ReadFile(filepath.Join(dest, "etc", "hostname"))
+	require.NoError(t, err)
+	require.Equal(t, "test\n", string(content))
+
+	target, err := os.Readlink(filepath.Join(dest, "etc", "name"))
+	require.NoError(t, err)
+	require.Equal(t, "hostname", target)
+
+	info, err := os.Stat(filepath.Join(dest, "etc", "hostname"))
+	require.NoError(t, err)
+
+	linkInfo, err := os.Stat(filepath.Join(dest, "etc", "hostname.link"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(info, linkInfo))
+
+	info, err = os.Stat(filepath.Join(dest, "etc", "empty"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	info, err = os.Stat(filepath.Join(dest, "etc"))
+	require.NoError(t, err)
+	require.True(t, info.ModTime().Equal(mtime))
+
+	require.DirExists(t, filepath.Join(dest, "boot", "efi"))
+
+	content, err = os.ReadFile(filepath.Join(dest, "sparse"))
+	require.NoError(t, err)
+	require.Len(t, content, 16<<20)
+	require.Equal(t, "start", string(content[:5]))
+	require.Equal(t, "middle", string(content[8<<20:8<<20+6]))
+
+	// The holes are kept, unless the file has been reflinked.
+	info, err = os.Stat(filepath.Join(dest, "sparse"))
+	require.NoError(t, err)
+	require.Less(t, info.Sys().(*syscall.Stat_t).Blocks*512, int64(16<<20))
+}
+
+func TestCopyTreeCanceled(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(src, "file"), []byte("test"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := CopyTree(ctx, src, dest, nil)
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -1,15 +1,24 @@
 package shared
 
 import (
+	"encoding"
 	"errors"
 	"fmt"
+	"net/netip"
+	"net/url"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf16"
 
+	lxdShared "github.com/canonical/lxd/shared"
 	"github.com/canonical/lxd/shared/osarch"
+
+	"github.com/canonical/lxd-imagebuilder/shared/version"
 )
 
 // ImageTarget represents the image target.
@@ -66,7 +75,8 @@ type Filter interface {
 	GetTypes() []DefinitionFilterType
 }
 
-// A DefinitionFilter defines filters for various actions.
+// A DefinitionFilter defines filters for various actions. It's embedded as the
+// last field, so the filters are written after the fields they apply to.
 type DefinitionFilter struct {
 	Releases      []string               `yaml:"releases,omitempty"`
 	Architectures []string               `yaml:"architectures,omitempty"`
@@ -97,20 +107,21 @@ func (d *DefinitionFilter) GetTypes() []DefinitionFilterType {
 // A DefinitionPackagesSet is a set of packages which are to be installed
 // or removed.
 type DefinitionPackagesSet struct {
-	DefinitionFilter `yaml:",inline"`
 	Packages         []string `yaml:"packages"`
 	Action           string   `yaml:"action"`
 	Early            bool     `yaml:"early,omitempty"`
+	Stage            string   `yaml:"stage,omitempty"`
 	Flags            []string `yaml:"flags,omitempty"`
+	DefinitionFilter `yaml:",inline"`
 }
 
 // A DefinitionPackagesRepository contains data of a specific repository.
 type DefinitionPackagesRepository struct {
-	DefinitionFilter `yaml:",inline"`
 	Name             string `yaml:"name"`           // Name of the repository
 	URL              string `yaml:"url"`            // URL (may differ based on manager)
 	Type             string `yaml:"type,omitempty"` // For distros that have more than one repository manager
 	Key              string `yaml:"key,omitempty"`  // GPG armored keyring
+	DefinitionFilter `yaml:",inline"`
 }
 
 // CustomManagerCmd represents a command for a custom manager.
@@ -131,12 +142,13 @@ type DefinitionPackagesCustomManager struct {
 
 // A DefinitionPackages represents a package handler.
 type DefinitionPackages struct {
-	Manager       string                           `yaml:"manager,omitempty"`
-	CustomManager *DefinitionPackagesCustomManager `yaml:"custom_manager,omitempty"`
-	Update        bool                             `yaml:"update,omitempty"`
-	Cleanup       bool                             `yaml:"cleanup,omitempty"`
-	Sets          []DefinitionPackagesSet          `yaml:"sets,omitempty"`
-	Repositories  []DefinitionPackagesRepository   `yaml:"repositories,omitempty"`
+	Manager          string                           `yaml:"manager,omitempty"`
+	CustomManager    *DefinitionPackagesCustomManager `yaml:"custom_manager,omitempty"`
+	Update           bool                             `yaml:"update,omitempty"`
+	Cleanup          bool                             `yaml:"cleanup,omitempty"`
+	Sets             []DefinitionPackagesSet          `yaml:"sets,omitempty"`
+	Repositories     []DefinitionPackagesRepository   `yaml:"repositories,omitempty"`
+	SkipVerification bool                             `yaml:"skip_verification,omitempty"`
 }
 
 // A DefinitionImage represents the image.
@@ -146,14 +158,36 @@ type DefinitionImage struct {
 	Release      string `yaml:"release,omitempty"`
 	Architecture string `yaml:"architecture,omitempty"`
 	Expiry       string `yaml:"expiry,omitempty"`
+	EOL          string `yaml:"eol,omitempty"`
+	EOLPolicy    string `yaml:"eol_policy,omitempty"`
 	Variant      string `yaml:"variant,omitempty"`
 	Name         string `yaml:"name,omitempty"`
 	Serial       string `yaml:"serial,omitempty"`
+	Init         string `yaml:"init,omitempty"`
 
 	// Internal fields (YAML input ignored)
 	ArchitectureMapped      string `yaml:"architecture_mapped,omitempty"`
 	ArchitectureKernel      string `yaml:"architecture_kernel,omitempty"`
 	ArchitecturePersonality string `yaml:"architecture_personality,omitempty"`
+
+	// initDetected is set if init is detected instead of set in the definition.
+	initDetected bool
+}
+
+// GetEOLDate returns the end-of-life date of the image release. The date is
+// taken from image.eol if set, otherwise from the embedded EOL database. The
+// returned bool is false if the date is unknown.
+func (d *DefinitionImage) GetEOLDate() (time.Time, bool, error) {
+	if d.EOL != "" {
+		eol, err := time.Parse(EOLDateLayout, d.EOL)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("Failed to parse EOL date %q: %w", d.EOL, err)
+		}
+
+		return eol, true, nil
+	}
+
+	return GetEOLDate(d.Distribution, d.Release)
 }
 
 // A DefinitionSource specifies the download type and location.
@@ -171,11 +205,11 @@ type DefinitionSource struct {
 
 // A DefinitionTargetLXCConfig represents the config part of the metadata.
 type DefinitionTargetLXCConfig struct {
-	DefinitionFilter `yaml:",inline"`
 	Type             string `yaml:"type"`
 	Before           uint   `yaml:"before,omitempty"`
 	After            uint   `yaml:"after,omitempty"`
 	Content          string `yaml:"content"`
+	DefinitionFilter `yaml:",inline"`
 }
 
 // A DefinitionTargetLXC represents LXC specific files as part of the metadata.
@@ -184,347 +218,2486 @@ type DefinitionTargetLXC struct {
 	Config        []DefinitionTargetLXCConfig `yaml:"config,omitempty"`
 }
 
-// DefinitionTargetLXDVM represents LXD VM specific options.
-type DefinitionTargetLXDVM struct {
-	Size       uint64 `yaml:"size,omitempty"`
-	Filesystem string `yaml:"filesystem,omitempty"`
+// DefinitionTargetLXDVMEncryption represents the LUKS encryption of the VM root partition.
+type DefinitionTargetLXDVMEncryption struct {
+	Passphrase string `yaml:"passphrase,omitempty"`
+	Keyfile    string `yaml:"keyfile,omitempty"`
 }
 
-// DefinitionTargetLXD represents LXD specific options.
-type DefinitionTargetLXD struct {
-	VM DefinitionTargetLXDVM `yaml:"vm,omitempty"`
+// DefinitionTargetLXDVMLVM represents the LVM layout of the VM root partition.
+type DefinitionTargetLXDVMLVM struct {
+	VolumeGroup    string `yaml:"volume_group,omitempty"`
+	RootSize       uint64 `yaml:"root_size,omitempty"`
+	SwapSize       uint64 `yaml:"swap_size,omitempty"`
+	DataSize       uint64 `yaml:"data_size,omitempty"`
+	DataMountpoint string `yaml:"data_mountpoint,omitempty"`
 }
 
-// A DefinitionTarget specifies target dependent files.
-type DefinitionTarget struct {
-	LXC  DefinitionTargetLXC  `yaml:"lxc,omitempty"`
-	LXD  DefinitionTargetLXD  `yaml:"lxd,omitempty"`
-	Type DefinitionFilterType // This field is internal only and used only for simplicity.
+// DefinitionTargetLXDVMZFSDataset represents a ZFS dataset of the VM root pool.
+type DefinitionTargetLXDVMZFSDataset struct {
+	Name       string            `yaml:"name"`
+	Mountpoint string            `yaml:"mountpoint,omitempty"`
+	Properties map[string]string `yaml:"properties,omitempty"`
 }
 
-// A DefinitionFile represents a file which is to be created inside to chroot.
-type DefinitionFile struct {
-	DefinitionFilter `yaml:",inline"`
-	Generator        string                 `yaml:"generator"`
-	Path             string                 `yaml:"path,omitempty"`
-	Content          string                 `yaml:"content,omitempty"`
-	Name             string                 `yaml:"name,omitempty"`
-	Template         DefinitionFileTemplate `yaml:"template,omitempty"`
-	Templated        bool                   `yaml:"templated,omitempty"`
-	Mode             string                 `yaml:"mode,omitempty"`
-	GID              string                 `yaml:"gid,omitempty"`
-	UID              string                 `yaml:"uid,omitempty"`
-	Pongo            bool                   `yaml:"pongo,omitempty"`
-	Source           string                 `yaml:"source,omitempty"`
+// DefinitionTargetLXDVMZFS represents the ZFS layout of the VM root partition.
+type DefinitionTargetLXDVMZFS struct {
+	Pool     string                            `yaml:"pool,omitempty"`
+	Datasets []DefinitionTargetLXDVMZFSDataset `yaml:"datasets,omitempty"`
 }
 
-// A DefinitionFileTemplate represents the settings used by generators.
-type DefinitionFileTemplate struct {
-	Properties map[string]string `yaml:"properties,omitempty"`
-	When       []string          `yaml:"when,omitempty"`
+// DefinitionTargetLXDVMBtrfsSubvolume represents a btrfs subvolume of the VM root filesystem.
+type DefinitionTargetLXDVMBtrfsSubvolume struct {
+	Name       string   `yaml:"name"`
+	Mountpoint string   `yaml:"mountpoint,omitempty"`
+	Options    []string `yaml:"options,omitempty"`
 }
 
-// A DefinitionAction specifies a custom action (script) which is to be run after
-// a certain action.
-type DefinitionAction struct {
-	DefinitionFilter `yaml:",inline"`
-	Trigger          string `yaml:"trigger"`
-	Action           string `yaml:"action"`
-	Pongo            bool   `yaml:"pongo,omitempty"`
+// DefinitionTargetLXDVMBtrfs represents the btrfs layout of the VM root partition.
+type DefinitionTargetLXDVMBtrfs struct {
+	Subvolumes   []DefinitionTargetLXDVMBtrfsSubvolume `yaml:"subvolumes,omitempty"`
+	MountOptions []string                              `yaml:"mount_options,omitempty"`
+	MkfsOptions  []string                              `yaml:"mkfs_options,omitempty"`
 }
 
-// DefinitionMappings defines custom mappings.
-type DefinitionMappings struct {
-	Architectures   map[string]string `yaml:"architectures,omitempty"`
-	ArchitectureMap string            `yaml:"architecture_map,omitempty"`
+// DefinitionTargetLXDVMFirmware represents the UEFI firmware files on the build
+// host used to boot the VM image under QEMU.
+type DefinitionTargetLXDVMFirmware struct {
+	Code string `yaml:"code,omitempty"`
+	Vars string `yaml:"vars,omitempty"`
 }
 
-// DefinitionEnvVars defines custom environment variables.
-type DefinitionEnvVars struct {
-	DefinitionFilter `yaml:",inline"`
-	Key              string `yaml:"key"`
-	Value            string `yaml:"value"`
+// DefinitionTargetLXDVMHardware represents the CPU microcode and the device
+// firmware installed into the VM image. The firmware files which aren't kept
+// are pruned after the packages have been installed.
+type DefinitionTargetLXDVMHardware struct {
+	Microcode bool     `yaml:"microcode,omitempty"`
+	Firmware  []string `yaml:"firmware,omitempty"`
 }
 
-// DefinitionEnv represents the config part of the environment section.
-type DefinitionEnv struct {
-	ClearDefaults bool                `yaml:"clear_defaults,omitempty"`
-	EnvVariables  []DefinitionEnvVars `yaml:"variables,omitempty"`
+// DefinitionTargetLXDVMVerity represents the dm-verity hash partition protecting
+// the read-only root partition of the VM image.
+type DefinitionTargetLXDVMVerity struct {
+	HashSize uint64 `yaml:"hash_size,omitempty"`
 }
 
-// DefinitionSimplestreamRequirements contains a map of image requirements
-// and filters to selectively apply the requirements.
-type DefinitionSimplestreamRequirements struct {
-	DefinitionFilter `yaml:",inline"`
+// DefinitionTargetLXDVMBootTest represents the boot test of the VM image under QEMU.
+type DefinitionTargetLXDVMBootTest struct {
+	Timeout  string   `yaml:"timeout,omitempty"`
+	Memory   uint64   `yaml:"memory,omitempty"`
+	Patterns []string `yaml:"patterns,omitempty"`
 
-	// Map of the image requirements.
-	Requirements map[string]string `yaml:"requirements,omitempty"`
+	// noNetwork is set in restricted mode to boot the VM without network access.
+	noNetwork bool
 }
 
-// DefinitionSimplestream contains additional information about the image.
-// It is parsed by the simplestream-maintainer when building a product
-// catalog.
-type DefinitionSimplestream struct {
-	// Pretty distro name.
-	DistroName string `yaml:"distro_name,omitempty"`
+// HasNetwork returns whether the VM has network access during the boot test.
+func (d *DefinitionTargetLXDVMBootTest) HasNetwork() bool {
+	return !d.noNetwork
+}
 
-	// Map of release aliases. Key represents the release name and value
-	// is a comma delimited string of additional release aliases.
-	ReleaseAliases map[string]string `yaml:"release_aliases,omitempty"`
+// GetTimeout returns how long to wait for the VM image to boot.
+func (d *DefinitionTargetLXDVMBootTest) GetTimeout() (time.Duration, error) {
+	if d.Timeout == "" {
+		return 5 * time.Minute, nil
+	}
 
-	// List of the image requirements.
-	Requirements []DefinitionSimplestreamRequirements `yaml:"requirements,omitempty"`
+	timeout, err := time.ParseDuration(d.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid targets.lxd.vm.boot_test.timeout %q: %w", d.Timeout, err)
+	}
+
+	if timeout <= 0 {
+		return 0, fmt.Errorf("Invalid targets.lxd.vm.boot_test.timeout %q: must be positive", d.Timeout)
+	}
+
+	return timeout, nil
 }
 
-// A Definition a definition.
-type Definition struct {
-	Image        DefinitionImage        `yaml:"image"`
-	Source       DefinitionSource       `yaml:"source"`
-	Targets      DefinitionTarget       `yaml:"targets,omitempty"`
-	Files        []DefinitionFile       `yaml:"files,omitempty"`
-	Packages     DefinitionPackages     `yaml:"packages,omitempty"`
-	Actions      []DefinitionAction     `yaml:"actions,omitempty"`
-	Mappings     DefinitionMappings     `yaml:"mappings,omitempty"`
-	Environment  DefinitionEnv          `yaml:"environment,omitempty"`
-	Simplestream DefinitionSimplestream `yaml:"simplestream,omitempty"`
+// DefinitionTargetLXDVMESP represents the EFI system partition of the VM image.
+type DefinitionTargetLXDVMESP struct {
+	Size  uint64 `yaml:"size,omitempty"`
+	Label string `yaml:"label,omitempty"`
+	FAT   uint   `yaml:"fat,omitempty"`
 }
 
-// SetValue writes the provided value to a field represented by the yaml tag 'key'.
-func (d *Definition) SetValue(key string, value string) error {
-	// Walk through the definition and find the field with the given key
-	field, err := getFieldByTag(reflect.ValueOf(d).Elem(), reflect.TypeOf(d).Elem(), key)
-	if err != nil {
-		return fmt.Errorf("Failed to get field by tag: %w", err)
-	}
+// DefinitionTargetLXDVMPartition represents the partition table entry of a
+// partition of the VM image.
+type DefinitionTargetLXDVMPartition struct {
+	Type       string   `yaml:"type,omitempty"`
+	Name       string   `yaml:"name,omitempty"`
+	Attributes []string `yaml:"attributes,omitempty"`
+}
 
-	// Fail if the field cannot be set
-	if !field.CanSet() {
-		return fmt.Errorf("Cannot set value for %s", key)
+// gptPartitionTypes are the partition types of the Discoverable Partitions
+// Specification which can be used by name.
+var gptPartitionTypes = map[string]string{
+	"esp":                  "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+	"xbootldr":             "BC13C2FF-59E6-4262-A352-B275FD6F7172",
+	"swap":                 "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F",
+	"linux-generic":        "0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+	"root-x86-64":          "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+	"root-arm64":           "B921B045-1DF0-41C3-AF44-4C6F280D3FAE",
+	"root-riscv64":         "72EC70A6-CF74-40E6-BD49-4BDA08E8F224",
+	"root-ppc64-le":        "C31C45E6-3F39-412E-80FB-4809C4980599",
+	"root-s390x":           "5EEAD9A9-FE09-4A1E-A1D7-520D00531306",
+	"root-x86-64-verity":   "2C7357ED-EBD2-46D9-AEC1-23D437EC2BF5",
+	"root-arm64-verity":    "DF3300CE-D69F-4C92-978C-9BFB0F38D820",
+	"root-riscv64-verity":  "AE0253BE-1167-4007-AC68-43926C14C5DE",
+	"root-ppc64-le-verity": "906BD944-4589-4AAE-A4E4-DD983917446A",
+	"root-s390x-verity":    "B325BFBE-C7BE-4AB8-8357-139E652D2F6B",
+}
+
+// gptPartitionAttributes are the bits of the partition attribute flags which
+// can be used by name.
+var gptPartitionAttributes = map[string]uint{
+	"required":             0,
+	"no-block-io-protocol": 1,
+	"legacy-bios-bootable": 2,
+	"grow-file-system":     59,
+	"read-only":            60,
+	"no-auto":              63,
+}
+
+// GetType returns the partition type GUID, or an empty string if the type is
+// unset.
+func (p *DefinitionTargetLXDVMPartition) GetType() string {
+	guid, ok := gptPartitionTypes[p.Type]
+	if ok {
+		return guid
 	}
 
-	switch field.Kind() {
-	case reflect.Bool:
-		v, err := strconv.ParseBool(value)
-		if err != nil {
-			return fmt.Errorf("Failed to parse bool %q: %w", value, err)
-		}
+	return strings.ToUpper(p.Type)
+}
 
-		field.SetBool(v)
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		v, err := strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			return fmt.Errorf("Failed to parse int %q: %w", value, err)
-		}
+// GetAttributes returns the partition attribute flags.
+func (p *DefinitionTargetLXDVMPartition) GetAttributes() uint64 {
+	var attributes uint64
 
-		field.SetInt(v)
-	case reflect.String:
-		field.SetString(value)
-	case reflect.Uint, reflect.Uintptr, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		v, err := strconv.ParseUint(value, 10, 64)
-		if err != nil {
-			return fmt.Errorf("Failed to parse uint %q: %w", value, err)
+	for _, attribute := range p.Attributes {
+		bit, ok := gptPartitionAttributes[attribute]
+		if !ok {
+			value, err := strconv.ParseUint(attribute, 10, 8)
+			if err != nil {
+				continue
+			}
+
+			bit = uint(value)
 		}
 
-		field.SetUint(v)
-	default:
-		return fmt.Errorf("Unsupported type '%s'", field.Kind())
+		attributes |= 1 << bit
 	}
 
-	return nil
+	return attributes
 }
 
-// SetDefaults sets some default values.
-func (d *Definition) SetDefaults() {
-	// default to local arch
-	if d.Image.Architecture == "" {
-		localArch, _ := osarch.ArchitectureGetLocal()
-		d.Image.Architecture = localArch
+// DefinitionTargetLXDVMSwap represents the swap space of the VM image.
+type DefinitionTargetLXDVMSwap struct {
+	Type string `yaml:"type,omitempty"`
+	Size uint64 `yaml:"size"`
+	Path string `yaml:"path,omitempty"`
+}
+
+// DefinitionTargetLXDVMBootArtifacts represents the kernel, initrd and kernel
+// command line which are extracted from the VM image for direct kernel boot.
+type DefinitionTargetLXDVMBootArtifacts struct {
+	Cmdline   string `yaml:"cmdline,omitempty"`
+	RootImage bool   `yaml:"root_image,omitempty"`
+}
+
+// DefinitionTargetLXDVMKernelCmdline represents the kernel command line of the
+// VM image, which is shared by the boot loaders and the boot artifacts.
+type DefinitionTargetLXDVMKernelCmdline struct {
+	Mode    string   `yaml:"mode,omitempty"`
+	Console []string `yaml:"console,omitempty"`
+	Extra   string   `yaml:"extra,omitempty"`
+}
+
+// DefinitionTargetLXDVMUBoot represents a u-boot binary which is written to the VM image.
+type DefinitionTargetLXDVMUBoot struct {
+	Path   string `yaml:"path"`
+	Offset uint64 `yaml:"offset"`
+}
+
+// DefinitionTargetLXDVMBootloader represents the boot loader installed into the VM image.
+type DefinitionTargetLXDVMBootloader struct {
+	Type       string                      `yaml:"type,omitempty"`
+	SecureBoot bool                        `yaml:"secure_boot,omitempty"`
+	UBoot      *DefinitionTargetLXDVMUBoot `yaml:"u_boot,omitempty"`
+}
+
+// DefinitionTargetLXDVMSeed represents a NoCloud seed used to boot the VM image outside of LXD.
+type DefinitionTargetLXDVMSeed struct {
+	UserData      string `yaml:"user_data,omitempty"`
+	MetaData      string `yaml:"meta_data,omitempty"`
+	NetworkConfig string `yaml:"network_config,omitempty"`
+	Embed         bool   `yaml:"embed,omitempty"`
+}
+
+// DefinitionTargetLXDVMDisk represents an additional disk which is created
+// alongside the VM image.
+type DefinitionTargetLXDVMDisk struct {
+	Name       string `yaml:"name"`
+	Type       string `yaml:"type,omitempty"`
+	Size       uint64 `yaml:"size,omitempty"`
+	Filesystem string `yaml:"filesystem,omitempty"`
+	Label      string `yaml:"label,omitempty"`
+	Mountpoint string `yaml:"mountpoint,omitempty"`
+}
+
+// DefinitionTargetLXDVMSize represents the size of the VM image, which is
+// either a number of bytes or "auto".
+type DefinitionTargetLXDVMSize struct {
+	Bytes uint64
+
+	// Auto calculates the size from the rootfs.
+	Auto bool
+}
+
+// UnmarshalText parses the size.
+func (d *DefinitionTargetLXDVMSize) UnmarshalText(text []byte) error {
+	if string(text) == "auto" {
+		*d = DefinitionTargetLXDVMSize{Auto: true}
+
+		return nil
 	}
 
-	// set default expiry of 30 days
-	if d.Image.Expiry == "" {
-		d.Image.Expiry = "30d"
+	size, err := strconv.ParseUint(string(text), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid size %q, must be a number of bytes or \"auto\"", text)
 	}
 
-	// Set default serial number
-	if d.Image.Serial == "" {
-		d.Image.Serial = time.Now().UTC().Format("20060102_1504")
+	*d = DefinitionTargetLXDVMSize{Bytes: size}
+
+	return nil
+}
+
+// UnmarshalYAML parses the size.
+func (d *DefinitionTargetLXDVMSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var size string
+
+	err := unmarshal(&size)
+	if err != nil {
+		return err
 	}
 
-	// Set default variant
-	if d.Image.Variant == "" {
-		d.Image.Variant = "default"
+	return d.UnmarshalText([]byte(size))
+}
+
+// MarshalYAML returns the size as it's written in the definition.
+func (d DefinitionTargetLXDVMSize) MarshalYAML() (interface{}, error) {
+	if d.Auto {
+		return "auto", nil
 	}
 
-	// Set default keyserver
-	if d.Source.Keyserver == "" {
-		d.Source.Keyserver = "hkps.pool.sks-keyservers.net"
+	return d.Bytes, nil
+}
+
+// DefinitionTargetLXDVM represents LXD VM specific options.
+type DefinitionTargetLXDVM struct {
+	Size              DefinitionTargetLXDVMSize                 `yaml:"size,omitempty"`
+	SizeHeadroom      uint64                                    `yaml:"size_headroom,omitempty"`
+	Filesystem        string                                    `yaml:"filesystem,omitempty"`
+	FilesystemOptions map[string]string                         `yaml:"filesystem_options,omitempty"`
+	Backend           string                                    `yaml:"backend,omitempty"`
+	Btrfs             *DefinitionTargetLXDVMBtrfs               `yaml:"btrfs,omitempty"`
+	BootArtifacts     *DefinitionTargetLXDVMBootArtifacts       `yaml:"boot_artifacts,omitempty"`
+	BootTest          *DefinitionTargetLXDVMBootTest            `yaml:"boot_test,omitempty"`
+	Bootloader        *DefinitionTargetLXDVMBootloader          `yaml:"bootloader,omitempty"`
+	Disks             []DefinitionTargetLXDVMDisk               `yaml:"disks,omitempty"`
+	Encryption        *DefinitionTargetLXDVMEncryption          `yaml:"encryption,omitempty"`
+	ESP               DefinitionTargetLXDVMESP                  `yaml:"esp,omitempty"`
+	Firmware          *DefinitionTargetLXDVMFirmware            `yaml:"firmware,omitempty"`
+	GrowRoot          bool                                      `yaml:"grow_root,omitempty"`
+	Hardware          *DefinitionTargetLXDVMHardware            `yaml:"hardware,omitempty"`
+	KernelCmdline     *DefinitionTargetLXDVMKernelCmdline       `yaml:"kernel_cmdline,omitempty"`
+	LVM               *DefinitionTargetLXDVMLVM                 `yaml:"lvm,omitempty"`
+	Partitions        map[string]DefinitionTargetLXDVMPartition `yaml:"partitions,omitempty"`
+	Seed              *DefinitionTargetLXDVMSeed                `yaml:"seed,omitempty"`
+	Shrink            string                                    `yaml:"shrink,omitempty"`
+	SkipChecks        bool                                      `yaml:"skip_checks,omitempty"`
+	Swap              *DefinitionTargetLXDVMSwap                `yaml:"swap,omitempty"`
+	Verity            *DefinitionTargetLXDVMVerity              `yaml:"verity,omitempty"`
+	ZFS               *DefinitionTargetLXDVMZFS                 `yaml:"zfs,omitempty"`
+}
+
+// GetZFSRootDataset returns the ZFS dataset which is mounted at /.
+func (d *DefinitionTargetLXDVM) GetZFSRootDataset() string {
+	if d.ZFS == nil {
+		return ""
 	}
 
-	// Set default name and description templates
-	if d.Image.Name == "" {
-		d.Image.Name = "{{ image.distribution }}-{{ image.release }}-{{ image.architecture_mapped }}-{{ image.variant }}-{{ image.serial }}"
+	for _, dataset := range d.ZFS.Datasets {
+		if dataset.Mountpoint == "/" {
+			return fmt.Sprintf("%s/%s", d.ZFS.Pool, dataset.Name)
+		}
 	}
 
-	if d.Image.Description == "" {
-		d.Image.Description = "{{ image.distribution|capfirst }} {{ image.release }} {{ image.architecture_mapped }}{% if image.variant != \"default\" %} ({{ image.variant }}){% endif %} ({{ image.serial }})"
+	return ""
+}
+
+// GetBtrfsSubvolumes returns the btrfs subvolumes of the root filesystem. If
+// none are defined, a single @ subvolume mounted at / is used.
+func (d *DefinitionTargetLXDVM) GetBtrfsSubvolumes() []DefinitionTargetLXDVMBtrfsSubvolume {
+	if d.Btrfs == nil || len(d.Btrfs.Subvolumes) == 0 {
+		return []DefinitionTargetLXDVMBtrfsSubvolume{{Name: "@", Mountpoint: "/"}}
 	}
 
-	// Set default target type. This will only be overridden if building VMs for LXD.
-	d.Targets.Type = DefinitionFilterTypeContainer
+	return d.Btrfs.Subvolumes
 }
 
-// Validate validates the Definition.
-func (d *Definition) Validate() error {
-	if strings.TrimSpace(d.Image.Distribution) == "" {
-		return errors.New("image.distribution may not be empty")
+// GetBtrfsRootSubvolume returns the btrfs subvolume which is mounted at /.
+func (d *DefinitionTargetLXDVM) GetBtrfsRootSubvolume() string {
+	for _, subvolume := range d.GetBtrfsSubvolumes() {
+		if subvolume.Mountpoint == "/" {
+			return subvolume.Name
+		}
 	}
 
-	validDownloaders := []string{
-		"almalinux-http",
-		"alpinelinux-http",
-		"alt-http",
-		"apertis-http",
-		"archlinux-http",
-		"busybox",
-		"centos-http",
-		"springdalelinux-http",
-		"debootstrap",
-		"rpmbootstrap",
-		"fedora-http",
-		"gentoo-http",
-		"ubuntu-http",
-		"sabayon-http",
-		"docker-http",
-		"oraclelinux-http",
-		"openeuler-http",
-		"opensuse-http",
-		"openwrt-http",
-		"plamolinux-http",
-		"voidlinux-http",
-		"funtoo-http",
-		"rootfs-http",
-		"rockylinux-http",
-		"vyos-http",
-		"slackware-http",
-		"nixos-http",
+	return ""
+}
+
+// validateFilesystemOptions validates the options used when creating the root filesystem.
+func (d *DefinitionTargetLXDVM) validateFilesystemOptions() error {
+	if len(d.FilesystemOptions) == 0 {
+		return nil
 	}
 
-	if !slices.Contains(validDownloaders, strings.TrimSpace(d.Source.Downloader)) {
-		return fmt.Errorf("source.downloader must be one of %v", validDownloaders)
+	if d.Filesystem != "" && d.Filesystem != "ext4" {
+		return fmt.Errorf("targets.lxd.vm.filesystem_options is not supported for %q", d.Filesystem)
 	}
 
-	if d.Packages.Manager != "" {
-		validManagers := []string{
-			"apk",
-			"apt",
-			"dnf",
-			"egoportage",
-			"opkg",
-			"pacman",
-			"portage",
-			"yum",
-			"equo",
-			"xbps",
-			"zypper",
-			"anise",
-			"slackpkg",
-		}
-
-		if !slices.Contains(validManagers, strings.TrimSpace(d.Packages.Manager)) {
-			return fmt.Errorf("packages.manager must be one of %v", validManagers)
-		}
+	for key, value := range d.FilesystemOptions {
+		switch key {
+		case "block_size":
+			if !slices.Contains([]string{"1024", "2048", "4096", "65536"}, value) {
+				return fmt.Errorf("targets.lxd.vm.filesystem_options.block_size must be one of %v", []string{"1024", "2048", "4096", "65536"})
+			}
 
-		if d.Packages.CustomManager != nil {
-			return errors.New("cannot have both packages.manager and packages.custom_manager set")
-		}
-	} else {
-		if d.Packages.CustomManager == nil {
-			return errors.New("packages.manager or packages.custom_manager needs to be set")
-		}
+		case "inode_count", "inode_ratio", "inode_size", "resize":
+			_, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid targets.lxd.vm.filesystem_options.%s %q: %w", key, value, err)
+			}
 
-		if d.Packages.CustomManager.Clean.Command == "" {
-			return errors.New("packages.custom_manager requires a clean command")
-		}
+		case "reserved_blocks":
+			percentage, err := strconv.ParseFloat(value, 64)
+			if err != nil || percentage < 0 || percentage > 50 {
+				return errors.New("targets.lxd.vm.filesystem_options.reserved_blocks must be a percentage between 0 and 50")
+			}
 
-		if d.Packages.CustomManager.Install.Command == "" {
-			return errors.New("packages.custom_manager requires an install command")
-		}
+		case "encoding", "features":
+			if value == "" || strings.ContainsAny(value, " \t") {
+				return fmt.Errorf("Invalid targets.lxd.vm.filesystem_options.%s %q", key, value)
+			}
 
-		if d.Packages.CustomManager.Remove.Command == "" {
-			return errors.New("packages.custom_manager requires a remove command")
+		default:
+			return fmt.Errorf("Unknown targets.lxd.vm.filesystem_options key %q", key)
 		}
+	}
 
-		if d.Packages.CustomManager.Refresh.Command == "" {
-			return errors.New("packages.custom_manager requires a refresh command")
-		}
+	_, hasInodeCount := d.FilesystemOptions["inode_count"]
+	_, hasInodeRatio := d.FilesystemOptions["inode_ratio"]
 
-		if d.Packages.CustomManager.Update.Command == "" {
-			return errors.New("packages.custom_manager requires an update command")
-		}
+	if hasInodeCount && hasInodeRatio {
+		return errors.New("targets.lxd.vm.filesystem_options cannot have both inode_count and inode_ratio set")
 	}
 
-	validGenerators := []string{
-		"dump",
+	return nil
+}
+
+// DefinitionTargetLXD represents LXD specific options.
+type DefinitionTargetLXD struct {
+	VM           DefinitionTargetLXDVM       `yaml:"vm,omitempty"`
+	Properties   map[string]string           `yaml:"properties,omitempty"`
+	Requirements map[string]string           `yaml:"requirements,omitempty"`
+	Publish      *DefinitionTargetLXDPublish `yaml:"publish,omitempty"`
+}
+
+// DefinitionTargetLXDPublish represents the LXD server the image is uploaded
+// to after the build.
+type DefinitionTargetLXDPublish struct {
+	Remote     string   `yaml:"remote,omitempty"`
+	Project    string   `yaml:"project,omitempty"`
+	Public     bool     `yaml:"public,omitempty"`
+	Aliases    []string `yaml:"aliases,omitempty"`
+	Keep       uint     `yaml:"keep,omitempty"`
+	Expiry     string   `yaml:"expiry,omitempty"`
+	ClientCert string   `yaml:"client_cert,omitempty"`
+	ClientKey  string   `yaml:"client_key,omitempty"`
+	ServerCert string   `yaml:"server_cert,omitempty"`
+}
+
+// DefinitionTargetTar represents the options of the created tarballs.
+type DefinitionTargetTar struct {
+	Format string   `yaml:"format,omitempty"`
+	Xattrs []string `yaml:"xattrs,omitempty"`
+}
+
+// DefinitionTargetWSLAppx represents the appx package scaffolding of a WSL distribution.
+type DefinitionTargetWSLAppx struct {
+	Name        string `yaml:"name,omitempty"`
+	Publisher   string `yaml:"publisher,omitempty"`
+	DisplayName string `yaml:"display_name,omitempty"`
+	Version     string `yaml:"version,omitempty"`
+}
+
+// DefinitionTargetWSL represents WSL specific options.
+type DefinitionTargetWSL struct {
+	DefaultName string                   `yaml:"default_name,omitempty"`
+	DefaultUser string                   `yaml:"default_user,omitempty"`
+	Systemd     bool                     `yaml:"systemd,omitempty"`
+	Icon        string                   `yaml:"icon,omitempty"`
+	Appx        *DefinitionTargetWSLAppx `yaml:"appx,omitempty"`
+}
+
+// DefinitionTargetSysext represents a systemd-sysext or systemd-confext extension image.
+type DefinitionTargetSysext struct {
+	Type   string   `yaml:"type,omitempty"`
+	Name   string   `yaml:"name,omitempty"`
+	Format string   `yaml:"format,omitempty"`
+	Paths  []string `yaml:"paths,omitempty"`
+	Level  string   `yaml:"level,omitempty"`
+}
+
+// DefinitionTargetEncrypt represents the encryption of the artifacts before
+// they're published to the target directory.
+type DefinitionTargetEncrypt struct {
+	Method         string   `yaml:"method,omitempty"`
+	Recipients     []string `yaml:"recipients,omitempty"`
+	PassphraseFile string   `yaml:"passphrase_file,omitempty"`
+}
+
+// A DefinitionTarget specifies target dependent files.
+type DefinitionTarget struct {
+	LXC     DefinitionTargetLXC      `yaml:"lxc,omitempty"`
+	LXD     DefinitionTargetLXD      `yaml:"lxd,omitempty"`
+	Tar     DefinitionTargetTar      `yaml:"tar,omitempty"`
+	WSL     DefinitionTargetWSL      `yaml:"wsl,omitempty"`
+	Sysext  DefinitionTargetSysext   `yaml:"sysext,omitempty"`
+	Encrypt *DefinitionTargetEncrypt `yaml:"encrypt,omitempty"`
+	Type    DefinitionFilterType     `yaml:"type,omitempty"` // This field is internal only and used only for simplicity.
+}
+
+// A DefinitionFile represents a file which is to be created inside to chroot.
+type DefinitionFile struct {
+	Generator        string                         `yaml:"generator"`
+	Path             string                         `yaml:"path,omitempty"`
+	Content          string                         `yaml:"content,omitempty"`
+	Name             string                         `yaml:"name,omitempty"`
+	Template         DefinitionFileTemplate         `yaml:"template,omitempty"`
+	Templated        bool                           `yaml:"templated,omitempty"`
+	Mode             string                         `yaml:"mode,omitempty"`
+	GID              string                         `yaml:"gid,omitempty"`
+	UID              string                         `yaml:"uid,omitempty"`
+	Pongo            bool                           `yaml:"pongo,omitempty"`
+	Source           string                         `yaml:"source,omitempty"`
+	Console          *DefinitionFileConsole         `yaml:"console,omitempty"`
+	Users            []DefinitionFileUser           `yaml:"users,omitempty"`
+	Network          *DefinitionFileNetwork         `yaml:"network,omitempty"`
+	Locale           *DefinitionFileLocale          `yaml:"locale,omitempty"`
+	Environment      *DefinitionFileEnvironment     `yaml:"environment,omitempty"`
+	Sysctl           map[string]string              `yaml:"sysctl,omitempty"`
+	SystemdUnit      *DefinitionFileSystemdUnit     `yaml:"systemd_unit,omitempty"`
+	Repositories     []DefinitionPackagesRepository `yaml:"repositories,omitempty"`
+	Proxy            *DefinitionFileProxy           `yaml:"proxy,omitempty"`
+	Branding         *DefinitionFileBranding        `yaml:"branding,omitempty"`
+	KernelModules    *DefinitionFileKernelModules   `yaml:"kernel_modules,omitempty"`
+	Resolv           *DefinitionFileResolv          `yaml:"resolv,omitempty"`
+	Swapfile         *DefinitionFileSwapfile        `yaml:"swapfile,omitempty"`
+	SELinux          *DefinitionFileSELinux         `yaml:"selinux,omitempty"`
+	Tmpfiles         []string                       `yaml:"tmpfiles,omitempty"`
+	DefinitionFilter `yaml:",inline"`
+
+	// index is the position of the file in the definition, or in its profile.
+	index int
+
+	// profile is the name of the profile the file comes from.
+	profile string
+}
+
+// ID returns the identifier of the file used in logs and errors, which is its
+// position in the definition.
+func (d *DefinitionFile) ID() string {
+	if d.profile != "" {
+		return fmt.Sprintf("files[%d] of profile %q", d.index, d.profile)
+	}
+
+	return fmt.Sprintf("files[%d]", d.index)
+}
+
+// A DefinitionRootfsOverlay represents a directory of the build host which is
+// merged onto the rootfs.
+type DefinitionRootfsOverlay struct {
+	Source           string `yaml:"source"`
+	Path             string `yaml:"path,omitempty"`
+	Trigger          string `yaml:"trigger,omitempty"`
+	UID              string `yaml:"uid,omitempty"`
+	GID              string `yaml:"gid,omitempty"`
+	Conflict         string `yaml:"conflict,omitempty"`
+	DefinitionFilter `yaml:",inline"`
+
+	// index is the position of the overlay in the definition.
+	index int
+}
+
+// ID returns the identifier of the overlay used in logs and errors, which is
+// its position in the definition.
+func (d *DefinitionRootfsOverlay) ID() string {
+	return fmt.Sprintf("rootfs_overlays[%d]", d.index)
+}
+
+// A DefinitionFileConsole represents the console keymap and font, and the
+// keyboard layout set by the console generator.
+type DefinitionFileConsole struct {
+	Keymap  string `yaml:"keymap,omitempty"`
+	Font    string `yaml:"font,omitempty"`
+	Layout  string `yaml:"layout,omitempty"`
+	Model   string `yaml:"model,omitempty"`
+	Variant string `yaml:"variant,omitempty"`
+	Options string `yaml:"options,omitempty"`
+}
+
+// validate validates the names used by the console generator. Whether they
+// exist in the rootfs is checked by the generator.
+func (c *DefinitionFileConsole) validate() error {
+	if c == nil || c.Keymap == "" && c.Layout == "" && c.Font == "" {
+		return errors.New("files.*.console requires a keymap, layout or font")
+	}
+
+	name := regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.+-]*$`)
+
+	if c.Keymap != "" && !name.MatchString(c.Keymap) {
+		return fmt.Errorf("Invalid files.*.console.keymap %q", c.Keymap)
+	}
+
+	if c.Font != "" && !name.MatchString(c.Font) {
+		return fmt.Errorf("Invalid files.*.console.font %q", c.Font)
+	}
+
+	if c.Layout != "" && !regexp.MustCompile(`^[a-z0-9_]+(,[a-z0-9_]+)*$`).MatchString(c.Layout) {
+		return fmt.Errorf("Invalid files.*.console.layout %q", c.Layout)
+	}
+
+	if c.Layout == "" && (c.Model != "" || c.Variant != "" || c.Options != "") {
+		return errors.New("files.*.console.model, variant and options require a layout")
+	}
+
+	for _, field := range []struct {
+		key   string
+		value string
+	}{{"model", c.Model}, {"variant", c.Variant}, {"options", c.Options}} {
+		if strings.ContainsAny(field.value, " \"'\\$`\n") {
+			return fmt.Errorf("Invalid files.*.console.%s %q", field.key, field.value)
+		}
+	}
+
+	return nil
+}
+
+// A DefinitionFileUser represents a user account created by the users
+// generator.
+type DefinitionFileUser struct {
+	Name              string   `yaml:"name"`
+	UID               string   `yaml:"uid,omitempty"`
+	GID               string   `yaml:"gid,omitempty"`
+	Home              string   `yaml:"home,omitempty"`
+	Shell             string   `yaml:"shell,omitempty"`
+	Groups            []string `yaml:"groups,omitempty"`
+	Sudo              bool     `yaml:"sudo,omitempty"`
+	Password          string   `yaml:"password,omitempty"`
+	Locked            bool     `yaml:"locked,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+// validateUsers validates the accounts of the users generator. Whether the
+// IDs are free is checked by the generator.
+func (d *DefinitionFile) validateUsers() error {
+	if len(d.Users) == 0 {
+		return fmt.Errorf("%s: generator \"users\" requires users", d.ID())
+	}
+
+	name := regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,31}$`)
+	names := map[string]bool{}
+
+	for i, user := range d.Users {
+		id := fmt.Sprintf("%s.users[%d]", d.ID(), i)
+
+		if !name.MatchString(user.Name) {
+			return fmt.Errorf("Invalid %s.name %q", id, user.Name)
+		}
+
+		if names[user.Name] {
+			return fmt.Errorf("%s.name %q is used more than once", id, user.Name)
+		}
+
+		names[user.Name] = true
+
+		for key, value := range map[string]string{"uid": user.UID, "gid": user.GID} {
+			if value == "" {
+				continue
+			}
+
+			_, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("Invalid %s.%s %q", id, key, value)
+			}
+		}
+
+		for key, value := range map[string]string{"home": user.Home, "shell": user.Shell} {
+			if value != "" && !filepath.IsAbs(value) {
+				return fmt.Errorf("%s.%s must be an absolute path", id, key)
+			}
+
+			if strings.ContainsAny(value, ":\n") {
+				return fmt.Errorf("Invalid %s.%s %q", id, key, value)
+			}
+		}
+
+		for _, group := range user.Groups {
+			if !name.MatchString(group) {
+				return fmt.Errorf("Invalid %s.groups group %q", id, group)
+			}
+		}
+
+		// Only hashes are accepted, so no plain text passwords end up in the
+		// definition.
+		if user.Password != "" && !regexp.MustCompile(`^\$[a-z0-9]+\$[^:\s]+$`).MatchString(user.Password) {
+			return fmt.Errorf("%s.password must be a crypt(3) hash", id)
+		}
+
+		for _, key := range user.SSHAuthorizedKeys {
+			if strings.TrimSpace(key) == "" || strings.Contains(key, "\n") {
+				return fmt.Errorf("Invalid %s.ssh_authorized_keys key %q", id, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// A DefinitionFileNetwork represents the network configuration written by the
+// network generator.
+type DefinitionFileNetwork struct {
+	Backend     string   `yaml:"backend,omitempty"`
+	Interface   string   `yaml:"interface,omitempty"`
+	Method      string   `yaml:"method,omitempty"`
+	DHCP6       bool     `yaml:"dhcp6,omitempty"`
+	Addresses   []string `yaml:"addresses,omitempty"`
+	Gateways    []string `yaml:"gateways,omitempty"`
+	Nameservers []string `yaml:"nameservers,omitempty"`
+	Search      []string `yaml:"search,omitempty"`
+}
+
+// NetworkBackends are the network configurations written by the network
+// generator.
+var NetworkBackends = []string{"ifupdown", "netplan", "networkd"}
+
+// validate validates the configuration of the network generator. Without a
+// configuration, the interface is configured using DHCP.
+func (n *DefinitionFileNetwork) validate() error {
+	if n == nil {
+		return nil
+	}
+
+	if n.Backend != "" && !slices.Contains(NetworkBackends, n.Backend) {
+		return fmt.Errorf("files.*.network.backend must be one of %v", NetworkBackends)
+	}
+
+	if n.Interface != "" && !regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`).MatchString(n.Interface) {
+		return fmt.Errorf("Invalid files.*.network.interface %q", n.Interface)
+	}
+
+	validMethods := []string{"dhcp", "static"}
+
+	if n.Method != "" && !slices.Contains(validMethods, n.Method) {
+		return fmt.Errorf("files.*.network.method must be one of %v", validMethods)
+	}
+
+	if n.Method == "static" {
+		if len(n.Addresses) == 0 {
+			return errors.New("files.*.network.method \"static\" requires addresses")
+		}
+
+		if n.DHCP6 {
+			return errors.New("files.*.network.dhcp6 cannot be used with method \"static\"")
+		}
+	} else if len(n.Addresses) > 0 || len(n.Gateways) > 0 {
+		return errors.New("files.*.network.addresses and gateways require method \"static\"")
+	}
+
+	for _, address := range n.Addresses {
+		_, err := netip.ParsePrefix(address)
+		if err != nil {
+			return fmt.Errorf("Invalid files.*.network.addresses address %q", address)
+		}
+	}
+
+	for _, list := range []struct {
+		key    string
+		values []string
+	}{{"gateways", n.Gateways}, {"nameservers", n.Nameservers}} {
+		for _, value := range list.values {
+			_, err := netip.ParseAddr(value)
+			if err != nil {
+				return fmt.Errorf("Invalid files.*.network.%s address %q", list.key, value)
+			}
+		}
+	}
+
+	for _, domain := range n.Search {
+		if !regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`).MatchString(domain) {
+			return fmt.Errorf("Invalid files.*.network.search domain %q", domain)
+		}
+	}
+
+	return nil
+}
+
+// A DefinitionFileResolv represents how /etc/resolv.conf is managed, as set by
+// the resolv generator.
+type DefinitionFileResolv struct {
+	Mode        string   `yaml:"mode,omitempty"`
+	Nameservers []string `yaml:"nameservers,omitempty"`
+	Search      []string `yaml:"search,omitempty"`
+	Options     []string `yaml:"options,omitempty"`
+}
+
+// ResolvModes are the ways the resolv generator manages /etc/resolv.conf.
+var ResolvModes = []string{"runtime", "static", "stub"}
+
+// validate validates the configuration of the resolv generator. The
+// nameservers and search domains of the stub mode configure systemd-resolved.
+func (r *DefinitionFileResolv) validate() error {
+	if r == nil || !slices.Contains(ResolvModes, r.Mode) {
+		return fmt.Errorf("files.*.resolv.mode must be one of %v", ResolvModes)
+	}
+
+	switch r.Mode {
+	case "static":
+		if len(r.Nameservers) == 0 {
+			return errors.New("files.*.resolv.mode \"static\" requires nameservers")
+		}
+
+		// The C library only uses the first three nameservers.
+		if len(r.Nameservers) > 3 {
+			return errors.New("files.*.resolv.mode \"static\" supports up to 3 nameservers")
+		}
+	case "stub":
+		if len(r.Options) > 0 {
+			return errors.New("files.*.resolv.options require mode \"static\"")
+		}
+	case "runtime":
+		if len(r.Nameservers) > 0 || len(r.Search) > 0 || len(r.Options) > 0 {
+			return errors.New("files.*.resolv.mode \"runtime\" doesn't take nameservers, search or options")
+		}
+	}
+
+	for _, nameserver := range r.Nameservers {
+		_, err := netip.ParseAddr(nameserver)
+		if err != nil {
+			return fmt.Errorf("Invalid files.*.resolv.nameservers address %q", nameserver)
+		}
+	}
+
+	for _, domain := range r.Search {
+		if !regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`).MatchString(domain) {
+			return fmt.Errorf("Invalid files.*.resolv.search domain %q", domain)
+		}
+	}
+
+	for _, option := range r.Options {
+		if !regexp.MustCompile(`^[a-z0-9-]+(:[0-9]+)?$`).MatchString(option) {
+			return fmt.Errorf("Invalid files.*.resolv.options option %q", option)
+		}
+	}
+
+	return nil
+}
+
+// A DefinitionFileSELinux represents how the rootfs is labeled by the
+// selinux-relabel generator.
+type DefinitionFileSELinux struct {
+	Mode string `yaml:"mode,omitempty"`
+}
+
+// SELinuxRelabelModes are the ways the selinux-relabel generator labels the
+// rootfs.
+var SELinuxRelabelModes = []string{"auto", "autorelabel", "setfiles"}
+
+// validate validates the configuration of the selinux-relabel generator,
+// which is optional.
+func (s *DefinitionFileSELinux) validate() error {
+	if s == nil || s.Mode == "" {
+		return nil
+	}
+
+	if !slices.Contains(SELinuxRelabelModes, s.Mode) {
+		return fmt.Errorf("files.*.selinux.mode must be one of %v", SELinuxRelabelModes)
+	}
+
+	return nil
+}
+
+// A DefinitionFileSwapfile represents the swap file created by the swapfile
+// generator.
+type DefinitionFileSwapfile struct {
+	Size uint64 `yaml:"size"`
+}
+
+// validateSwapfile validates the configuration of the swapfile generator. The
+// swap file is copied into the VM image, so it needs a file system on which
+// it doesn't have to be created in place.
+func (d *DefinitionFile) validateSwapfile(vm DefinitionTargetLXDVM) error {
+	if d.Swapfile == nil || d.Swapfile.Size == 0 || d.Swapfile.Size%1048576 != 0 {
+		return errors.New("files.*.swapfile.size must be a non-zero multiple of 1MiB")
+	}
+
+	if d.Path != "" && !strings.HasPrefix(d.Path, "/") {
+		return errors.New("files.*.path must be an absolute path")
+	}
+
+	// Containers use the swap of the host.
+	if !slices.Equal(d.Types, []DefinitionFilterType{DefinitionFilterTypeVM}) {
+		return errors.New("files.*.swapfile requires files.*.types to be [vm], as containers can't have swap of their own")
+	}
+
+	switch vm.Filesystem {
+	case "btrfs":
+		return errors.New("files.*.swapfile is not supported on btrfs, use targets.lxd.vm.swap with type \"file\" instead")
+	case "f2fs", "zfs":
+		return fmt.Errorf("files.*.swapfile is not supported on %s", vm.Filesystem)
+	}
+
+	path := d.Path
+	if path == "" {
+		path = "/swapfile"
+	}
+
+	if vm.Swap != nil && vm.Swap.Type == "file" && vm.Swap.Path == path {
+		return fmt.Errorf("files.*.path %q is already the swap file of targets.lxd.vm.swap", path)
+	}
+
+	return nil
+}
+
+// A DefinitionFileLocale represents the locale and timezone set by the locale
+// generator.
+type DefinitionFileLocale struct {
+	Lang     string   `yaml:"lang,omitempty"`
+	Generate []string `yaml:"generate,omitempty"`
+	Timezone string   `yaml:"timezone,omitempty"`
+}
+
+// validate validates the locales and timezone of the locale generator.
+// Whether they exist in the rootfs is checked by the generator.
+func (l *DefinitionFileLocale) validate() error {
+	if l == nil || l.Lang == "" && len(l.Generate) == 0 && l.Timezone == "" {
+		return errors.New("files.*.locale requires a lang, locales to generate or a timezone")
+	}
+
+	locale := regexp.MustCompile(`^([a-zA-Z]{2,8}(_[a-zA-Z0-9]+)?(\.[a-zA-Z0-9-]+)?(@[a-zA-Z0-9]+)?|C(\.[a-zA-Z0-9-]+)?|POSIX)$`)
+
+	if l.Lang != "" && !locale.MatchString(l.Lang) {
+		return fmt.Errorf("Invalid files.*.locale.lang %q", l.Lang)
+	}
+
+	for _, name := range l.Generate {
+		if !locale.MatchString(name) {
+			return fmt.Errorf("Invalid files.*.locale.generate locale %q", name)
+		}
+	}
+
+	if l.Timezone != "" && !regexp.MustCompile(`^[a-zA-Z0-9_+-]+(/[a-zA-Z0-9_+-]+)*$`).MatchString(l.Timezone) {
+		return fmt.Errorf("Invalid files.*.locale.timezone %q", l.Timezone)
+	}
+
+	return nil
+}
+
+// A DefinitionFileEnvironment represents the system-wide environment
+// variables set by the environment generator.
+type DefinitionFileEnvironment struct {
+	Variables map[string]string `yaml:"variables,omitempty"`
+	Path      []string          `yaml:"path,omitempty"`
+}
+
+// validate validates the variables and PATH additions of the environment
+// generator. Values can't contain characters which pam_env doesn't allow in
+// /etc/environment.
+func (e *DefinitionFileEnvironment) validate() error {
+	if e == nil || len(e.Variables) == 0 && len(e.Path) == 0 {
+		return errors.New("files.*.environment requires variables or a path")
+	}
+
+	name := regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	for key, value := range e.Variables {
+		if !name.MatchString(key) {
+			return fmt.Errorf("Invalid files.*.environment.variables name %q", key)
+		}
+
+		if key == "PATH" {
+			return errors.New("files.*.environment.variables cannot set PATH, use files.*.environment.path instead")
+		}
+
+		if strings.ContainsAny(value, "\"\\\n") {
+			return fmt.Errorf("Invalid files.*.environment.variables value of %q", key)
+		}
+	}
+
+	for _, dir := range e.Path {
+		if !strings.HasPrefix(dir, "/") {
+			return fmt.Errorf("files.*.environment.path %q must be an absolute path", dir)
+		}
+
+		if strings.ContainsAny(dir, ":\"'\\\n") {
+			return fmt.Errorf("Invalid files.*.environment.path %q", dir)
+		}
+	}
+
+	return nil
+}
+
+// validateSysctl validates the kernel parameters of the sysctl generator.
+func (d *DefinitionFile) validateSysctl() error {
+	if len(d.Sysctl) == 0 {
+		return errors.New("files.*.sysctl requires kernel parameters")
+	}
+
+	key := regexp.MustCompile(`^[a-zA-Z0-9_-]+([./][a-zA-Z0-9_*:@-]+)+$`)
+
+	for name, value := range d.Sysctl {
+		if !key.MatchString(name) {
+			return fmt.Errorf("Invalid files.*.sysctl key %q", name)
+		}
+
+		if strings.TrimSpace(value) == "" || strings.Contains(value, "\n") {
+			return fmt.Errorf("Invalid files.*.sysctl value of %q", name)
+		}
+	}
+
+	return nil
+}
+
+// A DefinitionFileSystemdUnit represents the drop-in and state of a unit set
+// by the systemd-unit generator.
+type DefinitionFileSystemdUnit struct {
+	DropIn string `yaml:"drop_in,omitempty"`
+	State  string `yaml:"state,omitempty"`
+}
+
+// SystemdUnitStates are the states the systemd-unit generator puts units in.
+var SystemdUnitStates = []string{"disabled", "enabled", "masked"}
+
+// validateSystemdUnit validates the unit of the systemd-unit generator, which
+// is set in name and gets the content of the file.
+func (d *DefinitionFile) validateSystemdUnit() error {
+	unitTypes := "service|socket|timer|target|path|mount|automount|swap|slice"
+
+	if !regexp.MustCompile(`^[a-zA-Z0-9:_.\\-]+(@[a-zA-Z0-9:_.\\-]*)?\.(` + unitTypes + `)$`).MatchString(d.Name) {
+		return fmt.Errorf("Invalid files.*.name %q, must be the name of a systemd unit", d.Name)
+	}
+
+	unit := DefinitionFileSystemdUnit{}
+	if d.SystemdUnit != nil {
+		unit = *d.SystemdUnit
+	}
+
+	if unit.DropIn != "" {
+		if !regexp.MustCompile(`^[a-zA-Z0-9_.-]+\.conf$`).MatchString(unit.DropIn) {
+			return fmt.Errorf("Invalid files.*.systemd_unit.drop_in %q", unit.DropIn)
+		}
+
+		if d.Content == "" {
+			return errors.New("files.*.systemd_unit.drop_in requires content")
+		}
+	}
+
+	if unit.State != "" && !slices.Contains(SystemdUnitStates, unit.State) {
+		return fmt.Errorf("files.*.systemd_unit.state must be one of %v", SystemdUnitStates)
+	}
+
+	if unit.State == "masked" && d.Content != "" {
+		return errors.New("files.*.systemd_unit.state \"masked\" cannot be used with content")
+	}
+
+	if d.Content == "" && unit.State == "" {
+		return errors.New("files.*.name requires content or files.*.systemd_unit.state")
+	}
+
+	return nil
+}
+
+// validateCACertificates validates the certificates of the ca-certificates
+// generator, which are read from content or the source file on the build host.
+// The name is used as the file name of the certificates.
+func (d *DefinitionFile) validateCACertificates() error {
+	if !regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`).MatchString(d.Name) {
+		return fmt.Errorf("Invalid files.*.name %q, must be a file name", d.Name)
+	}
+
+	if d.Content == "" && d.Source == "" {
+		return errors.New("files.*.name requires content or files.*.source")
+	}
+
+	if d.Content != "" && d.Source != "" {
+		return errors.New("files.*.content cannot be used with files.*.source")
+	}
+
+	if d.Content != "" {
+		_, err := ParsePEMCertificates([]byte(d.Content))
+		if err != nil {
+			return fmt.Errorf("Invalid files.*.content of %q: %w", d.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// A DefinitionFileProxy represents the proxies set by the proxy generator.
+type DefinitionFileProxy struct {
+	HTTP    string   `yaml:"http,omitempty"`
+	HTTPS   string   `yaml:"https,omitempty"`
+	NoProxy []string `yaml:"no_proxy,omitempty"`
+}
+
+// validate validates the proxies of the proxy generator, which are set in
+// /etc/environment and the configuration files of the package managers.
+func (p *DefinitionFileProxy) validate() error {
+	if p == nil || p.HTTP == "" && p.HTTPS == "" {
+		return errors.New("files.*.proxy requires http or https")
+	}
+
+	for key, value := range map[string]string{"http": p.HTTP, "https": p.HTTPS} {
+		if value == "" {
+			continue
+		}
+
+		u, err := url.Parse(value)
+		if err != nil || !slices.Contains([]string{"http", "https"}, u.Scheme) || u.Host == "" || strings.ContainsAny(value, "\"'\\\n ") {
+			return fmt.Errorf("Invalid files.*.proxy.%s %q", key, value)
+		}
+	}
+
+	for _, host := range p.NoProxy {
+		if host == "" || strings.ContainsAny(host, ",\"'\\\n ") {
+			return fmt.Errorf("Invalid files.*.proxy.no_proxy %q", host)
+		}
+	}
+
+	return nil
+}
+
+// A DefinitionFileBranding represents the MOTD, /etc/issue and os-release
+// fields set by the branding generator.
+type DefinitionFileBranding struct {
+	MOTD        string            `yaml:"motd,omitempty"`
+	MOTDScripts map[string]string `yaml:"motd_scripts,omitempty"`
+	Issue       string            `yaml:"issue,omitempty"`
+	OSRelease   map[string]string `yaml:"os_release,omitempty"`
+}
+
+// validate validates the branding of the branding generator. The os-release
+// fields are shell variable assignments, so their values can't contain
+// characters which need escaping.
+func (b *DefinitionFileBranding) validate() error {
+	if b == nil || b.MOTD == "" && len(b.MOTDScripts) == 0 && b.Issue == "" && len(b.OSRelease) == 0 {
+		return errors.New("files.*.branding requires motd, motd_scripts, issue or os_release")
+	}
+
+	// run-parts skips scripts with dots in their name.
+	scriptName := regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+	for name, script := range b.MOTDScripts {
+		if !scriptName.MatchString(name) {
+			return fmt.Errorf("Invalid files.*.branding.motd_scripts name %q", name)
+		}
+
+		if !strings.HasPrefix(script, "#!") {
+			return fmt.Errorf("files.*.branding.motd_scripts %q must start with a shebang", name)
+		}
+	}
+
+	key := regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+	for name, value := range b.OSRelease {
+		if !key.MatchString(name) {
+			return fmt.Errorf("Invalid files.*.branding.os_release name %q", name)
+		}
+
+		if strings.ContainsAny(value, "\"\\$`\n") {
+			return fmt.Errorf("Invalid files.*.branding.os_release value of %q", name)
+		}
+	}
+
+	return nil
+}
+
+// A DefinitionFileKernelModules represents the kernel modules loaded on boot,
+// blacklisted, configured and added to the initramfs by the kernel-modules
+// generator.
+type DefinitionFileKernelModules struct {
+	Load      []string          `yaml:"load,omitempty"`
+	Blacklist []string          `yaml:"blacklist,omitempty"`
+	Options   map[string]string `yaml:"options,omitempty"`
+	Initramfs []string          `yaml:"initramfs,omitempty"`
+}
+
+// validate validates the kernel modules of the kernel-modules generator.
+func (m *DefinitionFileKernelModules) validate() error {
+	if m == nil || len(m.Load) == 0 && len(m.Blacklist) == 0 && len(m.Options) == 0 && len(m.Initramfs) == 0 {
+		return errors.New("files.*.kernel_modules requires load, blacklist, options or initramfs")
+	}
+
+	module := regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+	for _, field := range []struct {
+		name    string
+		modules []string
+	}{{"load", m.Load}, {"blacklist", m.Blacklist}, {"initramfs", m.Initramfs}} {
+		for _, name := range field.modules {
+			if !module.MatchString(name) {
+				return fmt.Errorf("Invalid files.*.kernel_modules.%s module %q", field.name, name)
+			}
+		}
+	}
+
+	for name, value := range m.Options {
+		if !module.MatchString(name) {
+			return fmt.Errorf("Invalid files.*.kernel_modules.options module %q", name)
+		}
+
+		if strings.TrimSpace(value) == "" || strings.Contains(value, "\n") {
+			return fmt.Errorf("Invalid files.*.kernel_modules.options value of %q", name)
+		}
+	}
+
+	return nil
+}
+
+// RepositoriesManagers are the package managers the repositories generator
+// writes repositories for.
+var RepositoriesManagers = []string{"apk", "apt", "dnf", "yum", "zypper"}
+
+// validateRepositories validates the repositories of the repositories
+// generator, which are written in the format of the package manager.
+func (d *DefinitionFile) validateRepositories(manager string) error {
+	if !slices.Contains(RepositoriesManagers, manager) {
+		return fmt.Errorf("files.*.repositories requires packages.manager to be one of %v", RepositoriesManagers)
+	}
+
+	if len(d.Repositories) == 0 {
+		return errors.New("files.*.repositories requires at least one repository")
+	}
+
+	names := map[string]bool{}
+
+	for _, repo := range d.Repositories {
+		if !regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`).MatchString(repo.Name) {
+			return fmt.Errorf("Invalid files.*.repositories.*.name %q, must be a file name", repo.Name)
+		}
+
+		if names[repo.Name] {
+			return fmt.Errorf("Duplicate files.*.repositories.*.name %q", repo.Name)
+		}
+
+		names[repo.Name] = true
+
+		if strings.TrimSpace(repo.URL) == "" {
+			return fmt.Errorf("files.*.repositories.*.url of %q is required", repo.Name)
+		}
+
+		if len(repo.Types) > 0 {
+			return errors.New("files.*.repositories.*.types cannot be used, use files.*.types instead")
+		}
+
+		if repo.Key != "" && !strings.HasPrefix(strings.TrimSpace(repo.Key), "-----BEGIN ") {
+			return fmt.Errorf("files.*.repositories.*.key of %q must be an armored public key", repo.Name)
+		}
+	}
+
+	return nil
+}
+
+// A DefinitionFileTemplate represents the settings used by generators.
+type DefinitionFileTemplate struct {
+	Properties map[string]string `yaml:"properties,omitempty"`
+	When       []string          `yaml:"when,omitempty"`
+}
+
+// A DefinitionAction specifies a custom action (script) which is to be run after
+// a certain action.
+type DefinitionAction struct {
+	Name             string `yaml:"name,omitempty"`
+	Trigger          string `yaml:"trigger"`
+	Action           string `yaml:"action"`
+	Pongo            bool   `yaml:"pongo,omitempty"`
+	Retries          uint   `yaml:"retries,omitempty"`
+	RetryDelay       string `yaml:"retry_delay,omitempty"`
+	DefinitionFilter `yaml:",inline"`
+
+	// index is the position of the action in the definition, or in its profile.
+	index int
+
+	// profile is the name of the profile the action comes from.
+	profile string
+
+	// noNetwork is set in restricted mode to run the action without network access.
+	noNetwork bool
+}
+
+// GetRetryDelay returns the delay between two attempts of the action.
+func (d *DefinitionAction) GetRetryDelay() (time.Duration, error) {
+	if d.RetryDelay == "" {
+		return time.Second, nil
+	}
+
+	delay, err := time.ParseDuration(d.RetryDelay)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid retry_delay %q of action %q: %w", d.RetryDelay, d.ID(), err)
+	}
+
+	if delay < 0 {
+		return 0, fmt.Errorf("Invalid retry_delay %q of action %q: must not be negative", d.RetryDelay, d.ID())
+	}
+
+	return delay, nil
+}
+
+// ID returns the identifier of the action used in logs and errors, which is
+// its name if set, or its position in the definition.
+func (d *DefinitionAction) ID() string {
+	if d.Name != "" {
+		return d.Name
+	}
+
+	if d.profile != "" {
+		return fmt.Sprintf("actions[%d] of profile %q", d.index, d.profile)
+	}
+
+	return fmt.Sprintf("actions[%d]", d.index)
+}
+
+// DefinitionMappings defines custom mappings.
+type DefinitionMappings struct {
+	Architectures   map[string]string `yaml:"architectures,omitempty"`
+	ArchitectureMap string            `yaml:"architecture_map,omitempty"`
+}
+
+// DefinitionEnvVars defines custom environment variables.
+type DefinitionEnvVars struct {
+	Key              string `yaml:"key"`
+	Value            string `yaml:"value"`
+	DefinitionFilter `yaml:",inline"`
+}
+
+// DefinitionEnv represents the config part of the environment section.
+type DefinitionEnv struct {
+	ClearDefaults    bool                `yaml:"clear_defaults,omitempty"`
+	EnvVariables     []DefinitionEnvVars `yaml:"variables,omitempty"`
+	ResolvConfPolicy string              `yaml:"resolv_conf_policy,omitempty"`
+}
+
+// DefinitionSimplestreamRequirements contains a map of image requirements
+// and filters to selectively apply the requirements.
+type DefinitionSimplestreamRequirements struct {
+	// Map of the image requirements.
+	Requirements map[string]string `yaml:"requirements,omitempty"`
+
+	DefinitionFilter `yaml:",inline"`
+}
+
+// DefinitionSimplestream contains additional information about the image.
+// It is parsed by the simplestream-maintainer when building a product
+// catalog.
+type DefinitionSimplestream struct {
+	// Pretty distro name.
+	DistroName string `yaml:"distro_name,omitempty"`
+
+	// Map of release aliases. Key represents the release name and value
+	// is a comma delimited string of additional release aliases.
+	ReleaseAliases map[string]string `yaml:"release_aliases,omitempty"`
+
+	// List of the image requirements.
+	Requirements []DefinitionSimplestreamRequirements `yaml:"requirements,omitempty"`
+}
+
+// DefinitionFlavor represents a named bundle of a variant, package sets and
+// generators, which is applied to the definition using --flavor.
+type DefinitionFlavor struct {
+	Name     string                  `yaml:"name"`
+	Variant  string                  `yaml:"variant,omitempty"`
+	Packages []DefinitionPackagesSet `yaml:"packages,omitempty"`
+	Files    []DefinitionFile        `yaml:"files,omitempty"`
+}
+
+// DefinitionPlugin represents a source, manager or generator provided by a
+// separate binary.
+type DefinitionPlugin struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	Path string `yaml:"path,omitempty"`
+}
+
+// A Definition a definition.
+type Definition struct {
+	Image        DefinitionImage        `yaml:"image"`
+	Source       DefinitionSource       `yaml:"source"`
+	Targets      DefinitionTarget       `yaml:"targets,omitempty"`
+	Files        []DefinitionFile       `yaml:"files,omitempty"`
+	Packages     DefinitionPackages     `yaml:"packages,omitempty"`
+	Actions      []DefinitionAction     `yaml:"actions,omitempty"`
+	Mappings     DefinitionMappings     `yaml:"mappings,omitempty"`
+	Environment  DefinitionEnv          `yaml:"environment,omitempty"`
+	Simplestream DefinitionSimplestream `yaml:"simplestream,omitempty"`
+	Flavors      []DefinitionFlavor     `yaml:"flavors,omitempty"`
+	Profiles     []string               `yaml:"profiles,omitempty"`
+	Plugins      []DefinitionPlugin     `yaml:"plugins,omitempty"`
+	Requires     DefinitionRequires     `yaml:"requires,omitempty"`
+
+	RootfsOverlays []DefinitionRootfsOverlay `yaml:"rootfs_overlays,omitempty"`
+}
+
+// GetPlugin returns the plugin of the given type and name, or nil if there's none.
+func (d *Definition) GetPlugin(pluginType string, name string) *DefinitionPlugin {
+	for i, plugin := range d.Plugins {
+		if plugin.Type == pluginType && plugin.Name == name {
+			return &d.Plugins[i]
+		}
+	}
+
+	return nil
+}
+
+// ApplyFlavor sets the variant of the given flavor, and adds its package sets
+// and files to the definition.
+func (d *Definition) ApplyFlavor(name string) error {
+	for _, flavor := range d.Flavors {
+		if flavor.Name != name {
+			continue
+		}
+
+		if flavor.Variant != "" {
+			d.Image.Variant = flavor.Variant
+		}
+
+		d.Packages.Sets = append(d.Packages.Sets, flavor.Packages...)
+		d.Files = append(d.Files, flavor.Files...)
+
+		return nil
+	}
+
+	names := make([]string, 0, len(d.Flavors))
+
+	for _, flavor := range d.Flavors {
+		names = append(names, flavor.Name)
+	}
+
+	return fmt.Errorf("Unknown flavor %q, must be one of %v", name, names)
+}
+
+// SetValue writes the provided value to a field represented by the yaml tag 'key'.
+func (d *Definition) SetValue(key string, value string) error {
+	// Walk through the definition and find the field with the given key
+	field, err := getFieldByTag(reflect.ValueOf(d).Elem(), reflect.TypeOf(d).Elem(), key)
+	if err != nil {
+		return fmt.Errorf("Failed to get field by tag: %w", err)
+	}
+
+	// Fail if the field cannot be set
+	if !field.CanSet() {
+		return fmt.Errorf("Cannot set value for %s", key)
+	}
+
+	// Fields like the VM size parse their own values.
+	unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler)
+	if ok {
+		return unmarshaler.UnmarshalText([]byte(value))
+	}
+
+	switch field.Kind() {
+	case reflect.Bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Failed to parse bool %q: %w", value, err)
+		}
+
+		field.SetBool(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Failed to parse int %q: %w", value, err)
+		}
+
+		field.SetInt(v)
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Uint, reflect.Uintptr, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Failed to parse uint %q: %w", value, err)
+		}
+
+		field.SetUint(v)
+	default:
+		return fmt.Errorf("Unsupported type '%s'", field.Kind())
+	}
+
+	return nil
+}
+
+// SetDefaults sets some default values.
+func (d *Definition) SetDefaults() {
+	// default to local arch
+	if d.Image.Architecture == "" {
+		localArch, _ := osarch.ArchitectureGetLocal()
+		d.Image.Architecture = localArch
+	}
+
+	// Package sets are handled in the main stage per default
+	for i := range d.Packages.Sets {
+		if d.Packages.Sets[i].Stage == "" {
+			d.Packages.Sets[i].Stage = "main"
+		}
+	}
+
+	// Record the position of files, actions and overlays, which identifies
+	// them in logs. Entries of profiles keep their position in the profile.
+	index := 0
+
+	for i := range d.Files {
+		if d.Files[i].profile == "" {
+			d.Files[i].index = index
+			index++
+		}
+	}
+
+	index = 0
+
+	for i := range d.Actions {
+		if d.Actions[i].profile == "" {
+			d.Actions[i].index = index
+			index++
+		}
+	}
+
+	for i := range d.RootfsOverlays {
+		d.RootfsOverlays[i].index = i
+
+		if d.RootfsOverlays[i].Path == "" {
+			d.RootfsOverlays[i].Path = "/"
+		}
+
+		if d.RootfsOverlays[i].Trigger == "" {
+			d.RootfsOverlays[i].Trigger = "post-unpack"
+		}
+
+		if d.RootfsOverlays[i].Conflict == "" {
+			d.RootfsOverlays[i].Conflict = "overwrite"
+		}
+	}
+
+	// Warn about end-of-life releases per default
+	if d.Image.EOLPolicy == "" {
+		d.Image.EOLPolicy = "warn"
+	}
+
+	// Restore the systemd-resolved stub per default
+	if d.Environment.ResolvConfPolicy == "" {
+		d.Environment.ResolvConfPolicy = "auto"
+	}
+
+	// set default expiry of 30 days
+	if d.Image.Expiry == "" {
+		d.Image.Expiry = "30d"
+	}
+
+	// Set default serial number
+	if d.Image.Serial == "" {
+		d.Image.Serial = BuildDate().Format("20060102_1504")
+	}
+
+	// Set default variant
+	if d.Image.Variant == "" {
+		d.Image.Variant = "default"
+	}
+
+	// Set default keyserver
+	if d.Source.Keyserver == "" {
+		d.Source.Keyserver = "hkps.pool.sks-keyservers.net"
+	}
+
+	// Set default name and description templates
+	if d.Image.Name == "" {
+		d.Image.Name = "{{ image.distribution }}-{{ image.release }}-{{ image.architecture_mapped }}-{{ image.variant }}-{{ image.serial }}"
+	}
+
+	if d.Image.Description == "" {
+		d.Image.Description = "{{ image.distribution|capfirst }} {{ image.release }} {{ image.architecture_mapped }}{% if image.variant != \"default\" %} ({{ image.variant }}){% endif %} ({{ image.serial }})"
+	}
+
+	// Set default EFI system partition
+	if d.Targets.LXD.VM.ESP.Size == 0 {
+		d.Targets.LXD.VM.ESP.Size = 104857600
+	}
+
+	if d.Targets.LXD.VM.ESP.Label == "" {
+		d.Targets.LXD.VM.ESP.Label = "UEFI"
+	}
+
+	if d.Targets.LXD.VM.ESP.FAT == 0 {
+		d.Targets.LXD.VM.ESP.FAT = 32
+	}
+
+	// Set default swap space
+	if d.Targets.LXD.VM.Swap != nil {
+		if d.Targets.LXD.VM.Swap.Type == "" {
+			d.Targets.LXD.VM.Swap.Type = "partition"
+		}
+
+		if d.Targets.LXD.VM.Swap.Type == "file" && d.Targets.LXD.VM.Swap.Path == "" {
+			d.Targets.LXD.VM.Swap.Path = "/swapfile"
+		}
+	}
+
+	// Set default additional disks
+	for i := range d.Targets.LXD.VM.Disks {
+		disk := &d.Targets.LXD.VM.Disks[i]
+
+		if disk.Type == "" {
+			disk.Type = "data"
+		}
+
+		if disk.Type == "seed" {
+			if disk.Size == 0 {
+				disk.Size = 4194304
+			}
+
+			continue
+		}
+
+		if disk.Filesystem == "" {
+			disk.Filesystem = "ext4"
+		}
+
+		if disk.Label == "" && disk.Filesystem != "none" {
+			disk.Label = disk.Name
+		}
+	}
+
+	// Set default LVM layout
+	if d.Targets.LXD.VM.LVM != nil {
+		if d.Targets.LXD.VM.LVM.VolumeGroup == "" {
+			d.Targets.LXD.VM.LVM.VolumeGroup = "rootvg"
+		}
+
+		if d.Targets.LXD.VM.LVM.DataMountpoint == "" {
+			d.Targets.LXD.VM.LVM.DataMountpoint = "/srv"
+		}
+	}
+
+	// Set default btrfs layout
+	if d.Targets.LXD.VM.Filesystem == "btrfs" {
+		if d.Targets.LXD.VM.Btrfs == nil {
+			d.Targets.LXD.VM.Btrfs = &DefinitionTargetLXDVMBtrfs{}
+		}
+
+		if len(d.Targets.LXD.VM.Btrfs.Subvolumes) == 0 {
+			d.Targets.LXD.VM.Btrfs.Subvolumes = d.Targets.LXD.VM.GetBtrfsSubvolumes()
+		}
+	}
+
+	// Set default ZFS layout
+	if d.Targets.LXD.VM.Filesystem == "zfs" {
+		if d.Targets.LXD.VM.ZFS == nil {
+			d.Targets.LXD.VM.ZFS = &DefinitionTargetLXDVMZFS{}
+		}
+
+		if d.Targets.LXD.VM.ZFS.Pool == "" {
+			d.Targets.LXD.VM.ZFS.Pool = "rpool"
+		}
+
+		if len(d.Targets.LXD.VM.ZFS.Datasets) == 0 {
+			d.Targets.LXD.VM.ZFS.Datasets = []DefinitionTargetLXDVMZFSDataset{
+				{Name: "ROOT", Properties: map[string]string{"canmount": "off", "mountpoint": "none"}},
+				{Name: "ROOT/default", Mountpoint: "/"},
+				{Name: "home", Mountpoint: "/home"},
+			}
+		}
+	}
+
+	// Set default target type. This will only be overridden if building VMs for LXD.
+	d.Targets.Type = DefinitionFilterTypeContainer
+}
+
+// Validate validates the Definition.
+func (d *Definition) Validate() error {
+	// Report the required version first, as the definition may use features
+	// of a newer version.
+	err := d.Requires.check(version.Version)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(d.Image.Distribution) == "" {
+		return errors.New("image.distribution may not be empty")
+	}
+
+	if d.Image.Init != "" && !slices.Contains(InitSystems, d.Image.Init) {
+		return fmt.Errorf("image.init must be one of %v", InitSystems)
+	}
+
+	validDownloaders := []string{
+		"almalinux-http",
+		"alpinelinux-http",
+		"alt-http",
+		"apertis-http",
+		"archlinux-http",
+		"busybox",
+		"centos-http",
+		"springdalelinux-http",
+		"debootstrap",
+		"rpmbootstrap",
+		"fedora-http",
+		"gentoo-http",
+		"ubuntu-http",
+		"sabayon-http",
+		"docker-http",
+		"oraclelinux-http",
+		"openeuler-http",
+		"opensuse-http",
+		"openwrt-http",
+		"plamolinux-http",
+		"voidlinux-http",
+		"funtoo-http",
+		"rootfs-http",
+		"rockylinux-http",
+		"vyos-http",
+		"slackware-http",
+		"nixos-http",
+	}
+
+	validManagers := []string{
+		"apk",
+		"apt",
+		"dnf",
+		"egoportage",
+		"opkg",
+		"pacman",
+		"portage",
+		"yum",
+		"equo",
+		"xbps",
+		"zypper",
+		"anise",
+		"slackpkg",
+	}
+
+	validGenerators := []string{
+		"dump",
 		"copy",
 		"template",
 		"hostname",
 		"hosts",
 		"remove",
-		"cloud-init",
-		"lxd-agent",
-		"fstab",
+		"cloud-init",
+		"lxd-agent",
+		"fstab",
+		"console",
+		"users",
+		"network",
+		"locale",
+		"environment",
+		"machine-id",
+		"sysctl",
+		"systemd-unit",
+		"ca-certificates",
+		"repositories",
+		"proxy",
+		"branding",
+		"ssh-host-keys",
+		"kernel-modules",
+		"resolv",
+		"swapfile",
+		"selinux-relabel",
+		"tmpfiles",
+	}
+
+	err = d.validatePlugins(map[string][]string{
+		"generator": validGenerators,
+		"manager":   validManagers,
+		"source":    validDownloaders,
+	})
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(validDownloaders, strings.TrimSpace(d.Source.Downloader)) && d.GetPlugin("source", d.Source.Downloader) == nil {
+		return fmt.Errorf("source.downloader must be one of %v", validDownloaders)
+	}
+
+	if d.Packages.Manager != "" {
+		if !slices.Contains(validManagers, strings.TrimSpace(d.Packages.Manager)) && d.GetPlugin("manager", d.Packages.Manager) == nil {
+			return fmt.Errorf("packages.manager must be one of %v", validManagers)
+		}
+
+		if d.Packages.CustomManager != nil {
+			return errors.New("cannot have both packages.manager and packages.custom_manager set")
+		}
+	} else {
+		if d.Packages.CustomManager == nil {
+			return errors.New("packages.manager or packages.custom_manager needs to be set")
+		}
+
+		if d.Packages.CustomManager.Clean.Command == "" {
+			return errors.New("packages.custom_manager requires a clean command")
+		}
+
+		if d.Packages.CustomManager.Install.Command == "" {
+			return errors.New("packages.custom_manager requires an install command")
+		}
+
+		if d.Packages.CustomManager.Remove.Command == "" {
+			return errors.New("packages.custom_manager requires a remove command")
+		}
+
+		if d.Packages.CustomManager.Refresh.Command == "" {
+			return errors.New("packages.custom_manager requires a refresh command")
+		}
+
+		if d.Packages.CustomManager.Update.Command == "" {
+			return errors.New("packages.custom_manager requires an update command")
+		}
+	}
+
+	for _, file := range d.Files {
+		if !slices.Contains(validGenerators, strings.TrimSpace(file.Generator)) && d.GetPlugin("generator", file.Generator) == nil {
+			return fmt.Errorf("files.*.generator must be one of %v", validGenerators)
+		}
+
+		if file.Generator == "console" {
+			err := file.Console.validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "users" {
+			err := file.validateUsers()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "network" {
+			err := file.Network.validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "locale" {
+			err := file.Locale.validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "environment" {
+			err := file.Environment.validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "sysctl" {
+			err := file.validateSysctl()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "systemd-unit" {
+			err := file.validateSystemdUnit()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "ca-certificates" {
+			err := file.validateCACertificates()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "proxy" {
+			err := file.Proxy.validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "branding" {
+			err := file.Branding.validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "repositories" {
+			err := file.validateRepositories(d.Packages.Manager)
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "resolv" {
+			err := file.Resolv.validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "swapfile" {
+			err := file.validateSwapfile(d.Targets.LXD.VM)
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "selinux-relabel" {
+			err := file.SELinux.validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "tmpfiles" {
+			err := file.validateTmpfiles()
+			if err != nil {
+				return err
+			}
+		}
+
+		if file.Generator == "kernel-modules" {
+			if file.Name != "" && !regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`).MatchString(file.Name) {
+				return fmt.Errorf("Invalid files.*.name %q, must be a file name", file.Name)
+			}
+
+			err := file.KernelModules.validate()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	validMappings := []string{
+		"almalinux",
+		"alpinelinux",
+		"altlinux",
+		"archlinux",
+		"centos",
+		"debian",
+		"gentoo",
+		"plamolinux",
+		"voidlinux",
+		"funtoo",
+		"slackware",
+	}
+
+	architectureMap := strings.TrimSpace(d.Mappings.ArchitectureMap)
+	if architectureMap != "" {
+		if !slices.Contains(validMappings, architectureMap) {
+			return fmt.Errorf("mappings.architecture_map must be one of %v", validMappings)
+		}
+	}
+
+	for _, action := range d.Actions {
+		if !slices.Contains(ActionTriggers, action.Trigger) {
+			return fmt.Errorf("actions.*.trigger must be one of %v", ActionTriggers)
+		}
+	}
+
+	validOverlayTriggers := []string{"post-files", "post-unpack"}
+	validOverlayConflicts := []string{"error", "keep", "overwrite"}
+
+	for _, overlay := range d.RootfsOverlays {
+		if !filepath.IsAbs(overlay.Source) {
+			return fmt.Errorf("%s.source must be an absolute path", overlay.ID())
+		}
+
+		if !strings.HasPrefix(overlay.Path, "/") {
+			return fmt.Errorf("%s.path must be an absolute path", overlay.ID())
+		}
+
+		if !slices.Contains(validOverlayTriggers, overlay.Trigger) {
+			return fmt.Errorf("%s.trigger must be one of %v", overlay.ID(), validOverlayTriggers)
+		}
+
+		// The rootfs of the post-unpack trigger is shared by all image types.
+		if overlay.Trigger == "post-unpack" && len(overlay.Types) > 0 {
+			return fmt.Errorf("%s.types requires trigger \"post-files\"", overlay.ID())
+		}
+
+		if !slices.Contains(validOverlayConflicts, overlay.Conflict) {
+			return fmt.Errorf("%s.conflict must be one of %v", overlay.ID(), validOverlayConflicts)
+		}
+
+		for key, value := range map[string]string{"uid": overlay.UID, "gid": overlay.GID} {
+			if value == "" {
+				continue
+			}
+
+			_, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("Invalid %s.%s %q", overlay.ID(), key, value)
+			}
+		}
+	}
+
+	validPackageActions := []string{
+		"install",
+		"remove",
+	}
+
+	validPackageStages := []string{
+		"early",
+		"main",
+		"late",
+	}
+
+	for _, set := range d.Packages.Sets {
+		if !slices.Contains(validPackageActions, set.Action) {
+			return fmt.Errorf("packages.*.set.*.action must be one of %v", validPackageActions)
+		}
+
+		if !slices.Contains(validPackageStages, set.Stage) {
+			return fmt.Errorf("packages.*.set.*.stage must be one of %v", validPackageStages)
+		}
+	}
+
+	encryption := d.Targets.LXD.VM.Encryption
+	if encryption != nil {
+		if encryption.Passphrase == "" && encryption.Keyfile == "" {
+			return errors.New("targets.lxd.vm.encryption requires either a passphrase or a keyfile")
+		}
+
+		if encryption.Passphrase != "" && encryption.Keyfile != "" {
+			return errors.New("cannot have both targets.lxd.vm.encryption.passphrase and targets.lxd.vm.encryption.keyfile set")
+		}
+	}
+
+	bootTest := d.Targets.LXD.VM.BootTest
+	if bootTest != nil {
+		_, err := bootTest.GetTimeout()
+		if err != nil {
+			return err
+		}
+
+		if bootTest.Memory != 0 && bootTest.Memory%1048576 != 0 {
+			return errors.New("targets.lxd.vm.boot_test.memory must be a multiple of 1MiB")
+		}
+
+		for _, pattern := range bootTest.Patterns {
+			_, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("Invalid targets.lxd.vm.boot_test.patterns %q: %w", pattern, err)
+			}
+		}
+	}
+
+	firmware := d.Targets.LXD.VM.Firmware
+	if firmware != nil {
+		if !strings.HasPrefix(firmware.Code, "/") {
+			return errors.New("targets.lxd.vm.firmware.code must be an absolute path")
+		}
+
+		if firmware.Vars != "" && !strings.HasPrefix(firmware.Vars, "/") {
+			return errors.New("targets.lxd.vm.firmware.vars must be an absolute path")
+		}
+	}
+
+	hardware := d.Targets.LXD.VM.Hardware
+	if hardware != nil {
+		err := hardware.validate(d.Packages.Manager)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.Image.EOL != "" {
+		_, err := time.Parse(EOLDateLayout, d.Image.EOL)
+		if err != nil {
+			return fmt.Errorf("image.eol must be a date in the format YYYY-MM-DD: %w", err)
+		}
+	}
+
+	actionNames := map[string]bool{}
+
+	for _, action := range d.Actions {
+		_, err := action.GetRetryDelay()
+		if err != nil {
+			return err
+		}
+
+		if action.Name == "" {
+			continue
+		}
+
+		if actionNames[action.Name] {
+			return fmt.Errorf("Duplicate actions.*.name %q", action.Name)
+		}
+
+		actionNames[action.Name] = true
+	}
+
+	validEOLPolicies := []string{"fail", "ignore", "warn"}
+
+	if d.Image.EOLPolicy != "" && !slices.Contains(validEOLPolicies, d.Image.EOLPolicy) {
+		return fmt.Errorf("image.eol_policy must be one of %v", validEOLPolicies)
+	}
+
+	validResolvConfPolicies := []string{"auto", "keep"}
+
+	if d.Environment.ResolvConfPolicy != "" && !slices.Contains(validResolvConfPolicies, d.Environment.ResolvConfPolicy) {
+		return fmt.Errorf("environment.resolv_conf_policy must be one of %v", validResolvConfPolicies)
+	}
+
+	validTarFormats := []string{"", "gnu", "pax", "ustar"}
+
+	if !slices.Contains(validTarFormats, d.Targets.Tar.Format) {
+		return fmt.Errorf("targets.tar.format must be one of %v", validTarFormats[1:])
+	}
+
+	if len(d.Targets.Tar.Xattrs) > 0 && slices.Contains([]string{"gnu", "ustar"}, d.Targets.Tar.Format) {
+		return fmt.Errorf("targets.tar.xattrs cannot be used with targets.tar.format %q", d.Targets.Tar.Format)
+	}
+
+	sysext := d.Targets.Sysext
+
+	validSysextTypes := []string{"confext", "sysext"}
+
+	if sysext.Type != "" && !slices.Contains(validSysextTypes, sysext.Type) {
+		return fmt.Errorf("targets.sysext.type must be one of %v", validSysextTypes)
+	}
+
+	validSysextFormats := []string{"erofs", "squashfs"}
+
+	if sysext.Format != "" && !slices.Contains(validSysextFormats, sysext.Format) {
+		return fmt.Errorf("targets.sysext.format must be one of %v", validSysextFormats)
+	}
+
+	if sysext.Name != "" && !regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`).MatchString(sysext.Name) {
+		return fmt.Errorf("Invalid targets.sysext.name %q", sysext.Name)
+	}
+
+	// systemd-sysext only merges /usr and /opt, and systemd-confext only /etc.
+	sysextPrefixes := []string{"/usr", "/opt"}
+	if sysext.Type == "confext" {
+		sysextPrefixes = []string{"/etc"}
+	}
+
+	for _, path := range sysext.Paths {
+		cleanPath := filepath.Clean(path)
+
+		if !slices.ContainsFunc(sysextPrefixes, func(prefix string) bool {
+			return cleanPath == prefix || strings.HasPrefix(cleanPath, prefix+"/")
+		}) {
+			return fmt.Errorf("targets.sysext.paths %q must be located in one of %v", path, sysextPrefixes)
+		}
+	}
+
+	wsl := d.Targets.WSL
+
+	if wsl.DefaultUser != "" && !regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`).MatchString(wsl.DefaultUser) {
+		return fmt.Errorf("Invalid targets.wsl.default_user %q", wsl.DefaultUser)
+	}
+
+	if wsl.Icon != "" && !strings.HasPrefix(wsl.Icon, "/") {
+		return errors.New("targets.wsl.icon must be an absolute path")
+	}
+
+	if wsl.Appx != nil {
+		if !regexp.MustCompile(`^[a-zA-Z0-9.-]{3,50}$`).MatchString(wsl.Appx.Name) {
+			return fmt.Errorf("Invalid targets.wsl.appx.name %q", wsl.Appx.Name)
+		}
+
+		if !strings.HasPrefix(wsl.Appx.Publisher, "CN=") {
+			return errors.New("targets.wsl.appx.publisher must be a distinguished name starting with CN=")
+		}
+
+		if wsl.Appx.Version != "" && !regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+$`).MatchString(wsl.Appx.Version) {
+			return fmt.Errorf("Invalid targets.wsl.appx.version %q, must be of the form major.minor.build.revision", wsl.Appx.Version)
+		}
+	}
+
+	if d.Targets.LXD.VM.SizeHeadroom != 0 {
+		if !d.Targets.LXD.VM.Size.Auto {
+			return errors.New("targets.lxd.vm.size_headroom requires targets.lxd.vm.size to be \"auto\"")
+		}
+
+		if d.Targets.LXD.VM.SizeHeadroom > 1000 {
+			return errors.New("targets.lxd.vm.size_headroom must be at most 1000")
+		}
+	}
+
+	esp := d.Targets.LXD.VM.ESP
+
+	if esp.FAT != 0 && !slices.Contains([]uint{12, 16, 32}, esp.FAT) {
+		return errors.New("targets.lxd.vm.esp.fat must be one of [12 16 32]")
+	}
+
+	if esp.Size != 0 && esp.Size%1048576 != 0 {
+		return errors.New("targets.lxd.vm.esp.size must be a multiple of 1MiB")
+	}
+
+	if esp.FAT == 32 && esp.Size != 0 && esp.Size < 33554432 {
+		return errors.New("targets.lxd.vm.esp.size must be at least 32MiB for FAT32")
+	}
+
+	if len(esp.Label) > 11 || strings.ContainsAny(esp.Label, " \"/") {
+		return fmt.Errorf("Invalid targets.lxd.vm.esp.label %q", esp.Label)
+	}
+
+	err = d.Targets.LXD.VM.validatePartitions()
+	if err != nil {
+		return err
+	}
+
+	lvm := d.Targets.LXD.VM.LVM
+
+	swap := d.Targets.LXD.VM.Swap
+	if swap != nil {
+		validSwapTypes := []string{"file", "partition"}
+
+		if !slices.Contains(validSwapTypes, swap.Type) {
+			return fmt.Errorf("targets.lxd.vm.swap.type must be one of %v", validSwapTypes)
+		}
+
+		if swap.Size == 0 || swap.Size%1048576 != 0 {
+			return errors.New("targets.lxd.vm.swap.size must be a non-zero multiple of 1MiB")
+		}
+
+		if swap.Type == "file" && !strings.HasPrefix(swap.Path, "/") {
+			return errors.New("targets.lxd.vm.swap.path must be an absolute path")
+		}
+
+		// f2fs only supports pinned swap files, which can't be created on the build host.
+		if swap.Type == "file" && slices.Contains([]string{"f2fs", "zfs"}, d.Targets.LXD.VM.Filesystem) {
+			return fmt.Errorf("targets.lxd.vm.swap cannot be a file on %s", d.Targets.LXD.VM.Filesystem)
+		}
+
+		if lvm != nil && lvm.SwapSize > 0 {
+			return errors.New("cannot have both targets.lxd.vm.swap and targets.lxd.vm.lvm.swap_size set")
+		}
+	}
+
+	if lvm != nil {
+		if lvm.VolumeGroup != "" && !regexp.MustCompile(`^[a-zA-Z0-9_.+]+$`).MatchString(lvm.VolumeGroup) {
+			return fmt.Errorf("Invalid targets.lxd.vm.lvm.volume_group %q", lvm.VolumeGroup)
+		}
+
+		if lvm.DataMountpoint != "" && !strings.HasPrefix(lvm.DataMountpoint, "/") {
+			return errors.New("targets.lxd.vm.lvm.data_mountpoint must be an absolute path")
+		}
+
+		// Auto-sized images are checked once their size is known.
+		size := d.Targets.LXD.VM.Size.Bytes
+		if size != 0 && lvm.RootSize+lvm.SwapSize+lvm.DataSize >= size {
+			return errors.New("targets.lxd.vm.lvm volume sizes must add up to less than targets.lxd.vm.size")
+		}
+	}
+
+	err = d.Targets.LXD.VM.validateFilesystemOptions()
+	if err != nil {
+		return err
+	}
+
+	btrfs := d.Targets.LXD.VM.Btrfs
+	if btrfs != nil {
+		if d.Targets.LXD.VM.Filesystem != "btrfs" {
+			return errors.New("targets.lxd.vm.btrfs requires targets.lxd.vm.filesystem to be btrfs")
+		}
+
+		for _, option := range btrfs.MountOptions {
+			if strings.HasPrefix(option, "subvol=") || strings.HasPrefix(option, "subvolid=") {
+				return errors.New("targets.lxd.vm.btrfs.mount_options may not contain subvol or subvolid")
+			}
+		}
+
+		// The root file system is mounted by its label.
+		for _, option := range btrfs.MkfsOptions {
+			if option == "-L" || strings.HasPrefix(option, "--label") {
+				return errors.New("targets.lxd.vm.btrfs.mkfs_options may not set the label")
+			}
+		}
+
+		names := map[string]bool{}
+		mountpoints := map[string]bool{}
+
+		for _, subvolume := range btrfs.Subvolumes {
+			if subvolume.Name == "" {
+				return errors.New("targets.lxd.vm.btrfs.subvolumes.*.name may not be empty")
+			}
+
+			if strings.HasPrefix(subvolume.Name, "/") || slices.Contains(strings.Split(subvolume.Name, "/"), "..") {
+				return fmt.Errorf("Invalid targets.lxd.vm.btrfs.subvolumes.*.name %q", subvolume.Name)
+			}
+
+			if names[subvolume.Name] {
+				return fmt.Errorf("Duplicate targets.lxd.vm.btrfs.subvolumes.*.name %q", subvolume.Name)
+			}
+
+			names[subvolume.Name] = true
+
+			for _, option := range subvolume.Options {
+				if strings.HasPrefix(option, "subvol=") || strings.HasPrefix(option, "subvolid=") {
+					return errors.New("targets.lxd.vm.btrfs.subvolumes.*.options may not contain subvol or subvolid")
+				}
+			}
+
+			if subvolume.Mountpoint == "" {
+				continue
+			}
+
+			if !strings.HasPrefix(subvolume.Mountpoint, "/") {
+				return errors.New("targets.lxd.vm.btrfs.subvolumes.*.mountpoint must be an absolute path")
+			}
+
+			if mountpoints[subvolume.Mountpoint] {
+				return fmt.Errorf("Duplicate targets.lxd.vm.btrfs.subvolumes.*.mountpoint %q", subvolume.Mountpoint)
+			}
+
+			mountpoints[subvolume.Mountpoint] = true
+		}
+
+		if d.Targets.LXD.VM.GetBtrfsRootSubvolume() == "" {
+			return errors.New("targets.lxd.vm.btrfs.subvolumes requires a subvolume mounted at /")
+		}
 	}
 
-	for _, file := range d.Files {
-		if !slices.Contains(validGenerators, strings.TrimSpace(file.Generator)) {
-			return fmt.Errorf("files.*.generator must be one of %v", validGenerators)
+	err = d.validateDisks()
+	if err != nil {
+		return err
+	}
+
+	zfs := d.Targets.LXD.VM.ZFS
+	if zfs != nil {
+		if d.Targets.LXD.VM.Filesystem != "zfs" {
+			return errors.New("targets.lxd.vm.zfs requires targets.lxd.vm.filesystem to be zfs")
+		}
+
+		if lvm != nil {
+			return errors.New("cannot have both targets.lxd.vm.zfs and targets.lxd.vm.lvm set")
+		}
+
+		for _, dataset := range zfs.Datasets {
+			if dataset.Name == "" {
+				return errors.New("targets.lxd.vm.zfs.datasets.*.name may not be empty")
+			}
+		}
+
+		if d.Targets.LXD.VM.GetZFSRootDataset() == "" {
+			return errors.New("targets.lxd.vm.zfs.datasets requires a dataset mounted at /")
 		}
 	}
 
-	validMappings := []string{
-		"almalinux",
-		"alpinelinux",
-		"altlinux",
-		"archlinux",
-		"centos",
-		"debian",
-		"gentoo",
-		"plamolinux",
-		"voidlinux",
-		"funtoo",
-		"slackware",
+	kernelCmdline := d.Targets.LXD.VM.KernelCmdline
+	if kernelCmdline != nil {
+		if kernelCmdline.Mode != "" && !slices.Contains([]string{"ro", "rw"}, kernelCmdline.Mode) {
+			return errors.New("targets.lxd.vm.kernel_cmdline.mode must be one of [ro rw]")
+		}
+
+		for _, console := range kernelCmdline.Console {
+			if console == "" || strings.ContainsAny(console, " \t\n\"") {
+				return fmt.Errorf("Invalid targets.lxd.vm.kernel_cmdline.console %q", console)
+			}
+		}
+
+		_, err := ParseKernelCmdline(kernelCmdline.Extra)
+		if err != nil {
+			return fmt.Errorf("Invalid targets.lxd.vm.kernel_cmdline.extra: %w", err)
+		}
 	}
 
-	architectureMap := strings.TrimSpace(d.Mappings.ArchitectureMap)
-	if architectureMap != "" {
-		if !slices.Contains(validMappings, architectureMap) {
-			return fmt.Errorf("mappings.architecture_map must be one of %v", validMappings)
+	bootloader := d.Targets.LXD.VM.Bootloader
+	if bootloader != nil {
+		validBootloaders := []string{"grub", "systemd-boot", "uki"}
+
+		if bootloader.Type != "" && !slices.Contains(validBootloaders, bootloader.Type) {
+			return fmt.Errorf("targets.lxd.vm.bootloader.type must be one of %v", validBootloaders)
+		}
+
+		// Only grub is chain loaded by the signed shim of the distributions.
+		if bootloader.SecureBoot && bootloader.Type != "grub" {
+			return errors.New("targets.lxd.vm.bootloader.secure_boot requires targets.lxd.vm.bootloader.type to be grub")
+		}
+
+		uBoot := bootloader.UBoot
+		if uBoot != nil {
+			if !strings.HasPrefix(uBoot.Path, "/") || slices.Contains(strings.Split(uBoot.Path, "/"), "..") {
+				return errors.New("targets.lxd.vm.bootloader.u_boot.path must be an absolute path inside of the rootfs")
+			}
+
+			// u-boot must be placed between the partition table and the first partition.
+			if uBoot.Offset%512 != 0 || uBoot.Offset < 17408 || uBoot.Offset >= 1048576 {
+				return errors.New("targets.lxd.vm.bootloader.u_boot.offset must be a multiple of 512 between 17408 and 1048576")
+			}
 		}
 	}
 
-	validTriggers := []string{
-		"post-files",
-		"post-packages",
-		"post-unpack",
-		"post-update",
+	if d.Targets.LXD.VM.GrowRoot {
+		if d.Targets.LXD.VM.Encryption != nil || lvm != nil {
+			return errors.New("targets.lxd.vm.grow_root cannot be used with targets.lxd.vm.encryption or targets.lxd.vm.lvm")
+		}
+
+		if swap != nil && swap.Type == "partition" {
+			return errors.New("targets.lxd.vm.grow_root cannot be used with a swap partition")
+		}
+
+		// f2fs can only be resized while it's unmounted.
+		if d.Targets.LXD.VM.Filesystem == "f2fs" {
+			return errors.New("targets.lxd.vm.grow_root is not supported for \"f2fs\"")
+		}
 	}
 
-	for _, action := range d.Actions {
-		if !slices.Contains(validTriggers, action.Trigger) {
-			return fmt.Errorf("actions.*.trigger must be one of %v", validTriggers)
+	shrink := d.Targets.LXD.VM.Shrink
+	if shrink != "" {
+		validShrinkModes := []string{"none", "trim", "minimal"}
+
+		if !slices.Contains(validShrinkModes, shrink) {
+			return fmt.Errorf("targets.lxd.vm.shrink must be one of %v", validShrinkModes)
+		}
+
+		if shrink == "minimal" {
+			if d.Targets.LXD.VM.Filesystem != "" && d.Targets.LXD.VM.Filesystem != "ext4" {
+				return fmt.Errorf("targets.lxd.vm.shrink %q is not supported for %q", shrink, d.Targets.LXD.VM.Filesystem)
+			}
+
+			if d.Targets.LXD.VM.Encryption != nil || lvm != nil {
+				return fmt.Errorf("targets.lxd.vm.shrink %q cannot be used with targets.lxd.vm.encryption or targets.lxd.vm.lvm", shrink)
+			}
+
+			if swap != nil && swap.Type == "partition" {
+				return fmt.Errorf("targets.lxd.vm.shrink %q cannot be used with a swap partition", shrink)
+			}
 		}
 	}
 
-	validPackageActions := []string{
-		"install",
-		"remove",
+	verity := d.Targets.LXD.VM.Verity
+	if verity != nil {
+		if d.Targets.LXD.VM.Filesystem != "" && d.Targets.LXD.VM.Filesystem != "ext4" {
+			return fmt.Errorf("targets.lxd.vm.verity is not supported for %q", d.Targets.LXD.VM.Filesystem)
+		}
+
+		if d.Targets.LXD.VM.Encryption != nil || lvm != nil || swap != nil {
+			return errors.New("targets.lxd.vm.verity cannot be used with targets.lxd.vm.encryption, targets.lxd.vm.lvm or targets.lxd.vm.swap")
+		}
+
+		if d.Targets.LXD.VM.GrowRoot || shrink == "minimal" {
+			return errors.New("targets.lxd.vm.verity cannot be used with targets.lxd.vm.grow_root or targets.lxd.vm.shrink \"minimal\"")
+		}
+
+		// The root hash is only known at the end of the build, so it can't be
+		// part of a grub configuration inside of the root partition.
+		if (bootloader == nil || bootloader.Type != "uki") && d.Targets.LXD.VM.BootArtifacts == nil {
+			return errors.New("targets.lxd.vm.verity requires targets.lxd.vm.bootloader.type to be uki, or targets.lxd.vm.boot_artifacts")
+		}
+
+		if verity.HashSize%1048576 != 0 {
+			return errors.New("targets.lxd.vm.verity.hash_size must be a multiple of 1MiB")
+		}
 	}
 
-	for _, set := range d.Packages.Sets {
-		if !slices.Contains(validPackageActions, set.Action) {
-			return fmt.Errorf("packages.*.set.*.action must be one of %v", validPackageActions)
+	bootArtifacts := d.Targets.LXD.VM.BootArtifacts
+	if bootArtifacts != nil && bootArtifacts.RootImage {
+		// The root image only contains the root file system.
+		if d.Targets.LXD.VM.Filesystem == "zfs" {
+			return errors.New("targets.lxd.vm.boot_artifacts.root_image is not supported for \"zfs\"")
+		}
+
+		if d.Targets.LXD.VM.Encryption != nil || lvm != nil || verity != nil || (swap != nil && swap.Type == "partition") {
+			return errors.New("targets.lxd.vm.boot_artifacts.root_image cannot be used with targets.lxd.vm.encryption, targets.lxd.vm.lvm, targets.lxd.vm.verity or a swap partition")
+		}
+	}
+
+	backend := d.Targets.LXD.VM.Backend
+	if backend != "" {
+		validBackends := []string{"guestfs", "loop", "userspace"}
+
+		if !slices.Contains(validBackends, backend) {
+			return fmt.Errorf("targets.lxd.vm.backend must be one of %v", validBackends)
+		}
+	}
+
+	// The userspace and guestfs backends create the file systems from a
+	// directory, so anything which needs block devices during the build isn't
+	// available.
+	if backend == "userspace" || backend == "guestfs" {
+		if d.Targets.LXD.VM.Filesystem != "" && d.Targets.LXD.VM.Filesystem != "ext4" && d.Targets.LXD.VM.Filesystem != "btrfs" {
+			return fmt.Errorf("targets.lxd.vm.backend %q is not supported for %q", backend, d.Targets.LXD.VM.Filesystem)
+		}
+
+		if d.Targets.LXD.VM.Encryption != nil || lvm != nil || verity != nil {
+			return fmt.Errorf("targets.lxd.vm.backend %q cannot be used with targets.lxd.vm.encryption, targets.lxd.vm.lvm or targets.lxd.vm.verity", backend)
 		}
+
+		if shrink == "minimal" {
+			return fmt.Errorf("targets.lxd.vm.backend %q cannot be used with targets.lxd.vm.shrink \"minimal\"", backend)
+		}
+
+		// Swap files on btrfs need to be created without copy-on-write,
+		// which mkfs.btrfs doesn't keep.
+		if swap != nil && (swap.Type == "partition" || d.Targets.LXD.VM.Filesystem == "btrfs") {
+			return fmt.Errorf("targets.lxd.vm.backend %q cannot be used with a swap partition, or a swap file on btrfs", backend)
+		}
+
+		// grub-install needs the EFI system partition and the PReP boot
+		// partition to be block devices.
+		if bootloader != nil && (bootloader.Type == "grub" || bootloader.SecureBoot) {
+			return fmt.Errorf("targets.lxd.vm.backend %q requires targets.lxd.vm.bootloader.type to be systemd-boot or uki", backend)
+		}
+	}
+
+	// The file systems are created using the libguestfs API, which only
+	// supports some of the mkfs options.
+	if backend == "guestfs" {
+		for _, key := range []string{"resize", "features", "encoding"} {
+			_, ok := d.Targets.LXD.VM.FilesystemOptions[key]
+			if ok {
+				return fmt.Errorf("targets.lxd.vm.filesystem_options %q isn't supported by targets.lxd.vm.backend %q", key, backend)
+			}
+		}
+
+		if d.Targets.LXD.VM.Btrfs != nil && len(d.Targets.LXD.VM.Btrfs.MkfsOptions) > 0 {
+			return fmt.Errorf("targets.lxd.vm.btrfs.mkfs_options isn't supported by targets.lxd.vm.backend %q", backend)
+		}
+	}
+
+	err = d.validatePublish()
+	if err != nil {
+		return err
+	}
+
+	err = d.validateEncrypt()
+	if err != nil {
+		return err
+	}
+
+	flavors := map[string]bool{}
+
+	for _, flavor := range d.Flavors {
+		if flavor.Name == "" {
+			return errors.New("flavors.*.name may not be empty")
+		}
+
+		if flavors[flavor.Name] {
+			return fmt.Errorf("Duplicate flavors.*.name %q", flavor.Name)
+		}
+
+		flavors[flavor.Name] = true
 	}
 
 	// Mapped architecture (distro name)
@@ -536,7 +2709,7 @@ func (d *Definition) Validate() error {
 	d.Image.ArchitectureMapped = archMapped
 
 	// Kernel architecture and personality
-	archID, err := osarch.ArchitectureId(d.Image.Architecture)
+	archID, err := getArchitectureID(d.Mappings.ArchitectureMap, d.Image.Architecture)
 	if err != nil {
 		return fmt.Errorf("Failed to get architecture ID: %w", err)
 	}
@@ -558,6 +2731,252 @@ func (d *Definition) Validate() error {
 	return nil
 }
 
+// validatePlugins validates the plugins. Their names may not shadow the built-in
+// sources, managers and generators.
+func (d *Definition) validatePlugins(builtins map[string][]string) error {
+	for i, plugin := range d.Plugins {
+		if !regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`).MatchString(plugin.Name) {
+			return fmt.Errorf("Invalid plugins.*.name %q", plugin.Name)
+		}
+
+		names, ok := builtins[plugin.Type]
+		if !ok {
+			return fmt.Errorf("plugins.*.type must be one of %v", []string{"generator", "manager", "source"})
+		}
+
+		if slices.Contains(names, plugin.Name) {
+			return fmt.Errorf("plugins.*.name %q conflicts with a built-in %s", plugin.Name, plugin.Type)
+		}
+
+		if d.GetPlugin(plugin.Type, plugin.Name) != &d.Plugins[i] {
+			return fmt.Errorf("Duplicate %s plugin %q", plugin.Type, plugin.Name)
+		}
+
+		if plugin.Path != "" && !strings.HasPrefix(plugin.Path, "/") {
+			return errors.New("plugins.*.path must be an absolute path")
+		}
+	}
+
+	return nil
+}
+
+// validateDisks validates the additional disks of the VM image.
+func (d *Definition) validateDisks() error {
+	validTypes := []string{"data", "seed"}
+	validFilesystems := []string{"btrfs", "ext4", "none", "swap", "vfat", "xfs"}
+
+	// Longest labels supported by the filesystems.
+	maxLabelLength := map[string]int{"btrfs": 255, "ext4": 16, "swap": 15, "vfat": 11, "xfs": 12}
+
+	names := map[string]bool{}
+	mountpoints := map[string]bool{}
+	seeds := 0
+
+	for _, disk := range d.Targets.LXD.VM.Disks {
+		if !regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`).MatchString(disk.Name) {
+			return fmt.Errorf("Invalid targets.lxd.vm.disks.*.name %q", disk.Name)
+		}
+
+		if names[disk.Name] {
+			return fmt.Errorf("Duplicate targets.lxd.vm.disks.*.name %q", disk.Name)
+		}
+
+		names[disk.Name] = true
+
+		if !slices.Contains(validTypes, disk.Type) {
+			return fmt.Errorf("targets.lxd.vm.disks.*.type must be one of %v", validTypes)
+		}
+
+		if disk.Size == 0 || disk.Size%1048576 != 0 {
+			return errors.New("targets.lxd.vm.disks.*.size must be a non-zero multiple of 1MiB")
+		}
+
+		if disk.Type == "seed" {
+			if d.Targets.LXD.VM.Seed == nil {
+				return errors.New("targets.lxd.vm.disks of type seed require targets.lxd.vm.seed to be set")
+			}
+
+			if disk.Filesystem != "" || disk.Label != "" || disk.Mountpoint != "" {
+				return errors.New("targets.lxd.vm.disks of type seed may not set filesystem, label or mountpoint")
+			}
+
+			seeds++
+
+			if seeds > 1 {
+				return errors.New("targets.lxd.vm.disks may only contain one disk of type seed")
+			}
+
+			continue
+		}
+
+		if !slices.Contains(validFilesystems, disk.Filesystem) {
+			return fmt.Errorf("targets.lxd.vm.disks.*.filesystem must be one of %v", validFilesystems)
+		}
+
+		if disk.Filesystem == "none" && disk.Label != "" {
+			return errors.New("targets.lxd.vm.disks.*.label requires a filesystem")
+		}
+
+		if len(disk.Label) > maxLabelLength[disk.Filesystem] || strings.ContainsAny(disk.Label, " \"/") {
+			return fmt.Errorf("Invalid targets.lxd.vm.disks.*.label %q", disk.Label)
+		}
+
+		if disk.Mountpoint == "" {
+			continue
+		}
+
+		if disk.Filesystem == "none" || disk.Filesystem == "swap" {
+			return fmt.Errorf("targets.lxd.vm.disks.*.mountpoint can't be set for filesystem %q", disk.Filesystem)
+		}
+
+		if !strings.HasPrefix(disk.Mountpoint, "/") || disk.Mountpoint == "/" {
+			return errors.New("targets.lxd.vm.disks.*.mountpoint must be an absolute path other than /")
+		}
+
+		if mountpoints[disk.Mountpoint] {
+			return fmt.Errorf("Duplicate targets.lxd.vm.disks.*.mountpoint %q", disk.Mountpoint)
+		}
+
+		mountpoints[disk.Mountpoint] = true
+	}
+
+	return nil
+}
+
+// validatePartitions validates the partition table entries of the VM image.
+func (d *DefinitionTargetLXDVM) validatePartitions() error {
+	validPartitions := []string{"esp", "prep", "root", "swap", "verity"}
+
+	for key, partition := range d.Partitions {
+		if !slices.Contains(validPartitions, key) {
+			return fmt.Errorf("targets.lxd.vm.partitions keys must be one of %v", validPartitions)
+		}
+
+		_, ok := gptPartitionTypes[partition.Type]
+		if partition.Type != "" && !ok && !regexp.MustCompile(`^[0-9a-fA-F]{8}-([0-9a-fA-F]{4}-){3}[0-9a-fA-F]{12}$`).MatchString(partition.Type) {
+			return fmt.Errorf("Invalid targets.lxd.vm.partitions.%s.type %q", key, partition.Type)
+		}
+
+		// The name is stored as at most 36 UTF-16 code units.
+		if len(utf16.Encode([]rune(partition.Name))) > 36 {
+			return fmt.Errorf("targets.lxd.vm.partitions.%s.name must be at most 36 characters", key)
+		}
+
+		for _, attribute := range partition.Attributes {
+			_, ok := gptPartitionAttributes[attribute]
+			if ok {
+				continue
+			}
+
+			bit, err := strconv.ParseUint(attribute, 10, 8)
+			if err != nil || bit > 63 {
+				return fmt.Errorf("Invalid targets.lxd.vm.partitions.%s.attributes.* %q", key, attribute)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validatePublish validates the LXD server the image is uploaded to.
+func (d *Definition) validatePublish() error {
+	publish := d.Targets.LXD.Publish
+	if publish == nil {
+		return nil
+	}
+
+	if publish.Remote != "" {
+		if !strings.HasPrefix(publish.Remote, "https://") {
+			return errors.New("targets.lxd.publish.remote must be an https:// URL")
+		}
+
+		if publish.ClientCert == "" || publish.ClientKey == "" {
+			return errors.New("targets.lxd.publish.remote requires targets.lxd.publish.client_cert and targets.lxd.publish.client_key")
+		}
+	} else if publish.ClientCert != "" || publish.ClientKey != "" || publish.ServerCert != "" {
+		return errors.New("targets.lxd.publish.client_cert, client_key and server_cert require targets.lxd.publish.remote")
+	}
+
+	if publish.Project != "" && !regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`).MatchString(publish.Project) {
+		return fmt.Errorf("Invalid targets.lxd.publish.project %q", publish.Project)
+	}
+
+	aliases := map[string]bool{}
+
+	for _, alias := range publish.Aliases {
+		if alias == "" {
+			return errors.New("targets.lxd.publish.aliases.* may not be empty")
+		}
+
+		if aliases[alias] {
+			return fmt.Errorf("Duplicate targets.lxd.publish.aliases.* %q", alias)
+		}
+
+		aliases[alias] = true
+	}
+
+	_, err := lxdShared.GetExpiry(time.Now(), publish.Expiry)
+	if err != nil {
+		return fmt.Errorf("Invalid targets.lxd.publish.expiry %q", publish.Expiry)
+	}
+
+	return nil
+}
+
+// validateEncrypt validates the encryption of the artifacts.
+func (d *Definition) validateEncrypt() error {
+	encrypt := d.Targets.Encrypt
+	if encrypt == nil {
+		return nil
+	}
+
+	validMethods := []string{"age", "gpg"}
+
+	if !slices.Contains(validMethods, encrypt.Method) {
+		return fmt.Errorf("targets.encrypt.method must be one of %v", validMethods)
+	}
+
+	// age encrypts to public keys, and gpg is used with a symmetric passphrase.
+	if encrypt.Method == "age" {
+		if len(encrypt.Recipients) == 0 {
+			return errors.New("targets.encrypt.method \"age\" requires targets.encrypt.recipients")
+		}
+
+		if encrypt.PassphraseFile != "" {
+			return errors.New("targets.encrypt.passphrase_file isn't supported by targets.encrypt.method \"age\"")
+		}
+	} else {
+		if encrypt.PassphraseFile == "" {
+			return errors.New("targets.encrypt.method \"gpg\" requires targets.encrypt.passphrase_file")
+		}
+
+		if len(encrypt.Recipients) > 0 {
+			return errors.New("targets.encrypt.recipients isn't supported by targets.encrypt.method \"gpg\"")
+		}
+	}
+
+	recipients := map[string]bool{}
+
+	for _, recipient := range encrypt.Recipients {
+		if recipient == "" {
+			return errors.New("targets.encrypt.recipients.* may not be empty")
+		}
+
+		if recipients[recipient] {
+			return fmt.Errorf("Duplicate targets.encrypt.recipients.* %q", recipient)
+		}
+
+		recipients[recipient] = true
+	}
+
+	// Images are uploaded from the published artifacts.
+	if d.Targets.LXD.Publish != nil {
+		return errors.New("targets.encrypt cannot be used with targets.lxd.publish")
+	}
+
+	return nil
+}
+
 // GetRunnableActions returns a list of actions depending on the trigger
 // and releases.
 func (d *Definition) GetRunnableActions(trigger string, imageTarget ImageTarget) []DefinitionAction {
@@ -578,6 +2997,26 @@ func (d *Definition) GetRunnableActions(trigger string, imageTarget ImageTarget)
 	return out
 }
 
+// GetRootfsOverlays returns the rootfs overlays of the given trigger which
+// match the image.
+func (d *Definition) GetRootfsOverlays(trigger string, imageTarget ImageTarget) []DefinitionRootfsOverlay {
+	var out []DefinitionRootfsOverlay
+
+	for _, overlay := range d.RootfsOverlays {
+		if overlay.Trigger != trigger {
+			continue
+		}
+
+		if !ApplyFilter(&overlay, d.Image.Release, d.Image.ArchitectureMapped, d.Image.Variant, d.Targets.Type, imageTarget) {
+			continue
+		}
+
+		out = append(out, overlay)
+	}
+
+	return out
+}
+
 // GetEarlyPackages returns a list of packages which are to be installed or removed earlier than the actual package handling
 // Also removes them from the package set so they aren't attempted to be re-installed again as normal packages.
 func (d *Definition) GetEarlyPackages(action string) []string {
@@ -18,6 +18,70 @@ func TestSetDefinitionDefaults(t *testing.T) {
 
 	require.Equal(t, localArch, def.Image.Architecture)
 	require.Equal(t, "30d", def.Image.Expiry)
+	require.Equal(t, uint64(104857600), def.Targets.LXD.VM.ESP.Size)
+	require.Equal(t, "UEFI", def.Targets.LXD.VM.ESP.Label)
+	require.Equal(t, uint(32), def.Targets.LXD.VM.ESP.FAT)
+
+	def = Definition{
+		Targets: DefinitionTarget{
+			LXD: DefinitionTargetLXD{
+				VM: DefinitionTargetLXDVM{
+					LVM: &DefinitionTargetLXDVMLVM{},
+				},
+			},
+		},
+	}
+
+	def.SetDefaults()
+
+	require.Equal(t, "rootvg", def.Targets.LXD.VM.LVM.VolumeGroup)
+	require.Equal(t, "/srv", def.Targets.LXD.VM.LVM.DataMountpoint)
+
+	def = Definition{
+		Targets: DefinitionTarget{
+			LXD: DefinitionTargetLXD{
+				VM: DefinitionTargetLXDVM{
+					Swap: &DefinitionTargetLXDVMSwap{
+						Type: "file",
+					},
+				},
+			},
+		},
+	}
+
+	def.SetDefaults()
+
+	require.Equal(t, "/swapfile", def.Targets.LXD.VM.Swap.Path)
+
+	def = Definition{
+		Targets: DefinitionTarget{
+			LXD: DefinitionTargetLXD{
+				VM: DefinitionTargetLXDVM{
+					Filesystem: "zfs",
+				},
+			},
+		},
+	}
+
+	def.SetDefaults()
+
+	require.Equal(t, "rpool", def.Targets.LXD.VM.ZFS.Pool)
+	require.Equal(t, "rpool/ROOT/default", def.Targets.LXD.VM.GetZFSRootDataset())
+
+	def = Definition{
+		Targets: DefinitionTarget{
+			LXD: DefinitionTargetLXD{
+				VM: DefinitionTargetLXDVM{
+					Filesystem: "btrfs",
+				},
+			},
+		},
+	}
+
+	def.SetDefaults()
+
+	require.Equal(t, []DefinitionTargetLXDVMBtrfsSubvolume{{Name: "@", Mountpoint: "/"}}, def.Targets.LXD.VM.Btrfs.Subvolumes)
+	require.Equal(t, "@", def.Targets.LXD.VM.GetBtrfsRootSubvolume())
 }
 
 func TestValidateDefinition(t *testing.T) {
@@ -426,140 +490,4878 @@ func TestValidateDefinition(t *testing.T) {
 			"packages\\.\\*\\.set\\.\\*\\.action must be one of .+",
 			true,
 		},
-	}
-
-	for i, tt := range tests {
-		log.Printf("Running test #%d: %s", i, tt.name)
-		tt.definition.SetDefaults()
-		err := tt.definition.Validate()
-		if tt.shouldFail {
-			require.Regexp(t, tt.expected, err)
-		} else {
-			require.NoError(t, err)
-		}
-	}
-}
-
-func TestDefinitionSetValue(t *testing.T) {
-	d := Definition{
-		Image: DefinitionImage{
-			Distribution: "ubuntu",
-			Release:      "artful",
+		{
+			"missing passphrase and keyfile in targets.lxd.vm.encryption",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Encryption: &DefinitionTargetLXDVMEncryption{},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.encryption requires either a passphrase or a keyfile",
+			true,
 		},
-		Source: DefinitionSource{
-			Downloader:       "debootstrap",
-			URL:              "https://ubuntu.com",
-			Keys:             []string{"0xCODE"},
-			SkipVerification: true,
+		{
+			"passphrase and keyfile in targets.lxd.vm.encryption set",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Encryption: &DefinitionTargetLXDVMEncryption{
+								Passphrase: "secret",
+								Keyfile:    "/root/keyfile",
+							},
+						},
+					},
+				},
+			},
+			"cannot have both targets.lxd.vm.encryption.passphrase and targets.lxd.vm.encryption.keyfile set",
+			true,
 		},
-		Packages: DefinitionPackages{
-			Manager: "apt",
+		{
+			"invalid targets.lxd.vm.lvm.volume_group",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							LVM: &DefinitionTargetLXDVMLVM{
+								VolumeGroup: "root-vg",
+							},
+						},
+					},
+				},
+			},
+			"Invalid targets.lxd.vm.lvm.volume_group \"root-vg\"",
+			true,
 		},
-		Actions: []DefinitionAction{
-			{
-				Trigger: "post-update",
-				Action:  "/bin/true",
+		{
+			"targets.lxd.vm.lvm exceeding targets.lxd.vm.size",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Size: DefinitionTargetLXDVMSize{Bytes: 4294967296},
+							LVM: &DefinitionTargetLXDVMLVM{
+								RootSize: 3221225472,
+								DataSize: 1073741824,
+							},
+						},
+					},
+				},
 			},
-			{
-				Trigger: "post-packages",
-				Action:  "/bin/false",
+			"targets.lxd.vm.lvm volume sizes must add up to less than targets.lxd.vm.size",
+			true,
+		},
+		{
+			"targets.lxd.vm.lvm with auto targets.lxd.vm.size",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Size: DefinitionTargetLXDVMSize{Auto: true},
+							LVM: &DefinitionTargetLXDVMLVM{
+								RootSize: 3221225472,
+								DataSize: 1073741824,
+							},
+						},
+					},
+				},
 			},
+			"",
+			false,
 		},
-	}
-
-	err := d.SetValue("image.release", "bionic")
-	require.NoError(t, err)
-	require.Equal(t, "bionic", d.Image.Release)
-
-	err = d.SetValue("actions.0.trigger", "post-files")
-	require.NoError(t, err)
-	require.Equal(t, "post-files", d.Actions[0].Trigger)
-
-	// Index out of bounds
-	err = d.SetValue("actions.3.trigger", "post-files")
-	require.EqualError(t, err, "Failed to get field by tag: Index out of range")
-
-	// Nonsense
-	err = d.SetValue("image", "[foo: bar]")
-	require.EqualError(t, err, "Unsupported type 'struct'")
-
-	err = d.SetValue("source.skip_verification", "true")
-	require.NoError(t, err)
-	require.Equal(t, true, d.Source.SkipVerification)
-}
-
-func TestDefinitionFilter(t *testing.T) {
-	input := `packages:
-  sets:
-  - packages:
-    - foo
-    architectures:
-    - amd64`
-	def := Definition{}
-
-	err := yaml.Unmarshal([]byte(input), &def)
-	require.NoError(t, err)
-
-	require.Contains(t, def.Packages.Sets[0].Packages, "foo")
-	require.Contains(t, def.Packages.Sets[0].Architectures, "amd64")
-}
-
-func TestApplyFilter(t *testing.T) {
-	repo := DefinitionPackagesRepository{}
-
-	// Variants
-	repo.Variants = []string{"default"}
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", 0))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "cloud", "vm", 0))
-
-	// Architectures
-	repo.Architectures = []string{"amd64", "i386"}
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", 0))
-	require.True(t, ApplyFilter(&repo, "foo", "i386", "default", "vm", 0))
-	require.False(t, ApplyFilter(&repo, "foo", "s390", "default", "vm", 0))
-
-	// Releases
-	repo.Releases = []string{"foo"}
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", 0))
-	require.False(t, ApplyFilter(&repo, "bar", "amd64", "default", "vm", 0))
-
-	// Targets
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", 0))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", 0))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetUndefined))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetUndefined))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetAll|ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer|ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetAll|ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer|ImageTargetVM))
-
-	repo.Types = []DefinitionFilterType{DefinitionFilterTypeVM}
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetVM))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetAll|ImageTargetVM))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer|ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetAll|ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer|ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", 0))
-
-	repo.Types = []DefinitionFilterType{DefinitionFilterTypeContainer}
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetAll|ImageTargetContainer))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer|ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetAll|ImageTargetContainer))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer|ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", 0))
-
-	repo.Types = []DefinitionFilterType{DefinitionFilterTypeContainer, DefinitionFilterTypeVM}
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetAll|ImageTargetContainer))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer|ImageTargetVM))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetAll|ImageTargetContainer))
-	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer|ImageTargetVM))
-	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer))
+		{
+			"missing root dataset in targets.lxd.vm.zfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "zfs",
+							ZFS: &DefinitionTargetLXDVMZFS{
+								Datasets: []DefinitionTargetLXDVMZFSDataset{
+									{Name: "home", Mountpoint: "/home"},
+								},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.zfs.datasets requires a dataset mounted at /",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.esp.fat",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							ESP: DefinitionTargetLXDVMESP{
+								FAT: 8,
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.esp.fat must be one of \\[12 16 32\\]",
+			true,
+		},
+		{
+			"too small targets.lxd.vm.esp.size for FAT32",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							ESP: DefinitionTargetLXDVMESP{
+								Size: 16777216,
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.esp.size must be at least 32MiB for FAT32",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.esp.label",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							ESP: DefinitionTargetLXDVMESP{
+								Label: "EFI SYSTEM PART",
+							},
+						},
+					},
+				},
+			},
+			"Invalid targets.lxd.vm.esp.label \"EFI SYSTEM PART\"",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.swap.type",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Swap: &DefinitionTargetLXDVMSwap{
+								Type: "zram",
+								Size: 1073741824,
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.swap.type must be one of \\[file partition\\]",
+			true,
+		},
+		{
+			"swap file on zfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "zfs",
+							Swap: &DefinitionTargetLXDVMSwap{
+								Type: "file",
+								Size: 1073741824,
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.swap cannot be a file on zfs",
+			true,
+		},
+		{
+			"invalid targets.tar.format",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Tar: DefinitionTargetTar{
+						Format: "v7",
+					},
+				},
+			},
+			"targets.tar.format must be one of \\[gnu pax ustar\\]",
+			true,
+		},
+		{
+			"targets.tar.xattrs with gnu format",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Tar: DefinitionTargetTar{
+						Format: "gnu",
+						Xattrs: []string{"user.*"},
+					},
+				},
+			},
+			"targets.tar.xattrs cannot be used with targets.tar.format \"gnu\"",
+			true,
+		},
+		{
+			"invalid image.eol_policy",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+					EOLPolicy:    "error",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+			},
+			"image.eol_policy must be one of \\[fail ignore warn\\]",
+			true,
+		},
+		{
+			"invalid environment.resolv_conf_policy",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Environment: DefinitionEnv{
+					ResolvConfPolicy: "stub",
+				},
+			},
+			"environment.resolv_conf_policy must be one of \\[auto keep\\]",
+			true,
+		},
+		{
+			"relative targets.lxd.vm.firmware.code",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Firmware: &DefinitionTargetLXDVMFirmware{
+								Code: "OVMF_CODE_4M.fd",
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.firmware.code must be an absolute path",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.verity",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Bootloader: &DefinitionTargetLXDVMBootloader{
+								Type: "uki",
+							},
+							Verity: &DefinitionTargetLXDVMVerity{
+								HashSize: 67108864,
+							},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"targets.lxd.vm.verity with grub",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Bootloader: &DefinitionTargetLXDVMBootloader{
+								Type: "grub",
+							},
+							Verity: &DefinitionTargetLXDVMVerity{},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.verity requires targets.lxd.vm.bootloader.type to be uki, or targets.lxd.vm.boot_artifacts",
+			true,
+		},
+		{
+			"targets.lxd.vm.verity with grow_root",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							BootArtifacts: &DefinitionTargetLXDVMBootArtifacts{},
+							GrowRoot:      true,
+							Verity:        &DefinitionTargetLXDVMVerity{},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.verity cannot be used with targets.lxd.vm.grow_root or targets.lxd.vm.shrink \"minimal\"",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.boot_test.timeout",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							BootTest: &DefinitionTargetLXDVMBootTest{
+								Timeout: "-1m",
+							},
+						},
+					},
+				},
+			},
+			"Invalid targets.lxd.vm.boot_test.timeout \"-1m\": must be positive",
+			true,
+		},
+		{
+			"valid plugin source",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "my-source",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Plugins: []DefinitionPlugin{
+					{Name: "my-source", Type: "source"},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid plugins.*.type",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Plugins: []DefinitionPlugin{
+					{Name: "my-source", Type: "downloader"},
+				},
+			},
+			"plugins.\\*.type must be one of \\[generator manager source\\]",
+			true,
+		},
+		{
+			"plugin shadowing built-in",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Plugins: []DefinitionPlugin{
+					{Name: "debootstrap", Type: "source"},
+				},
+			},
+			"plugins.\\*.name \"debootstrap\" conflicts with a built-in source",
+			true,
+		},
+		{
+			"duplicate plugin",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "my-source",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Plugins: []DefinitionPlugin{
+					{Name: "my-source", Type: "source"},
+					{Name: "my-source", Type: "source", Path: "/usr/bin/my-source"},
+				},
+			},
+			"Duplicate source plugin \"my-source\"",
+			true,
+		},
+		{
+			"relative plugins.*.path",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "my-source",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Plugins: []DefinitionPlugin{
+					{Name: "my-source", Type: "source", Path: "my-source"},
+				},
+			},
+			"plugins.\\*.path must be an absolute path",
+			true,
+		},
+		{
+			"plugin of other type",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "my-source",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Plugins: []DefinitionPlugin{
+					{Name: "my-source", Type: "generator"},
+				},
+			},
+			"source.downloader must be one of .*",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.disks",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Seed: &DefinitionTargetLXDVMSeed{},
+							Disks: []DefinitionTargetLXDVMDisk{
+								{Name: "data", Size: 1073741824, Filesystem: "xfs", Mountpoint: "/srv/data"},
+								{Name: "swap", Size: 536870912, Filesystem: "swap"},
+								{Name: "raw", Size: 1048576, Filesystem: "none"},
+								{Name: "seed", Type: "seed"},
+							},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid targets.lxd.vm.disks.*.name",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Disks: []DefinitionTargetLXDVMDisk{
+								{Name: "Data", Size: 1048576},
+							},
+						},
+					},
+				},
+			},
+			"Invalid targets.lxd.vm.disks.\\*.name \"Data\"",
+			true,
+		},
+		{
+			"duplicate targets.lxd.vm.disks.*.name",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Disks: []DefinitionTargetLXDVMDisk{
+								{Name: "data", Size: 1048576},
+								{Name: "data", Size: 1048576},
+							},
+						},
+					},
+				},
+			},
+			"Duplicate targets.lxd.vm.disks.\\*.name \"data\"",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.disks.*.size",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Disks: []DefinitionTargetLXDVMDisk{
+								{Name: "data"},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.disks.\\*.size must be a non-zero multiple of 1MiB",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.disks.*.filesystem",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Disks: []DefinitionTargetLXDVMDisk{
+								{Name: "data", Size: 1048576, Filesystem: "zfs"},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.disks.\\*.filesystem must be one of .*",
+			true,
+		},
+		{
+			"too long targets.lxd.vm.disks.*.label",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Disks: []DefinitionTargetLXDVMDisk{
+								{Name: "data-for-applications", Size: 1048576},
+							},
+						},
+					},
+				},
+			},
+			"Invalid targets.lxd.vm.disks.\\*.label \"data-for-applications\"",
+			true,
+		},
+		{
+			"targets.lxd.vm.disks.*.mountpoint for swap",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Disks: []DefinitionTargetLXDVMDisk{
+								{Name: "swap", Size: 1048576, Filesystem: "swap", Mountpoint: "/swap"},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.disks.\\*.mountpoint can't be set for filesystem \"swap\"",
+			true,
+		},
+		{
+			"relative targets.lxd.vm.disks.*.mountpoint",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Disks: []DefinitionTargetLXDVMDisk{
+								{Name: "data", Size: 1048576, Mountpoint: "srv"},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.disks.\\*.mountpoint must be an absolute path other than /",
+			true,
+		},
+		{
+			"seed disk without targets.lxd.vm.seed",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Disks: []DefinitionTargetLXDVMDisk{
+								{Name: "seed", Type: "seed"},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.disks of type seed require targets.lxd.vm.seed to be set",
+			true,
+		},
+		{
+			"multiple seed disks",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Seed: &DefinitionTargetLXDVMSeed{},
+							Disks: []DefinitionTargetLXDVMDisk{
+								{Name: "seed", Type: "seed"},
+								{Name: "seed2", Type: "seed"},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.disks may only contain one disk of type seed",
+			true,
+		},
+		{
+			"valid console generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "console",
+						Console:   &DefinitionFileConsole{Keymap: "de-latin1-nodeadkeys", Font: "Lat15-Terminus16", Layout: "de,us", Options: "grp:alt_shift_toggle"},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"console generator without console",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "console",
+					},
+				},
+			},
+			"files.\\*.console requires a keymap, layout or font",
+			true,
+		},
+		{
+			"invalid files.*.console.keymap",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "console",
+						Console:   &DefinitionFileConsole{Keymap: "../us"},
+					},
+				},
+			},
+			"Invalid files.\\*.console.keymap \"../us\"",
+			true,
+		},
+		{
+			"invalid files.*.console.layout",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "console",
+						Console:   &DefinitionFileConsole{Layout: "de us"},
+					},
+				},
+			},
+			"Invalid files.\\*.console.layout \"de us\"",
+			true,
+		},
+		{
+			"files.*.console.variant without layout",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "console",
+						Console:   &DefinitionFileConsole{Keymap: "de", Variant: "nodeadkeys"},
+					},
+				},
+			},
+			"files.\\*.console.model, variant and options require a layout",
+			true,
+		},
+		{
+			"invalid files.*.console.options",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "console",
+						Console:   &DefinitionFileConsole{Layout: "de", Options: "$(reboot)"},
+					},
+				},
+			},
+			"Invalid files.\\*.console.options \"\\$\\(reboot\\)\"",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.kernel_cmdline",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							KernelCmdline: &DefinitionTargetLXDVMKernelCmdline{Mode: "rw", Console: []string{"tty0", "ttyS0,115200n8"}, Extra: "quiet dyndbg=\"file drivers/* +p\""},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid targets.lxd.vm.kernel_cmdline.mode",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							KernelCmdline: &DefinitionTargetLXDVMKernelCmdline{Mode: "readonly"},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.kernel_cmdline.mode must be one of \\[ro rw\\]",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.kernel_cmdline.console",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							KernelCmdline: &DefinitionTargetLXDVMKernelCmdline{Console: []string{"ttyS0 quiet"}},
+						},
+					},
+				},
+			},
+			"Invalid targets.lxd.vm.kernel_cmdline.console \"ttyS0 quiet\"",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.kernel_cmdline.extra",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							KernelCmdline: &DefinitionTargetLXDVMKernelCmdline{Extra: "dyndbg=\"file"},
+						},
+					},
+				},
+			},
+			"Invalid targets.lxd.vm.kernel_cmdline.extra: Unterminated quote in kernel command line",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.backend",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Backend:    "userspace",
+							Filesystem: "btrfs",
+							Bootloader: &DefinitionTargetLXDVMBootloader{Type: "systemd-boot"},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid targets.lxd.vm.backend",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Backend: "fuse",
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.backend must be one of \\[guestfs loop userspace\\]",
+			true,
+		},
+		{
+			"targets.lxd.vm.backend userspace with zfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Backend:    "userspace",
+							Filesystem: "zfs",
+							ZFS:        &DefinitionTargetLXDVMZFS{},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.backend \"userspace\" is not supported for \"zfs\"",
+			true,
+		},
+		{
+			"targets.lxd.vm.backend userspace with lvm",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Backend: "userspace",
+							LVM:     &DefinitionTargetLXDVMLVM{},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.backend \"userspace\" cannot be used with targets.lxd.vm.encryption, targets.lxd.vm.lvm or targets.lxd.vm.verity",
+			true,
+		},
+		{
+			"targets.lxd.vm.backend userspace with swap partition",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Backend: "userspace",
+							Swap:    &DefinitionTargetLXDVMSwap{Type: "partition", Size: 1048576},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.backend \"userspace\" cannot be used with a swap partition, or a swap file on btrfs",
+			true,
+		},
+		{
+			"targets.lxd.vm.backend userspace with grub",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Backend:    "userspace",
+							Bootloader: &DefinitionTargetLXDVMBootloader{Type: "grub"},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.backend \"userspace\" requires targets.lxd.vm.bootloader.type to be systemd-boot or uki",
+			true,
+		},
+		{
+			"valid targets.lxd.publish",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						Publish: &DefinitionTargetLXDPublish{
+							Remote:     "https://images.example.com:8443",
+							Project:    "nightly",
+							Aliases:    []string{"ubuntu/{{ image.release }}/latest"},
+							Keep:       3,
+							Expiry:     "2w",
+							ClientCert: "/etc/lxd-imagebuilder/client.crt",
+							ClientKey:  "/etc/lxd-imagebuilder/client.key",
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid targets.lxd.publish.remote",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						Publish: &DefinitionTargetLXDPublish{
+							Remote: "images.example.com",
+						},
+					},
+				},
+			},
+			"targets.lxd.publish.remote must be an https:// URL",
+			true,
+		},
+		{
+			"targets.lxd.publish.remote without client certificate",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						Publish: &DefinitionTargetLXDPublish{
+							Remote: "https://images.example.com:8443",
+						},
+					},
+				},
+			},
+			"targets.lxd.publish.remote requires targets.lxd.publish.client_cert and targets.lxd.publish.client_key",
+			true,
+		},
+		{
+			"duplicate targets.lxd.publish.aliases",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						Publish: &DefinitionTargetLXDPublish{
+							Aliases: []string{"latest", "latest"},
+						},
+					},
+				},
+			},
+			"Duplicate targets.lxd.publish.aliases.\\* \"latest\"",
+			true,
+		},
+		{
+			"invalid targets.lxd.publish.expiry",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						Publish: &DefinitionTargetLXDPublish{
+							Expiry: "2 weeks",
+						},
+					},
+				},
+			},
+			"Invalid targets.lxd.publish.expiry \"2 weeks\"",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.backend guestfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Backend:           "guestfs",
+							FilesystemOptions: map[string]string{"inode_size": "256"},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"targets.lxd.vm.backend guestfs with filesystem_options",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Backend:           "guestfs",
+							FilesystemOptions: map[string]string{"features": "casefold"},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.filesystem_options \"features\" isn't supported by targets.lxd.vm.backend \"guestfs\"",
+			true,
+		},
+		{
+			"targets.lxd.vm.backend guestfs with encryption",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Backend:    "guestfs",
+							Encryption: &DefinitionTargetLXDVMEncryption{Passphrase: "secret"},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.backend \"guestfs\" cannot be used with targets.lxd.vm.encryption, targets.lxd.vm.lvm or targets.lxd.vm.verity",
+			true,
+		},
+		{
+			"valid targets.encrypt",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Encrypt: &DefinitionTargetEncrypt{Method: "age", Recipients: []string{"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"}},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid targets.encrypt.method",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Encrypt: &DefinitionTargetEncrypt{Method: "zip"},
+				},
+			},
+			"targets.encrypt.method must be one of \\[age gpg\\]",
+			true,
+		},
+		{
+			"targets.encrypt.method gpg without passphrase_file",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Encrypt: &DefinitionTargetEncrypt{Method: "gpg"},
+				},
+			},
+			"targets.encrypt.method \"gpg\" requires targets.encrypt.passphrase_file",
+			true,
+		},
+		{
+			"targets.encrypt.method age with passphrase_file",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Encrypt: &DefinitionTargetEncrypt{Method: "age", Recipients: []string{"age1"}, PassphraseFile: "/run/secret"},
+				},
+			},
+			"targets.encrypt.passphrase_file isn't supported by targets.encrypt.method \"age\"",
+			true,
+		},
+		{
+			"duplicate targets.encrypt.recipients",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Encrypt: &DefinitionTargetEncrypt{Method: "age", Recipients: []string{"age1", "age1"}},
+				},
+			},
+			"Duplicate targets.encrypt.recipients.\\* \"age1\"",
+			true,
+		},
+		{
+			"targets.encrypt with targets.lxd.publish",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Encrypt: &DefinitionTargetEncrypt{Method: "gpg", PassphraseFile: "/run/secret"},
+					LXD:     DefinitionTargetLXD{Publish: &DefinitionTargetLXDPublish{}},
+				},
+			},
+			"targets.encrypt cannot be used with targets.lxd.publish",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.partitions",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Partitions: map[string]DefinitionTargetLXDVMPartition{
+								"root": {Type: "root-x86-64", Name: "root-x86-64", Attributes: []string{"grow-file-system", "48"}},
+								"esp":  {Type: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"},
+							},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid targets.lxd.vm.partitions key",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Partitions: map[string]DefinitionTargetLXDVMPartition{
+								"home": {Type: "linux-generic"},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.partitions keys must be one of \\[esp prep root swap verity\\]",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.partitions.*.type",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Partitions: map[string]DefinitionTargetLXDVMPartition{
+								"root": {Type: "root-vax"},
+							},
+						},
+					},
+				},
+			},
+			"Invalid targets.lxd.vm.partitions.root.type \"root-vax\"",
+			true,
+		},
+		{
+			"too long targets.lxd.vm.partitions.*.name",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Partitions: map[string]DefinitionTargetLXDVMPartition{
+								"root": {Name: "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.partitions.root.name must be at most 36 characters",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.partitions.*.attributes",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Partitions: map[string]DefinitionTargetLXDVMPartition{
+								"swap": {Attributes: []string{"64"}},
+							},
+						},
+					},
+				},
+			},
+			"Invalid targets.lxd.vm.partitions.swap.attributes.\\* \"64\"",
+			true,
+		},
+		{
+			"valid f2fs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "f2fs",
+							Swap:       &DefinitionTargetLXDVMSwap{Type: "partition", Size: 1073741824},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"swap file on f2fs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "f2fs",
+							Swap:       &DefinitionTargetLXDVMSwap{Type: "file", Size: 1073741824},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.swap cannot be a file on f2fs",
+			true,
+		},
+		{
+			"targets.lxd.vm.grow_root on f2fs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "f2fs",
+							GrowRoot:   true,
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.grow_root is not supported for \"f2fs\"",
+			true,
+		},
+		{
+			"targets.lxd.vm.shrink minimal on f2fs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "f2fs",
+							Shrink:     "minimal",
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.shrink \"minimal\" is not supported for \"f2fs\"",
+			true,
+		},
+		{
+			"targets.lxd.vm.boot_artifacts.root_image with zfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem:    "zfs",
+							BootArtifacts: &DefinitionTargetLXDVMBootArtifacts{RootImage: true},
+						},
+					},
+				},
+			},
+			`targets.lxd.vm.boot_artifacts.root_image is not supported for "zfs"`,
+			true,
+		},
+		{
+			"targets.lxd.vm.boot_artifacts.root_image with lvm",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							LVM:           &DefinitionTargetLXDVMLVM{},
+							BootArtifacts: &DefinitionTargetLXDVMBootArtifacts{RootImage: true},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.boot_artifacts.root_image cannot be used with targets.lxd.vm.encryption, targets.lxd.vm.lvm, targets.lxd.vm.verity or a swap partition",
+			true,
+		},
+		{
+			"valid rootfs_overlays",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				RootfsOverlays: []DefinitionRootfsOverlay{
+					{Source: "/srv/payload", Path: "/opt/payload", Trigger: "post-files", UID: "1000", GID: "1000", Conflict: "keep", DefinitionFilter: DefinitionFilter{Types: []DefinitionFilterType{"vm"}}},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"rootfs_overlays with relative source",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				RootfsOverlays: []DefinitionRootfsOverlay{
+					{Source: "payload"},
+				},
+			},
+			"rootfs_overlays\\[0\\].source must be an absolute path",
+			true,
+		},
+		{
+			"rootfs_overlays with types on post-unpack",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				RootfsOverlays: []DefinitionRootfsOverlay{
+					{Source: "/srv/payload", DefinitionFilter: DefinitionFilter{Types: []DefinitionFilterType{"vm"}}},
+				},
+			},
+			`rootfs_overlays\[0\].types requires trigger "post-files"`,
+			true,
+		},
+		{
+			"rootfs_overlays with invalid conflict",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				RootfsOverlays: []DefinitionRootfsOverlay{
+					{Source: "/srv/payload", Conflict: "merge"},
+				},
+			},
+			`rootfs_overlays\[0\].conflict must be one of \[error keep overwrite\]`,
+			true,
+		},
+		{
+			"rootfs_overlays with invalid uid",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				RootfsOverlays: []DefinitionRootfsOverlay{
+					{Source: "/srv/payload", UID: "root"},
+				},
+			},
+			`Invalid rootfs_overlays\[0\].uid "root"`,
+			true,
+		},
+		{
+			"invalid image.init",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Init:         "upstart",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+			},
+			`image.init must be one of \[openrc runit systemd sysvinit\]`,
+			true,
+		},
+		{
+			"valid users generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "users",
+						Users:     []DefinitionFileUser{{Name: "admin", Groups: []string{"sudo"}, Sudo: true, Password: "$6$salt$hash", SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA admin@example"}}},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"users generator without users",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "users",
+						Users:     nil,
+					},
+				},
+			},
+			`files\[0\]: generator "users" requires users`,
+			true,
+		},
+		{
+			"invalid files.*.users.*.name",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "users",
+						Users:     []DefinitionFileUser{{Name: "Admin"}},
+					},
+				},
+			},
+			`Invalid files\[0\].users\[0\].name "Admin"`,
+			true,
+		},
+		{
+			"plain text files.*.users.*.password",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "users",
+						Users:     []DefinitionFileUser{{Name: "admin", Password: "secret"}},
+					},
+				},
+			},
+			`files\[0\].users\[0\].password must be a crypt\(3\) hash`,
+			true,
+		},
+		{
+			"valid network generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "network",
+						Network:   &DefinitionFileNetwork{Method: "static", Addresses: []string{"192.0.2.10/24"}, Gateways: []string{"192.0.2.1"}, Nameservers: []string{"192.0.2.53"}},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"network generator without addresses",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "network",
+						Network:   &DefinitionFileNetwork{Method: "static"},
+					},
+				},
+			},
+			`files.\*.network.method "static" requires addresses`,
+			true,
+		},
+		{
+			"invalid files.*.network.addresses",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "network",
+						Network:   &DefinitionFileNetwork{Method: "static", Addresses: []string{"192.0.2.10"}},
+					},
+				},
+			},
+			`Invalid files.\*.network.addresses address "192.0.2.10"`,
+			true,
+		},
+		{
+			"invalid files.*.network.backend",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "network",
+						Network:   &DefinitionFileNetwork{Backend: "wicked"},
+					},
+				},
+			},
+			`files.\*.network.backend must be one of \[ifupdown netplan networkd\]`,
+			true,
+		},
+		{
+			"valid locale generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "locale",
+						Locale:    &DefinitionFileLocale{Lang: "en_US.UTF-8", Generate: []string{"de_DE@euro", "C.UTF-8"}, Timezone: "America/Argentina/Buenos_Aires"},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"locale generator without locale",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "locale",
+					},
+				},
+			},
+			"files.\\*.locale requires a lang, locales to generate or a timezone",
+			true,
+		},
+		{
+			"invalid files.*.locale.lang",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "locale",
+						Locale:    &DefinitionFileLocale{Lang: "en_US.UTF-8 UTF-8"},
+					},
+				},
+			},
+			`Invalid files.\*.locale.lang "en_US.UTF-8 UTF-8"`,
+			true,
+		},
+		{
+			"invalid files.*.locale.timezone",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "locale",
+						Locale:    &DefinitionFileLocale{Timezone: "../../etc/shadow"},
+					},
+				},
+			},
+			`Invalid files.\*.locale.timezone "../../etc/shadow"`,
+			true,
+		},
+		{
+			"valid environment generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:   "environment",
+						Environment: &DefinitionFileEnvironment{Variables: map[string]string{"http_proxy": "http://proxy.example.com:3128"}, Path: []string{"/opt/bin"}},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"environment generator without environment",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "environment",
+					},
+				},
+			},
+			"files.\\*.environment requires variables or a path",
+			true,
+		},
+		{
+			"files.*.environment.variables with PATH",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:   "environment",
+						Environment: &DefinitionFileEnvironment{Variables: map[string]string{"PATH": "/opt/bin"}},
+					},
+				},
+			},
+			"files.\\*.environment.variables cannot set PATH",
+			true,
+		},
+		{
+			"invalid files.*.environment.variables value",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:   "environment",
+						Environment: &DefinitionFileEnvironment{Variables: map[string]string{"MOTD": "say \"hi\""}},
+					},
+				},
+			},
+			`Invalid files.\*.environment.variables value of "MOTD"`,
+			true,
+		},
+		{
+			"relative files.*.environment.path",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:   "environment",
+						Environment: &DefinitionFileEnvironment{Path: []string{"bin"}},
+					},
+				},
+			},
+			`files.\*.environment.path "bin" must be an absolute path`,
+			true,
+		},
+		{
+			"valid sysctl generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "sysctl",
+						Sysctl:    map[string]string{"net.ipv4.ip_forward": "1", "net/ipv4/conf/eth0/rp_filter": "2"},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"sysctl generator without kernel parameters",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "sysctl",
+					},
+				},
+			},
+			"files.\\*.sysctl requires kernel parameters",
+			true,
+		},
+		{
+			"invalid files.*.sysctl key",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "sysctl",
+						Sysctl:    map[string]string{"swappiness": "10"},
+					},
+				},
+			},
+			`Invalid files.\*.sysctl key "swappiness"`,
+			true,
+		},
+		{
+			"invalid files.*.sysctl value",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "sysctl",
+						Sysctl:    map[string]string{"vm.swappiness": "10\nkernel.panic = 1"},
+					},
+				},
+			},
+			`Invalid files.\*.sysctl value of "vm.swappiness"`,
+			true,
+		},
+		{
+			"valid systemd-unit generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:   "systemd-unit",
+						Name:        "app.service",
+						Content:     "[Service]\nExecStart=/usr/bin/app\n",
+						SystemdUnit: &DefinitionFileSystemdUnit{DropIn: "override.conf", State: "enabled"},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid files.*.name of systemd-unit generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:   "systemd-unit",
+						Name:        "../app.service",
+						SystemdUnit: &DefinitionFileSystemdUnit{State: "enabled"},
+					},
+				},
+			},
+			`Invalid files.\*.name "../app.service", must be the name of a systemd unit`,
+			true,
+		},
+		{
+			"files.*.systemd_unit.drop_in without content",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:   "systemd-unit",
+						Name:        "app.service",
+						SystemdUnit: &DefinitionFileSystemdUnit{DropIn: "override.conf"},
+					},
+				},
+			},
+			`files.\*.systemd_unit.drop_in requires content`,
+			true,
+		},
+		{
+			"invalid files.*.systemd_unit.state",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:   "systemd-unit",
+						Name:        "app.service",
+						SystemdUnit: &DefinitionFileSystemdUnit{State: "started"},
+					},
+				},
+			},
+			`files.\*.systemd_unit.state must be one of .+`,
+			true,
+		},
+		{
+			"masked files.*.systemd_unit.state with content",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:   "systemd-unit",
+						Name:        "app.service",
+						Content:     "[Service]\nExecStart=/usr/bin/app\n",
+						SystemdUnit: &DefinitionFileSystemdUnit{State: "masked"},
+					},
+				},
+			},
+			`files.\*.systemd_unit.state "masked" cannot be used with content`,
+			true,
+		},
+		{
+			"valid ca-certificates generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "ca-certificates",
+						Name:      "corp-root",
+						Source:    "/etc/ssl/corp-root.pem",
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid files.*.name of ca-certificates generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "ca-certificates",
+						Name:      "../corp",
+						Source:    "/etc/ssl/corp-root.pem",
+					},
+				},
+			},
+			`Invalid files.\*.name "../corp", must be a file name`,
+			true,
+		},
+		{
+			"ca-certificates generator without certificates",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "ca-certificates",
+						Name:      "corp-root",
+					},
+				},
+			},
+			`files.\*.name requires content or files.\*.source`,
+			true,
+		},
+		{
+			"ca-certificates generator with content and source",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "ca-certificates",
+						Name:      "corp-root",
+						Content:   "-----BEGIN CERTIFICATE-----",
+						Source:    "/etc/ssl/corp-root.pem",
+					},
+				},
+			},
+			`files.\*.content cannot be used with files.\*.source`,
+			true,
+		},
+		{
+			"invalid files.*.content of ca-certificates generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "ca-certificates",
+						Name:      "corp-root",
+						Content:   "not a certificate",
+					},
+				},
+			},
+			`Invalid files.\*.content of "corp-root": No PEM encoded certificate found`,
+			true,
+		},
+		{
+			"valid repositories generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:    "repositories",
+						Repositories: []DefinitionPackagesRepository{{Name: "ubuntu", URL: "deb http://archive.ubuntu.com/ubuntu noble main", Key: "-----BEGIN PGP PUBLIC KEY BLOCK-----\n..."}},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid packages.manager of repositories generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "pacman",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:    "repositories",
+						Repositories: []DefinitionPackagesRepository{{Name: "core", URL: "Server = https://mirror.example.com/$repo/os/$arch"}},
+					},
+				},
+			},
+			`files.\*.repositories requires packages.manager to be one of \[apk apt dnf yum zypper\]`,
+			true,
+		},
+		{
+			"invalid files.*.repositories.*.name of repositories generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:    "repositories",
+						Repositories: []DefinitionPackagesRepository{{Name: "../ubuntu", URL: "deb http://archive.ubuntu.com/ubuntu noble main"}},
+					},
+				},
+			},
+			`Invalid files.\*.repositories.\*.name "../ubuntu", must be a file name`,
+			true,
+		},
+		{
+			"duplicate files.*.repositories.*.name of repositories generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:    "repositories",
+						Repositories: []DefinitionPackagesRepository{{Name: "ubuntu", URL: "deb http://archive.ubuntu.com/ubuntu noble main"}, {Name: "ubuntu", URL: "deb http://archive.ubuntu.com/ubuntu noble universe"}},
+					},
+				},
+			},
+			`Duplicate files.\*.repositories.\*.name "ubuntu"`,
+			true,
+		},
+		{
+			"missing files.*.repositories.*.url of repositories generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:    "repositories",
+						Repositories: []DefinitionPackagesRepository{{Name: "ubuntu"}},
+					},
+				},
+			},
+			`files.\*.repositories.\*.url of "ubuntu" is required`,
+			true,
+		},
+		{
+			"invalid files.*.repositories.*.key of repositories generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:    "repositories",
+						Repositories: []DefinitionPackagesRepository{{Name: "ubuntu", URL: "deb http://archive.ubuntu.com/ubuntu noble main", Key: "0x871920D1991BC93C"}},
+					},
+				},
+			},
+			`files.\*.repositories.\*.key of "ubuntu" must be an armored public key`,
+			true,
+		},
+		{
+			"valid proxy generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "proxy",
+						Proxy:     &DefinitionFileProxy{HTTP: "http://proxy.example.com:3128", NoProxy: []string{"localhost", ".example.com"}},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"missing files.*.proxy of proxy generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "proxy",
+					},
+				},
+			},
+			`files.\*.proxy requires http or https`,
+			true,
+		},
+		{
+			"invalid files.*.proxy.https of proxy generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "proxy",
+						Proxy:     &DefinitionFileProxy{HTTPS: "proxy.example.com:3128"},
+					},
+				},
+			},
+			`Invalid files.\*.proxy.https "proxy.example.com:3128"`,
+			true,
+		},
+		{
+			"invalid files.*.proxy.no_proxy of proxy generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "proxy",
+						Proxy:     &DefinitionFileProxy{HTTP: "http://proxy.example.com:3128", NoProxy: []string{"localhost,127.0.0.1"}},
+					},
+				},
+			},
+			`Invalid files.\*.proxy.no_proxy "localhost,127.0.0.1"`,
+			true,
+		},
+		{
+			"valid branding generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "branding",
+						Branding:  &DefinitionFileBranding{Issue: "Corp Linux", OSRelease: map[string]string{"PRETTY_NAME": "Corp Linux"}},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"missing files.*.branding of branding generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "branding",
+					},
+				},
+			},
+			`files.\*.branding requires motd, motd_scripts, issue or os_release`,
+			true,
+		},
+		{
+			"invalid files.*.branding.motd_scripts name of branding generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "branding",
+						Branding:  &DefinitionFileBranding{MOTDScripts: map[string]string{"10-corp.sh": "#!/bin/sh\necho hi"}},
+					},
+				},
+			},
+			`Invalid files.\*.branding.motd_scripts name "10-corp.sh"`,
+			true,
+		},
+		{
+			"missing shebang in files.*.branding.motd_scripts of branding generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "branding",
+						Branding:  &DefinitionFileBranding{MOTDScripts: map[string]string{"10-corp": "echo hi"}},
+					},
+				},
+			},
+			`files.\*.branding.motd_scripts "10-corp" must start with a shebang`,
+			true,
+		},
+		{
+			"invalid files.*.branding.os_release value of branding generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "branding",
+						Branding:  &DefinitionFileBranding{OSRelease: map[string]string{"PRETTY_NAME": "Corp \"Linux\""}},
+					},
+				},
+			},
+			`Invalid files.\*.branding.os_release value of "PRETTY_NAME"`,
+			true,
+		},
+		{
+			"valid requires.lxd-imagebuilder",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Requires: DefinitionRequires{
+					LXDImageBuilder: ">=3.0, <4",
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"unmet requires.lxd-imagebuilder",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Requires: DefinitionRequires{
+					LXDImageBuilder: ">=99.1",
+				},
+			},
+			`The definition requires lxd-imagebuilder >=99.1, but this is lxd-imagebuilder 3.0`,
+			true,
+		},
+		{
+			"invalid requires.lxd-imagebuilder",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Requires: DefinitionRequires{
+					LXDImageBuilder: "~3.0",
+				},
+			},
+			`Invalid requires.lxd-imagebuilder "~3.0"`,
+			true,
+		},
+		{
+			"valid kernel-modules generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:     "kernel-modules",
+						KernelModules: &DefinitionFileKernelModules{Load: []string{"virtio_net"}, Blacklist: []string{"floppy"}, Options: map[string]string{"kvm_intel": "nested=1"}},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"missing files.*.kernel_modules of kernel-modules generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "kernel-modules",
+					},
+				},
+			},
+			`files.\*.kernel_modules requires load, blacklist, options or initramfs`,
+			true,
+		},
+		{
+			"invalid files.*.kernel_modules.blacklist module of kernel-modules generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:     "kernel-modules",
+						KernelModules: &DefinitionFileKernelModules{Blacklist: []string{"floppy.ko"}},
+					},
+				},
+			},
+			`Invalid files.\*.kernel_modules.blacklist module "floppy.ko"`,
+			true,
+		},
+		{
+			"invalid files.*.kernel_modules.options value of kernel-modules generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:     "kernel-modules",
+						KernelModules: &DefinitionFileKernelModules{Options: map[string]string{"kvm": " "}},
+					},
+				},
+			},
+			`Invalid files.\*.kernel_modules.options value of "kvm"`,
+			true,
+		},
+		{
+			"invalid files.*.name of kernel-modules generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator:     "kernel-modules",
+						Name:          "../modules",
+						KernelModules: &DefinitionFileKernelModules{Load: []string{"virtio_net"}},
+					},
+				},
+			},
+			`Invalid files.\*.name "../modules", must be a file name`,
+			true,
+		},
+		{
+			"valid resolv generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "resolv",
+						Resolv:    &DefinitionFileResolv{Mode: "static", Nameservers: []string{"192.0.2.53"}, Search: []string{"example.com"}, Options: []string{"edns0"}},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"missing files.*.resolv.mode of resolv generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "resolv",
+					},
+				},
+			},
+			`files.\*.resolv.mode must be one of \[runtime static stub\]`,
+			true,
+		},
+		{
+			"missing files.*.resolv.nameservers of static mode",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "resolv",
+						Resolv:    &DefinitionFileResolv{Mode: "static"},
+					},
+				},
+			},
+			`files.\*.resolv.mode "static" requires nameservers`,
+			true,
+		},
+		{
+			"invalid files.*.resolv.nameservers of resolv generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "resolv",
+						Resolv:    &DefinitionFileResolv{Mode: "stub", Nameservers: []string{"dns.example.com"}},
+					},
+				},
+			},
+			`Invalid files.\*.resolv.nameservers address "dns.example.com"`,
+			true,
+		},
+		{
+			"files.*.resolv.nameservers with runtime mode",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "resolv",
+						Resolv:    &DefinitionFileResolv{Mode: "runtime", Nameservers: []string{"192.0.2.53"}},
+					},
+				},
+			},
+			`files.\*.resolv.mode "runtime" doesn't take nameservers, search or options`,
+			true,
+		},
+		{
+			"valid swapfile generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						DefinitionFilter: DefinitionFilter{
+							Types: []DefinitionFilterType{DefinitionFilterTypeVM},
+						},
+						Generator: "swapfile",
+						Path:      "/var/swap",
+						Swapfile:  &DefinitionFileSwapfile{Size: 1073741824},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"files.*.swapfile.size not a multiple of 1MiB",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						DefinitionFilter: DefinitionFilter{
+							Types: []DefinitionFilterType{DefinitionFilterTypeVM},
+						},
+						Generator: "swapfile",
+						Swapfile:  &DefinitionFileSwapfile{Size: 1000},
+					},
+				},
+			},
+			`files.\*.swapfile.size must be a non-zero multiple of 1MiB`,
+			true,
+		},
+		{
+			"swapfile generator for containers",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "swapfile",
+						Swapfile:  &DefinitionFileSwapfile{Size: 1048576},
+					},
+				},
+			},
+			`files.\*.swapfile requires files.\*.types to be \[vm\], as containers can't have swap of their own`,
+			true,
+		},
+		{
+			"swapfile generator on btrfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "btrfs",
+						},
+					},
+				},
+				Files: []DefinitionFile{
+					{
+						DefinitionFilter: DefinitionFilter{
+							Types: []DefinitionFilterType{DefinitionFilterTypeVM},
+						},
+						Generator: "swapfile",
+						Swapfile:  &DefinitionFileSwapfile{Size: 1048576},
+					},
+				},
+			},
+			`files.\*.swapfile is not supported on btrfs, use targets.lxd.vm.swap with type "file" instead`,
+			true,
+		},
+		{
+			"swapfile generator with the swap file of targets.lxd.vm.swap",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Swap: &DefinitionTargetLXDVMSwap{Type: "file", Size: 1048576, Path: "/swapfile"},
+						},
+					},
+				},
+				Files: []DefinitionFile{
+					{
+						DefinitionFilter: DefinitionFilter{
+							Types: []DefinitionFilterType{DefinitionFilterTypeVM},
+						},
+						Generator: "swapfile",
+						Swapfile:  &DefinitionFileSwapfile{Size: 1048576},
+					},
+				},
+			},
+			`files.\*.path "/swapfile" is already the swap file of targets.lxd.vm.swap`,
+			true,
+		},
+		{
+			"valid selinux-relabel generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "selinux-relabel",
+						SELinux:   &DefinitionFileSELinux{Mode: "setfiles"},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid files.*.selinux.mode",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "selinux-relabel",
+						SELinux:   &DefinitionFileSELinux{Mode: "restorecon"},
+					},
+				},
+			},
+			`files.\*.selinux.mode must be one of \[auto autorelabel setfiles\]`,
+			true,
+		},
+		{
+			"valid targets.lxd.vm.hardware",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Hardware: &DefinitionTargetLXDVMHardware{Microcode: true, Firmware: []string{"i915/*", "rtl_nic"}},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"targets.lxd.vm.hardware.microcode with unsupported manager",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "portage",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Hardware: &DefinitionTargetLXDVMHardware{Microcode: true},
+						},
+					},
+				},
+			},
+			`targets.lxd.vm.hardware.microcode isn't supported by package manager "portage", must be one of \[apk apt dnf pacman xbps yum zypper\]`,
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.hardware.firmware",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Hardware: &DefinitionTargetLXDVMHardware{Firmware: []string{"../modules"}},
+						},
+					},
+				},
+			},
+			`Invalid targets.lxd.vm.hardware.firmware "../modules", must be a path relative to /lib/firmware`,
+			true,
+		},
+		{
+			"valid tmpfiles generator",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "tmpfiles",
+						Tmpfiles:  []string{"d /var/lib/foo 0750 foo foo", "L+ /etc/foo.conf - - - - /usr/share/foo/foo.conf", "c /dev/net/tun 0666 - - - 10:200"},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"tmpfiles generator with age",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "tmpfiles",
+						Tmpfiles:  []string{"d /var/tmp/foo 1777 root root 10d"},
+					},
+				},
+			},
+			`Invalid files.\*.tmpfiles entry "d /var/tmp/foo 1777 root root 10d": Ages aren't supported`,
+			true,
+		},
+		{
+			"tmpfiles generator with invalid device",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "tmpfiles",
+						Tmpfiles:  []string{"c /dev/kmsg 0600 - - - 1"},
+					},
+				},
+			},
+			`Invalid files.\*.tmpfiles entry "c /dev/kmsg 0600 - - - 1": Invalid device "1", must be <major>:<minor>`,
+			true,
+		},
+		{
+			"tmpfiles generator with invalid type",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "tmpfiles",
+						Tmpfiles:  []string{"x /var/lib/foo"},
+					},
+				},
+			},
+			`Invalid type "x", must be one of \[b c d f L\]`,
+			true,
+		},
+		{
+			"valid targets.lxd.vm.btrfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "btrfs",
+							Btrfs: &DefinitionTargetLXDVMBtrfs{
+								Subvolumes: []DefinitionTargetLXDVMBtrfsSubvolume{
+									{Name: "@", Mountpoint: "/", Options: []string{"compress=zstd"}},
+									{Name: "@home", Mountpoint: "/home"},
+									{Name: "@snapshots"},
+								},
+							},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"targets.lxd.vm.btrfs without btrfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "ext4",
+							Btrfs: &DefinitionTargetLXDVMBtrfs{
+								Subvolumes: []DefinitionTargetLXDVMBtrfsSubvolume{
+									{Name: "@", Mountpoint: "/"},
+								},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.btrfs requires targets.lxd.vm.filesystem to be btrfs",
+			true,
+		},
+		{
+			"missing root subvolume in targets.lxd.vm.btrfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "btrfs",
+							Btrfs: &DefinitionTargetLXDVMBtrfs{
+								Subvolumes: []DefinitionTargetLXDVMBtrfsSubvolume{
+									{Name: "@home", Mountpoint: "/home"},
+								},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.btrfs.subvolumes requires a subvolume mounted at /",
+			true,
+		},
+		{
+			"duplicate targets.lxd.vm.btrfs.subvolumes.*.mountpoint",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "btrfs",
+							Btrfs: &DefinitionTargetLXDVMBtrfs{
+								Subvolumes: []DefinitionTargetLXDVMBtrfsSubvolume{
+									{Name: "@", Mountpoint: "/"},
+									{Name: "@root", Mountpoint: "/"},
+								},
+							},
+						},
+					},
+				},
+			},
+			"Duplicate targets.lxd.vm.btrfs.subvolumes.\\*.mountpoint \"/\"",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.btrfs.subvolumes.*.options",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "btrfs",
+							Btrfs: &DefinitionTargetLXDVMBtrfs{
+								Subvolumes: []DefinitionTargetLXDVMBtrfsSubvolume{
+									{Name: "@", Mountpoint: "/", Options: []string{"subvol=@other"}},
+								},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.btrfs.subvolumes.\\*.options may not contain subvol or subvolid",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.btrfs.mount_options",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "btrfs",
+							Btrfs: &DefinitionTargetLXDVMBtrfs{
+								Subvolumes: []DefinitionTargetLXDVMBtrfsSubvolume{
+									{Name: "@", Mountpoint: "/"},
+								},
+								MountOptions: []string{"compress=zstd:3", "subvolid=5"},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.btrfs.mount_options may not contain subvol or subvolid",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.btrfs.mkfs_options",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "btrfs",
+							Btrfs: &DefinitionTargetLXDVMBtrfs{
+								Subvolumes: []DefinitionTargetLXDVMBtrfsSubvolume{
+									{Name: "@", Mountpoint: "/"},
+								},
+								MkfsOptions: []string{"--label=root"},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.btrfs.mkfs_options may not set the label",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.filesystem_options",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "ext4",
+							FilesystemOptions: map[string]string{
+								"inode_ratio":     "16384",
+								"features":        "^64bit,casefold",
+								"reserved_blocks": "0.5",
+							},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"targets.lxd.vm.filesystem_options on btrfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "btrfs",
+							FilesystemOptions: map[string]string{
+								"inode_ratio": "16384",
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.filesystem_options is not supported for \"btrfs\"",
+			true,
+		},
+		{
+			"unknown targets.lxd.vm.filesystem_options key",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "ext4",
+							FilesystemOptions: map[string]string{
+								"journal": "false",
+							},
+						},
+					},
+				},
+			},
+			"Unknown targets.lxd.vm.filesystem_options key \"journal\"",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.filesystem_options.block_size",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "ext4",
+							FilesystemOptions: map[string]string{
+								"block_size": "512",
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.filesystem_options.block_size must be one of",
+			true,
+		},
+		{
+			"targets.lxd.vm.filesystem_options with inode_count and inode_ratio",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "ext4",
+							FilesystemOptions: map[string]string{
+								"inode_count": "1000",
+								"inode_ratio": "16384",
+							},
+						},
+					},
+				},
+			},
+			"cannot have both inode_count and inode_ratio set",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.size_headroom",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Size:         DefinitionTargetLXDVMSize{Auto: true},
+							SizeHeadroom: 50,
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"targets.lxd.vm.size_headroom without targets.lxd.vm.size auto",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Size:         DefinitionTargetLXDVMSize{Bytes: 4294967296},
+							SizeHeadroom: 50,
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.size_headroom requires targets.lxd.vm.size to be \"auto\"",
+			true,
+		},
+		{
+			"invalid targets.lxd.vm.size_headroom",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Size:         DefinitionTargetLXDVMSize{Auto: true},
+							SizeHeadroom: 1001,
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.size_headroom must be at most 1000",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.shrink",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Shrink: "minimal",
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid targets.lxd.vm.shrink",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Shrink: "zerofree",
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.shrink must be one of \\[none trim minimal\\]",
+			true,
+		},
+		{
+			"minimal targets.lxd.vm.shrink with btrfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "btrfs",
+							Shrink:     "minimal",
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.shrink \"minimal\" is not supported for \"btrfs\"",
+			true,
+		},
+		{
+			"minimal targets.lxd.vm.shrink with swap partition",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Shrink: "minimal",
+							Swap: &DefinitionTargetLXDVMSwap{
+								Type: "partition",
+								Size: 1048576,
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.shrink \"minimal\" cannot be used with a swap partition",
+			true,
+		},
+		{
+			"empty flavor name",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Flavors: []DefinitionFlavor{
+					{
+						Variant: "cloud",
+					},
+				},
+			},
+			"flavors.*.name may not be empty",
+			true,
+		},
+		{
+			"duplicate flavor name",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Flavors: []DefinitionFlavor{
+					{
+						Name: "cloud",
+					},
+					{
+						Name: "cloud",
+					},
+				},
+			},
+			"Duplicate flavors\\.\\*\\.name \"cloud\"",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.grow_root",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Filesystem: "btrfs",
+							GrowRoot:   true,
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"targets.lxd.vm.grow_root with swap partition",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							GrowRoot: true,
+							Swap: &DefinitionTargetLXDVMSwap{
+								Type: "partition",
+								Size: 1048576,
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.grow_root cannot be used with a swap partition",
+			true,
+		},
+		{
+			"targets.lxd.vm.grow_root with lvm",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							GrowRoot: true,
+							LVM:      &DefinitionTargetLXDVMLVM{},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.grow_root cannot be used with targets.lxd.vm.encryption or targets.lxd.vm.lvm",
+			true,
+		},
+		{
+			"valid targets.lxd.vm.bootloader",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Bootloader: &DefinitionTargetLXDVMBootloader{
+								Type:  "grub",
+								UBoot: &DefinitionTargetLXDVMUBoot{Path: "/usr/lib/u-boot/u-boot.itb", Offset: 32768},
+							},
+						},
+					},
+				},
+			},
+			"",
+			false,
+		},
+		{
+			"invalid targets.lxd.vm.bootloader.type",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Bootloader: &DefinitionTargetLXDVMBootloader{
+								Type: "lilo",
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.bootloader.type must be one of \\[grub systemd-boot uki\\]",
+			true,
+		},
+		{
+			"targets.lxd.vm.bootloader.secure_boot with systemd-boot",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Bootloader: &DefinitionTargetLXDVMBootloader{
+								Type:       "systemd-boot",
+								SecureBoot: true,
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.bootloader.secure_boot requires targets.lxd.vm.bootloader.type to be grub",
+			true,
+		},
+		{
+			"targets.lxd.vm.bootloader.u_boot.offset inside the partition table",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Bootloader: &DefinitionTargetLXDVMBootloader{
+								UBoot: &DefinitionTargetLXDVMUBoot{Path: "/usr/lib/u-boot/u-boot-sunxi-with-spl.bin", Offset: 8192},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.bootloader.u_boot.offset must be a multiple of 512 between 17408 and 1048576",
+			true,
+		},
+		{
+			"targets.lxd.vm.bootloader.u_boot.path outside of the rootfs",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					LXD: DefinitionTargetLXD{
+						VM: DefinitionTargetLXDVM{
+							Bootloader: &DefinitionTargetLXDVMBootloader{
+								UBoot: &DefinitionTargetLXDVMUBoot{Path: "/../../../root/.ssh/id_rsa", Offset: 32768},
+							},
+						},
+					},
+				},
+			},
+			"targets.lxd.vm.bootloader.u_boot.path must be an absolute path inside of the rootfs",
+			true,
+		},
+		{
+			"invalid targets.wsl.default_user",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					WSL: DefinitionTargetWSL{
+						DefaultUser: "Ubuntu User",
+					},
+				},
+			},
+			"Invalid targets.wsl.default_user \"Ubuntu User\"",
+			true,
+		},
+		{
+			"relative targets.wsl.icon",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					WSL: DefinitionTargetWSL{
+						Icon: "usr/share/wsl/ubuntu.ico",
+					},
+				},
+			},
+			"targets.wsl.icon must be an absolute path",
+			true,
+		},
+		{
+			"targets.wsl.appx.publisher without CN",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					WSL: DefinitionTargetWSL{
+						Appx: &DefinitionTargetWSLAppx{
+							Name:      "Ubuntu",
+							Publisher: "Canonical",
+						},
+					},
+				},
+			},
+			"targets.wsl.appx.publisher must be a distinguished name starting with CN=",
+			true,
+		},
+		{
+			"invalid targets.wsl.appx.version",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					WSL: DefinitionTargetWSL{
+						Appx: &DefinitionTargetWSLAppx{
+							Name:      "Ubuntu",
+							Publisher: "CN=Canonical",
+							Version:   "24.04",
+						},
+					},
+				},
+			},
+			"Invalid targets.wsl.appx.version \"24.04\", must be of the form major.minor.build.revision",
+			true,
+		},
+		{
+			"invalid targets.sysext.format",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Sysext: DefinitionTargetSysext{
+						Format: "ext4",
+					},
+				},
+			},
+			"targets.sysext.format must be one of \\[erofs squashfs\\]",
+			true,
+		},
+		{
+			"targets.sysext.paths outside of /usr",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Sysext: DefinitionTargetSysext{
+						Paths: []string{"/usr/bin/htop", "/etc/htoprc"},
+					},
+				},
+			},
+			"targets.sysext.paths \"/etc/htoprc\" must be located in one of \\[/usr /opt\\]",
+			true,
+		},
+		{
+			"targets.sysext.paths outside of /etc",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Targets: DefinitionTarget{
+					Sysext: DefinitionTargetSysext{
+						Type:  "confext",
+						Paths: []string{"/usr/lib/htop"},
+					},
+				},
+			},
+			"targets.sysext.paths \"/usr/lib/htop\" must be located in one of \\[/etc\\]",
+			true,
+		},
+		{
+			"duplicate actions.*.name",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Actions: []DefinitionAction{
+					{Trigger: "post-files", Name: "cleanup"},
+					{Trigger: "post-packages", Name: "cleanup"},
+				},
+			},
+			"Duplicate actions.\\*.name \"cleanup\"",
+			true,
+		},
+		{
+			"invalid actions.*.retry_delay",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Actions: []DefinitionAction{
+					{Trigger: "post-files", Name: "update-ca-trust", Retries: 3, RetryDelay: "5"},
+				},
+			},
+			"Invalid retry_delay \"5\" of action \"update-ca-trust\"",
+			true,
+		},
+	}
+
+	for i, tt := range tests {
+		log.Printf("Running test #%d: %s", i, tt.name)
+		tt.definition.SetDefaults()
+		err := tt.definition.Validate()
+		if tt.shouldFail {
+			require.Regexp(t, tt.expected, err)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestDefinitionTargetLXDVMPartition(t *testing.T) {
+	partition := DefinitionTargetLXDVMPartition{Type: "root-arm64", Attributes: []string{"no-auto", "read-only", "1"}}
+	require.Equal(t, "B921B045-1DF0-41C3-AF44-4C6F280D3FAE", partition.GetType())
+	require.Equal(t, uint64(1<<63|1<<60|1<<1), partition.GetAttributes())
+
+	partition = DefinitionTargetLXDVMPartition{Type: "0fc63daf-8483-4772-8e79-3d69d8477de4"}
+	require.Equal(t, "0FC63DAF-8483-4772-8E79-3D69D8477DE4", partition.GetType())
+	require.Equal(t, uint64(0), partition.GetAttributes())
+}
+
+func TestDefinitionApplyFlavor(t *testing.T) {
+	d := Definition{
+		Image: DefinitionImage{
+			Distribution: "ubuntu",
+			Release:      "noble",
+			Variant:      "default",
+		},
+		Packages: DefinitionPackages{
+			Manager: "apt",
+			Sets: []DefinitionPackagesSet{
+				{
+					Packages: []string{"openssh-server"},
+					Action:   "install",
+				},
+			},
+		},
+		Flavors: []DefinitionFlavor{
+			{
+				Name:    "cloud",
+				Variant: "cloud",
+				Packages: []DefinitionPackagesSet{
+					{
+						Packages: []string{"cloud-init"},
+						Action:   "install",
+					},
+				},
+				Files: []DefinitionFile{
+					{
+						Generator: "cloud-init",
+						Name:      "user-data",
+					},
+				},
+			},
+			{
+				Name: "minimal",
+			},
+		},
+	}
+
+	minimal := d
+	err := minimal.ApplyFlavor("minimal")
+	require.NoError(t, err)
+	require.Equal(t, "default", minimal.Image.Variant)
+	require.Len(t, minimal.Packages.Sets, 1)
+
+	err = d.ApplyFlavor("cloud")
+	require.NoError(t, err)
+	require.Equal(t, "cloud", d.Image.Variant)
+	require.Equal(t, []string{"cloud-init"}, d.Packages.Sets[1].Packages)
+	require.Equal(t, "cloud-init", d.Files[0].Generator)
+
+	err = d.ApplyFlavor("desktop")
+	require.EqualError(t, err, `Unknown flavor "desktop", must be one of [cloud minimal]`)
+}
+
+func TestDefinitionIDs(t *testing.T) {
+	d := Definition{
+		Files: []DefinitionFile{
+			{Generator: "hostname"},
+			{Generator: "hosts"},
+		},
+		Actions: []DefinitionAction{
+			{Trigger: "post-unpack"},
+			{Trigger: "post-files", Name: "update-ca-trust"},
+		},
+	}
+
+	d.SetDefaults()
+
+	require.Equal(t, "files[1]", d.Files[1].ID())
+	require.Equal(t, "actions[0]", d.Actions[0].ID())
+	require.Equal(t, "update-ca-trust", d.Actions[1].ID())
+
+	// The IDs are kept when filtering actions.
+	require.Equal(t, "update-ca-trust", d.GetRunnableActions("post-files", ImageTargetUndefined)[0].ID())
+}
+
+func TestDefinitionSetValue(t *testing.T) {
+	d := Definition{
+		Image: DefinitionImage{
+			Distribution: "ubuntu",
+			Release:      "artful",
+		},
+		Source: DefinitionSource{
+			Downloader:       "debootstrap",
+			URL:              "https://ubuntu.com",
+			Keys:             []string{"0xCODE"},
+			SkipVerification: true,
+		},
+		Packages: DefinitionPackages{
+			Manager: "apt",
+		},
+		Actions: []DefinitionAction{
+			{
+				Trigger: "post-update",
+				Action:  "/bin/true",
+			},
+			{
+				Trigger: "post-packages",
+				Action:  "/bin/false",
+			},
+		},
+	}
+
+	err := d.SetValue("image.release", "bionic")
+	require.NoError(t, err)
+	require.Equal(t, "bionic", d.Image.Release)
+
+	err = d.SetValue("actions.0.trigger", "post-files")
+	require.NoError(t, err)
+	require.Equal(t, "post-files", d.Actions[0].Trigger)
+
+	// Index out of bounds
+	err = d.SetValue("actions.3.trigger", "post-files")
+	require.EqualError(t, err, "Failed to get field by tag: Index out of range")
+
+	// Nonsense
+	err = d.SetValue("image", "[foo: bar]")
+	require.EqualError(t, err, "Unsupported type 'struct'")
+
+	err = d.SetValue("source.skip_verification", "true")
+	require.NoError(t, err)
+	require.Equal(t, true, d.Source.SkipVerification)
+
+	err = d.SetValue("targets.lxd.vm.size", "auto")
+	require.NoError(t, err)
+	require.Equal(t, DefinitionTargetLXDVMSize{Auto: true}, d.Targets.LXD.VM.Size)
+
+	err = d.SetValue("targets.lxd.vm.size", "8589934592")
+	require.NoError(t, err)
+	require.Equal(t, DefinitionTargetLXDVMSize{Bytes: 8589934592}, d.Targets.LXD.VM.Size)
+
+	err = d.SetValue("targets.lxd.vm.size", "8GiB")
+	require.EqualError(t, err, `Invalid size "8GiB", must be a number of bytes or "auto"`)
+}
+
+func TestDefinitionFilter(t *testing.T) {
+	input := `packages:
+  sets:
+  - packages:
+    - foo
+    architectures:
+    - amd64`
+	def := Definition{}
+
+	err := yaml.Unmarshal([]byte(input), &def)
+	require.NoError(t, err)
+
+	require.Contains(t, def.Packages.Sets[0].Packages, "foo")
+	require.Contains(t, def.Packages.Sets[0].Architectures, "amd64")
+}
+
+func TestApplyFilter(t *testing.T) {
+	repo := DefinitionPackagesRepository{}
+
+	// Variants
+	repo.Variants = []string{"default"}
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", 0))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "cloud", "vm", 0))
+
+	// Architectures
+	repo.Architectures = []string{"amd64", "i386"}
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", 0))
+	require.True(t, ApplyFilter(&repo, "foo", "i386", "default", "vm", 0))
+	require.False(t, ApplyFilter(&repo, "foo", "s390", "default", "vm", 0))
+
+	// Releases
+	repo.Releases = []string{"foo"}
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", 0))
+	require.False(t, ApplyFilter(&repo, "bar", "amd64", "default", "vm", 0))
+
+	// Targets
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", 0))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", 0))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetUndefined))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetUndefined))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetAll|ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer|ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetAll|ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer|ImageTargetVM))
+
+	repo.Types = []DefinitionFilterType{DefinitionFilterTypeVM}
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetVM))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetAll|ImageTargetVM))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer|ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetAll|ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer|ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", 0))
+
+	repo.Types = []DefinitionFilterType{DefinitionFilterTypeContainer}
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetAll|ImageTargetContainer))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer|ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetAll|ImageTargetContainer))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer|ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", 0))
+
+	repo.Types = []DefinitionFilterType{DefinitionFilterTypeContainer, DefinitionFilterTypeVM}
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetAll|ImageTargetContainer))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "container", ImageTargetContainer|ImageTargetVM))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetAll|ImageTargetContainer))
+	require.True(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer|ImageTargetVM))
+	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer))
+}
+
+func TestDefinitionTargetLXDVMSizeYAML(t *testing.T) {
+	var vm DefinitionTargetLXDVM
+
+	err := yaml.Unmarshal([]byte("size: 4294967296"), &vm)
+	require.NoError(t, err)
+	require.Equal(t, DefinitionTargetLXDVMSize{Bytes: 4294967296}, vm.Size)
+
+	err = yaml.Unmarshal([]byte("size: auto\nsize_headroom: 30"), &vm)
+	require.NoError(t, err)
+	require.Equal(t, DefinitionTargetLXDVMSize{Auto: true}, vm.Size)
+	require.Equal(t, uint64(30), vm.SizeHeadroom)
+
+	out, err := yaml.Marshal(vm)
+	require.NoError(t, err)
+	require.Equal(t, "size: auto\nsize_headroom: 30\n", string(out))
+
+	out, err = yaml.Marshal(DefinitionTargetLXDVM{Size: DefinitionTargetLXDVMSize{Bytes: 4294967296}})
+	require.NoError(t, err)
+	require.Equal(t, "size: 4294967296\n", string(out))
+
+	out, err = yaml.Marshal(DefinitionTargetLXDVM{})
+	require.NoError(t, err)
+	require.Equal(t, "{}\n", string(out))
+
+	err = yaml.Unmarshal([]byte("size: big"), &vm)
+	require.EqualError(t, err, `Invalid size "big", must be a number of bytes or "auto"`)
 }
 
 func TestDefinitionFilterTypeUnmarshalYAML(t *testing.T) {
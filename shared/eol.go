@@ -0,0 +1,39 @@
+package shared
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed eol.yaml
+var eolDatabase []byte
+
+// EOLDateLayout is the layout of end-of-life dates.
+const EOLDateLayout = "2006-01-02"
+
+// GetEOLDate returns the end-of-life date of the given release as found in the
+// embedded database. The returned bool is false if the release is unknown.
+func GetEOLDate(distribution, release string) (time.Time, bool, error) {
+	var db map[string]map[string]string
+
+	err := yaml.Unmarshal(eolDatabase, &db)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("Failed to unmarshal EOL database: %w", err)
+	}
+
+	date, ok := db[strings.ToLower(distribution)][release]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	eol, err := time.Parse(EOLDateLayout, date)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("Failed to parse EOL date %q: %w", date, err)
+	}
+
+	return eol, true, nil
+}
@@ -0,0 +1,30 @@
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetEOLDate(t *testing.T) {
+	eol, ok, err := GetEOLDate("Ubuntu", "bionic")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, time.Date(2023, 5, 31, 0, 0, 0, 0, time.UTC), eol)
+
+	_, ok, err = GetEOLDate("ubuntu", "unknown")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	image := DefinitionImage{
+		Distribution: "ubuntu",
+		Release:      "bionic",
+		EOL:          "2028-04-30",
+	}
+
+	eol, ok, err = image.GetEOLDate()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, time.Date(2028, 4, 30, 0, 0, 0, 0, time.UTC), eol)
+}
@@ -0,0 +1,66 @@
+package shared
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ActionTriggers are the triggers actions can be run at.
+var ActionTriggers = []string{
+	"post-files",
+	"post-packages",
+	"post-unpack",
+	"post-update",
+}
+
+// actionFaults maps triggers to the number of failing attempts of each of
+// their actions.
+var actionFaults = map[string]uint{}
+var actionFaultsLock sync.Mutex
+
+// SetActionFaults makes the given number of attempts of every action of a
+// trigger exit with an error instead of running the action, so the retries of
+// actions and the cleanup of failed builds can be tested.
+func SetActionFaults(faults map[string]uint) {
+	actionFaultsLock.Lock()
+	actionFaults = faults
+	actionFaultsLock.Unlock()
+}
+
+// ParseActionFault parses an action fault in the format
+// <trigger>[=<attempts>]. The number of failing attempts defaults to 1.
+func ParseActionFault(value string) (string, uint, error) {
+	trigger, attempts, found := strings.Cut(value, "=")
+
+	if !slices.Contains(ActionTriggers, trigger) {
+		return "", 0, fmt.Errorf("Invalid action fault %q, trigger must be one of %v", value, ActionTriggers)
+	}
+
+	if !found {
+		return trigger, 1, nil
+	}
+
+	n, err := strconv.ParseUint(attempts, 10, 32)
+	if err != nil || n == 0 {
+		return "", 0, fmt.Errorf("Invalid action fault %q, attempts must be a positive number", value)
+	}
+
+	return trigger, uint(n), nil
+}
+
+// actionScript returns the script run by the given attempt of the action,
+// which fails if a fault is injected into it.
+func actionScript(action DefinitionAction, attempt uint) string {
+	actionFaultsLock.Lock()
+	attempts := actionFaults[action.Trigger]
+	actionFaultsLock.Unlock()
+
+	if attempt > attempts {
+		return action.Action
+	}
+
+	return fmt.Sprintf("#!/bin/sh\necho 'Injected failure of %s' >&2\nexit 1\n", strings.ReplaceAll(action.ID(), "'", `'\''`))
+}
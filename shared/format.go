@@ -0,0 +1,34 @@
+package shared
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FormatDefinition returns the canonical form of the definition, which is
+// parsed into a Definition and written back. The keys are ordered as the
+// fields of the structs, with the filters last, optional fields left empty are
+// dropped, and mappings are indented by two spaces. Comments aren't kept. The
+// definition isn't validated, and no defaults are applied.
+func FormatDefinition(data []byte) ([]byte, error) {
+	// Definitions requiring a newer version have unknown fields.
+	err := CheckRequires(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var def Definition
+
+	err = yaml.UnmarshalStrict(data, &def)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse definition: %w", err)
+	}
+
+	out, err := yaml.Marshal(&def)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write definition: %w", err)
+	}
+
+	return out, nil
+}
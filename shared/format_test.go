@@ -0,0 +1,84 @@
+package shared
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatDefinition(t *testing.T) {
+	in := `# Comments are dropped.
+source:
+    url: http://archive.ubuntu.com/ubuntu
+    downloader: debootstrap
+image:
+    distribution: ubuntu
+    release: noble
+    description: Ubuntu
+files:
+    - variants: [default]
+      types: [vm]
+      generator: fstab
+    - generator: hostname
+      path: /etc/hostname
+      mode: ""
+packages:
+    sets:
+        - releases:
+              - noble
+          action: install
+          packages:
+              - vim
+    manager: apt
+`
+
+	out, err := FormatDefinition([]byte(in))
+	require.NoError(t, err)
+	require.Equal(t, `image:
+  description: Ubuntu
+  distribution: ubuntu
+  release: noble
+source:
+  downloader: debootstrap
+  url: http://archive.ubuntu.com/ubuntu
+files:
+- generator: fstab
+  variants:
+  - default
+  types:
+  - vm
+- generator: hostname
+  path: /etc/hostname
+packages:
+  manager: apt
+  sets:
+  - packages:
+    - vim
+    action: install
+    releases:
+    - noble
+`, string(out))
+
+	// The canonical form is stable.
+	again, err := FormatDefinition(out)
+	require.NoError(t, err)
+	require.Equal(t, string(out), string(again))
+
+	_, err = FormatDefinition([]byte("image:\n  distribution: ubuntu\n  unknown: true\n"))
+	require.ErrorContains(t, err, "Failed to parse definition")
+}
+
+func TestFormatDefinitionExamples(t *testing.T) {
+	for _, name := range []string{"ubuntu.yaml", "sabayon.yaml"} {
+		data, err := os.ReadFile("../doc/examples/" + name)
+		require.NoError(t, err)
+
+		out, err := FormatDefinition(data)
+		require.NoError(t, err, name)
+
+		again, err := FormatDefinition(out)
+		require.NoError(t, err, name)
+		require.Equal(t, string(out), string(again), name)
+	}
+}
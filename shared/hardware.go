@@ -0,0 +1,134 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// microcodePackages are the CPU microcode packages of the x86 architectures,
+// by package manager. AMD microcode is part of linux-firmware on dnf and yum
+// based distributions.
+var microcodePackages = map[string][]string{
+	"apk":    {"intel-ucode", "amd-ucode"},
+	"apt":    {"intel-microcode", "amd64-microcode"},
+	"dnf":    {"microcode_ctl", "linux-firmware"},
+	"pacman": {"intel-ucode", "amd-ucode"},
+	"xbps":   {"intel-ucode", "linux-firmware-amd"},
+	"yum":    {"microcode_ctl", "linux-firmware"},
+	"zypper": {"ucode-intel", "ucode-amd"},
+}
+
+// firmwarePackages are the device firmware packages, by package manager.
+// Distribution specific packages are keyed by "<manager>/<distribution>".
+var firmwarePackages = map[string][]string{
+	"apk":        {"linux-firmware"},
+	"apt":        {"linux-firmware"},
+	"apt/debian": {"firmware-linux"},
+	"dnf":        {"linux-firmware"},
+	"pacman":     {"linux-firmware"},
+	"xbps":       {"linux-firmware"},
+	"yum":        {"linux-firmware"},
+	"zypper":     {"kernel-firmware-all"},
+}
+
+// microcodeFirmwareDirs are the directories of /lib/firmware holding the CPU
+// microcode loaded by the kernel.
+var microcodeFirmwareDirs = []string{"amd-ucode", "intel-ucode"}
+
+// Packages returns the packages providing the microcode and the device
+// firmware. Microcode is only installed on x86.
+func (h *DefinitionTargetLXDVMHardware) Packages(manager string, distribution string, architecture string) []string {
+	var packages []string
+
+	if h.Microcode && slices.Contains([]string{"i686", "x86_64"}, architecture) {
+		packages = append(packages, microcodePackages[manager]...)
+	}
+
+	if len(h.Firmware) > 0 {
+		pkgs, ok := firmwarePackages[manager+"/"+strings.ToLower(distribution)]
+		if !ok {
+			pkgs = firmwarePackages[manager]
+		}
+
+		for _, pkg := range pkgs {
+			if !slices.Contains(packages, pkg) {
+				packages = append(packages, pkg)
+			}
+		}
+	}
+
+	return packages
+}
+
+// KeepFirmware returns whether the given file of /lib/firmware is kept. The
+// file is kept if one of the firmware patterns matches it or one of its
+// parent directories, ignoring its compression suffix. The microcode is kept
+// if it's installed.
+func (h *DefinitionTargetLXDVMHardware) KeepFirmware(name string) bool {
+	patterns := h.Firmware
+
+	if h.Microcode {
+		patterns = append(slices.Clip(patterns), microcodeFirmwareDirs...)
+	}
+
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".xz"), ".zst")
+
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			matched, _ := path.Match(strings.TrimSuffix(pattern, "/"), p)
+			if matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (h *DefinitionTargetLXDVMHardware) validate(manager string) error {
+	if h.Microcode {
+		_, ok := microcodePackages[manager]
+		if !ok {
+			return fmt.Errorf("targets.lxd.vm.hardware.microcode isn't supported by package manager %q, must be one of %v", manager, supportedManagers(microcodePackages))
+		}
+	}
+
+	if len(h.Firmware) > 0 {
+		_, ok := firmwarePackages[manager]
+		if !ok {
+			return fmt.Errorf("targets.lxd.vm.hardware.firmware isn't supported by package manager %q, must be one of %v", manager, supportedManagers(firmwarePackages))
+		}
+	}
+
+	for _, pattern := range h.Firmware {
+		if pattern == "" || strings.HasPrefix(pattern, "/") || slices.Contains(strings.Split(pattern, "/"), "..") {
+			return fmt.Errorf("Invalid targets.lxd.vm.hardware.firmware %q, must be a path relative to /lib/firmware", pattern)
+		}
+
+		_, err := path.Match(pattern, "")
+		if errors.Is(err, path.ErrBadPattern) {
+			return fmt.Errorf("Invalid targets.lxd.vm.hardware.firmware %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// supportedManagers returns the package managers of the given packages.
+func supportedManagers(packages map[string][]string) []string {
+	var managers []string
+
+	for key := range packages {
+		if !strings.Contains(key, "/") {
+			managers = append(managers, key)
+		}
+	}
+
+	sort.Strings(managers)
+
+	return managers
+}
@@ -0,0 +1,38 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefinitionTargetLXDVMHardwarePackages(t *testing.T) {
+	hardware := DefinitionTargetLXDVMHardware{Microcode: true}
+
+	require.Equal(t, []string{"intel-microcode", "amd64-microcode"}, hardware.Packages("apt", "ubuntu", "x86_64"))
+	require.Empty(t, hardware.Packages("apt", "ubuntu", "aarch64"))
+
+	hardware.Firmware = []string{"i915/*"}
+
+	require.Equal(t, []string{"intel-microcode", "amd64-microcode", "linux-firmware"}, hardware.Packages("apt", "ubuntu", "x86_64"))
+	require.Equal(t, []string{"intel-microcode", "amd64-microcode", "firmware-linux"}, hardware.Packages("apt", "debian", "x86_64"))
+	require.Equal(t, []string{"linux-firmware"}, hardware.Packages("apt", "ubuntu", "aarch64"))
+
+	// Packages aren't installed twice.
+	require.Equal(t, []string{"microcode_ctl", "linux-firmware"}, hardware.Packages("dnf", "fedora", "x86_64"))
+}
+
+func TestDefinitionTargetLXDVMHardwareKeepFirmware(t *testing.T) {
+	hardware := DefinitionTargetLXDVMHardware{Firmware: []string{"i915/tgl_*", "rtl_nic/", "iwlwifi-*.ucode"}}
+
+	require.True(t, hardware.KeepFirmware("i915/tgl_guc_70.bin"))
+	require.False(t, hardware.KeepFirmware("i915/adlp_dmc.bin"))
+	require.True(t, hardware.KeepFirmware("rtl_nic/rtl8168h-2.fw"))
+	require.True(t, hardware.KeepFirmware("iwlwifi-cc-a0-77.ucode.xz"))
+	require.False(t, hardware.KeepFirmware("intel-ucode/06-8c-01"))
+
+	hardware.Microcode = true
+
+	require.True(t, hardware.KeepFirmware("intel-ucode/06-8c-01"))
+	require.True(t, hardware.KeepFirmware("amd-ucode/microcode_amd_fam19h.bin"))
+}
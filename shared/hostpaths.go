@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"fmt"
+)
+
+// A DefinitionHostPath is a file or directory of the host running
+// lxd-imagebuilder, which the definition refers to.
+type DefinitionHostPath struct {
+	Key string
+
+	// Path points to the field of the definition, so it can be rewritten.
+	Path *string
+}
+
+// HostPaths returns the files and directories of the host the definition
+// refers to. Unset fields aren't included, and neither is a file:// source URL.
+func (d *Definition) HostPaths() []DefinitionHostPath {
+	var paths []DefinitionHostPath
+
+	add := func(key string, path *string) {
+		if *path != "" {
+			paths = append(paths, DefinitionHostPath{Key: key, Path: path})
+		}
+	}
+
+	for i := range d.Plugins {
+		add(fmt.Sprintf("plugins[%d].path", i), &d.Plugins[i].Path)
+	}
+
+	for i := range d.RootfsOverlays {
+		add(fmt.Sprintf("rootfs_overlays[%d].source", i), &d.RootfsOverlays[i].Source)
+	}
+
+	addFiles := func(prefix string, files []DefinitionFile) {
+		for i := range files {
+			if files[i].Generator == "copy" || files[i].Generator == "ca-certificates" {
+				add(fmt.Sprintf("%s[%d].source", prefix, i), &files[i].Source)
+			}
+		}
+	}
+
+	addFiles("files", d.Files)
+
+	for i := range d.Flavors {
+		addFiles(fmt.Sprintf("flavors[%d].files", i), d.Flavors[i].Files)
+	}
+
+	vm := &d.Targets.LXD.VM
+
+	if vm.Encryption != nil {
+		add("targets.lxd.vm.encryption.keyfile", &vm.Encryption.Keyfile)
+	}
+
+	if vm.Firmware != nil {
+		add("targets.lxd.vm.firmware.code", &vm.Firmware.Code)
+		add("targets.lxd.vm.firmware.vars", &vm.Firmware.Vars)
+	}
+
+	publish := d.Targets.LXD.Publish
+	if publish != nil {
+		add("targets.lxd.publish.client_cert", &publish.ClientCert)
+		add("targets.lxd.publish.client_key", &publish.ClientKey)
+		add("targets.lxd.publish.server_cert", &publish.ServerCert)
+	}
+
+	if d.Targets.Encrypt != nil {
+		add("targets.encrypt.passphrase_file", &d.Targets.Encrypt.PassphraseFile)
+	}
+
+	return paths
+}
@@ -0,0 +1,67 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// InitSystems are the init systems which are detected in the rootfs.
+var InitSystems = []string{"openrc", "runit", "systemd", "sysvinit"}
+
+// initSystemFiles are the files identifying an init system, in the order
+// they're checked. Distributions like Alpine Linux start OpenRC from the
+// inittab, so sysvinit comes last.
+var initSystemFiles = []struct {
+	init  string
+	files []string
+}{
+	{"systemd", []string{"usr/lib/systemd/systemd", "lib/systemd/systemd"}},
+	{"openrc", []string{"sbin/openrc", "usr/sbin/openrc", "sbin/openrc-run", "usr/sbin/openrc-run"}},
+	{"runit", []string{"sbin/runit", "usr/sbin/runit", "usr/bin/runit", "sbin/runit-init"}},
+	{"sysvinit", []string{"etc/inittab"}},
+}
+
+// DetectInitSystem returns the init system of the given rootfs, or an empty
+// string if none is found. The target of /sbin/init decides if it's a
+// symlink to one of them, as there may be several installed.
+func DetectInitSystem(rootfsDir string) string {
+	target, err := os.Readlink(filepath.Join(rootfsDir, "sbin", "init"))
+	if err == nil {
+		name := filepath.Base(target)
+
+		switch {
+		case strings.Contains(name, "systemd"):
+			return "systemd"
+		case strings.HasPrefix(name, "openrc"):
+			return "openrc"
+		case strings.HasPrefix(name, "runit"):
+			return "runit"
+		}
+	}
+
+	for _, init := range initSystemFiles {
+		for _, file := range init.files {
+			_, err := os.Lstat(filepath.Join(rootfsDir, file))
+			if err == nil {
+				return init.init
+			}
+		}
+	}
+
+	return ""
+}
+
+// DetectInit sets image.init to the init system of the given rootfs, unless
+// it's set in the definition. It returns whether the init system was
+// detected, and is run again once the packages have been installed.
+func (d *Definition) DetectInit(rootfsDir string) bool {
+	if d.Image.Init != "" && !d.Image.initDetected {
+		return false
+	}
+
+	d.Image.Init = DetectInitSystem(rootfsDir)
+	d.Image.initDetected = true
+
+	return true
+}
@@ -0,0 +1,79 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectInitSystem(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []string
+		init     string
+		expected string
+	}{
+		{"empty rootfs", nil, "", ""},
+		{"systemd", []string{"usr/lib/systemd/systemd", "etc/inittab"}, "", "systemd"},
+		{"openrc from inittab", []string{"sbin/openrc", "etc/inittab"}, "", "openrc"},
+		{"runit", []string{"usr/bin/runit"}, "", "runit"},
+		{"sysvinit", []string{"sbin/init", "etc/inittab"}, "", "sysvinit"},
+		{"init symlink", []string{"usr/lib/systemd/systemd", "sbin/openrc-init"}, "openrc-init", "openrc"},
+	}
+
+	for i, tt := range tests {
+		t.Logf("Running test #%d: %s", i, tt.name)
+
+		rootfsDir := t.TempDir()
+
+		for _, file := range tt.files {
+			path := filepath.Join(rootfsDir, file)
+
+			err := os.MkdirAll(filepath.Dir(path), 0755)
+			require.NoError(t, err)
+
+			err = os.WriteFile(path, nil, 0755)
+			require.NoError(t, err)
+		}
+
+		if tt.init != "" {
+			err := os.Symlink(tt.init, filepath.Join(rootfsDir, "sbin", "init"))
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, tt.expected, DetectInitSystem(rootfsDir))
+	}
+}
+
+func TestDefinitionDetectInit(t *testing.T) {
+	rootfsDir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(rootfsDir, "etc", "inittab"), nil, 0644)
+	require.NoError(t, err)
+
+	def := Definition{}
+
+	require.True(t, def.DetectInit(rootfsDir))
+	require.Equal(t, "sysvinit", def.Image.Init)
+
+	// The detected init system is updated.
+	err = os.MkdirAll(filepath.Join(rootfsDir, "lib", "systemd"), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(rootfsDir, "lib", "systemd", "systemd"), nil, 0755)
+	require.NoError(t, err)
+
+	require.True(t, def.DetectInit(rootfsDir))
+	require.Equal(t, "systemd", def.Image.Init)
+
+	// The init system of the definition is kept.
+	def = Definition{Image: DefinitionImage{Init: "openrc"}}
+
+	require.False(t, def.DetectInit(rootfsDir))
+	require.Equal(t, "openrc", def.Image.Init)
+}
@@ -6,9 +6,12 @@ import (
 	"github.com/canonical/lxd/shared/osarch"
 )
 
+// alpineLinuxArchitectureNames differ from Debian for 32-bit ARM: armhf is
+// ARMv6 with hard-float, and armv7 is ARMv7 with hard-float.
 var alpineLinuxArchitectureNames = map[int]string{
 	osarch.ARCH_32BIT_INTEL_X86:           "x86",
 	osarch.ARCH_64BIT_INTEL_X86:           "x86_64",
+	osarch.ARCH_32BIT_ARMV6_LITTLE_ENDIAN: "armhf",
 	osarch.ARCH_32BIT_ARMV7_LITTLE_ENDIAN: "armv7",
 }
 
@@ -22,9 +25,12 @@ var centosArchitectureNames = map[int]string{
 	osarch.ARCH_32BIT_INTEL_X86: "i386",
 }
 
+// debianArchitectureNames use armel for soft-float, which runs on ARMv5 and
+// ARMv6, and armhf for ARMv7 with hard-float.
 var debianArchitectureNames = map[int]string{
 	osarch.ARCH_32BIT_INTEL_X86:             "i386",
 	osarch.ARCH_64BIT_INTEL_X86:             "amd64",
+	osarch.ARCH_32BIT_ARMV6_LITTLE_ENDIAN:   "armel",
 	osarch.ARCH_32BIT_ARMV7_LITTLE_ENDIAN:   "armhf",
 	osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN:   "arm64",
 	osarch.ARCH_32BIT_POWERPC_BIG_ENDIAN:    "powerpc",
@@ -35,6 +41,7 @@ var debianArchitectureNames = map[int]string{
 var gentooArchitectureNames = map[int]string{
 	osarch.ARCH_32BIT_INTEL_X86:             "i686",
 	osarch.ARCH_64BIT_INTEL_X86:             "amd64",
+	osarch.ARCH_32BIT_ARMV6_LITTLE_ENDIAN:   "armv6j_hardfp",
 	osarch.ARCH_32BIT_ARMV7_LITTLE_ENDIAN:   "armv7a_hardfp",
 	osarch.ARCH_32BIT_POWERPC_BIG_ENDIAN:    "ppc",
 	osarch.ARCH_64BIT_POWERPC_BIG_ENDIAN:    "ppc64",
@@ -55,6 +62,7 @@ var altLinuxArchitectureNames = map[int]string{
 var voidLinuxArchitectureNames = map[int]string{
 	osarch.ARCH_32BIT_INTEL_X86:           "i686",
 	osarch.ARCH_64BIT_INTEL_X86:           "x86_64",
+	osarch.ARCH_32BIT_ARMV6_LITTLE_ENDIAN: "armv6l",
 	osarch.ARCH_32BIT_ARMV7_LITTLE_ENDIAN: "armv7l",
 	osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN: "aarch64",
 }
@@ -87,18 +95,12 @@ var distroArchitecture = map[string]map[int]string{
 // GetArch returns the correct architecture name used by the specified
 // distribution.
 func GetArch(distro, arch string) (string, error) {
-	// Special case armel as it is effectively a different userspace variant
-	// of armv7 without hard-float and so doesn't have its own kernel architecture name
-	if arch == "armel" {
-		return "armel", nil
-	}
-
 	archMap, ok := distroArchitecture[distro]
 	if !ok {
 		return "unknown", fmt.Errorf("Architecture map isn't supported: %s", distro)
 	}
 
-	archID, err := osarch.ArchitectureId(arch)
+	archID, err := getArchitectureID(distro, arch)
 	if err != nil {
 		return "unknown", err
 	}
@@ -110,3 +112,16 @@ func GetArch(distro, arch string) (string, error) {
 
 	return arch, nil
 }
+
+// getArchitectureID returns the ID of the given architecture. The names used by
+// the distribution take precedence over the generic ones, as e.g. armhf is
+// ARMv6 on Alpine Linux but ARMv7 on Debian.
+func getArchitectureID(distro string, arch string) (int, error) {
+	for archID, archName := range distroArchitecture[distro] {
+		if archName == arch {
+			return archID, nil
+		}
+	}
+
+	return osarch.ArchitectureId(arch)
+}
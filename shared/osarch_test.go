@@ -38,6 +38,41 @@ func TestGetArch(t *testing.T) {
 			"s390x",
 			"s390x",
 		},
+		{
+			"debian",
+			"armel",
+			"armel",
+		},
+		{
+			"debian",
+			"armv7l",
+			"armhf",
+		},
+		{
+			"alpinelinux",
+			"armhf",
+			"armhf",
+		},
+		{
+			"alpinelinux",
+			"armv6l",
+			"armhf",
+		},
+		{
+			"alpinelinux",
+			"armv7l",
+			"armv7",
+		},
+		{
+			"archlinux",
+			"armhf",
+			"armv7",
+		},
+		{
+			"voidlinux",
+			"armel",
+			"armv6l",
+		},
 	}
 
 	for i, tt := range tests {
@@ -53,3 +88,37 @@ func TestGetArch(t *testing.T) {
 	_, err = GetArch("debian", "arch")
 	require.EqualError(t, err, "Architecture isn't supported: arch")
 }
+
+func TestDefinitionArchitectureKernel(t *testing.T) {
+	tests := []struct {
+		distro      string
+		arch        string
+		kernel      string
+		personality string
+	}{
+		{"debian", "armel", "armv6l", "linux32"},
+		{"debian", "armhf", "armv7l", "linux32"},
+		{"alpinelinux", "armhf", "armv6l", "linux32"},
+		{"alpinelinux", "armv7", "armv7l", "linux32"},
+		{"", "armhf", "armv7l", "linux32"},
+		{"debian", "arm64", "aarch64", "linux64"},
+	}
+
+	for i, tt := range tests {
+		log.Printf("Running test #%d: %s %s", i, tt.distro, tt.arch)
+
+		def := Definition{
+			Image:    DefinitionImage{Distribution: "test", Architecture: tt.arch},
+			Source:   DefinitionSource{Downloader: "debootstrap"},
+			Packages: DefinitionPackages{Manager: "apt"},
+			Mappings: DefinitionMappings{ArchitectureMap: tt.distro},
+		}
+
+		def.SetDefaults()
+
+		err := def.Validate()
+		require.NoError(t, err)
+		require.Equal(t, tt.kernel, def.Image.ArchitectureKernel)
+		require.Equal(t, tt.personality, def.Image.ArchitecturePersonality)
+	}
+}
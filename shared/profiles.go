@@ -0,0 +1,150 @@
+package shared
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed profiles
+var profilesFS embed.FS
+
+// A definitionProfile is a snippet of a definition shipped with
+// lxd-imagebuilder, which definitions include by listing it in profiles.
+type definitionProfile struct {
+	// Packages are the packages installed by the profile, by package manager.
+	Packages map[string][]string `yaml:"packages,omitempty"`
+
+	// Definition is the part of the definition set by the profile.
+	Definition yaml.MapSlice `yaml:"definition,omitempty"`
+
+	// The filters apply to the installed packages.
+	DefinitionFilter `yaml:",inline"`
+}
+
+// Profiles returns the names of the profiles shipped with lxd-imagebuilder.
+func Profiles() []string {
+	entries, _ := fs.ReadDir(profilesFS, "profiles")
+
+	names := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".yaml"))
+	}
+
+	return names
+}
+
+// loadProfile returns the profile of the given name.
+func loadProfile(name string) (*definitionProfile, error) {
+	if !slices.Contains(Profiles(), name) {
+		return nil, fmt.Errorf("Unknown profile %q, must be one of %v", name, Profiles())
+	}
+
+	data, err := profilesFS.ReadFile("profiles/" + name + ".yaml")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read profile %q: %w", name, err)
+	}
+
+	var profile definitionProfile
+
+	err = yaml.UnmarshalStrict(data, &profile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse profile %q: %w", name, err)
+	}
+
+	return &profile, nil
+}
+
+// UnmarshalDefinition parses the definition strictly, including the profiles
+// it lists. The definition is parsed on top of the profiles, so its fields
+// override theirs, and lists other than the files, package sets and actions
+// replace theirs. The files, package sets and actions of the profiles come
+// before the ones of the definition, in the order of the profiles.
+func UnmarshalDefinition(data []byte, def *Definition) error {
+	var head struct {
+		Profiles []string `yaml:"profiles"`
+		Packages struct {
+			Manager string `yaml:"manager"`
+		} `yaml:"packages"`
+	}
+
+	// The definition is parsed strictly afterwards, which reports syntax
+	// errors.
+	err := yaml.Unmarshal(data, &head)
+	if err != nil || len(head.Profiles) == 0 {
+		return yaml.UnmarshalStrict(data, def)
+	}
+
+	var files []DefinitionFile
+	var sets []DefinitionPackagesSet
+	var actions []DefinitionAction
+
+	for i, name := range head.Profiles {
+		if slices.Contains(head.Profiles[:i], name) {
+			return fmt.Errorf("Duplicate profiles entry %q", name)
+		}
+
+		profile, err := loadProfile(name)
+		if err != nil {
+			return err
+		}
+
+		if len(profile.Packages) > 0 {
+			packages, ok := profile.Packages[head.Packages.Manager]
+			if !ok {
+				return fmt.Errorf("Profile %q doesn't support package manager %q, install its packages using packages.sets instead", name, head.Packages.Manager)
+			}
+
+			sets = append(sets, DefinitionPackagesSet{
+				DefinitionFilter: profile.DefinitionFilter,
+				Packages:         packages,
+				Action:           "install",
+			})
+		}
+
+		content, err := yaml.Marshal(profile.Definition)
+		if err != nil {
+			return fmt.Errorf("Failed to write profile %q: %w", name, err)
+		}
+
+		err = yaml.UnmarshalStrict(content, def)
+		if err != nil {
+			return fmt.Errorf("Failed to parse profile %q: %w", name, err)
+		}
+
+		// Entries of profiles are identified by their position in the profile.
+		for j := range def.Files {
+			def.Files[j].profile = name
+			def.Files[j].index = j
+		}
+
+		for j := range def.Actions {
+			def.Actions[j].profile = name
+			def.Actions[j].index = j
+		}
+
+		files = append(files, def.Files...)
+		sets = append(sets, def.Packages.Sets...)
+		actions = append(actions, def.Actions...)
+
+		def.Files = nil
+		def.Packages.Sets = nil
+		def.Actions = nil
+	}
+
+	err = yaml.UnmarshalStrict(data, def)
+	if err != nil {
+		return err
+	}
+
+	def.Files = append(files, def.Files...)
+	def.Packages.Sets = append(sets, def.Packages.Sets...)
+	def.Actions = append(actions, def.Actions...)
+
+	return nil
+}
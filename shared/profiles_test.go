@@ -0,0 +1,101 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfiles(t *testing.T) {
+	require.Equal(t, []string{"cloud-init", "openssh", "vm-bootloader"}, Profiles())
+
+	// Each profile results in a valid definition for the package managers it
+	// supports.
+	for _, name := range Profiles() {
+		profile, err := loadProfile(name)
+		require.NoError(t, err, name)
+
+		for manager := range profile.Packages {
+			var def Definition
+
+			err := UnmarshalDefinition([]byte("image:\n  distribution: ubuntu\nsource:\n  downloader: debootstrap\npackages:\n  manager: "+manager+"\nprofiles:\n- "+name+"\n"), &def)
+			require.NoError(t, err, name)
+
+			def.SetDefaults()
+
+			err = def.Validate()
+			require.NoError(t, err, "%s with %s", name, manager)
+		}
+	}
+}
+
+func TestUnmarshalDefinitionProfiles(t *testing.T) {
+	var def Definition
+
+	err := UnmarshalDefinition([]byte(`image:
+  distribution: ubuntu
+packages:
+  manager: apt
+  sets:
+  - packages:
+    - vim
+    action: install
+files:
+- generator: hostname
+actions:
+- trigger: post-files
+  action: echo
+targets:
+  lxd:
+    vm:
+      size: 10737418240
+      bootloader:
+        secure_boot: true
+profiles:
+- openssh
+- vm-bootloader
+`), &def)
+	require.NoError(t, err)
+
+	def.SetDefaults()
+
+	// The entries of the profiles come first.
+	require.Len(t, def.Files, 2)
+	require.Equal(t, "ssh-host-keys", def.Files[0].Generator)
+	require.Equal(t, `files[0] of profile "openssh"`, def.Files[0].ID())
+	require.Equal(t, "hostname", def.Files[1].Generator)
+	require.Equal(t, "files[0]", def.Files[1].ID())
+
+	require.Len(t, def.Packages.Sets, 3)
+	require.Equal(t, []string{"openssh-server"}, def.Packages.Sets[0].Packages)
+	require.Equal(t, []string{"grub-efi"}, def.Packages.Sets[1].Packages)
+	require.Equal(t, []DefinitionFilterType{DefinitionFilterTypeVM}, def.Packages.Sets[1].Types)
+	require.Equal(t, []string{"vim"}, def.Packages.Sets[2].Packages)
+
+	require.Len(t, def.Actions, 2)
+	require.Equal(t, "profile-openssh-enable", def.Actions[0].ID())
+	require.Equal(t, "actions[0]", def.Actions[1].ID())
+
+	// The fields of the definition are merged with the ones of the profiles.
+	require.Equal(t, uint64(10737418240), def.Targets.LXD.VM.Size.Bytes)
+	require.Equal(t, &DefinitionTargetLXDVMBootloader{Type: "grub", SecureBoot: true}, def.Targets.LXD.VM.Bootloader)
+
+	// The definition overrides the profiles.
+	def = Definition{}
+
+	err = UnmarshalDefinition([]byte("packages:\n  manager: apt\ntargets:\n  lxd:\n    vm:\n      bootloader:\n        type: systemd-boot\nprofiles:\n- vm-bootloader\n"), &def)
+	require.NoError(t, err)
+	require.Equal(t, "systemd-boot", def.Targets.LXD.VM.Bootloader.Type)
+
+	err = UnmarshalDefinition([]byte("packages:\n  manager: apt\nprofiles:\n- unknown\n"), &Definition{})
+	require.EqualError(t, err, `Unknown profile "unknown", must be one of [cloud-init openssh vm-bootloader]`)
+
+	err = UnmarshalDefinition([]byte("packages:\n  manager: apt\nprofiles:\n- openssh\n- openssh\n"), &Definition{})
+	require.EqualError(t, err, `Duplicate profiles entry "openssh"`)
+
+	err = UnmarshalDefinition([]byte("packages:\n  manager: portage\nprofiles:\n- openssh\n"), &Definition{})
+	require.EqualError(t, err, `Profile "openssh" doesn't support package manager "portage", install its packages using packages.sets instead`)
+
+	err = UnmarshalDefinition([]byte("packages:\n  manager: apt\nprofiles:\n- openssh\nunknown: true\n"), &Definition{})
+	require.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/shared/version"
+)
+
+// requiresConstraintRegex matches a single constraint on a version, like
+// ">=3.2".
+var requiresConstraintRegex = regexp.MustCompile(`^(>=|<=|>|<|==|!=)?\s*([0-9]+(\.[0-9]+)*)$`)
+
+// A DefinitionRequires represents the versions of lxd-imagebuilder the
+// definition can be built with.
+type DefinitionRequires struct {
+	LXDImageBuilder string `yaml:"lxd-imagebuilder,omitempty"`
+}
+
+// check returns an error if the constraints aren't met by the given version of
+// lxd-imagebuilder. The constraints are separated by commas, and all of them
+// need to be met.
+func (r *DefinitionRequires) check(current string) error {
+	if r.LXDImageBuilder == "" {
+		return nil
+	}
+
+	for _, constraint := range strings.Split(r.LXDImageBuilder, ",") {
+		match := requiresConstraintRegex.FindStringSubmatch(strings.TrimSpace(constraint))
+		if match == nil {
+			return fmt.Errorf("Invalid requires.lxd-imagebuilder %q", r.LXDImageBuilder)
+		}
+
+		cmp := compareVersions(current, match[2])
+
+		var ok bool
+
+		switch match[1] {
+		case ">=":
+			ok = cmp >= 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case "<":
+			ok = cmp < 0
+		case "!=":
+			ok = cmp != 0
+		default:
+			ok = cmp == 0
+		}
+
+		if !ok {
+			return fmt.Errorf("The definition requires lxd-imagebuilder %s, but this is lxd-imagebuilder %s. Use a version of lxd-imagebuilder matching the requirement to build it", r.LXDImageBuilder, current)
+		}
+	}
+
+	return nil
+}
+
+// CheckRequires returns an error if the definition can't be built with this
+// version of lxd-imagebuilder. Only requires is parsed, so definitions using
+// fields of newer versions fail with an upgrade message, rather than an
+// unknown field.
+func CheckRequires(data []byte) error {
+	var def struct {
+		Requires DefinitionRequires `yaml:"requires"`
+	}
+
+	// The definition is parsed strictly afterwards, which reports syntax
+	// errors.
+	err := yaml.Unmarshal(data, &def)
+	if err != nil {
+		return nil
+	}
+
+	return def.Requires.check(version.Version)
+}
+
+// compareVersions compares two dotted version numbers, returning -1, 0 or 1.
+// Missing components are treated as 0, so 3.2 equals 3.2.0.
+func compareVersions(a string, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var numA, numB int
+
+		if i < len(partsA) {
+			numA, _ = strconv.Atoi(partsA[i])
+		}
+
+		if i < len(partsB) {
+			numB, _ = strconv.Atoi(partsB[i])
+		}
+
+		if numA < numB {
+			return -1
+		}
+
+		if numA > numB {
+			return 1
+		}
+	}
+
+	return 0
+}
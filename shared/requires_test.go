@@ -0,0 +1,45 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefinitionRequiresCheck(t *testing.T) {
+	tests := []struct {
+		requires string
+		current  string
+		ok       bool
+	}{
+		{"", "3.0", true},
+		{">=3.2", "3.2", true},
+		{">=3.2", "3.10", true},
+		{">=3.2", "3.1.9", false},
+		{">3.2", "3.2.0", false},
+		{"<4, >=3.2", "3.5", true},
+		{"<4, >=3.2", "4.0", false},
+		{"3.2", "3.2.0", true},
+		{"!=3.2", "3.2", false},
+	}
+
+	for _, test := range tests {
+		r := DefinitionRequires{LXDImageBuilder: test.requires}
+
+		err := r.check(test.current)
+		if test.ok {
+			require.NoError(t, err, test.requires)
+		} else {
+			require.Error(t, err, test.requires)
+		}
+	}
+}
+
+func TestCheckRequires(t *testing.T) {
+	// Fields unknown to this version don't hide the requirement.
+	err := CheckRequires([]byte("requires:\n  lxd-imagebuilder: '>=99.0'\nimage:\n  distribution: ubuntu\n  newer_field: true\n"))
+	require.ErrorContains(t, err, "The definition requires lxd-imagebuilder >=99.0")
+
+	err = CheckRequires([]byte("image:\n  distribution: ubuntu\n"))
+	require.NoError(t, err)
+}
@@ -0,0 +1,145 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// urlPattern matches the URLs in repository files.
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// Restrict prepares the definition for a build in restricted mode, which is
+// used for definitions from untrusted users. It fails if the definition uses
+// features which run code or read files on the build host, or connects to
+// anything but the given mirrors. Actions are run without network access.
+func (d *Definition) Restrict(allowedMirrors []string) error {
+	if len(d.Plugins) > 0 {
+		return errors.New("plugins aren't allowed in restricted mode")
+	}
+
+	// Custom managers run arbitrary commands while the rootfs has network access.
+	if d.Packages.CustomManager != nil {
+		return errors.New("packages.custom_manager isn't allowed in restricted mode")
+	}
+
+	if len(d.RootfsOverlays) > 0 {
+		return errors.New("rootfs_overlays aren't allowed in restricted mode")
+	}
+
+	for _, file := range d.Files {
+		if file.Generator == "copy" {
+			return fmt.Errorf("%s: generator \"copy\" isn't allowed in restricted mode", file.ID())
+		}
+
+		if file.Generator == "ca-certificates" && file.Source != "" {
+			return fmt.Errorf("%s: source of generator \"ca-certificates\" isn't allowed in restricted mode", file.ID())
+		}
+	}
+
+	vm := d.Targets.LXD.VM
+
+	// These files are read from the build host.
+	if vm.Encryption != nil && vm.Encryption.Keyfile != "" {
+		return errors.New("targets.lxd.vm.encryption.keyfile isn't allowed in restricted mode")
+	}
+
+	if vm.Firmware != nil {
+		return errors.New("targets.lxd.vm.firmware isn't allowed in restricted mode")
+	}
+
+	// The u-boot binary is read after leaving the chroot, and written in front
+	// of the partitions.
+	if vm.Bootloader != nil && vm.Bootloader.UBoot != nil {
+		return errors.New("targets.lxd.vm.bootloader.u_boot isn't allowed in restricted mode")
+	}
+
+	if d.Targets.Encrypt != nil && d.Targets.Encrypt.PassphraseFile != "" {
+		return errors.New("targets.encrypt.passphrase_file isn't allowed in restricted mode")
+	}
+
+	if d.Targets.LXD.Publish != nil {
+		return errors.New("targets.lxd.publish isn't allowed in restricted mode")
+	}
+
+	// Unset URLs use the default mirrors of the downloaders and managers.
+	for _, field := range []struct {
+		key   string
+		value string
+	}{
+		{"source.url", d.Source.URL},
+		{"source.keyserver", d.Source.Keyserver},
+	} {
+		if field.value == "" {
+			continue
+		}
+
+		// URLs are rendered during the build.
+		rendered, err := RenderTemplate(field.value, d)
+		if err != nil {
+			return fmt.Errorf("Failed to render %s: %w", field.key, err)
+		}
+
+		if !isAllowedMirror(rendered, allowedMirrors) {
+			return fmt.Errorf("%s %q isn't an allowed mirror", field.key, rendered)
+		}
+	}
+
+	// Depending on the manager, the url of a repository is the content of a
+	// repository file, so all URLs in it are checked.
+	for i, repo := range d.Packages.Repositories {
+		rendered, err := RenderTemplate(repo.URL, d)
+		if err != nil {
+			return fmt.Errorf("Failed to render packages.repositories[%d].url: %w", i, err)
+		}
+
+		for _, repoURL := range urlPattern.FindAllString(rendered, -1) {
+			if !isAllowedMirror(repoURL, allowedMirrors) {
+				return fmt.Errorf("packages.repositories[%d].url %q isn't an allowed mirror", i, repoURL)
+			}
+		}
+	}
+
+	for i := range d.Actions {
+		d.Actions[i].noNetwork = true
+	}
+
+	// The image is untrusted as well, so it's booted without network access.
+	if vm.BootTest != nil {
+		d.Targets.LXD.VM.BootTest.noNetwork = true
+	}
+
+	return nil
+}
+
+// isAllowedMirror returns whether the given URL is located below one of the
+// allowed mirrors. The scheme and host need to match exactly.
+func isAllowedMirror(rawURL string, allowedMirrors []string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.User != nil {
+		return false
+	}
+
+	for _, mirror := range allowedMirrors {
+		m, err := url.Parse(mirror)
+		if err != nil {
+			continue
+		}
+
+		if u.Scheme != m.Scheme || u.Host != m.Host {
+			continue
+		}
+
+		prefix := strings.TrimSuffix(path.Clean("/"+m.Path), "/")
+		urlPath := path.Clean("/" + u.Path)
+
+		if urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,150 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefinitionRestrict(t *testing.T) {
+	mirrors := []string{"http://archive.ubuntu.com/ubuntu", "https://mirror.example.com/"}
+
+	tests := []struct {
+		name       string
+		definition Definition
+		expected   string
+	}{
+		{
+			"default mirrors",
+			Definition{},
+			"",
+		},
+		{
+			"allowed mirrors",
+			Definition{
+				Image:  DefinitionImage{Release: "noble"},
+				Source: DefinitionSource{URL: "http://archive.ubuntu.com/ubuntu/{{ image.release }}"},
+				Packages: DefinitionPackages{
+					Repositories: []DefinitionPackagesRepository{
+						{Name: "extra", URL: "deb https://mirror.example.com/extra noble main\ndeb http://archive.ubuntu.com/ubuntu noble universe"},
+					},
+				},
+			},
+			"",
+		},
+		{
+			"plugins",
+			Definition{Plugins: []DefinitionPlugin{{Name: "custom", Type: "downloader", Path: "/usr/bin/custom"}}},
+			"plugins aren't allowed in restricted mode",
+		},
+		{
+			"custom manager",
+			Definition{Packages: DefinitionPackages{CustomManager: &DefinitionPackagesCustomManager{}}},
+			"packages.custom_manager isn't allowed in restricted mode",
+		},
+		{
+			"rootfs overlays",
+			Definition{RootfsOverlays: []DefinitionRootfsOverlay{{Source: "/srv/payload"}}},
+			"rootfs_overlays aren't allowed in restricted mode",
+		},
+		{
+			"copy generator",
+			Definition{Files: []DefinitionFile{{Generator: "dump"}, {Generator: "copy", Source: "/etc/shadow", index: 1}}},
+			`files\[1\]: generator "copy" isn't allowed in restricted mode`,
+		},
+		{
+			"ca-certificates generator with source",
+			Definition{Files: []DefinitionFile{{Generator: "ca-certificates", Name: "corp", Source: "/etc/ssl/corp.pem"}}},
+			`files\[0\]: source of generator "ca-certificates" isn't allowed in restricted mode`,
+		},
+		{
+			"encryption keyfile",
+			Definition{Targets: DefinitionTarget{LXD: DefinitionTargetLXD{VM: DefinitionTargetLXDVM{Encryption: &DefinitionTargetLXDVMEncryption{Keyfile: "/root/key"}}}}},
+			"targets.lxd.vm.encryption.keyfile isn't allowed in restricted mode",
+		},
+		{
+			"u-boot",
+			Definition{Targets: DefinitionTarget{LXD: DefinitionTargetLXD{VM: DefinitionTargetLXDVM{Bootloader: &DefinitionTargetLXDVMBootloader{UBoot: &DefinitionTargetLXDVMUBoot{Path: "/usr/lib/u-boot/u-boot.itb"}}}}}},
+			"targets.lxd.vm.bootloader.u_boot isn't allowed in restricted mode",
+		},
+		{
+			"publish",
+			Definition{Targets: DefinitionTarget{LXD: DefinitionTargetLXD{Publish: &DefinitionTargetLXDPublish{}}}},
+			"targets.lxd.publish isn't allowed in restricted mode",
+		},
+		{
+			"source url on other host",
+			Definition{Source: DefinitionSource{URL: "http://archive.ubuntu.com.example.org/ubuntu"}},
+			`source.url "http://archive.ubuntu.com.example.org/ubuntu" isn't an allowed mirror`,
+		},
+		{
+			"source url with other scheme",
+			Definition{Source: DefinitionSource{URL: "https://archive.ubuntu.com/ubuntu"}},
+			`source.url "https://archive.ubuntu.com/ubuntu" isn't an allowed mirror`,
+		},
+		{
+			"source url outside of mirror path",
+			Definition{Source: DefinitionSource{URL: "http://archive.ubuntu.com/ubuntu/../private"}},
+			`source.url "http://archive.ubuntu.com/ubuntu/../private" isn't an allowed mirror`,
+		},
+		{
+			"source url with path prefix",
+			Definition{Source: DefinitionSource{URL: "http://archive.ubuntu.com/ubuntu-private"}},
+			`source.url "http://archive.ubuntu.com/ubuntu-private" isn't an allowed mirror`,
+		},
+		{
+			"source url on host file system",
+			Definition{Source: DefinitionSource{URL: "file:///etc"}},
+			`source.url "file:///etc" isn't an allowed mirror`,
+		},
+		{
+			"keyserver",
+			Definition{Source: DefinitionSource{Keyserver: "hkps://keyserver.ubuntu.com"}},
+			`source.keyserver "hkps://keyserver.ubuntu.com" isn't an allowed mirror`,
+		},
+		{
+			"repository file",
+			Definition{
+				Packages: DefinitionPackages{
+					Repositories: []DefinitionPackagesRepository{
+						{Name: "extra", URL: "[extra]\nbaseurl=https://mirror.example.com/extra\ngpgkey=http://internal.example.com/key"},
+					},
+				},
+			},
+			`packages.repositories\[0\].url "http://internal.example.com/key" isn't an allowed mirror`,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Logf("Running test #%d: %s", i, tt.name)
+
+		err := tt.definition.Restrict(mirrors)
+		if tt.expected == "" {
+			require.NoError(t, err)
+		} else {
+			require.Regexp(t, tt.expected, err)
+		}
+	}
+}
+
+func TestDefinitionRestrictActions(t *testing.T) {
+	definition := Definition{Actions: []DefinitionAction{{Trigger: "post-unpack"}, {Trigger: "post-packages"}}}
+
+	err := definition.Restrict(nil)
+	require.NoError(t, err)
+
+	for _, action := range definition.Actions {
+		require.True(t, action.noNetwork)
+	}
+}
+
+func TestDefinitionRestrictBootTest(t *testing.T) {
+	definition := Definition{}
+	definition.Targets.LXD.VM.BootTest = &DefinitionTargetLXDVMBootTest{}
+
+	require.True(t, definition.Targets.LXD.VM.BootTest.HasNetwork())
+
+	err := definition.Restrict(nil)
+	require.NoError(t, err)
+	require.False(t, definition.Targets.LXD.VM.BootTest.HasNetwork())
+}
@@ -0,0 +1,203 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// MergeRootfsOverlay merges the source directory of the given overlay onto the
+// rootfs using rsync.
+func MergeRootfsOverlay(ctx context.Context, overlay DefinitionRootfsOverlay, rootfsDir string) error {
+	info, err := os.Stat(overlay.Source)
+	if err != nil {
+		return fmt.Errorf("Failed to stat %q: %w", overlay.Source, err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%q isn't a directory", overlay.Source)
+	}
+
+	targetDir := filepath.Join(rootfsDir, overlay.Path)
+
+	err = checkRootfsOverlay(overlay, targetDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(targetDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", targetDir, err)
+	}
+
+	args := []string{"-aHASX", "--devices"}
+
+	if overlay.Conflict == "keep" {
+		args = append(args, "--ignore-existing")
+	}
+
+	if overlay.UID != "" || overlay.GID != "" {
+		owner := overlay.UID
+
+		if overlay.GID != "" {
+			owner += ":" + overlay.GID
+		}
+
+		args = append(args, "--chown="+owner)
+	}
+
+	// The trailing slashes merge the contents of the directories.
+	args = append(args, overlay.Source+"/", targetDir+"/")
+
+	err = RunCommand(ctx, nil, nil, "rsync", args...)
+	if err != nil {
+		return fmt.Errorf("Failed to copy %q to %q: %w", overlay.Source, targetDir, err)
+	}
+
+	return nil
+}
+
+// checkRootfsOverlay checks the files of the overlay against the ones of the
+// rootfs. Directories of the overlay need to be directories in the rootfs, as
+// rsync would replace them otherwise, e.g. the /lib symlink of a merged /usr.
+// With the "error" conflict policy, files which exist with other content fail
+// as well, so a rootfs can still be merged again with the same overlay.
+func checkRootfsOverlay(overlay DefinitionRootfsOverlay, targetDir string) error {
+	return filepath.WalkDir(overlay.Source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(overlay.Source, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(targetDir, relPath)
+
+		targetInfo, err := os.Lstat(target)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("Failed to stat %q: %w", target, err)
+			}
+
+			// Nothing below a new directory exists in the rootfs.
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if entry.IsDir() {
+			if !targetInfo.IsDir() {
+				return fmt.Errorf("%q of the overlay isn't a directory in the rootfs", filepath.Join("/", relPath))
+			}
+
+			return nil
+		}
+
+		if overlay.Conflict != "error" {
+			return nil
+		}
+
+		same, err := isSameFile(path, target)
+		if err != nil {
+			return err
+		}
+
+		if !same {
+			return fmt.Errorf("%q of the overlay already exists in the rootfs", filepath.Join("/", relPath))
+		}
+
+		return nil
+	})
+}
+
+// isSameFile returns whether the given files are regular files with the same
+// content, or symlinks with the same target.
+func isSameFile(a string, b string) (bool, error) {
+	infoA, err := os.Lstat(a)
+	if err != nil {
+		return false, fmt.Errorf("Failed to stat %q: %w", a, err)
+	}
+
+	infoB, err := os.Lstat(b)
+	if err != nil {
+		return false, fmt.Errorf("Failed to stat %q: %w", b, err)
+	}
+
+	if infoA.Mode().Type() != infoB.Mode().Type() {
+		return false, nil
+	}
+
+	switch {
+	case infoA.Mode().Type() == fs.ModeSymlink:
+		targetA, err := os.Readlink(a)
+		if err != nil {
+			return false, fmt.Errorf("Failed to read link %q: %w", a, err)
+		}
+
+		targetB, err := os.Readlink(b)
+		if err != nil {
+			return false, fmt.Errorf("Failed to read link %q: %w", b, err)
+		}
+
+		return targetA == targetB, nil
+	case infoA.Mode().IsRegular():
+		if infoA.Size() != infoB.Size() {
+			return false, nil
+		}
+
+		return hasSameContent(a, b)
+	}
+
+	return false, nil
+}
+
+// hasSameContent compares the given files in chunks, as overlays may contain
+// large files.
+func hasSameContent(a string, b string) (bool, error) {
+	fileA, err := os.Open(a)
+	if err != nil {
+		return false, fmt.Errorf("Failed to open %q: %w", a, err)
+	}
+
+	defer fileA.Close()
+
+	fileB, err := os.Open(b)
+	if err != nil {
+		return false, fmt.Errorf("Failed to open %q: %w", b, err)
+	}
+
+	defer fileB.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, len(bufA))
+
+	for {
+		nA, errA := io.ReadFull(fileA, bufA)
+		nB, errB := io.ReadFull(fileB, bufB)
+
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+
+		if errA != nil {
+			return false, fmt.Errorf("Failed to read %q: %w", a, errA)
+		}
+
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return false, fmt.Errorf("Failed to read %q: %w", b, errB)
+		}
+	}
+}
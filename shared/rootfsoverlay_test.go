@@ -0,0 +1,101 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRootfsOverlay(t *testing.T) {
+	sourceDir := t.TempDir()
+	rootfsDir := t.TempDir()
+
+	for _, dir := range []string{filepath.Join(sourceDir, "usr", "lib", "payload"), filepath.Join(rootfsDir, "usr", "lib")} {
+		err := os.MkdirAll(dir, 0755)
+		require.NoError(t, err)
+	}
+
+	for path, content := range map[string]string{
+		filepath.Join(sourceDir, "usr", "lib", "payload", "data"): "data",
+		filepath.Join(sourceDir, "usr", "lib", "os-release"):      "overlay",
+		filepath.Join(rootfsDir, "usr", "lib", "os-release"):      "rootfs",
+	} {
+		err := os.WriteFile(path, []byte(content), 0644)
+		require.NoError(t, err)
+	}
+
+	overlay := DefinitionRootfsOverlay{Source: sourceDir, Path: "/", Conflict: "overwrite"}
+
+	err := checkRootfsOverlay(overlay, rootfsDir)
+	require.NoError(t, err)
+
+	overlay.Conflict = "error"
+
+	err = checkRootfsOverlay(overlay, rootfsDir)
+	require.EqualError(t, err, `"/usr/lib/os-release" of the overlay already exists in the rootfs`)
+
+	// Files with the same content don't conflict.
+	err = os.WriteFile(filepath.Join(rootfsDir, "usr", "lib", "os-release"), []byte("overlay"), 0644)
+	require.NoError(t, err)
+
+	err = checkRootfsOverlay(overlay, rootfsDir)
+	require.NoError(t, err)
+
+	// Directories can't replace the symlinks of a merged /usr.
+	err = os.MkdirAll(filepath.Join(sourceDir, "lib"), 0755)
+	require.NoError(t, err)
+
+	err = os.Symlink("usr/lib", filepath.Join(rootfsDir, "lib"))
+	require.NoError(t, err)
+
+	overlay.Conflict = "keep"
+
+	err = checkRootfsOverlay(overlay, rootfsDir)
+	require.EqualError(t, err, `"/lib" of the overlay isn't a directory in the rootfs`)
+}
+
+func TestMergeRootfsOverlay(t *testing.T) {
+	_, err := exec.LookPath("rsync")
+	if err != nil {
+		t.Skip("rsync is missing")
+	}
+
+	sourceDir := t.TempDir()
+	rootfsDir := t.TempDir()
+
+	for path, content := range map[string]string{
+		filepath.Join(sourceDir, "new"):      "overlay",
+		filepath.Join(sourceDir, "existing"): "overlay",
+		filepath.Join(rootfsDir, "existing"): "rootfs",
+	} {
+		err := os.WriteFile(path, []byte(content), 0644)
+		require.NoError(t, err)
+	}
+
+	err = MergeRootfsOverlay(context.Background(), DefinitionRootfsOverlay{Source: sourceDir, Path: "/opt/payload", Conflict: "keep"}, rootfsDir)
+	require.NoError(t, err)
+
+	for _, name := range []string{"new", "existing"} {
+		content, err := os.ReadFile(filepath.Join(rootfsDir, "opt", "payload", name))
+		require.NoError(t, err)
+		require.Equal(t, "overlay", string(content))
+	}
+
+	err = MergeRootfsOverlay(context.Background(), DefinitionRootfsOverlay{Source: sourceDir, Path: "/", Conflict: "keep"}, rootfsDir)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(rootfsDir, "existing"))
+	require.NoError(t, err)
+	require.Equal(t, "rootfs", string(content))
+
+	err = MergeRootfsOverlay(context.Background(), DefinitionRootfsOverlay{Source: sourceDir, Path: "/", Conflict: "overwrite"}, rootfsDir)
+	require.NoError(t, err)
+
+	content, err = os.ReadFile(filepath.Join(rootfsDir, "existing"))
+	require.NoError(t, err)
+	require.Equal(t, "overlay", string(content))
+}
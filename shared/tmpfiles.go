@@ -0,0 +1,146 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TmpfilesTypes are the supported types of tmpfiles entries.
+var TmpfilesTypes = []string{"b", "c", "d", "f", "L"}
+
+// A TmpfilesEntry is a line of the tmpfiles generator, in the format of
+// tmpfiles.d: "<type> <path> <mode> <user> <group> <age> <argument>". Fields
+// set to "-" or left out use their defaults.
+type TmpfilesEntry struct {
+	Type     string
+	Replace  bool
+	Path     string
+	Mode     uint32
+	User     string
+	Group    string
+	Argument string
+}
+
+// ParseTmpfilesEntry parses a tmpfiles entry. The argument is the rest of the
+// line, so it may contain spaces.
+func ParseTmpfilesEntry(line string) (*TmpfilesEntry, error) {
+	fields := make([]string, 0, 7)
+	rest := strings.TrimSpace(line)
+
+	for len(fields) < 6 && rest != "" {
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+
+		fields = append(fields, rest[:end])
+		rest = strings.TrimLeft(rest[end:], " \t")
+	}
+
+	if rest != "" {
+		fields = append(fields, rest)
+	}
+
+	for len(fields) < 7 {
+		fields = append(fields, "-")
+	}
+
+	entry := &TmpfilesEntry{
+		Type:     strings.TrimSuffix(fields[0], "+"),
+		Replace:  strings.HasSuffix(fields[0], "+"),
+		Path:     fields[1],
+		User:     fields[3],
+		Group:    fields[4],
+		Argument: fields[6],
+	}
+
+	if !slices.Contains(TmpfilesTypes, entry.Type) || (entry.Replace && entry.Type == "d") {
+		return nil, fmt.Errorf("Invalid type %q, must be one of %v, or b+, c+, f+ or L+ to replace existing files", fields[0], TmpfilesTypes)
+	}
+
+	if !strings.HasPrefix(entry.Path, "/") || slices.Contains(strings.Split(entry.Path, "/"), "..") {
+		return nil, fmt.Errorf("Invalid path %q, must be an absolute path", entry.Path)
+	}
+
+	if fields[2] == "-" {
+		entry.Mode = 0644
+
+		if entry.Type == "d" {
+			entry.Mode = 0755
+		}
+	} else {
+		mode, err := strconv.ParseUint(fields[2], 8, 32)
+		if err != nil || mode > 07777 {
+			return nil, fmt.Errorf("Invalid mode %q, must be an octal mode", fields[2])
+		}
+
+		entry.Mode = uint32(mode)
+	}
+
+	// The files are created when building the image, so they don't age.
+	if fields[5] != "-" {
+		return nil, errors.New("Ages aren't supported")
+	}
+
+	if entry.Argument == "-" {
+		entry.Argument = ""
+	}
+
+	switch entry.Type {
+	case "b", "c":
+		_, _, err := entry.Device()
+		if err != nil {
+			return nil, err
+		}
+
+	case "d":
+		if entry.Argument != "" {
+			return nil, errors.New("Directories don't take an argument")
+		}
+
+	case "L":
+		if entry.Argument == "" {
+			return nil, errors.New("Missing symlink target")
+		}
+	}
+
+	return entry, nil
+}
+
+// Device returns the major and minor number of a device entry.
+func (e *TmpfilesEntry) Device() (uint32, uint32, error) {
+	major, minor, found := strings.Cut(e.Argument, ":")
+	if !found {
+		return 0, 0, fmt.Errorf("Invalid device %q, must be <major>:<minor>", e.Argument)
+	}
+
+	majorNum, err := strconv.ParseUint(major, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid device %q, must be <major>:<minor>", e.Argument)
+	}
+
+	minorNum, err := strconv.ParseUint(minor, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid device %q, must be <major>:<minor>", e.Argument)
+	}
+
+	return uint32(majorNum), uint32(minorNum), nil
+}
+
+func (d *DefinitionFile) validateTmpfiles() error {
+	if len(d.Tmpfiles) == 0 {
+		return errors.New("files.*.tmpfiles may not be empty")
+	}
+
+	for _, line := range d.Tmpfiles {
+		_, err := ParseTmpfilesEntry(line)
+		if err != nil {
+			return fmt.Errorf("Invalid files.*.tmpfiles entry %q: %w", line, err)
+		}
+	}
+
+	return nil
+}
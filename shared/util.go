@@ -4,21 +4,26 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/flosch/pongo2/v4"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -58,7 +63,25 @@ func Copy(src, dest string) error {
 	return destFile.Sync()
 }
 
-// RunCommand runs a command. Stdout is written to the given io.Writer. If nil, it's written to the real stdout. Stderr is always written to the real stderr.
+// commandOutputLines is the number of lines of its output a CommandError keeps.
+const commandOutputLines = 20
+
+var commandLogger *logrus.Logger
+
+// SetCommandLogger sets the logger the output of the commands run by
+// RunCommand is logged to, line by line. If nil, the output is written to the
+// real stdout and stderr.
+func SetCommandLogger(logger *logrus.Logger) {
+	commandLogger = logger
+}
+
+// commandWaitDelay is how long RunCommand waits for the output of a command to
+// be closed after it exited. Daemons started by the command may inherit it.
+var commandWaitDelay = 10 * time.Second
+
+// RunCommand runs a command. Stdout is written to the given io.Writer. If nil, it's written to the
+// logger set by SetCommandLogger, or the real stdout. Stderr is always written to the logger, or the
+// real stderr. If the command fails, the returned CommandError holds the last lines of its output.
 func RunCommand(ctx context.Context, stdin io.Reader, stdout io.Writer, name string, arg ...string) error {
 	cmd := exec.CommandContext(ctx, name, arg...)
 
@@ -66,21 +89,157 @@ func RunCommand(ctx context.Context, stdin io.Reader, stdout io.Writer, name str
 		cmd.Stdin = stdin
 	}
 
+	output := &commandOutput{}
+
+	stderr := &commandLineWriter{output: output, prefix: filepath.Base(name), stderr: true}
+	cmd.Stderr = stderr
+
 	if stdout != nil {
 		cmd.Stdout = stdout
 	} else {
-		cmd.Stdout = os.Stdout
+		cmd.Stdout = &commandLineWriter{output: output, prefix: filepath.Base(name)}
+	}
+
+	cmd.WaitDelay = commandWaitDelay
+
+	err := cmd.Run()
+
+	// The command itself succeeded, and only a process it left running still
+	// holds its output.
+	if errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+
+	stderr.Flush()
+
+	writer, ok := cmd.Stdout.(*commandLineWriter)
+	if ok {
+		writer.Flush()
+	}
+
+	if err != nil {
+		return &CommandError{Command: append([]string{name}, arg...), Err: err, Output: output.lines}
+	}
+
+	return nil
+}
+
+// CommandError is returned by RunCommand if the command fails.
+type CommandError struct {
+	Command []string
+	Err     error
+
+	// Output holds the last lines of the output of the command.
+	Output []string
+}
+
+// Error returns the error of the failed command, and the last line of its
+// output, which usually tells why it failed.
+func (e *CommandError) Error() string {
+	if len(e.Output) == 0 {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("%v: %s", e.Err, e.Output[len(e.Output)-1])
+}
+
+// Unwrap returns the error of the failed command.
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// commandOutput keeps the last lines of the stdout and stderr of a command,
+// which are written concurrently.
+type commandOutput struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+// add adds a line of the output, dropping the oldest one if there are too many.
+func (o *commandOutput) add(line string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.lines = append(o.lines, line)
+
+	if len(o.lines) > commandOutputLines {
+		o.lines = o.lines[len(o.lines)-commandOutputLines:]
+	}
+}
+
+// commandLineWriter splits the output of a command into lines, which are kept
+// in output and logged with the prefix, so the lines of concurrent stdout and
+// stderr don't get mixed up.
+type commandLineWriter struct {
+	output *commandOutput
+	prefix string
+	stderr bool
+
+	buf []byte
+}
+
+// Write writes the complete lines of p, and buffers the remainder.
+func (w *commandLineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.writeLine(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
 	}
 
-	cmd.Stderr = os.Stderr
+	return len(p), nil
+}
 
-	return cmd.Run()
+// Flush writes the remainder of the output without a final new line.
+func (w *commandLineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *commandLineWriter) writeLine(line string) {
+	// Progress bars redraw their line using carriage returns.
+	line = strings.TrimRight(line, "\r")
+	if i := strings.LastIndexByte(line, '\r'); i >= 0 {
+		line = line[i+1:]
+	}
+
+	if strings.TrimSpace(line) != "" {
+		w.output.add(line)
+	}
+
+	if commandLogger == nil {
+		out := os.Stdout
+		if w.stderr {
+			out = os.Stderr
+		}
+
+		fmt.Fprintln(out, line)
+
+		return
+	}
+
+	// Many tools report their progress on stderr, so it's not logged as a
+	// warning.
+	commandLogger.Info(w.prefix + ": " + line)
 }
 
 // RunScript runs a script hereby setting the SHELL and PATH env variables,
 // and redirecting the process's stdout and stderr to the real stdout and stderr
 // respectively.
 func RunScript(ctx context.Context, content string) error {
+	return runScript(ctx, content, os.Stdout, os.Stderr, false)
+}
+
+// runScript runs a script, writing its output to the given writers. If
+// noNetwork is true, it's run in a new network namespace.
+func runScript(ctx context.Context, content string, stdout io.Writer, stderr io.Writer, noNetwork bool) error {
 	fd, err := unix.MemfdCreate("tmp", 0)
 	if err != nil {
 		return fmt.Errorf("Failed to create memfd: %w", err)
@@ -95,12 +254,116 @@ func RunScript(ctx context.Context, content string) error {
 
 	fdPath := fmt.Sprintf("/proc/self/fd/%d", fd)
 
-	return RunCommand(ctx, nil, nil, fdPath)
+	cmd := exec.CommandContext(ctx, fdPath)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if noNetwork {
+		cmd.SysProcAttr = &unix.SysProcAttr{Cloneflags: unix.CLONE_NEWNET}
+	}
+
+	err = cmd.Run()
+	if err != nil {
+		return &ScriptError{Script: content, Err: err}
+	}
+
+	return nil
+}
+
+// RunAction runs the script of the given action. If it fails, it's retried up
+// to action.Retries times, and the output of each failed attempt is kept in
+// the returned ScriptError.
+func RunAction(ctx context.Context, logger *logrus.Logger, action DefinitionAction) error {
+	if action.Retries == 0 {
+		return runScript(ctx, actionScript(action, 1), os.Stdout, os.Stderr, action.noNetwork)
+	}
+
+	delay, err := action.GetRetryDelay()
+	if err != nil {
+		return err
+	}
+
+	var attempts []string
+
+	for attempt := uint(1); ; attempt++ {
+		var output bytes.Buffer
+
+		err := runScript(ctx, actionScript(action, attempt), io.MultiWriter(os.Stdout, &output), io.MultiWriter(os.Stderr, &output), action.noNetwork)
+		if err == nil {
+			return nil
+		}
+
+		var scriptErr *ScriptError
+
+		if !errors.As(err, &scriptErr) {
+			return err
+		}
+
+		attempts = append(attempts, output.String())
+		scriptErr.Attempts = attempts
+
+		if attempt > action.Retries || ctx.Err() != nil {
+			return err
+		}
+
+		logger.WithFields(logrus.Fields{"action": action.ID(), "attempt": attempt, "err": err}).Warnf("Action failed, retrying in %s", delay)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// ScriptError is returned by RunScript if the script fails.
+type ScriptError struct {
+	Script string
+	Err    error
+
+	// Attempts holds the output of each failed attempt, if the script was
+	// run by RunAction with retries.
+	Attempts []string
+}
+
+// Error returns the error of the failed script.
+func (e *ScriptError) Error() string {
+	if len(e.Attempts) > 1 {
+		return fmt.Sprintf("%v (after %d attempts)", e.Err, len(e.Attempts))
+	}
+
+	return e.Err.Error()
+}
+
+// Unwrap returns the error of the failed script.
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// tarArgs returns the tar arguments for the given tarball options.
+func tarArgs(options DefinitionTargetTar) []string {
+	var args []string
+
+	switch options.Format {
+	case "gnu", "ustar":
+		// Storing extended attributes always results in PAX headers.
+		return []string{fmt.Sprintf("--format=%s", options.Format)}
+	case "pax":
+		args = append(args, "--format=posix")
+	}
+
+	args = append(args, "--xattrs")
+
+	for _, pattern := range options.Xattrs {
+		args = append(args, fmt.Sprintf("--xattrs-include=%s", pattern))
+	}
+
+	return args
 }
 
 // Pack creates an uncompressed tarball.
-func Pack(ctx context.Context, filename, compression, path string, args ...string) (string, error) {
-	err := RunCommand(ctx, nil, nil, "tar", append([]string{"--xattrs", "-cf", filename, "-C", path, "--sort=name"}, args...)...)
+func Pack(ctx context.Context, filename, compression, path string, options DefinitionTargetTar, args ...string) (string, error) {
+	err := RunCommand(ctx, nil, nil, "tar", append(append(tarArgs(options), "-cf", filename, "-C", path, "--sort=name"), args...)...)
 	if err != nil {
 		// Clean up incomplete tarball
 		os.Remove(filename)
@@ -111,8 +374,8 @@ func Pack(ctx context.Context, filename, compression, path string, args ...strin
 }
 
 // PackUpdate updates an existing tarball.
-func PackUpdate(ctx context.Context, filename, compression, path string, args ...string) (string, error) {
-	err := RunCommand(ctx, nil, nil, "tar", append([]string{"--xattrs", "-uf", filename, "-C", path, "--sort=name"}, args...)...)
+func PackUpdate(ctx context.Context, filename, compression, path string, options DefinitionTargetTar, args ...string) (string, error) {
+	err := RunCommand(ctx, nil, nil, "tar", append(append(tarArgs(options), "-uf", filename, "-C", path, "--sort=name"), args...)...)
 	if err != nil {
 		return "", fmt.Errorf("Failed to update tarball: %w", err)
 	}
@@ -180,6 +443,47 @@ func compressTarball(ctx context.Context, filename, compression string) (string,
 	return fmt.Sprintf("%s.%s", filename, fileExtension), nil
 }
 
+// buildDate is the date set by SetBuildDate. The current time is used if it's
+// zero.
+var buildDate time.Time
+
+// SetBuildDate sets the date of the build, which is used instead of the current
+// time for the serial, the image metadata and the generated files, e.g. when
+// re-issuing the build of a past date.
+func SetBuildDate(date time.Time) {
+	buildDate = date.UTC()
+}
+
+// HasBuildDate returns whether the date of the build was set by SetBuildDate.
+func HasBuildDate() bool {
+	return !buildDate.IsZero()
+}
+
+// BuildDate returns the date of the build in UTC.
+func BuildDate() time.Time {
+	if buildDate.IsZero() {
+		return time.Now().UTC()
+	}
+
+	return buildDate
+}
+
+// ParseBuildDate parses a build date in RFC 3339 format, or a day in the
+// format YYYY-MM-DD which refers to its midnight in UTC.
+func ParseBuildDate(value string) (time.Time, error) {
+	date, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return date, nil
+	}
+
+	date, err = time.Parse(time.DateOnly, value)
+	if err == nil {
+		return date, nil
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid build date %q, expected YYYY-MM-DD or RFC 3339", value)
+}
+
 // GetExpiryDate returns an expiry date based on the creationDate and format.
 func GetExpiryDate(creationDate time.Time, format string) time.Time {
 	regex := regexp.MustCompile(`(?:(\d+)(s|m|h|d|w))*`)
@@ -230,6 +534,16 @@ func RenderTemplate(template string, iface interface{}) (string, error) {
 		return "", fmt.Errorf("Failed unmarshalling data: %w", err)
 	}
 
+	if ctx == nil {
+		ctx = pongo2.Context{}
+	}
+
+	// Helper functions available in all templates
+	ctx["env"] = os.Getenv
+	ctx["build_date"] = func(layout string) string {
+		return BuildDate().Format(layout)
+	}
+
 	// Load template from string
 	tpl, err := pongo2.FromString("{% autoescape off %}" + template + "{% endautoescape %}")
 	if err != nil {
@@ -585,3 +899,36 @@ func HasSuffix(key string, suffixes ...string) bool {
 
 	return false
 }
+
+// ParsePEMCertificates returns the certificates of the PEM encoded data. Text
+// around the PEM blocks is ignored. It fails if the data contains other PEM
+// blocks than certificates, or no certificate.
+func ParsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("Unexpected PEM block %q", block.Type)
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse certificate: %w", err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("No PEM encoded certificate found")
+	}
+
+	return certs, nil
+}
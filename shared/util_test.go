@@ -1,11 +1,18 @@
 package shared
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/flosch/pongo2/v4"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 )
 
@@ -54,6 +61,24 @@ func TestRenderTemplate(t *testing.T) {
 			"",
 			true,
 		},
+		{
+			"environment variable",
+			Definition{
+				Image: DefinitionImage{
+					Serial: "20240101",
+				},
+			},
+			"{{ image.serial }}-{{ env(\"LXD_IMAGEBUILDER_TEST_COMMIT\") }}",
+			"20240101-abc123",
+			false,
+		},
+		{
+			"build date",
+			pongo2.Context{},
+			"{{ build_date(\"2006\") }}",
+			time.Now().UTC().Format("2006"),
+			false,
+		},
 		{
 			"invalid context",
 			pongo2.Context{
@@ -65,6 +90,9 @@ func TestRenderTemplate(t *testing.T) {
 		},
 	}
 
+	os.Setenv("LXD_IMAGEBUILDER_TEST_COMMIT", "abc123")
+	defer os.Unsetenv("LXD_IMAGEBUILDER_TEST_COMMIT")
+
 	for i, tt := range tests {
 		log.Printf("Running test #%d: %s", i, tt.name)
 		ret, err := RenderTemplate(tt.template, tt.iface)
@@ -217,3 +245,206 @@ func TestSquashfsParseCompression(t *testing.T) {
 		}
 	}
 }
+
+func TestPack(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(sourceDir, "file"), []byte("content"), 0644)
+	require.NoError(t, err)
+
+	tests := []struct {
+		options    DefinitionTargetTar
+		paxHeaders bool
+	}{
+		{DefinitionTargetTar{}, true},
+		{DefinitionTargetTar{Format: "pax", Xattrs: []string{"user.*"}}, true},
+		{DefinitionTargetTar{Format: "gnu"}, false},
+		{DefinitionTargetTar{Format: "ustar"}, false},
+	}
+
+	for i, tt := range tests {
+		log.Printf("Running test #%d: %s", i, tt.options.Format)
+
+		filename, err := Pack(context.Background(), filepath.Join(targetDir, "test.tar"), "", sourceDir, tt.options, ".")
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		require.Equal(t, tt.paxHeaders, bytes.Contains(content, []byte("PaxHeaders")))
+
+		err = os.Remove(filename)
+		require.NoError(t, err)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	var logs bytes.Buffer
+
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+	logger.Formatter = &logrus.TextFormatter{DisableTimestamp: true}
+
+	SetCommandLogger(logger)
+	defer SetCommandLogger(nil)
+
+	err := RunCommand(context.Background(), nil, nil, "/bin/sh", "-c", "echo out; echo err >&2; printf 'progress 1%%\\rprogress 100%%'")
+	require.NoError(t, err)
+	// Stdout and stderr are read concurrently, so their lines may be logged in
+	// any order.
+	require.ElementsMatch(t, []string{`level=info msg="sh: out"`, `level=info msg="sh: err"`, `level=info msg="sh: progress 100%"`}, strings.Split(strings.TrimSuffix(logs.String(), "\n"), "\n"))
+
+	// Stdout isn't logged if it's written to a writer.
+	var out bytes.Buffer
+
+	logs.Reset()
+
+	err = RunCommand(context.Background(), nil, &out, "/bin/sh", "-c", "echo out; echo err >&2; exit 2")
+	require.EqualError(t, err, "exit status 2: err")
+	require.Equal(t, "out\n", out.String())
+	require.Equal(t, "level=info msg=\"sh: err\"\n", logs.String())
+
+	var commandErr *CommandError
+
+	require.True(t, errors.As(err, &commandErr))
+	require.Equal(t, []string{"/bin/sh", "-c", "echo out; echo err >&2; exit 2"}, commandErr.Command)
+
+	// Only the last lines of the output are kept.
+	err = RunCommand(context.Background(), nil, nil, "/bin/sh", "-c", "seq 1 100; exit 1")
+	require.EqualError(t, err, "exit status 1: 100")
+	require.True(t, errors.As(err, &commandErr))
+	require.Len(t, commandErr.Output, commandOutputLines)
+	require.Equal(t, "81", commandErr.Output[0])
+
+	// Daemons inheriting the output don't block the command.
+	defer func(delay time.Duration) { commandWaitDelay = delay }(commandWaitDelay)
+	commandWaitDelay = 100 * time.Millisecond
+
+	start := time.Now()
+
+	err = RunCommand(context.Background(), nil, nil, "/bin/sh", "-c", "sleep 10 & echo started")
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRunAction(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "counter")
+
+	// The script succeeds on the third attempt.
+	action := DefinitionAction{
+		Action: `#!/bin/sh
+echo attempt >> ` + counter + `
+[ "$(wc -l < ` + counter + `)" -ge 3 ] || { echo failed; exit 1; }
+`,
+		Retries:    2,
+		RetryDelay: "1ms",
+	}
+
+	err := RunAction(context.Background(), logrus.New(), action)
+	require.NoError(t, err)
+
+	// The script fails on all attempts.
+	err = os.Remove(counter)
+	require.NoError(t, err)
+
+	action.Retries = 1
+
+	err = RunAction(context.Background(), logrus.New(), action)
+	require.EqualError(t, err, "exit status 1 (after 2 attempts)")
+
+	var scriptErr *ScriptError
+
+	require.True(t, errors.As(err, &scriptErr))
+	require.Equal(t, []string{"failed\n", "failed\n"}, scriptErr.Attempts)
+
+	action.RetryDelay = "soon"
+
+	err = RunAction(context.Background(), logrus.New(), action)
+	require.Error(t, err)
+}
+
+func TestRunActionFaults(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "counter")
+
+	SetActionFaults(map[string]uint{"post-unpack": 2})
+	defer SetActionFaults(nil)
+
+	action := DefinitionAction{
+		Name:       "it's me",
+		Trigger:    "post-unpack",
+		Action:     "#!/bin/sh\necho attempt >> " + counter + "\n",
+		Retries:    2,
+		RetryDelay: "1ms",
+	}
+
+	// The action only runs on the third attempt.
+	err := RunAction(context.Background(), logrus.New(), action)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(counter)
+	require.NoError(t, err)
+	require.Equal(t, "attempt\n", string(content))
+
+	action.Retries = 1
+
+	err = RunAction(context.Background(), logrus.New(), action)
+	require.EqualError(t, err, "exit status 1 (after 2 attempts)")
+
+	var scriptErr *ScriptError
+
+	require.True(t, errors.As(err, &scriptErr))
+	require.Equal(t, []string{"Injected failure of it's me\n", "Injected failure of it's me\n"}, scriptErr.Attempts)
+
+	// Actions of other triggers aren't affected.
+	action.Trigger = "post-files"
+	action.Retries = 0
+
+	err = RunAction(context.Background(), logrus.New(), action)
+	require.NoError(t, err)
+
+	for value, expected := range map[string]string{
+		"post-files":      "",
+		"post-packages=3": "",
+		"pre-unpack":      `Invalid action fault "pre-unpack", trigger must be one of .+`,
+		"post-update=0":   `Invalid action fault "post-update=0", attempts must be a positive number`,
+	} {
+		_, _, err := ParseActionFault(value)
+		if expected == "" {
+			require.NoError(t, err)
+		} else {
+			require.Regexp(t, expected, err)
+		}
+	}
+
+	trigger, attempts, err := ParseActionFault("post-packages=3")
+	require.NoError(t, err)
+	require.Equal(t, "post-packages", trigger)
+	require.Equal(t, uint(3), attempts)
+}
+
+func TestBuildDate(t *testing.T) {
+	date, err := ParseBuildDate("2024-03-10")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), date)
+
+	date, err = ParseBuildDate("2024-03-10T12:30:00+01:00")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 3, 10, 11, 30, 0, 0, time.UTC).Unix(), date.Unix())
+
+	_, err = ParseBuildDate("10.03.2024")
+	require.Error(t, err)
+
+	SetBuildDate(date)
+	defer SetBuildDate(time.Time{})
+
+	require.True(t, HasBuildDate())
+	require.Equal(t, time.Date(2024, 3, 10, 11, 30, 0, 0, time.UTC), BuildDate())
+
+	out, err := RenderTemplate(`{{ build_date("20060102_1504") }}`, Definition{})
+	require.NoError(t, err)
+	require.Equal(t, "20240310_1130", out)
+
+	def := Definition{}
+	def.SetDefaults()
+	require.Equal(t, "20240310_1130", def.Image.Serial)
+}
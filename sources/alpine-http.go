@@ -100,7 +100,7 @@ func (s *alpineLinux) Run() error {
 	s.logger.WithField("file", filepath.Join(fpath, fname)).Info("Unpacking image")
 
 	// Unpack
-	err = shared.Unpack(filepath.Join(fpath, fname), s.rootfsDir)
+	err = shared.Unpack(s.ctx, filepath.Join(fpath, fname), s.rootfsDir)
 	if err != nil {
 		return fmt.Errorf("Failed to unpack %q: %w", fname, err)
 	}
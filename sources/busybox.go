@@ -45,7 +45,7 @@ func (s *busybox) Run() error {
 	s.logger.WithField("file", filepath.Join(fpath, fname)).Info("Unpacking image")
 
 	// Unpack
-	err = shared.Unpack(filepath.Join(fpath, fname), sourceDir)
+	err = shared.Unpack(s.ctx, filepath.Join(fpath, fname), sourceDir)
 	if err != nil {
 		return fmt.Errorf("Failed to unpack %q: %w", fname, err)
 	}
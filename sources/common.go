@@ -43,7 +43,7 @@ func (s *common) init(ctx context.Context, logger *logrus.Logger, definition sha
 	transport.TLSHandshakeTimeout = 60 * time.Second
 
 	s.client = &http.Client{
-		Transport: transport,
+		Transport: &limitedTransport{base: transport},
 	}
 }
 
@@ -0,0 +1,69 @@
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is returned by the requests failed by the download faults.
+var ErrInjectedFault = errors.New("Injected download failure")
+
+// DownloadFaults are the failures injected into the downloads of the
+// downloaders, so the handling of unreliable mirrors can be tested without
+// them.
+type DownloadFaults struct {
+	// ErrorRate is the share of requests which fail, between 0 and 1.
+	ErrorRate float64
+
+	// Delay is added to every request, simulating a slow mirror.
+	Delay time.Duration
+
+	// Seed seeds the choice of the failing requests, so a failure can be
+	// reproduced.
+	Seed int64
+}
+
+var downloadFaults DownloadFaults
+var downloadFaultsRand *rand.Rand
+var downloadFaultsLock sync.Mutex
+
+// SetDownloadFaults sets the faults injected into all downloads of the
+// process, including the ones using the default HTTP client.
+func SetDownloadFaults(faults DownloadFaults) {
+	downloadFaultsLock.Lock()
+	downloadFaults = faults
+	downloadFaultsRand = rand.New(rand.NewSource(faults.Seed))
+	downloadFaultsLock.Unlock()
+
+	http.DefaultClient.Transport = &limitedTransport{base: http.DefaultTransport}
+}
+
+// injectDownloadFault delays the request, and returns an error if it's chosen
+// to fail.
+func injectDownloadFault(req *http.Request) error {
+	downloadFaultsLock.Lock()
+	faults := downloadFaults
+	fail := faults.ErrorRate > 0 && downloadFaultsRand.Float64() < faults.ErrorRate
+	downloadFaultsLock.Unlock()
+
+	if faults.Delay > 0 {
+		timer := time.NewTimer(faults.Delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return req.Context().Err()
+		}
+	}
+
+	if fail {
+		return fmt.Errorf("%w of %q", ErrInjectedFault, req.URL.Redacted())
+	}
+
+	return nil
+}
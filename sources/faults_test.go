@@ -0,0 +1,55 @@
+package sources
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadFaults(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	defer SetDownloadFaults(DownloadFaults{})
+
+	client := &http.Client{Transport: &limitedTransport{base: http.DefaultTransport}}
+
+	// The same seed fails the same requests.
+	getFailures := func(seed int64) []bool {
+		SetDownloadFaults(DownloadFaults{ErrorRate: 0.5, Seed: seed})
+
+		var failures []bool
+
+		for i := 0; i < 20; i++ {
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			} else {
+				require.True(t, errors.Is(err, ErrInjectedFault))
+			}
+
+			failures = append(failures, err != nil)
+		}
+
+		return failures
+	}
+
+	failures := getFailures(1)
+	require.Contains(t, failures, true)
+	require.Contains(t, failures, false)
+	require.Equal(t, failures, getFailures(1))
+
+	SetDownloadFaults(DownloadFaults{Delay: 100 * time.Millisecond})
+
+	start := time.Now()
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
@@ -43,7 +43,7 @@ func (s *fedora) Run() error {
 	s.logger.WithField("file", filepath.Join(fpath, fname)).Info("Unpacking image")
 
 	// Unpack the base image
-	err = shared.Unpack(filepath.Join(fpath, fname), s.rootfsDir)
+	err = shared.Unpack(s.ctx, filepath.Join(fpath, fname), s.rootfsDir)
 	if err != nil {
 		return fmt.Errorf("Failed to unpack %q: %w", filepath.Join(fpath, fname), err)
 	}
@@ -95,7 +95,7 @@ func (s *fedora) unpackLayers(rootfsDir string) error {
 		for _, layer := range manifest.Layers {
 			s.logger.WithField("file", filepath.Join(rootfsDir, layer)).Info("Unpacking layer")
 
-			err := shared.Unpack(filepath.Join(rootfsDir, layer), rootfsDir)
+			err := shared.Unpack(s.ctx, filepath.Join(rootfsDir, layer), rootfsDir)
 			if err != nil {
 				return fmt.Errorf("Failed to unpack %q: %w", filepath.Join(rootfsDir, layer), err)
 			}
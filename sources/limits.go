@@ -0,0 +1,186 @@
+package sources
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DownloadLimits are the caps applied per host to the downloads of the
+// downloaders, so builds don't get blocked by the mirrors of a distribution.
+type DownloadLimits struct {
+	// MaxConnections is the number of concurrent requests to a host.
+	MaxConnections int
+
+	// MaxRate is the number of bytes per second read from a host.
+	MaxRate int64
+}
+
+// hostLimiter limits the requests to a single host. All downloads of the
+// process share it.
+type hostLimiter struct {
+	conns chan struct{}
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+var downloadLimits DownloadLimits
+var hostLimiters = map[string]*hostLimiter{}
+var hostLimitersLock sync.Mutex
+
+// SetDownloadLimits sets the limits of all downloads of the process, including
+// the ones using the default HTTP client.
+func SetDownloadLimits(limits DownloadLimits) {
+	hostLimitersLock.Lock()
+	downloadLimits = limits
+	hostLimiters = map[string]*hostLimiter{}
+	hostLimitersLock.Unlock()
+
+	http.DefaultClient.Transport = &limitedTransport{base: http.DefaultTransport}
+}
+
+// getHostLimiter returns the limiter of the given host.
+func getHostLimiter(host string) *hostLimiter {
+	hostLimitersLock.Lock()
+	defer hostLimitersLock.Unlock()
+
+	l, ok := hostLimiters[host]
+	if !ok {
+		l = &hostLimiter{}
+
+		if downloadLimits.MaxConnections > 0 {
+			l.conns = make(chan struct{}, downloadLimits.MaxConnections)
+		}
+
+		hostLimiters[host] = l
+	}
+
+	return l
+}
+
+// acquire waits for a free connection slot of the host.
+func (l *hostLimiter) acquire(ctx context.Context) error {
+	if l.conns == nil {
+		return nil
+	}
+
+	select {
+	case l.conns <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the connection slot taken by acquire.
+func (l *hostLimiter) release() {
+	if l.conns != nil {
+		<-l.conns
+	}
+}
+
+// wait blocks until n more bytes may be read from the host at the given rate.
+func (l *hostLimiter) wait(ctx context.Context, n int, rate int64) error {
+	l.mu.Lock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	delay := l.next.Sub(now)
+
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedTransport applies the download limits to the requests of base.
+type limitedTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := injectDownloadFault(req)
+	if err != nil {
+		return nil, err
+	}
+
+	hostLimitersLock.Lock()
+	limits := downloadLimits
+	hostLimitersLock.Unlock()
+
+	if limits.MaxConnections <= 0 && limits.MaxRate <= 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	l := getHostLimiter(req.URL.Host)
+
+	err = l.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+
+	// The connection slot is taken until the body has been read.
+	resp.Body = &limitedBody{body: resp.Body, ctx: req.Context(), limiter: l, rate: limits.MaxRate}
+
+	return resp, nil
+}
+
+// limitedBody is the body of a response of limitedTransport.
+type limitedBody struct {
+	body     io.ReadCloser
+	ctx      context.Context
+	limiter  *hostLimiter
+	rate     int64
+	released sync.Once
+}
+
+// Read implements io.Reader.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// Read in chunks of at most a tenth of a second, so the rate is smooth.
+	if b.rate > 0 && int64(len(p)) > b.rate/10+1 {
+		p = p[:b.rate/10+1]
+	}
+
+	n, err := b.body.Read(p)
+
+	if n > 0 && b.rate > 0 {
+		waitErr := b.limiter.wait(b.ctx, n, b.rate)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+// Close implements io.Closer.
+func (b *limitedBody) Close() error {
+	b.released.Do(b.limiter.release)
+
+	return b.body.Close()
+}
@@ -0,0 +1,67 @@
+package sources
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitedTransport(t *testing.T) {
+	var active, maxActive int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+
+		for {
+			current := atomic.LoadInt32(&maxActive)
+			if n <= current || atomic.CompareAndSwapInt32(&maxActive, current, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		_, _ = io.WriteString(w, strings.Repeat("x", 1000))
+	}))
+
+	defer server.Close()
+
+	SetDownloadLimits(DownloadLimits{MaxConnections: 2, MaxRate: 10000})
+	defer SetDownloadLimits(DownloadLimits{})
+
+	client := &http.Client{Transport: &limitedTransport{base: http.DefaultTransport}}
+
+	var wg sync.WaitGroup
+
+	start := time.Now()
+
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			resp, err := client.Get(server.URL)
+			require.NoError(t, err)
+
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Len(t, body, 1000)
+		}()
+	}
+
+	wg.Wait()
+
+	// The 6000 bytes take at least half a second at 10000 bytes per second.
+	require.LessOrEqual(t, atomic.LoadInt32(&maxActive), int32(2))
+	require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+}
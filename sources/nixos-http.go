@@ -25,7 +25,7 @@ func (s *nixos) Run() error {
 		return fmt.Errorf("Failed downloading tarball: %w", err)
 	}
 
-	err = shared.Unpack(filepath.Join(fpath, "system-tarball"), s.rootfsDir)
+	err = shared.Unpack(s.ctx, filepath.Join(fpath, "system-tarball"), s.rootfsDir)
 	if err != nil {
 		return fmt.Errorf("Failed unpacking rootfs: %w", err)
 	}
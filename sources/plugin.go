@@ -0,0 +1,30 @@
+package sources
+
+import (
+	"github.com/canonical/lxd-imagebuilder/plugins"
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// plugin is a downloader provided by a plugin binary.
+type plugin struct {
+	common
+
+	plugin shared.DefinitionPlugin
+}
+
+// Run runs the Source.Run method of the plugin.
+func (s *plugin) Run() error {
+	definition, err := plugins.MarshalDefinition(s.definition)
+	if err != nil {
+		return err
+	}
+
+	args := plugins.SourceArgs{
+		Definition: definition,
+		RootfsDir:  s.rootfsDir,
+		CacheDir:   s.cacheDir,
+		SourcesDir: s.sourcesDir,
+	}
+
+	return plugins.Call(s.ctx, s.logger, s.plugin, "Source.Run", args, &plugins.Empty{})
+}
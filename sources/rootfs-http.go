@@ -39,7 +39,7 @@ func (s *rootfs) Run() error {
 	s.logger.WithField("file", filepath.Join(fpath, filename)).Info("Unpacking image")
 
 	// Unpack
-	err = shared.Unpack(filepath.Join(fpath, filename), s.rootfsDir)
+	err = shared.Unpack(s.ctx, filepath.Join(fpath, filename), s.rootfsDir)
 	if err != nil {
 		return fmt.Errorf("Failed to unpack %q: %w", filepath.Join(fpath, filename), err)
 	}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/canonical/lxd-imagebuilder/plugins"
 	"github.com/canonical/lxd-imagebuilder/shared"
 )
 
@@ -54,12 +55,19 @@ var downloaders = map[string]func() downloader{
 
 // Load loads and initializes a downloader.
 func Load(ctx context.Context, downloaderName string, logger *logrus.Logger, definition shared.Definition, rootfsDir string, cacheDir string, sourcesDir string) (Downloader, error) {
+	var d downloader
+
 	df, ok := downloaders[downloaderName]
-	if !ok {
-		return nil, ErrUnknownDownloader
-	}
+	if ok {
+		d = df()
+	} else {
+		p := definition.GetPlugin(plugins.TypeSource, downloaderName)
+		if p == nil {
+			return nil, ErrUnknownDownloader
+		}
 
-	d := df()
+		d = &plugin{plugin: *p}
+	}
 
 	d.init(ctx, logger, definition, rootfsDir, cacheDir, sourcesDir)
 
@@ -117,7 +117,7 @@ func (s ubuntu) unpack(filePath, rootDir string) error {
 
 	s.logger.WithField("file", filePath).Info("Unpacking image")
 
-	err = shared.Unpack(filePath, rootDir)
+	err = shared.Unpack(s.ctx, filePath, rootDir)
 	if err != nil {
 		return fmt.Errorf("Failed to unpack %q: %w", filePath, err)
 	}